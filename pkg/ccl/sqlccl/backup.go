@@ -501,7 +501,8 @@ func backup(
 	maxConcurrentExports := clusterNodeCount(gossip) * storageccl.ExportRequestLimit
 	exportsSem := make(chan struct{}, maxConcurrentExports)
 
-	header := roachpb.Header{Timestamp: backupDesc.EndTime}
+	// Exports run strictly below foreground traffic.
+	header := roachpb.Header{Timestamp: backupDesc.EndTime, QoSClass: roachpb.QOS_BACKGROUND}
 	g, gCtx := errgroup.WithContext(ctx)
 	for i := range spans {
 		select {
@@ -120,6 +120,10 @@ func doLocalCSVTransform(
 		}
 	}()
 
+	// The DEFAULT expressions are evaluated as if all the records were
+	// inserted at the start of the transform.
+	walltime := timeutil.Now().UnixNano()
+
 	group, gCtx := errgroup.WithContext(ctx)
 	recordCh := make(chan csvRecord, chanSize)
 	kvCh := make(chan roachpb.KeyValue, chanSize)
@@ -127,13 +131,13 @@ func doLocalCSVTransform(
 	group.Go(func() error {
 		defer close(recordCh)
 		var err error
-		csvCount, err = readCSV(gCtx, comma, comment, len(tableDesc.VisibleColumns()), dataFiles, recordCh)
+		csvCount, err = readCSV(gCtx, comma, comment, len(csvInputColumns(tableDesc)), dataFiles, recordCh)
 		return err
 	})
 	group.Go(func() error {
 		defer close(kvCh)
 		return groupWorkers(gCtx, runtime.NumCPU(), func(ctx context.Context) error {
-			return convertRecord(ctx, recordCh, kvCh, nullif, tableDesc)
+			return convertRecord(ctx, recordCh, kvCh, nullif, tableDesc, walltime)
 		})
 	})
 	group.Go(func() error {
@@ -216,14 +220,21 @@ func makeCSVTableDescriptor(
 		return nil, err
 	}
 
-	visibleCols := tableDesc.VisibleColumns()
-	for _, col := range visibleCols {
-		if col.DefaultExpr != nil {
-			return nil, errors.Errorf("column %q: DEFAULT expression unsupported", col.Name)
+	return &tableDesc, nil
+}
+
+// csvInputColumns returns the columns of the table whose values are read from
+// the CSV records, in the order of the fields of the records: the visible
+// columns without a DEFAULT expression. The columns with a DEFAULT expression
+// are filled in by evaluating it for each record.
+func csvInputColumns(tableDesc *sqlbase.TableDescriptor) []sqlbase.ColumnDescriptor {
+	var cols []sqlbase.ColumnDescriptor
+	for _, col := range tableDesc.VisibleColumns() {
+		if col.DefaultExpr == nil {
+			cols = append(cols, col)
 		}
 	}
-
-	return &tableDesc, nil
+	return cols
 }
 
 // groupWorkers creates num worker go routines in an error group.
@@ -322,21 +333,25 @@ type csvRecord struct {
 }
 
 // convertRecord converts CSV records KV pairs and sends them on the kvCh chan.
+// The records hold the values of the input columns of the table (see
+// csvInputColumns); the DEFAULT expressions of the other columns are evaluated
+// with walltime (in nanoseconds) as the statement and transaction timestamp.
 func convertRecord(
 	ctx context.Context,
 	recordCh <-chan csvRecord,
 	kvCh chan<- roachpb.KeyValue,
 	nullif *string,
 	tableDesc *sqlbase.TableDescriptor,
+	walltime int64,
 ) error {
 	done := ctx.Done()
 
-	visibleCols := tableDesc.VisibleColumns()
+	inputCols := csvInputColumns(tableDesc)
 	keyDatums := make(sqlbase.EncDatumRow, len(tableDesc.PrimaryIndex.ColumnIDs))
 	// keyDatumIdx maps ColumnIDs to indexes in keyDatums.
 	keyDatumIdx := make(map[sqlbase.ColumnID]int)
 	for _, id := range tableDesc.PrimaryIndex.ColumnIDs {
-		for _, col := range visibleCols {
+		for _, col := range inputCols {
 			if col.ID == id {
 				keyDatumIdx[id] = len(keyDatumIdx)
 				break
@@ -344,36 +359,39 @@ func convertRecord(
 		}
 	}
 
-	ri, err := sqlbase.MakeRowInserter(nil /* txn */, tableDesc, nil, /* fkTables */
-		tableDesc.Columns, false /* checkFKs */, &sqlbase.DatumAlloc{})
-	if err != nil {
-		return errors.Wrap(err, "make row inserter")
-	}
-
 	parse := parser.Parser{}
 	evalCtx := parser.EvalContext{}
-	// Although we don't yet support DEFAULT expressions on visible columns,
-	// we do on hidden columns (which is only the default _rowid one). This
-	// allows those expressions to run.
-	cols, defaultExprs, err := sqlbase.ProcessDefaultColumns(tableDesc.Columns, tableDesc, &parse, &evalCtx)
+	ts := time.Unix(0, walltime)
+	evalCtx.SetTxnTimestamp(ts)
+	evalCtx.SetStmtTimestamp(ts)
+	// The columns which are not read from the records are the ones with a
+	// DEFAULT expression (including the hidden rowid column); they follow the
+	// input columns.
+	cols, defaultExprs, err := sqlbase.ProcessDefaultColumns(inputCols, tableDesc, &parse, &evalCtx)
 	if err != nil {
 		return errors.Wrap(err, "process default columns")
 	}
 
-	datums := make([]parser.Datum, len(visibleCols))
+	ri, err := sqlbase.MakeRowInserter(nil /* txn */, tableDesc, nil, /* fkTables */
+		cols, false /* checkFKs */, &sqlbase.DatumAlloc{})
+	if err != nil {
+		return errors.Wrap(err, "make row inserter")
+	}
+
+	datums := make([]parser.Datum, len(inputCols))
 	var insertErr error
 	for record := range recordCh {
 		for i, r := range record.r {
 			if nullif != nil && r == *nullif {
 				datums[i] = parser.DNull
 			} else {
-				datums[i], err = parser.ParseStringAs(visibleCols[i].Type.ToDatumType(), r, time.UTC)
+				datums[i], err = parser.ParseStringAs(inputCols[i].Type.ToDatumType(), r, time.UTC)
 				if err != nil {
-					return errors.Wrapf(err, "%s: row %d: parse %q as %s", record.file, record.row, visibleCols[i].Name, visibleCols[i].Type.SQLString())
+					return errors.Wrapf(err, "%s: row %d: parse %q as %s", record.file, record.row, inputCols[i].Name, inputCols[i].Type.SQLString())
 				}
 			}
-			if idx, ok := keyDatumIdx[visibleCols[i].ID]; ok {
-				keyDatums[idx] = sqlbase.DatumToEncDatum(visibleCols[i].Type, datums[i])
+			if idx, ok := keyDatumIdx[inputCols[i].ID]; ok {
+				keyDatums[idx] = sqlbase.DatumToEncDatum(inputCols[i].Type, datums[i])
 			}
 		}
 
@@ -795,6 +813,7 @@ func newReadCSVProcessor(
 	flowCtx *distsqlrun.FlowCtx, spec distsqlrun.ReadCSVSpec, output distsqlrun.RowReceiver,
 ) (distsqlrun.Processor, error) {
 	cp := &readCSVProcessor{
+		walltime:   timeutil.Now().UnixNano(),
 		comma:      spec.Comma,
 		comment:    spec.Comment,
 		nullif:     spec.Nullif,
@@ -810,6 +829,8 @@ func newReadCSVProcessor(
 }
 
 type readCSVProcessor struct {
+	// walltime is the timestamp used to evaluate DEFAULT expressions.
+	walltime   int64
 	comma      rune
 	comment    rune
 	nullif     *string
@@ -840,14 +861,14 @@ func (cp *readCSVProcessor) Run(ctx context.Context, wg *sync.WaitGroup) {
 	// Read CSV into CSV records
 	group.Go(func() error {
 		defer close(recordCh)
-		_, err := readCSV(gCtx, cp.comma, cp.comment, len(cp.tableDesc.VisibleColumns()), []string{cp.uri}, recordCh)
+		_, err := readCSV(gCtx, cp.comma, cp.comment, len(csvInputColumns(&cp.tableDesc)), []string{cp.uri}, recordCh)
 		return err
 	})
 	// Convert CSV records to KVs
 	group.Go(func() error {
 		defer close(kvCh)
 		return groupWorkers(gCtx, runtime.NumCPU(), func(ctx context.Context) error {
-			return convertRecord(ctx, recordCh, kvCh, cp.nullif, &cp.tableDesc)
+			return convertRecord(ctx, recordCh, kvCh, cp.nullif, &cp.tableDesc, cp.walltime)
 		})
 	})
 	// Sample KVs
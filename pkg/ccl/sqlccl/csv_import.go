@@ -0,0 +1,505 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package sqlccl
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/cockroachdb/cockroach/pkg/ccl/storageccl"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/distsqlrun"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// This file contains the processors of a distributed IMPORT: a csvReader reads
+// CSV files into rows of strings, a csvConverter converts these rows to the
+// KVs of a table and a kvWriter ingests the KVs into the ranges containing
+// them.
+
+var (
+	csvStringType = sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	csvIntType    = sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+)
+
+// defaultKVWriterBatchSize is the size of the batches of KVs of a kvWriter
+// whose spec doesn't specify one.
+const defaultKVWriterBatchSize = 32 << 20 // 32MB
+
+var kvWriterOutputTypes = []sqlbase.ColumnType{
+	csvIntType, // kvs
+	csvIntType, // bytes
+}
+
+func newCSVReaderProcessor(
+	flowCtx *distsqlrun.FlowCtx,
+	spec distsqlrun.CSVReaderSpec,
+	post *distsqlrun.PostProcessSpec,
+	output distsqlrun.RowReceiver,
+) (distsqlrun.Processor, error) {
+	if spec.NumColumns == 0 {
+		return nil, errors.New("CSVReader requires at least one column")
+	}
+	r := &csvReader{
+		spec:     spec,
+		outTypes: make([]sqlbase.ColumnType, spec.NumColumns+2),
+		output:   output,
+	}
+	for i := range r.outTypes {
+		r.outTypes[i] = csvStringType
+	}
+	// The record number.
+	r.outTypes[spec.NumColumns+1] = csvIntType
+	if err := r.out.Init(post, r.outTypes, &flowCtx.EvalCtx, output); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// csvReader reads CSV files and produces a row per record. See
+// distsqlrun.CSVReaderSpec.
+type csvReader struct {
+	spec     distsqlrun.CSVReaderSpec
+	outTypes []sqlbase.ColumnType
+	out      distsqlrun.ProcOutputHelper
+	output   distsqlrun.RowReceiver
+}
+
+var _ distsqlrun.Processor = &csvReader{}
+
+func (r *csvReader) OutputTypes() []sqlbase.ColumnType {
+	return r.outTypes
+}
+
+func (r *csvReader) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "CSVReader", nil)
+	ctx, span := tracing.ChildSpan(ctx, "csv reader")
+	defer tracing.FinishSpan(span)
+
+	group, gCtx := errgroup.WithContext(ctx)
+	recordCh := make(chan csvRecord)
+	// Read the CSV files into records.
+	group.Go(func() error {
+		defer close(recordCh)
+		_, err := readCSV(gCtx, rune(r.spec.Comma), rune(r.spec.Comment),
+			int(r.spec.NumColumns), r.spec.Uris, recordCh)
+		return err
+	})
+	// Send the records.
+	group.Go(func() error {
+		numCols := int(r.spec.NumColumns)
+		row := make(sqlbase.EncDatumRow, len(r.outTypes))
+		for record := range recordCh {
+			for i, field := range record.r {
+				row[i] = sqlbase.DatumToEncDatum(csvStringType, parser.NewDString(field))
+			}
+			row[numCols] = sqlbase.DatumToEncDatum(csvStringType, parser.NewDString(record.file))
+			row[numCols+1] = sqlbase.DatumToEncDatum(csvIntType, parser.NewDInt(parser.DInt(record.row)))
+			cs, err := r.out.EmitRow(gCtx, row)
+			if err != nil {
+				return err
+			}
+			if cs != distsqlrun.NeedMoreRows {
+				return errors.New("unexpected closure of consumer")
+			}
+		}
+		return nil
+	})
+	if err := group.Wait(); err != nil {
+		distsqlrun.DrainAndClose(ctx, r.output, err)
+		return
+	}
+	r.out.Close()
+}
+
+func newCSVConverterProcessor(
+	flowCtx *distsqlrun.FlowCtx,
+	spec distsqlrun.CSVConverterSpec,
+	input distsqlrun.RowSource,
+	post *distsqlrun.PostProcessSpec,
+	output distsqlrun.RowReceiver,
+) (distsqlrun.Processor, error) {
+	// The input has a column per input column of the table (see
+	// csvInputColumns), followed by the file and the record number.
+	numCols := len(csvInputColumns(&spec.TableDesc))
+	types := input.Types()
+	if len(types) != numCols+2 {
+		return nil, errors.Errorf("CSVConverter input has %d columns, expected %d", len(types), numCols+2)
+	}
+	for i, t := range types[:numCols+1] {
+		if t.SemanticType != sqlbase.ColumnType_STRING {
+			return nil, errors.Errorf("CSVConverter input column %d has type %s, expected STRING", i, t.SemanticType)
+		}
+	}
+	if t := types[numCols+1]; t.SemanticType != sqlbase.ColumnType_INT {
+		return nil, errors.Errorf("CSVConverter input column %d has type %s, expected INT", numCols+1, t.SemanticType)
+	}
+
+	c := &csvConverter{
+		spec:     spec,
+		input:    input,
+		numCols:  numCols,
+		output:   output,
+		walltime: spec.Walltime,
+	}
+	if c.walltime == 0 {
+		c.walltime = timeutil.Now().UnixNano()
+	}
+	if err := c.out.Init(post, csvOutputTypes, &flowCtx.EvalCtx, output); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// csvConverter converts the records produced by a csvReader to KVs. See
+// distsqlrun.CSVConverterSpec.
+type csvConverter struct {
+	spec    distsqlrun.CSVConverterSpec
+	input   distsqlrun.RowSource
+	numCols int
+	out     distsqlrun.ProcOutputHelper
+	output  distsqlrun.RowReceiver
+	// walltime is the timestamp used to evaluate DEFAULT expressions.
+	walltime int64
+
+	alloc sqlbase.DatumAlloc
+}
+
+var _ distsqlrun.Processor = &csvConverter{}
+
+func (c *csvConverter) OutputTypes() []sqlbase.ColumnType {
+	return csvOutputTypes
+}
+
+func (c *csvConverter) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTagInt(ctx, "CSVConverter", int(c.spec.TableDesc.ID))
+	ctx, span := tracing.ChildSpan(ctx, "csv converter")
+	defer tracing.FinishSpan(span)
+
+	group, gCtx := errgroup.WithContext(ctx)
+	recordCh := make(chan csvRecord)
+	kvCh := make(chan roachpb.KeyValue)
+	// Read the records from the input.
+	group.Go(func() error {
+		defer close(recordCh)
+		return c.readRecords(gCtx, recordCh)
+	})
+	// Convert the records to KVs.
+	group.Go(func() error {
+		defer close(kvCh)
+		return convertRecord(gCtx, recordCh, kvCh, c.spec.Nullif, &c.spec.TableDesc, c.walltime)
+	})
+	// Send the KVs.
+	group.Go(func() error {
+		row := make(sqlbase.EncDatumRow, len(csvOutputTypes))
+		for kv := range kvCh {
+			row[0] = sqlbase.DatumToEncDatum(csvOutputTypes[0], parser.NewDBytes(parser.DBytes(kv.Key)))
+			row[1] = sqlbase.DatumToEncDatum(csvOutputTypes[1], parser.NewDBytes(parser.DBytes(kv.Value.RawBytes)))
+			cs, err := c.out.EmitRow(gCtx, row)
+			if err != nil {
+				return err
+			}
+			if cs != distsqlrun.NeedMoreRows {
+				return errors.New("unexpected closure of consumer")
+			}
+		}
+		return nil
+	})
+	if err := group.Wait(); err != nil {
+		distsqlrun.DrainAndClose(ctx, c.output, err, c.input)
+		return
+	}
+	c.input.ConsumerClosed()
+	c.out.Close()
+}
+
+// readRecords sends the records of the input rows on recordCh. Metadata is
+// forwarded to the output.
+func (c *csvConverter) readRecords(ctx context.Context, recordCh chan<- csvRecord) error {
+	for {
+		row, meta := c.input.Next()
+		if !meta.Empty() {
+			if meta.Err != nil {
+				return meta.Err
+			}
+			if cs := c.output.Push(nil /* row */, meta); cs != distsqlrun.NeedMoreRows {
+				return errors.New("unexpected closure of consumer")
+			}
+			continue
+		}
+		if row == nil {
+			return nil
+		}
+
+		for i := range row {
+			if err := row[i].EnsureDecoded(&c.alloc); err != nil {
+				return err
+			}
+			if row[i].Datum == parser.DNull {
+				return errors.Errorf("NULL value in CSV record %s", row)
+			}
+		}
+		record := csvRecord{
+			r:    make([]string, c.numCols),
+			file: string(*row[c.numCols].Datum.(*parser.DString)),
+			row:  int(*row[c.numCols+1].Datum.(*parser.DInt)),
+		}
+		for i := range record.r {
+			record.r[i] = string(*row[i].Datum.(*parser.DString))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case recordCh <- record:
+		}
+	}
+}
+
+func newKVWriterProcessor(
+	flowCtx *distsqlrun.FlowCtx,
+	spec distsqlrun.KVWriterSpec,
+	input distsqlrun.RowSource,
+	post *distsqlrun.PostProcessSpec,
+	output distsqlrun.RowReceiver,
+) (distsqlrun.Processor, error) {
+	types := input.Types()
+	if len(types) != 2 ||
+		types[0].SemanticType != sqlbase.ColumnType_BYTES ||
+		types[1].SemanticType != sqlbase.ColumnType_BYTES {
+		return nil, errors.Errorf("KVWriter input must have two BYTES columns, got %v", types)
+	}
+	if (spec.Timestamp == hlc.Timestamp{}) {
+		return nil, errors.New("KVWriter requires a timestamp")
+	}
+	if spec.BatchSize == 0 {
+		spec.BatchSize = defaultKVWriterBatchSize
+	}
+	w := &kvWriter{
+		db:     flowCtx.ClientDB,
+		spec:   spec,
+		input:  input,
+		output: output,
+	}
+	if err := w.out.Init(post, kvWriterOutputTypes, &flowCtx.EvalCtx, output); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// kvWriter ingests KVs into the ranges containing them. See
+// distsqlrun.KVWriterSpec.
+type kvWriter struct {
+	db     *client.DB
+	spec   distsqlrun.KVWriterSpec
+	input  distsqlrun.RowSource
+	out    distsqlrun.ProcOutputHelper
+	output distsqlrun.RowReceiver
+
+	alloc sqlbase.DatumAlloc
+}
+
+var _ distsqlrun.Processor = &kvWriter{}
+
+func (w *kvWriter) OutputTypes() []sqlbase.ColumnType {
+	return kvWriterOutputTypes
+}
+
+func (w *kvWriter) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "KVWriter", nil)
+	ctx, span := tracing.ChildSpan(ctx, "kv writer")
+	defer tracing.FinishSpan(span)
+
+	if err := w.mainLoop(ctx); err != nil {
+		distsqlrun.DrainAndClose(ctx, w.output, err, w.input)
+		return
+	}
+	w.input.ConsumerClosed()
+	w.out.Close()
+}
+
+func (w *kvWriter) mainLoop(ctx context.Context) error {
+	var batch []roachpb.KeyValue
+	var batchSize, numKVs, numBytes int64
+	for {
+		row, meta := w.input.Next()
+		if !meta.Empty() {
+			if meta.Err != nil {
+				return meta.Err
+			}
+			if cs := w.output.Push(nil /* row */, meta); cs != distsqlrun.NeedMoreRows {
+				return errors.New("unexpected closure of consumer")
+			}
+			continue
+		}
+		if row == nil {
+			break
+		}
+
+		for i := range row {
+			if err := row[i].EnsureDecoded(&w.alloc); err != nil {
+				return err
+			}
+			if row[i].Datum == parser.DNull {
+				return errors.Errorf("NULL value in KV %s", row)
+			}
+		}
+		kv := roachpb.KeyValue{
+			Key: roachpb.Key(*row[0].Datum.(*parser.DBytes)),
+		}
+		kv.Value.RawBytes = []byte(*row[1].Datum.(*parser.DBytes))
+		batch = append(batch, kv)
+		batchSize += int64(len(kv.Key) + len(kv.Value.RawBytes))
+		if batchSize >= w.spec.BatchSize {
+			if err := w.ingest(ctx, batch); err != nil {
+				return err
+			}
+			numKVs += int64(len(batch))
+			numBytes += batchSize
+			batch = batch[:0]
+			batchSize = 0
+		}
+	}
+	if len(batch) > 0 {
+		if err := w.ingest(ctx, batch); err != nil {
+			return err
+		}
+		numKVs += int64(len(batch))
+		numBytes += batchSize
+	}
+
+	row := sqlbase.EncDatumRow{
+		sqlbase.DatumToEncDatum(csvIntType, parser.NewDInt(parser.DInt(numKVs))),
+		sqlbase.DatumToEncDatum(csvIntType, parser.NewDInt(parser.DInt(numBytes))),
+	}
+	if cs, err := w.out.EmitRow(ctx, row); err != nil {
+		return err
+	} else if cs != distsqlrun.NeedMoreRows {
+		return errors.New("unexpected closure of consumer")
+	}
+	return nil
+}
+
+// ingest sorts the KVs and sends an sstable with the KVs of each range they
+// belong to.
+func (w *kvWriter) ingest(ctx context.Context, kvs []roachpb.KeyValue) error {
+	sort.Slice(kvs, func(i, j int) bool {
+		return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0
+	})
+	for i := 1; i < len(kvs); i++ {
+		if kvs[i].Key.Equal(kvs[i-1].Key) {
+			return errors.Errorf("duplicate key: %s", kvs[i].Key)
+		}
+	}
+
+	for i := 0; i < len(kvs); {
+		desc, err := w.lookupRange(ctx, kvs[i].Key)
+		if err != nil {
+			return err
+		}
+		j, err := w.ingestRange(ctx, desc, kvs[i:])
+		if err != nil {
+			return err
+		}
+		i += j
+	}
+	return nil
+}
+
+// ingestRange sends an sstable with the first KVs which belong to the given
+// range and returns their number.
+func (w *kvWriter) ingestRange(
+	ctx context.Context, desc roachpb.RangeDescriptor, kvs []roachpb.KeyValue,
+) (int, error) {
+	sst, err := engine.MakeRocksDBSstFileWriter()
+	if err != nil {
+		return 0, err
+	}
+	defer sst.Close()
+
+	n := 0
+	for ; n < len(kvs); n++ {
+		addr, err := keys.Addr(kvs[n].Key)
+		if err != nil {
+			return 0, err
+		}
+		if !desc.ContainsKey(addr) {
+			break
+		}
+		if err := sst.Add(engine.MVCCKeyValue{
+			Key:   engine.MVCCKey{Key: kvs[n].Key, Timestamp: w.spec.Timestamp},
+			Value: kvs[n].Value.RawBytes,
+		}); err != nil {
+			return 0, err
+		}
+	}
+	if n == 0 {
+		return 0, errors.Errorf("key %s not in range %s", kvs[0].Key, desc)
+	}
+
+	data, err := sst.Finish()
+	if err != nil {
+		return 0, err
+	}
+	start, end := kvs[0].Key, kvs[n-1].Key.Next()
+	log.VEventf(ctx, 2, "ingesting %d KVs in [%s,%s) into r%d", n, start, end, desc.RangeID)
+	return n, storageccl.AddSSTable(ctx, w.db, start, end, data)
+}
+
+// lookupRange returns the descriptor of the range containing the given key.
+func (w *kvWriter) lookupRange(ctx context.Context, key roachpb.Key) (roachpb.RangeDescriptor, error) {
+	var desc roachpb.RangeDescriptor
+	addr, err := keys.Addr(key)
+	if err != nil {
+		return desc, err
+	}
+	// Ranges are addressed by their end key in the meta ranges, so the range
+	// containing key is the first one whose end key is greater than key.
+	kvs, err := w.db.Scan(ctx, keys.RangeMetaKey(addr).Next(), keys.Meta2Prefix.PrefixEnd(), 1)
+	if err != nil {
+		return desc, err
+	}
+	if len(kvs) != 1 {
+		return desc, errors.Errorf("no range descriptor found for key %s", key)
+	}
+	if err := kvs[0].ValueProto(&desc); err != nil {
+		return desc, err
+	}
+	return desc, nil
+}
+
+func init() {
+	distsqlrun.NewCSVReaderProcessor = newCSVReaderProcessor
+	distsqlrun.NewCSVConverterProcessor = newCSVConverterProcessor
+	distsqlrun.NewKVWriterProcessor = newKVWriterProcessor
+}
@@ -0,0 +1,189 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package sqlccl
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/sql/distsqlrun"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// runProcessor runs a processor and checks that it closed its output.
+func runProcessor(
+	t *testing.T, p distsqlrun.Processor, err error, out *distsqlrun.RowBuffer,
+) {
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Run(context.Background(), nil)
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+}
+
+func TestCSVImportProcessors(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	s, db, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+	sqlDB := sqlutils.MakeSQLRunner(t, db)
+
+	sqlDB.Exec(`CREATE DATABASE d`)
+	sqlDB.Exec(`CREATE TABLE d.t (a INT PRIMARY KEY, b STRING, INDEX (b))`)
+	// Split the table so that the KVs are ingested into several ranges.
+	sqlDB.Exec(`ALTER TABLE d.t SPLIT AT VALUES (50)`)
+	tableDesc := sqlbase.GetTableDescriptor(kvDB, "d", "t")
+
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	const numRows = 100
+	var data bytes.Buffer
+	for i := 0; i < numRows; i++ {
+		fmt.Fprintf(&data, "%d,s%d\n", i, i)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "data.csv"), data.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := distsqlrun.FlowCtx{
+		Settings: s.ClusterSettings(),
+		EvalCtx:  evalCtx,
+		ClientDB: kvDB,
+	}
+	post := &distsqlrun.PostProcessSpec{}
+
+	// The RowBuffers receiving the output of a processor are used as the input
+	// of the next processor.
+	records := distsqlrun.NewRowBuffer(
+		[]sqlbase.ColumnType{csvStringType, csvStringType, csvStringType, csvIntType},
+		nil /* rows */, distsqlrun.RowBufferArgs{},
+	)
+	reader, err := newCSVReaderProcessor(&flowCtx, distsqlrun.CSVReaderSpec{
+		Uris:       []string{"nodelocal://" + filepath.Join(dir, "data.csv")},
+		NumColumns: 2,
+	}, post, records)
+	runProcessor(t, reader, err, records)
+
+	kvs := distsqlrun.NewRowBuffer(csvOutputTypes, nil /* rows */, distsqlrun.RowBufferArgs{})
+	converter, err := newCSVConverterProcessor(&flowCtx, distsqlrun.CSVConverterSpec{
+		TableDesc: *tableDesc,
+	}, records, post, kvs)
+	runProcessor(t, converter, err, kvs)
+
+	res := &distsqlrun.RowBuffer{}
+	// Use a small batch size to ingest the KVs in several batches.
+	writer, err := newKVWriterProcessor(&flowCtx, distsqlrun.KVWriterSpec{
+		BatchSize: 1000,
+		Timestamp: s.Clock().Now(),
+	}, kvs, post, res)
+	runProcessor(t, writer, err, res)
+
+	row, meta := res.Next()
+	if !meta.Empty() {
+		t.Fatalf("unexpected metadata: %v", meta)
+	}
+	// Each row has a KV in the primary index and one in the secondary index.
+	if row == nil || row[0].Datum.String() != fmt.Sprint(2*numRows) {
+		t.Fatalf("expected %d KVs to be written, got %v", 2*numRows, row)
+	}
+
+	var count, sum int
+	sqlDB.QueryRow(`SELECT COUNT(*), SUM(a) FROM d.t`).Scan(&count, &sum)
+	if count != numRows || sum != numRows*(numRows-1)/2 {
+		t.Fatalf("expected %d rows with sum %d, got %d rows with sum %d",
+			numRows, numRows*(numRows-1)/2, count, sum)
+	}
+	var b string
+	sqlDB.QueryRow(`SELECT b FROM d.t@t_b_idx WHERE b = 's42'`).Scan(&b)
+	if b != "s42" {
+		t.Fatalf("expected s42, got %s", b)
+	}
+}
+
+func TestCSVConverterDefaultExprs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	s, db, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+	sqlDB := sqlutils.MakeSQLRunner(t, db)
+
+	sqlDB.Exec(`CREATE DATABASE d`)
+	sqlDB.Exec(`CREATE TABLE d.t (
+		a INT PRIMARY KEY,
+		b STRING DEFAULT 'default',
+		c INT DEFAULT unique_rowid(),
+		d TIMESTAMP DEFAULT now()
+	)`)
+	tableDesc := sqlbase.GetTableDescriptor(kvDB, "d", "t")
+
+	// Only the column without a DEFAULT expression is read from the records.
+	const numRows = 10
+	var records sqlbase.EncDatumRows
+	for i := 0; i < numRows; i++ {
+		records = append(records, sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(csvStringType, parser.NewDString(fmt.Sprint(i))),
+			sqlbase.DatumToEncDatum(csvStringType, parser.NewDString("data.csv")),
+			sqlbase.DatumToEncDatum(csvIntType, parser.NewDInt(parser.DInt(i+1))),
+		})
+	}
+	in := distsqlrun.NewRowBuffer(
+		[]sqlbase.ColumnType{csvStringType, csvStringType, csvIntType}, records,
+		distsqlrun.RowBufferArgs{},
+	)
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := distsqlrun.FlowCtx{
+		Settings: s.ClusterSettings(),
+		EvalCtx:  evalCtx,
+		ClientDB: kvDB,
+	}
+	post := &distsqlrun.PostProcessSpec{}
+
+	walltime := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	kvs := distsqlrun.NewRowBuffer(csvOutputTypes, nil /* rows */, distsqlrun.RowBufferArgs{})
+	converter, err := newCSVConverterProcessor(&flowCtx, distsqlrun.CSVConverterSpec{
+		TableDesc: *tableDesc,
+		Walltime:  walltime.UnixNano(),
+	}, in, post, kvs)
+	runProcessor(t, converter, err, kvs)
+
+	res := &distsqlrun.RowBuffer{}
+	writer, err := newKVWriterProcessor(&flowCtx, distsqlrun.KVWriterSpec{
+		Timestamp: s.Clock().Now(),
+	}, kvs, post, res)
+	runProcessor(t, writer, err, res)
+
+	var count, distinctC int
+	sqlDB.QueryRow(
+		`SELECT COUNT(*), COUNT(DISTINCT c) FROM d.t WHERE b = 'default' AND d = $1`, walltime,
+	).Scan(&count, &distinctC)
+	if count != numRows || distinctC != numRows {
+		t.Fatalf("expected %d rows with default values and distinct rowids, got %d rows and %d rowids",
+			numRows, count, distinctC)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package sqlccl
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/ccl/storageccl"
+	"github.com/cockroachdb/cockroach/pkg/sql/distsqlrun"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// csvWriterPartPlaceholder is replaced in the name pattern of a CSVWriterSpec
+// by a name unique to each file written.
+const csvWriterPartPlaceholder = "%part%"
+
+var csvWriterOutputTypes = []sqlbase.ColumnType{
+	{SemanticType: sqlbase.ColumnType_STRING}, // filename
+	{SemanticType: sqlbase.ColumnType_INT},    // rows
+	{SemanticType: sqlbase.ColumnType_INT},    // bytes
+}
+
+func newCSVWriterProcessor(
+	flowCtx *distsqlrun.FlowCtx,
+	spec distsqlrun.CSVWriterSpec,
+	input distsqlrun.RowSource,
+	post *distsqlrun.PostProcessSpec,
+	output distsqlrun.RowReceiver,
+) (distsqlrun.Processor, error) {
+	if !strings.Contains(spec.NamePattern, csvWriterPartPlaceholder) {
+		return nil, errors.Errorf("name pattern %q must contain %s", spec.NamePattern, csvWriterPartPlaceholder)
+	}
+	if spec.ChunkRows < 0 || spec.ChunkSize < 0 {
+		return nil, errors.Errorf("invalid chunk limits: %d rows, %d bytes", spec.ChunkRows, spec.ChunkSize)
+	}
+	sp := &csvWriter{
+		flowCtx: flowCtx,
+		spec:    spec,
+		input:   input,
+		output:  output,
+	}
+	if err := sp.out.Init(post, csvWriterOutputTypes, &flowCtx.EvalCtx, output); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// csvWriter writes its input rows to CSV files in an ExportStorage and
+// produces a row per file written. See distsqlrun.CSVWriterSpec.
+type csvWriter struct {
+	flowCtx *distsqlrun.FlowCtx
+	spec    distsqlrun.CSVWriterSpec
+	input   distsqlrun.RowSource
+	out     distsqlrun.ProcOutputHelper
+	output  distsqlrun.RowReceiver
+}
+
+var _ distsqlrun.Processor = &csvWriter{}
+
+func (sp *csvWriter) OutputTypes() []sqlbase.ColumnType {
+	return csvWriterOutputTypes
+}
+
+func (sp *csvWriter) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "CSVWriter", nil)
+	ctx, span := tracing.ChildSpan(ctx, "csv writer")
+	defer tracing.FinishSpan(span)
+
+	if err := sp.mainLoop(ctx); err != nil {
+		distsqlrun.DrainAndClose(ctx, sp.output, err, sp.input)
+		return
+	}
+	sp.input.ConsumerClosed()
+	sp.out.Close()
+}
+
+func (sp *csvWriter) mainLoop(ctx context.Context) error {
+	conf, err := storageccl.ExportStorageConfFromURI(sp.spec.Destination)
+	if err != nil {
+		return err
+	}
+	es, err := storageccl.MakeExportStorage(ctx, conf)
+	if err != nil {
+		return err
+	}
+	defer es.Close()
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	if sp.spec.Delimiter != 0 {
+		writer.Comma = rune(sp.spec.Delimiter)
+	}
+	types := sp.input.Types()
+	record := make([]string, len(types))
+	var alloc sqlbase.DatumAlloc
+
+	chunk := 0
+	rows := int64(0)
+	// flush writes the buffered rows to a new file and emits its summary row.
+	flush := func() error {
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+		part := fmt.Sprintf("n%d.%d", sp.flowCtx.EvalCtx.NodeID, chunk)
+		filename := strings.Replace(sp.spec.NamePattern, csvWriterPartPlaceholder, part, -1)
+		size := buf.Len()
+		if err := es.WriteFile(ctx, filename, bytes.NewReader(buf.Bytes())); err != nil {
+			return errors.Wrapf(err, "writing %s", filename)
+		}
+		log.VEventf(ctx, 2, "wrote %d rows (%d bytes) to %s", rows, size, filename)
+
+		res := sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(csvWriterOutputTypes[0], parser.NewDString(filename)),
+			sqlbase.DatumToEncDatum(csvWriterOutputTypes[1], parser.NewDInt(parser.DInt(rows))),
+			sqlbase.DatumToEncDatum(csvWriterOutputTypes[2], parser.NewDInt(parser.DInt(size))),
+		}
+		cs, err := sp.out.EmitRow(ctx, res)
+		if err != nil {
+			return err
+		}
+		if cs != distsqlrun.NeedMoreRows {
+			return errors.New("unexpected closure of consumer")
+		}
+		buf.Reset()
+		rows = 0
+		chunk++
+		return nil
+	}
+
+	for {
+		row, meta := sp.input.Next()
+		if !meta.Empty() {
+			if meta.Err != nil {
+				return meta.Err
+			}
+			if cs := sp.output.Push(nil /* row */, meta); cs != distsqlrun.NeedMoreRows {
+				return errors.New("unexpected closure of consumer")
+			}
+			continue
+		}
+		if row == nil {
+			break
+		}
+
+		for i := range row {
+			if err := row[i].EnsureDecoded(&alloc); err != nil {
+				return err
+			}
+			if row[i].Datum == parser.DNull {
+				record[i] = sp.spec.Nullas
+				continue
+			}
+			record[i] = parser.AsStringWithFlags(row[i].Datum, parser.FmtBareStrings)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+		rows++
+
+		if sp.spec.ChunkSize > 0 {
+			// The csv writer buffers its output; flush it to get the size of
+			// the chunk.
+			writer.Flush()
+		}
+		if (sp.spec.ChunkRows > 0 && rows >= sp.spec.ChunkRows) ||
+			(sp.spec.ChunkSize > 0 && int64(buf.Len()) >= sp.spec.ChunkSize) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if rows > 0 {
+		return flush()
+	}
+	return nil
+}
+
+func init() {
+	distsqlrun.NewCSVWriterProcessor = newCSVWriterProcessor
+}
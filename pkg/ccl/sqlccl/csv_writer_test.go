@@ -0,0 +1,148 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package sqlccl
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/distsqlrun"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestCSVWriter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	evalCtx.NodeID = 3
+	flowCtx := distsqlrun.FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	// The rows are (i, "s,i"), where the second column is NULL when i is a
+	// multiple of 4.
+	intType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	strType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	types := []sqlbase.ColumnType{intType, strType}
+	const numRows = 10
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		var s parser.Datum = parser.NewDString(fmt.Sprintf("s,%d", i))
+		if i%4 == 0 {
+			s = parser.DNull
+		}
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(i))),
+			sqlbase.DatumToEncDatum(strType, s),
+		}
+	}
+
+	testCases := []struct {
+		name string
+		spec distsqlrun.CSVWriterSpec
+		// expected holds the summary rows.
+		expected string
+	}{
+		{
+			name:     "Single",
+			spec:     distsqlrun.CSVWriterSpec{NamePattern: "single-%part%.csv", Nullas: "NULL"},
+			expected: "[['single-n3.0.csv' 10 77]]",
+		},
+		{
+			name: "ChunkRows",
+			spec: distsqlrun.CSVWriterSpec{
+				NamePattern: "rows-%part%.csv", ChunkRows: 4, Delimiter: '|',
+			},
+			expected: "[['rows-n3.0.csv' 4 21] ['rows-n3.1.csv' 4 21] ['rows-n3.2.csv' 2 9]]",
+		},
+		{
+			name: "ChunkSize",
+			spec: distsqlrun.CSVWriterSpec{
+				NamePattern: "size-%part%.csv", ChunkSize: 30,
+			},
+			expected: "[['size-n3.0.csv' 5 30] ['size-n3.1.csv' 5 35]]",
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			spec := c.spec
+			spec.Destination = "nodelocal://" + dir
+			in := distsqlrun.NewRowBuffer(types, rows, distsqlrun.RowBufferArgs{})
+			out := &distsqlrun.RowBuffer{}
+			w, err := newCSVWriterProcessor(&flowCtx, spec, in, &distsqlrun.PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Run(context.Background(), nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			var res sqlbase.EncDatumRows
+			var contents []string
+			for {
+				row, meta := out.Next()
+				if !meta.Empty() {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if row == nil {
+					break
+				}
+				res = append(res, row)
+				name := string(*row[0].Datum.(*parser.DString))
+				content, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if int64(len(content)) != int64(*row[2].Datum.(*parser.DInt)) {
+					t.Errorf("file %s has %d bytes, expected %s", name, len(content), row[2].Datum)
+				}
+				contents = append(contents, string(content))
+			}
+			if result := res.String(); result != c.expected {
+				t.Errorf("invalid results: %s, expected %s", result, c.expected)
+			}
+
+			// All the rows are written once, in order.
+			delim := ","
+			if spec.Delimiter != 0 {
+				delim = string(spec.Delimiter)
+			}
+			var expected bytes.Buffer
+			for i := 0; i < numRows; i++ {
+				s := fmt.Sprintf(`"s,%d"`, i)
+				if delim != "," {
+					s = fmt.Sprintf("s,%d", i)
+				}
+				if i%4 == 0 {
+					s = spec.Nullas
+				}
+				fmt.Fprintf(&expected, "%d%s%s\n", i, delim, s)
+			}
+			if result := strings.Join(contents, ""); result != expected.String() {
+				t.Errorf("invalid file contents:\n%s\nexpected:\n%s", result, expected.String())
+			}
+		})
+	}
+}
@@ -166,6 +166,68 @@ func TestDBAddSSTable(t *testing.T) {
 	}
 }
 
+// TestDBAddSSTableSplit verifies that an sstable spanning several ranges is
+// split at their boundaries and ingested by each of them.
+func TestDBAddSSTableSplit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, _, db := serverutils.StartServer(t, base.TestServerArgs{Insecure: true})
+	ctx := context.Background()
+	defer s.Stopper().Stop(ctx)
+
+	for _, splitKey := range []string{"b", "c", "d"} {
+		if err := db.AdminSplit(ctx, splitKey, splitKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sst, err := engine.MakeRocksDBSstFileWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	// The range [c,d) doesn't get any key.
+	expected := []string{"a1", "b1", "b2", "d1"}
+	for _, k := range expected {
+		kv := engine.MVCCKeyValue{
+			Key:   engine.MVCCKey{Key: roachpb.Key(k), Timestamp: hlc.Timestamp{WallTime: 1}},
+			Value: roachpb.MakeValueFromString(k).RawBytes,
+		}
+		if err := sst.Add(kv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := sst.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A single AddSSTable request can't span several ranges.
+	if err := db.ExperimentalAddSSTable(
+		ctx, "a", "e", data,
+	); !testutils.IsError(err, "key range .* outside of bounds of range") {
+		t.Fatalf("expected range key mismatch error, got: %+v", err)
+	}
+
+	if err := db.AddSSTable(ctx, "a", "e", data); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	rows, err := db.Scan(ctx, "a", "e", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, row := range rows {
+		if k, v := string(row.Key), string(row.ValueBytes()); k != v {
+			t.Errorf("expected %s to be %q, got %q", k, k, v)
+		}
+		found = append(found, string(row.Key))
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected keys %s, got %s", expected, found)
+	}
+}
+
 func randomMVCCKeyValues(rng *rand.Rand, numKVs int) []engine.MVCCKeyValue {
 	kvs := make([]engine.MVCCKeyValue, numKVs)
 	for i := range kvs {
@@ -138,22 +138,14 @@ func (b *sstBatcher) Finish(ctx context.Context, db *client.DB) error {
 	if err != nil {
 		return errors.Wrapf(err, "finishing constructed sstable")
 	}
+	return AddSSTable(ctx, db, start, end, sstBytes)
+}
 
-	const maxAddSSTableRetries = 10
-	for i := 0; ; i++ {
-		log.VEventf(ctx, 2, "sending AddSSTable [%s,%s)", start, end)
-		// TODO(dan): This will fail if the range has split.
-		err := db.ExperimentalAddSSTable(ctx, start, end, sstBytes)
-		if err == nil {
-			return nil
-		}
-		if _, ok := err.(*roachpb.AmbiguousResultError); i == maxAddSSTableRetries || !ok {
-			return errors.Wrapf(err, "addsstable [%s,%s)", start, end)
-		}
-		log.Warningf(ctx, "addsstable [%s,%s) attempt %d failed: %+v",
-			start, end, i, err)
-		continue
-	}
+// AddSSTable ingests the given sstable, which must only contain keys in
+// [start, end), splitting it at the boundaries of the ranges it overlaps.
+func AddSSTable(ctx context.Context, db *client.DB, start, end roachpb.Key, sstBytes []byte) error {
+	log.VEventf(ctx, 2, "sending AddSSTable [%s,%s)", start, end)
+	return db.AddSSTable(ctx, start, end, sstBytes)
 }
 
 func (b *sstBatcher) Close() {
@@ -56,6 +56,8 @@ import (
 	"math"
 	"math/rand"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -113,6 +115,24 @@ const (
 	// efficiently targeted connection to the most distant node.
 	defaultCullInterval = 60 * time.Second
 
+	// defaultClientsInterval is the default interval for gossiping the
+	// node's gossip clients, which make up the connectivity graph.
+	defaultClientsInterval = 2 * time.Second
+
+	// defaultPersistInterval is the default interval for persisting the
+	// bootstrap info, including the snapshot of the infos describing the
+	// cluster's layout.
+	defaultPersistInterval = 5 * time.Minute
+
+	// defaultPurgeInterval is the default interval for purging expired
+	// infos and old tombstones from the info store.
+	defaultPurgeInterval = 60 * time.Second
+
+	// ttlTombstoneGossip is how long a tombstone, i.e. an info with an empty
+	// value marking a deleted key, is kept in the info store. It only needs
+	// to outlive the propagation of the deletion through the network.
+	ttlTombstoneGossip = 10 * time.Minute
+
 	// defaultGossipStoresInterval is the default interval for gossiping
 	// store descriptors.
 	defaultGossipStoresInterval = 60 * time.Second
@@ -343,6 +363,25 @@ func (g *Gossip) SetStorage(storage Storage) error {
 	defer g.mu.Unlock()
 	g.storage = storage
 
+	// Seed the info store with the persisted infos, so that the node's view
+	// of the cluster is available before it manages to rejoin gossip. Infos
+	// already received through gossip are newer and take precedence.
+	now := monotonicUnixNano()
+	var restored int
+	for key, i := range storedBI.Infos {
+		if i == nil || i.expired(now) || !isPersistedKey(key) {
+			continue
+		}
+		if err := g.mu.is.addInfo(key, i); err == nil {
+			restored++
+		} else if err != errNotFresh {
+			log.Warningf(ctx, "failed to restore gossip info %q: %s", key, err)
+		}
+	}
+	if restored > 0 {
+		log.Infof(ctx, "restored %d gossip info(s) from persistent storage", restored)
+	}
+
 	// Merge the stored bootstrap info addresses with any we've become
 	// aware of through gossip.
 	existing := map[string]struct{}{}
@@ -358,7 +397,7 @@ func (g *Gossip) SetStorage(storage Storage) error {
 	}
 	// Persist merged addresses.
 	if numAddrs := len(g.bootstrapInfo.Addresses); numAddrs > len(storedBI.Addresses) {
-		if err := g.storage.WriteBootstrapInfo(&g.bootstrapInfo); err != nil {
+		if err := g.writeBootstrapInfoLocked(); err != nil {
 			log.Error(ctx, err)
 		}
 	}
@@ -388,6 +427,31 @@ func (g *Gossip) SetStorage(storage Storage) error {
 	return nil
 }
 
+// isPersistedKey returns whether the info with the given key is part of the
+// snapshot persisted along with the bootstrap addresses. Only the infos which
+// describe the cluster's layout are persisted; in particular neither the
+// sentinel nor the cluster ID are, since their presence is how a node notices
+// that it is connected to the gossip network.
+func isPersistedKey(key string) bool {
+	return key == KeyFirstRangeDescriptor || IsNodeIDKey(key) ||
+		strings.HasPrefix(key, MakeKeyPrefix(KeySystemRangeLeaseHolderPrefix))
+}
+
+// writeBootstrapInfoLocked snapshots the persisted infos into the bootstrap
+// info and writes it to storage. The gossip mutex must be held by the caller.
+func (g *Gossip) writeBootstrapInfoLocked() error {
+	g.bootstrapInfo.Infos = map[string]*Info{}
+	if err := g.mu.is.visitInfos(func(key string, i *Info) error {
+		if isPersistedKey(key) {
+			g.bootstrapInfo.Infos[key] = protoutil.Clone(i).(*Info)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return g.storage.WriteBootstrapInfo(&g.bootstrapInfo)
+}
+
 // setResolvers initializes the set of gossip resolvers used to find
 // nodes to bootstrap the gossip network.
 func (g *Gossip) setResolvers(resolvers []resolver.Resolver) {
@@ -565,7 +629,7 @@ func (g *Gossip) maybeCleanupBootstrapAddressesLocked() {
 		return
 	}
 
-	if err := g.storage.WriteBootstrapInfo(&g.bootstrapInfo); err != nil {
+	if err := g.writeBootstrapInfoLocked(); err != nil {
 		log.Error(ctx, err)
 	}
 }
@@ -690,7 +754,7 @@ func (g *Gossip) updateNodeAddress(key string, content roachpb.Value) {
 	// persist if possible.
 	added := g.maybeAddBootstrapAddressLocked(desc.Address, desc.NodeID)
 	if added && g.storage != nil {
-		if err := g.storage.WriteBootstrapInfo(&g.bootstrapInfo); err != nil {
+		if err := g.writeBootstrapInfoLocked(); err != nil {
 			log.Error(ctx, err)
 		}
 	}
@@ -834,9 +898,93 @@ func (g *Gossip) GetInfoStatus() InfoStatus {
 	for k, v := range g.mu.is.Infos {
 		is.Infos[k] = *protoutil.Clone(v).(*Info)
 	}
+	is.Connectivity = g.connectivityLocked()
 	return is
 }
 
+// Connectivity returns the gossip connectivity graph, assembled from the
+// gossip clients gossiped by every node.
+func (g *Gossip) Connectivity() Connectivity {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.connectivityLocked()
+}
+
+func (g *Gossip) connectivityLocked() Connectivity {
+	ctx := g.AnnotateCtx(context.TODO())
+	var c Connectivity
+	if i := g.mu.is.getInfo(KeySentinel); i != nil {
+		c.SentinelNodeID = i.NodeID
+	}
+	prefix := MakeKeyPrefix(KeyGossipClientsPrefix)
+	if err := g.mu.is.visitInfos(func(key string, i *Info) error {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		sourceID, err := strconv.ParseInt(strings.TrimPrefix(key, prefix), 10 /* base */, 64 /* bitSize */)
+		if err != nil {
+			log.Errorf(ctx, "unable to parse gossip clients key %q: %s", key, err)
+			return nil
+		}
+		clients, err := i.Value.GetBytes()
+		if err != nil {
+			log.Errorf(ctx, "unable to decode gossip clients of node %d: %s", sourceID, err)
+			return nil
+		}
+		for _, s := range strings.Split(string(clients), ",") {
+			if s == "" {
+				continue
+			}
+			targetID, err := strconv.ParseInt(s, 10 /* base */, 64 /* bitSize */)
+			if err != nil {
+				log.Errorf(ctx, "unable to parse gossip client of node %d: %s", sourceID, err)
+				continue
+			}
+			c.ClientConns = append(c.ClientConns, Connectivity_Conn{
+				SourceID: roachpb.NodeID(sourceID),
+				TargetID: roachpb.NodeID(targetID),
+			})
+		}
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	sort.Slice(c.ClientConns, func(i, j int) bool {
+		a, b := c.ClientConns[i], c.ClientConns[j]
+		return a.SourceID < b.SourceID || (a.SourceID == b.SourceID && a.TargetID < b.TargetID)
+	})
+	return c
+}
+
+// updateClients gossips the IDs of the nodes this node's gossip clients
+// are connected to, from which the connectivity graph is assembled.
+func (g *Gossip) updateClients(ctx context.Context) {
+	nodeID := g.NodeID.Get()
+	if nodeID == 0 {
+		return
+	}
+	g.clientsMu.Lock()
+	peerIDs := make([]int, 0, len(g.clientsMu.clients))
+	for _, c := range g.clientsMu.clients {
+		if c.peerID != 0 {
+			peerIDs = append(peerIDs, int(c.peerID))
+		}
+	}
+	g.clientsMu.Unlock()
+	sort.Ints(peerIDs)
+
+	var buf bytes.Buffer
+	for i, peerID := range peerIDs {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%d", peerID)
+	}
+	if err := g.AddInfo(MakeGossipClientsKey(nodeID), buf.Bytes(), 2*defaultClientsInterval); err != nil {
+		log.Errorf(ctx, "failed to gossip clients: %s", err)
+	}
+}
+
 // Callback is a callback method to be invoked on gossip update
 // of info denoted by key.
 type Callback func(string, roachpb.Value)
@@ -865,6 +1013,117 @@ func (g *Gossip) RegisterCallback(pattern string, method Callback) func() {
 	}
 }
 
+// ProtoCallback is a callback method to be invoked on gossip update of an
+// info, with the info's key and its value decoded into a message.
+type ProtoCallback func(key string, msg proto.Message)
+
+// ProtoSubscription describes the infos for which a ProtoCallback is invoked.
+type ProtoSubscription struct {
+	// Prefix restricts the subscription to the infos whose key starts with it,
+	// e.g. MakeKeyPrefix(KeyStorePrefix).
+	Prefix string
+	// New returns an empty message into which the value of an info is decoded.
+	// A new message is decoded for each update, so that the callback may hold
+	// on to it.
+	New func() proto.Message
+	// DeliverExisting, if set, causes the callback to also be invoked for the
+	// matching infos already present when it is registered.
+	DeliverExisting bool
+	// Coalesce, if positive, is the window during which the updates following
+	// a first one are collected before being delivered together, only the
+	// latest value of each key being delivered. This bounds the rate at which
+	// the callback is invoked for keys which are updated rapidly, e.g. store
+	// descriptors while rebalancing, to one batch per window.
+	Coalesce time.Duration
+}
+
+// RegisterProtoCallback registers a callback to be invoked with the decoded
+// value of every info matching the subscription which is received. Values
+// which fail to decode are logged and skipped. Returns a function to
+// unregister the callback.
+func (g *Gossip) RegisterProtoCallback(sub ProtoSubscription, method ProtoCallback) func() {
+	ctx := g.AnnotateCtx(context.TODO())
+	var decode Callback = func(key string, value roachpb.Value) {
+		msg := sub.New()
+		if err := value.GetProto(msg); err != nil {
+			log.Errorf(ctx, "unable to decode gossiped info %q: %s", key, err)
+			return
+		}
+		method(key, msg)
+	}
+	if sub.Coalesce > 0 {
+		c := &coalescingCallback{window: sub.Coalesce, stopper: g.server.stopper, method: decode}
+		decode = c.add
+	}
+
+	g.mu.Lock()
+	unregister := g.mu.is.registerMatcherCallback(prefixMatcher(sub.Prefix), decode, sub.DeliverExisting)
+	g.mu.Unlock()
+	return func() {
+		g.mu.Lock()
+		unregister()
+		g.mu.Unlock()
+	}
+}
+
+// coalescingCallback delivers the updates it receives within a window
+// following a first update together once the window elapses, only the
+// latest value of each key being delivered.
+type coalescingCallback struct {
+	window  time.Duration
+	stopper *stop.Stopper
+	method  Callback
+
+	// flushMu serializes deliveries, so that the updates of a window are
+	// never delivered before those of the previous one.
+	flushMu syncutil.Mutex
+	mu      struct {
+		syncutil.Mutex
+		// pending holds the latest value of each key updated during the
+		// current window. It is nil when no window is open.
+		pending map[string]roachpb.Value
+	}
+}
+
+func (c *coalescingCallback) add(key string, value roachpb.Value) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mu.pending == nil {
+		c.mu.pending = map[string]roachpb.Value{}
+		if err := c.stopper.RunAsyncTask(
+			context.TODO(), "gossip: coalesced callback", func(ctx context.Context) {
+				select {
+				case <-time.After(c.window):
+					c.flush()
+				case <-c.stopper.ShouldQuiesce():
+				}
+			}); err != nil {
+			c.mu.pending = nil
+			return
+		}
+	}
+	c.mu.pending[key] = value
+}
+
+func (c *coalescingCallback) flush() {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	pending := c.mu.pending
+	c.mu.pending = nil
+	c.mu.Unlock()
+
+	keys := make([]string, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c.method(key, pending[key])
+	}
+}
+
 // GetSystemConfig returns the local unmarshalled version of the system config.
 // The second return value indicates whether the system config has been set yet.
 func (g *Gossip) GetSystemConfig() (config.SystemConfig, bool) {
@@ -1100,8 +1359,14 @@ func (g *Gossip) manage() {
 	g.server.stopper.RunWorker(ctx, func(ctx context.Context) {
 		cullTicker := time.NewTicker(g.jitteredInterval(g.cullInterval))
 		stallTicker := time.NewTicker(g.jitteredInterval(g.stallInterval))
+		purgeTicker := time.NewTicker(g.jitteredInterval(defaultPurgeInterval))
+		clientsTicker := time.NewTicker(defaultClientsInterval)
+		persistTicker := time.NewTicker(g.jitteredInterval(defaultPersistInterval))
 		defer cullTicker.Stop()
 		defer stallTicker.Stop()
+		defer purgeTicker.Stop()
+		defer clientsTicker.Stop()
+		defer persistTicker.Stop()
 		for {
 			select {
 			case <-g.server.stopper.ShouldStop():
@@ -1114,7 +1379,7 @@ func (g *Gossip) manage() {
 				func() {
 					g.mu.Lock()
 					if !g.outgoing.hasSpace() {
-						leastUsefulID := g.mu.is.leastUseful(g.outgoing)
+						leastUsefulID := g.mu.is.leastUseful(g.cullCandidatesLocked())
 
 						if c := g.findClient(func(c *client) bool {
 							return c.peerID == leastUsefulID
@@ -1143,6 +1408,22 @@ func (g *Gossip) manage() {
 				g.mu.Lock()
 				g.maybeSignalStatusChangeLocked()
 				g.mu.Unlock()
+			case <-persistTicker.C:
+				g.mu.Lock()
+				if g.storage != nil {
+					if err := g.writeBootstrapInfoLocked(); err != nil {
+						log.Error(ctx, err)
+					}
+				}
+				g.mu.Unlock()
+			case <-clientsTicker.C:
+				g.updateClients(ctx)
+			case <-purgeTicker.C:
+				g.mu.Lock()
+				if n := g.mu.is.purge(monotonicUnixNano(), ttlTombstoneGossip); n > 0 {
+					log.Eventf(ctx, "purged %d expired info(s)", n)
+				}
+				g.mu.Unlock()
 			}
 		}
 	})
@@ -1158,11 +1439,21 @@ func (g *Gossip) jitteredInterval(interval time.Duration) time.Duration {
 // client to the most distant node to which we don't already have an outgoing
 // connection. Does nothing if we don't have room for any more outgoing
 // connections.
+//
+// Nodes in the same region as this node are preferred, so that infos mostly
+// propagate within regions and cross the slower links between regions through
+// fewer connections. A node in another region is only connected to if no node
+// in this node's region is too distant.
 func (g *Gossip) tightenNetwork(ctx context.Context) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 	if g.outgoing.hasSpace() {
-		distantNodeID, distantHops := g.mu.is.mostDistant(g.hasOutgoingLocked)
+		distantNodeID, distantHops := g.mu.is.mostDistant(func(nodeID roachpb.NodeID) bool {
+			return !g.sameRegionLocked(nodeID) || g.hasOutgoingLocked(nodeID)
+		})
+		if distantHops <= maxHops {
+			distantNodeID, distantHops = g.mu.is.mostDistant(g.hasOutgoingLocked)
+		}
 		log.VEventf(ctx, 2, "distantHops: %d from %d", distantHops, distantNodeID)
 		if distantHops <= maxHops {
 			return
@@ -1178,6 +1469,41 @@ func (g *Gossip) tightenNetwork(ctx context.Context) {
 	}
 }
 
+// cullCandidatesLocked returns the outgoing connections among which the least
+// useful one is closed when the outgoing connections are full. Connections to
+// other regions are culled first as long as there are several of them, since
+// they duplicate each other's infos over the slower links between regions;
+// one is always kept so that infos keep flowing between regions.
+func (g *Gossip) cullCandidatesLocked() nodeSet {
+	crossRegion := g.outgoing.filter(func(nodeID roachpb.NodeID) bool {
+		return !g.sameRegionLocked(nodeID)
+	})
+	if crossRegion.len() > 1 {
+		return crossRegion
+	}
+	return g.outgoing
+}
+
+// sameRegionLocked returns whether the given node is in the same region as
+// this node, the region of a node being the first tier of its locality. Nodes
+// whose region isn't known are considered to be in the same region. The mutex
+// is assumed held by the caller.
+func (g *Gossip) sameRegionLocked(nodeID roachpb.NodeID) bool {
+	region := func(nodeID roachpb.NodeID) (roachpb.Tier, bool) {
+		desc, err := g.getNodeDescriptorLocked(nodeID)
+		if err != nil || len(desc.Locality.Tiers) == 0 {
+			return roachpb.Tier{}, false
+		}
+		return desc.Locality.Tiers[0], true
+	}
+	localRegion, ok := region(g.NodeID.Get())
+	if !ok {
+		return true
+	}
+	nodeRegion, ok := region(nodeID)
+	return !ok || nodeRegion == localRegion
+}
+
 func (g *Gossip) doDisconnected(c *client) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
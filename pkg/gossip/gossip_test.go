@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
@@ -37,6 +38,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/netutil"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 )
@@ -60,6 +62,149 @@ func TestGossipInfoStore(t *testing.T) {
 	}
 }
 
+// TestGossipRegisterProtoCallback verifies that proto callbacks are invoked
+// with the decoded values of the infos matching their prefix, including the
+// existing ones only if requested.
+func TestGossipRegisterProtoCallback(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	rpcContext := newInsecureRPCContext(stopper)
+	g := NewTest(1, rpcContext, rpc.NewServer(rpcContext), stopper, metric.NewRegistry())
+
+	addStore := func(storeID roachpb.StoreID) {
+		desc := &roachpb.StoreDescriptor{StoreID: storeID}
+		if err := g.AddInfoProto(MakeStoreKey(storeID), desc, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addStore(1)
+	// Neither a value which can't be decoded nor a key outside of the prefix
+	// are delivered.
+	if err := g.AddInfo(MakeKey(KeyStorePrefix, "garbage"), []byte("\xff"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddInfoProto(MakeNodeIDKey(1), &roachpb.NodeDescriptor{NodeID: 1}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu syncutil.Mutex
+	received := map[bool][]roachpb.StoreID{}
+	for _, deliverExisting := range []bool{false, true} {
+		deliverExisting := deliverExisting
+		g.RegisterProtoCallback(ProtoSubscription{
+			Prefix:          MakeKeyPrefix(KeyStorePrefix),
+			New:             func() proto.Message { return &roachpb.StoreDescriptor{} },
+			DeliverExisting: deliverExisting,
+		}, func(_ string, msg proto.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			received[deliverExisting] = append(received[deliverExisting], msg.(*roachpb.StoreDescriptor).StoreID)
+		})
+	}
+	addStore(2)
+
+	expected := map[bool][]roachpb.StoreID{false: {2}, true: {1, 2}}
+	testutils.SucceedsSoon(t, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(received, expected) {
+			return errors.Errorf("expected stores %v, got %v", expected, received)
+		}
+		return nil
+	})
+}
+
+// TestGossipRegisterProtoCallbackCoalesce verifies that a coalescing
+// subscription only receives the latest value of each key updated during
+// the coalescing window.
+func TestGossipRegisterProtoCallbackCoalesce(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	rpcContext := newInsecureRPCContext(stopper)
+	g := NewTest(1, rpcContext, rpc.NewServer(rpcContext), stopper, metric.NewRegistry())
+
+	var mu syncutil.Mutex
+	var received []roachpb.StoreDescriptor
+	g.RegisterProtoCallback(ProtoSubscription{
+		Prefix:   MakeKeyPrefix(KeyStorePrefix),
+		New:      func() proto.Message { return &roachpb.StoreDescriptor{} },
+		Coalesce: time.Second,
+	}, func(_ string, msg proto.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, *msg.(*roachpb.StoreDescriptor))
+	})
+
+	for i := int32(1); i <= 5; i++ {
+		for _, storeID := range []roachpb.StoreID{1, 2} {
+			desc := &roachpb.StoreDescriptor{
+				StoreID:  storeID,
+				Capacity: roachpb.StoreCapacity{RangeCount: i},
+			}
+			if err := g.AddInfoProto(MakeStoreKey(storeID), desc, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	expected := []roachpb.StoreDescriptor{
+		{StoreID: 1, Capacity: roachpb.StoreCapacity{RangeCount: 5}},
+		{StoreID: 2, Capacity: roachpb.StoreCapacity{RangeCount: 5}},
+	}
+	testutils.SucceedsSoon(t, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(received, expected) {
+			return errors.Errorf("expected stores %+v, got %+v", expected, received)
+		}
+		return nil
+	})
+}
+
+// TestGossipCullCrossRegion verifies that the connections to other regions
+// are culled first, but never all of them.
+func TestGossipCullCrossRegion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	rpcContext := newInsecureRPCContext(stopper)
+	g := NewTest(1, rpcContext, rpc.NewServer(rpcContext), stopper, metric.NewRegistry())
+
+	regions := map[roachpb.NodeID]string{1: "us", 2: "us", 3: "eu", 4: "eu", 5: ""}
+	for nodeID, region := range regions {
+		desc := &roachpb.NodeDescriptor{
+			NodeID:  nodeID,
+			Address: util.MakeUnresolvedAddr("tcp", fmt.Sprintf("%d.%d.%d.%d:1", nodeID, nodeID, nodeID, nodeID)),
+		}
+		if region != "" {
+			desc.Locality.Tiers = []roachpb.Tier{{Key: "region", Value: region}, {Key: "zone", Value: "a"}}
+		}
+		if err := g.AddInfoProto(MakeNodeIDKey(nodeID), desc, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for nodeID, exp := range map[roachpb.NodeID]bool{2: true, 3: false, 4: false, 5: true} {
+		if same := g.sameRegionLocked(nodeID); same != exp {
+			t.Errorf("expected node %d to be in the same region: %t, got %t", nodeID, exp, same)
+		}
+	}
+
+	g.outgoing.addNode(2)
+	g.outgoing.addNode(3)
+	if c := g.cullCandidatesLocked(); !reflect.DeepEqual(c.nodes, g.outgoing.nodes) {
+		t.Errorf("expected all outgoing connections to be culling candidates, got %v", c.asSlice())
+	}
+	g.outgoing.addNode(4)
+	if c := g.cullCandidatesLocked(); c.len() != 2 || !c.hasNode(3) || !c.hasNode(4) {
+		t.Errorf("expected the cross-region connections to be culling candidates, got %v", c.asSlice())
+	}
+}
+
 // TestGossipOverwriteNode verifies that if a new node is added with the same
 // address as an old node, that old node is removed from the cluster.
 func TestGossipOverwriteNode(t *testing.T) {
@@ -237,6 +382,36 @@ func TestGossipRaceLogStatus(t *testing.T) {
 	close(gun)
 }
 
+// TestGossipConnectivity verifies that the connectivity graph assembled
+// from the gossiped clients of each node reflects the gossip connections.
+func TestGossipConnectivity(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	local := startGossip(1, stopper, t, metric.NewRegistry())
+	peer := startGossip(2, stopper, t, metric.NewRegistry())
+
+	local.mu.Lock()
+	local.startClientLocked(peer.GetNodeAddr())
+	local.mu.Unlock()
+	if err := local.AddInfo(KeySentinel, nil, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Connectivity{
+		SentinelNodeID: 1,
+		ClientConns:    []Connectivity_Conn{{SourceID: 1, TargetID: 2}},
+	}
+	testutils.SucceedsSoon(t, func() error {
+		local.updateClients(context.TODO())
+		if c := peer.Connectivity(); !reflect.DeepEqual(c, expected) {
+			return errors.Errorf("expected connectivity %+v, got %+v", expected, c)
+		}
+		return nil
+	})
+}
+
 // TestGossipOutgoingLimitEnforced verifies that a gossip node won't open more
 // outgoing connections than it should. If the gossip implementation is racy
 // with respect to opening outgoing connections, this may not fail every time
@@ -18,6 +18,13 @@ func (i *Info) expired(now int64) bool {
 	return i.TTLStamp <= now
 }
 
+// isTombstone returns true if the info carries an empty value, which is
+// how a deleted key (e.g. the descriptor of a removed node) is gossiped.
+func (i *Info) isTombstone() bool {
+	b, err := i.Value.GetBytes()
+	return err == nil && len(b) == 0
+}
+
 // isFresh returns false if the info has an originating timestamp
 // earlier than the latest seen by this node.
 func (i *Info) isFresh(highWaterStamp int64) bool {
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"math"
 	"regexp"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
@@ -45,6 +46,13 @@ func (allMatcher) MatchString(string) bool {
 	return true
 }
 
+// prefixMatcher matches the keys starting with the given prefix.
+type prefixMatcher string
+
+func (m prefixMatcher) MatchString(key string) bool {
+	return strings.HasPrefix(key, string(m))
+}
+
 // callback holds regexp pattern match and GossipCallback method.
 type callback struct {
 	matcher stringMatcher
@@ -232,15 +240,26 @@ func (is *infoStore) registerCallback(pattern string, method Callback) func() {
 	} else {
 		matcher = regexp.MustCompile(pattern)
 	}
+	return is.registerMatcherCallback(matcher, method, true /* deliverExisting */)
+}
+
+// registerMatcherCallback is like registerCallback, for the keys accepted by
+// the given matcher. The callback is only invoked for the infos already in the
+// store if deliverExisting is set.
+func (is *infoStore) registerMatcherCallback(
+	matcher stringMatcher, method Callback, deliverExisting bool,
+) func() {
 	cb := &callback{matcher: matcher, method: method}
 	is.callbacks = append(is.callbacks, cb)
-	if err := is.visitInfos(func(key string, i *Info) error {
-		if matcher.MatchString(key) {
-			is.runCallbacks(key, i.Value, method)
+	if deliverExisting {
+		if err := is.visitInfos(func(key string, i *Info) error {
+			if matcher.MatchString(key) {
+				is.runCallbacks(key, i.Value, method)
+			}
+			return nil
+		}); err != nil {
+			panic(err)
 		}
-		return nil
-	}); err != nil {
-		panic(err)
 	}
 
 	return func() {
@@ -325,6 +344,22 @@ func (is *infoStore) visitInfos(visitInfo func(string, *Info) error) error {
 	return nil
 }
 
+// purge removes expired infos, as well as tombstones which have been
+// circulating for longer than tombstoneTTL, from the infoStore. Both are
+// otherwise only dropped lazily, so that without purging they remain in
+// memory indefinitely on nodes which never visit them. Returns the number
+// of infos removed.
+func (is *infoStore) purge(now int64, tombstoneTTL time.Duration) int {
+	var count int
+	for k, i := range is.Infos {
+		if i.expired(now) || (i.isTombstone() && i.Value.Timestamp.WallTime+int64(tombstoneTTL) <= now) {
+			delete(is.Infos, k)
+			count++
+		}
+	}
+	return count
+}
+
 // combine combines an incremental delta with the current infoStore.
 // All hop distances on infos are incremented to indicate they've
 // arrived from an external source. Returns the count of "fresh"
@@ -332,7 +367,13 @@ func (is *infoStore) visitInfos(visitInfo func(string, *Info) error) error {
 func (is *infoStore) combine(
 	infos map[string]*Info, nodeID roachpb.NodeID,
 ) (freshCount int, err error) {
+	now := monotonicUnixNano()
 	for key, i := range infos {
+		// Don't resurrect infos which expired while in transit or which the
+		// peer has yet to purge.
+		if i.expired(now) {
+			continue
+		}
 		infoCopy := *i
 		infoCopy.Hops++
 		infoCopy.PeerID = nodeID
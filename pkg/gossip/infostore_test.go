@@ -117,6 +117,58 @@ func TestInfoStoreGetInfoTTL(t *testing.T) {
 	}
 }
 
+// Verify that purging removes expired infos and tombstones older than
+// the tombstone TTL, and that expired infos aren't combined from peers.
+func TestInfoStorePurge(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	is, stopper := newTestInfoStore()
+	defer stopper.Stop(context.TODO())
+
+	for key, i := range map[string]*Info{
+		"live":      is.newInfo([]byte("live"), 0),
+		"expired":   is.newInfo([]byte("expired"), time.Nanosecond),
+		"tombstone": is.newInfo(nil, 0),
+	} {
+		if err := is.addInfo(key, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := monotonicUnixNano()
+	if n := is.purge(now, time.Hour); n != 1 {
+		t.Errorf("expected 1 info to be purged, got %d", n)
+	}
+	if _, ok := is.Infos["expired"]; ok {
+		t.Error("expired info wasn't purged")
+	}
+	if _, ok := is.Infos["tombstone"]; !ok {
+		t.Error("recent tombstone was purged")
+	}
+
+	if n := is.purge(now+int64(time.Hour), time.Hour); n != 1 {
+		t.Errorf("expected 1 info to be purged, got %d", n)
+	}
+	if _, ok := is.Infos["tombstone"]; ok {
+		t.Error("old tombstone wasn't purged")
+	}
+	if _, ok := is.Infos["live"]; !ok {
+		t.Error("live info was purged")
+	}
+
+	expired := is.newInfo([]byte("expired"), time.Nanosecond)
+	expired.NodeID = 2
+	expired.OrigStamp = monotonicUnixNano()
+	time.Sleep(time.Nanosecond)
+	if fresh, err := is.combine(map[string]*Info{"expired": expired}, 2); err != nil {
+		t.Fatal(err)
+	} else if fresh != 0 {
+		t.Errorf("expected expired info not to be combined, got %d fresh info(s)", fresh)
+	}
+	if _, ok := is.Infos["expired"]; ok {
+		t.Error("expired info was combined from peer")
+	}
+}
+
 // Add infos using same key, same and lesser timestamp; verify no
 // replacement.
 func TestAddInfoSameKeyLessThanEqualTimestamp(t *testing.T) {
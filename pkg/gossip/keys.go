@@ -56,6 +56,15 @@ const (
 	// KeyNodeLivenessPrefix is the key prefix for gossiping node liveness info.
 	KeyNodeLivenessPrefix = "liveness"
 
+	// KeyDistSQLNodeVersionKeyPrefix is the key prefix for each node's DistSQL
+	// version. The value is a distsqlrun.DistSQLVersionGossipInfo.
+	KeyDistSQLNodeVersionKeyPrefix = "distsql-version"
+
+	// KeyGossipClientsPrefix is the key prefix for each node's gossip
+	// clients. The suffix is a node ID and the value is a comma-separated
+	// list of the IDs of the nodes its gossip clients are connected to.
+	KeyGossipClientsPrefix = "gossip-clients"
+
 	// KeySentinel is a key for gossip which must not expire or
 	// else the node considers itself partitioned and will retry with
 	// bootstrap hosts.  The sentinel is gossiped by the node that holds
@@ -68,6 +77,11 @@ const (
 	// of storage.Replica structs.
 	KeyFirstRangeDescriptor = "first-range"
 
+	// KeySystemRangeLeaseHolderPrefix is the key prefix for gossiping the lease
+	// holders of the ranges containing system data. The suffix is a range ID
+	// and the value is a SystemRangeLeaseHolder.
+	KeySystemRangeLeaseHolderPrefix = "system-range-leaseholder"
+
 	// KeySystemConfig is the gossip key for the system DB span.
 	// The value if a config.SystemConfig which holds all key/value
 	// pairs in the system DB span.
@@ -81,6 +95,13 @@ func MakeKey(components ...string) string {
 	return strings.Join(components, separator)
 }
 
+// MakeKeyPrefix returns the common prefix of the Gossip keys created by
+// invocations of MakeKey with multiple arguments for which the first argument
+// is equal to the given prefix.
+func MakeKeyPrefix(prefix string) string {
+	return prefix + separator
+}
+
 // MakePrefixPattern returns a regular expression pattern that
 // matches precisely the Gossip keys created by invocations of
 // MakeKey with multiple arguments for which the first argument
@@ -119,11 +140,29 @@ func MakeNodeLivenessKey(nodeID roachpb.NodeID) string {
 	return MakeKey(KeyNodeLivenessPrefix, nodeID.String())
 }
 
+// MakeDistSQLNodeVersionKey returns the gossip key for the given node's
+// DistSQL version info.
+func MakeDistSQLNodeVersionKey(nodeID roachpb.NodeID) string {
+	return MakeKey(KeyDistSQLNodeVersionKeyPrefix, nodeID.String())
+}
+
+// MakeGossipClientsKey returns the gossip key for the gossip clients of
+// the given node.
+func MakeGossipClientsKey(nodeID roachpb.NodeID) string {
+	return MakeKey(KeyGossipClientsPrefix, nodeID.String())
+}
+
 // MakeStoreKey returns the gossip key for the given store.
 func MakeStoreKey(storeID roachpb.StoreID) string {
 	return MakeKey(KeyStorePrefix, storeID.String())
 }
 
+// MakeSystemRangeLeaseHolderKey returns the gossip key for the lease holder of
+// the given system range.
+func MakeSystemRangeLeaseHolderKey(rangeID roachpb.RangeID) string {
+	return MakeKey(KeySystemRangeLeaseHolderPrefix, rangeID.String())
+}
+
 // MakeDeadReplicasKey returns the dead replicas gossip key for the given store.
 func MakeDeadReplicasKey(storeID roachpb.StoreID) string {
 	return MakeKey(KeyDeadReplicasPrefix, storeID.String())
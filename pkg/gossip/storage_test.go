@@ -15,24 +15,33 @@
 package gossip_test
 
 import (
+	"math"
 	"reflect"
 	"sort"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
+	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/gossip"
 	"github.com/cockroachdb/cockroach/pkg/gossip/resolver"
 	"github.com/cockroachdb/cockroach/pkg/gossip/simulation"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/rpc"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 )
 
 type testStorage struct {
@@ -271,3 +280,77 @@ func TestGossipStorageCleanup(t *testing.T) {
 		return nil
 	})
 }
+
+// TestGossipStorageRestoresInfos verifies that the infos persisted along
+// with the bootstrap addresses are restored when the storage is set, with
+// the exception of those signalling a connection to the gossip network.
+func TestGossipStorageRestoresInfos(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	rpcContext := rpc.NewContext(
+		log.AmbientContext{Tracer: tracing.NewTracer()},
+		&base.Config{Insecure: true},
+		hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		stopper,
+	)
+	g := gossip.NewTest(1, rpcContext, rpc.NewServer(rpcContext), stopper, metric.NewRegistry())
+
+	makeInfo := func(msg proto.Message) *gossip.Info {
+		bytes, err := protoutil.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &gossip.Info{
+			Value:     roachpb.MakeValueFromBytesAndTimestamp(bytes, hlc.Timestamp{WallTime: 1}),
+			OrigStamp: 1,
+			TTLStamp:  math.MaxInt64,
+			NodeID:    2,
+		}
+	}
+	nodeDesc := roachpb.NodeDescriptor{
+		NodeID:  2,
+		Address: util.MakeUnresolvedAddr("tcp", "localhost:26258"),
+	}
+	rangeDesc := roachpb.RangeDescriptor{RangeID: 1, StartKey: roachpb.RKeyMin, EndKey: roachpb.RKeyMax}
+	var ts testStorage
+	ts.info.Infos = map[string]*gossip.Info{
+		gossip.MakeNodeIDKey(2):         makeInfo(&nodeDesc),
+		gossip.KeyFirstRangeDescriptor: makeInfo(&rangeDesc),
+		gossip.KeySentinel:             makeInfo(&roachpb.NodeDescriptor{}),
+	}
+	if err := g.SetStorage(&ts); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.SucceedsSoon(t, func() error {
+		if _, err := g.GetNodeDescriptor(2); err != nil {
+			return err
+		}
+		return nil
+	})
+	var desc roachpb.RangeDescriptor
+	if err := g.GetInfoProto(gossip.KeyFirstRangeDescriptor, &desc); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(desc, rangeDesc) {
+		t.Errorf("expected first range descriptor %+v, got %+v", rangeDesc, desc)
+	}
+	if _, err := g.GetInfo(gossip.KeySentinel); err == nil {
+		t.Error("unexpectedly restored the sentinel")
+	}
+
+	// Learning about the restored node's address persists the bootstrap
+	// info, including the snapshot of the infos.
+	testutils.SucceedsSoon(t, func() error {
+		var keys []string
+		for key := range ts.Info().Infos {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if expected := []string{gossip.KeyFirstRangeDescriptor, gossip.MakeNodeIDKey(2)}; !reflect.DeepEqual(keys, expected) {
+			return errors.Errorf("expected persisted infos %s, got %s", expected, keys)
+		}
+		return nil
+	})
+}
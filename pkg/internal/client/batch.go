@@ -18,6 +18,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 )
 
 const (
@@ -225,11 +226,24 @@ func (b *Batch) fillResults() error {
 				row := &result.Rows[k]
 				row.Key = []byte(args.(*roachpb.DeleteRequest).Key)
 
+			case *roachpb.QueryIntentRequest:
+				row := &result.Rows[k]
+				row.Key = []byte(req.Key)
+				if result.Err == nil {
+					row.Value = &roachpb.Value{}
+					row.Value.SetBool(reply.(*roachpb.QueryIntentResponse).FoundIntent)
+				}
+
 			case *roachpb.DeleteRangeRequest:
 				if result.Err == nil {
 					result.Keys = reply.(*roachpb.DeleteRangeResponse).Keys
 				}
 
+			case *roachpb.DeleteRangeWhereRequest:
+				if result.Err == nil {
+					result.Keys = reply.(*roachpb.DeleteRangeWhereResponse).Keys
+				}
+
 			default:
 				if result.Err == nil {
 					result.Err = errors.Errorf("unsupported reply: %T for %T",
@@ -318,7 +332,8 @@ func (b *Batch) AddRawRequest(reqs ...roachpb.Request) {
 			*roachpb.PutRequest,
 			*roachpb.ConditionalPutRequest,
 			*roachpb.IncrementRequest,
-			*roachpb.DeleteRequest:
+			*roachpb.DeleteRequest,
+			*roachpb.QueryIntentRequest:
 			numRows = 1
 		}
 		b.appendReqs(args)
@@ -398,6 +413,19 @@ func (b *Batch) PutInline(key, value interface{}) {
 // key can be either a byte slice or a string. value can be any key type, a
 // proto.Message or any Go primitive type (bool, int, etc).
 func (b *Batch) CPut(key, value, expValue interface{}) {
+	b.cput(key, value, expValue, false)
+}
+
+// CPutAllowingIfNotExists is like CPut except it also succeeds if the key
+// doesn't exist, i.e. it sets the value if the existing value is equal to
+// expValue or if there is no existing entry. This lets upserts replace the
+// value they expect without first reading whether the key exists. The
+// DistSender rejects it until cluster.VersionCPutAllowIfDoesNotExist is active.
+func (b *Batch) CPutAllowingIfNotExists(key, value, expValue interface{}) {
+	b.cput(key, value, expValue, true)
+}
+
+func (b *Batch) cput(key, value, expValue interface{}, allowNotExist bool) {
 	k, err := marshalKey(key)
 	if err != nil {
 		b.initResult(0, 1, notRaw, err)
@@ -413,7 +441,7 @@ func (b *Batch) CPut(key, value, expValue interface{}) {
 		b.initResult(0, 1, notRaw, err)
 		return
 	}
-	b.appendReqs(roachpb.NewConditionalPut(k, v, ev))
+	b.appendReqs(roachpb.NewConditionalPut(k, v, ev, allowNotExist))
 	b.initResult(1, 1, notRaw, nil)
 }
 
@@ -517,6 +545,22 @@ func (b *Batch) CheckConsistency(s, e interface{}, withDiff bool) {
 	b.initResult(1, 0, notRaw, nil)
 }
 
+// QueryIntent checks whether the intent at the key was written by the
+// transaction, in its epoch and with at least its sequence number. A new
+// result will be appended to the batch which will contain a single row, whose
+// value is a bool set if the intent was found.
+//
+// key can be either a byte slice or a string.
+func (b *Batch) QueryIntent(key interface{}, txn enginepb.TxnMeta) {
+	k, err := marshalKey(key)
+	if err != nil {
+		b.initResult(0, 1, notRaw, err)
+		return
+	}
+	b.appendReqs(roachpb.NewQueryIntent(k, txn))
+	b.initResult(1, 1, notRaw, nil)
+}
+
 // Del deletes one or more keys.
 //
 // A new result will be appended to the batch and each key will have a
@@ -558,6 +602,32 @@ func (b *Batch) DelRange(s, e interface{}, returnKeys bool) {
 	b.initResult(1, 0, notRaw, nil)
 }
 
+// DelRangeWhere deletes the rows between begin (inclusive) and end (exclusive)
+// which satisfy the given predicate. The predicate is evaluated on each range
+// the span touches, so the rows need not be read by the client. The deletion
+// is non-transactional and must not be run in a transaction.
+//
+// A new result will be appended to the batch which will contain 0 rows and
+// Result.Err will indicate success or failure.
+//
+// key can be either a byte slice or a string.
+func (b *Batch) DelRangeWhere(
+	s, e interface{}, pred roachpb.DeleteRangePredicate, returnKeys bool,
+) {
+	begin, err := marshalKey(s)
+	if err != nil {
+		b.initResult(0, 0, notRaw, err)
+		return
+	}
+	end, err := marshalKey(e)
+	if err != nil {
+		b.initResult(0, 0, notRaw, err)
+		return
+	}
+	b.appendReqs(roachpb.NewDeleteRangeWhere(begin, end, pred, returnKeys))
+	b.initResult(1, 0, notRaw, nil)
+}
+
 // adminMerge is only exported on DB. It is here for symmetry with the
 // other operations.
 func (b *Batch) adminMerge(key interface{}) {
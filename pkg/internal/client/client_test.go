@@ -459,6 +459,62 @@ func TestClientRunConcurrentTransaction(t *testing.T) {
 	}
 }
 
+// TestTxnRollbackToSavepoint verifies that rolling back to a savepoint
+// restores the values the keys had when the savepoint was created.
+func TestTxnRollbackToSavepoint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	s, _, db := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	if err := db.Put(context.TODO(), "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(context.TODO(), "c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Txn(context.TODO(), func(ctx context.Context, txn *client.Txn) error {
+		sp, err := txn.CreateSavepoint(ctx)
+		if err != nil {
+			return err
+		}
+		if err := txn.Put(ctx, "a", "2"); err != nil {
+			return err
+		}
+		if err := txn.Put(ctx, "b", "2"); err != nil {
+			return err
+		}
+		if err := txn.DelRange(ctx, "c", "d"); err != nil {
+			return err
+		}
+		if err := txn.RollbackToSavepoint(ctx, sp); err != nil {
+			return err
+		}
+		return txn.ReleaseSavepoint(sp)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]string{"a": "1", "b": "", "c": "3"} {
+		gr, err := db.Get(context.TODO(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected == "" {
+			if gr.Exists() {
+				t.Errorf("%s: expected no value, got %q", key, gr.ValueBytes())
+			}
+			continue
+		}
+		if gr.Value == nil {
+			t.Errorf("%s: expected %q, got no value", key, expected)
+		} else if err := gr.Value.Verify(gr.Key); err != nil {
+			t.Errorf("%s: %s", key, err)
+		} else if string(gr.ValueBytes()) != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, gr.ValueBytes())
+		}
+	}
+}
+
 // TestClientGetAndPutProto verifies gets and puts of protobufs using the
 // client's convenience methods.
 func TestClientGetAndPutProto(t *testing.T) {
@@ -17,6 +17,7 @@ package client
 import (
 	"bytes"
 	"fmt"
+	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/pkg/errors"
@@ -24,9 +25,9 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
-	"github.com/cockroachdb/cockroach/pkg/util/retry"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 )
 
@@ -228,6 +229,21 @@ func (db *DB) GetProto(ctx context.Context, key interface{}, msg proto.Message)
 	return r.ValueProto(msg)
 }
 
+// QueryIntent returns whether the intent at the key was written by the
+// transaction, in its epoch and with at least its sequence number. It waits
+// for the writes to the key which are still being replicated.
+//
+// key can be either a byte slice or a string.
+func (db *DB) QueryIntent(ctx context.Context, key interface{}, txn enginepb.TxnMeta) (bool, error) {
+	b := &Batch{}
+	b.QueryIntent(key, txn)
+	r, err := getOneRow(db.Run(ctx, b), b)
+	if err != nil {
+		return false, err
+	}
+	return r.Value.GetBool()
+}
+
 // Put sets the value for a key.
 //
 // key can be either a byte slice or a string. value can be any key type, a
@@ -266,6 +282,17 @@ func (db *DB) CPut(ctx context.Context, key, value, expValue interface{}) error
 	return getOneErr(db.Run(ctx, b), b)
 }
 
+// CPutAllowingIfNotExists is like CPut except it also succeeds if the key
+// doesn't exist.
+//
+// key can be either a byte slice or a string. value can be any key type, a
+// proto.Message or any Go primitive type (bool, int, etc).
+func (db *DB) CPutAllowingIfNotExists(ctx context.Context, key, value, expValue interface{}) error {
+	b := &Batch{}
+	b.CPutAllowingIfNotExists(key, value, expValue)
+	return getOneErr(db.Run(ctx, b), b)
+}
+
 // InitPut sets the first value for a key to value. A ConditionFailedError is
 // reported if a value already exists for the key and it's not equal to the
 // value passed in. If failOnTombstones is set to true, tombstones count as
@@ -354,6 +381,18 @@ func (db *DB) DelRange(ctx context.Context, begin, end interface{}) error {
 	return getOneErr(db.Run(ctx, b), b)
 }
 
+// DelRangeWhere deletes the rows between begin (inclusive) and end (exclusive)
+// which satisfy the given predicate. See Batch.DelRangeWhere.
+//
+// key can be either a byte slice or a string.
+func (db *DB) DelRangeWhere(
+	ctx context.Context, begin, end interface{}, pred roachpb.DeleteRangePredicate,
+) error {
+	b := &Batch{}
+	b.DelRangeWhere(begin, end, pred, false)
+	return getOneErr(db.Run(ctx, b), b)
+}
+
 // AdminMerge merges the range containing key and the subsequent
 // range. After the merge operation is complete, the range containing
 // key will contain all of the key/value pairs of the subsequent range
@@ -448,6 +487,47 @@ func (db *DB) ExperimentalAddSSTable(
 	return getOneErr(db.Run(ctx, b), b)
 }
 
+// AddSSTable links the given sstable, which must only contain keys in
+// [begin,end), into the RocksDB log-structured merge-tree of the ranges it
+// overlaps. Unlike ExperimentalAddSSTable, the sstable may span several
+// ranges: it is split at their boundaries, including those of the splits
+// happening concurrently. The ingestion isn't atomic across ranges.
+//
+// begin and end can be either a byte slice or a string.
+func (db *DB) AddSSTable(ctx context.Context, begin, end interface{}, data []byte) error {
+	a, ok := db.sender.(SSTableAdder)
+	if !ok {
+		return errors.Errorf("ingesting sstables isn't supported by %T", db.sender)
+	}
+	beginKey, err := marshalKey(begin)
+	if err != nil {
+		return err
+	}
+	endKey, err := marshalKey(end)
+	if err != nil {
+		return err
+	}
+	return a.AddSSTable(ctx, roachpb.Span{Key: beginKey, EndKey: endKey}, data)
+}
+
+// RangeFeed streams the revisions committed to the keys in the given span
+// after startFrom on eventC, interleaved with checkpoints which indicate that
+// all the revisions of a part of the span up to a timestamp have been emitted.
+// It blocks until the context is canceled or an error occurs. A revision may
+// be emitted more than once, but never after a checkpoint covering it.
+func (db *DB) RangeFeed(
+	ctx context.Context,
+	span roachpb.Span,
+	startFrom hlc.Timestamp,
+	eventC chan<- *roachpb.RangeFeedEvent,
+) error {
+	f, ok := db.sender.(RangeFeeder)
+	if !ok {
+		return errors.Errorf("range feeds are not supported by %T", db.sender)
+	}
+	return f.RangeFeed(ctx, span, startFrom, eventC)
+}
+
 // sendAndFill is a helper which sends the given batch and fills its results,
 // returning the appropriate error which is either from the first failing call,
 // or an "internal" error.
@@ -491,6 +571,23 @@ func (db *DB) Run(ctx context.Context, b *Batch) error {
 	return sendAndFill(ctx, db.send, b)
 }
 
+// RunStale executes the read-only operations queued up within a batch at a
+// timestamp maxStaleness in the past. Since the reads don't have to be served
+// by the lease holders of the ranges, they're routed to the nearest replicas,
+// trading the freshness of the results for latency: a replica which hasn't
+// caught up with the writes at or below the timestamp redirects the read to
+// the lease holder, and intents are ignored, as for INCONSISTENT reads. A
+// zero maxStaleness reads at the current time without bounding the staleness
+// of the replicas.
+func (db *DB) RunStale(ctx context.Context, b *Batch, maxStaleness time.Duration) error {
+	if maxStaleness < 0 {
+		return errors.Errorf("invalid staleness %s", maxStaleness)
+	}
+	b.Header.ReadConsistency = roachpb.INCONSISTENT
+	b.Header.MaxStalenessNanos = maxStaleness.Nanoseconds()
+	return db.Run(ctx, b)
+}
+
 // Txn executes retryable in the context of a distributed transaction. The
 // transaction is automatically aborted if retryable returns any error aside
 // from recoverable internal errors, and is automatically committed
@@ -602,15 +699,14 @@ func getOneRow(runErr error, b *Batch) (KeyValue, error) {
 // It performs the increment as a retryable non-transactional increment. The key
 // might be incremented multiple times because of the retries.
 func IncrementValRetryable(ctx context.Context, db *DB, key roachpb.Key, inc int64) (int64, error) {
-	var err error
 	var res KeyValue
-	for r := retry.Start(base.DefaultRetryOptions()); r.Next(); {
-		res, err = db.Inc(ctx, key, inc)
-		switch err.(type) {
-		case *roachpb.UnhandledRetryableError, *roachpb.AmbiguousResultError:
-			continue
-		}
-		break
-	}
+	// The increment isn't idempotent, but the callers tolerate the key being
+	// incremented more than once, so it's retried after ambiguous results.
+	err := RunWithRetries(ctx, base.DefaultRetryOptions(), true, /* idempotent */
+		func(ctx context.Context) error {
+			var err error
+			res, err = db.Inc(ctx, key, inc)
+			return err
+		})
 	return res.ValueInt(), err
 }
@@ -19,11 +19,13 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
@@ -214,6 +216,40 @@ func TestBatch(t *testing.T) {
 	checkResults(t, expected, b.Results)
 }
 
+func TestDB_RunStale(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	s, db := setup(t)
+	defer s.Stopper().Stop(context.TODO())
+	ctx := context.TODO()
+
+	if err := db.Put(ctx, "aa", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A read an hour in the past doesn't see the write, while a read without
+	// staleness does.
+	for _, c := range []struct {
+		staleness time.Duration
+		expected  []byte
+	}{
+		{time.Hour, []byte("")},
+		{0, []byte("1")},
+	} {
+		b := &client.Batch{}
+		b.Get("aa")
+		if err := db.RunStale(ctx, b, c.staleness); err != nil {
+			t.Fatal(err)
+		}
+		checkResult(t, c.expected, b.Results[0].Rows[0].ValueBytes())
+	}
+
+	b := &client.Batch{}
+	b.Put("aa", "2")
+	if err := db.RunStale(ctx, b, time.Second); !testutils.IsError(err, "not allowed") {
+		t.Fatalf("expected writes to be rejected, got %v", err)
+	}
+}
+
 func TestDB_Scan(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	s, db := setup(t)
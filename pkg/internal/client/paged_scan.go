@@ -0,0 +1,250 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package client
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+)
+
+// defaultPageKeys is the default maximum number of keys of a page of a
+// PagedScan.
+const defaultPageKeys = 10000
+
+// Runner is implemented by DB and Txn, which both run batches.
+type Runner interface {
+	Run(ctx context.Context, b *Batch) error
+}
+
+// PagedScanOptions configures a PagedScan.
+type PagedScanOptions struct {
+	// PageKeys is the maximum number of keys of a page. Defaults to
+	// defaultPageKeys.
+	PageKeys int64
+	// PageBytes, if set, is the approximate size of the keys and values of a
+	// page. The number of keys of each page is estimated from the size of the
+	// rows returned so far, and doesn't exceed PageKeys.
+	PageBytes int64
+	// Reverse scans the span in descending order.
+	Reverse bool
+	// Prefetch requests each page as soon as the previous one is returned,
+	// while the caller processes it.
+	Prefetch bool
+}
+
+// PagedScan scans a span page by page: each page is the result of a Scan
+// bounded by MaxSpanRequestKeys, and the next one resumes from its resume
+// span. Pages are returned by Next, until the span has been scanned entirely.
+// A PagedScan isn't safe for concurrent use, and must be closed if Prefetch
+// is set.
+type PagedScan struct {
+	runner Runner
+	opts   PagedScanOptions
+	// remaining is the part of the span which hasn't been scanned yet. Its key
+	// is nil once the scan is complete.
+	remaining roachpb.Span
+	// rows and bytes are the number and size of the rows returned so far.
+	rows, bytes int64
+	// prefetched, if set, receives the result of the page being prefetched.
+	prefetched chan pageResult
+}
+
+type pageResult struct {
+	rows   []KeyValue
+	resume roachpb.Span
+	err    error
+}
+
+// NewPagedScan returns a PagedScan of the rows between begin (inclusive) and
+// end (exclusive), which runs its batches through r.
+//
+// key can be either a byte slice or a string.
+func NewPagedScan(r Runner, begin, end interface{}, opts PagedScanOptions) (*PagedScan, error) {
+	beginKey, err := marshalKey(begin)
+	if err != nil {
+		return nil, err
+	}
+	endKey, err := marshalKey(end)
+	if err != nil {
+		return nil, err
+	}
+	if opts.PageKeys <= 0 {
+		opts.PageKeys = defaultPageKeys
+	}
+	return &PagedScan{
+		runner:    r,
+		opts:      opts,
+		remaining: roachpb.Span{Key: beginKey, EndKey: endKey},
+	}, nil
+}
+
+// Next returns the next page of rows, or no rows once the span has been
+// scanned entirely.
+func (s *PagedScan) Next(ctx context.Context) ([]KeyValue, error) {
+	for {
+		var res pageResult
+		if s.prefetched != nil {
+			res = <-s.prefetched
+			s.prefetched = nil
+		} else if s.remaining.Key != nil {
+			res = s.fetch(ctx, s.remaining, s.pageKeys())
+		} else {
+			return nil, nil
+		}
+		if res.err != nil {
+			return nil, res.err
+		}
+
+		s.remaining = res.resume
+		s.rows += int64(len(res.rows))
+		for _, row := range res.rows {
+			s.bytes += int64(len(row.Key))
+			if row.Value != nil {
+				s.bytes += int64(len(row.Value.RawBytes))
+			}
+		}
+		if s.opts.Prefetch && s.remaining.Key != nil {
+			prefetched := make(chan pageResult, 1)
+			go func(span roachpb.Span, maxKeys int64) {
+				prefetched <- s.fetch(ctx, span, maxKeys)
+			}(s.remaining, s.pageKeys())
+			s.prefetched = prefetched
+		}
+		if len(res.rows) > 0 {
+			return res.rows, nil
+		}
+	}
+}
+
+// ResumeSpan returns the part of the span which hasn't been returned yet, for
+// instance to checkpoint the progress of the scan. It is empty once the span
+// has been scanned entirely.
+func (s *PagedScan) ResumeSpan() roachpb.Span {
+	return s.remaining
+}
+
+// Close waits for the page being prefetched, if any.
+func (s *PagedScan) Close() {
+	if s.prefetched != nil {
+		<-s.prefetched
+		s.prefetched = nil
+	}
+}
+
+// pageKeys returns the maximum number of keys of the next page.
+func (s *PagedScan) pageKeys() int64 {
+	if s.opts.PageBytes <= 0 || s.bytes == 0 {
+		return s.opts.PageKeys
+	}
+	n := s.opts.PageBytes * s.rows / s.bytes
+	if n < 1 {
+		return 1
+	}
+	if n > s.opts.PageKeys {
+		return s.opts.PageKeys
+	}
+	return n
+}
+
+// fetch scans the given span, up to maxKeys keys. It doesn't modify the
+// PagedScan, so that it can run concurrently with the caller.
+func (s *PagedScan) fetch(ctx context.Context, span roachpb.Span, maxKeys int64) pageResult {
+	b := &Batch{}
+	b.Header.MaxSpanRequestKeys = maxKeys
+	if s.opts.Reverse {
+		b.ReverseScan(span.Key, span.EndKey)
+	} else {
+		b.Scan(span.Key, span.EndKey)
+	}
+	r, err := getOneResult(s.runner.Run(ctx, b), b)
+	if err != nil {
+		return pageResult{err: err}
+	}
+	return pageResult{rows: r.Rows, resume: r.ResumeSpan}
+}
+
+// ScanIterator iterates over the rows of a span one by one. The rows are
+// fetched page by page through a PagedScan which prefetches the next page in
+// the background while the caller consumes the current one, hiding the
+// latency of each page for large sequential reads. A ScanIterator isn't safe
+// for concurrent use, and must be closed.
+//
+// Typical usage:
+//
+//   it, err := NewScanIterator(db, begin, end, PagedScanOptions{})
+//   ...
+//   defer it.Close()
+//   for it.Next(ctx) {
+//     kv := it.KeyValue()
+//     ...
+//   }
+//   if err := it.Err(); err != nil {
+//     ...
+//   }
+type ScanIterator struct {
+	scan *PagedScan
+	// page holds the rows of the current page, starting with the current row.
+	page []KeyValue
+	err  error
+}
+
+// NewScanIterator returns a ScanIterator over the rows between begin
+// (inclusive) and end (exclusive), which runs its batches through r. The
+// Prefetch option is always set.
+//
+// key can be either a byte slice or a string.
+func NewScanIterator(
+	r Runner, begin, end interface{}, opts PagedScanOptions,
+) (*ScanIterator, error) {
+	opts.Prefetch = true
+	scan, err := NewPagedScan(r, begin, end, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &ScanIterator{scan: scan}, nil
+}
+
+// Next advances the iterator to the next row. It returns false once the span
+// has been scanned entirely or if an error occurred, which is then returned by
+// Err.
+func (it *ScanIterator) Next(ctx context.Context) bool {
+	if it.err != nil {
+		return false
+	}
+	if len(it.page) > 0 {
+		it.page = it.page[1:]
+	}
+	if len(it.page) == 0 {
+		it.page, it.err = it.scan.Next(ctx)
+	}
+	return len(it.page) > 0
+}
+
+// KeyValue returns the current row. It must only be called after Next
+// returned true.
+func (it *ScanIterator) KeyValue() KeyValue {
+	return it.page[0]
+}
+
+// Err returns the error which ended the iteration, if any.
+func (it *ScanIterator) Err() error {
+	return it.err
+}
+
+// Close waits for the page being prefetched, if any.
+func (it *ScanIterator) Close() {
+	it.scan.Close()
+}
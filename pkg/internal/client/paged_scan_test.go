@@ -0,0 +1,166 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// newScanTestDB returns a DB whose sender serves scans of the given keys,
+// bounded by MaxSpanRequestKeys.
+func newScanTestDB(keys []string) *DB {
+	return NewDB(newTestSender(func(ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+		br := ba.CreateReply()
+		for i, union := range ba.Requests {
+			req := union.GetInner()
+			span := req.Header()
+			var rows []roachpb.KeyValue
+			for _, k := range keys {
+				if k >= string(span.Key) && k < string(span.EndKey) {
+					rows = append(rows, roachpb.KeyValue{
+						Key: roachpb.Key(k), Value: roachpb.MakeValueFromString(k),
+					})
+				}
+			}
+			_, reverse := req.(*roachpb.ReverseScanRequest)
+			if reverse {
+				sort.Slice(rows, func(i, j int) bool { return rows[i].Key.Compare(rows[j].Key) > 0 })
+			}
+			var resume *roachpb.Span
+			if max := ba.MaxSpanRequestKeys; max > 0 && int64(len(rows)) > max {
+				if reverse {
+					resume = &roachpb.Span{Key: span.Key, EndKey: rows[max-1].Key}
+				} else {
+					resume = &roachpb.Span{Key: rows[max].Key, EndKey: span.EndKey}
+				}
+				rows = rows[:max]
+			}
+			if reverse {
+				resp := br.Responses[i].GetInner().(*roachpb.ReverseScanResponse)
+				resp.Rows, resp.ResumeSpan = rows, resume
+			} else {
+				resp := br.Responses[i].GetInner().(*roachpb.ScanResponse)
+				resp.Rows, resp.ResumeSpan = rows, resume
+			}
+		}
+		return br, nil
+	}), hlc.NewClock(hlc.UnixNano, 0))
+}
+
+func makeScanTestKeys(n int) []string {
+	var keys []string
+	for i := 0; i < n; i++ {
+		keys = append(keys, fmt.Sprintf("k%d", i))
+	}
+	return keys
+}
+
+func TestPagedScan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	keys := makeScanTestKeys(10)
+	db := newScanTestDB(keys)
+
+	testCases := []struct {
+		opts  PagedScanOptions
+		pages []int
+	}{
+		{opts: PagedScanOptions{PageKeys: 3}, pages: []int{3, 3, 3, 1}},
+		{opts: PagedScanOptions{PageKeys: 3, Prefetch: true}, pages: []int{3, 3, 3, 1}},
+		{opts: PagedScanOptions{PageKeys: 4, Reverse: true}, pages: []int{4, 4, 2}},
+		{opts: PagedScanOptions{PageKeys: 3, PageBytes: 1 << 20}, pages: []int{3, 3, 3, 1}},
+		// The pages get down to a single row once the size of the rows is known.
+		{opts: PagedScanOptions{PageKeys: 3, PageBytes: 1}, pages: []int{3, 1, 1, 1, 1, 1, 1, 1}},
+	}
+	ctx := context.Background()
+	for i, c := range testCases {
+		s, err := NewPagedScan(db, "k0", "l", c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pages []int
+		var scanned []string
+		for {
+			rows, err := s.Next(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) == 0 {
+				break
+			}
+			pages = append(pages, len(rows))
+			for _, row := range rows {
+				scanned = append(scanned, string(row.Key))
+			}
+		}
+		s.Close()
+
+		if !reflect.DeepEqual(pages, c.pages) {
+			t.Errorf("%d: expected pages of %d rows, got %d", i, c.pages, pages)
+		}
+		expected := append([]string(nil), keys...)
+		if c.opts.Reverse {
+			sort.Sort(sort.Reverse(sort.StringSlice(expected)))
+		}
+		if !reflect.DeepEqual(scanned, expected) {
+			t.Errorf("%d: expected %s, got %s", i, expected, scanned)
+		}
+		if span := s.ResumeSpan(); span.Key != nil {
+			t.Errorf("%d: expected an empty resume span, got %s", i, span)
+		}
+	}
+}
+
+func TestScanIterator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	keys := makeScanTestKeys(10)
+	db := newScanTestDB(keys)
+	ctx := context.Background()
+	for _, reverse := range []bool{false, true} {
+		it, err := NewScanIterator(db, "k0", "l", PagedScanOptions{PageKeys: 3, Reverse: reverse})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var scanned []string
+		for it.Next(ctx) {
+			scanned = append(scanned, string(it.KeyValue().Key))
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if it.Next(ctx) {
+			t.Errorf("reverse=%t: expected the iterator to remain exhausted", reverse)
+		}
+		it.Close()
+
+		expected := append([]string(nil), keys...)
+		if reverse {
+			sort.Sort(sort.Reverse(sort.StringSlice(expected)))
+		}
+		if !reflect.DeepEqual(scanned, expected) {
+			t.Errorf("reverse=%t: expected %s, got %s", reverse, expected, scanned)
+		}
+	}
+}
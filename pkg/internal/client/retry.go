@@ -0,0 +1,72 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package client
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+)
+
+// IsRetryableError returns whether an operation which failed with the given
+// error can be retried:
+//
+// - Transaction retry errors, whether or not they were handled by a Txn, are
+//   always retryable.
+// - Errors returned when a request could not be delivered to any replica, or
+//   was rejected by a draining node, are always retryable: the request wasn't
+//   carried out.
+// - AmbiguousResultErrors are only retryable if the operation is idempotent,
+//   since it may have been carried out.
+func IsRetryableError(err error, idempotent bool) bool {
+	switch err.(type) {
+	case *roachpb.UnhandledRetryableError, *roachpb.HandledRetryableTxnError,
+		*roachpb.SendError, *roachpb.NodeUnavailableError:
+		return true
+	case *roachpb.AmbiguousResultError:
+		return idempotent
+	}
+	return false
+}
+
+// RunWithRetries runs fn until it succeeds or fails with an error that isn't
+// retryable according to IsRetryableError, backing off between the attempts
+// according to opts. The error of the last attempt is returned if the retries
+// are exhausted or the context is canceled.
+//
+// The idempotent flag must only be set if running fn more than once has the
+// same effect as running it once; fn is then retried after ambiguous results.
+func RunWithRetries(
+	ctx context.Context, opts retry.Options, idempotent bool, fn func(context.Context) error,
+) error {
+	var err error
+	for r := retry.StartWithCtx(ctx, opts); r.Next(); {
+		err = fn(ctx)
+		if !IsRetryableError(err, idempotent) {
+			return err
+		}
+		log.VEventf(ctx, 2, "retrying after error: %s", err)
+	}
+	if err == nil {
+		// The loop ended before the first attempt.
+		if err = ctx.Err(); err == nil {
+			err = errors.New("retry loop aborted")
+		}
+	}
+	return err
+}
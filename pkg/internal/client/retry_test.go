@@ -0,0 +1,85 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+)
+
+func TestRunWithRetries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	opts := retry.Options{
+		InitialBackoff: time.Microsecond,
+		MaxBackoff:     time.Millisecond,
+		MaxRetries:     3,
+	}
+	retryErr := roachpb.NewSendError("boom")
+	ambiguousErr := roachpb.NewAmbiguousResultError("boom")
+	otherErr := errors.New("boom")
+
+	testCases := []struct {
+		errs        []error
+		idempotent  bool
+		expErr      error
+		expAttempts int
+	}{
+		{errs: nil, expAttempts: 1},
+		{errs: []error{retryErr, retryErr}, expAttempts: 3},
+		{errs: []error{otherErr}, expErr: otherErr, expAttempts: 1},
+		{errs: []error{retryErr, otherErr}, expErr: otherErr, expAttempts: 2},
+		// Ambiguous results are only retried for idempotent operations.
+		{errs: []error{ambiguousErr}, expErr: ambiguousErr, expAttempts: 1},
+		{errs: []error{ambiguousErr}, idempotent: true, expAttempts: 2},
+		// The error of the last attempt is returned once the retries are
+		// exhausted.
+		{errs: []error{retryErr, retryErr, retryErr, retryErr, retryErr}, expErr: retryErr, expAttempts: 4},
+	}
+	for i, tc := range testCases {
+		attempts := 0
+		err := RunWithRetries(context.Background(), opts, tc.idempotent, func(context.Context) error {
+			attempts++
+			if attempts <= len(tc.errs) {
+				return tc.errs[attempts-1]
+			}
+			return nil
+		})
+		if err != tc.expErr {
+			t.Errorf("%d: expected error %v, got %v", i, tc.expErr, err)
+		}
+		if attempts != tc.expAttempts {
+			t.Errorf("%d: expected %d attempts, got %d", i, tc.expAttempts, attempts)
+		}
+	}
+
+	// No attempt is made if the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts.InitialBackoff, opts.MaxBackoff = time.Hour, time.Hour
+	if err := RunWithRetries(ctx, opts, false, func(context.Context) error {
+		t.Fatal("unexpected attempt")
+		return nil
+	}); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
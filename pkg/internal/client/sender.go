@@ -18,6 +18,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 )
 
@@ -35,6 +36,34 @@ type SenderWithDistSQLBackdoor interface {
 	// GetTxnState returns the state that the TxnCoordSender has for a
 	// transaction. The bool is false is no state is found.
 	GetTxnState(txnID uuid.UUID) (roachpb.Transaction, bool)
+
+	// DisableReadRefresh tells the TxnCoordSender that the transaction reads
+	// data without going through it, in its current epoch. The reads of the
+	// transaction then can't be refreshed to avoid restarting it when its
+	// timestamp is pushed.
+	DisableReadRefresh(txn roachpb.Transaction)
+
+	// AddLeafReads adds the spans read by a leaf txn of the transaction, in its
+	// current epoch, to the reads which are refreshed when its timestamp is
+	// pushed.
+	AddLeafReads(txn roachpb.Transaction, spans []roachpb.Span)
+}
+
+// RangeFeeder is implemented by the senders able to stream the changes
+// committed to a key span, see DB.RangeFeed.
+type RangeFeeder interface {
+	RangeFeed(
+		ctx context.Context,
+		span roachpb.Span,
+		startFrom hlc.Timestamp,
+		eventC chan<- *roachpb.RangeFeedEvent,
+	) error
+}
+
+// SSTableAdder is implemented by the senders able to ingest sstables which
+// span several ranges, see DB.AddSSTable.
+type SSTableAdder interface {
+	AddSSTable(ctx context.Context, span roachpb.Span, data []byte) error
 }
 
 // SenderFunc is an adapter to allow the use of ordinary functions
@@ -58,6 +58,8 @@ type Txn struct {
 		// TODO(andrei): Can this go away now that UserPriority and Proto.Priority
 		// are initialized at the same time?
 		UserPriority roachpb.UserPriority
+		// QoSClass is the class of service of the transaction's batches.
+		QoSClass roachpb.QoSClass
 		// active is set whenever the transaction is actively running. It will
 		// be initially set when the transaction sends its first batch, but is
 		// reset if the transaction is aborted.
@@ -90,11 +92,20 @@ type Txn struct {
 		// TODO(andrei): This is broken for DistSQL, which doesn't account for the
 		// requests it uses the transaction for.
 		commandCount int
+		// savepoints holds the active savepoints and the undo log used to roll
+		// back to them.
+		savepoints txnSavepoints
+		// leafReads holds the spans read by a leaf txn, to be refreshed by the
+		// root txn if its timestamp gets pushed (see LeafState).
+		leafReads []roachpb.Span
 	}
 
 	// Set for DistSQL transactions that get errors that would otherwise be
 	// handled by the TxnCoordSender.
 	acceptUnhandledRetryableErrors bool
+
+	// leaf is set for transactions created through NewLeafTxn.
+	leaf bool
 }
 
 // NewTxn returns a new txn.
@@ -121,6 +132,21 @@ func NewTxnWithProto(db *DB, proto roachpb.Transaction) *Txn {
 	return txn
 }
 
+// NewLeafTxn returns a txn that runs requests on behalf of a root txn, which
+// is described by the provided Transaction proto. Leaf txns are used by
+// DistSQL flows; they bypass the local TxnCoordSender and get the retryable
+// errors that it would otherwise handle. Leaf txns are read-only and can be
+// used by multiple goroutines concurrently, and several of them can run
+// concurrently on behalf of the same root txn, on any node. The state that a
+// leaf txn accumulates while running requests can be merged back into the
+// root txn with UpdateStateOnLeafTxn.
+func NewLeafTxn(db *DB, proto roachpb.Transaction) *Txn {
+	txn := NewTxnWithProto(db, proto)
+	txn.acceptUnhandledRetryableErrors = true
+	txn.leaf = true
+	return txn
+}
+
 // ID returns the current ID of the transaction.
 func (txn *Txn) ID() uuid.UUID {
 	txn.mu.Lock()
@@ -199,6 +225,31 @@ func (txn *Txn) UserPriority() roachpb.UserPriority {
 	return txn.mu.UserPriority
 }
 
+// SetQoSClass sets the class of service of the transaction. Transactions
+// default to roachpb.QOS_NORMAL; bulk background work such as backfills should
+// use roachpb.QOS_BACKGROUND so that it is admitted and retried strictly below
+// foreground traffic. The class must be set before any operations are
+// performed on the transaction.
+func (txn *Txn) SetQoSClass(class roachpb.QoSClass) error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.mu.QoSClass == class {
+		return nil
+	}
+	if txn.mu.active {
+		return errors.Errorf("cannot change the QoS class of a running transaction")
+	}
+	txn.mu.QoSClass = class
+	return nil
+}
+
+// QoSClass returns the transaction's class of service.
+func (txn *Txn) QoSClass() roachpb.QoSClass {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.QoSClass
+}
+
 // SetDebugName sets the debug name associated with the transaction which will
 // appear in log files and the web UI.
 func (txn *Txn) SetDebugName(name string) {
@@ -299,6 +350,78 @@ func (txn *Txn) Proto() *roachpb.Transaction {
 	return &txn.mu.Proto
 }
 
+// IsLeaf returns true if the txn was created through NewLeafTxn.
+func (txn *Txn) IsLeaf() bool {
+	return txn.leaf
+}
+
+// LeafState returns the state accumulated by a leaf txn: a copy of its
+// Transaction proto and the spans it read. It is to be passed to
+// UpdateStateOnLeafTxn on the root txn once the leaf is done. Unlike Proto(),
+// it is safe to call while requests are executing concurrently.
+func (txn *Txn) LeafState(ctx context.Context) roachpb.LeafTxnFinalState {
+	if !txn.leaf {
+		log.Fatalf(ctx, "LeafState called on root txn %s", txn.DebugName())
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	refreshSpans, _ := roachpb.MergeSpans(append([]roachpb.Span(nil), txn.mu.leafReads...))
+	return roachpb.LeafTxnFinalState{
+		Txn:          txn.mu.Proto.Clone(),
+		RefreshSpans: refreshSpans,
+	}
+}
+
+// UpdateStateOnLeafTxn updates the root txn with the state of one of its leaf
+// txns, as returned by LeafState. The clock observations made by the leaf's
+// requests are absorbed, so that later requests of the txn don't needlessly
+// get uncertainty restarts on the nodes the leaf read from. The spans read by
+// the leaf are handed to the TxnCoordSender, which refreshes them along with
+// the txn's own reads if its timestamp gets pushed. The state of a leaf that
+// ran in a previous epoch or incarnation of the txn is ignored.
+func (txn *Txn) UpdateStateOnLeafTxn(ctx context.Context, leaf *roachpb.LeafTxnFinalState) {
+	if txn.leaf {
+		log.Fatalf(ctx, "UpdateStateOnLeafTxn called on leaf txn %s", txn.DebugName())
+	}
+	txn.mu.Lock()
+	if leaf.Txn.ID != txn.mu.Proto.ID || leaf.Txn.Epoch != txn.mu.Proto.Epoch {
+		txn.mu.Unlock()
+		return
+	}
+	for _, v := range leaf.Txn.ObservedTimestamps {
+		txn.mu.Proto.UpdateObservedTimestamp(v.NodeID, v.Timestamp)
+	}
+	// The reads of the leaf can only be refreshed from the timestamp they were
+	// performed at. If the root's reads were refreshed in the meantime, the
+	// reads of the leaf weren't validated up to the new timestamp.
+	refreshValid := !leaf.RefreshInvalid && leaf.Txn.OrigTimestamp == txn.mu.Proto.OrigTimestamp
+	proto := txn.mu.Proto.Clone()
+	txn.mu.Unlock()
+
+	s, ok := txn.db.GetSender().(SenderWithDistSQLBackdoor)
+	if !ok {
+		return
+	}
+	if refreshValid {
+		s.AddLeafReads(proto, leaf.RefreshSpans)
+	} else {
+		s.DisableReadRefresh(proto)
+	}
+}
+
+// DisableReadRefresh must be called on a root txn before it reads data through
+// leaf txns whose state won't be merged back with UpdateStateOnLeafTxn. The
+// reads of the txn can't be refreshed then, so it restarts if its timestamp
+// gets pushed, unless it restarts for another reason first.
+func (txn *Txn) DisableReadRefresh() {
+	txn.mu.Lock()
+	proto := txn.mu.Proto.Clone()
+	txn.mu.Unlock()
+	if s, ok := txn.db.GetSender().(SenderWithDistSQLBackdoor); ok {
+		s.DisableReadRefresh(proto)
+	}
+}
+
 // IsSerializableRestart returns true if the transaction is serializable and
 // its timestamp has been pushed. Used to detect whether the txn will be
 // allowed to commit.
@@ -374,6 +497,17 @@ func (txn *Txn) CPut(ctx context.Context, key, value, expValue interface{}) erro
 	return getOneErr(txn.Run(ctx, b), b)
 }
 
+// CPutAllowingIfNotExists is like CPut except it also succeeds if the key
+// doesn't exist.
+//
+// key can be either a byte slice or a string. value can be any key type, a
+// proto.Message or any Go primitive type (bool, int, etc).
+func (txn *Txn) CPutAllowingIfNotExists(ctx context.Context, key, value, expValue interface{}) error {
+	b := txn.NewBatch()
+	b.CPutAllowingIfNotExists(key, value, expValue)
+	return getOneErr(txn.Run(ctx, b), b)
+}
+
 // InitPut sets the first value for a key to value. An error is reported if a
 // value already exists for the key and it's not equal to the value passed in.
 // If failOnTombstones is set to true, tombstones count as mismatched values
@@ -768,8 +902,12 @@ func (txn *Txn) Exec(
 
 		txn.commitTriggers = nil
 
-		log.VEventf(ctx, 2, "automatically retrying transaction: %s because of error: %s",
-			txn.DebugName(), err)
+		log.StructuredEvent(ctx, &roachpb.TxnRetryEvent{
+			TxnName: txn.DebugName(),
+			TxnID:   retErr.TxnID,
+			Epoch:   retErr.Transaction.Epoch,
+			Reason:  retErr.Msg,
+		})
 	}
 
 	return err
@@ -804,6 +942,17 @@ func (txn *Txn) isRetryableErrMeantForTxnLocked(retryErr roachpb.HandledRetryabl
 // required (or even erroneous). Returns (nil, nil) for an empty batch.
 func (txn *Txn) Send(
 	ctx context.Context, ba roachpb.BatchRequest,
+) (*roachpb.BatchResponse, *roachpb.Error) {
+	if pErr := txn.maybeRecordUndo(ctx, ba); pErr != nil {
+		return nil, pErr
+	}
+	return txn.send(ctx, ba)
+}
+
+// send is like Send, without recording the prior values of the keys written
+// by the batch for the active savepoints.
+func (txn *Txn) send(
+	ctx context.Context, ba roachpb.BatchRequest,
 ) (*roachpb.BatchResponse, *roachpb.Error) {
 	// It doesn't make sense to use inconsistent reads in a transaction. However,
 	// we still need to accept it as a parameter for this to compile.
@@ -841,6 +990,9 @@ func (txn *Txn) Send(
 		if txn.mu.UserPriority != 0 {
 			ba.UserPriority = txn.mu.UserPriority
 		}
+		if txn.mu.QoSClass != roachpb.QOS_NORMAL {
+			ba.QoSClass = txn.mu.QoSClass
+		}
 
 		if !txn.mu.active {
 			user := roachpb.MakePriority(ba.UserPriority)
@@ -899,6 +1051,9 @@ func (txn *Txn) Send(
 		ba.Txn = &newTxn
 		return nil
 	}
+	if txn.leaf && ba.IsWrite() {
+		return nil, roachpb.NewErrorf("cannot write through leaf txn: %s", ba)
+	}
 	if pErr := lockedPrelude(); pErr != nil {
 		return nil, pErr
 	}
@@ -979,6 +1134,12 @@ func (txn *Txn) Send(
 		// header. Some errors (e.g. a restart) have a Txn attached to them as
 		// well; these errors have been handled above.
 		txn.mu.Proto.Update(br.Txn)
+
+		if txn.leaf {
+			ba.RefreshSpanIterate(br, func(key, endKey roachpb.Key) {
+				txn.mu.leafReads = append(txn.mu.leafReads, roachpb.Span{Key: key, EndKey: endKey})
+			})
+		}
 	}
 
 	if elideEndTxn {
@@ -0,0 +1,240 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package client
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+)
+
+// Savepoint identifies a point in a transaction to which the transaction's
+// writes can be rolled back, see Txn.CreateSavepoint.
+type Savepoint struct {
+	// txnID and epoch identify the incarnation of the transaction in which
+	// the savepoint was created. A restart discards all the writes of the
+	// transaction, and with them its savepoints.
+	txnID uuid.UUID
+	epoch uint32
+	// seq is the sequence number of the transaction when the savepoint was
+	// created.
+	seq int32
+	// index is the position of the savepoint in the stack of active
+	// savepoints, and undoLen the length of the undo log at its creation.
+	index   int
+	undoLen int
+}
+
+// undoEntry records the value of a key before it was first written after the
+// creation of the latest savepoint. A nil value means that the key didn't
+// exist.
+type undoEntry struct {
+	key   roachpb.Key
+	value *roachpb.Value
+}
+
+// txnSavepoints holds the savepoint state of a transaction.
+type txnSavepoints struct {
+	txnID uuid.UUID
+	epoch uint32
+	// marks is the stack of active savepoints, holding for each of them the
+	// length of the undo log at its creation.
+	marks []int
+	// undo is the undo log. The entries following a mark restore the values
+	// the keys had when the savepoint was created.
+	undo []undoEntry
+	// keys is the set of keys recorded in the undo log since the latest mark.
+	keys map[string]struct{}
+}
+
+var errSavepointInvalid = errors.New("savepoint no longer exists")
+
+// CreateSavepoint creates a savepoint to which the writes performed by the
+// transaction afterwards can be rolled back. While savepoints are active, the
+// prior value of each key about to be written is read first, which makes
+// writes more expensive. Savepoints don't survive transaction restarts, and
+// mustn't be used concurrently with the transaction's writes.
+func (txn *Txn) CreateSavepoint(ctx context.Context) (Savepoint, error) {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	sp := &txn.mu.savepoints
+	if sp.txnID != txn.mu.Proto.ID || sp.epoch != txn.mu.Proto.Epoch {
+		*sp = txnSavepoints{txnID: txn.mu.Proto.ID, epoch: txn.mu.Proto.Epoch}
+	}
+	sp.marks = append(sp.marks, len(sp.undo))
+	sp.keys = map[string]struct{}{}
+	return Savepoint{
+		txnID:   sp.txnID,
+		epoch:   sp.epoch,
+		seq:     txn.mu.Proto.Sequence,
+		index:   len(sp.marks) - 1,
+		undoLen: len(sp.undo),
+	}, nil
+}
+
+// RollbackToSavepoint discards the writes performed by the transaction since
+// the given savepoint was created, by restoring the prior values of the keys
+// written since. The savepoint remains active, while those created after it
+// are released.
+func (txn *Txn) RollbackToSavepoint(ctx context.Context, s Savepoint) error {
+	txn.mu.Lock()
+	if err := txn.checkSavepointLocked(s); err != nil {
+		txn.mu.Unlock()
+		return err
+	}
+	sp := &txn.mu.savepoints
+	entries := sp.undo[s.undoLen:]
+	txn.mu.Unlock()
+
+	// The first entry for a key holds its value as of the savepoint; later
+	// ones were recorded for savepoints which are being released.
+	var ba roachpb.BatchRequest
+	restored := map[string]struct{}{}
+	for _, e := range entries {
+		if _, ok := restored[string(e.key)]; ok {
+			continue
+		}
+		restored[string(e.key)] = struct{}{}
+		if e.value != nil {
+			ba.Add(&roachpb.PutRequest{Span: roachpb.Span{Key: e.key}, Value: *e.value})
+		} else {
+			ba.Add(&roachpb.DeleteRequest{Span: roachpb.Span{Key: e.key}})
+		}
+	}
+	if len(ba.Requests) > 0 {
+		if _, pErr := txn.send(ctx, ba); pErr != nil {
+			return pErr.GoError()
+		}
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if err := txn.checkSavepointLocked(s); err != nil {
+		return err
+	}
+	sp.marks = sp.marks[:s.index+1]
+	sp.undo = sp.undo[:s.undoLen]
+	sp.keys = map[string]struct{}{}
+	return nil
+}
+
+// ReleaseSavepoint releases the given savepoint, as well as those created
+// after it. The writes performed since are kept, and can still be rolled
+// back to an earlier savepoint.
+func (txn *Txn) ReleaseSavepoint(s Savepoint) error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if err := txn.checkSavepointLocked(s); err != nil {
+		return err
+	}
+	sp := &txn.mu.savepoints
+	sp.marks = sp.marks[:s.index]
+	if len(sp.marks) == 0 {
+		*sp = txnSavepoints{}
+		return nil
+	}
+	sp.keys = map[string]struct{}{}
+	for _, e := range sp.undo[sp.marks[len(sp.marks)-1]:] {
+		sp.keys[string(e.key)] = struct{}{}
+	}
+	return nil
+}
+
+// checkSavepointLocked returns an error if the given savepoint isn't active.
+func (txn *Txn) checkSavepointLocked(s Savepoint) error {
+	sp := &txn.mu.savepoints
+	if s.txnID != txn.mu.Proto.ID || s.epoch != txn.mu.Proto.Epoch {
+		return errors.Errorf("savepoint created at sequence %d invalidated by transaction restart", s.seq)
+	}
+	if sp.txnID != s.txnID || sp.epoch != s.epoch ||
+		s.index >= len(sp.marks) || sp.marks[s.index] != s.undoLen {
+		return errSavepointInvalid
+	}
+	return nil
+}
+
+// maybeRecordUndo reads and records in the undo log the prior values of the
+// keys written by the batch which haven't been recorded since the latest
+// savepoint, if any savepoint is active.
+func (txn *Txn) maybeRecordUndo(ctx context.Context, ba roachpb.BatchRequest) *roachpb.Error {
+	txn.mu.Lock()
+	sp := &txn.mu.savepoints
+	if len(sp.marks) == 0 || sp.txnID != txn.mu.Proto.ID || sp.epoch != txn.mu.Proto.Epoch {
+		txn.mu.Unlock()
+		return nil
+	}
+	var reads roachpb.BatchRequest
+	for _, union := range ba.Requests {
+		switch req := union.GetInner().(type) {
+		case *roachpb.PutRequest, *roachpb.ConditionalPutRequest, *roachpb.InitPutRequest,
+			*roachpb.IncrementRequest, *roachpb.DeleteRequest:
+			key := req.Header().Key
+			if _, ok := sp.keys[string(key)]; !ok {
+				reads.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: key}})
+			}
+		case *roachpb.DeleteRangeRequest:
+			reads.Add(&roachpb.ScanRequest{Span: req.Span})
+		case *roachpb.EndTransactionRequest:
+		default:
+			if roachpb.IsTransactionWrite(req) {
+				txn.mu.Unlock()
+				return roachpb.NewErrorf("%s not supported while savepoints are active", req.Method())
+			}
+		}
+	}
+	txn.mu.Unlock()
+	if len(reads.Requests) == 0 {
+		return nil
+	}
+
+	br, pErr := txn.send(ctx, reads)
+	if pErr != nil {
+		return pErr
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if len(sp.marks) == 0 {
+		return nil
+	}
+	record := func(key roachpb.Key, value *roachpb.Value) {
+		if _, ok := sp.keys[string(key)]; ok {
+			return
+		}
+		sp.keys[string(key)] = struct{}{}
+		if value != nil {
+			// The value is replayed as a Put, which can't carry the timestamp
+			// of the version it was read from.
+			v := roachpb.Value{RawBytes: append([]byte(nil), value.RawBytes...)}
+			v.ClearChecksum()
+			v.InitChecksum(key)
+			value = &v
+		}
+		sp.undo = append(sp.undo, undoEntry{key: key, value: value})
+	}
+	for i, union := range br.Responses {
+		switch resp := union.GetInner().(type) {
+		case *roachpb.GetResponse:
+			record(reads.Requests[i].GetInner().Header().Key, resp.Value)
+		case *roachpb.ScanResponse:
+			for j := range resp.Rows {
+				record(resp.Rows[j].Key, &resp.Rows[j].Value)
+			}
+		}
+	}
+	return nil
+}
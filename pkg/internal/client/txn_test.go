@@ -737,6 +737,47 @@ func TestSetPriority(t *testing.T) {
 	}
 }
 
+// TestSetQoSClass verifies that the QoS class of a transaction is set on its
+// batches and cannot be changed once the transaction is running.
+func TestSetQoSClass(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	clock := hlc.NewClock(hlc.UnixNano, 0)
+	var expected roachpb.QoSClass
+	db := NewDB(newTestSender(
+		func(ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+			if ba.QoSClass != expected {
+				return nil, roachpb.NewErrorf("expected QoS class %s, got %s", expected, ba.QoSClass)
+			}
+			br := &roachpb.BatchResponse{}
+			br.Txn = &roachpb.Transaction{}
+			br.Txn.Update(ba.Txn) // copy
+			return br, nil
+		}), clock)
+
+	for _, class := range []roachpb.QoSClass{roachpb.QOS_NORMAL, roachpb.QOS_BACKGROUND} {
+		expected = class
+		txn := NewTxn(db)
+		if err := txn.SetQoSClass(class); err != nil {
+			t.Fatal(err)
+		}
+		if _, pErr := txn.Send(context.Background(), roachpb.BatchRequest{}); pErr != nil {
+			t.Fatal(pErr)
+		}
+		if txn.QoSClass() != class {
+			t.Fatalf("expected QoS class %s, got %s", class, txn.QoSClass())
+		}
+		if err := txn.SetQoSClass(class); err != nil {
+			t.Fatal(err)
+		}
+		if err := txn.SetQoSClass(1 - class); !testutils.IsError(
+			err, "cannot change the QoS class of a running transaction",
+		) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
 // Tests that a retryable error for an inner txn doesn't cause the outer txn to
 // be retried.
 func TestWrongTxnRetry(t *testing.T) {
@@ -871,3 +912,152 @@ func TestConcurrentTxnRequests(t *testing.T) {
 		t.Errorf("expected %v, got %v", expectedCallCounts, callCounts)
 	}
 }
+
+// TestLeafTxnState verifies that a root txn absorbs the clock observations
+// made by the requests of its leaf txns, and that leaf txns record the spans
+// they read.
+func TestLeafTxnState(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	clock := hlc.NewClock(hlc.UnixNano, 0)
+	const nodeID = roachpb.NodeID(2)
+	observedTS := hlc.Timestamp{WallTime: 123}
+	db := NewDB(newTestSender(func(ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+		br := ba.CreateReply()
+		txnClone := ba.Txn.Clone()
+		br.Txn = &txnClone
+		br.Txn.UpdateObservedTimestamp(nodeID, observedTS)
+		return br, nil
+	}), clock)
+
+	root := NewTxn(db)
+	leaf := NewLeafTxn(db, *root.Proto())
+	if root.IsLeaf() || !leaf.IsLeaf() {
+		t.Fatalf("expected only the leaf txn to be a leaf")
+	}
+	if _, err := leaf.Get(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leaf.Scan(ctx, "b", "c", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.Put(ctx, "a", "value"); !testutils.IsError(err, "cannot write through leaf txn") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	leafState := leaf.LeafState(ctx)
+	expSpans := []roachpb.Span{
+		{Key: roachpb.Key("a")},
+		{Key: roachpb.Key("b"), EndKey: roachpb.Key("c")},
+	}
+	if !reflect.DeepEqual(leafState.RefreshSpans, expSpans) {
+		t.Fatalf("expected refresh spans %v, got %v", expSpans, leafState.RefreshSpans)
+	}
+
+	// The state of a leaf from a previous epoch is ignored.
+	staleState := leafState
+	staleState.Txn = leafState.Txn.Clone()
+	staleState.Txn.Epoch--
+	root.Proto().Epoch++
+	root.UpdateStateOnLeafTxn(ctx, &staleState)
+	if _, ok := root.Proto().GetObservedTimestamp(nodeID); ok {
+		t.Fatalf("unexpected observed timestamp in root txn: %s", root.Proto())
+	}
+
+	leafState.Txn.Epoch++
+	root.UpdateStateOnLeafTxn(ctx, &leafState)
+	if ts, ok := root.Proto().GetObservedTimestamp(nodeID); !ok || ts != observedTS {
+		t.Fatalf("expected observed timestamp %s in root txn, got: %s", observedTS, root.Proto())
+	}
+}
+
+// TestTxnSavepoints verifies that rolling back to a savepoint restores the
+// values the keys written since had when the savepoint was created.
+func TestTxnSavepoints(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	clock := hlc.NewClock(hlc.UnixNano, 0)
+	kvs := map[string]roachpb.Value{}
+	db := NewDB(newTestSender(func(ba roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+		br := ba.CreateReply()
+		for i, union := range ba.Requests {
+			switch req := union.GetInner().(type) {
+			case *roachpb.GetRequest:
+				if v, ok := kvs[string(req.Key)]; ok {
+					br.Responses[i].GetInner().(*roachpb.GetResponse).Value = &v
+				}
+			case *roachpb.PutRequest:
+				kvs[string(req.Key)] = req.Value
+			case *roachpb.DeleteRequest:
+				delete(kvs, string(req.Key))
+			}
+		}
+		return br, nil
+	}), clock)
+
+	ctx := context.Background()
+	txn := NewTxn(db)
+	expect := func(key string, exp string) {
+		kv, err := txn.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var act string
+		if kv.Value != nil {
+			b, err := kv.Value.GetBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			act = string(b)
+		}
+		if act != exp {
+			t.Errorf("expected %q at %q, got %q", exp, key, act)
+		}
+	}
+
+	if err := txn.Put(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	sp1, err := txn.CreateSavepoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, "a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, "b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	sp2, err := txn.CreateSavepoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, "a", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Del(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := txn.RollbackToSavepoint(ctx, sp2); err != nil {
+		t.Fatal(err)
+	}
+	expect("a", "2")
+	expect("b", "2")
+
+	if err := txn.RollbackToSavepoint(ctx, sp1); err != nil {
+		t.Fatal(err)
+	}
+	expect("a", "1")
+	expect("b", "")
+
+	// Rolling back to sp1 released sp2.
+	if err := txn.RollbackToSavepoint(ctx, sp2); !testutils.IsError(err, "savepoint no longer exists") {
+		t.Fatalf("expected released savepoint error, got %v", err)
+	}
+	if err := txn.ReleaseSavepoint(sp1); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, "a", "4"); err != nil {
+		t.Fatal(err)
+	}
+	expect("a", "4")
+}
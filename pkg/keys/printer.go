@@ -538,6 +538,100 @@ func PrettyPrint(key roachpb.Key) string {
 	return prettyPrintInternal(key, true)
 }
 
+// RedactedMarker replaces the parts of a key which may contain user data in
+// the output of PrettyPrintRedacted.
+const RedactedMarker = "‹×›"
+
+// PrettyPrintRedacted prints the key like PrettyPrint, but without the parts
+// which may contain user data, so that the output can be shared freely (for
+// example in traces sent to a collector). Table keys are printed down to
+// their index, local keys down to their prefix, and the addressed key of
+// meta keys is redacted likewise; system keys are printed in full and other
+// keys are redacted entirely.
+func PrettyPrintRedacted(key roachpb.Key) string {
+	for _, k := range constKeyDict {
+		if key.Equal(k.value) {
+			return k.name
+		}
+	}
+	for _, k := range keyOfKeyDict {
+		if bytes.HasPrefix(key, k.prefix) {
+			return k.name + PrettyPrintRedacted(key[len(k.prefix):])
+		}
+	}
+	switch {
+	case key.Compare(LocalMax) < 0:
+		return "/Local/" + RedactedMarker
+	case key.Compare(SystemMax) <= 0:
+		return PrettyPrint(key)
+	case key.Compare(TableDataMin) >= 0 && key.Compare(TableDataMax) < 0:
+		rest, _, err := DecodeTablePrefix(key)
+		if err != nil {
+			return "/Table/" + RedactedMarker
+		}
+		if len(rest) > 0 {
+			if indexRest, _, err := encoding.DecodeUvarintAscending(rest); err == nil {
+				rest = indexRest
+			}
+		}
+		prefix := PrettyPrint(key[:len(key)-len(rest)])
+		if len(rest) == 0 {
+			return prefix
+		}
+		return prefix + "/" + RedactedMarker
+	}
+	return "/" + RedactedMarker
+}
+
+// PrettyPrintRedactedRange prints the key range [start, end) with its keys
+// printed by PrettyPrintRedacted.
+func PrettyPrintRedactedRange(start, end roachpb.Key) string {
+	if len(end) == 0 {
+		return PrettyPrintRedacted(start)
+	}
+	return PrettyPrintRedacted(start) + "-" + PrettyPrintRedacted(end)
+}
+
+// KeyPrinter pretty-prints keys, and the spans and batches they're part of,
+// for error and log messages. If Redact is set, the parts of the keys which
+// may contain user data are redacted (see PrettyPrintRedacted), which keeps
+// the messages readable without leaking the data.
+type KeyPrinter struct {
+	Redact bool
+}
+
+// Key prints the key.
+func (p KeyPrinter) Key(key roachpb.Key) string {
+	if p.Redact {
+		return PrettyPrintRedacted(key)
+	}
+	return PrettyPrint(key)
+}
+
+// Span prints the key span [start, end).
+func (p KeyPrinter) Span(start, end roachpb.Key) string {
+	if p.Redact {
+		return PrettyPrintRedactedRange(start, end)
+	}
+	return roachpb.Span{Key: start, EndKey: end}.String()
+}
+
+// Batch prints the requests of the batch and their keys, like
+// BatchRequest.String.
+func (p KeyPrinter) Batch(ba roachpb.BatchRequest) string {
+	return ba.StringWithKeys(p.Key)
+}
+
+// BatchSummary prints the summary of the batch (see BatchRequest.Summary).
+func (p KeyPrinter) BatchSummary(ba roachpb.BatchRequest) string {
+	return ba.SummaryWithKeys(p.Key)
+}
+
+// BatchSpan prints the key span of the batch (see BatchRequest.KeySpan).
+func (p KeyPrinter) BatchSpan(ba roachpb.BatchRequest) string {
+	return ba.KeySpanWithKeys(p.Key)
+}
+
 var errIllegalInput = errors.New("illegal input")
 
 // UglyPrint is a partial right inverse to PrettyPrint: it takes a key
@@ -210,3 +210,66 @@ func TestPrettyPrintRange(t *testing.T) {
 		}
 	}
 }
+
+func TestPrettyPrintRedacted(t *testing.T) {
+	tableKey := makeKey(MakeTablePrefix(61), encoding.EncodeUvarintAscending(nil, 1),
+		encoding.EncodeStringAscending(nil, "secret"))
+
+	testCases := []struct {
+		key      roachpb.Key
+		expected string
+	}{
+		{MinKey, "/Min"},
+		{MaxKey, "/Max"},
+		{RangeDescriptorKey(roachpb.RKey("secret")), "/Local/‹×›"},
+		{NodeLivenessKey(10033), "/System/NodeLiveness/10033"},
+		{SystemMax, "/System/Max"},
+		{roachpb.Key("secret"), "/‹×›"},
+		{MakeTablePrefix(61), "/Table/61"},
+		{makeKey(MakeTablePrefix(61), encoding.EncodeUvarintAscending(nil, 1)), "/Table/61/1"},
+		{tableKey, "/Table/61/1/‹×›"},
+		{RangeMetaKey(roachpb.RKey(tableKey)), "/Meta2/Table/61/1/‹×›"},
+		{RangeMetaKey(roachpb.RKey("secret")), "/Meta2/‹×›"},
+		{Meta2KeyMax, "/Meta2/Max"},
+	}
+
+	for i, tc := range testCases {
+		if str := PrettyPrintRedacted(tc.key); str != tc.expected {
+			t.Errorf("%d: expected \"%s\", got \"%s\"", i, tc.expected, str)
+		}
+	}
+
+	if str, exp := PrettyPrintRedactedRange(tableKey, MaxKey), "/Table/61/1/‹×›-/Max"; str != exp {
+		t.Errorf("expected \"%s\", got \"%s\"", exp, str)
+	}
+}
+
+func TestKeyPrinter(t *testing.T) {
+	tableKey := makeKey(MakeTablePrefix(61), encoding.EncodeUvarintAscending(nil, 1),
+		encoding.EncodeStringAscending(nil, "secret"))
+	var ba roachpb.BatchRequest
+	ba.Add(roachpb.NewGet(tableKey))
+	ba.Add(roachpb.NewScan(tableKey, MaxKey))
+
+	testCases := []struct {
+		redact           bool
+		key, span, batch string
+	}{
+		{false, `/Table/61/1/"secret"`, `/{Table/61/1/"secret"-Max}`,
+			`Get [/Table/61/1/"secret",/Min), Scan [/Table/61/1/"secret",/Max)`},
+		{true, `/Table/61/1/‹×›`, `/Table/61/1/‹×›-/Max`,
+			`Get [/Table/61/1/‹×›,/Min), Scan [/Table/61/1/‹×›,/Max)`},
+	}
+	for _, tc := range testCases {
+		p := KeyPrinter{Redact: tc.redact}
+		if str := p.Key(tableKey); str != tc.key {
+			t.Errorf("redact=%t: expected key \"%s\", got \"%s\"", tc.redact, tc.key, str)
+		}
+		if str := p.Span(tableKey, MaxKey); str != tc.span {
+			t.Errorf("redact=%t: expected span \"%s\", got \"%s\"", tc.redact, tc.span, str)
+		}
+		if str := p.Batch(ba); str != tc.batch {
+			t.Errorf("redact=%t: expected batch \"%s\", got \"%s\"", tc.redact, tc.batch, str)
+		}
+	}
+}
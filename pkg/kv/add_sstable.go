@@ -0,0 +1,154 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// maxAddSSTableRetries is the number of times the ingestion of an sstable
+// by a range is retried after an ambiguous result.
+const maxAddSSTableRetries = 10
+
+// AddSSTable ingests the given sstable, whose keys must all be contained in
+// the given span. The sstable is split at the boundaries of the ranges it
+// overlaps, and each piece is sent in an AddSSTable request to its range; the
+// pieces are split again if their range splits before they are ingested. The
+// ingestion isn't atomic: some of the pieces may have been ingested when an
+// error is returned.
+func (ds *DistSender) AddSSTable(ctx context.Context, span roachpb.Span, data []byte) error {
+	ctx = ds.AnnotateCtx(ctx)
+	startKey, err := keys.Addr(span.Key)
+	if err != nil {
+		return err
+	}
+	endKey, err := keys.AddrUpperBound(span.EndKey)
+	if err != nil {
+		return err
+	}
+	return ds.addSSTable(ctx, roachpb.RSpan{Key: startKey, EndKey: endKey}, data)
+}
+
+// addSSTable ingests the given sstable, whose keys are all contained in rs.
+func (ds *DistSender) addSSTable(ctx context.Context, rs roachpb.RSpan, data []byte) error {
+	span := roachpb.Span{Key: rs.Key.AsRawKey(), EndKey: rs.EndKey.AsRawKey()}
+	for i := 0; ; i++ {
+		ri := NewRangeIterator(ds)
+		ri.Seek(ctx, rs.Key, Ascending)
+		if !ri.Valid() {
+			return ri.Error().GoError()
+		}
+		if ri.NeedAnother(rs) {
+			return ds.splitAndAddSSTable(ctx, rs, data, ri)
+		}
+
+		log.VEventf(ctx, 2, "sending AddSSTable [%s,%s) to r%d", span.Key, span.EndKey, ri.Desc().RangeID)
+		var ba roachpb.BatchRequest
+		ba.Add(&roachpb.AddSSTableRequest{Span: span, Data: data})
+		_, pErr := ds.Send(ctx, ba)
+		if pErr == nil {
+			return nil
+		}
+		switch pErr.GetDetail().(type) {
+		case *roachpb.RangeKeyMismatchError:
+			// The range split since it was looked up. Its descriptor was evicted
+			// from the cache, so the sstable gets split along the new ranges.
+			log.VEventf(ctx, 2, "AddSSTable [%s,%s) spans several ranges: %s", span.Key, span.EndKey, pErr)
+			continue
+		case *roachpb.AmbiguousResultError:
+			// The ingestion of an sstable is idempotent.
+			if i < maxAddSSTableRetries {
+				log.Warningf(ctx, "addsstable [%s,%s) attempt %d failed: %s", span.Key, span.EndKey, i, pErr)
+				continue
+			}
+		}
+		return errors.Wrapf(pErr.GoError(), "addsstable [%s,%s)", span.Key, span.EndKey)
+	}
+}
+
+// splitAndAddSSTable splits the given sstable, whose keys are all contained in
+// rs, at the boundaries of the ranges rs overlaps, starting from the range
+// the iterator is positioned at, and ingests each of the pieces.
+func (ds *DistSender) splitAndAddSSTable(
+	ctx context.Context, rs roachpb.RSpan, data []byte, ri *RangeIterator,
+) error {
+	reader := engine.MakeRocksDBSstFileReader()
+	defer reader.Close()
+	if err := reader.IngestExternalFile(data); err != nil {
+		return errors.Wrap(err, "reading sstable")
+	}
+
+	for ; ri.Valid(); ri.Next(ctx) {
+		partialRS, err := rs.Intersect(ri.Desc())
+		if err != nil {
+			return err
+		}
+		piece, pieceRS, err := makeSSTablePiece(&reader, partialRS)
+		if err != nil {
+			return err
+		}
+		if piece != nil {
+			if err := ds.addSSTable(ctx, pieceRS, piece); err != nil {
+				return err
+			}
+		}
+		if !ri.NeedAnother(rs) {
+			return nil
+		}
+	}
+	return ri.Error().GoError()
+}
+
+// makeSSTablePiece returns an sstable containing the keys of the given
+// reader which are in rs, along with the span of these keys. A nil sstable is
+// returned if there are no such keys.
+func makeSSTablePiece(
+	reader *engine.RocksDBSstFileReader, rs roachpb.RSpan,
+) ([]byte, roachpb.RSpan, error) {
+	writer, err := engine.MakeRocksDBSstFileWriter()
+	if err != nil {
+		return nil, roachpb.RSpan{}, err
+	}
+	defer writer.Close()
+
+	var first, last roachpb.Key
+	start := engine.MakeMVCCMetadataKey(rs.Key.AsRawKey())
+	end := engine.MakeMVCCMetadataKey(rs.EndKey.AsRawKey())
+	if err := reader.Iterate(start, end, func(kv engine.MVCCKeyValue) (bool, error) {
+		if first == nil {
+			first = kv.Key.Key
+		}
+		last = kv.Key.Key
+		return false, writer.Add(kv)
+	}); err != nil {
+		return nil, roachpb.RSpan{}, err
+	}
+	if first == nil {
+		return nil, roachpb.RSpan{}, nil
+	}
+	piece, err := writer.Finish()
+	if err != nil {
+		return nil, roachpb.RSpan{}, err
+	}
+	return piece, roachpb.RSpan{
+		Key: roachpb.RKey(first), EndKey: roachpb.RKey(last.Next()),
+	}, nil
+}
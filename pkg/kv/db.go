@@ -47,6 +47,7 @@ var allExternalMethods = [...]roachpb.Request{
 	roachpb.RangeLookup:        &roachpb.RangeLookupRequest{},
 	roachpb.WriteBatch:         &roachpb.WriteBatchRequest{},
 	roachpb.Export:             &roachpb.ExportRequest{},
+	roachpb.PollChanges:        &roachpb.PollChangesRequest{},
 }
 
 // A DBServer provides an HTTP server endpoint serving the key-value API.
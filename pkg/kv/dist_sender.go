@@ -16,9 +16,13 @@ package kv
 
 import (
 	"fmt"
+	"math/rand"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
+	"github.com/gogo/protobuf/proto"
+	opentracing "github.com/opentracing/opentracing-go"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 
@@ -30,11 +34,16 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/rpc"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/admission"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 	"github.com/cockroachdb/cockroach/pkg/util/retry"
 	"github.com/cockroachdb/cockroach/pkg/util/shuffle"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 )
@@ -49,6 +58,19 @@ const (
 	defaultRangeDescriptorCacheSize = 1 << 20
 	// The default limit for asynchronous senders.
 	defaultSenderConcurrency = 500
+	// The factor by which the backoff between retries of background batches
+	// (see roachpb.QOS_BACKGROUND) is scaled.
+	backgroundBackoffMultiplier = 4
+	// The default rate, in retries per second, and burst of the budget shared
+	// by the retries of the DistSender, unless RPCRetryOptions has one.
+	defaultRetryBudgetRate  = 100
+	defaultRetryBudgetBurst = 1000
+	// The minimum interval between direct fetches of the first range
+	// descriptor from known nodes while it is missing from gossip.
+	firstRangeFetchInterval = time.Second
+	// The window during which updates to the gossiped first range
+	// descriptor are coalesced into a single eviction of the cached one.
+	firstRangeGossipCoalesce = 50 * time.Millisecond
 )
 
 var (
@@ -70,9 +92,33 @@ var (
 	metaDistSenderNotLeaseHolderErrCount = metric.Metadata{
 		Name: "distsender.errors.notleaseholder",
 		Help: "Number of NotLeaseHolderErrors encountered"}
+	metaDistSenderUntrustworthyClockErrCount = metric.Metadata{
+		Name: "distsender.errors.untrustworthyclock",
+		Help: "Number of responses rejected because their timestamp was too far ahead of the local clock"}
+	metaDistSenderValueChecksumErrCount = metric.Metadata{
+		Name: "distsender.errors.valuechecksum",
+		Help: "Number of responses rejected because a returned value failed checksum verification"}
+	metaDistSenderRetryBudget = metric.Metadata{
+		Name: "distsender.retry.budget",
+		Help: "Number of retries the DistSender may start without waiting for its retry budget; negative when retries wait"}
 	metaSlowDistSenderRequests = metric.Metadata{
 		Name: "requests.slow.distsender",
 		Help: "Number of requests that have been stuck for a long time in the dist sender"}
+	metaDistSenderDescriptorLookupLatency = metric.Metadata{
+		Name: "distsender.latency.descriptor_lookup",
+		Help: "Latency of range descriptor lookups"}
+	metaDistSenderTruncateLatency = metric.Metadata{
+		Name: "distsender.latency.truncate",
+		Help: "Latency of truncating partial batches to their range"}
+	metaDistSenderTransportLatency = metric.Metadata{
+		Name: "distsender.latency.transport",
+		Help: "Latency of sending partial batches to the replicas of their range"}
+	metaDistSenderCombineLatency = metric.Metadata{
+		Name: "distsender.latency.combine",
+		Help: "Latency of combining the responses of partial batches"}
+	metaDistSenderRPCLatency = metric.Metadata{
+		Name: "distsender.rpc.latency",
+		Help: "Recent latency of RPCs sent to individual replicas"}
 )
 
 // DistSenderMetrics is the set of metrics for a given distributed sender.
@@ -83,21 +129,98 @@ type DistSenderMetrics struct {
 	LocalSentCount         *metric.Counter
 	NextReplicaErrCount    *metric.Counter
 	NotLeaseHolderErrCount *metric.Counter
-	SlowRequestsCount      *metric.Gauge
+	// UntrustworthyClockErrCount counts the responses whose timestamp was
+	// rejected by UpdateAndCheckMaxOffset.
+	UntrustworthyClockErrCount *metric.Counter
+	// ValueChecksumErrCount counts the responses to batches verifying their
+	// checksums which returned a corrupted value.
+	ValueChecksumErrCount *metric.Counter
+	// RetryBudget tracks the tokens available in the retry budget.
+	RetryBudget       *metric.Gauge
+	SlowRequestsCount *metric.Gauge
+
+	// The latencies of the phases of the processing of batches, see
+	// startPhase.
+	DescriptorLookupLatency *metric.Histogram
+	TruncateLatency         *metric.Histogram
+	TransportLatency        *metric.Histogram
+	CombineLatency          *metric.Histogram
+	// RPCLatency is the latency of each RPC to a replica, including failed
+	// ones, over the recent window only.
+	RPCLatency *metric.WindowedHistogram
 }
 
-func makeDistSenderMetrics() DistSenderMetrics {
+func makeDistSenderMetrics(histogramWindow time.Duration) DistSenderMetrics {
 	return DistSenderMetrics{
-		BatchCount:             metric.NewCounter(metaDistSenderBatchCount),
-		PartialBatchCount:      metric.NewCounter(metaDistSenderPartialBatchCount),
-		SentCount:              metric.NewCounter(metaTransportSentCount),
-		LocalSentCount:         metric.NewCounter(metaTransportLocalSentCount),
-		NextReplicaErrCount:    metric.NewCounter(metaDistSenderNextReplicaErrCount),
-		NotLeaseHolderErrCount: metric.NewCounter(metaDistSenderNotLeaseHolderErrCount),
-		SlowRequestsCount:      metric.NewGauge(metaSlowDistSenderRequests),
+		BatchCount:                 metric.NewCounter(metaDistSenderBatchCount),
+		PartialBatchCount:          metric.NewCounter(metaDistSenderPartialBatchCount),
+		SentCount:                  metric.NewCounter(metaTransportSentCount),
+		LocalSentCount:             metric.NewCounter(metaTransportLocalSentCount),
+		NextReplicaErrCount:        metric.NewCounter(metaDistSenderNextReplicaErrCount),
+		NotLeaseHolderErrCount:     metric.NewCounter(metaDistSenderNotLeaseHolderErrCount),
+		UntrustworthyClockErrCount: metric.NewCounter(metaDistSenderUntrustworthyClockErrCount),
+		ValueChecksumErrCount:      metric.NewCounter(metaDistSenderValueChecksumErrCount),
+		SlowRequestsCount:          metric.NewGauge(metaSlowDistSenderRequests),
+		DescriptorLookupLatency:    metric.NewLatency(metaDistSenderDescriptorLookupLatency, histogramWindow),
+		TruncateLatency:            metric.NewLatency(metaDistSenderTruncateLatency, histogramWindow),
+		TransportLatency:           metric.NewLatency(metaDistSenderTransportLatency, histogramWindow),
+		CombineLatency:             metric.NewLatency(metaDistSenderCombineLatency, histogramWindow),
+		RPCLatency:                 metric.NewWindowedLatency(metaDistSenderRPCLatency, histogramWindow),
 	}
 }
 
+// phaseTimer times a phase of the processing of a batch. See startPhase.
+type phaseTimer struct {
+	ctx     context.Context
+	name    string
+	latency *metric.Histogram
+	start   time.Time
+}
+
+// startPhase starts timing a phase of the processing of a batch, e.g. the
+// lookup of a range descriptor or the wait for a replica's response. Once
+// the phase ends, its duration is logged to the span in ctx and recorded into
+// the given latency histogram.
+func startPhase(ctx context.Context, name string, latency *metric.Histogram) phaseTimer {
+	return phaseTimer{ctx: ctx, name: name, latency: latency, start: timeutil.Now()}
+}
+
+// end ends the phase.
+func (t phaseTimer) end() {
+	elapsed := timeutil.Since(t.start)
+	t.latency.RecordValue(elapsed.Nanoseconds())
+	log.VEventf(t.ctx, 2, "%s took %s", t.name, elapsed)
+}
+
+// keyPrinter returns the printer of the keys in the DistSender's error and log
+// messages, and in the tags of its spans. Unless disabled by
+// trace.redact_keys.enabled, the keys are redacted.
+func (ds *DistSender) keyPrinter() keys.KeyPrinter {
+	return keys.KeyPrinter{Redact: ds.st.RedactKeys.Get()}
+}
+
+// slowRequestThreshold returns the time after which a batch waiting for a
+// replica is reported as slow: the override of the batch, if any, and
+// otherwise kv.dist_sender.slow_request_threshold.
+func (ds *DistSender) slowRequestThreshold(ba roachpb.BatchRequest) time.Duration {
+	if ba.SlowRequestThresholdNanos > 0 {
+		return time.Duration(ba.SlowRequestThresholdNanos)
+	}
+	return ds.st.SlowRequestThreshold.Get()
+}
+
+// tagRange tags the span in ctx with the range to which a part of a batch is
+// sent and the key span of that part, printed by keyPrinter so that traces
+// can be shared for support. Since a batch can span several ranges, the tag
+// is keyed by the range ID.
+func (ds *DistSender) tagRange(ctx context.Context, rangeID roachpb.RangeID, rs roachpb.RSpan) {
+	sp := opentracing.SpanFromContext(ctx)
+	if sp == nil || tracing.IsBlackHoleSpan(sp) {
+		return
+	}
+	sp.SetTag(fmt.Sprintf("r%d", rangeID), ds.keyPrinter().Span(rs.Key.AsRawKey(), rs.EndKey.AsRawKey()))
+}
+
 // A firstRangeMissingError indicates that the first range has not yet
 // been gossiped. This will be the case for a node which hasn't yet
 // joined the gossip network.
@@ -129,6 +252,25 @@ type DistSender struct {
 	// ranges.
 	gossip  *gossip.Gossip
 	metrics DistSenderMetrics
+	// st, if set, controls whether the load gossiped by the stores is taken
+	// into account when ordering replicas.
+	st *cluster.Settings
+	// nodeUnavailable, if set, reports whether a node is known to be dead or
+	// draining.
+	nodeUnavailable func(roachpb.NodeID) bool
+	// rangeFeedPollInterval is the interval at which the ranges of a range
+	// feed are polled for changes.
+	rangeFeedPollInterval time.Duration
+	testingKnobs          DistSenderTestingKnobs
+
+	// shuffleRand orders the replicas which are equally good candidates for
+	// an RPC. It is seeded by shuffleSeed, so that the order in which the
+	// replicas are tried can be replayed.
+	shuffleSeed int64
+	shuffleRand struct {
+		syncutil.Mutex
+		*rand.Rand
+	}
 	// rangeCache caches replica metadata for key ranges.
 	rangeCache           *RangeDescriptorCache
 	rangeLookupMaxRanges int32
@@ -137,11 +279,26 @@ type DistSender struct {
 	transportFactory TransportFactory
 	rpcContext       *rpc.Context
 	rpcRetryOptions  retry.Options
-	asyncSenderSem   chan struct{}
+	// latencyFunc reports the latency to the nodes, which orders the replicas
+	// that are equally close by their attributes. It is nil when unknown.
+	latencyFunc LatencyFunc
+	// admission limits the number of partial batches sent asynchronously.
+	// It may be shared with other subsystems of the process.
+	admission        *admission.Controller
 	asyncSenderCount int32
+
+	// firstRangeFallback holds the first range descriptor last fetched
+	// directly from a known node because it was missing from gossip.
+	firstRangeFallback struct {
+		syncutil.Mutex
+		desc      *roachpb.RangeDescriptor
+		fetchedAt time.Time
+	}
 }
 
 var _ client.Sender = &DistSender{}
+var _ client.RangeFeeder = &DistSender{}
+var _ client.SSTableAdder = &DistSender{}
 
 // DistSenderConfig holds configuration and auxiliary objects that can be passed
 // to NewDistSender.
@@ -162,9 +319,29 @@ type DistSenderConfig struct {
 	RPCContext        *rpc.Context
 	RangeDescriptorDB RangeDescriptorDB
 	// SenderConcurrency specifies the parallelization available when
-	// splitting batches into multiple requests when they span ranges.
+	// splitting batches into multiple requests when they span ranges. It is
+	// ignored if AdmissionController is set.
 	// TODO(spencer): This is per-process. We should add a per-batch limit.
 	SenderConcurrency int32
+	// AdmissionController, if set, is the process-wide admission controller
+	// from which partial batches sent asynchronously draw their tokens. If
+	// unset, the DistSender uses a private controller sized according to
+	// SenderConcurrency.
+	AdmissionController *admission.Controller
+	// Settings are the cluster settings of the node. They control among
+	// other things whether reads which can be served by any replica avoid
+	// overloaded stores. Defaults to testing settings.
+	Settings *cluster.Settings
+	// NodeUnavailable, if set, reports whether node liveness considers the
+	// given node dead or draining. Replicas on such nodes are tried last
+	// instead of being discovered unavailable through RPC timeouts.
+	NodeUnavailable func(roachpb.NodeID) bool
+	// RangeFeedPollInterval is the interval at which the ranges of a range
+	// feed are polled for changes. Defaults to defaultRangeFeedPollInterval.
+	RangeFeedPollInterval time.Duration
+	// HistogramWindowInterval is (server.Context).HistogramWindowInterval.
+	// Defaults to metric.TestSampleInterval.
+	HistogramWindowInterval time.Duration
 
 	TestingKnobs DistSenderTestingKnobs
 }
@@ -175,6 +352,22 @@ type DistSenderTestingKnobs struct {
 	// The RPC dispatcher. Defaults to grpc but can be changed here for
 	// testing purposes.
 	TransportFactory TransportFactory
+	// ReplicaResponseFilter, if set, is called with the result of each RPC
+	// sent to a replica of a range, before the DistSender classifies it. The
+	// result it returns is used instead, which lets tests turn a reply into an
+	// ambiguous RPC error or into a NotLeaseHolderError. It may also block to
+	// delay the result, e.g. to order the responses of the parts of a batch.
+	ReplicaResponseFilter func(
+		ctx context.Context, rangeID roachpb.RangeID, ba roachpb.BatchRequest, call BatchCall,
+	) BatchCall
+	// ReplicaShuffleSeed, if non-zero, seeds the shuffling of the replicas
+	// which are equally good candidates for an RPC, instead of a random seed.
+	// The seed of a DistSender is logged when it's created, and passing it
+	// here reproduces its routing decisions.
+	ReplicaShuffleSeed int64
+	// LatencyFunc, if set, replaces the latencies to the nodes measured by
+	// the heartbeats of the RPCContext.
+	LatencyFunc LatencyFunc
 }
 
 var _ base.ModuleTestingKnobs = &DistSenderTestingKnobs{}
@@ -187,10 +380,21 @@ func (*DistSenderTestingKnobs) ModuleTestingKnobs() {}
 // DistSenderContext or the fields within is optional. For omitted values, sane
 // defaults will be used.
 func NewDistSender(cfg DistSenderConfig, g *gossip.Gossip) *DistSender {
+	if cfg.HistogramWindowInterval == 0 {
+		cfg.HistogramWindowInterval = metric.TestSampleInterval
+	}
+	if cfg.Settings == nil {
+		cfg.Settings = cluster.MakeTestingClusterSettings()
+	}
 	ds := &DistSender{
 		clock:   cfg.Clock,
 		gossip:  g,
-		metrics: makeDistSenderMetrics(),
+		metrics: makeDistSenderMetrics(cfg.HistogramWindowInterval),
+		st:      cfg.Settings,
+
+		nodeUnavailable:       cfg.NodeUnavailable,
+		rangeFeedPollInterval: cfg.RangeFeedPollInterval,
+		testingKnobs:          cfg.TestingKnobs,
 	}
 
 	ds.AmbientContext = cfg.AmbientCtx
@@ -198,6 +402,13 @@ func NewDistSender(cfg DistSenderConfig, g *gossip.Gossip) *DistSender {
 		panic("no tracer set in AmbientCtx")
 	}
 
+	ds.shuffleSeed = cfg.TestingKnobs.ReplicaShuffleSeed
+	if ds.shuffleSeed == 0 {
+		ds.shuffleSeed = randutil.NewPseudoSeed()
+	}
+	ds.shuffleRand.Rand = rand.New(rand.NewSource(ds.shuffleSeed))
+	log.Infof(ds.AnnotateCtx(context.Background()), "replica shuffle seed: %d", ds.shuffleSeed)
+
 	if cfg.nodeDescriptor != nil {
 		atomic.StorePointer(&ds.nodeDescriptor, unsafe.Pointer(cfg.nodeDescriptor))
 	}
@@ -215,6 +426,9 @@ func NewDistSender(cfg DistSenderConfig, g *gossip.Gossip) *DistSender {
 		lcSize = defaultLeaseHolderCacheSize
 	}
 	ds.leaseHolderCache = NewLeaseHolderCache(int(lcSize))
+	if ds.rangeFeedPollInterval <= 0 {
+		ds.rangeFeedPollInterval = defaultRangeFeedPollInterval
+	}
 	if cfg.RangeLookupMaxRanges <= 0 {
 		ds.rangeLookupMaxRanges = defaultRangeLookupMaxRanges
 	}
@@ -227,39 +441,89 @@ func NewDistSender(cfg DistSenderConfig, g *gossip.Gossip) *DistSender {
 	if cfg.RPCRetryOptions != nil {
 		ds.rpcRetryOptions = *cfg.RPCRetryOptions
 	}
+	// All the retry loops of the DistSender share a budget, so that they
+	// collectively back off when the cluster is unavailable.
+	if ds.rpcRetryOptions.Budget == nil {
+		ds.rpcRetryOptions.Budget = retry.NewBudget(defaultRetryBudgetRate, defaultRetryBudgetBurst)
+	}
+	ds.metrics.RetryBudget = metric.NewFunctionalGauge(
+		metaDistSenderRetryBudget, ds.rpcRetryOptions.Budget.Available)
 	if cfg.RPCContext != nil {
 		ds.rpcContext = cfg.RPCContext
 		if ds.rpcRetryOptions.Closer == nil {
 			ds.rpcRetryOptions.Closer = ds.rpcContext.Stopper.ShouldQuiesce()
 		}
+		ds.latencyFunc = ds.rpcContext.RemoteClocks.Latency
+	}
+	if cfg.TestingKnobs.LatencyFunc != nil {
+		ds.latencyFunc = cfg.TestingKnobs.LatencyFunc
 	}
-	if cfg.SenderConcurrency != 0 {
-		ds.asyncSenderSem = make(chan struct{}, cfg.SenderConcurrency)
+	if cfg.AdmissionController != nil {
+		ds.admission = cfg.AdmissionController
+	} else if cfg.SenderConcurrency != 0 {
+		ds.admission = admission.NewController(int64(cfg.SenderConcurrency))
 	} else {
-		ds.asyncSenderSem = make(chan struct{}, defaultSenderConcurrency)
+		ds.admission = admission.NewController(defaultSenderConcurrency)
 	}
 
 	if g != nil {
 		ctx := ds.AnnotateCtx(context.Background())
-		g.RegisterCallback(gossip.KeyFirstRangeDescriptor,
-			func(_ string, value roachpb.Value) {
-				if log.V(1) {
-					var desc roachpb.RangeDescriptor
-					if err := value.GetProto(&desc); err != nil {
-						log.Errorf(ctx, "unable to parse gossiped first range descriptor: %s", err)
-					} else {
-						log.Infof(ctx, "gossiped first range descriptor: %+v", desc.Replicas)
-					}
-				}
-				err := ds.rangeCache.EvictCachedRangeDescriptor(ctx, roachpb.RKeyMin, nil, false)
-				if err != nil {
-					log.Warningf(ctx, "failed to evict first range descriptor: %s", err)
-				}
-			})
+		g.RegisterProtoCallback(gossip.ProtoSubscription{
+			Prefix: gossip.KeyFirstRangeDescriptor,
+			New:    func() proto.Message { return &roachpb.RangeDescriptor{} },
+			// Evicting the cached descriptor once for a burst of updates is
+			// enough.
+			Coalesce: firstRangeGossipCoalesce,
+		}, func(_ string, msg proto.Message) {
+			if log.V(1) {
+				desc := msg.(*roachpb.RangeDescriptor)
+				log.Infof(ctx, "gossiped first range descriptor: %+v", desc.Replicas)
+			}
+			err := ds.rangeCache.EvictCachedRangeDescriptor(ctx, roachpb.RKeyMin, nil, false)
+			if err != nil {
+				log.Warningf(ctx, "failed to evict first range descriptor: %s", err)
+			}
+		})
+		g.RegisterProtoCallback(gossip.ProtoSubscription{
+			Prefix:          gossip.MakeKeyPrefix(gossip.KeySystemRangeLeaseHolderPrefix),
+			New:             func() proto.Message { return &gossip.SystemRangeLeaseHolder{} },
+			DeliverExisting: true,
+		}, func(_ string, msg proto.Message) {
+			ds.updateSystemRangeLeaseHolder(ctx, msg.(*gossip.SystemRangeLeaseHolder))
+		})
 	}
 	return ds
 }
 
+// shuffle randomizes the order of the replicas with the DistSender's seeded
+// source.
+func (ds *DistSender) shuffle(replicas shuffle.Interface) {
+	ds.shuffleRand.Lock()
+	defer ds.shuffleRand.Unlock()
+	shuffle.ShuffleWithRand(ds.shuffleRand.Rand, replicas)
+}
+
+// updateSystemRangeLeaseHolder caches the gossiped lease holder of a range
+// containing system data, along with the range's descriptor if no descriptor
+// is cached for its start key yet. This lets requests for system data be sent
+// to the lease holder on the first attempt, even right after startup.
+func (ds *DistSender) updateSystemRangeLeaseHolder(
+	ctx context.Context, leaseHolder *gossip.SystemRangeLeaseHolder,
+) {
+	if log.V(1) {
+		log.Infof(ctx, "gossiped lease holder of r%d: %s",
+			leaseHolder.Desc.RangeID, leaseHolder.LeaseHolder)
+	}
+	ds.leaseHolderCache.Update(ctx, leaseHolder.Desc.RangeID, leaseHolder.LeaseHolder)
+	desc, err := ds.rangeCache.GetCachedRangeDescriptor(leaseHolder.Desc.StartKey, false /* inclusive */)
+	if err != nil || desc != nil {
+		return
+	}
+	if err := ds.rangeCache.InsertRangeDescriptors(ctx, leaseHolder.Desc); err != nil {
+		log.Warningf(ctx, "failed to cache descriptor of r%d: %s", leaseHolder.Desc.RangeID, err)
+	}
+}
+
 // Metrics returns a struct which contains metrics related to the distributed
 // sender's activity.
 func (ds *DistSender) Metrics() DistSenderMetrics {
@@ -307,7 +571,7 @@ func (ds *DistSender) RangeLookup(
 		Reverse:   useReverseScan,
 	})
 	replicas := NewReplicaSlice(ds.gossip, desc)
-	shuffle.Shuffle(replicas)
+	ds.shuffle(replicas)
 	br, err := ds.sendRPC(ctx, desc.RangeID, replicas, ba)
 	if err != nil {
 		return nil, nil, roachpb.NewError(err)
@@ -328,11 +592,110 @@ func (ds *DistSender) FirstRange() (*roachpb.RangeDescriptor, error) {
 	}
 	rangeDesc := &roachpb.RangeDescriptor{}
 	if err := ds.gossip.GetInfoProto(gossip.KeyFirstRangeDescriptor, rangeDesc); err != nil {
+		if rangeDesc := ds.fetchFirstRange(); rangeDesc != nil {
+			return rangeDesc, nil
+		}
 		return nil, firstRangeMissingError{}
 	}
 	return rangeDesc, nil
 }
 
+// fetchFirstRange reads the first range descriptor directly from the nodes
+// this node knows about, i.e. the ones from its join list and the ones it's
+// connected to, for use until gossip provides the descriptor. The descriptor
+// is read inconsistently from whichever of these nodes has a replica of the
+// first range, so it may be stale; a stale descriptor is corrected by the
+// usual range descriptor cache eviction. Returns nil if none of the nodes
+// could provide the descriptor.
+func (ds *DistSender) fetchFirstRange() *roachpb.RangeDescriptor {
+	if ds.rpcContext == nil {
+		return nil
+	}
+	ds.firstRangeFallback.Lock()
+	defer ds.firstRangeFallback.Unlock()
+	if timeutil.Since(ds.firstRangeFallback.fetchedAt) < firstRangeFetchInterval {
+		return ds.firstRangeFallback.desc
+	}
+	ds.firstRangeFallback.fetchedAt = timeutil.Now()
+	ds.firstRangeFallback.desc = nil
+
+	ctx := ds.AnnotateCtx(context.TODO())
+	var ba roachpb.BatchRequest
+	ba.Timestamp = ds.clock.Now()
+	ba.ReadConsistency = roachpb.INCONSISTENT
+	ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: keys.RangeDescriptorKey(roachpb.RKeyMin)}})
+	for _, addr := range ds.knownAddrs() {
+		// The replica is left unspecified, which makes the node look up its
+		// replica of the first range, if any.
+		replicas := ReplicaSlice{{
+			NodeDesc: &roachpb.NodeDescriptor{Address: util.MakeUnresolvedAddr("tcp", addr)},
+		}}
+		br, err := ds.sendRPC(ctx, 0 /* rangeID */, replicas, ba)
+		if err == nil && br.Error != nil {
+			err = br.Error.GoError()
+		}
+		if err != nil {
+			log.VEventf(ctx, 2, "unable to fetch first range descriptor from %s: %s", addr, err)
+			continue
+		}
+		value := br.Responses[0].GetInner().(*roachpb.GetResponse).Value
+		if value == nil {
+			continue
+		}
+		var desc roachpb.RangeDescriptor
+		if err := value.GetProto(&desc); err != nil {
+			log.Errorf(ctx, "unable to parse first range descriptor from %s: %s", addr, err)
+			continue
+		}
+		if log.V(1) {
+			log.Infof(ctx, "fetched first range descriptor from %s: %+v", addr, desc.Replicas)
+		}
+		ds.firstRangeFallback.desc = &desc
+		return &desc
+	}
+	return nil
+}
+
+// knownAddrs returns the addresses of the nodes from the join list, followed
+// by those of the nodes the rpc.Context is connected to.
+func (ds *DistSender) knownAddrs() []string {
+	var addrs []string
+	seen := make(map[string]struct{})
+	add := func(addr string) {
+		if _, ok := seen[addr]; !ok {
+			seen[addr] = struct{}{}
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, r := range ds.gossip.GetResolvers() {
+		add(r.Addr())
+	}
+	for _, addr := range ds.rpcContext.Addrs() {
+		add(addr)
+	}
+	return addrs
+}
+
+// LatencyFunc returns the function reporting the latency to the nodes of the
+// cluster, as measured by the heartbeats of the connections to them. It
+// returns nil if the DistSender has no RPC context.
+func (ds *DistSender) LatencyFunc() LatencyFunc {
+	return ds.latencyFunc
+}
+
+// NodeLatency returns the latency to the given node, and whether it is known.
+// It is unknown until the node is gossiped and connected to.
+func (ds *DistSender) NodeLatency(nodeID roachpb.NodeID) (time.Duration, bool) {
+	if ds.latencyFunc == nil || ds.gossip == nil {
+		return 0, false
+	}
+	nodeDesc, err := ds.gossip.GetNodeDescriptor(nodeID)
+	if err != nil {
+		return 0, false
+	}
+	return ds.latencyFunc(nodeDesc.Address.String())
+}
+
 // getNodeDescriptor returns ds.nodeDescriptor, but makes an attempt to load
 // it from the Gossip network if a nil value is found.
 // We must jump through hoops here to get the node descriptor because it's not available
@@ -363,6 +726,25 @@ func (ds *DistSender) getNodeDescriptor() *roachpb.NodeDescriptor {
 	return nil
 }
 
+// deprioritizeOverloadedReplicas moves the replicas on stores which gossiped
+// a load significantly higher than the other replicas' stores to the back of
+// the slice, if enabled by the cluster settings.
+func (ds *DistSender) deprioritizeOverloadedReplicas(replicas ReplicaSlice) {
+	if ds.st == nil || !ds.st.EnableLoadBasedReplicaOrdering.Get() ||
+		ds.gossip == nil || len(replicas) < 2 {
+		return
+	}
+	capacities := make(map[roachpb.StoreID]roachpb.StoreCapacity, len(replicas))
+	for _, r := range replicas {
+		var storeDesc roachpb.StoreDescriptor
+		if err := ds.gossip.GetInfoProto(gossip.MakeStoreKey(r.StoreID), &storeDesc); err != nil {
+			continue
+		}
+		capacities[r.StoreID] = storeDesc.Capacity
+	}
+	replicas.MoveOverloadedToBack(capacities, ds.st.ReplicaOrderingLoadThreshold.Get())
+}
+
 // sendRPC sends one or more RPCs to replicas from the supplied
 // roachpb.Replica slice. Returns an RPC error if the request could
 // not be sent. Note that the reply may contain a higher level error
@@ -388,9 +770,7 @@ func (ds *DistSender) sendRPC(
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	tracing.AnnotateTrace()
-	defer tracing.AnnotateTrace()
-
+	defer startPhase(ctx, "transport wait", ds.metrics.TransportLatency).end()
 	return ds.sendToReplicas(ctx, SendOptions{metrics: &ds.metrics}, rangeID, replicas, ba, ds.rpcContext)
 }
 
@@ -423,9 +803,11 @@ func (ds *DistSender) CountRanges(ctx context.Context, rs roachpb.RSpan) (int64,
 func (ds *DistSender) getDescriptor(
 	ctx context.Context, descKey roachpb.RKey, evictToken *EvictionToken, useReverseScan bool,
 ) (*roachpb.RangeDescriptor, *EvictionToken, error) {
+	phase := startPhase(ctx, "descriptor lookup", ds.metrics.DescriptorLookupLatency)
 	desc, returnToken, err := ds.rangeCache.LookupRangeDescriptor(
 		ctx, descKey, evictToken, useReverseScan,
 	)
+	phase.end()
 	if err != nil {
 		return nil, returnToken, err
 	}
@@ -443,7 +825,20 @@ func (ds *DistSender) sendSingleRange(
 	// Rearrange the replicas so that those replicas with long common
 	// prefix of attributes end up first. If there's no prefix, this is a
 	// no-op.
-	replicas.OptimizeReplicaOrder(ds.getNodeDescriptor())
+	replicas.optimizeReplicaOrder(ds.getNodeDescriptor(), ds.latencyFunc, ds.shuffle)
+
+	// Replicas on nodes which are known to be dead or draining are unlikely
+	// to serve the request, so they're tried last.
+	if ds.nodeUnavailable != nil {
+		replicas.MoveUnavailableToBack(ds.nodeUnavailable)
+	}
+
+	// Reads which don't have to be served by the lease holder are sent to the
+	// replicas on overloaded stores last, to spread the read load away from
+	// hot nodes.
+	if ba.IsReadOnly() && ba.ReadConsistency == roachpb.INCONSISTENT {
+		ds.deprioritizeOverloadedReplicas(replicas)
+	}
 
 	// If this request needs to go to a lease holder and we know who that is, move
 	// it to the front.
@@ -462,10 +857,14 @@ func (ds *DistSender) sendSingleRange(
 	}
 
 	// If the reply contains a timestamp, update the local HLC with it.
+	now := br.Now
 	if br.Error != nil && br.Error.Now != (hlc.Timestamp{}) {
-		ds.clock.Update(br.Error.Now)
-	} else if br.Now != (hlc.Timestamp{}) {
-		ds.clock.Update(br.Now)
+		now = br.Error.Now
+	}
+	if now != (hlc.Timestamp{}) {
+		if _, err := ds.clock.UpdateAndCheckMaxOffset(now); err != nil {
+			return nil, ds.untrustworthyClockError(ctx, ba, now, err)
+		}
 	}
 
 	// Untangle the error from the received response.
@@ -474,6 +873,31 @@ func (ds *DistSender) sendSingleRange(
 	return br, pErr
 }
 
+// untrustworthyClockError returns the error of a batch whose response carried
+// a timestamp which the local clock rejected as too far ahead of it. Rather
+// than updating the clock with it, which would undermine the assumptions
+// made about timestamps observed from the local clock, the response is
+// discarded; since a batch which isn't read-only may have been applied
+// regardless, its error is ambiguous.
+func (ds *DistSender) untrustworthyClockError(
+	ctx context.Context, ba roachpb.BatchRequest, now hlc.Timestamp, err error,
+) *roachpb.Error {
+	ds.metrics.UntrustworthyClockErrCount.Inc(1)
+	clockErr := &roachpb.UntrustworthyRemoteClockError{RemoteTimestamp: now}
+	if offsetErr, ok := err.(*hlc.UntrustworthyRemoteWallTimeError); ok {
+		clockErr.OffsetNanos = offsetErr.Offset.Nanoseconds()
+		clockErr.MaxOffsetNanos = offsetErr.MaxOffset.Nanoseconds()
+	}
+	log.Warningf(ctx, "discarding response to %s: %s", ds.keyPrinter().Batch(ba), clockErr)
+	pErr := roachpb.NewError(clockErr)
+	if ba.IsReadOnly() {
+		return pErr
+	}
+	ambErr := roachpb.NewAmbiguousResultError(clockErr.Error())
+	ambErr.WrappedErr = pErr
+	return roachpb.NewError(ambErr)
+}
+
 // initAndVerifyBatch initializes timestamp-related information and
 // verifies batch constraints before splitting.
 func (ds *DistSender) initAndVerifyBatch(
@@ -484,10 +908,15 @@ func (ds *DistSender) initAndVerifyBatch(
 		ba.Header.GatewayNodeID = ds.gossip.NodeID.Get()
 	}
 
+	if ba.MaxStalenessNanos < 0 {
+		return roachpb.NewErrorf("invalid max staleness %d", ba.MaxStalenessNanos)
+	}
+
 	// In the event that timestamp isn't set and read consistency isn't
-	// required, set the timestamp using the local clock.
+	// required, set the timestamp using the local clock, going back by the
+	// staleness the caller is willing to accept.
 	if ba.ReadConsistency == roachpb.INCONSISTENT && ba.Timestamp == (hlc.Timestamp{}) {
-		ba.Timestamp = ds.clock.Now()
+		ba.Timestamp = ds.clock.Now().Add(-ba.MaxStalenessNanos, 0)
 	}
 
 	if ba.Txn != nil {
@@ -535,7 +964,7 @@ func (ds *DistSender) initAndVerifyBatch(
 		for _, req := range ba.Requests {
 			inner := req.GetInner()
 			switch inner.(type) {
-			case *roachpb.ScanRequest, *roachpb.DeleteRangeRequest:
+			case *roachpb.ScanRequest, *roachpb.DeleteRangeRequest, *roachpb.DeleteRangeWhereRequest:
 				// Accepted range requests. All other range requests are still
 				// not supported.
 				// TODO(vivek): don't enumerate all range requests.
@@ -552,6 +981,18 @@ func (ds *DistSender) initAndVerifyBatch(
 		}
 	}
 
+	// Nodes which don't know about AllowIfDoesNotExist would ignore it, and
+	// fail the conditional puts of keys which don't exist.
+	if !ds.st.Version.IsActive(cluster.VersionCPutAllowIfDoesNotExist) {
+		for _, req := range ba.Requests {
+			if cput, ok := req.GetInner().(*roachpb.ConditionalPutRequest); ok && cput.AllowIfDoesNotExist {
+				return roachpb.NewErrorf(
+					"conditional puts allowing missing keys require cluster version %s",
+					cluster.VersionCPutAllowIfDoesNotExist)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -578,13 +1019,18 @@ func (ds *DistSender) Send(
 ) (*roachpb.BatchResponse, *roachpb.Error) {
 	ds.metrics.BatchCount.Inc(1)
 
-	tracing.AnnotateTrace()
-
 	if pErr := ds.initAndVerifyBatch(ctx, &ba); pErr != nil {
 		return nil, pErr
 	}
 
 	ctx = ds.AnnotateCtx(ctx)
+	// A sample of the batches, and those which are slow, are traced into the
+	// tracer's registry. The batch is summarized as it was received, since
+	// its requests are replaced by those of each part below.
+	ctx, finishSampled := ds.st.Tracer.StartSampledSpan(ctx, "dist sender", ds.slowRequestThreshold(ba))
+	defer func(origBa roachpb.BatchRequest) {
+		finishSampled(func() string { return ds.keyPrinter().BatchSummary(origBa) })
+	}(ba)
 	ctx, cleanup := tracing.EnsureContext(ctx, ds.AmbientContext.Tracer, "dist sender")
 	defer cleanup()
 
@@ -632,12 +1078,18 @@ func (ds *DistSender) Send(
 	}
 
 	reply := rplChunks[0]
-	for _, rpl := range rplChunks[1:] {
-		reply.Responses = append(reply.Responses, rpl.Responses...)
-		reply.CollectedSpans = append(reply.CollectedSpans, rpl.CollectedSpans...)
+	if len(rplChunks) > 1 {
+		phase := startPhase(ctx, "combine", ds.metrics.CombineLatency)
+		for _, rpl := range rplChunks[1:] {
+			reply.Responses = append(reply.Responses, rpl.Responses...)
+			reply.CollectedSpans = append(reply.CollectedSpans, rpl.CollectedSpans...)
+			reply.RangeReport = append(reply.RangeReport, rpl.RangeReport...)
+		}
+		phase.end()
 	}
 	lastHeader := rplChunks[len(rplChunks)-1].BatchResponse_Header
 	lastHeader.CollectedSpans = reply.CollectedSpans
+	lastHeader.RangeReport = reply.RangeReport
 	reply.BatchResponse_Header = lastHeader
 	return reply, nil
 }
@@ -685,7 +1137,10 @@ func (ds *DistSender) divideAndSendBatchToRanges(
 
 			// Combine the new response with the existing one (including updating
 			// the headers).
-			if err := br.Combine(resp.reply, resp.positions); err != nil {
+			phase := startPhase(ctx, "combine", ds.metrics.CombineLatency)
+			err := br.Combine(resp.reply, resp.positions)
+			phase.end()
+			if err != nil {
 				pErr = roachpb.NewError(err)
 				return
 			}
@@ -737,6 +1192,13 @@ func (ds *DistSender) divideAndSendBatchToRanges(
 		responseCh := make(chan response, 1)
 		responseChs = append(responseChs, responseCh)
 
+		if ri.NeedAnother(rs) && ba.IsSingleAddSSTableRequest() {
+			// The sstable would be sent in full to each of the ranges. Let the
+			// caller split it at the range boundaries instead, see AddSSTable.
+			responseCh <- response{pErr: roachpb.NewError(roachpb.NewRangeKeyMismatchError(
+				rs.Key.AsRawKey(), rs.EndKey.AsRawKey(), ri.Desc()))}
+			return
+		}
 		if batchIdx == 0 && ri.NeedAnother(rs) {
 			// TODO(tschottdorf): we should have a mechanism for discovering
 			// range merges (descriptor staleness will mostly go unnoticed),
@@ -853,10 +1315,23 @@ func (ds *DistSender) divideAndSendBatchToRanges(
 	return
 }
 
-// sendPartialBatchAsync sends the partial batch asynchronously if
-// there aren't currently more than the allowed number of concurrent
-// async requests outstanding. Returns whether the partial batch was
-// sent.
+// retryOptions returns the options with which sends of the batch are retried.
+// Background batches back off more aggressively than foreground ones, leaving
+// the ranges they are retrying on to foreground traffic.
+func (ds *DistSender) retryOptions(ba roachpb.BatchRequest) retry.Options {
+	opts := ds.rpcRetryOptions
+	if ba.QoSClass == roachpb.QOS_BACKGROUND {
+		opts.InitialBackoff *= backgroundBackoffMultiplier
+		opts.MaxBackoff *= backgroundBackoffMultiplier
+	}
+	return opts
+}
+
+// sendPartialBatchAsync sends the partial batch asynchronously if an
+// admission token is immediately available. Returns whether the partial
+// batch was sent. When no token is available, the partial batch is sent
+// synchronously right away rather than waiting for one, so that saturation
+// adds no latency.
 func (ds *DistSender) sendPartialBatchAsync(
 	ctx context.Context,
 	ba roachpb.BatchRequest,
@@ -866,14 +1341,22 @@ func (ds *DistSender) sendPartialBatchAsync(
 	batchIdx int,
 	responseCh chan response,
 ) bool {
-	if err := ds.rpcContext.Stopper.RunLimitedAsyncTask(
+	pri := admission.HighPri
+	if ba.QoSClass == roachpb.QOS_BACKGROUND {
+		pri = admission.LowPri
+	}
+	if !ds.admission.TryAdmit(pri) {
+		return false
+	}
+	if err := ds.rpcContext.Stopper.RunAsyncTask(
 		ctx, "kv.DistSender: sending partial batch",
-		ds.asyncSenderSem, false, /* !wait */
 		func(ctx context.Context) {
+			defer ds.admission.Release()
 			atomic.AddInt32(&ds.asyncSenderCount, 1)
 			responseCh <- ds.sendPartialBatch(ctx, ba, rs, desc, evictToken, batchIdx)
 		},
 	); err != nil {
+		ds.admission.Release()
 		return false
 	}
 	return true
@@ -911,19 +1394,27 @@ func (ds *DistSender) sendPartialBatch(
 	if err != nil {
 		return response{pErr: roachpb.NewError(err)}
 	}
+	ds.tagRange(ctx, desc.RangeID, intersected)
+	phase := startPhase(ctx, "truncate", ds.metrics.TruncateLatency)
 	truncBA, positions, err := truncate(ba, intersected)
+	phase.end()
 	if len(positions) == 0 && err == nil {
 		// This shouldn't happen in the wild, but some tests exercise it.
 		return response{
-			pErr: roachpb.NewErrorf("truncation resulted in empty batch on %s: %s", intersected, ba),
+			pErr: roachpb.NewErrorf("truncation resulted in empty batch on %s: %s",
+				ds.keyPrinter().Span(intersected.Key.AsRawKey(), intersected.EndKey.AsRawKey()),
+				ds.keyPrinter().Batch(ba)),
 		}
 	}
 	if err != nil {
 		return response{pErr: roachpb.NewError(err)}
 	}
 
+	start := timeutil.Now()
+	var attempts int32
+
 	// Start a retry loop for sending the batch to the range.
-	for r := retry.StartWithCtx(ctx, ds.rpcRetryOptions); r.Next(); {
+	for r := retry.StartWithCtx(ctx, ds.retryOptions(ba)); r.Next(); {
 		// If we've cleared the descriptor on a send failure, re-lookup.
 		if desc == nil {
 			var descKey roachpb.RKey
@@ -939,14 +1430,20 @@ func (ds *DistSender) sendPartialBatch(
 			}
 		}
 
+		attempts++
 		reply, pErr = ds.sendSingleRange(ctx, truncBA, desc)
 
 		// If sending succeeded, return immediately.
 		if pErr == nil {
+			if ba.CollectRangeReport && len(reply.RangeReport) == 1 {
+				// sendToReplicas reported the replica which served the batch.
+				reply.RangeReport[0].Attempts = attempts
+				reply.RangeReport[0].LatencyNanos = timeutil.Since(start).Nanoseconds()
+			}
 			return response{reply: reply, positions: positions}
 		}
 
-		log.ErrEventf(ctx, "reply error %s: %s", ba, pErr)
+		log.ErrEventf(ctx, "reply error %s: %s", ds.keyPrinter().Batch(ba), pErr)
 
 		// Error handling: If the error indicates that our range
 		// descriptor is out of date, evict it from the cache and try
@@ -1105,6 +1602,28 @@ func fillSkippedResponses(
 	}
 }
 
+// verifyChecksums verifies the checksums of the values of the reply to ba
+// from the given replica. On a mismatch, the responses of the reply are
+// replaced by a ValueChecksumError.
+func (ds *DistSender) verifyChecksums(
+	ctx context.Context,
+	ba roachpb.BatchRequest,
+	br *roachpb.BatchResponse,
+	replica roachpb.ReplicaDescriptor,
+) {
+	key, err := br.VerifyChecksums(&ba)
+	if err == nil {
+		return
+	}
+	ds.metrics.ValueChecksumErrCount.Inc(1)
+	log.Errorf(ctx, "value at %s returned by %s failed checksum verification",
+		ds.keyPrinter().Key(key), replica)
+	br.Responses = nil
+	br.Error = roachpb.NewError(&roachpb.ValueChecksumError{
+		Key: key, Replica: replica, Message: err.Error(),
+	})
+}
+
 // sendToReplicas sends one or more RPCs to clients specified by the
 // slice of replicas. On success, Send returns the first successful
 // reply. If an error occurs which is not specific to a single
@@ -1143,7 +1662,11 @@ func (ds *DistSender) sendToReplicas(
 	}
 	// Must be buffered because tests have blocking SendNext implementations.
 	done := make(chan BatchCall, 1)
-	log.VEventf(ctx, 2, "r%d: sending batch %s to %s", rangeID, args.Summary(), transport.NextReplica())
+	// curReplica is the replica the batch was last sent to, whose result is
+	// the next one received.
+	curReplica := transport.NextReplica()
+	log.VEventf(ctx, 2, "r%d: sending batch %s to %s", rangeID, args.CountsSummary(), curReplica)
+	sentAt := timeutil.Now()
 	transport.SendNext(ctx, done)
 
 	// Wait for completions. This loop will retry operations that fail
@@ -1151,16 +1674,21 @@ func (ds *DistSender) sendToReplicas(
 	// other replicas.
 	slowTimer := timeutil.NewTimer()
 	defer slowTimer.Stop()
-	slowTimer.Reset(base.SlowRequestThreshold)
+	slowThreshold := ds.slowRequestThreshold(args)
+	slowTimer.Reset(slowThreshold)
 	for {
 		select {
 		case <-slowTimer.C:
 			log.Warningf(ctx, "have been waiting %s sending RPC to r%d for batch: %s",
-				base.SlowRequestThreshold, rangeID, args)
+				slowThreshold, rangeID, ds.keyPrinter().BatchSummary(args))
 			ds.metrics.SlowRequestsCount.Inc(1)
 			defer ds.metrics.SlowRequestsCount.Dec(1)
 
 		case call := <-done:
+			ds.metrics.RPCLatency.RecordValue(timeutil.Since(sentAt).Nanoseconds())
+			if fn := ds.testingKnobs.ReplicaResponseFilter; fn != nil {
+				call = fn(ctx, rangeID, args, call)
+			}
 			if err := call.Err; err != nil {
 				// All connection errors except for an unavailable node (this
 				// is GRPC's fail-fast error), may mean that the request
@@ -1191,6 +1719,17 @@ func (ds *DistSender) sendToReplicas(
 				propagateError := false
 				switch tErr := call.Reply.Error.GetDetail().(type) {
 				case nil:
+					if args.VerifyChecksums {
+						ds.verifyChecksums(ctx, args, call.Reply, curReplica)
+					}
+					if args.CollectRangeReport {
+						// The attempts and latency are filled in by
+						// sendPartialBatch.
+						call.Reply.RangeReport = []roachpb.RangeExecution{{
+							RangeID: rangeID,
+							Replica: curReplica,
+						}}
+					}
 					return call.Reply, nil
 				case *roachpb.StoreNotFoundError, *roachpb.NodeUnavailableError:
 					// These errors are likely to be unique to the replica that reported
@@ -1246,7 +1785,9 @@ func (ds *DistSender) sendToReplicas(
 			}
 
 			ds.metrics.NextReplicaErrCount.Inc(1)
-			log.VEventf(ctx, 2, "error: %v; trying next peer %s", call, transport.NextReplica())
+			curReplica = transport.NextReplica()
+			log.VEventf(ctx, 2, "error: %v; trying next peer %s", call, curReplica)
+			sentAt = timeutil.Now()
 			transport.SendNext(ctx, done)
 		}
 	}
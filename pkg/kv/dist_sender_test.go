@@ -33,6 +33,8 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/rpc"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util"
@@ -40,6 +42,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
@@ -735,6 +738,124 @@ func TestEvictOnFirstRangeGossip(t *testing.T) {
 	})
 }
 
+// TestSystemRangeLeaseHolderGossip verifies that the gossiped lease holders
+// of system ranges are cached along with the ranges' descriptors.
+func TestSystemRangeLeaseHolderGossip(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	cfg := DistSenderConfig{
+		AmbientCtx: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:      clock,
+	}
+	ds := NewDistSender(cfg, g)
+
+	leaseHolder := gossip.SystemRangeLeaseHolder{
+		Desc: roachpb.RangeDescriptor{
+			RangeID:  2,
+			StartKey: roachpb.RKey(keys.Meta2Prefix),
+			EndKey:   roachpb.RKey(keys.SystemPrefix),
+			Replicas: []roachpb.ReplicaDescriptor{
+				{NodeID: 1, StoreID: 1, ReplicaID: 1},
+				{NodeID: 2, StoreID: 2, ReplicaID: 2},
+			},
+		},
+		LeaseHolder: roachpb.ReplicaDescriptor{NodeID: 2, StoreID: 2, ReplicaID: 2},
+	}
+	if err := g.AddInfoProto(
+		gossip.MakeSystemRangeLeaseHolderKey(leaseHolder.Desc.RangeID), &leaseHolder, 0,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.SucceedsSoon(t, func() error {
+		if l, ok := ds.leaseHolderCache.Lookup(context.TODO(), leaseHolder.Desc.RangeID); !ok ||
+			l != leaseHolder.LeaseHolder {
+			return errors.Errorf("expected lease holder %s to be cached, got %s", leaseHolder.LeaseHolder, l)
+		}
+		desc, err := ds.rangeCache.GetCachedRangeDescriptor(leaseHolder.Desc.StartKey, false /* inclusive */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if desc == nil || !desc.Equal(leaseHolder.Desc) {
+			return errors.Errorf("expected descriptor %s to be cached, got %v", &leaseHolder.Desc, desc)
+		}
+		return nil
+	})
+}
+
+// TestFirstRangeFallback verifies that the first range descriptor is fetched
+// directly from a known node while it is missing from gossip.
+func TestFirstRangeFallback(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	rpcContext := rpc.NewContext(
+		log.AmbientContext{Tracer: tracing.NewTracer()},
+		&base.Config{Insecure: true},
+		clock,
+		stopper,
+	)
+	const knownAddr = "known:26257"
+	if _, err := rpcContext.GRPCDial(knownAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	var numFetches int32
+	var testFn rpcSendFn = func(
+		_ context.Context,
+		_ SendOptions,
+		replicas ReplicaSlice,
+		args roachpb.BatchRequest,
+		_ *rpc.Context,
+	) (*roachpb.BatchResponse, error) {
+		atomic.AddInt32(&numFetches, 1)
+		if addr := replicas[0].NodeDesc.Address.String(); addr != knownAddr {
+			return nil, errors.Errorf("unexpected address %s", addr)
+		}
+		if args.ReadConsistency != roachpb.INCONSISTENT {
+			return nil, errors.Errorf("expected an inconsistent read, got %s", args.ReadConsistency)
+		}
+		reply := args.CreateReply()
+		var value roachpb.Value
+		if err := value.SetProto(&testRangeDescriptor); err != nil {
+			return nil, err
+		}
+		reply.Responses[0].GetInner().(*roachpb.GetResponse).Value = &value
+		return reply, nil
+	}
+
+	cfg := DistSenderConfig{
+		AmbientCtx: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:      clock,
+		RPCContext: rpcContext,
+		TestingKnobs: DistSenderTestingKnobs{
+			TransportFactory: adaptLegacyTransport(testFn),
+		},
+	}
+	ds := NewDistSender(cfg, g)
+
+	// The descriptor is fetched once per firstRangeFetchInterval.
+	for i := 0; i < 2; i++ {
+		desc, err := ds.FirstRange()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !desc.Equal(testRangeDescriptor) {
+			t.Fatalf("expected descriptor %s, got %s", &testRangeDescriptor, desc)
+		}
+	}
+	if num := atomic.LoadInt32(&numFetches); num != 1 {
+		t.Fatalf("expected a single fetch of the first range descriptor, got %d", num)
+	}
+}
+
 func TestEvictCacheOnError(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	// if rpcError is true, the first attempt gets an RPC error, otherwise
@@ -1344,7 +1465,10 @@ func TestClockUpdateOnResponse(t *testing.T) {
 	stopper := stop.NewStopper()
 	defer stopper.Stop(context.TODO())
 
-	g, clock := makeGossip(t, stopper)
+	g, _ := makeGossip(t, stopper)
+	// The timestamps of the responses below are ahead of the local clock, but
+	// within its max offset.
+	clock := hlc.NewClock(hlc.UnixNano, time.Minute)
 	cfg := DistSenderConfig{
 		AmbientCtx:        log.AmbientContext{Tracer: tracing.NewTracer()},
 		Clock:             clock,
@@ -1389,6 +1513,351 @@ func TestClockUpdateOnResponse(t *testing.T) {
 	doCheck(replyError, fakeTime)
 }
 
+// TestUntrustworthyClockOnResponse verifies that the DistSender rejects
+// responses whose timestamp is further ahead of the local clock than the max
+// offset, instead of updating its clock with them.
+func TestUntrustworthyClockOnResponse(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	cfg := DistSenderConfig{
+		AmbientCtx:        log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:             clock,
+		RangeDescriptorDB: defaultMockRangeDescriptorDB,
+	}
+	ds := NewDistSender(cfg, g)
+	fakeTime := clock.Now().Add(10*time.Second.Nanoseconds(), 0)
+	ds.transportFactory = SenderTransportFactory(tracing.NewTracer(), client.SenderFunc(
+		func(_ context.Context, args roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+			rb := args.CreateReply()
+			rb.Now = fakeTime
+			return rb, nil
+		}))
+
+	// Read-only batches fail with an UntrustworthyRemoteClockError.
+	get := roachpb.NewGet(roachpb.Key("a"))
+	_, pErr := client.SendWrapped(context.Background(), ds, get)
+	if clockErr, ok := pErr.GetDetail().(*roachpb.UntrustworthyRemoteClockError); !ok {
+		t.Fatalf("expected an UntrustworthyRemoteClockError, got %v", pErr)
+	} else if clockErr.RemoteTimestamp != fakeTime {
+		t.Fatalf("expected remote timestamp %s, got %s", fakeTime, clockErr.RemoteTimestamp)
+	}
+
+	// Other batches may have been applied, so their error is ambiguous.
+	put := roachpb.NewPut(roachpb.Key("a"), roachpb.MakeValueFromString("value"))
+	_, pErr = client.SendWrapped(context.Background(), ds, put)
+	if ambErr, ok := pErr.GetDetail().(*roachpb.AmbiguousResultError); !ok {
+		t.Fatalf("expected an AmbiguousResultError, got %v", pErr)
+	} else if _, ok := ambErr.WrappedErr.GetDetail().(*roachpb.UntrustworthyRemoteClockError); !ok {
+		t.Fatalf("expected a wrapped UntrustworthyRemoteClockError, got %v", ambErr.WrappedErr)
+	}
+
+	if now := clock.Now(); !now.Less(fakeTime) {
+		t.Fatalf("clock was advanced to %s", now)
+	}
+	if count := ds.metrics.UntrustworthyClockErrCount.Count(); count != 2 {
+		t.Fatalf("expected 2 untrustworthy clock errors, got %d", count)
+	}
+}
+
+// TestReplicaResponseFilter verifies that the results of the RPCs sent to
+// replicas can be replaced by the ReplicaResponseFilter testing knob before
+// the DistSender acts on them.
+func TestReplicaResponseFilter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	leaseHolder := roachpb.ReplicaDescriptor{NodeID: 99, StoreID: 999}
+	var filtered []roachpb.RangeID
+	var filter func(BatchCall) BatchCall
+	var testFn rpcSendFn = func(
+		_ context.Context, _ SendOptions, _ ReplicaSlice, args roachpb.BatchRequest, _ *rpc.Context,
+	) (*roachpb.BatchResponse, error) {
+		return args.CreateReply(), nil
+	}
+	cfg := DistSenderConfig{
+		AmbientCtx: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:      clock,
+		TestingKnobs: DistSenderTestingKnobs{
+			TransportFactory: adaptLegacyTransport(testFn),
+			ReplicaResponseFilter: func(
+				_ context.Context, rangeID roachpb.RangeID, _ roachpb.BatchRequest, call BatchCall,
+			) BatchCall {
+				filtered = append(filtered, rangeID)
+				return filter(call)
+			},
+		},
+		RangeDescriptorDB: defaultMockRangeDescriptorDB,
+	}
+	ds := NewDistSender(cfg, g)
+
+	// A commit whose reply is lost is ambiguous.
+	filter = func(BatchCall) BatchCall {
+		return BatchCall{Err: errors.New("connection reset")}
+	}
+	var ba roachpb.BatchRequest
+	ba.Txn = &roachpb.Transaction{Name: "test"}
+	ba.Add(roachpb.NewPut(roachpb.Key("a"), roachpb.MakeValueFromString("value")))
+	ba.Add(&roachpb.EndTransactionRequest{Span: roachpb.Span{Key: roachpb.Key("a")}, Commit: true})
+	if _, pErr := ds.Send(context.Background(), ba); !testutils.IsPError(pErr, "result is ambiguous") {
+		t.Fatalf("expected an AmbiguousResultError, got %v", pErr)
+	}
+	if exp := []roachpb.RangeID{2}; !reflect.DeepEqual(filtered, exp) {
+		t.Fatalf("expected the filter to be called for %v, got %v", exp, filtered)
+	}
+
+	// A NotLeaseHolderError delivered in place of the reply redirects the
+	// retry of the batch to the lease holder it names.
+	filtered = nil
+	first := true
+	filter = func(call BatchCall) BatchCall {
+		if first {
+			first = false
+			call.Reply.Error = roachpb.NewError(&roachpb.NotLeaseHolderError{LeaseHolder: &leaseHolder})
+		}
+		return call
+	}
+	get := roachpb.NewGet(roachpb.Key("a"))
+	if _, pErr := client.SendWrapped(context.Background(), ds, get); pErr != nil {
+		t.Fatal(pErr)
+	}
+	if len(filtered) != 2 {
+		t.Fatalf("expected the filter to be called twice, got %d calls", len(filtered))
+	}
+	if cur, ok := ds.leaseHolderCache.Lookup(context.TODO(), 2); !ok || cur.StoreID != leaseHolder.StoreID {
+		t.Fatalf("expected lease holder %+v to be cached, got %+v", leaseHolder, cur)
+	}
+}
+
+// TestSlowRequestThreshold verifies that the threshold after which the
+// DistSender reports a batch as slow is set by the cluster setting, unless
+// the batch overrides it.
+func TestSlowRequestThreshold(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	st := cluster.MakeTestingClusterSettings()
+	ds := NewDistSender(DistSenderConfig{
+		AmbientCtx: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:      clock,
+		Settings:   st,
+	}, g)
+
+	var ba roachpb.BatchRequest
+	if threshold := ds.slowRequestThreshold(ba); threshold != base.SlowRequestThreshold {
+		t.Fatalf("expected the default threshold %s, got %s", base.SlowRequestThreshold, threshold)
+	}
+	defer settings.TestingSetDuration(&st.SlowRequestThreshold, time.Second)()
+	if threshold := ds.slowRequestThreshold(ba); threshold != time.Second {
+		t.Fatalf("expected the threshold of the setting, got %s", threshold)
+	}
+	ba.SlowRequestThresholdNanos = time.Millisecond.Nanoseconds()
+	if threshold := ds.slowRequestThreshold(ba); threshold != time.Millisecond {
+		t.Fatalf("expected the threshold of the batch, got %s", threshold)
+	}
+}
+
+// TestRangeReport verifies that the DistSender reports the execution of
+// the partial batches of a batch which requested it.
+func TestRangeReport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	var count int32
+	var testFn rpcSendFn = func(
+		_ context.Context, _ SendOptions, _ ReplicaSlice, args roachpb.BatchRequest, _ *rpc.Context,
+	) (*roachpb.BatchResponse, error) {
+		count++
+		if count == 1 {
+			// Make the DistSender look up the descriptor again and retry.
+			reply := &roachpb.BatchResponse{}
+			reply.Error = roachpb.NewError(roachpb.NewRangeNotFoundError(args.RangeID))
+			return reply, nil
+		}
+		return args.CreateReply(), nil
+	}
+	cfg := DistSenderConfig{
+		AmbientCtx: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:      clock,
+		TestingKnobs: DistSenderTestingKnobs{
+			TransportFactory: adaptLegacyTransport(testFn),
+		},
+		RangeDescriptorDB: defaultMockRangeDescriptorDB,
+	}
+	ds := NewDistSender(cfg, g)
+
+	var ba roachpb.BatchRequest
+	ba.Add(roachpb.NewGet(roachpb.Key("a")))
+	ba.CollectRangeReport = true
+	br, pErr := ds.Send(context.Background(), ba)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if len(br.RangeReport) != 1 {
+		t.Fatalf("expected a report for one range, got %+v", br.RangeReport)
+	}
+	if exec := br.RangeReport[0]; exec.RangeID != testRangeDescriptor.RangeID || exec.Attempts != 2 {
+		t.Fatalf("expected two attempts on r%d, got %+v", testRangeDescriptor.RangeID, exec)
+	}
+
+	ba.CollectRangeReport = false
+	br, pErr = ds.Send(context.Background(), ba)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if len(br.RangeReport) != 0 {
+		t.Fatalf("expected no report, got %+v", br.RangeReport)
+	}
+}
+
+// TestQueryIntentBatchedWithReads verifies that QueryIntent requests are
+// routed like point reads, and sent along with the reads of their batch.
+func TestQueryIntentBatchedWithReads(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	var sent [][]roachpb.Method
+	var testFn rpcSendFn = func(
+		_ context.Context, _ SendOptions, _ ReplicaSlice, args roachpb.BatchRequest, _ *rpc.Context,
+	) (*roachpb.BatchResponse, error) {
+		sent = append(sent, args.Methods())
+		reply := args.CreateReply()
+		for i, union := range args.Requests {
+			if qi, ok := union.GetInner().(*roachpb.QueryIntentRequest); ok {
+				reply.Responses[i].GetInner().(*roachpb.QueryIntentResponse).FoundIntent =
+					qi.Key.Equal(roachpb.Key("b"))
+			}
+		}
+		return reply, nil
+	}
+	cfg := DistSenderConfig{
+		AmbientCtx: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:      clock,
+		TestingKnobs: DistSenderTestingKnobs{
+			TransportFactory: adaptLegacyTransport(testFn),
+		},
+		RangeDescriptorDB: defaultMockRangeDescriptorDB,
+	}
+	ds := NewDistSender(cfg, g)
+
+	txn := roachpb.MakeTransaction(
+		"test", roachpb.Key("a"), roachpb.NormalUserPriority,
+		enginepb.SERIALIZABLE, clock.Now(), clock.MaxOffset().Nanoseconds(),
+	)
+	var ba roachpb.BatchRequest
+	ba.Add(roachpb.NewGet(roachpb.Key("a")))
+	ba.Add(roachpb.NewQueryIntent(roachpb.Key("b"), txn.TxnMeta))
+	ba.Add(roachpb.NewQueryIntent(roachpb.Key("c"), txn.TxnMeta))
+	br, pErr := ds.Send(context.Background(), ba)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	exp := [][]roachpb.Method{{roachpb.Get, roachpb.QueryIntent, roachpb.QueryIntent}}
+	if !reflect.DeepEqual(sent, exp) {
+		t.Fatalf("expected batches %v, got %v", exp, sent)
+	}
+	for i, found := range []bool{true, false} {
+		resp := br.Responses[i+1].GetInner().(*roachpb.QueryIntentResponse)
+		if resp.FoundIntent != found {
+			t.Errorf("%d: expected FoundIntent=%t, got %t", i, found, resp.FoundIntent)
+		}
+	}
+}
+
+// TestVerifyChecksumsOnResponse verifies that batches asking for it have
+// the checksums of their values verified, and fail with a ValueChecksumError
+// naming the key and replica of a corrupted value.
+func TestVerifyChecksumsOnResponse(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	var testFn rpcSendFn = func(
+		_ context.Context, _ SendOptions, _ ReplicaSlice, args roachpb.BatchRequest, _ *rpc.Context,
+	) (*roachpb.BatchResponse, error) {
+		reply := args.CreateReply()
+		value := roachpb.MakeValueFromString("value")
+		value.InitChecksum(roachpb.Key("a"))
+		value.RawBytes[len(value.RawBytes)-1]++
+		reply.Responses[0].GetInner().(*roachpb.GetResponse).Value = &value
+		return reply, nil
+	}
+	cfg := DistSenderConfig{
+		AmbientCtx: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:      clock,
+		TestingKnobs: DistSenderTestingKnobs{
+			TransportFactory: adaptLegacyTransport(testFn),
+		},
+		RangeDescriptorDB: defaultMockRangeDescriptorDB,
+	}
+	ds := NewDistSender(cfg, g)
+
+	// The corrupted value is returned unless verification is requested.
+	get := roachpb.NewGet(roachpb.Key("a"))
+	if _, pErr := client.SendWrapped(context.Background(), ds, get); pErr != nil {
+		t.Fatal(pErr)
+	}
+	_, pErr := client.SendWrappedWith(context.Background(), ds, roachpb.Header{
+		VerifyChecksums: true,
+	}, get)
+	if checksumErr, ok := pErr.GetDetail().(*roachpb.ValueChecksumError); !ok {
+		t.Fatalf("expected a ValueChecksumError, got %v", pErr)
+	} else if !checksumErr.Key.Equal(roachpb.Key("a")) {
+		t.Fatalf("expected the error to name key a, got %s", checksumErr.Key)
+	}
+	if count := ds.metrics.ValueChecksumErrCount.Count(); count != 1 {
+		t.Fatalf("expected 1 value checksum error, got %d", count)
+	}
+}
+
+// TestPhaseLatencies verifies that the phases of the processing of a batch
+// are recorded into the DistSender's metrics.
+func TestPhaseLatencies(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	cfg := DistSenderConfig{
+		AmbientCtx:        log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:             clock,
+		RangeDescriptorDB: defaultMockRangeDescriptorDB,
+	}
+	ds := NewDistSender(cfg, g)
+	ds.transportFactory = SenderTransportFactory(tracing.NewTracer(), client.SenderFunc(
+		func(_ context.Context, args roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+			return args.CreateReply(), nil
+		}))
+
+	put := roachpb.NewPut(roachpb.Key("a"), roachpb.MakeValueFromString("value"))
+	if _, err := client.SendWrapped(context.Background(), ds, put); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := ds.Metrics()
+	for name, h := range map[string]*metric.Histogram{
+		"descriptor lookup": metrics.DescriptorLookupLatency,
+		"truncate":          metrics.TruncateLatency,
+		"transport wait":    metrics.TransportLatency,
+		"combine":           metrics.CombineLatency,
+	} {
+		if h.TotalCount() == 0 {
+			t.Errorf("expected the %s phase to be recorded", name)
+		}
+	}
+}
+
 // TestTruncateWithSpanAndDescriptor verifies that a batch request is truncated with a
 // range span and the range of a descriptor found in cache.
 func TestTruncateWithSpanAndDescriptor(t *testing.T) {
@@ -2128,3 +2597,180 @@ func TestGatewayNodeID(t *testing.T) {
 		t.Errorf("got GatewayNodeID=%d, want %d", observedNodeID, expNodeID)
 	}
 }
+
+// TestDistSenderBackgroundRetryOptions verifies that background batches back
+// off more aggressively than foreground ones.
+func TestDistSenderBackgroundRetryOptions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	opts := retry.Options{
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+		Budget:         retry.NewBudget(1 /* rate */, 10 /* burst */),
+	}
+	ds := NewDistSender(DistSenderConfig{
+		AmbientCtx:      log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:           clock,
+		RPCRetryOptions: &opts,
+	}, g)
+	if budget := ds.metrics.RetryBudget.Value(); budget != 10 {
+		t.Errorf("expected a retry budget of 10, got %d", budget)
+	}
+
+	var ba roachpb.BatchRequest
+	if normal := ds.retryOptions(ba); normal != opts {
+		t.Errorf("expected %+v for a foreground batch, got %+v", opts, normal)
+	}
+	ba.QoSClass = roachpb.QOS_BACKGROUND
+	background := ds.retryOptions(ba)
+	if e := opts.InitialBackoff * backgroundBackoffMultiplier; background.InitialBackoff != e {
+		t.Errorf("expected initial backoff %s, got %s", e, background.InitialBackoff)
+	}
+	if e := opts.MaxBackoff * backgroundBackoffMultiplier; background.MaxBackoff != e {
+		t.Errorf("expected max backoff %s, got %s", e, background.MaxBackoff)
+	}
+	if background.Budget != opts.Budget {
+		t.Errorf("expected background batches to share the retry budget")
+	}
+
+	// Without a budget in the options, the DistSender uses its own.
+	ds = NewDistSender(DistSenderConfig{
+		AmbientCtx: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:      clock,
+	}, g)
+	if budget := ds.metrics.RetryBudget.Value(); budget != defaultRetryBudgetBurst {
+		t.Errorf("expected a retry budget of %d, got %d", defaultRetryBudgetBurst, budget)
+	}
+}
+
+// TestReplicaShuffleSeed verifies that DistSenders with the same replica
+// shuffle seed order the replicas of a range the same way.
+func TestReplicaShuffleSeed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	newDistSender := func() *DistSender {
+		return NewDistSender(DistSenderConfig{
+			AmbientCtx:   log.AmbientContext{Tracer: tracing.NewTracer()},
+			Clock:        clock,
+			TestingKnobs: DistSenderTestingKnobs{ReplicaShuffleSeed: 42},
+		}, g)
+	}
+	ds1, ds2 := newDistSender(), newDistSender()
+	makeReplicas := func() ReplicaSlice {
+		var rs ReplicaSlice
+		for i := 1; i <= 5; i++ {
+			rs = append(rs, ReplicaInfo{
+				ReplicaDescriptor: roachpb.ReplicaDescriptor{NodeID: roachpb.NodeID(i)},
+			})
+		}
+		return rs
+	}
+	for i := 0; i < 10; i++ {
+		rs1, rs2 := makeReplicas(), makeReplicas()
+		rs1.optimizeReplicaOrder(nil, nil /* latencyFn */, ds1.shuffle)
+		rs2.optimizeReplicaOrder(nil, nil /* latencyFn */, ds2.shuffle)
+		if !reflect.DeepEqual(rs1, rs2) {
+			t.Fatalf("%d: expected %v, got %v", i, rs1, rs2)
+		}
+	}
+}
+
+// TestDistSenderMaxStaleness verifies that the timestamp of an INCONSISTENT
+// read is set according to the staleness bound of the batch.
+func TestDistSenderMaxStaleness(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	var observedTS hlc.Timestamp
+	var testFn rpcSendFn = func(
+		_ context.Context,
+		_ SendOptions,
+		_ ReplicaSlice,
+		ba roachpb.BatchRequest,
+		_ *rpc.Context,
+	) (*roachpb.BatchResponse, error) {
+		observedTS = ba.Timestamp
+		return ba.CreateReply(), nil
+	}
+
+	cfg := DistSenderConfig{
+		AmbientCtx: log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:      clock,
+		TestingKnobs: DistSenderTestingKnobs{
+			TransportFactory: adaptLegacyTransport(testFn),
+		},
+		RangeDescriptorDB: defaultMockRangeDescriptorDB,
+	}
+	ds := NewDistSender(cfg, g)
+
+	var ba roachpb.BatchRequest
+	ba.ReadConsistency = roachpb.INCONSISTENT
+	ba.MaxStalenessNanos = time.Hour.Nanoseconds()
+	ba.Add(roachpb.NewGet(roachpb.Key("a")))
+	before := clock.Now()
+	if _, pErr := ds.Send(context.Background(), ba); pErr != nil {
+		t.Fatal(pErr)
+	}
+	after := clock.Now()
+	if observedTS.Less(before.Add(-ba.MaxStalenessNanos, 0)) ||
+		after.Add(-ba.MaxStalenessNanos, 0).Less(observedTS) {
+		t.Errorf("expected a timestamp an hour before [%s, %s], got %s", before, after, observedTS)
+	}
+
+	ba.MaxStalenessNanos = -1
+	if _, pErr := ds.Send(context.Background(), ba); !testutils.IsPError(pErr, "invalid max staleness") {
+		t.Errorf("unexpected error: %v", pErr)
+	}
+}
+
+// TestDistSenderCPutAllowIfDoesNotExistVersion verifies that conditional puts
+// allowing the key not to exist are rejected until the cluster version allows
+// them.
+func TestDistSenderCPutAllowIfDoesNotExistVersion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	oldSettings := cluster.MakeClusterSettings(cluster.VersionBase, cluster.BinaryServerVersion)
+	if err := oldSettings.InitializeVersion(cluster.ClusterVersion{
+		MinimumVersion: cluster.VersionReadRefresh,
+		UseVersion:     cluster.VersionReadRefresh,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	key := roachpb.Key("a")
+	value, expValue := roachpb.MakeValueFromString("b"), roachpb.MakeValueFromString("c")
+	testCases := []struct {
+		st            *cluster.Settings
+		allowNotExist bool
+		expErr        string
+	}{
+		{oldSettings, false, ""},
+		{oldSettings, true, "require cluster version"},
+		{cluster.MakeTestingClusterSettings(), true, ""},
+	}
+	for i, c := range testCases {
+		ds := NewDistSender(DistSenderConfig{
+			AmbientCtx: log.AmbientContext{Tracer: tracing.NewTracer()},
+			Clock:      hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+			Settings:   c.st,
+		}, nil /* gossip */)
+		var ba roachpb.BatchRequest
+		ba.Add(roachpb.NewConditionalPut(key, value, expValue, c.allowNotExist))
+		pErr := ds.initAndVerifyBatch(context.Background(), &ba)
+		if c.expErr == "" {
+			if pErr != nil {
+				t.Errorf("%d: unexpected error: %s", i, pErr)
+			}
+		} else if !testutils.IsPError(pErr, c.expErr) {
+			t.Errorf("%d: expected error %q, got %v", i, c.expErr, pErr)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+const (
+	// defaultRangeFeedPollInterval is the default interval at which the
+	// ranges of a range feed are polled for changes.
+	defaultRangeFeedPollInterval = time.Second
+	// rangeFeedPollMaxKeys bounds the number of keys whose revisions are
+	// returned by a single poll request.
+	rangeFeedPollMaxKeys = 10000
+)
+
+// RangeFeed streams the changes committed to the keys in the given span after
+// startFrom on eventC, until the context is canceled or an error occurs.
+//
+// The subscription is divided along range boundaries, and each range is
+// polled independently with PollChanges requests. A poll at timestamp T
+// returns the revisions committed up to T, and prevents any revision from
+// being committed at or below T afterwards; once its revisions have been
+// emitted, a checkpoint resolves the range's span at T. When a range splits,
+// its subscription is divided between the new ranges, which resume from the
+// last resolved timestamp.
+//
+// Revisions are emitted in timestamp order for each key, but not across keys
+// or ranges. A revision may be emitted more than once if a poll fails after
+// emitting part of its revisions, but never after a checkpoint covering it.
+func (ds *DistSender) RangeFeed(
+	ctx context.Context,
+	span roachpb.Span,
+	startFrom hlc.Timestamp,
+	eventC chan<- *roachpb.RangeFeedEvent,
+) error {
+	ctx = ds.AnnotateCtx(ctx)
+	if keys.IsLocal(span.Key) {
+		return errors.Errorf("range feeds are not supported on local keys: %s", span)
+	}
+	startKey, err := keys.Addr(span.Key)
+	if err != nil {
+		return err
+	}
+	endKey, err := keys.AddrUpperBound(span.EndKey)
+	if err != nil {
+		return err
+	}
+	if !startKey.Less(endKey) {
+		return errors.Errorf("invalid range feed span %s", span)
+	}
+
+	g, gCtx := errgroup.WithContext(ctx)
+	var spawn func(rs roachpb.RSpan, ts hlc.Timestamp)
+	spawn = func(rs roachpb.RSpan, ts hlc.Timestamp) {
+		g.Go(func() error {
+			return ds.partialRangeFeed(gCtx, rs, ts, eventC, spawn)
+		})
+	}
+	spawn(roachpb.RSpan{Key: startKey, EndKey: endKey}, startFrom)
+	return g.Wait()
+}
+
+// partialRangeFeed polls the given span for changes committed after ts, as
+// long as it is contained in a single range. Once the span is found to cover
+// several ranges, a feed is spawned for its intersection with each of them
+// instead.
+func (ds *DistSender) partialRangeFeed(
+	ctx context.Context,
+	rs roachpb.RSpan,
+	ts hlc.Timestamp,
+	eventC chan<- *roachpb.RangeFeedEvent,
+	spawn func(roachpb.RSpan, hlc.Timestamp),
+) error {
+	span := roachpb.Span{Key: rs.Key.AsRawKey(), EndKey: rs.EndKey.AsRawKey()}
+	for {
+		ri := NewRangeIterator(ds)
+		ri.Seek(ctx, rs.Key, Ascending)
+		if !ri.Valid() {
+			return ri.Error().GoError()
+		}
+		if ri.NeedAnother(rs) {
+			for ; ri.Valid(); ri.Next(ctx) {
+				partialRS, err := rs.Intersect(ri.Desc())
+				if err != nil {
+					return err
+				}
+				spawn(partialRS, ts)
+				if !ri.NeedAnother(rs) {
+					return nil
+				}
+			}
+			return ri.Error().GoError()
+		}
+
+		resolved, pErr := ds.pollRangeFeed(ctx, span, ts, eventC)
+		if pErr != nil {
+			if _, ok := pErr.GetDetail().(*roachpb.SendError); !ok {
+				return pErr.GoError()
+			}
+			// The range is unavailable for now; keep polling it.
+			log.Warningf(ctx, "failed to poll range feed span %s: %s", span, pErr)
+		} else {
+			ts = resolved
+		}
+
+		select {
+		case <-time.After(ds.rangeFeedPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pollRangeFeed emits the revisions of the keys in the given span committed
+// after startFrom and up to the current time, followed by a checkpoint of the
+// span at that time, which is returned.
+func (ds *DistSender) pollRangeFeed(
+	ctx context.Context,
+	span roachpb.Span,
+	startFrom hlc.Timestamp,
+	eventC chan<- *roachpb.RangeFeedEvent,
+) (hlc.Timestamp, *roachpb.Error) {
+	var ba roachpb.BatchRequest
+	ba.Timestamp = ds.clock.Now()
+	ba.MaxSpanRequestKeys = rangeFeedPollMaxKeys
+	for resume := &span; resume != nil; {
+		ba.Requests = nil
+		ba.Add(&roachpb.PollChangesRequest{Span: *resume, StartTime: startFrom})
+		br, pErr := ds.Send(ctx, ba)
+		if pErr != nil {
+			return hlc.Timestamp{}, pErr
+		}
+		resp := br.Responses[0].GetInner().(*roachpb.PollChangesResponse)
+		for _, kv := range resp.Revisions {
+			event := &roachpb.RangeFeedEvent{
+				Val: &roachpb.RangeFeedValue{Key: kv.Key, Value: kv.Value},
+			}
+			if err := sendRangeFeedEvent(ctx, eventC, event); err != nil {
+				return hlc.Timestamp{}, roachpb.NewError(err)
+			}
+		}
+		resume = resp.ResumeSpan
+	}
+
+	event := &roachpb.RangeFeedEvent{
+		Checkpoint: &roachpb.RangeFeedCheckpoint{Span: span, ResolvedTS: ba.Timestamp},
+	}
+	if err := sendRangeFeedEvent(ctx, eventC, event); err != nil {
+		return hlc.Timestamp{}, roachpb.NewError(err)
+	}
+	return ba.Timestamp, nil
+}
+
+func sendRangeFeedEvent(
+	ctx context.Context, eventC chan<- *roachpb.RangeFeedEvent, event *roachpb.RangeFeedEvent,
+) error {
+	select {
+	case eventC <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
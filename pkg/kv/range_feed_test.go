@@ -0,0 +1,126 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestRangeFeed verifies that a range feed emits the revisions committed to
+// its span and resolves all of it, including after a split.
+func TestRangeFeed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	s, _, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+	ctx := context.TODO()
+
+	setupMultipleRanges(t, s, "b")
+	db := s.KVDB().(*client.DB)
+	if err := db.Put(ctx, "a1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(ctx, "c1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	feedCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	span := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("d")}
+	eventC := make(chan *roachpb.RangeFeedEvent, 16)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- db.RangeFeed(feedCtx, span, hlc.Timestamp{}, eventC)
+	}()
+
+	// waitFor consumes events until the given keys have been emitted and
+	// the whole span has been resolved past their revisions.
+	waitFor := func(keys ...string) {
+		pending := map[string]hlc.Timestamp{}
+		for _, k := range keys {
+			pending[k] = hlc.Timestamp{}
+		}
+		// The latest checkpoint of each resolved span, keyed by start key.
+		resolved := map[string]roachpb.RangeFeedCheckpoint{}
+		deadline := time.After(45 * time.Second)
+		for {
+			select {
+			case event := <-eventC:
+				if v := event.Val; v != nil {
+					if _, ok := pending[string(v.Key)]; ok {
+						pending[string(v.Key)] = v.Value.Timestamp
+					}
+					continue
+				}
+				resolved[string(event.Checkpoint.Span.Key)] = *event.Checkpoint
+			case err := <-errC:
+				t.Fatalf("range feed failed: %v", err)
+			case <-deadline:
+				t.Fatalf("timed out waiting for %v; resolved: %v", keys, resolved)
+			}
+			if checkResolved(span, resolved, pending) {
+				return
+			}
+		}
+	}
+	waitFor("a1", "c1")
+
+	if err := db.AdminSplit(ctx, "c", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(ctx, "c2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("c2")
+
+	cancel()
+	if err := <-errC; errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected the range feed to be canceled, got %v", err)
+	}
+}
+
+// checkResolved returns whether all the pending revisions have been emitted,
+// and the given checkpoints cover the span at timestamps which resolve them.
+func checkResolved(
+	span roachpb.Span,
+	resolved map[string]roachpb.RangeFeedCheckpoint,
+	pending map[string]hlc.Timestamp,
+) bool {
+	var maxTS hlc.Timestamp
+	for _, ts := range pending {
+		if ts == (hlc.Timestamp{}) {
+			return false
+		}
+		maxTS.Forward(ts)
+	}
+	for key := span.Key; !key.Equal(span.EndKey); {
+		c, ok := resolved[string(key)]
+		if !ok || c.ResolvedTS.Less(maxTS) {
+			return false
+		}
+		key = c.Span.EndKey
+	}
+	return true
+}
@@ -15,16 +15,35 @@
 package kv
 
 import (
+	"time"
+
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 )
 
 // A RangeIterator provides a mechanism for iterating over all ranges
-// in a key span. A new RangeIterator must be positioned with Seek()
-// to begin iteration.
+// in a key span, using the range descriptors cached by a DistSender. A new
+// RangeIterator must be positioned with Seek() to begin iteration. It then
+// moves in the direction of the last Seek() with Next(), or back with Prev().
+// If a consumer finds the descriptor of the current range to be stale, e.g.
+// because a request to the range failed with a RangeKeyMismatchError, it
+// calls Restart() to resume the iteration from the current key with a fresh
+// descriptor.
+//
+// A typical iteration over a span looks like:
+//
+//   ri := kv.NewRangeIterator(ds)
+//   for ri.Seek(ctx, span.Key, kv.Ascending); ri.Valid(); ri.Next(ctx) {
+//     // Use ri.Desc().
+//     if !ri.NeedAnother(span) {
+//       break
+//     }
+//   }
+//   if err := ri.Error().GoError(); err != nil { ... }
 //
 // RangeIterator is not thread-safe.
 type RangeIterator struct {
@@ -35,6 +54,34 @@ type RangeIterator struct {
 	token   *EvictionToken
 	init    bool
 	pErr    *roachpb.Error
+
+	// stats accumulates the stats of all the steps, and stepStats those of
+	// the last one.
+	stats, stepStats RangeIteratorStats
+}
+
+// RangeIteratorStats describes the work done by a RangeIterator to position
+// itself, either for a single step or cumulatively.
+type RangeIteratorStats struct {
+	// Steps is the number of times the iterator was positioned, by Seek(),
+	// Next(), Prev() or Restart().
+	Steps int64
+	// Lookups is the number of range descriptor lookups, served from the
+	// cache or not, including the retried ones.
+	Lookups int64
+	// Evictions is the number of range descriptors evicted from the cache,
+	// because they didn't contain the key they were looked up for or because
+	// of a Restart().
+	Evictions int64
+	// LookupTime is the time spent looking up range descriptors.
+	LookupTime time.Duration
+}
+
+func (s *RangeIteratorStats) add(o RangeIteratorStats) {
+	s.Steps += o.Steps
+	s.Lookups += o.Lookups
+	s.Evictions += o.Evictions
+	s.LookupTime += o.LookupTime
 }
 
 // NewRangeIterator creates a new RangeIterator.
@@ -87,6 +134,22 @@ func (ri *RangeIterator) LeaseHolder(ctx context.Context) (roachpb.ReplicaDescri
 	return ri.ds.leaseHolderCache.Lookup(ctx, ri.Desc().RangeID)
 }
 
+// ScanDirection returns the direction in which Next() advances, as set by
+// the last Seek().
+func (ri *RangeIterator) ScanDirection() ScanDirection {
+	return ri.scanDir
+}
+
+// Stats returns the stats accumulated over all the steps of the iterator.
+func (ri *RangeIterator) Stats() RangeIteratorStats {
+	return ri.stats
+}
+
+// StepStats returns the stats of the last step of the iterator.
+func (ri *RangeIterator) StepStats() RangeIteratorStats {
+	return ri.stepStats
+}
+
 // Token returns the eviction token corresponding to the range
 // descriptor for the current iteration. The iterator must be valid.
 func (ri *RangeIterator) Token() *EvictionToken {
@@ -143,8 +206,61 @@ func (ri *RangeIterator) Next(ctx context.Context) {
 	}
 }
 
+// Prev moves the iterator back to the range preceding the current one in
+// the direction of the iteration, i.e. to the range on the left of the
+// current one for an Ascending iteration. The direction of the iteration is
+// unchanged. The iterator must be valid.
+func (ri *RangeIterator) Prev(ctx context.Context) {
+	if !ri.Valid() {
+		panic(ri.Error())
+	}
+	scanDir := ri.scanDir
+	if scanDir == Ascending {
+		ri.Seek(ctx, ri.desc.StartKey, Descending)
+	} else {
+		ri.Seek(ctx, ri.desc.EndKey, Ascending)
+	}
+	ri.scanDir = scanDir
+	if ri.pErr != nil {
+		return
+	}
+	// Position the iterator at the key Next() would have left it at when
+	// moving to this range.
+	if scanDir == Ascending {
+		ri.key = ri.desc.StartKey
+	} else {
+		ri.key = ri.desc.EndKey
+	}
+}
+
+// Restart evicts the descriptor of the current range from the range
+// descriptor cache, if the iterator is valid, and seeks again to the current
+// key in the same direction. This resumes an iteration whose current
+// descriptor turned out to be stale, or which failed to seek because of a
+// transient error, without starting over. The iterator must have been
+// positioned with Seek().
+func (ri *RangeIterator) Restart(ctx context.Context) {
+	if !ri.init {
+		panic(ri.Error())
+	}
+	if ri.pErr == nil {
+		if err := ri.token.Evict(ctx); err != nil {
+			ri.pErr = roachpb.NewError(err)
+			return
+		}
+		// The eviction is accounted to the step performed by Seek below.
+		defer func() {
+			ri.stepStats.Evictions++
+			ri.stats.Evictions++
+		}()
+	}
+	ri.Seek(ctx, ri.key, ri.scanDir)
+}
+
 // Seek positions the iterator at the specified key.
 func (ri *RangeIterator) Seek(ctx context.Context, key roachpb.RKey, scanDir ScanDirection) {
+	ri.stepStats = RangeIteratorStats{Steps: 1}
+	defer func() { ri.stats.add(ri.stepStats) }()
 	if log.HasSpanOrEvent(ctx) {
 		rev := ""
 		if scanDir == Descending {
@@ -159,7 +275,8 @@ func (ri *RangeIterator) Seek(ctx context.Context, key roachpb.RKey, scanDir Sca
 
 	if (scanDir == Ascending && key.Equal(roachpb.RKeyMax)) ||
 		(scanDir == Descending && key.Equal(roachpb.RKeyMin)) {
-		ri.pErr = roachpb.NewErrorf("RangeIterator seek to invalid key %s", key)
+		ri.pErr = roachpb.NewErrorf("RangeIterator seek to invalid key %s",
+			ri.ds.keyPrinter().Key(key.AsRawKey()))
 		return
 	}
 
@@ -167,8 +284,11 @@ func (ri *RangeIterator) Seek(ctx context.Context, key roachpb.RKey, scanDir Sca
 	// deals with retryable range descriptor lookups.
 	for r := retry.StartWithCtx(ctx, ri.ds.rpcRetryOptions); r.Next(); {
 		var err error
+		start := timeutil.Now()
 		ri.desc, ri.token, err = ri.ds.getDescriptor(
 			ctx, ri.key, ri.token, ri.scanDir == Descending)
+		ri.stepStats.Lookups++
+		ri.stepStats.LookupTime += timeutil.Since(start)
 
 		if log.V(2) {
 			log.Infof(ctx, "key: %s, desc: %s err: %v", ri.key, ri.desc, err)
@@ -199,6 +319,7 @@ func (ri *RangeIterator) Seek(ctx context.Context, key roachpb.RKey, scanDir Sca
 				ri.pErr = roachpb.NewError(err)
 				return
 			}
+			ri.stepStats.Evictions++
 			// On addressing errors, don't backoff; retry immediately.
 			r.Reset()
 			continue
@@ -213,6 +334,7 @@ func (ri *RangeIterator) Seek(ctx context.Context, key roachpb.RKey, scanDir Sca
 	if pErr := ri.ds.deduceRetryEarlyExitError(ctx); pErr != nil {
 		ri.pErr = pErr
 	} else {
-		ri.pErr = roachpb.NewErrorf("RangeIterator failed to seek to %s", key)
+		ri.pErr = roachpb.NewErrorf("RangeIterator failed to seek to %s",
+			ri.ds.keyPrinter().Key(key.AsRawKey()))
 	}
 }
@@ -203,3 +203,113 @@ func TestRangeIterSeekReverse(t *testing.T) {
 		}
 	}
 }
+
+func TestRangeIterPrev(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	ds := NewDistSender(DistSenderConfig{
+		AmbientCtx:        log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:             clock,
+		RangeDescriptorDB: alphaRangeDescriptorDB,
+	}, g)
+
+	ctx := context.Background()
+
+	for _, scanDir := range []ScanDirection{Ascending, Descending} {
+		ri := NewRangeIterator(ds)
+		// Range 5 spans [d,e).
+		if scanDir == Ascending {
+			ri.Seek(ctx, roachpb.RKey("d"), scanDir)
+		} else {
+			ri.Seek(ctx, roachpb.RKey("e"), scanDir)
+		}
+		ri.Next(ctx)
+		ri.Prev(ctx)
+		if !ri.Valid() {
+			t.Fatal(ri.Error())
+		}
+		if desc := ri.Desc(); !reflect.DeepEqual(alphaRangeDescriptors[4], desc) {
+			t.Fatalf("%d: expected %v; got %v", scanDir, alphaRangeDescriptors[4], desc)
+		}
+		if ri.ScanDirection() != scanDir {
+			t.Fatalf("%d: the direction changed to %d", scanDir, ri.ScanDirection())
+		}
+		// Next moves in the original direction from the range Prev moved to.
+		ri.Next(ctx)
+		exp := alphaRangeDescriptors[5]
+		if scanDir == Descending {
+			exp = alphaRangeDescriptors[3]
+		}
+		if desc := ri.Desc(); !reflect.DeepEqual(exp, desc) {
+			t.Fatalf("%d: expected %v; got %v", scanDir, exp, desc)
+		}
+	}
+
+	// There is no range before the first one.
+	ri := NewRangeIterator(ds)
+	ri.Seek(ctx, roachpb.RKey(roachpb.KeyMin), Ascending)
+	ri.Prev(ctx)
+	if ri.Valid() {
+		t.Fatalf("expected an invalid iterator, got %v", ri.Desc())
+	}
+}
+
+func TestRangeIterRestart(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	var lookups int
+	db := MockRangeDescriptorDB(func(key roachpb.RKey, useReverseScan bool) (
+		[]roachpb.RangeDescriptor, []roachpb.RangeDescriptor, *roachpb.Error,
+	) {
+		if !bytes.HasPrefix(key, keys.Meta2Prefix) {
+			lookups++
+		}
+		return alphaRangeDescriptorDB(key, useReverseScan)
+	})
+	g, clock := makeGossip(t, stopper)
+	ds := NewDistSender(DistSenderConfig{
+		AmbientCtx:        log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:             clock,
+		RangeDescriptorDB: db,
+	}, g)
+
+	ctx := context.Background()
+
+	ri := NewRangeIterator(ds)
+	ri.Seek(ctx, roachpb.RKey("c"), Ascending)
+	ri.Next(ctx)
+	if !ri.Valid() {
+		t.Fatal(ri.Error())
+	}
+	if stats := ri.StepStats(); stats.Steps != 1 || stats.Lookups != 1 || stats.Evictions != 0 {
+		t.Fatalf("unexpected step stats %+v", stats)
+	}
+	before := lookups
+
+	// Restarting evicts the descriptor of the current range, which is looked
+	// up again, and stays at the current key.
+	ri.Restart(ctx)
+	if !ri.Valid() {
+		t.Fatal(ri.Error())
+	}
+	if desc := ri.Desc(); !reflect.DeepEqual(alphaRangeDescriptors[4], desc) {
+		t.Fatalf("expected %v; got %v", alphaRangeDescriptors[4], desc)
+	}
+	if !ri.Key().Equal(roachpb.RKey("d")) {
+		t.Fatalf("expected the iterator at d, got %s", ri.Key())
+	}
+	if lookups <= before {
+		t.Fatalf("expected the descriptor to be looked up again")
+	}
+	if stats := ri.StepStats(); stats.Steps != 1 || stats.Lookups != 1 || stats.Evictions != 1 {
+		t.Fatalf("unexpected step stats %+v", stats)
+	}
+	if stats := ri.Stats(); stats.Steps != 3 || stats.Lookups != 3 || stats.Evictions != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
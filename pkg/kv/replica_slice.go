@@ -15,6 +15,9 @@
 package kv
 
 import (
+	"sort"
+	"time"
+
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/gossip"
@@ -34,6 +37,11 @@ func (i ReplicaInfo) attrs() []string {
 	return i.NodeDesc.Attrs.Attrs
 }
 
+// A LatencyFunc returns the latency of the connection to the node at the given
+// address, and whether it is known, e.g. from the heartbeats of the rpc
+// Context (see RemoteClockMonitor.Latency).
+type LatencyFunc func(addr string) (time.Duration, bool)
+
 // A ReplicaSlice is a slice of ReplicaInfo.
 type ReplicaSlice []ReplicaInfo
 
@@ -100,6 +108,14 @@ func (rs ReplicaSlice) FindReplicaByNodeID(nodeID roachpb.NodeID) int {
 // returned (hence, if the return value equals the length of the ReplicaSlice,
 // at least one replica matched all attributes).
 func (rs ReplicaSlice) SortByCommonAttributePrefix(attrs []string) int {
+	return rs.sortByCommonAttributePrefix(attrs, shuffle.Shuffle)
+}
+
+// sortByCommonAttributePrefix is SortByCommonAttributePrefix with the given
+// shuffle function.
+func (rs ReplicaSlice) sortByCommonAttributePrefix(
+	attrs []string, shuffleFn func(shuffle.Interface),
+) int {
 	if len(rs) < 2 {
 		return 0
 	}
@@ -116,7 +132,7 @@ func (rs ReplicaSlice) SortByCommonAttributePrefix(attrs []string) int {
 			}
 		}
 		if topIndex < len(rs)-1 {
-			shuffle.Shuffle(rs[firstNotOrdered : topIndex+1])
+			shuffleFn(rs[firstNotOrdered : topIndex+1])
 		}
 		if firstNotOrdered == 0 {
 			return bucket
@@ -147,22 +163,132 @@ func (rs ReplicaSlice) MoveToFront(i int) {
 // nodeDesc is the descriptor of the current node. It can be nil, in which case
 // information about the current descriptor is not used in optimizing the order.
 //
+// latencyFn can be nil. Otherwise, the replicas which are equally close by
+// their attributes are ordered by the latency it reports to their nodes,
+// lowest first, ahead of those whose latency is unknown.
+//
 // Note that this method is not concerned with any information the node might
 // have about who the lease holder might be. If there is such info (e.g. in a
 // LeaseHolderCache), the caller will probably want to further tweak the head of
 // the ReplicaSlice.
-func (rs ReplicaSlice) OptimizeReplicaOrder(nodeDesc *roachpb.NodeDescriptor) {
-	// If we don't know which node we're on, send the RPCs randomly.
+func (rs ReplicaSlice) OptimizeReplicaOrder(
+	nodeDesc *roachpb.NodeDescriptor, latencyFn LatencyFunc,
+) {
+	rs.optimizeReplicaOrder(nodeDesc, latencyFn, shuffle.Shuffle)
+}
+
+// optimizeReplicaOrder is OptimizeReplicaOrder with the given shuffle
+// function.
+func (rs ReplicaSlice) optimizeReplicaOrder(
+	nodeDesc *roachpb.NodeDescriptor, latencyFn LatencyFunc, shuffleFn func(shuffle.Interface),
+) {
+	// If we don't know which node we're on, send the RPCs randomly, unless
+	// we know the latency to the nodes.
 	if nodeDesc == nil {
-		shuffle.Shuffle(rs)
+		shuffleFn(rs)
+		rs.sortByLatency(nil, latencyFn)
 		return
 	}
 	// Sort replicas by attribute affinity, which we treat as a stand-in for
-	// proximity (for now).
-	rs.SortByCommonAttributePrefix(nodeDesc.Attrs.Attrs)
+	// proximity (for now), and break the ties by latency, which measures it.
+	rs.sortByCommonAttributePrefix(nodeDesc.Attrs.Attrs, shuffleFn)
+	rs.sortByLatency(nodeDesc.Attrs.Attrs, latencyFn)
 
 	// If there is a replica in local node, move it to the front.
 	if i := rs.FindReplicaByNodeID(nodeDesc.NodeID); i > 0 {
 		rs.MoveToFront(i)
 	}
 }
+
+// sortByLatency stably sorts the replicas which have a common attribute
+// prefix of the same length with attrs by the latency latencyFn reports to
+// their nodes, lowest first. The replicas of unknown latency keep their order
+// after the others. The replicas must already be sorted by
+// sortByCommonAttributePrefix. A nil latencyFn leaves them unchanged.
+func (rs ReplicaSlice) sortByLatency(attrs []string, latencyFn LatencyFunc) {
+	if latencyFn == nil || len(rs) < 2 {
+		return
+	}
+	type entry struct {
+		ReplicaInfo
+		prefix  int
+		latency time.Duration
+		known   bool
+	}
+	entries := make([]entry, len(rs))
+	for i, r := range rs {
+		e := entry{ReplicaInfo: r}
+		for e.prefix < len(attrs) && e.prefix < len(r.attrs()) &&
+			r.attrs()[e.prefix] == attrs[e.prefix] {
+			e.prefix++
+		}
+		e.latency, e.known = latencyFn(r.NodeDesc.Address.String())
+		entries[i] = e
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.prefix != b.prefix {
+			return a.prefix > b.prefix
+		}
+		if a.known != b.known {
+			return a.known
+		}
+		return a.known && a.latency < b.latency
+	})
+	for i := range entries {
+		rs[i] = entries[i].ReplicaInfo
+	}
+}
+
+// MoveOverloadedToBack moves the replicas on overloaded stores to the back of
+// the slice, keeping the relative order of the remaining replicas, as well as
+// that of the moved ones, stable. A store is overloaded if the queries or the
+// CPU seconds it serves per second exceed their mean over the stores of all
+// the replicas by more than the given fraction of that mean. Replicas whose
+// store is missing from capacities are never considered overloaded.
+func (rs ReplicaSlice) MoveOverloadedToBack(
+	capacities map[roachpb.StoreID]roachpb.StoreCapacity, threshold float64,
+) {
+	if len(capacities) < 2 {
+		return
+	}
+	var meanQPS, meanCPU float64
+	for _, c := range capacities {
+		meanQPS += c.QueriesPerSecond
+		meanCPU += c.CpuPerSecond
+	}
+	meanQPS /= float64(len(capacities))
+	meanCPU /= float64(len(capacities))
+
+	rs.moveToBack(func(r ReplicaInfo) bool {
+		c, ok := capacities[r.StoreID]
+		return ok && (c.QueriesPerSecond > meanQPS*(1+threshold) ||
+			c.CpuPerSecond > meanCPU*(1+threshold))
+	})
+}
+
+// MoveUnavailableToBack moves the replicas on nodes for which unavailable
+// returns true, e.g. nodes which node liveness considers dead or draining,
+// to the back of the slice, keeping the relative order of the remaining
+// replicas, as well as that of the moved ones, stable.
+func (rs ReplicaSlice) MoveUnavailableToBack(unavailable func(roachpb.NodeID) bool) {
+	rs.moveToBack(func(r ReplicaInfo) bool {
+		return unavailable(r.NodeID)
+	})
+}
+
+// moveToBack stably partitions the slice so that the replicas for which
+// pred returns true come last.
+func (rs ReplicaSlice) moveToBack(pred func(ReplicaInfo) bool) {
+	var back ReplicaSlice
+	front := 0
+	for _, r := range rs {
+		if pred(r) {
+			back = append(back, r)
+		} else {
+			rs[front] = r
+			front++
+		}
+	}
+	copy(rs[front:], back)
+}
@@ -15,10 +15,13 @@
 package kv
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 )
 
@@ -159,10 +162,129 @@ func TestMoveLocalReplicaToFront(t *testing.T) {
 		},
 	}
 	for _, test := range testCase {
-		test.slice.OptimizeReplicaOrder(&test.localNodeDesc)
+		test.slice.OptimizeReplicaOrder(&test.localNodeDesc, nil /* latencyFn */)
 		if s := test.slice[0]; s.NodeID != test.localNodeDesc.NodeID {
 			t.Errorf("unexpected header, wanted nodeid = %d, got %d", test.localNodeDesc.NodeID, s.NodeID)
 		}
 	}
 
 }
+
+// TestOptimizeReplicaOrderByLatency verifies that OptimizeReplicaOrder
+// orders the replicas which are equally close by attributes by latency.
+func TestOptimizeReplicaOrderByLatency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	latencies := map[string]time.Duration{
+		"node2:1": 30 * time.Millisecond,
+		"node3:1": 10 * time.Millisecond,
+		"node4:1": time.Millisecond,
+	}
+	latencyFn := func(addr string) (time.Duration, bool) {
+		latency, ok := latencies[addr]
+		return latency, ok
+	}
+	makeSlice := func() ReplicaSlice {
+		var rs ReplicaSlice
+		for i, attr := range []string{"a", "a", "b", "a"} {
+			nodeID := roachpb.NodeID(i + 2)
+			rs = append(rs, ReplicaInfo{
+				ReplicaDescriptor: roachpb.ReplicaDescriptor{NodeID: nodeID, StoreID: roachpb.StoreID(nodeID)},
+				NodeDesc: &roachpb.NodeDescriptor{
+					NodeID:  nodeID,
+					Address: util.MakeUnresolvedAddr("tcp", fmt.Sprintf("node%d:1", nodeID)),
+					Attrs:   roachpb.Attributes{Attrs: []string{attr}},
+				},
+			})
+		}
+		return rs
+	}
+
+	testCases := []struct {
+		nodeDesc *roachpb.NodeDescriptor
+		exp      []roachpb.StoreID
+	}{
+		// Without a node descriptor, only the latencies matter and the replica
+		// of unknown latency comes last.
+		{nil, []roachpb.StoreID{4, 3, 2, 5}},
+		// The attributes take precedence over the latencies.
+		{&roachpb.NodeDescriptor{NodeID: 1, Attrs: roachpb.Attributes{Attrs: []string{"a"}}},
+			[]roachpb.StoreID{3, 2, 5, 4}},
+		// The local replica comes first regardless of latency.
+		{&roachpb.NodeDescriptor{NodeID: 5, Attrs: roachpb.Attributes{Attrs: []string{"a"}}},
+			[]roachpb.StoreID{5, 3, 2, 4}},
+	}
+	for i, tc := range testCases {
+		rs := makeSlice()
+		rs.OptimizeReplicaOrder(tc.nodeDesc, latencyFn)
+		if stores := getStores(rs); !reflect.DeepEqual(stores, tc.exp) {
+			t.Errorf("%d: expected order %s, got %s", i, tc.exp, stores)
+		}
+	}
+}
+
+func TestMoveOverloadedToBack(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	const threshold = 0.2
+	testCases := []struct {
+		capacities map[roachpb.StoreID]roachpb.StoreCapacity
+		exp        []roachpb.StoreID
+	}{
+		// No capacities known.
+		{nil, []roachpb.StoreID{1, 2, 3, 4, 5}},
+		// Balanced load.
+		{map[roachpb.StoreID]roachpb.StoreCapacity{
+			1: {QueriesPerSecond: 100, CpuPerSecond: 1},
+			2: {QueriesPerSecond: 110, CpuPerSecond: 1},
+			3: {QueriesPerSecond: 90, CpuPerSecond: 1},
+		}, []roachpb.StoreID{1, 2, 3, 4, 5}},
+		// Overloaded in queries.
+		{map[roachpb.StoreID]roachpb.StoreCapacity{
+			1: {QueriesPerSecond: 500},
+			2: {QueriesPerSecond: 100},
+			3: {QueriesPerSecond: 100},
+		}, []roachpb.StoreID{2, 3, 4, 5, 1}},
+		// Overloaded in CPU, with stores of unknown load.
+		{map[roachpb.StoreID]roachpb.StoreCapacity{
+			2: {CpuPerSecond: 4},
+			4: {CpuPerSecond: 1},
+			5: {CpuPerSecond: 4},
+		}, []roachpb.StoreID{1, 3, 4, 2, 5}},
+	}
+	for i, tc := range testCases {
+		rs := createReplicaSlice()
+		rs.MoveOverloadedToBack(tc.capacities, threshold)
+		if stores := getStores(rs); !reflect.DeepEqual(stores, tc.exp) {
+			t.Errorf("%d: expected order %s, got %s", i, tc.exp, stores)
+		}
+	}
+}
+
+func TestMoveUnavailableToBack(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testCases := []struct {
+		unavailable []roachpb.NodeID
+		exp         []roachpb.StoreID
+	}{
+		{nil, []roachpb.StoreID{1, 2, 3, 4, 5}},
+		{[]roachpb.NodeID{1}, []roachpb.StoreID{2, 3, 4, 5, 1}},
+		{[]roachpb.NodeID{4, 2}, []roachpb.StoreID{1, 3, 5, 2, 4}},
+		{[]roachpb.NodeID{1, 2, 3, 4, 5}, []roachpb.StoreID{1, 2, 3, 4, 5}},
+	}
+	for i, tc := range testCases {
+		rs := createReplicaSlice()
+		for j := range rs {
+			rs[j].NodeID = roachpb.NodeID(rs[j].StoreID)
+		}
+		rs.MoveUnavailableToBack(func(nodeID roachpb.NodeID) bool {
+			for _, id := range tc.unavailable {
+				if id == nodeID {
+					return true
+				}
+			}
+			return false
+		})
+		if stores := getStores(rs); !reflect.DeepEqual(stores, tc.exp) {
+			t.Errorf("%d: expected order %s, got %s", i, tc.exp, stores)
+		}
+	}
+}
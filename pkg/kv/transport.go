@@ -49,6 +49,8 @@ type batchClient struct {
 	pending    bool
 	retryable  bool
 	deadline   time.Time
+	// dialDuration is the time it took to obtain the connection.
+	dialDuration time.Duration
 }
 
 // BatchCall contains a response and an RPC error (note that the
@@ -113,19 +115,22 @@ func grpcTransportFactoryImpl(
 ) (Transport, error) {
 	clients := make([]batchClient, 0, len(replicas))
 	for _, replica := range replicas {
+		dialStart := timeutil.Now()
 		conn, err := rpcContext.GRPCDial(replica.NodeDesc.Address.String())
 		if err != nil {
 			return nil, err
 		}
+		dialDuration := timeutil.Since(dialStart)
 		argsCopy := args
 		argsCopy.Replica = replica.ReplicaDescriptor
 		remoteAddr := replica.NodeDesc.Address.String()
 		clients = append(clients, batchClient{
-			remoteAddr: remoteAddr,
-			conn:       conn,
-			client:     roachpb.NewInternalClient(conn),
-			args:       argsCopy,
-			healthy:    rpcContext.ConnHealth(remoteAddr) == nil,
+			remoteAddr:   remoteAddr,
+			conn:         conn,
+			client:       roachpb.NewInternalClient(conn),
+			args:         argsCopy,
+			healthy:      rpcContext.ConnHealth(remoteAddr) == nil,
+			dialDuration: dialDuration,
 		})
 	}
 
@@ -200,6 +205,7 @@ func (gt *grpcTransport) SendNext(ctx context.Context, done chan<- BatchCall) {
 	go func() {
 		defer gt.closeWG.Done()
 		gt.opts.metrics.SentCount.Inc(1)
+		sendStart := timeutil.Now()
 		reply, err := func() (*roachpb.BatchResponse, error) {
 			if localServer := gt.rpcContext.GetLocalInternalServerForAddr(client.remoteAddr); localServer != nil {
 				log.VEvent(ctx, 2, "sending request to local server")
@@ -235,6 +241,7 @@ func (gt *grpcTransport) SendNext(ctx context.Context, done chan<- BatchCall) {
 			}
 			return reply, err
 		}()
+		logReplicaAttempt(ctx, client, timeutil.Since(sendStart), reply, err)
 		// NotLeaseHolderErrors can be retried.
 		var retryable bool
 		if reply != nil && reply.Error != nil {
@@ -249,6 +256,34 @@ func (gt *grpcTransport) SendNext(ctx context.Context, done chan<- BatchCall) {
 	}()
 }
 
+// logReplicaAttempt logs the timing of an attempt to send the batch to a
+// replica to the span in the context: the time it took to dial the replica's
+// node, the round trip time of the RPC, and the time the node reported
+// processing the batch. The difference between the last two is the time
+// spent in the network.
+func logReplicaAttempt(
+	ctx context.Context,
+	client batchClient,
+	rpcDuration time.Duration,
+	reply *roachpb.BatchResponse,
+	err error,
+) {
+	if !log.HasSpanOrEvent(ctx) {
+		return
+	}
+	ev := &roachpb.ReplicaAttemptEvent{
+		Replica:   client.args.Replica,
+		DialNanos: client.dialDuration.Nanoseconds(),
+		RPCNanos:  rpcDuration.Nanoseconds(),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	} else if reply != nil {
+		ev.ServerProcessingNanos = reply.ServerProcessingNanos
+	}
+	log.StructuredEvent(ctx, ev)
+}
+
 func (gt *grpcTransport) NextReplica() roachpb.ReplicaDescriptor {
 	if gt.IsExhausted() {
 		return roachpb.ReplicaDescriptor{}
@@ -0,0 +1,122 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// asyncWrite is a point write of a transaction which was acknowledged before
+// being replicated (see roachpb.Header.AsyncConsensus). Until it is proven
+// with a QueryIntent request, the write may not have been carried out.
+type asyncWrite struct {
+	key roachpb.Key
+	// sequence is the sequence number of the batch which wrote the key.
+	sequence int32
+}
+
+// recordAsyncWritesLocked adds the writes of a batch which was sent with
+// AsyncConsensus to the writes of the transaction to prove.
+func (tm *txnMetadata) recordAsyncWritesLocked(ba roachpb.BatchRequest) {
+	if ba.Txn.Epoch < tm.asyncWritesEpoch {
+		return
+	}
+	if ba.Txn.Epoch > tm.asyncWritesEpoch {
+		tm.asyncWrites = nil
+		tm.asyncWritesEpoch = ba.Txn.Epoch
+	}
+	for _, union := range ba.Requests {
+		tm.asyncWrites = append(tm.asyncWrites, asyncWrite{
+			key:      union.GetInner().Header().Key,
+			sequence: ba.Txn.Sequence,
+		})
+	}
+}
+
+// asyncWritesToProveLocked returns the writes of the transaction which have
+// to be proven before the batch is sent: all of them if the batch commits the
+// transaction, and those overlapping the requests of the batch otherwise.
+func (tm *txnMetadata) asyncWritesToProveLocked(
+	ba roachpb.BatchRequest, commit bool,
+) []asyncWrite {
+	if ba.Txn.Epoch != tm.asyncWritesEpoch {
+		return nil
+	}
+	if commit {
+		return append([]asyncWrite(nil), tm.asyncWrites...)
+	}
+	var writes []asyncWrite
+	for _, w := range tm.asyncWrites {
+		for _, union := range ba.Requests {
+			if union.GetInner().Header().Overlaps(roachpb.Span{Key: w.key}) {
+				writes = append(writes, w)
+				break
+			}
+		}
+	}
+	return writes
+}
+
+// proveAsyncWrites checks that the given writes of the transaction, which
+// were acknowledged before being replicated, were carried out. The
+// QueryIntent requests wait for the writes still being replicated. A
+// retryable error is returned if any of the writes failed to apply.
+func (tc *TxnCoordSender) proveAsyncWrites(
+	ctx context.Context, ba roachpb.BatchRequest, writes []asyncWrite,
+) *roachpb.Error {
+	var proofBa roachpb.BatchRequest
+	proofBa.Timestamp = ba.Timestamp
+	proofBa.Txn = ba.Txn
+	for _, w := range writes {
+		txnMeta := ba.Txn.TxnMeta
+		txnMeta.Sequence = w.sequence
+		proofBa.Add(roachpb.NewQueryIntent(w.key, txnMeta))
+	}
+	br, pErr := tc.wrapped.Send(ctx, proofBa)
+	if pErr != nil {
+		return pErr
+	}
+	for i, union := range br.Responses {
+		if !union.GetInner().(*roachpb.QueryIntentResponse).FoundIntent {
+			log.VEventf(ctx, 2, "failed to prove write to %s", writes[i].key)
+			return roachpb.NewErrorWithTxn(
+				roachpb.NewTransactionRetryError(roachpb.RETRY_ASYNC_WRITE_FAILURE), ba.Txn)
+		}
+	}
+	log.VEventf(ctx, 2, "proved %d writes", len(writes))
+
+	tc.txnMu.Lock()
+	defer tc.txnMu.Unlock()
+	if txnMeta := tc.txnMu.txns[ba.Txn.ID]; txnMeta != nil {
+		remaining := txnMeta.asyncWrites[:0]
+		for _, w := range txnMeta.asyncWrites {
+			proven := false
+			for _, p := range writes {
+				if w.sequence == p.sequence && w.key.Equal(p.key) {
+					proven = true
+					break
+				}
+			}
+			if !proven {
+				remaining = append(remaining, w)
+			}
+		}
+		txnMeta.asyncWrites = remaining
+	}
+	return nil
+}
@@ -75,6 +75,35 @@ type txnMetadata struct {
 	// txnEnd is closed when the transaction is aborted or committed,
 	// terminating the associated heartbeat instance.
 	txnEnd chan struct{}
+
+	// inFlight holds the requests of the transaction which are being sent.
+	// They are cancelled as soon as a heartbeat finds the transaction
+	// aborted, instead of being retried until they time out.
+	inFlight map[*inFlightRequest]struct{}
+
+	// asyncWrites holds the writes of the transaction which were acknowledged
+	// before being replicated and haven't been proven since. They belong to
+	// asyncWritesEpoch; the writes of previous epochs don't matter anymore.
+	asyncWrites      []asyncWrite
+	asyncWritesEpoch uint32
+}
+
+// inFlightRequest is a request of a transaction being sent by the
+// coordinator.
+type inFlightRequest struct {
+	cancel context.CancelFunc
+	// aborted is set if the request was cancelled because the transaction
+	// was found aborted. Protected by TxnCoordSender.txnMu.
+	aborted bool
+}
+
+// abortInFlightLocked cancels the in-flight requests of the transaction.
+func (tm *txnMetadata) abortInFlightLocked() {
+	for req := range tm.inFlight {
+		req.aborted = true
+		req.cancel()
+	}
+	tm.inFlight = nil
 }
 
 // setLastUpdate updates the wall time (in nanoseconds) since the most
@@ -109,10 +138,15 @@ type TxnMetrics struct {
 	Restarts *metric.Histogram
 
 	// Counts of restart types.
-	RestartsWriteTooOld    *metric.Counter
-	RestartsDeleteRange    *metric.Counter
-	RestartsSerializable   *metric.Counter
-	RestartsPossibleReplay *metric.Counter
+	RestartsWriteTooOld       *metric.Counter
+	RestartsDeleteRange       *metric.Counter
+	RestartsSerializable      *metric.Counter
+	RestartsPossibleReplay    *metric.Counter
+	RestartsAsyncWriteFailure *metric.Counter
+
+	// Refreshes is the number of serializable restarts avoided by refreshing
+	// the reads of the transaction.
+	Refreshes *metric.Counter
 }
 
 var (
@@ -146,22 +180,30 @@ var (
 	metaRestartsPossibleReplay = metric.Metadata{
 		Name: "txn.restarts.possiblereplay",
 		Help: "Number of restarts due to possible replays of command batches at the storage layer"}
+	metaRestartsAsyncWriteFailure = metric.Metadata{
+		Name: "txn.restarts.asyncwritefailure",
+		Help: "Number of restarts due to writes acknowledged before being replicated which failed to apply"}
+	metaRefreshes = metric.Metadata{
+		Name: "txn.refreshes",
+		Help: "Number of serializable restarts avoided by refreshing the reads of KV transactions"}
 )
 
 // MakeTxnMetrics returns a TxnMetrics struct that contains metrics whose
 // windowed portions retain data for approximately histogramWindow.
 func MakeTxnMetrics(histogramWindow time.Duration) TxnMetrics {
 	return TxnMetrics{
-		Aborts:                 metric.NewCounterWithRates(metaAbortsRates),
-		Commits:                metric.NewCounterWithRates(metaCommitsRates),
-		Commits1PC:             metric.NewCounterWithRates(metaCommits1PCRates),
-		Abandons:               metric.NewCounterWithRates(metaAbandonsRates),
-		Durations:              metric.NewLatency(metaDurationsHistograms, histogramWindow),
-		Restarts:               metric.NewHistogram(metaRestartsHistogram, histogramWindow, 100, 3),
-		RestartsWriteTooOld:    metric.NewCounter(metaRestartsWriteTooOld),
-		RestartsDeleteRange:    metric.NewCounter(metaRestartsDeleteRange),
-		RestartsSerializable:   metric.NewCounter(metaRestartsSerializable),
-		RestartsPossibleReplay: metric.NewCounter(metaRestartsPossibleReplay),
+		Aborts:                    metric.NewCounterWithRates(metaAbortsRates),
+		Commits:                   metric.NewCounterWithRates(metaCommitsRates),
+		Commits1PC:                metric.NewCounterWithRates(metaCommits1PCRates),
+		Abandons:                  metric.NewCounterWithRates(metaAbandonsRates),
+		Durations:                 metric.NewLatency(metaDurationsHistograms, histogramWindow),
+		Restarts:                  metric.NewHistogram(metaRestartsHistogram, histogramWindow, 100, 3),
+		RestartsWriteTooOld:       metric.NewCounter(metaRestartsWriteTooOld),
+		RestartsDeleteRange:       metric.NewCounter(metaRestartsDeleteRange),
+		RestartsSerializable:      metric.NewCounter(metaRestartsSerializable),
+		RestartsPossibleReplay:    metric.NewCounter(metaRestartsPossibleReplay),
+		RestartsAsyncWriteFailure: metric.NewCounter(metaRestartsAsyncWriteFailure),
+		Refreshes:                 metric.NewCounter(metaRefreshes),
 	}
 }
 
@@ -184,14 +226,18 @@ type TxnCoordSender struct {
 	clientTimeout     time.Duration
 	txnMu             struct {
 		syncutil.Mutex
-		txns map[uuid.UUID]*txnMetadata // txn key to metadata
+		txns  map[uuid.UUID]*txnMetadata // txn key to metadata
+		reads map[uuid.UUID]*txnReads    // txn key to reads
 	}
 	linearizable bool // enables linearizable behaviour
 	stopper      *stop.Stopper
 	metrics      TxnMetrics
+	heartbeats   txnHeartbeatBatcher
 }
 
 var _ client.Sender = &TxnCoordSender{}
+var _ client.RangeFeeder = &TxnCoordSender{}
+var _ client.SSTableAdder = &TxnCoordSender{}
 
 const defaultClientTimeout = 10 * time.Second
 
@@ -220,11 +266,16 @@ func NewTxnCoordSender(
 		metrics:           txnMetrics,
 	}
 	tc.txnMu.txns = map[uuid.UUID]*txnMetadata{}
+	tc.txnMu.reads = map[uuid.UUID]*txnReads{}
 
 	ctx := tc.AnnotateCtx(context.Background())
+	tc.heartbeats = makeTxnHeartbeatBatcher(ctx, wrapped, stopper)
 	tc.stopper.RunWorker(ctx, func(ctx context.Context) {
 		tc.printStatsLoop(ctx)
 	})
+	tc.stopper.RunWorker(ctx, func(ctx context.Context) {
+		tc.gcReadsLoop(ctx)
+	})
 	return tc
 }
 
@@ -323,6 +374,8 @@ func (tc *TxnCoordSender) Send(
 
 	startNS := tc.clock.PhysicalNow()
 
+	var inFlight *inFlightRequest
+	var proofs []asyncWrite
 	if ba.Txn != nil {
 		// If this request is part of a transaction...
 		if err := tc.validateTxnForBatch(ctx, &ba); err != nil {
@@ -364,6 +417,29 @@ func (tc *TxnCoordSender) Send(
 			if pErr := tc.maybeRejectClientLocked(ctx, *ba.Txn); pErr != nil {
 				return pErr
 			}
+			// Start tracking the reads of the epoch before its first request is
+			// sent, as the responses may come back after those of later requests.
+			tc.getReadsLocked(ba.Txn)
+
+			// Track the request so that it can be cancelled if the transaction
+			// is found aborted while it's in flight.
+			if txnMeta := tc.txnMu.txns[txnID]; txnMeta != nil {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				inFlight = &inFlightRequest{cancel: cancel}
+				if txnMeta.inFlight == nil {
+					txnMeta.inFlight = map[*inFlightRequest]struct{}{}
+				}
+				txnMeta.inFlight[inFlight] = struct{}{}
+
+				// The transaction record has been written by now, so the
+				// point writes of the batch don't have to wait for their
+				// replication. The writes which are still in doubt have to be
+				// proven before the batch can rely on them.
+				ba.AsyncConsensus = tc.st.AsyncConsensusEnabled.Get() &&
+					ba.IsAsyncConsensusCandidate()
+				proofs = txnMeta.asyncWritesToProveLocked(ba, hasET && et.Commit)
+			}
 
 			if !hasET {
 				return nil
@@ -432,7 +508,21 @@ func (tc *TxnCoordSender) Send(
 	var br *roachpb.BatchResponse
 	{
 		var pErr *roachpb.Error
-		br, pErr = tc.wrapped.Send(ctx, ba)
+		if len(proofs) > 0 {
+			pErr = tc.proveAsyncWrites(ctx, ba, proofs)
+		}
+		if pErr == nil {
+			br, pErr = tc.wrapped.Send(ctx, ba)
+			if pErr != nil && ba.Txn != nil {
+				br, pErr = tc.maybeRetryWithRefresh(ctx, ba, pErr)
+			}
+		}
+
+		if inFlight != nil {
+			if pErr := tc.finishInFlight(ctx, ba.Txn, inFlight); pErr != nil {
+				return nil, pErr
+			}
+		}
 
 		if _, ok := pErr.GetDetail().(*roachpb.OpRequiresTxnError); ok {
 			br, pErr = tc.resendWithTxn(ctx, ba)
@@ -527,6 +617,26 @@ func (tc *TxnCoordSender) maybeRejectClientLocked(
 	}
 }
 
+// finishInFlight stops tracking the given in-flight request of the
+// transaction. If the request was cancelled because the transaction was found
+// aborted, the error telling the client to restart the transaction is
+// returned, in place of the request's outcome.
+func (tc *TxnCoordSender) finishInFlight(
+	ctx context.Context, txn *roachpb.Transaction, req *inFlightRequest,
+) *roachpb.Error {
+	req.cancel()
+	tc.txnMu.Lock()
+	defer tc.txnMu.Unlock()
+	if txnMeta := tc.txnMu.txns[txn.ID]; txnMeta != nil {
+		delete(txnMeta.inFlight, req)
+	}
+	if !req.aborted {
+		return nil
+	}
+	log.VEventf(ctx, 2, "cancelled in-flight request of aborted txn %s", txn.ID)
+	return tc.maybeRejectClientLocked(ctx, *txn)
+}
+
 // validateTxn validates properties of a txn specified on a request.
 // The transaction is expected to be initialized by the time it reaches
 // the TxnCoordSender. Furthermore, no transactional writes are allowed
@@ -596,6 +706,7 @@ func (tc *TxnCoordSender) unregisterTxnLocked(
 	txnMeta.keys = nil
 
 	delete(tc.txnMu.txns, txnID)
+	delete(tc.txnMu.reads, txnID)
 
 	return duration, restarts, status
 }
@@ -755,17 +866,15 @@ func (tc *TxnCoordSender) heartbeat(ctx context.Context, txnID uuid.UUID) bool {
 		return false
 	}
 
-	ba := roachpb.BatchRequest{}
-	ba.Txn = &txn
-
-	hb := &roachpb.HeartbeatTxnRequest{
-		Now: tc.clock.Now(),
-	}
-	hb.Key = txn.Key
-	ba.Add(hb)
-
 	log.Event(ctx, "heartbeat")
-	br, pErr := tc.wrapped.Send(ctx, ba)
+	var respTxn *roachpb.Transaction
+	var pErr *roachpb.Error
+	if now := tc.clock.Now(); tc.st.Version.IsActive(cluster.VersionCoalescedHeartbeats) {
+		respTxn, pErr = tc.heartbeats.heartbeat(
+			ctx, &txn, now, tc.heartbeatInterval/heartbeatBatchWaitDivisor)
+	} else {
+		respTxn, pErr = tc.heartbeats.sendOne(ctx, &txn, now)
+	}
 
 	// Correctness mandates that when we can't heartbeat the transaction, we
 	// make sure the client doesn't keep going. This is particularly relevant
@@ -779,7 +888,7 @@ func (tc *TxnCoordSender) heartbeat(ctx context.Context, txnID uuid.UUID) bool {
 		tc.tryAsyncAbort(txn.ID)
 		txn.Status = roachpb.ABORTED
 	} else {
-		txn.Update(br.Responses[0].GetInner().(*roachpb.HeartbeatTxnResponse).Txn)
+		txn.Update(respTxn)
 	}
 
 	// Give the news to the txn in the txns map. This will update long-running
@@ -787,7 +896,12 @@ func (tc *TxnCoordSender) heartbeat(ctx context.Context, txnID uuid.UUID) bool {
 	// but in particular makes sure that they notice when they've been aborted
 	// (in which case we'll give them an error on their next request).
 	tc.txnMu.Lock()
-	tc.txnMu.txns[txnID].txn.Update(&txn)
+	txnMeta = tc.txnMu.txns[txnID]
+	txnMeta.txn.Update(&txn)
+	if txnMeta.txn.Status == roachpb.ABORTED {
+		// Requests still in flight are doomed; don't let them keep retrying.
+		txnMeta.abortInFlightLocked()
+	}
 	tc.txnMu.Unlock()
 
 	return true
@@ -846,6 +960,8 @@ func (tc *TxnCoordSender) updateState(
 					tc.metrics.RestartsSerializable.Inc(1)
 				case roachpb.RETRY_POSSIBLE_REPLAY:
 					tc.metrics.RestartsPossibleReplay.Inc(1)
+				case roachpb.RETRY_ASYNC_WRITE_FAILURE:
+					tc.metrics.RestartsAsyncWriteFailure.Inc(1)
 				}
 			}
 			newTxn = roachpb.PrepareTransactionForRetry(ctx, pErr, ba.UserPriority, tc.clock)
@@ -884,6 +1000,16 @@ func (tc *TxnCoordSender) updateState(
 		}
 	}
 
+	// Keep track of the reads of pending transactions, so that they can be
+	// refreshed if the transaction's timestamp gets pushed.
+	if pErr == nil {
+		if newTxn.Status == roachpb.PENDING {
+			tc.recordReadsLocked(ba, br)
+		} else {
+			delete(tc.txnMu.reads, txnID)
+		}
+	}
+
 	txnMeta := tc.txnMu.txns[txnID]
 	// For successful transactional requests, keep the written intents and
 	// the updated transaction record to be sent along with the reply.
@@ -964,6 +1090,9 @@ func (tc *TxnCoordSender) updateState(
 
 	// Update our record of this transaction, even on error.
 	if txnMeta != nil {
+		if pErr == nil && ba.AsyncConsensus {
+			txnMeta.recordAsyncWritesLocked(ba)
+		}
 		txnMeta.txn.Update(&newTxn)
 		txnMeta.setLastUpdate(tc.clock.PhysicalNow())
 	}
@@ -981,6 +1110,31 @@ func (tc *TxnCoordSender) GetTxnState(txnID uuid.UUID) (roachpb.Transaction, boo
 	return roachpb.Transaction{}, false
 }
 
+// RangeFeed is part of the client.RangeFeeder interface. Range feeds are
+// served by the wrapped sender.
+func (tc *TxnCoordSender) RangeFeed(
+	ctx context.Context,
+	span roachpb.Span,
+	startFrom hlc.Timestamp,
+	eventC chan<- *roachpb.RangeFeedEvent,
+) error {
+	f, ok := tc.wrapped.(client.RangeFeeder)
+	if !ok {
+		return errors.Errorf("range feeds are not supported by %T", tc.wrapped)
+	}
+	return f.RangeFeed(ctx, span, startFrom, eventC)
+}
+
+// AddSSTable is part of the client.SSTableAdder interface. SSTables are
+// ingested by the wrapped sender.
+func (tc *TxnCoordSender) AddSSTable(ctx context.Context, span roachpb.Span, data []byte) error {
+	a, ok := tc.wrapped.(client.SSTableAdder)
+	if !ok {
+		return errors.Errorf("ingesting sstables isn't supported by %T", tc.wrapped)
+	}
+	return a.AddSSTable(ctx, span, data)
+}
+
 // TODO(tschottdorf): this method is somewhat awkward but unless we want to
 // give this error back to the client, our options are limited. We'll have to
 // run the whole thing for them, or any restart will still end up at the client
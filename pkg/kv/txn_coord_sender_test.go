@@ -39,6 +39,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 )
@@ -645,6 +646,64 @@ func TestTxnCoordSenderCancel(t *testing.T) {
 	}
 }
 
+// TestTxnCoordSenderAbortCancelsInFlight verifies that the requests of a
+// transaction which are in flight when a heartbeat finds the transaction
+// aborted are cancelled, and return an error restarting the transaction.
+func TestTxnCoordSenderAbortCancelsInFlight(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	inFlight := make(chan struct{})
+	var senderFn client.SenderFunc = func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		if _, ok := ba.GetArg(roachpb.HeartbeatTxn); ok {
+			select {
+			case <-inFlight:
+				return nil, roachpb.NewErrorWithTxn(roachpb.NewTransactionAbortedError(), ba.Txn)
+			default:
+			}
+		} else if _, ok := ba.GetArg(roachpb.Put); ok && ba.Txn.Writing {
+			// Block the second write until it is cancelled.
+			close(inFlight)
+			<-ctx.Done()
+			return nil, roachpb.NewError(ctx.Err())
+		}
+		br := ba.CreateReply()
+		txnClone := ba.Txn.Clone()
+		br.Txn = &txnClone
+		br.Txn.Writing = true
+		if _, ok := ba.GetArg(roachpb.HeartbeatTxn); ok {
+			br.Responses[0].GetInner().(*roachpb.HeartbeatTxnResponse).Txn = &txnClone
+		}
+		return br, nil
+	}
+	ambient := log.AmbientContext{Tracer: tracing.NewTracer()}
+	sender := NewTxnCoordSender(
+		ambient,
+		cluster.MakeTestingClusterSettings(),
+		senderFn,
+		clock,
+		false,
+		stopper,
+		MakeTxnMetrics(metric.TestSampleInterval),
+	)
+	defer teardownHeartbeats(sender)
+	sender.heartbeatInterval = 1 * time.Millisecond
+	db := client.NewDB(sender, clock)
+
+	txn := client.NewTxn(db)
+	if err := txn.Put(context.TODO(), "a", "value"); err != nil {
+		t.Fatal(err)
+	}
+	err := txn.Put(context.TODO(), "b", "value")
+	if _, ok := err.(*roachpb.HandledRetryableTxnError); !ok {
+		t.Fatalf("expected the write to be cancelled with a retryable error, got %v", err)
+	}
+}
+
 // TestTxnCoordSenderGCTimeout verifies that the coordinator cleans up extant
 // transactions and intents after the lastUpdateNanos exceeds the timeout.
 func TestTxnCoordSenderGCTimeout(t *testing.T) {
@@ -1263,6 +1322,107 @@ func checkTxnMetrics(
 	})
 }
 
+// TestTxnCoordSenderAsyncConsensus verifies that the point writes of a
+// transaction following the write of its record are sent with
+// AsyncConsensus, and that they are proven before the transaction relies on
+// them.
+func TestTxnCoordSenderAsyncConsensus(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	for _, found := range []bool{true, false} {
+		t.Run(fmt.Sprintf("found=%t", found), func(t *testing.T) {
+			stopper := stop.NewStopper()
+			defer stopper.Stop(context.TODO())
+			manual := hlc.NewManualClock(123)
+			clock := hlc.NewClock(manual.UnixNano, time.Nanosecond)
+
+			var mu syncutil.Mutex
+			var batches []roachpb.BatchRequest
+			var senderFn client.SenderFunc = func(_ context.Context, ba roachpb.BatchRequest) (
+				*roachpb.BatchResponse, *roachpb.Error) {
+				if _, ok := ba.GetArg(roachpb.HeartbeatTxn); !ok {
+					mu.Lock()
+					batches = append(batches, ba)
+					mu.Unlock()
+				}
+				br := ba.CreateReply()
+				for _, union := range br.Responses {
+					if resp, ok := union.GetInner().(*roachpb.QueryIntentResponse); ok {
+						resp.FoundIntent = found
+					}
+				}
+				txnClone := ba.Txn.Clone()
+				br.Txn = &txnClone
+				br.Txn.Writing = true
+				return br, nil
+			}
+			st := cluster.MakeTestingClusterSettings()
+			st.AsyncConsensusEnabled.Override(true)
+			ambient := log.AmbientContext{Tracer: tracing.NewTracer()}
+			ts := NewTxnCoordSender(
+				ambient,
+				st,
+				senderFn,
+				clock,
+				false,
+				stopper,
+				MakeTxnMetrics(metric.TestSampleInterval),
+			)
+			defer teardownHeartbeats(ts)
+
+			ctx := context.TODO()
+			db := client.NewDB(ts, clock)
+			txn := client.NewTxn(db)
+			for _, key := range []string{"a", "b"} {
+				if err := txn.Put(ctx, roachpb.Key(key), []byte("value")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The first write of b is proven before b is written again, and the
+			// second one before committing. If the first proof fails, the
+			// transaction restarts.
+			err := txn.Put(ctx, roachpb.Key("b"), []byte("value"))
+			expBatches := []string{"1 Put, 1 BeginTxn", "1 Put", "1 QueryIntent"}
+			if found {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := txn.CommitOrCleanup(ctx); err != nil {
+					t.Fatal(err)
+				}
+				expBatches = append(expBatches, "1 Put", "1 QueryIntent", "1 EndTxn")
+			} else {
+				if _, ok := err.(*roachpb.HandledRetryableTxnError); !ok {
+					t.Fatalf("expected a retryable error, got %v", err)
+				}
+				if c := ts.metrics.RestartsAsyncWriteFailure.Count(); c != 1 {
+					t.Errorf("expected 1 restart, got %d", c)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			var summaries []string
+			for _, ba := range batches {
+				summaries = append(summaries, ba.CountsSummary())
+			}
+			if !reflect.DeepEqual(summaries, expBatches) {
+				t.Fatalf("expected batches %v, got %v", expBatches, summaries)
+			}
+			for i, ba := range batches {
+				if async := i == 1 || i == 3; ba.AsyncConsensus != async {
+					t.Errorf("%d: expected AsyncConsensus=%t for %s", i, async, ba)
+				}
+				if qi, ok := ba.GetArg(roachpb.QueryIntent); ok {
+					if seq := qi.(*roachpb.QueryIntentRequest).Txn.Sequence; seq != batches[i-1].Txn.Sequence {
+						t.Errorf("%d: expected proof of sequence %d, got %d",
+							i, batches[i-1].Txn.Sequence, seq)
+					}
+				}
+			}
+		})
+	}
+}
+
 // setupMetricsTest returns a TxnCoordSender and ManualClock pointing to a newly created
 // LocalTestCluster. Also returns a cleanup function to be executed at the end of the
 // test.
@@ -1466,6 +1626,7 @@ func TestTxnRestartCount(t *testing.T) {
 	defer cleanupFn()
 
 	key := []byte("key-restart")
+	readKey := []byte("key-restart-read")
 	value := []byte("value")
 	db := client.NewDB(sender, s.Clock)
 
@@ -1474,6 +1635,15 @@ func TestTxnRestartCount(t *testing.T) {
 	if _, err := txn.Get(context.TODO(), key); err != nil {
 		t.Fatal(err)
 	}
+	if _, err := txn.Get(context.TODO(), readKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// Outside of the transaction, write to a key read by the transaction, so
+	// that its reads can't be refreshed.
+	if err := db.Put(context.TODO(), readKey, value); err != nil {
+		t.Fatal(err)
+	}
 
 	// Outside of the transaction, read the same key as was read within the transaction. This
 	// means that future attempts to write will increase the timestamp.
@@ -1495,6 +1665,230 @@ func TestTxnRestartCount(t *testing.T) {
 
 	teardownHeartbeats(sender)
 	checkTxnMetrics(t, sender, "restart txn", 0, 0, 0, 1, 1)
+	if c := sender.metrics.Refreshes.Count(); c != 0 {
+		t.Errorf("expected no refreshes, got %d", c)
+	}
+}
+
+// TestTxnRefreshReads verifies that a transaction whose timestamp is pushed
+// commits without restarting if the keys it read weren't written to since.
+func TestTxnRefreshReads(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	s, sender, cleanupFn := setupMetricsTest(t)
+	defer cleanupFn()
+
+	ctx := context.TODO()
+	key := []byte("key-refresh")
+	readKey := []byte("key-refresh-read")
+	value := []byte("value")
+	db := client.NewDB(sender, s.Clock)
+
+	txn := client.NewTxn(db)
+	if _, err := txn.Get(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := txn.Scan(ctx, readKey, roachpb.Key(readKey).PrefixEnd(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reads are tracked from the first request of the transaction, which
+	// was sent in epoch 0.
+	sender.txnMu.Lock()
+	reads := sender.txnMu.reads[txn.Proto().ID]
+	if reads == nil || reads.invalid || reads.epoch != 0 || len(reads.spans) != 2 {
+		t.Errorf("expected 2 refreshable read spans in epoch 0, got %+v", reads)
+	}
+	sender.txnMu.Unlock()
+
+	// Outside of the transaction, read the key the transaction writes next, so
+	// that its timestamp gets pushed.
+	if _, err := db.Get(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, key, value); err != nil {
+		t.Fatal(err)
+	}
+	if !txn.Proto().OrigTimestamp.Less(txn.Proto().Timestamp) {
+		t.Errorf("expected timestamp to increase: %s", txn.Proto())
+	}
+	pushedTS := txn.Proto().Timestamp
+
+	// The reads are refreshed at the pushed timestamp, at which the
+	// transaction commits.
+	if err := txn.CommitOrCleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if epoch := txn.Proto().Epoch; epoch != 0 {
+		t.Errorf("expected the transaction not to restart, got epoch %d", epoch)
+	}
+	if ts := txn.Proto().OrigTimestamp; ts != pushedTS {
+		t.Errorf("expected the transaction to commit at %s, got %s", pushedTS, ts)
+	}
+	teardownHeartbeats(sender)
+	checkTxnMetrics(t, sender, "refresh txn", 1, 0, 0, 0, 0)
+	if c := sender.metrics.Refreshes.Count(); c != 1 {
+		t.Errorf("expected 1 refresh, got %d", c)
+	}
+}
+
+// TestTxnRefreshRequiresClusterVersion verifies that a transaction whose
+// timestamp is pushed restarts instead of refreshing its reads until all the
+// nodes of the cluster know about refresh requests.
+func TestTxnRefreshRequiresClusterVersion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	s, testSender := createTestDB(t)
+	defer s.Stop()
+	st := cluster.MakeClusterSettings(cluster.VersionBase, cluster.BinaryServerVersion)
+	if err := st.InitializeVersion(cluster.ClusterVersion{
+		MinimumVersion: cluster.VersionCoalescedHeartbeats,
+		UseVersion:     cluster.VersionCoalescedHeartbeats,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sender := NewTxnCoordSender(log.AmbientContext{Tracer: st.Tracer}, st,
+		testSender.wrapped, s.Clock, false, s.Stopper, MakeTxnMetrics(metric.TestSampleInterval))
+	defer teardownHeartbeats(sender)
+
+	ctx := context.TODO()
+	key := []byte("key-refresh-version")
+	db := client.NewDB(sender, s.Clock)
+	txn := client.NewTxn(db)
+	if _, err := txn.Get(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	// Outside of the transaction, read the key the transaction writes next, so
+	// that its timestamp gets pushed.
+	if _, err := db.Get(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	err := txn.CommitOrCleanup(ctx)
+	assertTransactionRetryError(t, err)
+	if c := sender.metrics.Refreshes.Count(); c != 0 {
+		t.Errorf("expected no refreshes, got %d", c)
+	}
+}
+
+// TestTxnReadsEpochStart verifies that the reads of a transaction are only
+// refreshable if they are tracked from the start of its epoch.
+func TestTxnReadsEpochStart(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := &TxnCoordSender{clock: hlc.NewClock(hlc.UnixNano, time.Nanosecond)}
+	tc.txnMu.reads = map[uuid.UUID]*txnReads{}
+
+	testCases := []struct {
+		epoch    uint32
+		sequence int32
+		valid    bool
+	}{
+		// A new transaction.
+		{0, 1, true},
+		// A transaction which sent requests before it was tracked.
+		{0, 2, false},
+		// A restarted transaction.
+		{1, 0, true},
+		{1, 1, false},
+	}
+	for _, c := range testCases {
+		txn := roachpb.MakeTransaction("test", roachpb.Key("a"), 0, enginepb.SERIALIZABLE,
+			tc.clock.Now(), 0)
+		txn.Epoch = c.epoch
+		txn.Sequence = c.sequence
+		reads := tc.getReadsLocked(&txn)
+		if reads == nil || reads.invalid == c.valid {
+			t.Errorf("epoch %d, sequence %d: expected valid=%t, got %+v",
+				c.epoch, c.sequence, c.valid, reads)
+		}
+		// Later requests of the epoch don't change the validity of the reads.
+		txn.Sequence++
+		if reads2 := tc.getReadsLocked(&txn); reads2 != reads {
+			t.Errorf("epoch %d, sequence %d: expected the reads to be tracked once",
+				c.epoch, c.sequence)
+		}
+	}
+}
+
+// TestTxnRefreshLeafReads verifies that the reads of the leaf txns of a
+// transaction, once merged back into the root txn, are refreshed along with
+// the reads of the root when its timestamp is pushed. This includes the case
+// of a leaf txn reading before the root txn sent any request.
+func TestTxnRefreshLeafReads(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testCases := []struct {
+		rootRead bool
+		conflict bool
+	}{
+		{true, false},
+		{true, true},
+		{false, false},
+	}
+	for _, c := range testCases {
+		rootRead, conflict := c.rootRead, c.conflict
+		t.Run(fmt.Sprintf("rootRead=%t/conflict=%t", rootRead, conflict), func(t *testing.T) {
+			s, sender, cleanupFn := setupMetricsTest(t)
+			defer cleanupFn()
+
+			ctx := context.TODO()
+			key := []byte("key-leaf")
+			readKey := []byte("key-leaf-read")
+			value := []byte("value")
+			db := client.NewDB(sender, s.Clock)
+			// The leaf txn bypasses the TxnCoordSender.
+			leafDB := client.NewDB(sender.wrapped, s.Clock)
+
+			txn := client.NewTxn(db)
+			if rootRead {
+				if _, err := txn.Get(ctx, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			leaf := client.NewLeafTxn(leafDB, *txn.Proto())
+			if _, err := leaf.Scan(ctx, readKey, roachpb.Key(readKey).PrefixEnd(), 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := leaf.Put(ctx, readKey, value); !testutils.IsError(err, "cannot write through leaf txn") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			leafState := leaf.LeafState(ctx)
+			if len(leafState.RefreshSpans) != 1 {
+				t.Fatalf("expected 1 refresh span, got %v", leafState.RefreshSpans)
+			}
+			txn.UpdateStateOnLeafTxn(ctx, &leafState)
+
+			if conflict {
+				// Outside of the transaction, write to a key read by the leaf, so that
+				// the reads of the transaction can't be refreshed.
+				if err := db.Put(ctx, readKey, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Outside of the transaction, read the key the transaction writes next, so
+			// that its timestamp gets pushed.
+			if _, err := db.Get(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if err := txn.Put(ctx, key, value); err != nil {
+				t.Fatal(err)
+			}
+			err := txn.CommitOrCleanup(ctx)
+			if conflict {
+				if _, ok := err.(*roachpb.HandledRetryableTxnError); !ok {
+					t.Fatalf("expected a retryable error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			expRefreshes := int64(1)
+			if conflict {
+				expRefreshes = 0
+			}
+			if c := sender.metrics.Refreshes.Count(); c != expRefreshes {
+				t.Errorf("expected %d refreshes, got %d", expRefreshes, c)
+			}
+		})
+	}
 }
 
 func TestTxnDurations(t *testing.T) {
@@ -0,0 +1,183 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// heartbeatBatchWaitDivisor determines for how long a heartbeat waits to be
+// coalesced with those of other transactions, as a fraction of the heartbeat
+// interval.
+const heartbeatBatchWaitDivisor = 10
+
+// txnHeartbeatBatcher coalesces the heartbeats of the transactions
+// coordinated by a TxnCoordSender. A heartbeat waits briefly for those of
+// other transactions, after which all of them are sent in a single
+// non-transactional batch. The DistSender splits that batch into one RPC per
+// range holding the transaction records, instead of one RPC per transaction.
+type txnHeartbeatBatcher struct {
+	ambientCtx context.Context
+	wrapped    client.Sender
+	stopper    *stop.Stopper
+
+	mu struct {
+		syncutil.Mutex
+		// pending are the heartbeats waiting for the next batch. A flush is
+		// scheduled whenever the first one is added.
+		pending []pendingHeartbeat
+	}
+}
+
+type pendingHeartbeat struct {
+	// txn is a copy of the transaction's metadata, since the caller may give
+	// up waiting for the heartbeat and update the transaction.
+	txn     enginepb.TxnMeta
+	now     hlc.Timestamp
+	resultC chan heartbeatResult
+}
+
+type heartbeatResult struct {
+	txn  *roachpb.Transaction
+	pErr *roachpb.Error
+	// sendAlone is set if the heartbeat wasn't coalesced with any other, or if
+	// the batch it was coalesced into failed. In the latter case, sending it
+	// alone prevents an error affecting some of the transactions from
+	// aborting all of them.
+	sendAlone bool
+}
+
+func makeTxnHeartbeatBatcher(
+	ambientCtx context.Context, wrapped client.Sender, stopper *stop.Stopper,
+) txnHeartbeatBatcher {
+	return txnHeartbeatBatcher{
+		ambientCtx: ambientCtx,
+		wrapped:    wrapped,
+		stopper:    stopper,
+	}
+}
+
+// heartbeat heartbeats the given transaction, coalescing the heartbeat with
+// those of other transactions sent within the given wait duration. It
+// returns the transaction as found in its record.
+func (b *txnHeartbeatBatcher) heartbeat(
+	ctx context.Context, txn *roachpb.Transaction, now hlc.Timestamp, wait time.Duration,
+) (*roachpb.Transaction, *roachpb.Error) {
+	resultC := make(chan heartbeatResult, 1)
+	b.mu.Lock()
+	b.mu.pending = append(b.mu.pending, pendingHeartbeat{txn: txn.TxnMeta, now: now, resultC: resultC})
+	if len(b.mu.pending) == 1 {
+		// The flush must not be tied to the context of this transaction, whose
+		// cancellation would fail the heartbeats of the others.
+		if err := b.stopper.RunAsyncTask(
+			b.ambientCtx, "kv.txnHeartbeatBatcher: flush", func(ctx context.Context) {
+				b.flush(ctx, wait)
+			}); err != nil {
+			b.mu.pending = nil
+			b.mu.Unlock()
+			return nil, roachpb.NewError(err)
+		}
+	}
+	b.mu.Unlock()
+
+	select {
+	case res := <-resultC:
+		if res.sendAlone {
+			return b.sendOne(ctx, txn, now)
+		}
+		return res.txn, res.pErr
+	case <-ctx.Done():
+		return nil, roachpb.NewError(ctx.Err())
+	case <-b.stopper.ShouldQuiesce():
+		return nil, roachpb.NewError(&roachpb.NodeUnavailableError{})
+	}
+}
+
+// flush waits for the given duration and sends the heartbeats pending by
+// then.
+func (b *txnHeartbeatBatcher) flush(ctx context.Context, wait time.Duration) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-b.stopper.ShouldQuiesce():
+		return
+	}
+
+	b.mu.Lock()
+	pending := b.mu.pending
+	b.mu.pending = nil
+	b.mu.Unlock()
+
+	if len(pending) == 1 {
+		pending[0].resultC <- heartbeatResult{sendAlone: true}
+		return
+	}
+
+	var ba roachpb.BatchRequest
+	for i, p := range pending {
+		ba.Timestamp.Forward(p.now)
+		ba.Add(&roachpb.HeartbeatTxnRequest{
+			Span: roachpb.Span{Key: p.txn.Key},
+			Now:  p.now,
+			Txn:  &pending[i].txn,
+		})
+	}
+	log.VEventf(ctx, 2, "heartbeating %d transactions", len(pending))
+	br, pErr := b.wrapped.Send(ctx, ba)
+	for i, p := range pending {
+		if pErr != nil {
+			p.resultC <- heartbeatResult{sendAlone: true}
+			continue
+		}
+		txn := br.Responses[i].GetInner().(*roachpb.HeartbeatTxnResponse).Txn
+		if txn == nil {
+			p.resultC <- heartbeatResult{pErr: roachpb.NewErrorf(
+				"heartbeat for transaction %s failed; record not present", p.txn.ID)}
+			continue
+		}
+		p.resultC <- heartbeatResult{txn: txn}
+	}
+}
+
+// sendOne heartbeats the given transaction in a batch of its own.
+func (b *txnHeartbeatBatcher) sendOne(
+	ctx context.Context, txn *roachpb.Transaction, now hlc.Timestamp,
+) (*roachpb.Transaction, *roachpb.Error) {
+	ba := roachpb.BatchRequest{}
+	ba.Txn = txn
+
+	hb := &roachpb.HeartbeatTxnRequest{
+		Now: now,
+	}
+	hb.Key = txn.Key
+	ba.Add(hb)
+
+	br, pErr := b.wrapped.Send(ctx, ba)
+	if pErr != nil {
+		return nil, pErr
+	}
+	return br.Responses[0].GetInner().(*roachpb.HeartbeatTxnResponse).Txn, nil
+}
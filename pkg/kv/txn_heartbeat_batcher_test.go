@@ -0,0 +1,151 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+)
+
+// TestTxnHeartbeatBatcherFlush verifies that pending heartbeats are sent in a
+// single non-transactional batch, and that they are sent alone if there is
+// nothing to coalesce them with or if the coalesced batch fails.
+func TestTxnHeartbeatBatcherFlush(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	now := hlc.Timestamp{WallTime: 10}
+	txns := []roachpb.Transaction{
+		roachpb.MakeTransaction("a", roachpb.Key("a"), 0, 0, now, 0),
+		roachpb.MakeTransaction("b", roachpb.Key("b"), 0, 0, now, 0),
+		roachpb.MakeTransaction("c", roachpb.Key("c"), 0, 0, now, 0),
+	}
+
+	var batches []roachpb.BatchRequest
+	var sendErr *roachpb.Error
+	sender := client.SenderFunc(func(
+		_ context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		batches = append(batches, ba)
+		if sendErr != nil {
+			return nil, sendErr
+		}
+		br := ba.CreateReply()
+		for i, union := range ba.Requests {
+			hb := union.GetInner().(*roachpb.HeartbeatTxnRequest)
+			// The record of the last transaction is missing.
+			if i < len(ba.Requests)-1 {
+				txn := roachpb.Transaction{TxnMeta: *hb.Txn, LastHeartbeat: hb.Now}
+				br.Responses[i].GetInner().(*roachpb.HeartbeatTxnResponse).Txn = &txn
+			}
+		}
+		return br, nil
+	})
+	b := makeTxnHeartbeatBatcher(context.Background(), sender, stopper)
+
+	flush := func(n int) []heartbeatResult {
+		var resultCs []chan heartbeatResult
+		for i := 0; i < n; i++ {
+			resultC := make(chan heartbeatResult, 1)
+			resultCs = append(resultCs, resultC)
+			b.mu.pending = append(b.mu.pending, pendingHeartbeat{
+				txn: txns[i].TxnMeta, now: now, resultC: resultC,
+			})
+		}
+		batches = nil
+		b.flush(context.Background(), 0)
+		var results []heartbeatResult
+		for _, resultC := range resultCs {
+			results = append(results, <-resultC)
+		}
+		return results
+	}
+
+	results := flush(len(txns))
+	if len(batches) != 1 {
+		t.Fatalf("expected a single batch, got %d", len(batches))
+	}
+	if ba := batches[0]; ba.Txn != nil || len(ba.Requests) != len(txns) {
+		t.Fatalf("expected a non-transactional batch of %d heartbeats, got %s", len(txns), ba)
+	}
+	for i, res := range results {
+		if res.sendAlone {
+			t.Errorf("%d: unexpectedly sent alone", i)
+		}
+		if i < len(txns)-1 {
+			if res.pErr != nil || res.txn == nil || res.txn.ID != txns[i].ID {
+				t.Errorf("%d: unexpected result %+v", i, res)
+			}
+		} else if !testutils.IsPError(res.pErr, "record not present") {
+			t.Errorf("%d: unexpected error %v", i, res.pErr)
+		}
+	}
+
+	sendErr = roachpb.NewErrorf("boom")
+	for i, res := range flush(len(txns)) {
+		if !res.sendAlone {
+			t.Errorf("%d: expected heartbeat to be sent alone after the batch failed", i)
+		}
+	}
+
+	for i, res := range flush(1) {
+		if !res.sendAlone {
+			t.Errorf("%d: expected a single heartbeat to be sent alone", i)
+		}
+	}
+	if len(batches) != 0 {
+		t.Fatalf("expected no batch for a single heartbeat, got %d", len(batches))
+	}
+}
+
+// TestTxnHeartbeatBatcherSendOne verifies that a heartbeat sent alone is part
+// of the heartbeated transaction.
+func TestTxnHeartbeatBatcherSendOne(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	now := hlc.Timestamp{WallTime: 10}
+	txn := roachpb.MakeTransaction("a", roachpb.Key("a"), 0, 0, now, 0)
+	sender := client.SenderFunc(func(
+		_ context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		hb := ba.Requests[0].GetInner().(*roachpb.HeartbeatTxnRequest)
+		if ba.Txn == nil || ba.Txn.ID != txn.ID || hb.Txn != nil {
+			return nil, roachpb.NewError(fmt.Errorf("unexpected heartbeat %s", ba))
+		}
+		br := ba.CreateReply()
+		br.Responses[0].GetInner().(*roachpb.HeartbeatTxnResponse).Txn = ba.Txn
+		return br, nil
+	})
+	b := makeTxnHeartbeatBatcher(context.Background(), sender, stopper)
+	respTxn, pErr := b.sendOne(context.Background(), &txn, now)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if respTxn.ID != txn.ID {
+		t.Fatalf("expected %s, got %s", txn.ID, respTxn.ID)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// txnReads holds the spans read by a transaction in its current epoch. When
+// the transaction gets a serializable retry error because its timestamp was
+// pushed, the spans are refreshed at the pushed timestamp instead of
+// restarting the transaction, see maybeRetryWithRefresh.
+type txnReads struct {
+	epoch uint32
+	spans []roachpb.Span
+	// invalid is set if the reads of the epoch can't be refreshed, because
+	// some of them might not have gone through the coordinator or because
+	// there were too many of them.
+	invalid bool
+	// lastUpdateNanos is the wall time of the latest request of the
+	// transaction, used to forget about the reads of abandoned transactions.
+	lastUpdateNanos int64
+}
+
+// epochStartSequence returns the sequence number of a transaction which
+// hasn't sent any request in the given epoch yet: transactions start at
+// sequence 1 (see roachpb.MakeTransaction), and restarts reset the sequence
+// to 0 (see roachpb.Transaction.Restart). The DistSender increments it for
+// each batch.
+func epochStartSequence(epoch uint32) int32 {
+	if epoch == 0 {
+		return 1
+	}
+	return 0
+}
+
+// getReadsLocked returns the reads of the given transaction in its epoch,
+// or nil if the transaction is in an older epoch than the one they're
+// tracked for. The reads are tracked starting with the first request of
+// the epoch, before it is sent; if the transaction sent requests before the
+// coordinator started tracking it, its reads can't be refreshed.
+func (tc *TxnCoordSender) getReadsLocked(txn *roachpb.Transaction) *txnReads {
+	reads := tc.txnMu.reads[txn.ID]
+	if reads != nil && reads.epoch > txn.Epoch {
+		return nil
+	}
+	if reads == nil || reads.epoch < txn.Epoch {
+		reads = &txnReads{
+			epoch:   txn.Epoch,
+			invalid: txn.Sequence != epochStartSequence(txn.Epoch),
+		}
+		tc.txnMu.reads[txn.ID] = reads
+	}
+	reads.lastUpdateNanos = tc.clock.PhysicalNow()
+	return reads
+}
+
+// recordReadsLocked adds the spans read by the batch to the reads of its
+// transaction.
+func (tc *TxnCoordSender) recordReadsLocked(ba roachpb.BatchRequest, br *roachpb.BatchResponse) {
+	reads := tc.getReadsLocked(ba.Txn)
+	if reads == nil || reads.invalid {
+		return
+	}
+	ba.RefreshSpanIterate(br, func(key, endKey roachpb.Key) {
+		reads.spans = append(reads.spans, roachpb.Span{Key: key, EndKey: endKey})
+	})
+	tc.condenseReadsLocked(reads)
+}
+
+// condenseReadsLocked merges the read spans if there are more of them than
+// allowed, and gives up on refreshing the reads if there are still too many.
+func (tc *TxnCoordSender) condenseReadsLocked(reads *txnReads) {
+	if max := int(tc.st.MaxRefreshSpans.Get()); len(reads.spans) > max {
+		reads.spans, _ = roachpb.MergeSpans(reads.spans)
+		if len(reads.spans) > max {
+			reads.spans = nil
+			reads.invalid = true
+		}
+	}
+}
+
+// AddLeafReads is part of the SenderWithDistSQLBackdoor interface.
+func (tc *TxnCoordSender) AddLeafReads(txn roachpb.Transaction, spans []roachpb.Span) {
+	tc.txnMu.Lock()
+	defer tc.txnMu.Unlock()
+	reads := tc.getReadsLocked(&txn)
+	if reads == nil || reads.invalid {
+		return
+	}
+	reads.spans = append(reads.spans, spans...)
+	tc.condenseReadsLocked(reads)
+}
+
+// DisableReadRefresh is part of the SenderWithDistSQLBackdoor interface.
+func (tc *TxnCoordSender) DisableReadRefresh(txn roachpb.Transaction) {
+	tc.txnMu.Lock()
+	defer tc.txnMu.Unlock()
+	if reads := tc.getReadsLocked(&txn); reads != nil {
+		reads.spans = nil
+		reads.invalid = true
+	}
+}
+
+// maybeRetryWithRefresh handles the serializable retry error returned for a
+// batch of a transaction whose timestamp was pushed. Instead of restarting
+// the transaction, the spans it read are refreshed at the pushed timestamp:
+// if none of them was written to in the meantime, the reads are valid at that
+// timestamp, and the batch is sent again with the original timestamp of the
+// transaction forwarded to it. The error is returned as is if the reads
+// can't be refreshed, or if nodes which don't know about refresh requests
+// might still be part of the cluster.
+func (tc *TxnCoordSender) maybeRetryWithRefresh(
+	ctx context.Context, ba roachpb.BatchRequest, pErr *roachpb.Error,
+) (*roachpb.BatchResponse, *roachpb.Error) {
+	tErr, ok := pErr.GetDetail().(*roachpb.TransactionRetryError)
+	if !ok || tErr.Reason != roachpb.RETRY_SERIALIZABLE || pErr.GetTxn() == nil {
+		return nil, pErr
+	}
+	refreshTS := pErr.GetTxn().Timestamp
+	refreshTS.Forward(ba.Txn.Timestamp)
+
+	tc.txnMu.Lock()
+	// The transaction record may have been pushed further than the error
+	// tells, which the heartbeat may have found out.
+	if txnMeta := tc.txnMu.txns[ba.Txn.ID]; txnMeta != nil && txnMeta.txn.Epoch == ba.Txn.Epoch {
+		refreshTS.Forward(txnMeta.txn.Timestamp)
+	}
+	var spans []roachpb.Span
+	reads := tc.txnMu.reads[ba.Txn.ID]
+	canRefresh := reads != nil && reads.epoch == ba.Txn.Epoch && !reads.invalid &&
+		tc.st.MaxRefreshSpans.Get() > 0 && tc.st.Version.IsActive(cluster.VersionReadRefresh)
+	if canRefresh {
+		spans = append([]roachpb.Span(nil), reads.spans...)
+	}
+	tc.txnMu.Unlock()
+	if !canRefresh || !ba.Txn.OrigTimestamp.Less(refreshTS) {
+		return nil, pErr
+	}
+
+	if len(spans) > 0 {
+		refreshTxn := ba.Txn.Clone()
+		refreshTxn.Timestamp = refreshTS
+		var refreshBa roachpb.BatchRequest
+		refreshBa.Timestamp = refreshTS
+		refreshBa.Txn = &refreshTxn
+		for _, span := range spans {
+			if len(span.EndKey) == 0 {
+				refreshBa.Add(&roachpb.RefreshRequest{Span: span})
+			} else {
+				refreshBa.Add(&roachpb.RefreshRangeRequest{Span: span})
+			}
+		}
+		if _, refreshErr := tc.wrapped.Send(ctx, refreshBa); refreshErr != nil {
+			log.VEventf(ctx, 2, "failed to refresh %d read spans at %s: %s",
+				len(spans), refreshTS, refreshErr)
+			return nil, pErr
+		}
+	}
+	log.VEventf(ctx, 2, "refreshed %d read spans at %s; retrying", len(spans), refreshTS)
+	tc.metrics.Refreshes.Inc(1)
+
+	// Writes of the batch which were carried out before the error are
+	// detected as replays and cause the transaction to restart after all.
+	retryTxn := ba.Txn.Clone()
+	retryTxn.Timestamp = refreshTS
+	retryTxn.OrigTimestamp = refreshTS
+	ba.Txn = &retryTxn
+	return tc.wrapped.Send(ctx, ba)
+}
+
+// gcReadsLoop periodically forgets about the reads of the transactions which
+// haven't sent a request for longer than the client timeout. Those include
+// read-only transactions, which don't let the coordinator know when they
+// finish. A transaction which comes back afterwards can't be refreshed.
+func (tc *TxnCoordSender) gcReadsLoop(ctx context.Context) {
+	var timer timeutil.Timer
+	defer timer.Stop()
+	for {
+		timer.Reset(tc.clientTimeout)
+		select {
+		case <-timer.C:
+			timer.Read = true
+			timeout := tc.clock.PhysicalNow() - tc.clientTimeout.Nanoseconds()
+			tc.txnMu.Lock()
+			for txnID, reads := range tc.txnMu.reads {
+				if _, ok := tc.txnMu.txns[txnID]; !ok && reads.lastUpdateNanos < timeout {
+					delete(tc.txnMu.reads, txnID)
+				}
+			}
+			tc.txnMu.Unlock()
+		case <-tc.stopper.ShouldStop():
+			return
+		}
+	}
+}
@@ -716,6 +716,12 @@ func TestTxnRestartedSerializableTimestampRegression(t *testing.T) {
 	s, _ := createTestDB(t)
 	defer s.Stop()
 
+	// The transaction doesn't read anything, so refreshing its reads would
+	// let it commit without restarting.
+	st := s.Store.ClusterSettings()
+	st.Manual.Store(true)
+	st.MaxRefreshSpans.Override(0)
+
 	keyA := "a"
 	keyB := "b"
 	ch := make(chan struct{})
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"strconv"
 
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 	"github.com/gogo/protobuf/proto"
 	"github.com/pkg/errors"
@@ -235,6 +236,22 @@ func (dr *DeleteRangeResponse) combine(c combinable) error {
 	return nil
 }
 
+var _ combinable = &DeleteRangeResponse{}
+
+// combine implements the combinable interface.
+func (dr *DeleteRangeWhereResponse) combine(c combinable) error {
+	otherDR := c.(*DeleteRangeWhereResponse)
+	if dr != nil {
+		dr.Keys = append(dr.Keys, otherDR.Keys...)
+		if err := dr.ResponseHeader.combine(otherDR.Header()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ combinable = &DeleteRangeWhereResponse{}
+
 // combine implements the combinable interface.
 func (rr *ResolveIntentRangeResponse) combine(c combinable) error {
 	otherRR := c.(*ResolveIntentRangeResponse)
@@ -289,6 +306,20 @@ func (r *AdminScatterResponse) combine(c combinable) error {
 
 var _ combinable = &AdminScatterResponse{}
 
+// Combine implements the combinable interface.
+func (r *PollChangesResponse) combine(c combinable) error {
+	if r != nil {
+		otherR := c.(*PollChangesResponse)
+		if err := r.ResponseHeader.combine(otherR.Header()); err != nil {
+			return err
+		}
+		r.Revisions = append(r.Revisions, otherR.Revisions...)
+	}
+	return nil
+}
+
+var _ combinable = &PollChangesResponse{}
+
 // Header implements the Request interface.
 func (rh Span) Header() Span {
 	return rh
@@ -314,6 +345,11 @@ func (h *BatchResponse_Header) combine(o BatchResponse_Header) error {
 	}
 	h.Now.Forward(o.Now)
 	h.CollectedSpans = append(h.CollectedSpans, o.CollectedSpans...)
+	h.RangeReport = append(h.RangeReport, o.RangeReport...)
+	// The parts of a batch are processed in parallel.
+	if o.ServerProcessingNanos > h.ServerProcessingNanos {
+		h.ServerProcessingNanos = o.ServerProcessingNanos
+	}
 	return nil
 }
 
@@ -517,6 +553,21 @@ func (*AdminScatterRequest) Method() Method { return AdminScatter }
 // Method implements the Request interface.
 func (*AddSSTableRequest) Method() Method { return AddSSTable }
 
+// Method implements the Request interface.
+func (*PollChangesRequest) Method() Method { return PollChanges }
+
+// Method implements the Request interface.
+func (*RefreshRequest) Method() Method { return Refresh }
+
+// Method implements the Request interface.
+func (*RefreshRangeRequest) Method() Method { return RefreshRange }
+
+// Method implements the Request interface.
+func (*QueryIntentRequest) Method() Method { return QueryIntent }
+
+// Method implements the Request interface.
+func (*DeleteRangeWhereRequest) Method() Method { return DeleteRangeWhere }
+
 // ShallowCopy implements the Request interface.
 func (gr *GetRequest) ShallowCopy() Request {
 	shallowCopy := *gr
@@ -733,6 +784,36 @@ func (r *AddSSTableRequest) ShallowCopy() Request {
 	return &shallowCopy
 }
 
+// ShallowCopy implements the Request interface.
+func (r *PollChangesRequest) ShallowCopy() Request {
+	shallowCopy := *r
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (r *RefreshRequest) ShallowCopy() Request {
+	shallowCopy := *r
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (r *RefreshRangeRequest) ShallowCopy() Request {
+	shallowCopy := *r
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (r *QueryIntentRequest) ShallowCopy() Request {
+	shallowCopy := *r
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (r *DeleteRangeWhereRequest) ShallowCopy() Request {
+	shallowCopy := *r
+	return &shallowCopy
+}
+
 // NewGet returns a Request initialized to get the value at key.
 func NewGet(key Key) Request {
 	return &GetRequest{
@@ -778,8 +859,9 @@ func NewPutInline(key Key, value Value) Request {
 }
 
 // NewConditionalPut returns a Request initialized to put value as a byte
-// slice at key if the existing value at key equals expValueBytes.
-func NewConditionalPut(key Key, value, expValue Value) Request {
+// slice at key if the existing value at key equals expValueBytes, or if
+// allowNotExist is set and the key doesn't exist.
+func NewConditionalPut(key Key, value, expValue Value, allowNotExist bool) Request {
 	value.InitChecksum(key)
 	var expValuePtr *Value
 	if expValue.RawBytes != nil {
@@ -792,8 +874,9 @@ func NewConditionalPut(key Key, value, expValue Value) Request {
 		Span: Span{
 			Key: key,
 		},
-		Value:    value,
-		ExpValue: expValuePtr,
+		Value:               value,
+		ExpValue:            expValuePtr,
+		AllowIfDoesNotExist: allowNotExist,
 	}
 }
 
@@ -834,6 +917,21 @@ func NewDeleteRange(startKey, endKey Key, returnKeys bool) Request {
 	}
 }
 
+// NewDeleteRangeWhere returns a Request initialized to delete the keys between
+// startKey and endKey which satisfy the given predicate.
+func NewDeleteRangeWhere(
+	startKey, endKey Key, pred DeleteRangePredicate, returnKeys bool,
+) Request {
+	return &DeleteRangeWhereRequest{
+		Span: Span{
+			Key:    startKey,
+			EndKey: endKey,
+		},
+		Predicate:  pred,
+		ReturnKeys: returnKeys,
+	}
+}
+
 // NewScan returns a Request initialized to scan from start to end keys
 // with max results.
 func NewScan(key, endKey Key) Request {
@@ -845,6 +943,18 @@ func NewScan(key, endKey Key) Request {
 	}
 }
 
+// NewQueryIntent returns a Request initialized to check whether the intent
+// at key was written by txn, in its epoch and with at least its sequence
+// number.
+func NewQueryIntent(key Key, txn enginepb.TxnMeta) Request {
+	return &QueryIntentRequest{
+		Span: Span{
+			Key: key,
+		},
+		Txn: txn,
+	}
+}
+
 // NewCheckConsistency returns a Request initialized to scan from start to end keys.
 func NewCheckConsistency(key, endKey Key, withDiff bool) Request {
 	return &CheckConsistencyRequest{
@@ -916,7 +1026,6 @@ func (*AdminSplitRequest) flags() int          { return isAdmin | isAlone }
 func (*AdminMergeRequest) flags() int          { return isAdmin | isAlone }
 func (*AdminTransferLeaseRequest) flags() int  { return isAdmin | isAlone }
 func (*AdminChangeReplicasRequest) flags() int { return isAdmin | isAlone }
-func (*HeartbeatTxnRequest) flags() int        { return isWrite | isTxn }
 func (*GCRequest) flags() int                  { return isWrite | isRange }
 func (*PushTxnRequest) flags() int             { return isWrite | isAlone }
 func (*QueryTxnRequest) flags() int            { return isRead | isAlone }
@@ -927,6 +1036,17 @@ func (*NoopRequest) flags() int                { return isRead } // slightly spe
 func (*TruncateLogRequest) flags() int         { return isWrite }
 func (*MergeRequest) flags() int               { return isWrite }
 
+// HeartbeatTxn can only be part of a transaction when it heartbeats the
+// transaction of its batch. A heartbeat which specifies the transaction
+// itself is sent outside of one, and the heartbeats of many transactions
+// may be coalesced into a batch spanning multiple ranges.
+func (htr *HeartbeatTxnRequest) flags() int {
+	if htr.Txn != nil {
+		return isWrite
+	}
+	return isWrite | isTxn
+}
+
 func (*RequestLeaseRequest) flags() int {
 	return isWrite | isAlone | skipLeaseCheck
 }
@@ -957,6 +1077,18 @@ func (*ExportRequest) flags() int                   { return isRead | isRange |
 func (*ImportRequest) flags() int                   { return isAdmin | isAlone }
 func (*AdminScatterRequest) flags() int             { return isAdmin | isAlone | isRange }
 func (*AddSSTableRequest) flags() int               { return isWrite | isAlone | isRange }
+func (*PollChangesRequest) flags() int              { return isRead | isRange | updatesTSCache }
+func (*RefreshRequest) flags() int                  { return isRead | isTxn | updatesTSCache }
+func (*RefreshRangeRequest) flags() int             { return isRead | isTxn | isRange | updatesTSCache }
+func (*QueryIntentRequest) flags() int              { return isRead | isTxn }
+
+// DeleteRangeWhereRequest can't be part of a transaction, so that it's executed
+// independently on each range instead of being wrapped into a transaction when
+// it spans several ranges. Like DeleteRange, it updates the timestamp cache to
+// avoid the phantom delete anomaly.
+func (*DeleteRangeWhereRequest) flags() int {
+	return isWrite | isRange | isAlone | updatesTSCache | consultsTSCache
+}
 
 // Keys returns credentials in an s3gof3r.Keys
 func (b *ExportStorage_S3) Keys() s3gof3r.Keys {
@@ -23,6 +23,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 )
 
 //go:generate go run -tags gen-batch gen_batch.go
@@ -141,6 +142,32 @@ func (ba *BatchRequest) IsSingleQueryTxnRequest() bool {
 	return false
 }
 
+// IsSingleAddSSTableRequest returns true iff the batch contains a single
+// request, and that request is for an AddSSTable.
+func (ba *BatchRequest) IsSingleAddSSTableRequest() bool {
+	if ba.IsSingleRequest() {
+		_, ok := ba.Requests[0].GetInner().(*AddSSTableRequest)
+		return ok
+	}
+	return false
+}
+
+// IsAsyncConsensusCandidate returns true iff the batch is made of
+// transactional point writes only, which can be acknowledged before they are
+// replicated (see Header.AsyncConsensus). Batches writing the transaction
+// record are not candidates.
+func (ba *BatchRequest) IsAsyncConsensusCandidate() bool {
+	if len(ba.Requests) == 0 {
+		return false
+	}
+	for _, union := range ba.Requests {
+		if args := union.GetInner(); !IsTransactionWrite(args) || IsRange(args) {
+			return false
+		}
+	}
+	return true
+}
+
 // GetPrevLeaseForLeaseRequest returns the previous lease, at the time
 // of proposal, for a request lease or transfer lease request. If the
 // batch does not contain a single lease request, this method will panic.
@@ -222,6 +249,37 @@ func (ba *BatchRequest) IntentSpanIterate(br *BatchResponse, fn func(key, endKey
 	}
 }
 
+// RefreshSpanIterate calls the passed method with the key ranges read by the
+// read-only requests contained in the batch, which would have to be read again
+// for the transaction to move to a higher timestamp. Like for
+// IntentSpanIterate, the ResumeSpan of a response is subtracted from the
+// request span.
+func (ba *BatchRequest) RefreshSpanIterate(br *BatchResponse, fn func(key, endKey Key)) {
+	for i, arg := range ba.Requests {
+		req := arg.GetInner()
+		if !IsReadOnly(req) || !UpdatesTimestampCache(req) {
+			continue
+		}
+		h := req.Header()
+		if br != nil {
+			resumeSpan := br.Responses[i].GetInner().Header().ResumeSpan
+			if resumeSpan != nil {
+				if bytes.Equal(resumeSpan.Key, h.Key) {
+					if bytes.Equal(resumeSpan.EndKey, h.EndKey) {
+						// Nothing was read.
+						continue
+					}
+					fn(resumeSpan.EndKey, h.EndKey)
+				} else {
+					fn(h.Key, resumeSpan.Key)
+				}
+				continue
+			}
+		}
+		fn(h.Key, h.EndKey)
+	}
+}
+
 // Combine implements the Combinable interface. It combines each slot of the
 // given request into the corresponding slot of the base response. The number
 // of slots must be equal and the respective slots must be combinable.
@@ -270,6 +328,42 @@ func (br *BatchResponse) Add(reply Response) {
 	br.Responses[len(br.Responses)-1].MustSetInner(reply)
 }
 
+// VerifyChecksums verifies the checksums of the values returned by the
+// responses to the requests of ba. It returns the key of the first value
+// whose checksum doesn't match, along with the error describing the mismatch.
+func (br *BatchResponse) VerifyChecksums(ba *BatchRequest) (Key, error) {
+	for i := range br.Responses {
+		switch t := br.Responses[i].GetInner().(type) {
+		case *GetResponse:
+			if t.Value == nil {
+				continue
+			}
+			key := ba.Requests[i].GetInner().Header().Key
+			if err := t.Value.Verify(key); err != nil {
+				return key, err
+			}
+		case *ScanResponse:
+			if key, err := verifyRowChecksums(t.Rows); err != nil {
+				return key, err
+			}
+		case *ReverseScanResponse:
+			if key, err := verifyRowChecksums(t.Rows); err != nil {
+				return key, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+func verifyRowChecksums(rows []KeyValue) (Key, error) {
+	for i := range rows {
+		if err := rows[i].Value.Verify(rows[i].Key); err != nil {
+			return rows[i].Key, err
+		}
+	}
+	return nil, nil
+}
+
 // Methods returns a slice of the contained methods.
 func (ba *BatchRequest) Methods() []Method {
 	var res []Method
@@ -330,10 +424,84 @@ func (ba BatchRequest) Split(canSplitET bool) [][]RequestUnion {
 	return parts
 }
 
+// Summary prints a short summary of the batch: the number of requests of
+// each method, the encoded size of the batch and its key span.
+func (ba *BatchRequest) Summary() string {
+	return ba.SummaryWithKeys(Key.String)
+}
+
+// SummaryWithKeys is like Summary, but prints the keys of the key span with
+// the given function, e.g. to redact them.
+func (ba *BatchRequest) SummaryWithKeys(printKey func(Key) string) string {
+	if len(ba.Requests) == 0 {
+		return "empty batch"
+	}
+	var buf bytes.Buffer
+	buf.WriteString(ba.CountsSummary())
+	writeSizeAndSpan(&buf, int64(ba.Size()), ba.KeySpanWithKeys(printKey))
+	return buf.String()
+}
+
+// writeSizeAndSpan appends the size and key span of a batch to its summary.
+func writeSizeAndSpan(buf *bytes.Buffer, size int64, span string) {
+	if size > 0 {
+		fmt.Fprintf(buf, " (%s)", humanizeutil.IBytes(size))
+	}
+	if span != "" {
+		fmt.Fprintf(buf, " on %s", span)
+	}
+}
+
+// KeySpan returns the smallest span containing the keys of the requests of
+// the batch. Its EndKey is empty if the requests all address the same key.
+func (ba *BatchRequest) KeySpan() Span {
+	var sp Span
+	for _, arg := range ba.Requests {
+		h := arg.GetInner().Header()
+		if len(h.Key) == 0 {
+			continue
+		}
+		endKey := h.EndKey
+		if len(endKey) == 0 {
+			endKey = h.Key.Next()
+		}
+		if sp.Key == nil || h.Key.Compare(sp.Key) < 0 {
+			sp.Key = h.Key
+		}
+		if sp.EndKey == nil || endKey.Compare(sp.EndKey) > 0 {
+			sp.EndKey = endKey
+		}
+	}
+	if sp.EndKey.Equal(sp.Key.Next()) {
+		sp.EndKey = nil
+	}
+	return sp
+}
+
+// KeySpanWithKeys prints the key span of the batch (see KeySpan) with its
+// keys printed by the given function. It returns an empty string if the
+// requests of the batch have no keys.
+func (ba *BatchRequest) KeySpanWithKeys(printKey func(Key) string) string {
+	sp := ba.KeySpan()
+	if len(sp.Key) == 0 {
+		return ""
+	}
+	if len(sp.EndKey) == 0 {
+		return printKey(sp.Key)
+	}
+	return printKey(sp.Key) + "-" + printKey(sp.EndKey)
+}
+
 // String gives a brief summary of the contained requests and keys in the batch.
 // TODO(tschottdorf): the key range is useful information, but requires `keys`.
 // See #2198.
 func (ba BatchRequest) String() string {
+	return ba.StringWithKeys(Key.String)
+}
+
+// StringWithKeys is like String, but prints the keys of the requests with the
+// given function, e.g. to redact them.
+func (ba BatchRequest) StringWithKeys(printKey func(Key) string) string {
 	var str []string
 	if ba.Txn != nil {
 		str = append(str, fmt.Sprintf("[txn: %s]", ba.Txn.Short()))
@@ -352,7 +520,7 @@ func (ba BatchRequest) String() string {
 			str = append(str, req.Method().String())
 		} else {
 			h := req.Header()
-			str = append(str, fmt.Sprintf("%s [%s,%s)", req.Method(), h.Key, h.EndKey))
+			str = append(str, fmt.Sprintf("%s [%s,%s)", req.Method(), printKey(h.Key), printKey(h.EndKey)))
 		}
 	}
 	return strings.Join(str, ", ")
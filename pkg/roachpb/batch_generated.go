@@ -9,7 +9,7 @@ import (
 	"strconv"
 )
 
-type reqCounts [36]int32
+type reqCounts [41]int32
 
 // getReqCounts returns the number of times each
 // request type appears in the batch.
@@ -89,6 +89,16 @@ func (ba *BatchRequest) getReqCounts() reqCounts {
 			counts[34]++
 		case r.AddSstable != nil:
 			counts[35]++
+		case r.PollChanges != nil:
+			counts[36]++
+		case r.Refresh != nil:
+			counts[37]++
+		case r.RefreshRange != nil:
+			counts[38]++
+		case r.QueryIntent != nil:
+			counts[39]++
+		case r.DeleteRangeWhere != nil:
+			counts[40]++
 		default:
 			panic(fmt.Sprintf("unsupported request: %+v", r))
 		}
@@ -133,10 +143,15 @@ var requestNames = []string{
 	"QueryTxn",
 	"AdmScatter",
 	"AddSstable",
+	"PollChanges",
+	"Refresh",
+	"RefreshRng",
+	"QueryIntent",
+	"DelRngWhere",
 }
 
-// Summary prints a short summary of the requests in a batch.
-func (ba *BatchRequest) Summary() string {
+// CountsSummary prints the number of requests of each method in a batch.
+func (ba *BatchRequest) CountsSummary() string {
 	if len(ba.Requests) == 0 {
 		return "empty batch"
 	}
@@ -203,6 +218,11 @@ func (ba *BatchRequest) CreateReply() *BatchResponse {
 	var buf33 []QueryTxnResponse
 	var buf34 []AdminScatterResponse
 	var buf35 []AddSSTableResponse
+	var buf36 []PollChangesResponse
+	var buf37 []RefreshResponse
+	var buf38 []RefreshRangeResponse
+	var buf39 []QueryIntentResponse
+	var buf40 []DeleteRangeWhereResponse
 
 	for i, r := range ba.Requests {
 		switch {
@@ -422,6 +442,36 @@ func (ba *BatchRequest) CreateReply() *BatchResponse {
 			}
 			br.Responses[i].AddSstable = &buf35[0]
 			buf35 = buf35[1:]
+		case r.PollChanges != nil:
+			if buf36 == nil {
+				buf36 = make([]PollChangesResponse, counts[36])
+			}
+			br.Responses[i].PollChanges = &buf36[0]
+			buf36 = buf36[1:]
+		case r.Refresh != nil:
+			if buf37 == nil {
+				buf37 = make([]RefreshResponse, counts[37])
+			}
+			br.Responses[i].Refresh = &buf37[0]
+			buf37 = buf37[1:]
+		case r.RefreshRange != nil:
+			if buf38 == nil {
+				buf38 = make([]RefreshRangeResponse, counts[38])
+			}
+			br.Responses[i].RefreshRange = &buf38[0]
+			buf38 = buf38[1:]
+		case r.QueryIntent != nil:
+			if buf39 == nil {
+				buf39 = make([]QueryIntentResponse, counts[39])
+			}
+			br.Responses[i].QueryIntent = &buf39[0]
+			buf39 = buf39[1:]
+		case r.DeleteRangeWhere != nil:
+			if buf40 == nil {
+				buf40 = make([]DeleteRangeWhereResponse, counts[40])
+			}
+			br.Responses[i].DeleteRangeWhere = &buf40[0]
+			buf40 = buf40[1:]
 		default:
 			panic(fmt.Sprintf("unsupported request: %+v", r))
 		}
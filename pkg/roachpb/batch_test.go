@@ -15,11 +15,13 @@
 package roachpb
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/kr/pretty"
 )
 
@@ -103,6 +105,29 @@ func TestBatchRequestGetArg(t *testing.T) {
 	}
 }
 
+func TestBatchRequestIsAsyncConsensusCandidate(t *testing.T) {
+	testCases := []struct {
+		bu  []RequestUnion
+		exp bool
+	}{
+		{[]RequestUnion{}, false},
+		{[]RequestUnion{{Put: &PutRequest{}}}, true},
+		{[]RequestUnion{{Put: &PutRequest{}}, {ConditionalPut: &ConditionalPutRequest{}}}, true},
+		{[]RequestUnion{{Increment: &IncrementRequest{}}, {Delete: &DeleteRequest{}}}, true},
+		{[]RequestUnion{{Put: &PutRequest{}}, {Get: &GetRequest{}}}, false},
+		{[]RequestUnion{{DeleteRange: &DeleteRangeRequest{}}}, false},
+		{[]RequestUnion{{BeginTransaction: &BeginTransactionRequest{}}, {Put: &PutRequest{}}}, false},
+		{[]RequestUnion{{Put: &PutRequest{}}, {EndTransaction: &EndTransactionRequest{}}}, false},
+	}
+
+	for i, c := range testCases {
+		ba := BatchRequest{Requests: c.bu}
+		if r := ba.IsAsyncConsensusCandidate(); r != c.exp {
+			t.Errorf("%d: expected %t for %s, got %t", i, c.exp, ba.Summary(), r)
+		}
+	}
+}
+
 func TestBatchRequestSummary(t *testing.T) {
 	// The Summary function is generated automatically, so the tests don't need to
 	// be exhaustive.
@@ -150,9 +175,113 @@ func TestBatchRequestSummary(t *testing.T) {
 			ru.SetValue(v)
 			br.Requests = append(br.Requests, ru)
 		}
-		if str := br.Summary(); str != tc.expected {
+		if str := br.CountsSummary(); str != tc.expected {
 			t.Errorf("%d: got '%s', expected '%s', batch: %+v", i, str, tc.expected, br)
 		}
+		// The requests have no keys, so the event prints the full summary.
+		if str, exp := br.SummaryEvent().String(), br.Summary(); str != exp {
+			t.Errorf("%d: got summary event '%s', expected '%s', batch: %+v", i, str, exp, br)
+		}
+	}
+}
+
+func TestBatchRequestSummaryWithKeys(t *testing.T) {
+	testCases := []struct {
+		reqs    []Request
+		span    Span
+		summary string
+	}{
+		{
+			reqs:    []Request{&GetRequest{Span: Span{Key: Key("b")}}},
+			span:    Span{Key: Key("b")},
+			summary: "1 Get",
+		},
+		{
+			reqs: []Request{
+				&GetRequest{Span: Span{Key: Key("b")}},
+				&PutRequest{Span: Span{Key: Key("b")}},
+			},
+			span:    Span{Key: Key("b")},
+			summary: "1 Get, 1 Put",
+		},
+		{
+			reqs: []Request{
+				&PutRequest{Span: Span{Key: Key("d")}},
+				&ScanRequest{Span: Span{Key: Key("b"), EndKey: Key("c")}},
+			},
+			span:    Span{Key: Key("b"), EndKey: Key("d").Next()},
+			summary: "1 Put, 1 Scan",
+		},
+		{
+			reqs: []Request{
+				&ScanRequest{Span: Span{Key: Key("b"), EndKey: Key("f")}},
+				&GetRequest{Span: Span{Key: Key("c")}},
+			},
+			span:    Span{Key: Key("b"), EndKey: Key("f")},
+			summary: "1 Get, 1 Scan",
+		},
+	}
+	for i, tc := range testCases {
+		var ba BatchRequest
+		ba.Add(tc.reqs...)
+		if span := ba.KeySpan(); !reflect.DeepEqual(span, tc.span) {
+			t.Errorf("%d: expected key span %s, got %s", i, tc.span, span)
+		}
+		printedSpan := tc.span.Key.String()
+		if tc.span.EndKey != nil {
+			printedSpan += "-" + tc.span.EndKey.String()
+		}
+		exp := fmt.Sprintf("%s (%s) on %s",
+			tc.summary, humanizeutil.IBytes(int64(ba.Size())), printedSpan)
+		if summary := ba.Summary(); summary != exp {
+			t.Errorf("%d: expected summary %q, got %q", i, exp, summary)
+		}
+		ev := ba.SummaryEvent()
+		ev.Span = printedSpan
+		if str := ev.String(); str != exp {
+			t.Errorf("%d: expected summary event %q, got %q", i, exp, str)
+		}
+	}
+}
+
+func TestBatchResponseVerifyChecksums(t *testing.T) {
+	makeValue := func(key Key, corrupt bool) Value {
+		v := MakeValueFromString("value")
+		v.InitChecksum(key)
+		if corrupt {
+			v.RawBytes[len(v.RawBytes)-1]++
+		}
+		return v
+	}
+	testCases := []struct {
+		corruptKey Key
+		expKey     Key
+	}{
+		{nil, nil},
+		{Key("a"), Key("a")},
+		{Key("c"), Key("c")},
+		{Key("e"), Key("e")},
+	}
+	for i, tc := range testCases {
+		var ba BatchRequest
+		ba.Add(NewGet(Key("a")), NewScan(Key("b"), Key("d")), NewReverseScan(Key("e"), Key("f")))
+		var br BatchResponse
+		getValue := makeValue(Key("a"), tc.corruptKey.Equal(Key("a")))
+		br.Add(&GetResponse{Value: &getValue})
+		br.Add(&ScanResponse{Rows: []KeyValue{
+			{Key: Key("b"), Value: makeValue(Key("b"), false)},
+			{Key: Key("c"), Value: makeValue(Key("c"), tc.corruptKey.Equal(Key("c")))},
+		}})
+		br.Add(&ReverseScanResponse{Rows: []KeyValue{
+			{Key: Key("e"), Value: makeValue(Key("e"), tc.corruptKey.Equal(Key("e")))},
+		}})
+		key, err := br.VerifyChecksums(&ba)
+		if !key.Equal(tc.expKey) {
+			t.Errorf("%d: expected key %s, got %s", i, tc.expKey, key)
+		}
+		if (err != nil) != (tc.expKey != nil) {
+			t.Errorf("%d: unexpected error %v", i, err)
+		}
 	}
 }
 
@@ -214,6 +343,49 @@ func TestIntentSpanIterate(t *testing.T) {
 	}
 }
 
+func TestRefreshSpanIterate(t *testing.T) {
+	testCases := []struct {
+		req    Request
+		resp   Response
+		span   Span
+		resume *Span
+	}{
+		{&GetRequest{}, &GetResponse{},
+			Span{Key: Key("a")}, nil},
+		{&ScanRequest{}, &ScanResponse{},
+			Span{Key("b"), Key("d")}, &Span{Key("c"), Key("d")}},
+		{&ReverseScanRequest{}, &ReverseScanResponse{},
+			Span{Key("e"), Key("g")}, &Span{Key("e"), Key("f")}},
+		{&ScanRequest{}, &ScanResponse{},
+			Span{Key("h"), Key("j")}, &Span{Key("h"), Key("j")}},
+		{&PutRequest{}, &PutResponse{},
+			Span{Key: Key("k")}, nil},
+	}
+
+	ba := BatchRequest{}
+	br := BatchResponse{}
+	for _, tc := range testCases {
+		tc.req.SetHeader(tc.span)
+		ba.Add(tc.req)
+		tc.resp.SetHeader(ResponseHeader{ResumeSpan: tc.resume})
+		br.Add(tc.resp)
+	}
+
+	var spans []Span
+	ba.RefreshSpanIterate(&br, func(key, endKey Key) {
+		spans = append(spans, Span{Key: key, EndKey: endKey})
+	})
+	// The write and the scan which didn't read anything are skipped.
+	expected := []Span{
+		{Key: Key("a")},
+		{Key("b"), Key("c")},
+		{Key("f"), Key("g")},
+	}
+	if !reflect.DeepEqual(expected, spans) {
+		t.Fatalf("unexpected spans: e = %+v, found = %+v", expected, spans)
+	}
+}
+
 func TestBatchResponseCombine(t *testing.T) {
 	br := &BatchResponse{}
 	{
@@ -234,6 +406,37 @@ func TestBatchResponseCombine(t *testing.T) {
 		}
 	}
 
+	// The server processing time of parts processed in parallel is the
+	// longest of them.
+	for _, nanos := range []int64{20, 10} {
+		brProcessing := &BatchResponse{
+			BatchResponse_Header: BatchResponse_Header{
+				ServerProcessingNanos: nanos,
+			},
+		}
+		if err := br.Combine(brProcessing, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if br.ServerProcessingNanos != 20 {
+		t.Fatalf("expected a server processing time of 20ns, got %d", br.ServerProcessingNanos)
+	}
+
+	// The range reports of the parts are concatenated.
+	for _, rangeID := range []RangeID{1, 2} {
+		brReport := &BatchResponse{
+			BatchResponse_Header: BatchResponse_Header{
+				RangeReport: []RangeExecution{{RangeID: rangeID, Attempts: 1}},
+			},
+		}
+		if err := br.Combine(brReport, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(br.RangeReport) != 2 || br.RangeReport[0].RangeID != 1 || br.RangeReport[1].RangeID != 2 {
+		t.Fatalf("unexpected range report: %+v", br.RangeReport)
+	}
+
 	br.Responses = make([]ResponseUnion, 1)
 
 	singleScanBR := func() *BatchResponse {
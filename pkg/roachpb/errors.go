@@ -17,6 +17,7 @@ package roachpb
 import (
 	"bytes"
 	"fmt"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/util/caller"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
@@ -598,3 +599,24 @@ func (e *StoreNotFoundError) message(_ *Error) string {
 }
 
 var _ ErrorDetailInterface = &StoreNotFoundError{}
+
+func (e *UntrustworthyRemoteClockError) Error() string {
+	return e.message(nil)
+}
+
+func (e *UntrustworthyRemoteClockError) message(_ *Error) string {
+	return fmt.Sprintf("remote timestamp %s is too far ahead (%s) of the local clock to be trustworthy "+
+		"(max offset %s)", e.RemoteTimestamp, time.Duration(e.OffsetNanos), time.Duration(e.MaxOffsetNanos))
+}
+
+var _ ErrorDetailInterface = &UntrustworthyRemoteClockError{}
+
+func (e *ValueChecksumError) Error() string {
+	return e.message(nil)
+}
+
+func (e *ValueChecksumError) message(_ *Error) string {
+	return fmt.Sprintf("value returned by replica %s failed checksum verification: %s", e.Replica, e.Message)
+}
+
+var _ ErrorDetailInterface = &ValueChecksumError{}
@@ -151,8 +151,8 @@ var requestNames = []string{`)
 	// We don't use Fprint to avoid go vet warnings about
 	// formatting directives in string.
 	fmt.Fprintf(f, "%s", `
-// Summary prints a short summary of the requests in a batch.
-func (ba *BatchRequest) Summary() string {
+// CountsSummary prints the number of requests of each method in a batch.
+func (ba *BatchRequest) CountsSummary() string {
 	if len(ba.Requests) == 0 {
 		return "empty batch"
 	}
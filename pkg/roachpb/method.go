@@ -133,4 +133,18 @@ const (
 	AdminScatter
 	// AddSSTable links a file into the RocksDB log-structured merge-tree.
 	AddSSTable
+	// PollChanges returns the revisions written to a keyrange within a time
+	// interval.
+	PollChanges
+	// Refresh verifies that a key read by a transaction hasn't been written
+	// to since the transaction's original timestamp.
+	Refresh
+	// RefreshRange verifies that the keys in a range read by a transaction
+	// haven't been written to since the transaction's original timestamp.
+	RefreshRange
+	// QueryIntent checks whether the intent written by a transaction at a key
+	// is in place.
+	QueryIntent
+	// DeleteRangeWhere deletes the keys of a range which satisfy a predicate.
+	DeleteRangeWhere
 )
@@ -0,0 +1,42 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package roachpb
+
+import "github.com/cockroachdb/cockroach/pkg/util/hlc"
+
+// RangeFeedEvent is an event of a range feed, which streams the changes
+// committed to a key span. Exactly one of its fields is set.
+type RangeFeedEvent struct {
+	// Val is set for a revision committed to a key of the span.
+	Val *RangeFeedValue
+	// Checkpoint is set once all the revisions committed to a part of the
+	// span up to a timestamp have been emitted.
+	Checkpoint *RangeFeedCheckpoint
+}
+
+// RangeFeedValue is a revision of a key. Its value holds the timestamp the
+// revision was committed at, and has no bytes if the key was deleted.
+type RangeFeedValue struct {
+	Key   Key
+	Value Value
+}
+
+// RangeFeedCheckpoint indicates that all the revisions of the keys in Span
+// committed at or before ResolvedTS have been emitted, and that no revision
+// will be committed to them at or before ResolvedTS anymore.
+type RangeFeedCheckpoint struct {
+	Span       Span
+	ResolvedTS hlc.Timestamp
+}
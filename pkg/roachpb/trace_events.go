@@ -0,0 +1,69 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package roachpb
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// SummaryEvent returns a structured summary of the batch, for logging to
+// traces. The key span of the summary is left to the caller to print, since
+// its keys may have to be redacted.
+func (ba *BatchRequest) SummaryEvent() *BatchSummaryEvent {
+	ev := &BatchSummaryEvent{RangeID: ba.RangeID, SizeBytes: int64(ba.Size())}
+	for i, v := range ba.getReqCounts() {
+		if v != 0 {
+			ev.Requests = append(ev.Requests, RequestCount{Method: requestNames[i], Count: v})
+		}
+	}
+	return ev
+}
+
+// String formats the summary like BatchRequest.Summary.
+func (ev BatchSummaryEvent) String() string {
+	if len(ev.Requests) == 0 {
+		return "empty batch"
+	}
+	var buf bytes.Buffer
+	for i, rc := range ev.Requests {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%d %s", rc.Count, rc.Method)
+	}
+	writeSizeAndSpan(&buf, ev.SizeBytes, ev.Span)
+	return buf.String()
+}
+
+func (ev ReplicaAttemptEvent) String() string {
+	rpc := time.Duration(ev.RPCNanos)
+	server := time.Duration(ev.ServerProcessingNanos)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "replica attempt to %s: dial %s, rpc %s",
+		ev.Replica, time.Duration(ev.DialNanos), rpc)
+	if ev.Error != "" {
+		fmt.Fprintf(&buf, ", error: %s", ev.Error)
+	} else {
+		fmt.Fprintf(&buf, ", server %s, network %s", server, rpc-server)
+	}
+	return buf.String()
+}
+
+func (ev TxnRetryEvent) String() string {
+	return fmt.Sprintf("automatically retrying transaction: %s (epoch %d) because of error: %s",
+		ev.TxnName, ev.Epoch, ev.Reason)
+}
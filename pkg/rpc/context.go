@@ -241,6 +241,17 @@ func (ctx *Context) SetLocalInternalServer(internalServer roachpb.InternalServer
 	ctx.localInternalServer = internalServer
 }
 
+// Addrs returns the addresses of the nodes to which the context has a
+// connection, or is in the process of establishing one.
+func (ctx *Context) Addrs() []string {
+	var addrs []string
+	ctx.conns.Range(func(k, _ interface{}) bool {
+		addrs = append(addrs, k.(string))
+		return true
+	})
+	return addrs
+}
+
 func (ctx *Context) removeConn(key string, meta *connMeta) {
 	ctx.conns.Delete(key)
 	if log.V(1) {
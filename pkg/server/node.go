@@ -41,6 +41,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/storage"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/admission"
 	"github.com/cockroachdb/cockroach/pkg/util/grpcutil"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
@@ -128,6 +129,10 @@ type Node struct {
 	lastUp      int64
 	initialBoot bool // True if this is the first time this node has started.
 	txnMetrics  kv.TxnMetrics
+	// admission, if set, admits batches of the background QoS class (see
+	// roachpb.QOS_BACKGROUND) before they are served, so that they queue
+	// behind foreground work of the process.
+	admission *admission.Controller
 
 	storesServer storage.Server
 }
@@ -248,6 +253,7 @@ func NewNode(
 	stopper *stop.Stopper,
 	txnMetrics kv.TxnMetrics,
 	eventLogger sql.EventLogger,
+	admissionController *admission.Controller,
 ) *Node {
 	n := &Node{
 		storeCfg:    cfg,
@@ -257,6 +263,7 @@ func NewNode(
 		stores:      storage.NewStores(cfg.AmbientCtx, cfg.Clock, cfg.Settings.Version.MinSupportedVersion, cfg.Settings.Version.ServerVersion),
 		txnMetrics:  txnMetrics,
 		eventLogger: eventLogger,
+		admission:   admissionController,
 	}
 	n.storesServer = storage.MakeServer(&n.Descriptor, n.stores)
 	return n
@@ -828,7 +835,16 @@ func (n *Node) batchInternal(
 			finishSpan(*br)
 		}(&br)
 		if log.HasSpanOrEvent(ctx) {
-			log.Event(ctx, args.Summary())
+			ev := args.SummaryEvent()
+			ev.Span = keys.KeyPrinter{Redact: n.storeCfg.Settings.RedactKeys.Get()}.BatchSpan(*args)
+			log.StructuredEvent(ctx, ev)
+		}
+
+		if n.admission != nil && args.QoSClass == roachpb.QOS_BACKGROUND {
+			if err := n.admission.Admit(ctx, admission.LowPri); err != nil {
+				return err
+			}
+			defer n.admission.Release()
 		}
 
 		tStart := timeutil.Now()
@@ -841,8 +857,10 @@ func (n *Node) batchInternal(
 		if br.Error != nil {
 			panic(roachpb.ErrorUnexpectedlySet(n.stores, br))
 		}
-		n.metrics.callComplete(timeutil.Since(tStart), pErr)
+		processing := timeutil.Since(tStart)
+		n.metrics.callComplete(processing, pErr)
 		br.Error = pErr
+		br.ServerProcessingNanos = processing.Nanoseconds()
 		return nil
 	}); err != nil {
 		return nil, err
@@ -119,7 +119,7 @@ func createTestNode(
 	metricsRecorder := status.NewMetricsRecorder(cfg.Clock, cfg.NodeLiveness,
 		nodeRPCContext.RemoteClocks, cfg.Gossip)
 	node := NewNode(cfg, metricsRecorder, metric.NewRegistry(), stopper,
-		kv.MakeTxnMetrics(metric.TestSampleInterval), sql.MakeEventLogger(nil))
+		kv.MakeTxnMetrics(metric.TestSampleInterval), sql.MakeEventLogger(nil), nil)
 	roachpb.RegisterInternalServer(grpcServer, node)
 	ln, err := netutil.ListenAndServeGRPC(stopper, grpcServer, addr)
 	if err != nil {
@@ -61,6 +61,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/ts"
 	"github.com/cockroachdb/cockroach/pkg/ui"
 	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/admission"
 	"github.com/cockroachdb/cockroach/pkg/util/envutil"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/httputil"
@@ -82,6 +83,10 @@ var (
 	// GracefulDrainModes is the standard succession of drain modes entered
 	// for a graceful shutdown.
 	GracefulDrainModes = []serverpb.DrainMode{serverpb.DrainMode_CLIENT, serverpb.DrainMode_LEASES}
+
+	// admissionTokens is the size of the process-wide pool of admission tokens
+	// shared by KV batch fan-out, DistSQL flows and jobs.
+	admissionTokens = envutil.EnvOrDefaultInt64("COCKROACH_ADMISSION_TOKENS", 1000)
 )
 
 // Server is the cockroach server node.
@@ -119,6 +124,7 @@ type Server struct {
 	sessionRegistry    *sql.SessionRegistry
 	queryRegistry      *sql.QueryRegistry
 	jobRegistry        *jobs.Registry
+	admission          *admission.Controller
 	engines            Engines
 	internalMemMetrics sql.MemoryMetrics
 	adminMemMetrics    sql.MemoryMetrics
@@ -182,6 +188,8 @@ func NewServer(cfg Config, stopper *stop.Stopper) (*Server, error) {
 	}
 	s.grpc = rpc.NewServer(s.rpcContext)
 
+	s.admission = admission.NewController(admissionTokens)
+
 	s.gossip = gossip.New(
 		s.cfg.AmbientCtx,
 		&s.nodeIDContainer,
@@ -212,6 +220,15 @@ func NewServer(cfg Config, stopper *stop.Stopper) (*Server, error) {
 		Clock:           s.clock,
 		RPCContext:      s.rpcContext,
 		RPCRetryOptions: &retryOpts,
+		Settings:        st,
+		// The node liveness is only created once the DistSender, through which
+		// it reads and writes liveness records, exists.
+		NodeUnavailable: func(nodeID roachpb.NodeID) bool {
+			return s.nodeLiveness.IsUnavailable(nodeID)
+		},
+
+		AdmissionController:     s.admission,
+		HistogramWindowInterval: s.cfg.HistogramWindowInterval(),
 	}
 	if distSenderTestingKnobs := s.cfg.TestingKnobs.DistSender; distSenderTestingKnobs != nil {
 		distSenderCfg.TestingKnobs = *distSenderTestingKnobs.(*kv.DistSenderTestingKnobs)
@@ -352,14 +369,14 @@ func NewServer(cfg Config, stopper *stop.Stopper) (*Server, error) {
 	s.runtime = status.MakeRuntimeStatSampler(s.clock)
 	s.registry.AddMetricStruct(s.runtime)
 
-	s.node = NewNode(storeCfg, s.recorder, s.registry, s.stopper, txnMetrics, sql.MakeEventLogger(s.leaseMgr))
+	s.node = NewNode(storeCfg, s.recorder, s.registry, s.stopper, txnMetrics, sql.MakeEventLogger(s.leaseMgr), s.admission)
 	roachpb.RegisterInternalServer(s.grpc, s.node)
 	storage.RegisterConsistencyServer(s.grpc, s.node.storesServer)
 
 	s.sessionRegistry = sql.MakeSessionRegistry()
 	s.queryRegistry = sql.MakeQueryRegistry()
 	s.jobRegistry = jobs.MakeRegistry(
-		s.clock, s.db, sqlExecutor, s.gossip, &s.nodeIDContainer, s.ClusterID)
+		s.clock, s.db, sqlExecutor, s.gossip, &s.nodeIDContainer, s.ClusterID, s.admission)
 
 	distSQLMetrics := distsqlrun.MakeDistSQLMetrics(cfg.HistogramWindowInterval())
 	s.registry.AddMetricStruct(distSQLMetrics)
@@ -373,6 +390,7 @@ func NewServer(cfg Config, stopper *stop.Stopper) (*Server, error) {
 		FlowDB:     client.NewDB(s.distSender, s.clock),
 		RPCContext: s.rpcContext,
 		Stopper:    s.stopper,
+		Gossip:     s.gossip,
 		NodeID:     &s.nodeIDContainer,
 
 		TempStorage: tempEngine,
@@ -382,6 +400,8 @@ func NewServer(cfg Config, stopper *stop.Stopper) (*Server, error) {
 		Metrics: &distSQLMetrics,
 
 		JobRegistry: s.jobRegistry,
+
+		AdmissionController: s.admission,
 	}
 	if distSQLTestingKnobs := s.cfg.TestingKnobs.DistSQL; distSQLTestingKnobs != nil {
 		distSQLCfg.TestingKnobs = *distSQLTestingKnobs.(*distsqlrun.TestingKnobs)
@@ -1032,6 +1052,7 @@ func (s *Server) Start(ctx context.Context) error {
 	s.mux.Handle(authPrefix, gwMux)
 	s.mux.Handle("/health", gwMux)
 	s.mux.Handle(statusVars, http.HandlerFunc(s.status.handleVars))
+	s.mux.Handle(statusTraces, authorizedHandler(handleTraces(s.st.Tracer.Registry())))
 	log.Event(ctx, "added http endpoints")
 
 	// Before serving SQL requests, we have to make sure the database is
@@ -1086,6 +1107,9 @@ func (s *Server) doDrain(modes []serverpb.DrainMode, setTo bool) ([]serverpb.Dra
 				// the pgServer has given sessions a chance to finish ongoing
 				// work.
 				defer s.leaseMgr.SetDraining(setTo)
+				// Other nodes stop planning flows on this node once it rejects
+				// them.
+				s.distSQLServer.SetDraining(setTo)
 				return s.pgServer.SetDraining(setTo)
 			}(); err != nil {
 				return nil, err
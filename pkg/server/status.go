@@ -28,6 +28,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/coreos/etcd/raft"
 	gwruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
@@ -54,6 +55,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 )
 
 const (
@@ -69,6 +71,9 @@ const (
 	// statusVars exposes prometheus metrics for monitoring consumption.
 	statusVars = statusPrefix + "vars"
 
+	// statusTraces exposes the traces of sampled and slow operations.
+	statusTraces = statusPrefix + "traces"
+
 	// raftStateDormant is used when there is no known raft state.
 	raftStateDormant = "StateDormant"
 
@@ -700,6 +705,26 @@ func (s *statusServer) handleVars(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleTraces returns a handler serving the traces kept in the given
+// registry, most recent first.
+func handleTraces(registry *tracing.TraceRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(httputil.ContentTypeHeader, httputil.PlaintextContentType)
+		for _, rt := range registry.Traces() {
+			var slow string
+			if rt.Slow {
+				slow = " (slow)"
+			}
+			fmt.Fprintf(w, "=== %s %s took %s%s\n%s\n",
+				rt.Start.Format(time.RFC3339Nano), rt.Operation, rt.Duration, slow, rt.Summary)
+			if rt.Spans != nil {
+				fmt.Fprintln(w, tracing.FormatRecordedSpans(rt.Spans))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
 // Ranges returns range info for the specified node.
 func (s *statusServer) Ranges(
 	ctx context.Context, req *serverpb.RangesRequest,
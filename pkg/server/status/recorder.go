@@ -20,7 +20,9 @@ import (
 	"io"
 	"os"
 	"strconv"
+	"time"
 
+	"github.com/codahale/hdrhistogram"
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/build"
@@ -57,6 +59,13 @@ type quantile struct {
 	quantile float64
 }
 
+// windowedHistogram is implemented by the histograms whose windowed data
+// is recorded at recordHistogramQuantiles, i.e. metric.Histogram and
+// metric.WindowedHistogram.
+type windowedHistogram interface {
+	Windowed() (*hdrhistogram.Histogram, time.Duration)
+}
+
 var recordHistogramQuantiles = []quantile{
 	{"-max", 100},
 	{"-p99.999", 99.999},
@@ -418,7 +427,7 @@ func extractValue(mtr interface{}) (float64, error) {
 // recordable values.
 func eachRecordableValue(reg *metric.Registry, fn func(string, float64)) {
 	reg.Each(func(name string, mtr interface{}) {
-		if histogram, ok := mtr.(*metric.Histogram); ok {
+		if histogram, ok := mtr.(windowedHistogram); ok {
 			// TODO(mrtracy): Where should this comment go for better
 			// visibility?
 			//
@@ -24,7 +24,7 @@ var (
 	BinaryMinimumSupportedVersion = VersionBase
 
 	// BinaryServerVersion is the version of this binary.
-	BinaryServerVersion = VersionSplitHardStateBelowRaft
+	BinaryServerVersion = VersionCPutAllowIfDoesNotExist
 )
 
 // List all historical versions here in reverse chronological order, with
@@ -33,6 +33,19 @@ var (
 // NB: when adding a version, don't forget to bump ServerVersion above (and
 // perhaps MinimumSupportedVersion, if necessary).
 var (
+	// VersionCPutAllowIfDoesNotExist allows ConditionalPut requests to succeed
+	// if the key doesn't exist, with AllowIfDoesNotExist.
+	VersionCPutAllowIfDoesNotExist = roachpb.Version{Major: 1, Minor: 0, Unstable: 5}
+
+	// VersionReadRefresh allows transactions to refresh their reads with
+	// Refresh and RefreshRange requests instead of restarting when their
+	// timestamp is pushed.
+	VersionReadRefresh = roachpb.Version{Major: 1, Minor: 0, Unstable: 4}
+
+	// VersionCoalescedHeartbeats allows HeartbeatTxn requests to specify the
+	// transaction to heartbeat, so that they can be sent outside of it.
+	VersionCoalescedHeartbeats = roachpb.Version{Major: 1, Minor: 0, Unstable: 3}
+
 	// VersionSplitHardStateBelowRaft is https://github.com/cockroachdb/cockroach/pull/17051.
 	VersionSplitHardStateBelowRaft = roachpb.Version{Major: 1, Minor: 0, Unstable: 2}
 
@@ -45,6 +45,10 @@ var ValidateEnterpriseLicense = func(s string) error {
 // BulkIOWriteLimiterBurst is the burst for the BulkIOWriteLimiter cluster setting.
 const BulkIOWriteLimiterBurst = 2 * 1024 * 1024 // 2MB
 
+// BackfillWriteLimiterBurst is the burst for the BackfillWriteLimiter cluster
+// setting.
+const BackfillWriteLimiterBurst = 2 * 1024 * 1024 // 2MB
+
 // DebugRemoteMode controls who can access /debug/requests.
 type DebugRemoteMode string
 
@@ -105,9 +109,13 @@ func DistSQLExecModeFromString(val string) DistSQLExecMode {
 
 // TracingSettings is the subset of ClusterSettings affecting tracing.
 type TracingSettings struct {
-	EnableNetTrace  *settings.BoolSetting
-	LightstepToken  *settings.StringSetting
-	ZipkinCollector *settings.StringSetting
+	EnableNetTrace   *settings.BoolSetting
+	LightstepToken   *settings.StringSetting
+	ZipkinCollector  *settings.StringSetting
+	JaegerCollector  *settings.StringSetting
+	ZipkinSampleRate *settings.FloatSetting
+	SampleRate       *settings.FloatSetting
+	RedactKeys       *settings.BoolSetting
 
 	Tracer *tracing.Tracer
 }
@@ -130,6 +138,14 @@ func (t tracingReconfigurationOptions) ZipkinAddr() string {
 	return t.ts.ZipkinCollector.Get()
 }
 
+func (t tracingReconfigurationOptions) JaegerAddr() string {
+	return t.ts.JaegerCollector.Get()
+}
+
+func (t tracingReconfigurationOptions) ZipkinSampleRate() float64 {
+	return t.ts.ZipkinSampleRate.Get()
+}
+
 // ReportingSettings is the subset of ClusterSettings affecting crash and
 // diagnostics reporting.
 type ReportingSettings struct {
@@ -159,11 +175,34 @@ func (rs ReportingSettings) HasCrashReportsEnabled() bool {
 
 // DistSQLSettings is the subset of ClusterSettings affecting DistSQL.
 type DistSQLSettings struct {
-	DistSQLUseTempStorage      *settings.BoolSetting
-	DistSQLUseTempStorageSorts *settings.BoolSetting
-	DistSQLUseTempStorageJoins *settings.BoolSetting
-	DistributeIndexJoin        *settings.BoolSetting
-	PlanMergeJoins             *settings.BoolSetting
+	DistSQLUseTempStorage         *settings.BoolSetting
+	DistSQLUseTempStorageSorts    *settings.BoolSetting
+	DistSQLUseTempStorageJoins    *settings.BoolSetting
+	DistSQLUseTempStorageAggs     *settings.BoolSetting
+	DistSQLUseTempStorageDistinct *settings.BoolSetting
+	DistSQLWorkMem                *settings.ByteSizeSetting
+	DistSQLAggregatorWorkers      *settings.IntSetting
+	DistSQLVectorizeAggs          *settings.BoolSetting
+	DistributeIndexJoin           *settings.BoolSetting
+	PlanMergeJoins                *settings.BoolSetting
+	PlanInterleavedJoins          *settings.BoolSetting
+	PlanLookupJoins               *settings.BoolSetting
+	PlanRuntimeFilters            *settings.BoolSetting
+
+	BackfillWriteLimit   *settings.ByteSizeSetting
+	BackfillWriteLimiter *rate.Limiter
+
+	MaxRunningFlows  *settings.IntSetting
+	MaxQueuedFlows   *settings.IntSetting
+	FlowQueueTimeout *settings.DurationSetting
+
+	FlowMemoryLimit       *settings.ByteSizeSetting
+	FlowMemoryReservation *settings.ByteSizeSetting
+	QueryMemoryLimit      *settings.ByteSizeSetting
+	FlowTempStorageLimit  *settings.ByteSizeSetting
+
+	RowChannelBufSize *settings.IntSetting
+	StreamCompression *settings.BoolSetting
 }
 
 // SQLStatsSettings is the subset of ClusterSettings affecting SQL statistics
@@ -178,6 +217,8 @@ type SQLStatsSettings struct {
 // sessions.
 type SQLSessionSettings struct {
 	TraceTxnThreshold           *settings.DurationSetting
+	TraceStmtThreshold          *settings.DurationSetting
+	SlowQueryLogThreshold       *settings.DurationSetting
 	TraceSessionEventLogEnabled *settings.BoolSetting
 	LogStatementsExecuteEnabled *settings.BoolSetting
 	DistSQLClusterExecMode      *settings.EnumSetting
@@ -201,6 +242,14 @@ type RebalancingSettings struct {
 	TimeUntilStoreDead *settings.DurationSetting
 }
 
+// DistSenderSettings is the subset of ClusterSettings affecting the
+// routing of requests by the DistSender.
+type DistSenderSettings struct {
+	EnableLoadBasedReplicaOrdering *settings.BoolSetting
+	ReplicaOrderingLoadThreshold   *settings.FloatSetting
+	SlowRequestThreshold           *settings.DurationSetting
+}
+
 // StorageSettings is the subset of ClusterSettings affecting the storage
 // layer.
 type StorageSettings struct {
@@ -218,6 +267,8 @@ type StorageSettings struct {
 	ImportBatchSize             *settings.ByteSizeSetting
 	AddSSTableEnabled           *settings.BoolSetting
 	MaxIntents                  *settings.IntSetting
+	MaxRefreshSpans             *settings.IntSetting
+	AsyncConsensusEnabled       *settings.BoolSetting
 }
 
 // UISettings is the subset of ClusterSettings affecting the UI.
@@ -275,6 +326,7 @@ type Settings struct {
 	ReportingSettings
 	RocksDBSettings
 	RebalancingSettings
+	DistSenderSettings
 	StorageSettings
 	SQLStatsSettings
 	SQLSessionSettings
@@ -424,6 +476,45 @@ func MakeClusterSettings(minVersion, serverVersion roachpb.Version) *Settings {
 		envutil.EnvOrDefaultString("COCKROACH_TEST_ZIPKIN_COLLECTOR", ""),
 	).OnChange(tracingOnChange)
 
+	s.JaegerCollector = r.RegisterStringSetting(
+		"trace.jaeger.collector",
+		"if set, traces go to the Zipkin-compatible endpoint of the given Jaeger collector (example: '127.0.0.1:9411'); ignored if trace.lightstep.token or trace.zipkin.collector is set.",
+		envutil.EnvOrDefaultString("COCKROACH_TEST_JAEGER_COLLECTOR", ""),
+	).OnChange(tracingOnChange)
+
+	s.ZipkinSampleRate = r.RegisterValidatedFloatSetting(
+		"trace.zipkin.sample_rate",
+		"fraction of the traces sent to the collector set by trace.zipkin.collector or trace.jaeger.collector",
+		1,
+		func(v float64) error {
+			if v < 0 || v > 1 {
+				return errors.Errorf("cannot set trace.zipkin.sample_rate to a value outside [0, 1]: %f", v)
+			}
+			return nil
+		},
+	).OnChange(tracingOnChange)
+
+	s.SampleRate = r.RegisterValidatedFloatSetting(
+		"trace.sample_rate",
+		"fraction of KV batches and DistSQL queries traced into the registry served at /_status/traces, which also keeps the slow ones",
+		0.001,
+		func(v float64) error {
+			if v < 0 || v > 1 {
+				return errors.Errorf("cannot set trace.sample_rate to a value outside [0, 1]: %f", v)
+			}
+			return nil
+		},
+	).OnChange(func() {
+		s.Tracer.SetSampleRate(s.SampleRate.Get())
+	})
+	s.Tracer.SetSampleRate(s.SampleRate.Get())
+
+	s.RedactKeys = r.RegisterBoolSetting(
+		"trace.redact_keys.enabled",
+		"if set, the keys in the tags of traced KV operations and in the errors and logs of the DistSender are redacted down to their table and index",
+		true,
+	)
+
 	crashReportsOnChange := func() {
 		f := log.ReportingSettings(s.ReportingSettings)
 		log.ReportingSettingsSingleton.Store(&f)
@@ -465,6 +556,24 @@ func MakeClusterSettings(minVersion, serverVersion roachpb.Version) *Settings {
 		"kv.transaction.max_intents",
 		"maximum number of write intents allowed for a KV transaction", 100000)
 
+	// maxRefreshSpans is the limit for the number of spans read by a
+	// transaction which its coordinator keeps track of, so that they can be
+	// refreshed instead of restarting the transaction when its timestamp is
+	// pushed. Transactions reading more spans restart as usual.
+	s.MaxRefreshSpans = r.RegisterIntSetting(
+		"kv.transaction.max_refresh_spans",
+		"maximum number of read spans tracked to refresh a KV transaction instead of restarting it (0 to disable)",
+		1000)
+
+	// AsyncConsensusEnabled lets the writes of transactions be acknowledged
+	// as soon as they're proposed to Raft. Their coordinator proves them
+	// before relying on them, which saves waiting for the replication of each
+	// write of a transaction spanning many ranges.
+	s.AsyncConsensusEnabled = r.RegisterBoolSetting(
+		"kv.transaction.async_consensus.enabled",
+		"if set, transactional writes are acknowledged before being replicated and proven before the transaction commits",
+		false)
+
 	s.MinWALSyncInterval = r.RegisterDurationSetting(
 		"rocksdb.min_wal_sync_interval",
 		"minimum duration between syncs of the RocksDB WAL",
@@ -524,6 +633,36 @@ func MakeClusterSettings(minVersion, serverVersion roachpb.Version) *Settings {
 		"minimum fraction away from the mean a store's stats (like disk usage or writes per second) can be before it is considered overfull or underfull",
 		0.20)
 
+	// EnableLoadBasedReplicaOrdering controls whether the DistSender takes the
+	// load gossiped by the stores into account when choosing the replica to
+	// send reads to which don't need to be served by the leaseholder.
+	s.EnableLoadBasedReplicaOrdering = r.RegisterBoolSetting(
+		"kv.dist_sender.load_based_ordering.enabled",
+		"set to try replicas on overloaded stores last for reads which can be served by any replica",
+		false)
+
+	// ReplicaOrderingLoadThreshold is the minimum ratio of a store's load to
+	// the mean load of the stores of a range's replicas at which that store is
+	// considered overloaded when ordering the replicas.
+	s.ReplicaOrderingLoadThreshold = r.RegisterNonNegativeFloatSetting(
+		"kv.dist_sender.load_based_ordering.threshold",
+		"minimum fraction above the mean load of a range's stores (in queries or CPU per second) a store's load must be for it to be considered overloaded",
+		0.20)
+
+	// SlowRequestThreshold is the time the DistSender waits for a replica
+	// before it reports a request as slow. It defaults to the value of
+	// base.SlowRequestThreshold, which can't be imported here.
+	s.SlowRequestThreshold = r.RegisterValidatedDurationSetting(
+		"kv.dist_sender.slow_request_threshold",
+		"the time to wait for a replica before considering a request to be slow",
+		60*time.Second,
+		func(v time.Duration) error {
+			if v <= 0 {
+				return errors.Errorf("cannot set kv.dist_sender.slow_request_threshold to a non-positive duration: %s", v)
+			}
+			return nil
+		})
+
 	s.SyncRaftLog = r.RegisterBoolSetting(
 		"kv.raft_log.synchronize",
 		"set to true to synchronize on Raft log writes to persistent storage",
@@ -598,6 +737,30 @@ func MakeClusterSettings(minVersion, serverVersion roachpb.Version) *Settings {
 		true,
 	)
 
+	s.DistSQLUseTempStorageAggs = r.RegisterBoolSetting(
+		"sql.defaults.distsql.tempstorage.aggregations",
+		"set to true to enable use of disk for distributed sql aggregations. sql.defaults.distsql.tempstorage must be true",
+		true,
+	)
+
+	s.DistSQLUseTempStorageDistinct = r.RegisterBoolSetting(
+		"sql.defaults.distsql.tempstorage.distinct",
+		"set to true to enable use of disk for distributed sql distinct operations. sql.defaults.distsql.tempstorage must be true",
+		true,
+	)
+
+	s.DistSQLWorkMem = r.RegisterValidatedByteSizeSetting(
+		"sql.defaults.distsql.workmem",
+		"default amount of memory each distributed sql processor can use before falling back to disk. sql.defaults.distsql.tempstorage must be true",
+		64<<20, // 64 MiB
+		func(v int64) error {
+			if v < 1 {
+				return errors.Errorf("cannot set sql.defaults.distsql.workmem to a value less than 1: %d", v)
+			}
+			return nil
+		},
+	)
+
 	// StmtStatsEnable determines whether to collect per-statement
 	// statistics.
 	s.StmtStatsEnable = r.RegisterBoolSetting(
@@ -621,6 +784,18 @@ func MakeClusterSettings(minVersion, serverVersion roachpb.Version) *Settings {
 	// If true, for index joins  we instantiate a join reader on every node that
 	// has a stream (usually from a table reader). If false, there is a single join
 	// reader.
+	s.DistSQLAggregatorWorkers = r.RegisterIntSetting(
+		"sql.distsql.aggregator.workers",
+		"number of goroutines among which each distributed sql aggregator partitions its groups",
+		1,
+	)
+
+	s.DistSQLVectorizeAggs = r.RegisterBoolSetting(
+		"sql.distsql.aggregator.vectorize",
+		"if set, distributed sql aggregators process their input in columnar batches when all their aggregations support it",
+		true,
+	)
+
 	s.DistributeIndexJoin = r.RegisterBoolSetting(
 		"sql.distsql.distribute_index_joins",
 		"if set, for index joins we instantiate a join reader on every node that has a "+
@@ -634,6 +809,110 @@ func MakeClusterSettings(minVersion, serverVersion roachpb.Version) *Settings {
 		true,
 	)
 
+	s.PlanInterleavedJoins = r.RegisterBoolSetting(
+		"sql.distsql.interleaved_joins.enabled",
+		"if set, we plan joins between a table and a table interleaved in it with a single scan when possible",
+		true,
+	)
+
+	s.PlanLookupJoins = r.RegisterBoolSetting(
+		"sql.distsql.lookup_joins.enabled",
+		"if set, we plan joins with a selective input as lookups in an index of the other table when possible",
+		false,
+	)
+
+	s.PlanRuntimeFilters = r.RegisterBoolSetting(
+		"sql.distsql.runtime_filters.enabled",
+		"if set, hash joins filter the rows of the table scans of one side with the values of the other side when possible",
+		true,
+	)
+
+	s.BackfillWriteLimit = r.RegisterByteSizeSetting(
+		"sql.distsql.backfill.max_rate",
+		"the rate limit (bytes/sec) for the writes of each node on behalf of index backfills",
+		math.MaxInt64,
+	)
+
+	s.BackfillWriteLimiter = rate.NewLimiter(
+		rate.Limit(s.BackfillWriteLimit.Get()), BackfillWriteLimiterBurst,
+	)
+
+	s.BackfillWriteLimit.OnChange(func() {
+		s.BackfillWriteLimiter.SetLimit(rate.Limit(s.BackfillWriteLimit.Get()))
+	})
+
+	s.MaxRunningFlows = r.RegisterValidatedIntSetting(
+		"sql.distsql.max_running_flows",
+		"maximum number of distributed sql flows running concurrently on a node; further flows are queued",
+		500,
+		func(v int64) error {
+			if v < 1 {
+				return errors.Errorf("cannot set sql.distsql.max_running_flows to a value less than 1: %d", v)
+			}
+			return nil
+		},
+	)
+
+	s.MaxQueuedFlows = r.RegisterValidatedIntSetting(
+		"sql.distsql.max_queued_flows",
+		"maximum number of distributed sql flows waiting to run on a node; further flows are rejected",
+		1000,
+		func(v int64) error {
+			if v < 0 {
+				return errors.Errorf("cannot set sql.distsql.max_queued_flows to a negative value: %d", v)
+			}
+			return nil
+		},
+	)
+
+	s.FlowQueueTimeout = r.RegisterNonNegativeDurationSetting(
+		"sql.distsql.flow_queue_timeout",
+		"maximum amount of time a distributed sql flow waits to run on a node before it is abandoned",
+		10*time.Second,
+	)
+
+	s.FlowMemoryLimit = r.RegisterByteSizeSetting(
+		"sql.distsql.flow_memory_limit",
+		"maximum amount of memory each distributed sql flow can use on a node; 0 means no limit",
+		1<<30, // 1 GiB
+	)
+
+	s.FlowMemoryReservation = r.RegisterByteSizeSetting(
+		"sql.distsql.flow_memory_reservation",
+		"amount of memory each distributed sql flow reserves from the node's sql memory pool before it starts; flows which can't reserve it are queued",
+		256<<10, // 256 KiB
+	)
+
+	s.QueryMemoryLimit = r.RegisterByteSizeSetting(
+		"sql.distsql.query_memory_limit",
+		"maximum amount of memory the flows of a distributed sql query can use across all nodes; 0 means no limit",
+		0,
+	)
+
+	s.FlowTempStorageLimit = r.RegisterByteSizeSetting(
+		"sql.distsql.flow_temp_storage_limit",
+		"maximum amount of temporary storage each distributed sql flow can use on a node; 0 means no limit besides the node's temporary storage budget",
+		0,
+	)
+
+	s.RowChannelBufSize = r.RegisterValidatedIntSetting(
+		"sql.distsql.row_channel_buffer_size",
+		"number of rows buffered between the processors of a distributed sql flow",
+		16,
+		func(v int64) error {
+			if v < 1 {
+				return errors.Errorf("cannot set sql.distsql.row_channel_buffer_size to a value less than 1: %d", v)
+			}
+			return nil
+		},
+	)
+
+	s.StreamCompression = r.RegisterBoolSetting(
+		"sql.distsql.stream_compression.enabled",
+		"if set, the rows sent between nodes by distributed sql flows are compressed; requires all nodes to be upgraded",
+		false,
+	)
+
 	// traceTxnThreshold can be used to log SQL transactions that take
 	// longer than duration to complete. For example, traceTxnThreshold=1s
 	// will log the trace for any transaction that takes 1s or longer. To
@@ -645,6 +924,27 @@ func MakeClusterSettings(minVersion, serverVersion roachpb.Version) *Settings {
 		"sql.trace.txn.enable_threshold",
 		"duration beyond which all transactions are traced (set to 0 to disable)", 0)
 
+	// traceStmtThreshold is the per-statement counterpart of
+	// traceTxnThreshold: the statements are recorded individually, including
+	// the spans of all the nodes they run on, and the trace of those which
+	// take longer than the duration is logged on the gateway. Statements of
+	// transactions which are already recorded aren't recorded separately.
+	s.TraceStmtThreshold = r.RegisterDurationSetting(
+		"sql.trace.stmt.enable_threshold",
+		"duration beyond which all statements are traced (set to 0 to disable); "+
+			"finer-grained than sql.trace.txn.enable_threshold", 0)
+
+	// slowQueryLogThreshold enables the slow query log, into which the
+	// statements which take longer than the duration are written with a
+	// condensed trace, the KV batches they sent and their transaction's
+	// retries (see crdb_internal.node_slow_queries). Like
+	// traceStmtThreshold, any positive duration causes all statements to be
+	// recorded.
+	s.SlowQueryLogThreshold = r.RegisterDurationSetting(
+		"sql.trace.slow_query_log.threshold",
+		"duration beyond which statements are written with their trace to the node's slow query log "+
+			"(set to 0 to disable); any positive duration causes all statements to be traced", 0)
+
 	// traceSessionEventLogEnabled can be used to enable the event log
 	// that is normally kept for every SQL connection. The event log has a
 	// non-trivial performance impact and also reveals SQL statements
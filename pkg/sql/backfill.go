@@ -290,6 +290,10 @@ func (sc *SchemaChanger) truncateIndexes(
 					defer sc.testingKnobs.RunAfterBackfillChunk()
 				}
 
+				if err := txn.SetQoSClass(roachpb.QOS_BACKGROUND); err != nil {
+					return err
+				}
+
 				// TODO(vivek): See comment in backfillIndexesChunk.
 				if err := txn.SetSystemConfigTrigger(); err != nil {
 					return err
@@ -31,7 +31,9 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/jobs"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/duration"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 )
 
 const crdbInternalName = "crdb_internal"
@@ -46,6 +48,8 @@ var crdbInternal = virtualSchema{
 		crdbInternalStmtStatsTable,
 		crdbInternalJobsTable,
 		crdbInternalSessionTraceTable,
+		crdbInternalInflightTraceSpansTable,
+		crdbInternalSlowQueriesTable,
 		crdbInternalClusterSettingsTable,
 		crdbInternalSessionVariablesTable,
 		crdbInternalLocalQueriesTable,
@@ -502,6 +506,110 @@ CREATE TABLE crdb_internal.session_trace (
 	},
 }
 
+// crdbInternalInflightTraceSpansTable exposes the spans of this node's
+// tracer which haven't finished yet, e.g. those of the DistSender sends and
+// DistSQL flows in progress.
+var crdbInternalInflightTraceSpansTable = virtualSchemaTable{
+	schema: `
+CREATE TABLE crdb_internal.node_inflight_trace_spans (
+  node_id        INT NOT NULL,
+  trace_id       INT NOT NULL,
+  span_id        INT NOT NULL,
+  parent_span_id INT,                  -- NULL for the root span of a trace.
+  operation      STRING NOT NULL,
+  start_time     TIMESTAMPTZ NOT NULL,
+  duration       INTERVAL NOT NULL,    -- The time elapsed since start_time.
+  tags           STRING NOT NULL       -- The span's tags, as key=value pairs.
+);
+`,
+	populate: func(_ context.Context, p *planner, _ string, addRow func(...parser.Datum) error) error {
+		if p.session.User != security.RootUser {
+			return errors.New("only root can access in-flight trace spans")
+		}
+
+		nodeID := parser.NewDInt(parser.DInt(int64(p.ExecCfg().NodeInfo.NodeID.Get())))
+		now := timeutil.Now()
+		for _, sp := range p.session.execCfg.Settings.Tracer.ActiveSpans() {
+			parentSpanID := parser.DNull
+			if sp.ParentSpanID != 0 {
+				parentSpanID = parser.NewDInt(parser.DInt(sp.ParentSpanID))
+			}
+			tagKeys := make([]string, 0, len(sp.Tags))
+			for k := range sp.Tags {
+				tagKeys = append(tagKeys, k)
+			}
+			sort.Strings(tagKeys)
+			var tags bytes.Buffer
+			for i, k := range tagKeys {
+				if i > 0 {
+					tags.WriteString(", ")
+				}
+				fmt.Fprintf(&tags, "%s=%s", k, sp.Tags[k])
+			}
+			if err := addRow(
+				nodeID,
+				parser.NewDInt(parser.DInt(sp.TraceID)),
+				parser.NewDInt(parser.DInt(sp.SpanID)),
+				parentSpanID,
+				parser.NewDString(sp.Operation),
+				parser.MakeDTimestampTZ(sp.StartTime, time.Microsecond),
+				&parser.DInterval{Duration: duration.Duration{Nanos: now.Sub(sp.StartTime).Nanoseconds()}},
+				parser.NewDString(tags.String()),
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// crdbInternalSlowQueriesTable exposes the statements of this node's slow
+// query log, i.e. the most recent ones which took longer than
+// sql.trace.slow_query_log.threshold.
+var crdbInternalSlowQueriesTable = virtualSchemaTable{
+	schema: `
+CREATE TABLE crdb_internal.node_slow_queries (
+  node_id          INT NOT NULL,
+  start_time       TIMESTAMPTZ NOT NULL,
+  duration         INTERVAL NOT NULL,
+  username         STRING NOT NULL,
+  application_name STRING NOT NULL,
+  statement        STRING NOT NULL,
+  batches          STRING NOT NULL,    -- The KV batches sent, one per line.
+  retries          STRING NOT NULL,    -- The txn's automatic retries, one per line.
+  trace            STRING NOT NULL     -- The spans of the trace with their durations.
+);
+`,
+	populate: func(_ context.Context, p *planner, _ string, addRow func(...parser.Datum) error) error {
+		if p.session.User != security.RootUser {
+			return errors.New("only root can access the slow query log")
+		}
+
+		slowQueries := p.session.slowQueries
+		if slowQueries == nil {
+			return errors.New("cannot access the slow query log from this context")
+		}
+
+		nodeID := parser.NewDInt(parser.DInt(int64(p.ExecCfg().NodeInfo.NodeID.Get())))
+		for _, q := range slowQueries.get() {
+			if err := addRow(
+				nodeID,
+				parser.MakeDTimestampTZ(q.start, time.Microsecond),
+				&parser.DInterval{Duration: duration.Duration{Nanos: q.duration.Nanoseconds()}},
+				parser.NewDString(q.user),
+				parser.NewDString(q.appName),
+				parser.NewDString(q.stmt),
+				parser.NewDString(strings.Join(q.batches, "\n")),
+				parser.NewDString(strings.Join(q.retries, "\n")),
+				parser.NewDString(q.trace),
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
 // crdbInternalClusterSettingsTable exposes the list of current
 // cluster settings.
 var crdbInternalClusterSettingsTable = virtualSchemaTable{
@@ -563,7 +671,8 @@ CREATE TABLE crdb_internal.%s (
   client_address   STRING,         -- the address of the client that issued the query
   application_name STRING,         -- the name of the application as per SET application_name
   distributed      BOOL,           -- whether the query is running distributed
-  phase            STRING          -- the current execution phase
+  phase            STRING,         -- the current execution phase
+  progress         FLOAT           -- the estimated fraction of its rows that a distributed query has read
 );
 `
 
@@ -601,6 +710,7 @@ func populateQueriesTable(
 	for _, session := range response.Sessions {
 		for _, query := range session.ActiveQueries {
 			isDistributedDatum := parser.DNull
+			progressDatum := parser.DNull
 			phase := strings.ToLower(query.Phase.String())
 			if phase == "executing" {
 				isDistributedDatum = parser.DBoolFalse
@@ -608,6 +718,11 @@ func populateQueriesTable(
 					isDistributedDatum = parser.DBoolTrue
 				}
 			}
+			if query.EstimatedRows > 0 {
+				progressDatum = parser.NewDFloat(
+					parser.DFloat(float64(query.RowsRead) / float64(query.EstimatedRows)),
+				)
+			}
 			if err := addRow(
 				parser.NewDString(query.ID),
 				parser.NewDInt(parser.DInt(session.NodeID)),
@@ -618,6 +733,7 @@ func populateQueriesTable(
 				parser.NewDString(session.ApplicationName),
 				isDistributedDatum,
 				parser.NewDString(phase),
+				progressDatum,
 			); err != nil {
 				return err
 			}
@@ -638,6 +754,7 @@ func populateQueriesTable(
 				parser.DNull,
 				parser.DNull,
 				parser.DNull,
+				parser.DNull,
 			); err != nil {
 				return err
 			}
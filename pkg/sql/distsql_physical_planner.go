@@ -69,6 +69,10 @@ type distSQLPlanner struct {
 	spanResolver distsqlplan.SpanResolver
 	testingKnobs DistSQLPlannerTestingKnobs
 
+	// gossip is used to find out the distsqlrun versions accepted by the other
+	// nodes (see distsqlrun.DistSQLVersionGossipInfo).
+	gossip *gossip.Gossip
+
 	// runnerChan is used to send out requests (for running SetupFlow RPCs) to a
 	// pool of workers.
 	runnerChan chan runnerRequest
@@ -98,11 +102,23 @@ func newDistSQLPlanner(
 		distSQLSrv:   distSQLSrv,
 		spanResolver: distsqlplan.NewSpanResolver(distSender, gossip, nodeDesc, resolverPolicy),
 		testingKnobs: testingKnobs,
+		gossip:       gossip,
 	}
 	dsp.initRunners()
 	return dsp
 }
 
+// nodeVersionIsCompatible returns whether the given node accepts flows with the
+// given distsqlrun version, according to the versions it gossips. Nodes which
+// haven't gossiped their versions (yet) are assumed to be incompatible.
+func (dsp *distSQLPlanner) nodeVersionIsCompatible(nodeID roachpb.NodeID, version uint32) bool {
+	var v distsqlrun.DistSQLVersionGossipInfo
+	if err := dsp.gossip.GetInfoProto(gossip.MakeDistSQLNodeVersionKey(nodeID), &v); err != nil {
+		return false
+	}
+	return v.MinAcceptedVersion <= version && version <= v.Version
+}
+
 // setSpanResolver switches to a different SpanResolver. It is the caller's
 // responsibility to make sure the distSQLPlanner is not in use.
 func (dsp *distSQLPlanner) setSpanResolver(spanResolver distsqlplan.SpanResolver) {
@@ -293,13 +309,6 @@ func (dsp *distSQLPlanner) checkSupportForNode(node planNode) (distRecommendatio
 		return dsp.checkSupportForNode(n.index)
 
 	case *groupNode:
-		for _, fholder := range n.funcs {
-			if f, ok := fholder.expr.(*parser.FuncExpr); ok {
-				if strings.ToUpper(f.Func.FunctionReference.String()) == "ARRAY_AGG" {
-					return 0, newQueryNotSupportedError("ARRAY_AGG aggregation not supported yet")
-				}
-			}
-		}
 		rec, err := dsp.checkSupportForNode(n.plan)
 		if err != nil {
 			return 0, err
@@ -349,8 +358,12 @@ type planningCtx struct {
 	spanIter distsqlplan.SpanResolverIterator
 	// nodeAddresses contains addresses for all NodeIDs that are referenced by any
 	// physicalPlan we generate with this context.
-	// Nodes that fail a health check have empty addresses.
+	// Nodes that fail a health check, or which don't accept the flows of this
+	// node, have empty addresses.
 	nodeAddresses map[roachpb.NodeID]string
+	// drainingNodes contains the nodes which rejected their flow because they
+	// are draining; it is populated by distSQLPlanner.Run.
+	drainingNodes []roachpb.NodeID
 }
 
 // physicalPlan is a partial physical plan which corresponds to a planNode
@@ -486,6 +499,11 @@ func (dsp *distSQLPlanner) partitionSpans(
 						// always has its address in the nodeMap).
 						addr = ""
 						log.VEventf(ctx, 1, "marking node %d as unhealthy for this plan: %v", nodeID, err)
+					} else if !dsp.nodeVersionIsCompatible(nodeID, distsqlrun.MinAcceptedVersion) {
+						// The node wouldn't accept our flows (e.g. during a rolling upgrade);
+						// use the gateway instead, like for unhealthy nodes.
+						addr = ""
+						log.VEventf(ctx, 1, "not using node %d for this plan: incompatible DistSQL version", nodeID)
 					}
 					planCtx.nodeAddresses[nodeID] = addr
 				}
@@ -1036,9 +1054,27 @@ func (dsp *distSQLPlanner) addAggregators(
 			}
 			aggregations[i].Func = distsqlrun.AggregatorSpec_Func(funcIdx)
 			aggregations[i].Distinct = (f.Type == parser.DistinctFuncType)
+			for j, renderIdx := range fholder.orderRenderIdxs {
+				dir := distsqlrun.Ordering_Column_ASC
+				if f.OrderBy[j].Direction == parser.Descending {
+					dir = distsqlrun.Ordering_Column_DESC
+				}
+				aggregations[i].Ordering.Columns = append(
+					aggregations[i].Ordering.Columns,
+					distsqlrun.Ordering_Column{
+						ColIdx:    uint32(p.planToStreamColMap[renderIdx]),
+						Direction: dir,
+					},
+				)
+			}
 		}
 		if fholder.argRenderIdx != noRenderIdx {
 			aggregations[i].ColIdx = []uint32{uint32(p.planToStreamColMap[fholder.argRenderIdx])}
+			for _, renderIdx := range fholder.otherArgRenderIdxs {
+				aggregations[i].ColIdx = append(
+					aggregations[i].ColIdx, uint32(p.planToStreamColMap[renderIdx]),
+				)
+			}
 		}
 		if fholder.hasFilter {
 			col := uint32(p.planToStreamColMap[fholder.filterRenderIdx])
@@ -1181,6 +1217,8 @@ func (dsp *distSQLPlanner) addAggregators(
 					Func:         localFunc,
 					ColIdx:       e.ColIdx,
 					FilterColIdx: e.FilterColIdx,
+					Filter:       e.Filter,
+					SkipNulls:    e.SkipNulls,
 				}
 
 				var localResultType sqlbase.ColumnType
@@ -1202,6 +1240,9 @@ func (dsp *distSQLPlanner) addAggregators(
 					// The input of final expression aIdx is the output of the
 					// local expression aIdx.
 					ColIdx: []uint32{uint32(aIdx)},
+					// Partial sums may overflow even if the total doesn't, so
+					// only the final stage checks for overflow.
+					ErrorOnOverflow: e.ErrorOnOverflow,
 				}
 				if needRender {
 					_, finalPreRenderTypes[aIdx], err = distsqlrun.GetAggregateInfo(
@@ -1240,8 +1281,9 @@ func (dsp *distSQLPlanner) addAggregators(
 		}
 
 		localAggSpec := distsqlrun.AggregatorSpec{
-			Aggregations: localAgg,
-			GroupCols:    groupCols,
+			Aggregations:     localAgg,
+			GroupCols:        groupCols,
+			OrderedGroupCols: orderedGroupCols(groupCols, p.MergeOrdering),
 		}
 
 		p.AddNoGroupingStage(
@@ -1303,6 +1345,9 @@ func (dsp *distSQLPlanner) addAggregators(
 		if prevStageNode != 0 {
 			node = prevStageNode
 		}
+		// The streams are merged according to the current ordering, so the final
+		// aggregator can emit groups as they complete.
+		finalAggSpec.OrderedGroupCols = orderedGroupCols(finalAggSpec.GroupCols, p.MergeOrdering)
 		p.AddSingleGroupStage(
 			node,
 			distsqlrun.ProcessorCoreUnion{Aggregator: &finalAggSpec},
@@ -1345,10 +1390,16 @@ func (dsp *distSQLPlanner) addAggregators(
 			p.AddProcessor(proc)
 		}
 
-		// Connect the streams.
+		// Connect the streams. If the result of any of the aggregations depends on
+		// the order of its input, the streams need to be merged according to the
+		// current ordering.
+		mergeOrdering := distsqlrun.Ordering{}
+		if n.isOrderSensitive() {
+			mergeOrdering = p.MergeOrdering
+		}
 		for bucket := 0; bucket < len(p.ResultRouters); bucket++ {
 			pIdx := pIdxStart + distsqlplan.ProcessorIdx(bucket)
-			p.MergeResultStreams(p.ResultRouters, bucket, distsqlrun.Ordering{}, pIdx, 0)
+			p.MergeResultStreams(p.ResultRouters, bucket, mergeOrdering, pIdx, 0)
 		}
 
 		// Set the new result routers.
@@ -1366,6 +1417,27 @@ func (dsp *distSQLPlanner) addAggregators(
 	return nil
 }
 
+// orderedGroupCols returns the group columns which form a prefix of the given
+// ordering. The rows of the groups having the same values on these columns are
+// contiguous in a stream with this ordering.
+func orderedGroupCols(groupCols []uint32, ordering distsqlrun.Ordering) []uint32 {
+	var res []uint32
+	for _, o := range ordering.Columns {
+		found := false
+		for _, c := range groupCols {
+			if o.ColIdx == c {
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+		res = append(res, o.ColIdx)
+	}
+	return res
+}
+
 func (dsp *distSQLPlanner) createPlanForIndexJoin(
 	planCtx *planningCtx, n *indexJoinNode,
 ) (physicalPlan, error) {
@@ -1460,6 +1532,545 @@ func getTypesForPlanResult(node planNode, planToStreamColMap []int) []sqlbase.Co
 	return types
 }
 
+// joinPostAndOnExpr sets up the post-processing spec and the ON expression of
+// a joiner for the given joinNode, given its ON condition (which is normally
+// n.pred.onCond), the equality columns of the left
+// input and the mapping of the columns of the left and right plans to the
+// columns of the joiner inputs (numLeftTypes is the number of columns of the
+// left input). It also returns the mapping of the joinNode columns to the
+// joiner output columns, and whether the joiner has merged columns.
+func joinPostAndOnExpr(
+	n *joinNode,
+	onCond parser.TypedExpr,
+	leftEqCols []uint32,
+	leftPlanToStreamColMap, rightPlanToStreamColMap []int,
+	numLeftTypes int,
+) (
+	post distsqlrun.PostProcessSpec,
+	joinToStreamColMap []int,
+	onExpr distsqlrun.Expression,
+	mergedColumns bool,
+) {
+	joinToStreamColMap = makePlanToStreamColMap(len(n.columns))
+	post.Projection = true
+	// addOutCol appends to post.OutputColumns and returns the index
+	// in the slice of the added column.
+	addOutCol := func(col uint32) int {
+		idx := len(post.OutputColumns)
+		post.OutputColumns = append(post.OutputColumns, col)
+		return idx
+	}
+
+	// The join columns are in three groups:
+	//  - numMergedEqualityColumns "merged" columns (corresponding to the equality columns)
+	//  - the columns on the left side (numLeftCols)
+	//  - the columns on the right side (numRightCols)
+	joinCol := 0
+
+	// In case of INNER joins there is no need there is no need for merged columns;
+	// the left equality columns are used instead.
+	// In case of OUTER joins we add extra `mergedColNum` columns and they
+	// occupy first positions in a row. Remaining left and right columns will
+	// have a corresponding "offset"
+	var mergedColNum int
+	if n.joinType == joinTypeInner {
+		mergedColNum = 0
+	} else {
+		mergedColNum = n.pred.numMergedEqualityColumns
+	}
+	for i := 0; i < n.pred.numMergedEqualityColumns; i++ {
+		if !n.columns[joinCol].Omitted {
+			if mergedColNum != 0 {
+				// Reserve place for new merged columns
+				joinToStreamColMap[joinCol] = addOutCol(uint32(i))
+			} else {
+				// For inner joins, merged columns are always equivalent to the left columns)
+				joinToStreamColMap[joinCol] = addOutCol(leftEqCols[i])
+			}
+		}
+		joinCol++
+	}
+
+	for i := 0; i < n.pred.numLeftCols; i++ {
+		if !n.columns[joinCol].Omitted {
+			joinToStreamColMap[joinCol] = addOutCol(
+				uint32(mergedColNum + leftPlanToStreamColMap[i]))
+		}
+		joinCol++
+	}
+	for i := 0; i < n.pred.numRightCols; i++ {
+		if !n.columns[joinCol].Omitted {
+			joinToStreamColMap[joinCol] = addOutCol(
+				uint32(mergedColNum + rightPlanToStreamColMap[i] + numLeftTypes),
+			)
+		}
+		joinCol++
+	}
+	if mergedColNum != 0 {
+		if mergedColNum != len(leftEqCols) {
+			panic("merged columns number is different from equality columns")
+		}
+		mergedColumns = true
+	}
+
+	if onCond != nil {
+		// We have to remap ordinal references in the on condition (which refer to
+		// the join columns as described above) to values that make sense in the
+		// joiner (0 to N-1 for the left input columns, N to N+M-1 for the right
+		// input columns).
+		joinColMap := make([]int, 0, len(n.columns))
+		// There should be no merged columns when ON clause is present
+		if n.pred.numMergedEqualityColumns != 0 {
+			panic("merged columns with ON condition")
+		}
+		for i := 0; i < n.pred.numLeftCols; i++ {
+			joinColMap = append(joinColMap, mergedColNum+leftPlanToStreamColMap[i])
+		}
+		for i := 0; i < n.pred.numRightCols; i++ {
+			joinColMap = append(joinColMap, mergedColNum+rightPlanToStreamColMap[i]+numLeftTypes)
+		}
+		onExpr = distsqlplan.MakeExpression(onCond, joinColMap)
+	}
+
+	return post, joinToStreamColMap, onExpr, mergedColumns
+}
+
+// createPlanForInterleavedJoin plans a join between a table and a table
+// interleaved in its primary key using interleavedReaderJoiners, which read
+// the rows of both tables with a single scan and join them as they are read,
+// one processor for each node that holds data of the parent table. It returns
+// false if the join can't be planned this way.
+func (dsp *distSQLPlanner) createPlanForInterleavedJoin(
+	planCtx *planningCtx, n *joinNode,
+) (_ physicalPlan, ok bool, _ error) {
+	if !dsp.st.PlanInterleavedJoins.Get() {
+		return physicalPlan{}, false, nil
+	}
+	var joinType distsqlrun.JoinType
+	switch n.joinType {
+	case joinTypeInner:
+		joinType = distsqlrun.JoinType_INNER
+	case joinTypeLeftOuter:
+		// The joiner doesn't support merged columns.
+		if n.pred.numMergedEqualityColumns != 0 {
+			return physicalPlan{}, false, nil
+		}
+		joinType = distsqlrun.JoinType_LEFT_OUTER
+	default:
+		return physicalPlan{}, false, nil
+	}
+
+	parent, ok := n.left.plan.(*scanNode)
+	if !ok {
+		return physicalPlan{}, false, nil
+	}
+	child, ok := n.right.plan.(*scanNode)
+	if !ok {
+		return physicalPlan{}, false, nil
+	}
+	if parent.index != &parent.desc.PrimaryIndex || parent.reverse || parent.hardLimit != 0 ||
+		child.reverse || child.hardLimit != 0 {
+		return physicalPlan{}, false, nil
+	}
+	ancestors := child.index.Interleave.Ancestors
+	if len(ancestors) == 0 {
+		return physicalPlan{}, false, nil
+	}
+	if last := ancestors[len(ancestors)-1]; last.TableID != parent.desc.ID ||
+		last.IndexID != parent.index.ID {
+		return physicalPlan{}, false, nil
+	}
+	prefixLen := 0
+	for _, a := range ancestors {
+		prefixLen += int(a.SharedPrefixLen)
+	}
+	if prefixLen != len(parent.index.ColumnIDs) {
+		return physicalPlan{}, false, nil
+	}
+	// The rows of the child table are read along with the rows of the parent
+	// table they are interleaved in, so the child table must be read in full.
+	if len(child.spans) != 1 || !child.spans[0].EqualValue(child.desc.IndexSpan(child.index.ID)) {
+		return physicalPlan{}, false, nil
+	}
+	// The equality columns must be the primary key columns of the parent table
+	// and the corresponding columns of the child index.
+	if len(n.pred.leftEqualityIndices) != prefixLen {
+		return physicalPlan{}, false, nil
+	}
+	matched := make([]bool, prefixLen)
+	for i, leftCol := range n.pred.leftEqualityIndices {
+		rightCol := n.pred.rightEqualityIndices[i]
+		found := false
+		for j, id := range parent.index.ColumnIDs {
+			if !matched[j] && parent.cols[leftCol].ID == id &&
+				child.cols[rightCol].ID == child.index.ColumnIDs[j] {
+				matched[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			return physicalPlan{}, false, nil
+		}
+	}
+
+	var tables [2]distsqlrun.InterleavedReaderJoinerSpec_Table
+	var planToStreamColMaps [2][]int
+	for i, scan := range [2]*scanNode{parent, child} {
+		trSpec, post, err := initTableReaderSpec(scan)
+		if err != nil {
+			return physicalPlan{}, false, err
+		}
+		post.Projection = true
+		post.OutputColumns = getOutputColumnsFromScanNode(scan)
+		planToStreamColMaps[i] = makePlanToStreamColMap(len(scan.resultColumns))
+		for j, col := range post.OutputColumns {
+			planToStreamColMaps[i][col] = j
+		}
+		tables[i] = distsqlrun.InterleavedReaderJoinerSpec_Table{
+			Desc:     trSpec.Table,
+			IndexIdx: trSpec.IndexIdx,
+			Post:     post,
+		}
+	}
+
+	leftEqCols := make([]uint32, prefixLen)
+	for i, leftPlanCol := range n.pred.leftEqualityIndices {
+		leftEqCols[i] = uint32(planToStreamColMaps[0][leftPlanCol])
+	}
+	post, joinToStreamColMap, onExpr, mergedColumns := joinPostAndOnExpr(
+		n, n.pred.onCond, leftEqCols, planToStreamColMaps[0], planToStreamColMaps[1],
+		len(tables[0].Post.OutputColumns),
+	)
+	if mergedColumns {
+		panic("merged columns not supported by interleaved reader joiner")
+	}
+
+	spanPartitions, err := dsp.partitionSpans(planCtx, parent.spans)
+	if err != nil {
+		return physicalPlan{}, false, err
+	}
+	spanPartitions = alignInterleavedSpanPartitions(parent.desc, parent.index, spanPartitions)
+
+	var p physicalPlan
+	stageID := p.NewStageID()
+	for _, sp := range spanPartitions {
+		irj := &distsqlrun.InterleavedReaderJoinerSpec{
+			Tables: tables[:],
+			Spans:  make([]distsqlrun.TableReaderSpan, len(sp.spans)),
+			OnExpr: onExpr,
+			Type:   joinType,
+		}
+		for i := range sp.spans {
+			irj.Spans[i].Span = sp.spans[i]
+		}
+
+		proc := distsqlplan.Processor{
+			Node: sp.node,
+			Spec: distsqlrun.ProcessorSpec{
+				Core:    distsqlrun.ProcessorCoreUnion{InterleavedReaderJoiner: irj},
+				Post:    post,
+				Output:  []distsqlrun.OutputRouterSpec{{Type: distsqlrun.OutputRouterSpec_PASS_THROUGH}},
+				StageID: stageID,
+			},
+		}
+		pIdx := p.AddProcessor(proc)
+		p.ResultRouters = append(p.ResultRouters, pIdx)
+	}
+
+	p.planToStreamColMap = joinToStreamColMap
+	p.ResultTypes = getTypesForPlanResult(n, joinToStreamColMap)
+	// The rows are emitted in the order of the parent table.
+	p.SetMergeOrdering(dsp.convertOrdering(n.ordering.ordering, p.planToStreamColMap))
+	return p, true, nil
+}
+
+// alignInterleavedSpanPartitions moves the boundaries between the given span
+// partitions which fall inside a row of the given primary index (or inside the
+// rows interleaved in it) to the end of that row, so that the rows interleaved
+// in a row are read by the same processor as the row itself. Partitions which
+// end up with no spans are removed.
+func alignInterleavedSpanPartitions(
+	desc *sqlbase.TableDescriptor, index *sqlbase.IndexDescriptor, partitions []spanPartition,
+) []spanPartition {
+	if len(partitions) <= 1 {
+		return partitions
+	}
+	var spans []*roachpb.Span
+	for i := range partitions {
+		for j := range partitions[i].spans {
+			spans = append(spans, &partitions[i].spans[j])
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Key.Compare(spans[j].Key) < 0 })
+
+	prev := spans[0]
+	for _, cur := range spans[1:] {
+		if prev.EndKey.Equal(cur.Key) {
+			if rowEnd := interleavedRowEnd(desc, index, cur.Key); rowEnd != nil {
+				if rowEnd.Compare(cur.EndKey) >= 0 {
+					// The whole span is part of the row.
+					prev.EndKey, cur.Key = cur.EndKey, cur.EndKey
+					continue
+				}
+				prev.EndKey, cur.Key = rowEnd, rowEnd
+			}
+		}
+		prev = cur
+	}
+
+	result := partitions[:0]
+	for _, sp := range partitions {
+		spans := sp.spans[:0]
+		for _, s := range sp.spans {
+			if s.Key.Compare(s.EndKey) < 0 {
+				spans = append(spans, s)
+			}
+		}
+		if len(spans) > 0 {
+			sp.spans = spans
+			result = append(result, sp)
+		}
+	}
+	return result
+}
+
+// interleavedRowEnd returns the key following all the keys of the row of the
+// given primary index which the given key is part of, including the keys of
+// the rows interleaved in it. It returns nil if the key is not part of a row of
+// the index, or if it is the first key of the row.
+func interleavedRowEnd(
+	desc *sqlbase.TableDescriptor, index *sqlbase.IndexDescriptor, key roachpb.Key,
+) roachpb.Key {
+	rest := []byte(key)
+	ancestors := index.Interleave.Ancestors
+	numCols := 0
+	for i := 0; i <= len(ancestors); i++ {
+		tableID, indexID, n := desc.ID, index.ID, len(index.ColumnIDs)-numCols
+		if i < len(ancestors) {
+			tableID, indexID = ancestors[i].TableID, ancestors[i].IndexID
+			n = int(ancestors[i].SharedPrefixLen)
+		}
+		var decodedTableID sqlbase.ID
+		var decodedIndexID sqlbase.IndexID
+		var err error
+		rest, decodedTableID, decodedIndexID, err = sqlbase.DecodeTableIDIndexID(rest)
+		if err != nil || decodedTableID != tableID || decodedIndexID != indexID {
+			return nil
+		}
+		for j := 0; j < n; j++ {
+			l, err := encoding.PeekLength(rest)
+			if err != nil {
+				return nil
+			}
+			rest = rest[l:]
+		}
+		numCols += n
+		if i < len(ancestors) {
+			// Consume the interleave sentinel.
+			var ok bool
+			if rest, ok = encoding.DecodeIfNotNull(rest); !ok {
+				return nil
+			}
+		}
+	}
+	if len(rest) == 0 {
+		return nil
+	}
+	return key[:len(key)-len(rest)].PrefixEnd()
+}
+
+// isSelectiveJoinInput returns whether the given plan is expected to produce
+// few rows, in which case looking up the matching rows of the other side of a
+// join is cheaper than reading the other side in full. For now this is only
+// based on the limits and constraints of the scans; it should use table
+// statistics once they are available.
+func isSelectiveJoinInput(plan planNode) bool {
+	switch n := plan.(type) {
+	case *scanNode:
+		if n.hardLimit != 0 || n.softLimit != 0 {
+			return true
+		}
+		return len(n.spans) != 1 || !n.spans[0].EqualValue(n.desc.IndexSpan(n.index.ID))
+	case *renderNode:
+		return isSelectiveJoinInput(n.source.plan)
+	case *limitNode:
+		return true
+	}
+	return false
+}
+
+// createPlanForLookupJoin plans a join whose left side is selective and whose
+// right side is a table scan using lookupJoiners, which look up the rows of
+// the table matching the left rows in an index whose columns are all
+// constrained by the equality columns; there is a lookupJoiner for each of the
+// left streams. It returns false if the join can't be planned this way.
+func (dsp *distSQLPlanner) createPlanForLookupJoin(
+	planCtx *planningCtx, n *joinNode,
+) (_ physicalPlan, ok bool, _ error) {
+	// The lookupJoiner doesn't maintain the ordering of its input.
+	if !dsp.st.PlanLookupJoins.Get() || len(n.ordering.ordering) > 0 {
+		return physicalPlan{}, false, nil
+	}
+	var joinType distsqlrun.JoinType
+	switch n.joinType {
+	case joinTypeInner:
+		joinType = distsqlrun.JoinType_INNER
+	case joinTypeLeftOuter:
+		// The joiner doesn't support merged columns.
+		if n.pred.numMergedEqualityColumns != 0 {
+			return physicalPlan{}, false, nil
+		}
+		joinType = distsqlrun.JoinType_LEFT_OUTER
+	default:
+		return physicalPlan{}, false, nil
+	}
+	table, ok := n.right.plan.(*scanNode)
+	if !ok || !isSelectiveJoinInput(n.left.plan) {
+		return physicalPlan{}, false, nil
+	}
+	// All the rows of the table must be looked up; a filter is fine for inner
+	// joins only (it is applied to the joined rows).
+	if table.reverse || table.hardLimit != 0 ||
+		len(table.spans) != 1 || !table.spans[0].EqualValue(table.desc.IndexSpan(table.index.ID)) ||
+		(table.filter != nil && joinType != distsqlrun.JoinType_INNER) {
+		return physicalPlan{}, false, nil
+	}
+
+	// Find an index whose columns are all equality columns, and which contains
+	// all the columns that are needed.
+	var index *sqlbase.IndexDescriptor
+	var indexIdx uint32
+	var lookupEqIdx []int
+	for i := -1; i < len(table.desc.Indexes) && index == nil; i++ {
+		candidate := &table.desc.PrimaryIndex
+		if i >= 0 {
+			candidate = &table.desc.Indexes[i]
+			if !indexCoversNeededColumns(table, candidate) {
+				continue
+			}
+		}
+		lookupEqIdx = lookupEqIdx[:0]
+		for _, id := range candidate.ColumnIDs {
+			eqIdx := -1
+			for j, rightCol := range n.pred.rightEqualityIndices {
+				if table.cols[rightCol].ID == id {
+					eqIdx = j
+					break
+				}
+			}
+			if eqIdx == -1 {
+				break
+			}
+			lookupEqIdx = append(lookupEqIdx, eqIdx)
+		}
+		if len(lookupEqIdx) == len(candidate.ColumnIDs) {
+			index, indexIdx = candidate, uint32(i+1)
+		}
+	}
+	if index == nil {
+		return physicalPlan{}, false, nil
+	}
+
+	leftColumns := planColumns(n.left.plan)
+	for _, eqIdx := range lookupEqIdx {
+		leftType := sqlbase.DatumTypeToColumnType(leftColumns[n.pred.leftEqualityIndices[eqIdx]].Typ)
+		rightCol := n.pred.rightEqualityIndices[eqIdx]
+		if leftType.SemanticType != table.cols[rightCol].Type.SemanticType {
+			return physicalPlan{}, false, nil
+		}
+	}
+	// The other equality columns are checked by the ON expression.
+	onCond := n.pred.onCond
+	for i := range n.pred.leftEqualityIndices {
+		isLookup := false
+		for _, eqIdx := range lookupEqIdx {
+			isLookup = isLookup || eqIdx == i
+		}
+		if isLookup {
+			continue
+		}
+		if n.pred.numMergedEqualityColumns != 0 {
+			// Merged columns can't be combined with an ON expression.
+			return physicalPlan{}, false, nil
+		}
+		eq := parser.NewTypedComparisonExpr(
+			parser.EQ,
+			n.pred.iVarHelper.IndexedVar(n.pred.leftEqualityIndices[i]),
+			n.pred.iVarHelper.IndexedVar(n.pred.numLeftCols+n.pred.rightEqualityIndices[i]),
+		)
+		onCond = mergeConj(onCond, eq)
+	}
+
+	leftPlan, err := dsp.createPlanForNode(planCtx, n.left.plan)
+	if err != nil {
+		return physicalPlan{}, false, err
+	}
+	lookupCols := make([]uint32, len(lookupEqIdx))
+	for i, eqIdx := range lookupEqIdx {
+		lookupCols[i] = uint32(leftPlan.planToStreamColMap[n.pred.leftEqualityIndices[eqIdx]])
+	}
+
+	// The internal columns of the lookupJoiner are the left columns followed by
+	// all the columns of the table.
+	numLeftTypes := len(leftPlan.ResultTypes)
+	leftEqCols := make([]uint32, len(n.pred.leftEqualityIndices))
+	for i, leftPlanCol := range n.pred.leftEqualityIndices {
+		leftEqCols[i] = uint32(leftPlan.planToStreamColMap[leftPlanCol])
+	}
+	tableToStreamColMap := make([]int, len(table.resultColumns))
+	for i := range tableToStreamColMap {
+		tableToStreamColMap[i] = i
+	}
+	post, joinToStreamColMap, onExpr, mergedColumns := joinPostAndOnExpr(
+		n, onCond, leftEqCols, leftPlan.planToStreamColMap, tableToStreamColMap, numLeftTypes,
+	)
+	if mergedColumns {
+		panic("merged columns not supported by lookup joiner")
+	}
+	if table.filter != nil {
+		indexVarMap := make([]int, len(table.resultColumns))
+		for i := range indexVarMap {
+			indexVarMap[i] = numLeftTypes + i
+		}
+		post.Filter = distsqlplan.MakeExpression(table.filter, indexVarMap)
+	}
+
+	lookupJoinerSpec := distsqlrun.LookupJoinerSpec{
+		Table:         *table.desc,
+		IndexIdx:      indexIdx,
+		LookupColumns: lookupCols,
+		OnExpr:        onExpr,
+		Type:          joinType,
+	}
+	leftPlan.AddNoGroupingStage(
+		distsqlrun.ProcessorCoreUnion{LookupJoiner: &lookupJoinerSpec},
+		post,
+		getTypesForPlanResult(n, joinToStreamColMap),
+		distsqlrun.Ordering{},
+	)
+	leftPlan.planToStreamColMap = joinToStreamColMap
+	return leftPlan, true, nil
+}
+
+// indexCoversNeededColumns returns whether the given secondary index contains
+// all the columns needed by the scan.
+func indexCoversNeededColumns(n *scanNode, index *sqlbase.IndexDescriptor) bool {
+	indexed := make(map[sqlbase.ColumnID]struct{})
+	for _, ids := range [][]sqlbase.ColumnID{
+		index.ColumnIDs, index.ExtraColumnIDs, index.StoreColumnIDs,
+	} {
+		for _, id := range ids {
+			indexed[id] = struct{}{}
+		}
+	}
+	for i, c := range n.cols {
+		if _, ok := indexed[c.ID]; n.valNeededForCol[i] && !ok {
+			return false
+		}
+	}
+	return true
+}
+
 func (dsp *distSQLPlanner) createPlanForJoin(
 	planCtx *planningCtx, n *joinNode,
 ) (physicalPlan, error) {
@@ -1482,6 +2093,17 @@ func (dsp *distSQLPlanner) createPlanForJoin(
 	//    joiner.
 	//
 	//  - The routers of the joiner processors are the result routers of the plan.
+	//
+	// Joins between a table and a table interleaved in it, and joins with a
+	// selective input which can be planned as index lookups are planned
+	// separately, see createPlanForInterleavedJoin and createPlanForLookupJoin.
+
+	if p, ok, err := dsp.createPlanForInterleavedJoin(planCtx, n); ok || err != nil {
+		return p, err
+	}
+	if p, ok, err := dsp.createPlanForLookupJoin(planCtx, n); ok || err != nil {
+		return p, err
+	}
 
 	leftPlan, err := dsp.createPlanForNode(planCtx, n.left.plan)
 	if err != nil {
@@ -1498,18 +2120,14 @@ func (dsp *distSQLPlanner) createPlanForJoin(
 		&leftPlan.PhysicalPlan, &rightPlan.PhysicalPlan,
 	)
 
-	joinToStreamColMap := makePlanToStreamColMap(len(n.columns))
-
 	// Nodes where we will run the join processors.
 	var nodes []roachpb.NodeID
 
 	// We initialize these properties of the joiner. They will then be used to
 	// fill in the processor spec. See descriptions for HashJoinerSpec.
 	var joinType distsqlrun.JoinType
-	var onExpr distsqlrun.Expression
 	var leftEqCols, rightEqCols []uint32
 	var leftMergeOrd, rightMergeOrd distsqlrun.Ordering
-	var mergedColumns bool
 
 	switch n.joinType {
 	case joinTypeInner:
@@ -1595,87 +2213,9 @@ func (dsp *distSQLPlanner) createPlanForJoin(
 		}
 	}
 
-	post := distsqlrun.PostProcessSpec{
-		Projection: true,
-	}
-	// addOutCol appends to post.OutputColumns and returns the index
-	// in the slice of the added column.
-	addOutCol := func(col uint32) int {
-		idx := len(post.OutputColumns)
-		post.OutputColumns = append(post.OutputColumns, col)
-		return idx
-	}
-
-	// The join columns are in three groups:
-	//  - numMergedEqualityColumns "merged" columns (corresponding to the equality columns)
-	//  - the columns on the left side (numLeftCols)
-	//  - the columns on the right side (numRightCols)
-	joinCol := 0
-
-	// In case of INNER joins there is no need there is no need for merged columns;
-	// the left equality columns are used instead.
-	// In case of OUTER joins we add extra `mergedColNum` columns and they
-	// occupy first positions in a row. Remaining left and right columns will
-	// have a corresponding "offset"
-	var mergedColNum int
-	if n.joinType == joinTypeInner {
-		mergedColNum = 0
-	} else {
-		mergedColNum = n.pred.numMergedEqualityColumns
-	}
-	for i := 0; i < n.pred.numMergedEqualityColumns; i++ {
-		if !n.columns[joinCol].Omitted {
-			if mergedColNum != 0 {
-				// Reserve place for new merged columns
-				joinToStreamColMap[joinCol] = addOutCol(uint32(i))
-			} else {
-				// For inner joins, merged columns are always equivalent to the left columns)
-				joinToStreamColMap[joinCol] = addOutCol(leftEqCols[i])
-			}
-		}
-		joinCol++
-	}
-
-	for i := 0; i < n.pred.numLeftCols; i++ {
-		if !n.columns[joinCol].Omitted {
-			joinToStreamColMap[joinCol] = addOutCol(
-				uint32(mergedColNum + leftPlan.planToStreamColMap[i]))
-		}
-		joinCol++
-	}
-	for i := 0; i < n.pred.numRightCols; i++ {
-		if !n.columns[joinCol].Omitted {
-			joinToStreamColMap[joinCol] = addOutCol(
-				uint32(mergedColNum + rightPlan.planToStreamColMap[i] + len(leftTypes)),
-			)
-		}
-		joinCol++
-	}
-	if mergedColNum != 0 {
-		if mergedColNum != len(leftEqCols) {
-			panic("merged columns number is different from equality columns")
-		}
-		mergedColumns = true
-	}
-
-	if n.pred.onCond != nil {
-		// We have to remap ordinal references in the on condition (which refer to
-		// the join columns as described above) to values that make sense in the
-		// joiner (0 to N-1 for the left input columns, N to N+M-1 for the right
-		// input columns).
-		joinColMap := make([]int, 0, len(n.columns))
-		// There should be no merged columns when ON clause is present
-		if n.pred.numMergedEqualityColumns != 0 {
-			panic("merged columns with ON condition")
-		}
-		for i := 0; i < n.pred.numLeftCols; i++ {
-			joinColMap = append(joinColMap, mergedColNum+leftPlan.planToStreamColMap[i])
-		}
-		for i := 0; i < n.pred.numRightCols; i++ {
-			joinColMap = append(joinColMap, mergedColNum+rightPlan.planToStreamColMap[i]+len(leftTypes))
-		}
-		onExpr = distsqlplan.MakeExpression(n.pred.onCond, joinColMap)
-	}
+	post, joinToStreamColMap, onExpr, mergedColumns := joinPostAndOnExpr(
+		n, n.pred.onCond, leftEqCols, leftPlan.planToStreamColMap, rightPlan.planToStreamColMap, len(leftTypes),
+	)
 
 	// Create the Core spec.
 	var core distsqlrun.ProcessorCoreUnion
@@ -1770,6 +2310,15 @@ func (dsp *distSQLPlanner) createPlanForJoin(
 		p.ResultRouters = append(p.ResultRouters, pIdx)
 	}
 
+	if core.HashJoiner != nil && len(nodes) == 1 && dsp.st.PlanRuntimeFilters.Get() {
+		addRuntimeFilter(
+			&p, pIdxStart,
+			[2][]distsqlplan.ProcessorIdx{leftRouters, rightRouters},
+			[2][]uint32{leftEqCols, rightEqCols},
+			[2][]sqlbase.ColumnType{leftTypes, rightTypes},
+		)
+	}
+
 	p.planToStreamColMap = joinToStreamColMap
 	p.ResultTypes = getTypesForPlanResult(n, joinToStreamColMap)
 
@@ -1780,6 +2329,92 @@ func (dsp *distSQLPlanner) createPlanForJoin(
 	return p, nil
 }
 
+// addRuntimeFilter sets up a run-time filter (see
+// distsqlrun.RuntimeFilterSpec) from the hash joiner with the given index to
+// the table readers of one of its inputs, if possible. The inputs are given
+// by the result routers of their plans, with their equality columns and
+// types, left then right.
+//
+// The filter is shared through the flow, so the table readers must be on the
+// node of the joiner and feed it directly. The rows they skip must not
+// otherwise affect the results, so the table readers can't have a limit and
+// the join must not emit the unmatched rows of their side. The left side is
+// preferred, since the hash joiner stores the right side unless the left side
+// is small.
+func addRuntimeFilter(
+	p *physicalPlan,
+	joinerIdx distsqlplan.ProcessorIdx,
+	routers [2][]distsqlplan.ProcessorIdx,
+	eqCols [2][]uint32,
+	types [2][]sqlbase.ColumnType,
+) {
+	if len(eqCols[0]) == 0 {
+		return
+	}
+	joiner := &p.Processors[joinerIdx]
+	spec := joiner.Spec.Core.HashJoiner
+	// The values of the equality columns must have the same encodings on both
+	// sides.
+	for i := range eqCols[0] {
+		leftType := types[0][eqCols[0][i]].ToDatumType()
+		rightType := types[1][eqCols[1][i]].ToDatumType()
+		if !leftType.Equivalent(rightType) {
+			return
+		}
+	}
+
+	for side := 0; side < 2; side++ {
+		switch spec.Type {
+		case distsqlrun.JoinType_INNER:
+		case distsqlrun.JoinType_LEFT_OUTER:
+			if side == 0 {
+				continue
+			}
+		case distsqlrun.JoinType_RIGHT_OUTER:
+			if side == 1 {
+				continue
+			}
+		default:
+			continue
+		}
+
+		// Map the equality columns to columns of the table of each table
+		// reader.
+		filterCols := make([][]uint32, len(routers[side]))
+		for i, pIdx := range routers[side] {
+			proc := &p.Processors[pIdx]
+			post := &proc.Spec.Post
+			if proc.Node != joiner.Node || proc.Spec.Core.TableReader == nil ||
+				post.Limit != 0 || post.Offset != 0 || len(post.RenderExprs) != 0 {
+				filterCols = nil
+				break
+			}
+			filterCols[i] = make([]uint32, len(eqCols[side]))
+			for j, c := range eqCols[side] {
+				if post.Projection {
+					c = post.OutputColumns[c]
+				}
+				filterCols[i][j] = c
+			}
+		}
+		if filterCols == nil {
+			continue
+		}
+
+		// The IDs of the filters only need to be unique within the flow.
+		id := uint32(joinerIdx) + 1
+		spec.RuntimeFilterID = id
+		spec.RuntimeFilterLeft = side == 1
+		for i, pIdx := range routers[side] {
+			p.Processors[pIdx].Spec.Core.TableReader.RuntimeFilter = &distsqlrun.RuntimeFilterSpec{
+				ID:      id,
+				Columns: filterCols[i],
+			}
+		}
+		return
+	}
+}
+
 func (dsp *distSQLPlanner) createPlanForNode(
 	planCtx *planningCtx, node planNode,
 ) (physicalPlan, error) {
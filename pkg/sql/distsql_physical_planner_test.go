@@ -29,9 +29,11 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/gossip"
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/kv"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/rpc"
 	"github.com/cockroachdb/cockroach/pkg/security"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/distsqlplan"
@@ -42,8 +44,10 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
 	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
 )
@@ -630,6 +634,9 @@ func TestPartitionSpans(t *testing.T) {
 	testCases := []struct {
 		ranges    []testSpanResolverRange
 		deadNodes []int
+		// incompatibleNodes advertise a DistSQL version which doesn't accept the
+		// flows of the gateway.
+		incompatibleNodes []int
 
 		gatewayNode int
 
@@ -717,6 +724,18 @@ func TestPartitionSpans(t *testing.T) {
 				3: {{"A1", "B"}, {"C", "C1"}, {"D1", "X"}},
 			},
 		},
+
+		{
+			ranges:            []testSpanResolverRange{{"A", 1}, {"B", 2}, {"C", 1}, {"D", 3}},
+			incompatibleNodes: []int{2, 3},
+			gatewayNode:       1,
+
+			spans: [][2]string{{"A1", "C1"}, {"D1", "X"}},
+
+			partitions: map[int][][2]string{
+				1: {{"A1", "C1"}, {"D1", "X"}},
+			},
+		},
 	}
 
 	for testIdx, tc := range testCases {
@@ -735,11 +754,41 @@ func TestPartitionSpans(t *testing.T) {
 			}
 			tsp.ranges = tc.ranges
 
+			st := cluster.MakeTestingClusterSettings()
+			rpcContext := rpc.NewContext(
+				log.AmbientContext{Tracer: st.Tracer},
+				&base.Config{Insecure: true},
+				hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+				stopper,
+			)
+			g := gossip.NewTest(
+				roachpb.NodeID(tc.gatewayNode), rpcContext, rpc.NewServer(rpcContext), stopper,
+				metric.NewRegistry(),
+			)
+			for _, n := range tsp.nodes {
+				info := distsqlrun.DistSQLVersionGossipInfo{
+					Version:            distsqlrun.Version,
+					MinAcceptedVersion: distsqlrun.MinAcceptedVersion,
+				}
+				for _, i := range tc.incompatibleNodes {
+					if int(n.NodeID) == i {
+						info.MinAcceptedVersion = distsqlrun.Version + 1
+						info.Version = distsqlrun.Version + 1
+					}
+				}
+				if err := g.AddInfoProto(
+					gossip.MakeDistSQLNodeVersionKey(n.NodeID), &info, 0, /* ttl */
+				); err != nil {
+					t.Fatal(err)
+				}
+			}
+
 			dsp := distSQLPlanner{
-				st:           cluster.MakeTestingClusterSettings(),
+				st:           st,
 				nodeDesc:     *tsp.nodes[tc.gatewayNode-1],
 				stopper:      stopper,
 				spanResolver: tsp,
+				gossip:       g,
 				testingKnobs: DistSQLPlannerTestingKnobs{
 					OverrideHealthCheck: func(node roachpb.NodeID, addr string) error {
 						for _, n := range tc.deadNodes {
@@ -781,3 +830,162 @@ func TestPartitionSpans(t *testing.T) {
 		})
 	}
 }
+
+func TestAddRuntimeFilter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	intType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	floatType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_FLOAT}
+	tableReader := func(node roachpb.NodeID, post distsqlrun.PostProcessSpec) distsqlplan.Processor {
+		return distsqlplan.Processor{
+			Node: node,
+			Spec: distsqlrun.ProcessorSpec{
+				Core: distsqlrun.ProcessorCoreUnion{TableReader: &distsqlrun.TableReaderSpec{}},
+				Post: post,
+			},
+		}
+	}
+	projection := distsqlrun.PostProcessSpec{Projection: true, OutputColumns: []uint32{2, 0}}
+
+	testCases := []struct {
+		name       string
+		joinType   distsqlrun.JoinType
+		left       distsqlplan.Processor
+		right      distsqlplan.Processor
+		rightTypes []sqlbase.ColumnType
+		// filtered is the side whose table reader applies the filter: 0 for the
+		// left side, 1 for the right side, or -1 for none.
+		filtered   int
+		filterCols []uint32
+	}{
+		{
+			name:     "inner",
+			joinType: distsqlrun.JoinType_INNER,
+			left:     tableReader(1, projection),
+			right:    tableReader(1, distsqlrun.PostProcessSpec{}),
+			filtered: 0, filterCols: []uint32{0},
+		},
+		{
+			name:     "left outer",
+			joinType: distsqlrun.JoinType_LEFT_OUTER,
+			left:     tableReader(1, projection),
+			right:    tableReader(1, distsqlrun.PostProcessSpec{}),
+			filtered: 1, filterCols: []uint32{1},
+		},
+		{
+			name:     "full outer",
+			joinType: distsqlrun.JoinType_FULL_OUTER,
+			left:     tableReader(1, projection),
+			right:    tableReader(1, distsqlrun.PostProcessSpec{}),
+			filtered: -1,
+		},
+		{
+			name:     "remote left",
+			joinType: distsqlrun.JoinType_INNER,
+			left:     tableReader(2, projection),
+			right:    tableReader(1, distsqlrun.PostProcessSpec{}),
+			filtered: 1, filterCols: []uint32{1},
+		},
+		{
+			name:     "limit",
+			joinType: distsqlrun.JoinType_INNER,
+			left:     tableReader(1, distsqlrun.PostProcessSpec{Limit: 10}),
+			right:    tableReader(1, distsqlrun.PostProcessSpec{Offset: 10}),
+			filtered: -1,
+		},
+		{
+			name:       "mismatched types",
+			joinType:   distsqlrun.JoinType_INNER,
+			left:       tableReader(1, projection),
+			right:      tableReader(1, distsqlrun.PostProcessSpec{}),
+			rightTypes: []sqlbase.ColumnType{intType, floatType},
+			filtered:   -1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var p physicalPlan
+			p.Processors = []distsqlplan.Processor{
+				tc.left,
+				tc.right,
+				{
+					Node: 1,
+					Spec: distsqlrun.ProcessorSpec{Core: distsqlrun.ProcessorCoreUnion{
+						HashJoiner: &distsqlrun.HashJoinerSpec{Type: tc.joinType},
+					}},
+				},
+			}
+			rightTypes := tc.rightTypes
+			if rightTypes == nil {
+				rightTypes = []sqlbase.ColumnType{intType, intType}
+			}
+			addRuntimeFilter(
+				&p, 2, /* joinerIdx */
+				[2][]distsqlplan.ProcessorIdx{{0}, {1}},
+				[2][]uint32{{1}, {1}},
+				[2][]sqlbase.ColumnType{{intType, intType}, rightTypes},
+			)
+
+			joiner := p.Processors[2].Spec.Core.HashJoiner
+			for side := 0; side < 2; side++ {
+				filter := p.Processors[side].Spec.Core.TableReader.RuntimeFilter
+				if side != tc.filtered {
+					if filter != nil {
+						t.Errorf("unexpected run-time filter on side %d: %+v", side, filter)
+					}
+					continue
+				}
+				expected := &distsqlrun.RuntimeFilterSpec{ID: 3, Columns: tc.filterCols}
+				if !reflect.DeepEqual(filter, expected) {
+					t.Errorf("expected run-time filter %+v on side %d, got %+v", expected, side, filter)
+				}
+				if joiner.RuntimeFilterID != 3 || joiner.RuntimeFilterLeft != (side == 1) {
+					t.Errorf("unexpected hash joiner run-time filter %d (left: %t)",
+						joiner.RuntimeFilterID, joiner.RuntimeFilterLeft)
+				}
+			}
+			if tc.filtered == -1 && joiner.RuntimeFilterID != 0 {
+				t.Errorf("unexpected hash joiner run-time filter %d", joiner.RuntimeFilterID)
+			}
+		})
+	}
+}
+
+func TestSplitQueryMemoryBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	makeFlows := func(numProcessors ...int) map[roachpb.NodeID]distsqlrun.FlowSpec {
+		flows := make(map[roachpb.NodeID]distsqlrun.FlowSpec)
+		for i, n := range numProcessors {
+			flows[roachpb.NodeID(i+1)] = distsqlrun.FlowSpec{
+				Processors: make([]distsqlrun.ProcessorSpec, n),
+			}
+		}
+		return flows
+	}
+
+	testCases := []struct {
+		budget        int64
+		numProcessors []int
+		expected      []int64
+	}{
+		{budget: 0, numProcessors: []int{1, 2}, expected: []int64{0, 0}},
+		{budget: 1000, numProcessors: []int{1}, expected: []int64{1000}},
+		{budget: 1000, numProcessors: []int{1, 3}, expected: []int64{250, 750}},
+		{budget: 1000, numProcessors: []int{2, 1, 1}, expected: []int64{500, 250, 250}},
+		{budget: 100, numProcessors: []int{1, 1, 1}, expected: []int64{33, 33, 33}},
+		{budget: 2, numProcessors: []int{1, 2}, expected: []int64{1, 1}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%d/%v", tc.budget, tc.numProcessors), func(t *testing.T) {
+			flows := makeFlows(tc.numProcessors...)
+			splitQueryMemoryBudget(tc.budget, flows)
+			for i, expected := range tc.expected {
+				if budget := flows[roachpb.NodeID(i+1)].MemoryBudget; budget != expected {
+					t.Errorf("flow %d: expected a budget of %d, got %d", i+1, expected, budget)
+				}
+			}
+		})
+	}
+}
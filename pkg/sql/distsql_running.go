@@ -15,11 +15,15 @@
 package sql
 
 import (
+	"sync"
+	"time"
+
 	"golang.org/x/net/context"
 
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 
+	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/kv"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
@@ -28,6 +32,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 )
@@ -37,6 +42,22 @@ import (
 // multiple queries.
 const numRunners = 16
 
+// maxConcurrentFlowSetups is the maximum number of SetupFlow RPCs that a query
+// has in flight at any time.
+const maxConcurrentFlowSetups = 8
+
+// setupFlowsTimeout is the timeout for setting up all the remote flows of a
+// query. It is a variable so that tests can lower it.
+var setupFlowsTimeout = 30 * time.Second
+
+// cancelFlowsTimeout is the timeout of the CancelFlows RPCs sent to the nodes
+// running the flows of a canceled query.
+const cancelFlowsTimeout = 5 * time.Second
+
+// maxFlowSetupRetries is the maximum number of times a query is planned again
+// when nodes reject its flows because they are draining.
+const maxFlowSetupRetries = 3
+
 // runnerRequest is the request that is sent (via a channel) to a worker.
 type runnerRequest struct {
 	ctx         context.Context
@@ -62,7 +83,6 @@ func (req runnerRequest) run() {
 		res.err = err
 	} else {
 		client := distsqlrun.NewDistSQLClient(conn)
-		// TODO(radu): do we want a timeout here?
 		resp, err := client.SetupFlow(req.ctx, req.flowReq)
 		if err != nil {
 			res.err = err
@@ -73,6 +93,70 @@ func (req runnerRequest) run() {
 	req.resultChan <- res
 }
 
+// cancelFlowsOnQueryCancellation cancels the flows with the given ID on the
+// given nodes if ctx is canceled before queryDone is closed. Without it, remote
+// flows of a canceled query would only find out when they next push rows to
+// the gateway, and would keep reading until then.
+func (dsp *distSQLPlanner) cancelFlowsOnQueryCancellation(
+	ctx context.Context,
+	flowID distsqlrun.FlowID,
+	nodeAddresses map[roachpb.NodeID]string,
+	queryDone <-chan struct{},
+) {
+	// The RPCs can't use ctx, which is canceled by the time they're sent.
+	taskCtx := dsp.distSQLSrv.AnnotateCtx(context.Background())
+	taskCtx = log.WithLogTagStr(taskCtx, "f", flowID.Short())
+	if err := dsp.stopper.RunAsyncTask(taskCtx, "distsql: cancel flows", func(taskCtx context.Context) {
+		select {
+		case <-ctx.Done():
+		case <-queryDone:
+			return
+		case <-dsp.stopper.ShouldQuiesce():
+			return
+		}
+		log.VEventf(taskCtx, 1, "query canceled; canceling flows on %d nodes", len(nodeAddresses))
+		dsp.cancelRemoteFlows(taskCtx, flowID, nodeAddresses)
+	}); err != nil {
+		log.Warningf(taskCtx, "unable to watch for query cancellation: %s", err)
+	}
+}
+
+// cancelRemoteFlows cancels the flows with the given ID on the given nodes,
+// and waits for the CancelFlows RPCs to complete. Errors are only logged.
+func (dsp *distSQLPlanner) cancelRemoteFlows(
+	ctx context.Context, flowID distsqlrun.FlowID, nodeAddresses map[roachpb.NodeID]string,
+) {
+	req := &distsqlrun.CancelFlowsRequest{FlowIDs: []distsqlrun.FlowID{flowID}}
+	var wg sync.WaitGroup
+	for nodeID, addr := range nodeAddresses {
+		wg.Add(1)
+		go func(nodeID roachpb.NodeID, addr string) {
+			defer wg.Done()
+			if err := dsp.cancelFlows(ctx, addr, req); err != nil {
+				log.Warningf(ctx, "error canceling flows on node %d: %s", nodeID, err)
+			}
+		}(nodeID, addr)
+	}
+	wg.Wait()
+}
+
+// cancelFlows sends a CancelFlows RPC to the node with the given address.
+func (dsp *distSQLPlanner) cancelFlows(
+	ctx context.Context, addr string, req *distsqlrun.CancelFlowsRequest,
+) error {
+	conn, err := dsp.rpcContext.GRPCDial(addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, cancelFlowsTimeout)
+	defer cancel()
+	resp, err := distsqlrun.NewDistSQLClient(conn).CancelFlows(ctx, req)
+	if err != nil {
+		return err
+	}
+	return resp.Error.ErrorDetail()
+}
+
 func (dsp *distSQLPlanner) initRunners() {
 	// This channel has to be unbuffered because we want to only be able to send
 	// requests if a worker is actually there to receive them.
@@ -94,6 +178,31 @@ func (dsp *distSQLPlanner) initRunners() {
 	}
 }
 
+// splitQueryMemoryBudget divides the memory budget of a query among its
+// flows, in proportion to their number of processors. Each node limits the
+// memory of its flow to its share, so the flows of the query as a whole can't
+// use more than the budget. A budget of 0 means that the query is not limited.
+func splitQueryMemoryBudget(budget int64, flows map[roachpb.NodeID]distsqlrun.FlowSpec) {
+	if budget <= 0 {
+		return
+	}
+	var numProcessors int64
+	for _, flow := range flows {
+		numProcessors += int64(len(flow.Processors))
+	}
+	if numProcessors == 0 {
+		return
+	}
+	for nodeID, flow := range flows {
+		flow.MemoryBudget = budget / numProcessors * int64(len(flow.Processors))
+		if flow.MemoryBudget == 0 {
+			// A flow's budget of 0 means that it is not limited.
+			flow.MemoryBudget = 1
+		}
+		flows[nodeID] = flow
+	}
+}
+
 // Run executes a physical plan. The plan should have been finalized using
 // FinalizePlan.
 //
@@ -109,6 +218,47 @@ func (dsp *distSQLPlanner) Run(
 	ctx := planCtx.ctx
 
 	flows := plan.GenerateFlowSpecs()
+	// Compressed streams require a protocol version which older nodes don't
+	// accept, so the newer version is only used when the streams are
+	// compressed and all the nodes involved accept it; otherwise we fall back
+	// to the older encoding.
+	version := uint32(distsqlrun.MinAcceptedVersion)
+	compression := distsqlrun.StreamCompression_UNCOMPRESSED
+	if len(flows) > 1 && dsp.st.StreamCompression.Get() {
+		accepted := true
+		for nodeID := range flows {
+			if nodeID != dsp.nodeDesc.NodeID &&
+				!dsp.nodeVersionIsCompatible(nodeID, distsqlrun.Version) {
+				accepted = false
+				break
+			}
+		}
+		if accepted {
+			version = distsqlrun.Version
+			compression = distsqlrun.StreamCompression_SNAPPY
+		}
+	}
+	// The processors send their execution statistics if the query is traced.
+	collectStats := false
+	if sp := opentracing.SpanFromContext(ctx); sp != nil && tracing.IsRecording(sp) {
+		collectStats = true
+	}
+	bufSize := uint32(dsp.st.RowChannelBufSize.Get())
+	workMem := recv.workMem
+	if workMem == 0 {
+		workMem = dsp.st.DistSQLWorkMem.Get()
+	}
+	for nodeID, flow := range flows {
+		flow.RowChannelBufSize = bufSize
+		flow.WorkMem = workMem
+		flow.StreamCompression = compression
+		flow.CollectStats = collectStats
+		for i := range flow.Processors {
+			flow.Processors[i].Version = version
+		}
+		flows[nodeID] = flow
+	}
+	splitQueryMemoryBudget(dsp.st.QueryMemoryLimit.Get(), flows)
 
 	if logPlanDiagram {
 		log.VEvent(ctx, 1, "creating plan diagram")
@@ -134,72 +284,157 @@ func (dsp *distSQLPlanner) Run(
 		evalCtxProto.SearchPath = append(evalCtxProto.SearchPath, s)
 	}
 
+	// The flows read through leaf txns, which bypass the TxnCoordSender. Their
+	// reads are merged back into the root txn when they are done, except on
+	// older nodes which don't send them; the reads of the txn can't be
+	// refreshed if any of the flows runs on such a node.
+	for nodeID := range flows {
+		if nodeID != thisNodeID && !dsp.nodeVersionIsCompatible(nodeID, distsqlrun.LeafTxnReadsVersion) {
+			txn.DisableReadRefresh()
+			break
+		}
+	}
+
 	// Start all the flows except the flow on this node (there is always a flow on
 	// this node).
-	var resultChan chan runnerResult
+	if err := dsp.setupRemoteFlows(planCtx, txn, flows, version, evalCtxProto); err != nil {
+		return err
+	}
+
+	var remoteNodes map[roachpb.NodeID]string
 	if len(flows) > 1 {
-		resultChan = make(chan runnerResult, len(flows)-1)
+		remoteNodes = make(map[roachpb.NodeID]string, len(flows)-1)
+		for nodeID := range flows {
+			if nodeID != thisNodeID {
+				remoteNodes[nodeID] = planCtx.nodeAddresses[nodeID]
+			}
+		}
+		queryDone := make(chan struct{})
+		defer close(queryDone)
+		dsp.cancelFlowsOnQueryCancellation(ctx, flows[thisNodeID].FlowID, remoteNodes, queryDone)
+	}
+
+	// Set up the flow on this node.
+	localReq := distsqlrun.SetupFlowRequest{
+		Version:     version,
+		Txn:         *txn.Proto(),
+		Flow:        flows[thisNodeID],
+		EvalContext: evalCtxProto,
+	}
+	ctx, flow, err := dsp.distSQLSrv.SetupSyncFlow(ctx, &localReq, recv)
+	if err != nil {
+		// The remote flows would otherwise wait for their streams to this flow
+		// to time out.
+		dsp.cancelRemoteFlows(
+			dsp.distSQLSrv.AnnotateCtx(context.Background()), localReq.Flow.FlowID, remoteNodes,
+		)
+		return err
+	}
+	// TODO(radu): this should go through the flow scheduler.
+	flow.Start(ctx, func() {})
+	flow.Wait()
+	flow.Cleanup(ctx)
+
+	return nil
+}
+
+// setupRemoteFlows sets up the flows of all the nodes except this one, and
+// waits for them to be scheduled (but not to complete). At most
+// maxConcurrentFlowSetups SetupFlow RPCs are in flight at any time, and the
+// whole setup is bounded by setupFlowsTimeout.
+//
+// If any flow fails to be set up, the remaining flows are not set up and the
+// flows which were (or might have been) set up are canceled, so that they
+// don't wait for the flow on this node, which won't run.
+func (dsp *distSQLPlanner) setupRemoteFlows(
+	planCtx *planningCtx,
+	txn *client.Txn,
+	flows map[roachpb.NodeID]distsqlrun.FlowSpec,
+	version uint32,
+	evalCtxProto distsqlrun.EvalContext,
+) error {
+	if len(flows) <= 1 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(planCtx.ctx, setupFlowsTimeout)
+	defer cancel()
+
+	thisNodeID := dsp.nodeDesc.NodeID
+	// The remote flows' spans are created as children of the query's span.
+	traceCtx, err := tracing.InjectSpanContext(opentracing.SpanFromContext(ctx))
+	if err != nil {
+		log.Warningf(ctx, "error injecting span context: %s", err)
 	}
+	var reqs []runnerRequest
+	resultChan := make(chan runnerResult, len(flows)-1)
 	for nodeID, flowSpec := range flows {
 		if nodeID == thisNodeID {
 			// Skip this node.
 			continue
 		}
 		req := &distsqlrun.SetupFlowRequest{
-			Version:     distsqlrun.Version,
-			Txn:         *txn.Proto(),
-			Flow:        flowSpec,
-			EvalContext: evalCtxProto,
+			Version:      version,
+			Txn:          *txn.Proto(),
+			Flow:         flowSpec,
+			EvalContext:  evalCtxProto,
+			TraceContext: traceCtx,
 		}
-		runReq := runnerRequest{
+		reqs = append(reqs, runnerRequest{
 			ctx:         ctx,
 			rpcContext:  dsp.rpcContext,
 			flowReq:     req,
 			nodeID:      nodeID,
 			nodeAddress: planCtx.nodeAddresses[nodeID],
 			resultChan:  resultChan,
-		}
-		// Send out a request to the workers; if no worker is available, run
-		// directly.
-		select {
-		case dsp.runnerChan <- runReq:
-		default:
-			runReq.run()
-		}
+		})
 	}
 
 	var firstErr error
-	// Now wait for all the flows to be scheduled on remote nodes. Note that we
-	// are not waiting for the flows themselves to complete.
-	for i := 0; i < len(flows)-1; i++ {
+	// started contains the nodes to which a SetupFlow RPC was sent.
+	started := make(map[roachpb.NodeID]string, len(reqs))
+	for next, inFlight := 0, 0; inFlight > 0 || (firstErr == nil && next < len(reqs)); {
+		for ; firstErr == nil && next < len(reqs) && inFlight < maxConcurrentFlowSetups; next++ {
+			runReq := reqs[next]
+			started[runReq.nodeID] = runReq.nodeAddress
+			inFlight++
+			// Send out a request to the workers; if no worker is available, run
+			// directly.
+			select {
+			case dsp.runnerChan <- runReq:
+			default:
+				runReq.run()
+			}
+		}
+
+		// Wait for a flow to be scheduled on its remote node. Note that we are
+		// not waiting for the flow itself to complete.
 		res := <-resultChan
+		inFlight--
+		if res.err == nil {
+			continue
+		}
 		if firstErr == nil {
 			firstErr = res.err
 		}
+		if distsqlrun.IsDrainingError(res.err) {
+			planCtx.drainingNodes = append(planCtx.drainingNodes, res.nodeID)
+		}
 		// TODO(radu): accumulate the flows that we failed to set up and move them
 		// into the local flow.
 	}
-	if firstErr != nil {
-		return firstErr
-	}
-
-	// Set up the flow on this node.
-	localReq := distsqlrun.SetupFlowRequest{
-		Version:     distsqlrun.Version,
-		Txn:         *txn.Proto(),
-		Flow:        flows[thisNodeID],
-		EvalContext: evalCtxProto,
-	}
-	ctx, flow, err := dsp.distSQLSrv.SetupSyncFlow(ctx, &localReq, recv)
-	if err != nil {
-		return err
+	if firstErr == nil {
+		return nil
 	}
-	// TODO(radu): this should go through the flow scheduler.
-	flow.Start(ctx, func() {})
-	flow.Wait()
-	flow.Cleanup(ctx)
 
-	return nil
+	// The flows which were set up would otherwise wait for their streams to
+	// the flow on this node to time out. A node whose RPC failed might still
+	// have set up its flow (e.g. if the RPC timed out), so it is included.
+	// The RPCs can't use planCtx.ctx, which might be canceled.
+	cancelCtx := dsp.distSQLSrv.AnnotateCtx(context.Background())
+	cancelCtx = log.WithLogTagStr(cancelCtx, "f", flows[thisNodeID].FlowID.Short())
+	log.VEventf(cancelCtx, 1, "failed to set up flows; canceling flows on %d nodes", len(started))
+	dsp.cancelRemoteFlows(cancelCtx, flows[thisNodeID].FlowID, started)
+	return firstErr
 }
 
 // distSQLReceiver is a RowReceiver that sends results to a StatementResultWriter.
@@ -234,13 +469,37 @@ type distSQLReceiver struct {
 
 	// The transaction in which the flow producing data for this receiver runs.
 	// The distSQLReceiver updates the TransactionProto in response to
-	// RetryableTxnError's. Nil if no transaction should be updated on errors
-	// (i.e. if the flow overall doesn't run in a transaction).
+	// RetryableTxnError's and to the state of the leaf txns used by the
+	// processors. Nil if no transaction should be updated (i.e. if the flow
+	// overall doesn't run in a transaction).
 	txn *client.Txn
 
 	// A handler for clock signals arriving from remote nodes. This should update
 	// this node's clock.
 	updateClock func(observedTs hlc.Timestamp)
+
+	// stats accumulates the execution statistics sent by the processors of the
+	// flows, if they collect them.
+	stats []distsqlrun.ProcessorStats
+
+	// onProgress, if set, is called with the total number of rows read from KV
+	// by the processors of the flows, and the estimated total, whenever one of
+	// them reports its progress.
+	onProgress func(rowsRead, estimatedRows int64)
+	// progress is the latest progress reported by each processor which reads
+	// from KV.
+	progress map[processorID]distsqlrun.ProcessorProgress
+
+	// workMem, if set, is the amount of memory each processor of the flows can
+	// use before falling back to temporary storage; it defaults to the
+	// sql.defaults.distsql.workmem cluster setting.
+	workMem int64
+}
+
+// processorID identifies a processor within the flows of a query.
+type processorID struct {
+	nodeID       roachpb.NodeID
+	processorIdx int32
 }
 
 // rowResultWriter is a subset of StatementResultWriter for use in the
@@ -323,6 +582,29 @@ func (r *distSQLReceiver) Push(
 				r.err = errors.Errorf("error ingesting remote spans: %s", err)
 			}
 		}
+		if meta.LeafTxn != nil && r.txn != nil {
+			// Absorb the clock observations made by the reads of the flows, so that
+			// the following reads of the txn don't needlessly get uncertainty
+			// restarts.
+			r.txn.UpdateStateOnLeafTxn(r.ctx, meta.LeafTxn)
+		}
+		if p := meta.Progress; p != nil {
+			// Surface the progress of long-running processors in the trace of the
+			// query.
+			log.VEventf(r.ctx, 2, "%s on node %d: %d rows consumed, %d bytes accumulated",
+				p.Processor, p.NodeID, p.RowsConsumed, p.BytesAccumulated)
+			if p.RowsRead > 0 && r.onProgress != nil {
+				r.updateProgress(p)
+			}
+		}
+		if s := meta.Stats; s != nil {
+			r.stats = append(r.stats, *s)
+			log.VEventf(r.ctx, 2,
+				"%s %d on node %d: %d rows in (stalled %s), %d rows out (%s, stalled %s), max memory %s",
+				s.Processor, s.ProcessorIdx, s.NodeID, s.InputRows, s.InputStallTime,
+				s.OutputRows, humanizeutil.IBytes(s.OutputBytes), s.OutputStallTime,
+				humanizeutil.IBytes(s.MaxMemory))
+		}
 		return r.status
 	}
 	if r.err != nil {
@@ -370,6 +652,26 @@ func (r *distSQLReceiver) ProducerDone() {
 	r.closed = true
 }
 
+// updateProgress records the progress of a processor which reads from KV, and
+// reports the totals over all the processors to onProgress. A processor
+// without an estimate yet counts as having read all its rows.
+func (r *distSQLReceiver) updateProgress(p *distsqlrun.ProcessorProgress) {
+	if r.progress == nil {
+		r.progress = make(map[processorID]distsqlrun.ProcessorProgress)
+	}
+	r.progress[processorID{nodeID: p.NodeID, processorIdx: p.ProcessorIdx}] = *p
+	var rowsRead, estimatedRows int64
+	for _, p := range r.progress {
+		rowsRead += p.RowsRead
+		if p.EstimatedRows > p.RowsRead {
+			estimatedRows += p.EstimatedRows
+		} else {
+			estimatedRows += p.RowsRead
+		}
+	}
+	r.onProgress(rowsRead, estimatedRows)
+}
+
 // updateCaches takes information about some ranges that were mis-planned and
 // updates the range descriptor and lease-holder caches accordingly.
 //
@@ -406,14 +708,37 @@ func (dsp *distSQLPlanner) PlanAndRun(
 	recv *distSQLReceiver,
 	evalCtx parser.EvalContext,
 ) error {
-	planCtx := dsp.NewPlanningCtx(ctx, txn)
+	// A sample of the queries, and those which are slow, are traced into the
+	// tracer's registry.
+	ctx, finishSampled := dsp.st.Tracer.StartSampledSpan(ctx, "distsql", base.SlowRequestThreshold)
+	defer finishSampled(func() string { return planToString(ctx, tree) })
+
+	// drainingNodes accumulates the nodes which rejected their flows because
+	// they are draining; they are not used when the query is planned again.
+	var drainingNodes []roachpb.NodeID
+	for attempt := 0; ; attempt++ {
+		planCtx := dsp.NewPlanningCtx(ctx, txn)
+		for _, nodeID := range drainingNodes {
+			// An empty address marks the node as unhealthy: the spans it owns
+			// are processed by the gateway.
+			planCtx.nodeAddresses[nodeID] = ""
+		}
 
-	log.VEvent(ctx, 1, "creating DistSQL plan")
+		log.VEvent(ctx, 1, "creating DistSQL plan")
 
-	plan, err := dsp.createPlanForNode(&planCtx, tree)
-	if err != nil {
-		return err
+		plan, err := dsp.createPlanForNode(&planCtx, tree)
+		if err != nil {
+			return err
+		}
+		dsp.FinalizePlan(&planCtx, &plan)
+		err = dsp.Run(&planCtx, txn, &plan, recv, evalCtx)
+		// The flows are set up before any row is produced, so the query can be
+		// planned again if some of them were rejected by draining nodes.
+		if err == nil || len(planCtx.drainingNodes) == 0 || attempt >= maxFlowSetupRetries {
+			return err
+		}
+		log.VEventf(ctx, 1, "nodes %v are draining, planning the query again: %v",
+			planCtx.drainingNodes, err)
+		drainingNodes = append(drainingNodes, planCtx.drainingNodes...)
 	}
-	dsp.FinalizePlan(&planCtx, &plan)
-	return dsp.Run(&planCtx, txn, &plan, recv, evalCtx)
 }
@@ -0,0 +1,289 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sql
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/rpc"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/distsqlrun"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/netutil"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+)
+
+// setupFlowServer is a DistSQLServer which sets up flows with the given
+// function, and records the flows canceled on it.
+type setupFlowServer struct {
+	nodeID    roachpb.NodeID
+	setupFlow func(context.Context, roachpb.NodeID) error
+
+	mu struct {
+		sync.Mutex
+		canceled []distsqlrun.FlowID
+	}
+}
+
+var _ distsqlrun.DistSQLServer = &setupFlowServer{}
+
+// SetupFlow is part of the DistSQLServer interface.
+func (s *setupFlowServer) SetupFlow(
+	ctx context.Context, _ *distsqlrun.SetupFlowRequest,
+) (*distsqlrun.SimpleResponse, error) {
+	if err := s.setupFlow(ctx, s.nodeID); err != nil {
+		return &distsqlrun.SimpleResponse{Error: distsqlrun.NewError(err)}, nil
+	}
+	return &distsqlrun.SimpleResponse{}, nil
+}
+
+// CancelFlows is part of the DistSQLServer interface.
+func (s *setupFlowServer) CancelFlows(
+	_ context.Context, req *distsqlrun.CancelFlowsRequest,
+) (*distsqlrun.SimpleResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.canceled = append(s.mu.canceled, req.FlowIDs...)
+	return &distsqlrun.SimpleResponse{}, nil
+}
+
+// canceledFlows returns the flows canceled on the server.
+func (s *setupFlowServer) canceledFlows() []distsqlrun.FlowID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]distsqlrun.FlowID(nil), s.mu.canceled...)
+}
+
+// RunSyncFlow is part of the DistSQLServer interface.
+func (s *setupFlowServer) RunSyncFlow(distsqlrun.DistSQL_RunSyncFlowServer) error {
+	return errors.New("unimplemented")
+}
+
+// FlowStream is part of the DistSQLServer interface.
+func (s *setupFlowServer) FlowStream(distsqlrun.DistSQL_FlowStreamServer) error {
+	return errors.New("unimplemented")
+}
+
+// PauseFlows is part of the DistSQLServer interface.
+func (s *setupFlowServer) PauseFlows(
+	context.Context, *distsqlrun.PauseFlowsRequest,
+) (*distsqlrun.SimpleResponse, error) {
+	return nil, errors.New("unimplemented")
+}
+
+// ResumeFlows is part of the DistSQLServer interface.
+func (s *setupFlowServer) ResumeFlows(
+	context.Context, *distsqlrun.ResumeFlowsRequest,
+) (*distsqlrun.SimpleResponse, error) {
+	return nil, errors.New("unimplemented")
+}
+
+// setupFlowsTest holds the state of a test of setupRemoteFlows: a gateway
+// (node 1) and remote nodes, each served by a setupFlowServer.
+type setupFlowsTest struct {
+	dsp     *distSQLPlanner
+	planCtx *planningCtx
+	txn     *client.Txn
+	flows   map[roachpb.NodeID]distsqlrun.FlowSpec
+	servers []*setupFlowServer
+}
+
+// makeSetupFlowsTest starts the servers of numRemoteNodes remote nodes, which
+// set up flows with the given function.
+func makeSetupFlowsTest(
+	t *testing.T,
+	stopper *stop.Stopper,
+	numRemoteNodes int,
+	setupFlow func(context.Context, roachpb.NodeID) error,
+) *setupFlowsTest {
+	st := cluster.MakeTestingClusterSettings()
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	rpcContext := rpc.NewContext(
+		log.AmbientContext{Tracer: st.Tracer}, &base.Config{Insecure: true}, clock, stopper,
+	)
+	gatewayID := roachpb.NodeID(1)
+	flowID := distsqlrun.FlowID{UUID: uuid.MakeV4()}
+	sft := &setupFlowsTest{
+		dsp: &distSQLPlanner{
+			st:         st,
+			nodeDesc:   roachpb.NodeDescriptor{NodeID: gatewayID},
+			rpcContext: rpcContext,
+			stopper:    stopper,
+			distSQLSrv: &distsqlrun.ServerImpl{
+				ServerConfig: distsqlrun.ServerConfig{
+					AmbientContext: log.AmbientContext{Tracer: st.Tracer},
+				},
+			},
+		},
+		planCtx: &planningCtx{
+			ctx:           context.Background(),
+			nodeAddresses: make(map[roachpb.NodeID]string),
+		},
+		txn: client.NewTxn(client.NewDB(client.SenderFunc(
+			func(context.Context, roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+				return nil, roachpb.NewErrorf("unexpected request")
+			}), clock)),
+		flows: map[roachpb.NodeID]distsqlrun.FlowSpec{gatewayID: {FlowID: flowID}},
+	}
+	sft.dsp.initRunners()
+
+	for i := 0; i < numRemoteNodes; i++ {
+		nodeID := gatewayID + 1 + roachpb.NodeID(i)
+		server := &setupFlowServer{nodeID: nodeID, setupFlow: setupFlow}
+		grpcServer := rpc.NewServer(rpcContext)
+		distsqlrun.RegisterDistSQLServer(grpcServer, server)
+		ln, err := netutil.ListenAndServeGRPC(stopper, grpcServer, util.IsolatedTestAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sft.servers = append(sft.servers, server)
+		sft.planCtx.nodeAddresses[nodeID] = ln.Addr().String()
+		sft.flows[nodeID] = distsqlrun.FlowSpec{FlowID: flowID}
+	}
+	return sft
+}
+
+// setupRemoteFlows runs setupRemoteFlows on the gateway.
+func (sft *setupFlowsTest) setupRemoteFlows() error {
+	return sft.dsp.setupRemoteFlows(
+		sft.planCtx, sft.txn, sft.flows, distsqlrun.Version, distsqlrun.EvalContext{},
+	)
+}
+
+// expectCanceled verifies that the flow of the query was canceled on every
+// remote node.
+func (sft *setupFlowsTest) expectCanceled(t *testing.T) {
+	flowID := sft.flows[sft.dsp.nodeDesc.NodeID].FlowID
+	for _, s := range sft.servers {
+		canceled := s.canceledFlows()
+		if len(canceled) != 1 || canceled[0] != flowID {
+			t.Errorf("node %d: expected flow %s to be canceled, got %v", s.nodeID, flowID, canceled)
+		}
+	}
+}
+
+// TestSetupRemoteFlowsConcurrency verifies that at most
+// maxConcurrentFlowSetups SetupFlow RPCs are in flight at any time.
+func TestSetupRemoteFlowsConcurrency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	const numRemoteNodes = 2*maxConcurrentFlowSetups + 1
+	setupCh := make(chan roachpb.NodeID)
+	unblockCh := make(chan struct{})
+	sft := makeSetupFlowsTest(t, stopper, numRemoteNodes,
+		func(ctx context.Context, nodeID roachpb.NodeID) error {
+			setupCh <- nodeID
+			<-unblockCh
+			return nil
+		})
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- sft.setupRemoteFlows() }()
+
+	// The first maxConcurrentFlowSetups RPCs block; no other RPC is sent until
+	// one of them completes.
+	for i := 0; i < maxConcurrentFlowSetups; i++ {
+		<-setupCh
+	}
+	select {
+	case nodeID := <-setupCh:
+		t.Fatalf("more than %d RPCs in flight: flow set up on node %d",
+			maxConcurrentFlowSetups, nodeID)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Once one RPC completes, another one is sent.
+	unblockCh <- struct{}{}
+	<-setupCh
+	close(unblockCh)
+	for i := maxConcurrentFlowSetups + 1; i < numRemoteNodes; i++ {
+		<-setupCh
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sft.servers {
+		if canceled := s.canceledFlows(); len(canceled) != 0 {
+			t.Errorf("node %d: expected no flow to be canceled, got %v", s.nodeID, canceled)
+		}
+	}
+}
+
+// TestSetupRemoteFlowsTimeout verifies that setting up the remote flows is
+// bounded by setupFlowsTimeout, and that the flows are canceled when it
+// expires.
+func TestSetupRemoteFlowsTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	defer func(timeout time.Duration) { setupFlowsTimeout = timeout }(setupFlowsTimeout)
+	setupFlowsTimeout = 10 * time.Millisecond
+
+	sft := makeSetupFlowsTest(t, stopper, 3, /* numRemoteNodes */
+		func(ctx context.Context, _ roachpb.NodeID) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	if err := sft.setupRemoteFlows(); !testutils.IsError(err, "deadline exceeded") {
+		t.Fatalf("expected deadline exceeded error, got %v", err)
+	}
+	sft.expectCanceled(t)
+}
+
+// TestSetupRemoteFlowsCancelsStartedFlows verifies that when a flow fails to
+// be set up, no further flow is set up, and the flows on all the nodes which
+// were contacted are canceled, including those which were set up before the
+// failure.
+func TestSetupRemoteFlowsCancelsStartedFlows(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	// The RPCs are all sent at once, and fail on one node only once they were
+	// all received.
+	const numRemoteNodes = maxConcurrentFlowSetups
+	var received sync.WaitGroup
+	received.Add(numRemoteNodes)
+	failingNode := roachpb.NodeID(3)
+	sft := makeSetupFlowsTest(t, stopper, numRemoteNodes,
+		func(ctx context.Context, nodeID roachpb.NodeID) error {
+			received.Done()
+			if nodeID != failingNode {
+				return nil
+			}
+			received.Wait()
+			return errors.New("injected setup error")
+		})
+	if err := sft.setupRemoteFlows(); !testutils.IsError(err, "injected setup error") {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	sft.expectCanceled(t)
+}
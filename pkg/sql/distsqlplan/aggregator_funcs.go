@@ -35,11 +35,14 @@ import (
 // A less trivial example is COUNT: the local stage counts (COUNT), the final stage
 // adds the counts (SUM_INT).
 //
-// A more complex example is AVG, for which we have to do *multiple*
-// aggregations in each stage: we need to get a sum and a count, so the local
-// stage does SUM and COUNT, and the final stage does SUM and SUM_INT. We also
-// need an expression that takes these two values and generates the final AVG
-// result.
+// A more complex example is AVG, for which each local stage needs to produce
+// both a sum and a count: the local stage (AVG_STATE) produces a transition
+// state holding both, and the final stage (AVG_MERGE) combines the states and
+// divides the total sum by the total count.
+//
+// Aggregations can also be planned as *multiple* aggregations in each stage,
+// along with an expression that takes the final stage results and generates
+// the final result (see FinalRendering).
 type DistAggregationInfo struct {
 	// The local stage consists of one or more aggregations. All aggregations have
 	// the same input.
@@ -58,7 +61,7 @@ type DistAggregationInfo struct {
 	// final stage processor.  However, there are some complications:
 	//   - this structure is a blueprint for aggregating inputs of different
 	//     types, and in some cases the expression may be different depending on
-	//     the types (see AVG below).
+	//     the types.
 	//   - we support combining multiple "top level" aggregations into the same
 	//     processors, so the correct indexing of the input variables is not
 	//     predetermined.
@@ -78,6 +81,11 @@ var DistAggregationTable = map[distsqlrun.AggregatorSpec_Func]DistAggregationInf
 		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_IDENT},
 	},
 
+	distsqlrun.AggregatorSpec_ANY_VALUE: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_ANY_VALUE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_ANY_VALUE},
+	},
+
 	distsqlrun.AggregatorSpec_BOOL_AND: {
 		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_BOOL_AND},
 		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_BOOL_AND},
@@ -118,43 +126,120 @@ var DistAggregationTable = map[distsqlrun.AggregatorSpec_Func]DistAggregationInf
 		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_XOR_AGG},
 	},
 
-	// AVG is more tricky than the ones above; we need two intermediate values in
-	// the local and final stages:
-	//  - the local stage accumulates the SUM and the COUNT;
-	//  - the final stage sums these partial results (SUM and SUM_INT);
-	//  - a final rendering then divides the two results.
-	//
-	// At a high level, this is analogous to rewriting AVG(x) as SUM(x)/COUNT(x).
-	distsqlrun.AggregatorSpec_AVG: {
+	// The local stage of APPROX_COUNT_DISTINCT builds a HyperLogLog sketch of
+	// its input; the final stage merges these sketches and estimates the
+	// distinct count of their union. Merging sketches is lossless, so the result
+	// doesn't depend on how the input is partitioned.
+	distsqlrun.AggregatorSpec_APPROX_COUNT_DISTINCT: {
 		LocalStage: []distsqlrun.AggregatorSpec_Func{
-			distsqlrun.AggregatorSpec_SUM,
-			distsqlrun.AggregatorSpec_COUNT,
+			distsqlrun.AggregatorSpec_APPROX_COUNT_DISTINCT_SKETCH,
 		},
 		FinalStage: []distsqlrun.AggregatorSpec_Func{
-			distsqlrun.AggregatorSpec_SUM,
-			distsqlrun.AggregatorSpec_SUM_INT,
+			distsqlrun.AggregatorSpec_APPROX_COUNT_DISTINCT_MERGE,
+		},
+	},
+
+	// The local stage of MEDIAN builds a t-digest of its input; the final stage
+	// merges these digests and estimates the median of their union.
+	distsqlrun.AggregatorSpec_MEDIAN: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_PERCENTILE_SKETCH},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_MEDIAN_MERGE},
+	},
+
+	// The sketches built by COUNT_MIN_SKETCH are merged losslessly by adding
+	// their counters.
+	distsqlrun.AggregatorSpec_COUNT_MIN_SKETCH: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_COUNT_MIN_SKETCH},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{
+			distsqlrun.AggregatorSpec_COUNT_MIN_SKETCH_MERGE,
 		},
-		FinalRendering: func(h *parser.IndexedVarHelper, varIdxOffset int) (parser.TypedExpr, error) {
-			sum := h.IndexedVar(varIdxOffset)
-			count := h.IndexedVar(varIdxOffset + 1)
-
-			expr := &parser.BinaryExpr{
-				Operator: parser.Div,
-				Left:     sum,
-				Right:    count,
-			}
-
-			// There is no "FLOAT / INT" operator; cast the denominator to float in
-			// this case. Note that there is a "DECIMAL / INT" operator, so we don't
-			// need the same handling for that case.
-			if sum.ResolvedType().Equivalent(parser.TypeFloat) {
-				expr.Right = &parser.CastExpr{
-					Expr: count,
-					Type: parser.NewFloatColType(0 /* prec */, false /* precSpecified */),
-				}
-			}
-			return expr.TypeCheck(nil, parser.TypeAny)
+	},
+
+	// The local stage of EQUIDEPTH_HISTOGRAM builds a t-digest of its input,
+	// prefixed with the number of buckets; the final stage merges the digests
+	// and estimates the boundaries of the buckets.
+	distsqlrun.AggregatorSpec_EQUIDEPTH_HISTOGRAM: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{
+			distsqlrun.AggregatorSpec_EQUIDEPTH_HISTOGRAM_SKETCH,
 		},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{
+			distsqlrun.AggregatorSpec_EQUIDEPTH_HISTOGRAM_MERGE,
+		},
+	},
+
+	// The two-argument statistical aggregates share their local stage, which
+	// encodes their transition state. The final stage merges these states and
+	// computes the result of each aggregate.
+	distsqlrun.AggregatorSpec_CORR: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_CORR_MERGE},
+	},
+	distsqlrun.AggregatorSpec_COVAR_POP: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_COVAR_POP_MERGE},
+	},
+	distsqlrun.AggregatorSpec_COVAR_SAMP: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_COVAR_SAMP_MERGE},
+	},
+	distsqlrun.AggregatorSpec_REGR_AVGX: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_AVGX_MERGE},
+	},
+	distsqlrun.AggregatorSpec_REGR_AVGY: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_AVGY_MERGE},
+	},
+	distsqlrun.AggregatorSpec_REGR_COUNT: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_COUNT_MERGE},
+	},
+	distsqlrun.AggregatorSpec_REGR_INTERCEPT: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_INTERCEPT_MERGE},
+	},
+	distsqlrun.AggregatorSpec_REGR_R2: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_R2_MERGE},
+	},
+	distsqlrun.AggregatorSpec_REGR_SLOPE: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_SLOPE_MERGE},
+	},
+	distsqlrun.AggregatorSpec_REGR_SXX: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_SXX_MERGE},
+	},
+	distsqlrun.AggregatorSpec_REGR_SXY: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_SXY_MERGE},
+	},
+	distsqlrun.AggregatorSpec_REGR_SYY: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_REGR_SYY_MERGE},
+	},
+
+	// AVG, VARIANCE and STDDEV need more than a single partial result from
+	// the local stage; it produces a transition state (an array of partial
+	// results, e.g. the count and the sum for AVG) which the final stage merges.
+	distsqlrun.AggregatorSpec_AVG: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_AVG_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_AVG_MERGE},
+	},
+	distsqlrun.AggregatorSpec_VARIANCE: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_VARIANCE_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_VARIANCE_MERGE},
+	},
+	distsqlrun.AggregatorSpec_STDDEV: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_VARIANCE_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_STDDEV_MERGE},
+	},
+
+	// The local stage of TOP_K pads its state to k elements, so that the final
+	// stage learns k from it.
+	distsqlrun.AggregatorSpec_TOP_K: {
+		LocalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_TOP_K_STATE},
+		FinalStage: []distsqlrun.AggregatorSpec_Func{distsqlrun.AggregatorSpec_TOP_K_MERGE},
 	},
 }
 
@@ -16,10 +16,13 @@ package distsqlplan
 
 import (
 	"fmt"
+	"math"
+	"strings"
 	"testing"
 
 	"golang.org/x/net/context"
 
+	"github.com/cockroachdb/apd"
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/sql/distsqlrun"
@@ -86,17 +89,25 @@ func runTestFlow(
 //
 // Both types of flows are set up and ran against the first numRows of the given
 // table. We assume the table's first column is the primary key, with values
-// from 1 to numRows. A non-PK column that works with the function is chosen.
+// from 1 to numRows. The non-PK columns colIdxs, which work with the function,
+// are its arguments.
 func checkDistAggregationInfo(
 	t *testing.T,
 	srv serverutils.TestServerInterface,
 	tableDesc *sqlbase.TableDescriptor,
-	colIdx int,
+	colIdxs []int,
 	numRows int,
 	fn distsqlrun.AggregatorSpec_Func,
 	info DistAggregationInfo,
 ) {
-	colType := tableDesc.Columns[colIdx].Type
+	colTypes := make([]sqlbase.ColumnType, len(colIdxs))
+	outputCols := make([]uint32, len(colIdxs))
+	aggCols := make([]uint32, len(colIdxs))
+	for i, colIdx := range colIdxs {
+		colTypes[i] = tableDesc.Columns[colIdx].Type
+		outputCols[i] = uint32(colIdx)
+		aggCols[i] = uint32(i)
+	}
 
 	makeTableReader := func(startPK, endPK int, streamID int) distsqlrun.ProcessorSpec {
 		tr := distsqlrun.TableReaderSpec{
@@ -118,7 +129,7 @@ func checkDistAggregationInfo(
 			Core: distsqlrun.ProcessorCoreUnion{TableReader: &tr},
 			Post: distsqlrun.PostProcessSpec{
 				Projection:    true,
-				OutputColumns: []uint32{uint32(colIdx)},
+				OutputColumns: outputCols,
 			},
 			Output: []distsqlrun.OutputRouterSpec{{
 				Type: distsqlrun.OutputRouterSpec_PASS_THROUGH,
@@ -139,13 +150,13 @@ func checkDistAggregationInfo(
 		distsqlrun.ProcessorSpec{
 			Input: []distsqlrun.InputSyncSpec{{
 				Type:        distsqlrun.InputSyncSpec_UNORDERED,
-				ColumnTypes: []sqlbase.ColumnType{colType},
+				ColumnTypes: colTypes,
 				Streams: []distsqlrun.StreamEndpointSpec{
 					{Type: distsqlrun.StreamEndpointSpec_LOCAL, StreamID: 0},
 				},
 			}},
 			Core: distsqlrun.ProcessorCoreUnion{Aggregator: &distsqlrun.AggregatorSpec{
-				Aggregations: []distsqlrun.AggregatorSpec_Aggregation{{Func: fn, ColIdx: []uint32{0}}},
+				Aggregations: []distsqlrun.AggregatorSpec_Aggregation{{Func: fn, ColIdx: aggCols}},
 			}},
 			Output: []distsqlrun.OutputRouterSpec{{
 				Type: distsqlrun.OutputRouterSpec_PASS_THROUGH,
@@ -171,7 +182,7 @@ func checkDistAggregationInfo(
 	intermediaryTypes := make([]sqlbase.ColumnType, numIntermediary)
 	for i, fn := range info.LocalStage {
 		var err error
-		_, intermediaryTypes[i], err = distsqlrun.GetAggregateInfo(fn, colType)
+		_, intermediaryTypes[i], err = distsqlrun.GetAggregateInfo(fn, colTypes...)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -180,7 +191,7 @@ func checkDistAggregationInfo(
 	localAggregations := make([]distsqlrun.AggregatorSpec_Aggregation, numIntermediary)
 	for i, fn := range info.LocalStage {
 		// Local aggregations have the same input.
-		localAggregations[i] = distsqlrun.AggregatorSpec_Aggregation{Func: fn, ColIdx: []uint32{0}}
+		localAggregations[i] = distsqlrun.AggregatorSpec_Aggregation{Func: fn, ColIdx: aggCols}
 	}
 	finalAggregations := make([]distsqlrun.AggregatorSpec_Aggregation, numIntermediary)
 	for i, fn := range info.FinalStage {
@@ -215,7 +226,7 @@ func checkDistAggregationInfo(
 		agg := distsqlrun.ProcessorSpec{
 			Input: []distsqlrun.InputSyncSpec{{
 				Type:        distsqlrun.InputSyncSpec_UNORDERED,
-				ColumnTypes: []sqlbase.ColumnType{colType},
+				ColumnTypes: colTypes,
 				Streams: []distsqlrun.StreamEndpointSpec{
 					{Type: distsqlrun.StreamEndpointSpec_LOCAL, StreamID: distsqlrun.StreamID(2 * i)},
 				},
@@ -259,11 +270,72 @@ func checkDistAggregationInfo(
 			}
 		}
 	}
-	if rowsDist.String() != rowsNonDist.String() {
+	if !equalRowsWithinTolerance(t, rowsDist, rowsNonDist) {
 		t.Errorf("different results\nw/o local stage:   %s\nwith local stage:  %s", rowsNonDist, rowsDist)
 	}
 }
 
+// equalRowsWithinTolerance returns whether the given rows are equal. Floats
+// and decimals are allowed to differ slightly: the local and final stages of
+// some aggregations accumulate values in a different order than a single stage
+// does, so their results can differ in rounding.
+func equalRowsWithinTolerance(t *testing.T, a, b sqlbase.EncDatumRows) bool {
+	const tolerance = 1e-9
+	decimalTolerance := apd.New(1, -9)
+	if len(a) != len(b) {
+		return false
+	}
+	var alloc sqlbase.DatumAlloc
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if err := a[i][j].EnsureDecoded(&alloc); err != nil {
+				t.Fatal(err)
+			}
+			if err := b[i][j].EnsureDecoded(&alloc); err != nil {
+				t.Fatal(err)
+			}
+			switch da := a[i][j].Datum.(type) {
+			case *parser.DFloat:
+				if db, ok := b[i][j].Datum.(*parser.DFloat); ok {
+					diff := math.Abs(float64(*da) - float64(*db))
+					if diff > tolerance*math.Max(math.Abs(float64(*da)), math.Abs(float64(*db))) {
+						return false
+					}
+					continue
+				}
+			case *parser.DDecimal:
+				if db, ok := b[i][j].Datum.(*parser.DDecimal); ok {
+					var diff, absA, absB apd.Decimal
+					ed := apd.MakeErrDecimal(parser.DecimalCtx)
+					ed.Sub(&diff, &da.Decimal, &db.Decimal)
+					ed.Abs(&diff, &diff)
+					ed.Abs(&absA, &da.Decimal)
+					ed.Abs(&absB, &db.Decimal)
+					max := &absA
+					if absA.Cmp(&absB) < 0 {
+						max = &absB
+					}
+					ed.Mul(max, max, decimalTolerance)
+					if err := ed.Err(); err != nil {
+						t.Fatal(err)
+					}
+					if diff.Cmp(max) > 0 {
+						return false
+					}
+					continue
+				}
+			}
+			if a[i][j].String() != b[i][j].String() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // Test that distributing agg functions according to DistAggregationTable
 // yields correct results. We're going to run each aggregation as either the
 // two-stage process described by the DistAggregationTable or as a single global
@@ -314,20 +386,51 @@ func TestDistAggregationTable(t *testing.T) {
 			// COUNT_ROWS takes no arguments; skip it in this test.
 			continue
 		}
+		if fn == distsqlrun.AggregatorSpec_ANY_VALUE {
+			// ANY_VALUE returns an arbitrary value; skip it in this test.
+			continue
+		}
+		if fn == distsqlrun.AggregatorSpec_TOP_K ||
+			fn == distsqlrun.AggregatorSpec_EQUIDEPTH_HISTOGRAM {
+			// TOP_K and EQUIDEPTH_HISTOGRAM require the same k or number of buckets
+			// on all rows; skip them in this test.
+			continue
+		}
 		// We're going to test each aggregation function on every column that can be
-		// used as input for it.
+		// used as input for it. Functions taking two arguments get another column of
+		// the same type as their second argument.
 		foundCol := false
 		for colIdx := 1; colIdx < len(desc.Columns); colIdx++ {
+			colIdxs := []int{colIdx}
 			// See if this column works with this function.
 			_, _, err := distsqlrun.GetAggregateInfo(fn, desc.Columns[colIdx].Type)
 			if err != nil {
-				continue
+				for otherIdx := 1; otherIdx < len(desc.Columns); otherIdx++ {
+					if otherIdx != colIdx &&
+						desc.Columns[otherIdx].Type.Equal(desc.Columns[colIdx].Type) {
+						colIdxs = append(colIdxs, otherIdx)
+						break
+					}
+				}
+				if len(colIdxs) == 1 {
+					continue
+				}
+				_, _, err = distsqlrun.GetAggregateInfo(
+					fn, desc.Columns[colIdxs[0]].Type, desc.Columns[colIdxs[1]].Type,
+				)
+				if err != nil {
+					continue
+				}
 			}
 			foundCol = true
+			colNames := make([]string, len(colIdxs))
+			for i, c := range colIdxs {
+				colNames[i] = desc.Columns[c].Name
+			}
 			for _, numRows := range []int{5, numRows / 10, numRows / 2, numRows} {
-				name := fmt.Sprintf("%s/%s/%d", fn, desc.Columns[colIdx].Name, numRows)
+				name := fmt.Sprintf("%s/%s/%d", fn, strings.Join(colNames, ","), numRows)
 				t.Run(name, func(t *testing.T) {
-					checkDistAggregationInfo(t, tc.Server(0), desc, colIdx, numRows, fn, info)
+					checkDistAggregationInfo(t, tc.Server(0), desc, colIdxs, numRows, fn, info)
 				})
 			}
 		}
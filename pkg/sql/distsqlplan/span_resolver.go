@@ -165,8 +165,9 @@ func NewSpanResolver(
 	case BinPackingLeaseHolderChoice:
 		oracle = &binPackingOracle{
 			maxPreferredRangesPerLeaseHolder: maxPreferredRangesPerLeaseHolder,
-			gossip:   gossip,
-			nodeDesc: nodeDesc,
+			gossip:      gossip,
+			nodeDesc:    nodeDesc,
+			latencyFunc: distSender.LatencyFunc(),
 		}
 	}
 	return &spanResolver{
@@ -383,6 +384,9 @@ type binPackingOracle struct {
 	// nodeDesc is the descriptor of the current node. It will be used to give
 	// preference to the current node and others "close" to it.
 	nodeDesc roachpb.NodeDescriptor
+	// latencyFunc, if not nil, reports the latency to the nodes, which is
+	// used to break the ties between replicas equally "close" by attributes.
+	latencyFunc kv.LatencyFunc
 }
 
 var _ leaseHolderOracle = &binPackingOracle{}
@@ -394,7 +398,7 @@ func (o *binPackingOracle) ChoosePreferredLeaseHolder(
 	if err != nil {
 		return kv.ReplicaInfo{}, err
 	}
-	replicas.OptimizeReplicaOrder(&o.nodeDesc)
+	replicas.OptimizeReplicaOrder(&o.nodeDesc, o.latencyFunc)
 
 	// Look for a replica that has been assigned some ranges, but it's not yet full.
 	minLoad := int(math.MaxInt32)
@@ -15,13 +15,20 @@
 package distsqlrun
 
 import (
+	"bytes"
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/pkg/errors"
@@ -52,6 +59,14 @@ func GetAggregateInfo(
 	builtins := parser.Aggregates[strings.ToLower(fn.String())]
 	for _, b := range builtins {
 		types := b.Types.Types()
+		if v, ok := b.Types.(parser.VariadicType); ok {
+			// Variadic aggregates like COUNT accept any number of arguments of
+			// the same type.
+			types = make([]parser.Type, len(inputTypes))
+			for i := range types {
+				types[i] = v.Typ
+			}
+		}
 		if len(types) != len(inputTypes) {
 			continue
 		}
@@ -67,7 +82,8 @@ func GetAggregateInfo(
 			constructAgg := func(evalCtx *parser.EvalContext) parser.AggregateFunc {
 				return b.AggregateFunc(datumTypes, evalCtx)
 			}
-			return constructAgg, sqlbase.DatumTypeToColumnType(b.FixedReturnType()), nil
+			retType := b.InferReturnTypeFromInputArgTypes(datumTypes)
+			return constructAgg, sqlbase.DatumTypeToColumnType(retType), nil
 		}
 	}
 	return nil, sqlbase.ColumnType{}, errors.Errorf(
@@ -85,7 +101,10 @@ func GetAggregateInfo(
 type aggregator struct {
 	processorBase
 
-	flowCtx     *FlowCtx
+	flowCtx *FlowCtx
+	// evalCtx is passed to the aggregate functions. Shards use their own copy
+	// of the flow's context, which holds scratch space.
+	evalCtx     *parser.EvalContext
 	input       RowSource
 	funcs       []*aggregateFuncHolder
 	outputTypes []sqlbase.ColumnType
@@ -95,8 +114,78 @@ type aggregator struct {
 
 	groupCols    columns
 	aggregations []AggregatorSpec_Aggregation
+	// orderedGroupCols is the subset of groupCols on which the input is
+	// ordered. The groups accumulated so far are emitted each time the values
+	// of these columns change.
+	orderedGroupCols columns
+	// sortOutput is set if the groups are emitted in the order of their group
+	// keys. The group keys then use an order-preserving encoding.
+	sortOutput bool
+
+	// buckets maps the key of each group to the aggregate functions
+	// accumulating its values, one per element of funcs. The keys are
+	// allocated by keys.
+	buckets map[string]aggregateFuncs
+	keys    keyAlloc
+	// rowIdx is incremented for each row which is accumulated. It allows the
+	// aggregations sharing a distinctSet to only check each row once.
+	rowIdx int64
+
+	// otherArgs is scratch space for the arguments beyond the first of
+	// aggregations with multiple arguments, followed by the values of the
+	// ordering columns of aggregations with an ordering.
+	otherArgs parser.Datums
+
+	// testingKnobMemLimit is used in testing to set a limit on the memory that
+	// should be used by the aggregator before spilling groups to disk. Minimum
+	// value to enable is 1.
+	testingKnobMemLimit int64
+	// testingKnobMaxSpillLevel is used in testing to override the number of
+	// times spilled groups are re-partitioned before they are sorted instead.
+	// Minimum value to enable is 1.
+	testingKnobMaxSpillLevel int
+	// testingKnobWorkers is used in testing to override the number of shards
+	// accumulating the groups. Minimum value to enable is 1.
+	testingKnobWorkers int
+	// shards, if set, partitions the groups among several aggregators which
+	// accumulate them in parallel.
+	shards *aggregatorShards
+	// tempStorage is used to store the rows of groups which do not fit in
+	// memory. It can be nil, in which case the aggregator errors out once its
+	// memory budget is exhausted.
+	tempStorage engine.Engine
+	// spill, if set, holds the partitions to which rows belonging to groups
+	// that are not in memory are written.
+	spill *aggregatorSpill
+	// spiller decides whether a memory budget error triggers spilling.
+	spiller spiller
+	// spilling is set once a new group didn't fit in memory. From then on, rows
+	// belonging to groups that are not in memory are written to spill until the
+	// in-memory buckets are released.
+	spilling bool
+
+	// rowsConsumed counts the input rows consumed so far. Progress metadata is
+	// emitted every aggregatorProgressRows of them.
+	rowsConsumed int64
+	// testingKnobProgressRows is used in testing to override the number of
+	// input rows consumed between progress reports. Minimum value to enable is
+	// 1.
+	testingKnobProgressRows int64
+	// accumulatedBytes is the memory used by the groups of a shard as of the
+	// last batch it accumulated. It is accessed atomically.
+	accumulatedBytes int64
 
-	buckets map[string]struct{} // The set of bucket keys.
+	// traceGroups is set if the aggregator is traced. The groups using the
+	// most memory are then recorded into the processor span, which helps find
+	// the skewed group keys behind memory budget errors.
+	traceGroups bool
+	// largestGroups holds the aggregatorTraceGroups groups using the most
+	// memory among those released so far, largest first.
+	largestGroups []groupMemUsage
+
+	// vec, if set, accumulates the groups in columnar batches instead of
+	// buckets.
+	vec *vecAggregation
 }
 
 var _ Processor = &aggregator{}
@@ -109,59 +198,150 @@ func newAggregator(
 	output RowReceiver,
 ) (*aggregator, error) {
 	ag := &aggregator{
-		flowCtx:      flowCtx,
-		input:        input,
-		groupCols:    spec.GroupCols,
-		aggregations: spec.Aggregations,
-		buckets:      make(map[string]struct{}),
-		funcs:        make([]*aggregateFuncHolder, len(spec.Aggregations)),
-		outputTypes:  make([]sqlbase.ColumnType, len(spec.Aggregations)),
-		bucketsAcc:   flowCtx.EvalCtx.Mon.MakeBoundAccount(),
+		flowCtx:          flowCtx,
+		evalCtx:          &flowCtx.EvalCtx,
+		input:            input,
+		groupCols:        spec.GroupCols,
+		orderedGroupCols: spec.OrderedGroupCols,
+		sortOutput:       spec.SortOutput,
+		aggregations:     spec.Aggregations,
+		buckets:          make(map[string]aggregateFuncs),
+		funcs:            make([]*aggregateFuncHolder, len(spec.Aggregations)),
+		outputTypes:      make([]sqlbase.ColumnType, len(spec.Aggregations)),
+		bucketsAcc:       flowCtx.EvalCtx.Mon.MakeBoundAccount(),
+		tempStorage:      flowCtx.tempStorage,
 	}
 
+	for _, c := range ag.orderedGroupCols {
+		found := false
+		for _, g := range ag.groupCols {
+			if c == g {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("ordered group column %d is not a group column", c)
+		}
+	}
+
+	if err := ag.initFuncs(input.Types()); err != nil {
+		return nil, err
+	}
+	if err := ag.out.Init(post, ag.outputTypes, &flowCtx.EvalCtx, output); err != nil {
+		return nil, err
+	}
+
+	return ag, nil
+}
+
+// initFuncs sets up the aggregate function holders and the output types of
+// the aggregations.
+func (ag *aggregator) initFuncs(inputTypes []sqlbase.ColumnType) error {
 	// Loop over the select expressions and extract any aggregate functions --
 	// non-aggregation functions are replaced with parser.NewIdentAggregate,
 	// (which just returns the last value added to them for a bucket) to provide
 	// grouped-by values for each bucket.  ag.funcs is updated to contain all
 	// the functions which need to be fed values.
-	inputTypes := input.Types()
-	for i, aggInfo := range spec.Aggregations {
+	distinctSets := make(map[string]*distinctSet)
+	for i, aggInfo := range ag.aggregations {
 		if aggInfo.FilterColIdx != nil {
 			col := *aggInfo.FilterColIdx
 			if col >= uint32(len(inputTypes)) {
-				return nil, errors.Errorf("FilterColIdx out of range (%d)", col)
+				return errors.Errorf("FilterColIdx out of range (%d)", col)
 			}
 			t := inputTypes[col].SemanticType
 			if t != sqlbase.ColumnType_BOOL && t != sqlbase.ColumnType_NULL {
-				return nil, errors.Errorf(
+				return errors.Errorf(
 					"filter column %d must be of boolean type, not %s", *aggInfo.FilterColIdx, t,
 				)
 			}
 		}
+		// The values of the ordering columns are passed after the arguments.
+		if n := len(aggInfo.ColIdx) - 1 + len(aggInfo.Ordering.Columns); n > len(ag.otherArgs) {
+			ag.otherArgs = make(parser.Datums, n)
+		}
 		argTypes := make([]sqlbase.ColumnType, len(aggInfo.ColIdx))
 		for i, c := range aggInfo.ColIdx {
 			if c >= uint32(len(inputTypes)) {
-				return nil, errors.Errorf("ColIdx out of range (%d)", aggInfo.ColIdx)
+				return errors.Errorf("ColIdx out of range (%d)", aggInfo.ColIdx)
 			}
 			argTypes[i] = inputTypes[c]
 		}
 		aggConstructor, retType, err := GetAggregateInfo(aggInfo.Func, argTypes...)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if len(aggInfo.Ordering.Columns) > 0 {
+			if aggInfo.Func != AggregatorSpec_FIRST_VALUE &&
+				aggInfo.Func != AggregatorSpec_LAST_VALUE {
+				return errors.Errorf("%s aggregations don't support an ordering", aggInfo.Func)
+			}
+			directions := make([]parser.Direction, len(aggInfo.Ordering.Columns))
+			for j, c := range aggInfo.Ordering.Columns {
+				if c.ColIdx >= uint32(len(inputTypes)) {
+					return errors.Errorf("ordering column index out of range (%d)", c.ColIdx)
+				}
+				directions[j] = parser.Ascending
+				if c.Direction == Ordering_Column_DESC {
+					directions[j] = parser.Descending
+				}
+			}
+			create, last := aggConstructor, aggInfo.Func == AggregatorSpec_LAST_VALUE
+			aggConstructor = func(evalCtx *parser.EvalContext) parser.AggregateFunc {
+				return parser.NewOrderedAggregate(create, evalCtx, directions, last)
+			}
+		}
+		if aggInfo.ErrorOnOverflow {
+			if aggInfo.Func != AggregatorSpec_SUM {
+				return errors.Errorf("%s aggregations don't support erroring on overflow", aggInfo.Func)
+			}
+			switch t := argTypes[0].SemanticType; t {
+			case sqlbase.ColumnType_INT:
+				aggConstructor = func(evalCtx *parser.EvalContext) parser.AggregateFunc {
+					return parser.NewIntSumAggregate(evalCtx, true /* errorOnOverflow */)
+				}
+			case sqlbase.ColumnType_DECIMAL:
+				aggConstructor = func(evalCtx *parser.EvalContext) parser.AggregateFunc {
+					return parser.NewDecimalSumAggregate(evalCtx, true /* errorOnOverflow */)
+				}
+			default:
+				return errors.Errorf("SUM over %s doesn't support erroring on overflow", t)
+			}
 		}
 
 		ag.funcs[i] = ag.newAggregateFuncHolder(aggConstructor)
+		if len(aggInfo.ColIdx) > 1 {
+			ag.funcs[i].numOtherArgs = len(aggInfo.ColIdx) - 1
+		}
+		if err := ag.funcs[i].filter.init(aggInfo.Filter, inputTypes, ag.evalCtx); err != nil {
+			return err
+		}
 		if aggInfo.Distinct {
-			ag.funcs[i].seen = make(map[string]struct{})
+			// Aggregations which are DISTINCT on the same argument and have the
+			// same filter see the same values, so they share their set of seen
+			// values.
+			key := fmt.Sprintf("%v", aggInfo.ColIdx)
+			if aggInfo.FilterColIdx != nil {
+				key += fmt.Sprintf("/%d", *aggInfo.FilterColIdx)
+			}
+			if aggInfo.Filter.Expr != "" {
+				key += "/" + aggInfo.Filter.Expr
+			}
+			if aggInfo.SkipNulls {
+				key += "/skip-nulls"
+			}
+			set, ok := distinctSets[key]
+			if !ok {
+				set = newDistinctSet()
+				distinctSets[key] = set
+			}
+			ag.funcs[i].seen = set
 		}
 
 		ag.outputTypes[i] = retType
 	}
-	if err := ag.out.Init(post, ag.outputTypes, &flowCtx.EvalCtx, output); err != nil {
-		return nil, err
-	}
-
-	return ag, nil
+	return nil
 }
 
 // Run is part of the processor interface.
@@ -169,24 +349,76 @@ func (ag *aggregator) Run(ctx context.Context, wg *sync.WaitGroup) {
 	if wg != nil {
 		defer wg.Done()
 	}
-	defer ag.bucketsAcc.Close(ctx)
-	defer func() {
-		for _, f := range ag.funcs {
-			for _, aggFunc := range f.buckets {
-				aggFunc.Close(ctx)
-			}
-		}
-	}()
 
 	ctx = log.WithLogTag(ctx, "Agg", nil)
-	ctx, span := processorSpan(ctx, "aggregator")
+	ctx, span := processorSpan(ctx, ag.flowCtx, "aggregator")
 	defer tracing.FinishSpan(span)
+	ag.traceGroups = span != nil
 
 	if log.V(2) {
 		log.Infof(ctx, "starting aggregation process")
 		defer log.Infof(ctx, "exiting aggregator")
 	}
 
+	// Enable fall back to disk if the cluster setting is set or a memory limit
+	// has been set through testing.
+	ag.spiller = makeSpiller(
+		ag.flowCtx, "aggregator", ag.flowCtx.Settings.DistSQLUseTempStorageAggs,
+		ag.testingKnobMemLimit > 0,
+	)
+	defer ag.spiller.close(ctx)
+	// Spilled groups are aggregated one partition at a time, which doesn't
+	// preserve the order of the groups.
+	if ag.spiller.enabled() && len(ag.groupCols) > 0 && !ag.sortOutput {
+		// Limit the memory use by creating a child monitor with a hard limit.
+		// Groups which don't fit within this limit are spilled to disk.
+		limit := ag.testingKnobMemLimit
+		if limit <= 0 {
+			limit = ag.flowCtx.workMemLimit()
+		}
+		limitedMon := mon.MakeMonitorInheritWithLimit(
+			"aggregator-limited", limit, ag.flowCtx.EvalCtx.Mon,
+		)
+		limitedMon.Start(ctx, ag.flowCtx.EvalCtx.Mon, mon.BoundAccount{})
+		defer limitedMon.Stop(ctx)
+		ag.bucketsAcc = limitedMon.MakeBoundAccount()
+		ag.spill = &aggregatorSpill{}
+		ag.spiller.onSpill = ag.startSpilling
+	}
+
+	// Accumulate the groups in parallel if configured to. Groups can't be
+	// spilled to disk in that case, and inputs ordered on the group columns
+	// are accumulated a few groups at a time, which wouldn't benefit from it.
+	if ag.spill == nil && len(ag.groupCols) > 0 && len(ag.orderedGroupCols) == 0 {
+		workers := ag.testingKnobWorkers
+		if workers <= 0 {
+			workers = int(ag.flowCtx.Settings.DistSQLAggregatorWorkers.Get())
+		}
+		if workers > 1 {
+			shards, err := newAggregatorShards(ag, workers)
+			if err != nil {
+				DrainAndClose(ctx, ag.out.output, err, ag.input)
+				return
+			}
+			ag.shards = shards
+			defer ag.shards.close(ctx)
+		}
+	}
+	// Accumulate the groups in columnar batches if all the aggregations support
+	// it. Groups emitted in order, spilled to disk or partitioned among shards
+	// need the buckets.
+	if ag.spill == nil && ag.shards == nil && len(ag.orderedGroupCols) == 0 && !ag.sortOutput &&
+		ag.flowCtx.Settings.DistSQLVectorizeAggs.Get() {
+		ag.vec = newVecAggregation(ag)
+	}
+	defer ag.bucketsAcc.Close(ctx)
+	defer ag.releaseBuckets(ctx)
+	defer func() {
+		if ag.spill != nil {
+			ag.spill.close(ctx)
+		}
+	}()
+
 	if err := ag.accumulateRows(ctx); err != nil {
 		// We swallow the error here, it has already been forwarded to the output.
 		return
@@ -196,38 +428,202 @@ func (ag *aggregator) Run(ctx context.Context, wg *sync.WaitGroup) {
 
 	// Queries like `SELECT MAX(n) FROM t` expect a row of NULLs if nothing was
 	// aggregated.
-	if len(ag.buckets) < 1 && len(ag.groupCols) == 0 {
-		ag.buckets[""] = struct{}{}
+	if len(ag.buckets) < 1 && len(ag.groupCols) == 0 && ag.vec == nil {
+		funcs := ag.newAggregateFuncs()
+		if err := ag.bucketsAcc.Grow(ctx, bucketSize(0 /* keyLen */, funcs)); err != nil {
+			funcs.close(ctx)
+			DrainAndClose(ctx, ag.out.output, err, ag.input)
+			return
+		}
+		ag.buckets[""] = funcs
+	}
+
+	if consumerDone, err := ag.flush(ctx); err != nil {
+		ag.traceLargestGroups(ctx)
+		DrainAndClose(ctx, ag.out.output, err, ag.input)
+		return
+	} else if consumerDone {
+		// emitHelper() already closed the output.
+		return
 	}
 
-	// Render the results.
-	var consumerDone bool
+	ag.traceLargestGroups(ctx)
+	sendTraceData(ctx, ag.out.output)
+	ag.out.Close()
+}
+
+// flush emits the results of all the groups accumulated so far, including
+// the ones that were spilled to disk, and releases their state. It returns true
+// if the consumer doesn't need any more rows, in which case the inputs and the
+// output have already been closed.
+func (ag *aggregator) flush(ctx context.Context, inputs ...RowSource) (consumerDone bool, _ error) {
+	if consumerDone, err := ag.renderBuckets(ctx, inputs...); err != nil || consumerDone {
+		return consumerDone, err
+	}
+	// Aggregate the groups which were spilled to disk, one partition at a time.
+	if ag.spill != nil && ag.spill.partitions != nil {
+		if consumerDone, err := ag.aggregateSpilledPartitions(ctx, inputs...); err != nil ||
+			consumerDone {
+			return consumerDone, err
+		}
+		ag.spill = &aggregatorSpill{}
+	}
+	ag.releaseBuckets(ctx)
+	return false, nil
+}
+
+// renderBuckets emits the result rows for all the buckets currently held in
+// memory. It returns true if the consumer doesn't need any more rows, in which
+// case the inputs and the output have already been closed.
+func (ag *aggregator) renderBuckets(
+	ctx context.Context, inputs ...RowSource,
+) (consumerDone bool, _ error) {
+	if ag.vec != nil {
+		return ag.vec.render(ctx, inputs...)
+	}
+	// The groups are held either by ag or by its shards. No more rows are
+	// accumulated into them, so their DISTINCT sets are no longer needed, and
+	// each group is released once its result is emitted.
+	owners := []*aggregator{ag}
+	if ag.shards != nil {
+		owners = ag.shards.shards
+	}
+	for _, owner := range owners {
+		owner.releaseDistinctSets(ctx)
+	}
+	if ag.sortOutput {
+		return ag.renderSortedBuckets(ctx, owners, inputs...)
+	}
 	row := make(sqlbase.EncDatumRow, len(ag.funcs))
-	for bucket := range ag.buckets {
-		for i, f := range ag.funcs {
-			result, err := f.get(bucket)
-			if err != nil {
-				DrainAndClose(ctx, ag.out.output, err, ag.input)
-				return
-			}
-			if result == nil {
-				// Special case useful when this is a local stage of a distributed
-				// aggregation.
-				result = parser.DNull
+	for _, owner := range owners {
+		for key, funcs := range owner.buckets {
+			if consumerDone, err := ag.renderGroup(ctx, row, funcs, inputs...); err != nil ||
+				consumerDone {
+				return consumerDone, err
 			}
-			row[i] = sqlbase.DatumToEncDatum(ag.outputTypes[i], result)
+			ag.releaseGroup(ctx, owner, key, funcs)
 		}
+	}
+	return false, nil
+}
 
-		consumerDone = !emitHelper(ctx, &ag.out, row, ProducerMetadata{})
-		if consumerDone {
-			break
+// sortedGroup is a group whose result is emitted by renderSortedBuckets.
+type sortedGroup struct {
+	// owner is the aggregator holding the group, i.e. the aggregator rendering
+	// the groups or one of its shards.
+	owner *aggregator
+	key   string
+	funcs aggregateFuncs
+}
+
+const sizeOfSortedGroup = int64(unsafe.Sizeof(sortedGroup{}))
+
+// renderSortedBuckets emits the result rows for the buckets of the given
+// aggregators, i.e. ag or its shards, in the order of their group keys. Each
+// group is released once its result is emitted.
+func (ag *aggregator) renderSortedBuckets(
+	ctx context.Context, owners []*aggregator, inputs ...RowSource,
+) (consumerDone bool, _ error) {
+	numGroups := 0
+	for _, owner := range owners {
+		numGroups += len(owner.buckets)
+	}
+	groupsSize := int64(numGroups) * sizeOfSortedGroup
+	if err := ag.bucketsAcc.Grow(ctx, groupsSize); err != nil {
+		return false, err
+	}
+	defer ag.bucketsAcc.Shrink(ctx, groupsSize)
+	groups := make([]sortedGroup, 0, numGroups)
+	for _, owner := range owners {
+		for key, funcs := range owner.buckets {
+			groups = append(groups, sortedGroup{owner: owner, key: key, funcs: funcs})
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].key < groups[j].key })
+
+	row := make(sqlbase.EncDatumRow, len(ag.funcs))
+	for _, g := range groups {
+		if consumerDone, err := ag.renderGroup(ctx, row, g.funcs, inputs...); err != nil ||
+			consumerDone {
+			return consumerDone, err
+		}
+		ag.releaseGroup(ctx, g.owner, g.key, g.funcs)
+	}
+	return false, nil
+}
+
+// renderGroup emits the result row of the group with the given aggregate
+// functions, using row as scratch space. It returns true if the consumer
+// doesn't need any more rows, in which case the inputs and the output have
+// already been closed.
+func (ag *aggregator) renderGroup(
+	ctx context.Context, row sqlbase.EncDatumRow, funcs aggregateFuncs, inputs ...RowSource,
+) (consumerDone bool, _ error) {
+	for i, f := range funcs {
+		result, err := f.Result()
+		if err != nil {
+			return false, err
+		}
+		if result == nil {
+			// Special case useful when this is a local stage of a distributed
+			// aggregation.
+			result = parser.DNull
+		}
+		row[i] = sqlbase.DatumToEncDatum(ag.outputTypes[i], result)
+	}
+	return !emitHelper(ctx, &ag.out, row, ProducerMetadata{}, inputs...), nil
+}
+
+// releaseGroup releases the aggregation state of a group held by owner, i.e.
+// ag or one of its shards, once its result was emitted. This lets other
+// processors and queries use its memory while the remaining groups are
+// emitted.
+func (ag *aggregator) releaseGroup(
+	ctx context.Context, owner *aggregator, key string, funcs aggregateFuncs,
+) {
+	if ag.traceGroups {
+		ag.noteGroup(key, funcs)
+	}
+	// This is the memory accounted for when the group was created (see
+	// accumulateGroupRow).
+	size := bucketSize(len(key), funcs)
+	funcs.close(ctx)
+	delete(owner.buckets, key)
+	owner.bucketsAcc.Shrink(ctx, size)
+}
+
+// releaseDistinctSets empties the DISTINCT sets of the aggregations, and
+// releases their memory.
+func (ag *aggregator) releaseDistinctSets(ctx context.Context) {
+	for _, f := range ag.funcs {
+		if f.seen != nil {
+			f.seen.reset(ctx, &ag.bucketsAcc)
 		}
 	}
-	// If the consumer has been found to be done, emitHelper() already closed the
-	// output.
-	if !consumerDone {
-		sendTraceData(ctx, ag.out.output)
-		ag.out.Close()
+}
+
+// releaseBuckets releases the aggregation state of all the buckets currently
+// held in memory.
+func (ag *aggregator) releaseBuckets(ctx context.Context) {
+	if ag.traceGroups {
+		ag.noteLargestGroups()
+	}
+	for _, funcs := range ag.buckets {
+		funcs.close(ctx)
+	}
+	ag.releaseDistinctSets(ctx)
+	ag.buckets = make(map[string]aggregateFuncs)
+	if ag.vec != nil {
+		ag.vec.reset()
+	}
+	ag.keys = keyAlloc{}
+	ag.bucketsAcc.Clear(ctx)
+	atomic.StoreInt64(&ag.accumulatedBytes, 0)
+	ag.spilling = false
+	if ag.shards != nil {
+		for _, shard := range ag.shards.shards {
+			shard.releaseBuckets(ctx)
+		}
 	}
 }
 
@@ -242,12 +638,23 @@ func (ag *aggregator) accumulateRows(ctx context.Context) (err error) {
 		if err != nil {
 			log.Infof(ctx, "accumulate error %s", err)
 			if cleanupRequired {
+				ag.traceLargestGroups(ctx)
 				DrainAndClose(ctx, ag.out.output, err, ag.input)
 			}
 		}
 	}()
 
-	var scratch []byte
+	if ag.shards != nil {
+		ag.shards.start(ctx)
+		defer func() {
+			// Wait for the shards to finish accumulating the rows handed to them.
+			if waitErr := ag.shards.wait(); err == nil {
+				err = waitErr
+			}
+		}()
+	}
+
+	var scratch, orderedScratch, lastOrdered []byte
 	for {
 		row, meta := ag.input.Next()
 		if !meta.Empty() {
@@ -267,120 +674,889 @@ func (ag *aggregator) accumulateRows(ctx context.Context) (err error) {
 			continue
 		}
 		if row == nil {
+			if ag.vec != nil {
+				return ag.vec.flushBatch(ctx)
+			}
 			return nil
 		}
 
-		// The encoding computed here determines which bucket the non-grouping
-		// datums are accumulated to.
-		encoded, err := ag.encode(scratch, row)
-		if err != nil {
-			return err
+		ag.rowsConsumed++
+		progressRows := ag.testingKnobProgressRows
+		if progressRows <= 0 {
+			progressRows = aggregatorProgressRows
 		}
-
-		if err := ag.bucketsAcc.Grow(ctx, int64(len(encoded))); err != nil {
-			return err
+		if ag.rowsConsumed%progressRows == 0 {
+			meta := ProducerMetadata{Progress: ag.progress()}
+			if !emitHelper(ctx, &ag.out, nil /* row */, meta, ag.input) {
+				cleanupRequired = false
+				return errors.Errorf("consumer stopped before it received rows")
+			}
 		}
 
-		ag.buckets[string(encoded)] = struct{}{}
-		// Feed the func holders for this bucket the non-grouping datums.
-		for i, a := range ag.aggregations {
-			if a.FilterColIdx != nil {
-				if err := row[*a.FilterColIdx].EnsureDecoded(&ag.datumAlloc); err != nil {
-					return err
-				}
-				if row[*a.FilterColIdx].Datum != parser.DBoolTrue {
-					// This row doesn't contribute to this aggregation.
-					continue
-				}
+		if len(ag.orderedGroupCols) > 0 {
+			orderedScratch, err = ag.encode(orderedScratch[:0], ag.orderedGroupCols, row)
+			if err != nil {
+				return err
 			}
-			var value parser.Datum
-			if len(a.ColIdx) != 0 {
-				c := a.ColIdx[0]
-				if err := row[c].EnsureDecoded(&ag.datumAlloc); err != nil {
+			if lastOrdered != nil && !bytes.Equal(orderedScratch, lastOrdered) {
+				// We have seen all the rows of the groups accumulated so far; emit them.
+				if consumerDone, err := ag.flush(ctx, ag.input); err != nil {
 					return err
+				} else if consumerDone {
+					cleanupRequired = false
+					return errors.Errorf("consumer stopped before it received all rows")
 				}
+			}
+			lastOrdered, orderedScratch = orderedScratch, lastOrdered
+		}
+
+		if scratch, err = ag.accumulateRow(ctx, scratch, row); err != nil {
+			return err
+		}
+	}
+}
+
+// progress reports the number of input rows consumed so far and the memory
+// used by the groups accumulated from them.
+func (ag *aggregator) progress() *ProcessorProgress {
+	bytes := ag.bucketsAcc.CurrentlyAllocated()
+	if ag.shards != nil {
+		for _, shard := range ag.shards.shards {
+			bytes += atomic.LoadInt64(&shard.accumulatedBytes)
+		}
+	}
+	return &ProcessorProgress{
+		NodeID:           ag.flowCtx.nodeID,
+		ProcessorIdx:     ag.flowCtx.processorIdx,
+		Processor:        "aggregator",
+		RowsConsumed:     ag.rowsConsumed,
+		BytesAccumulated: bytes,
+	}
+}
+
+// accumulateRow feeds the given row to the aggregate functions of its group,
+// or hands it to the shard accumulating the group. The given scratch buffer is
+// used to encode the group key; the buffer is returned for reuse.
+func (ag *aggregator) accumulateRow(
+	ctx context.Context, scratch []byte, row sqlbase.EncDatumRow,
+) ([]byte, error) {
+	// The encoding computed here determines which bucket the non-grouping
+	// datums are accumulated to.
+	encoded, err := ag.encode(scratch, ag.groupCols, row)
+	if err != nil {
+		return scratch, err
+	}
+	if ag.vec != nil {
+		return encoded[:0], ag.vec.addRow(ctx, encoded, row)
+	}
+	if ag.shards != nil {
+		return encoded[:0], ag.shards.addRow(ctx, encoded, row)
+	}
+	return encoded[:0], ag.accumulateGroupRow(ctx, encoded, row)
+}
+
+// accumulateGroupRow feeds the given row to the aggregate functions of the
+// group with the given key. If the aggregator is allowed to spill to disk and
+// there is not enough memory for a new group, the row is written to disk
+// instead.
+func (ag *aggregator) accumulateGroupRow(
+	ctx context.Context, encoded []byte, row sqlbase.EncDatumRow,
+) error {
+	funcs, ok := ag.buckets[string(encoded)]
+	if !ok {
+		if ag.spilling {
+			// New groups go straight to disk.
+			return ag.spill.addRow(ctx, encoded, row)
+		}
+		// Account for the bucket key as well as for the aggregate functions up
+		// front, so that running out of memory leaves no partially created
+		// bucket behind.
+		funcs = ag.newAggregateFuncs()
+		spilled, err := ag.spiller.grow(ctx, &ag.bucketsAcc, bucketSize(len(encoded), funcs))
+		if err != nil || spilled {
+			funcs.close(ctx)
+			if err != nil {
+				return err
+			}
+			return ag.spill.addRow(ctx, encoded, row)
+		}
+		ag.buckets[ag.keys.intern(encoded)] = funcs
+	}
+
+	// Feed the func holders for this bucket the non-grouping datums.
+	ag.rowIdx++
+	for i, a := range ag.aggregations {
+		if a.FilterColIdx != nil {
+			if err := row[*a.FilterColIdx].EnsureDecoded(&ag.datumAlloc); err != nil {
+				return err
+			}
+			if row[*a.FilterColIdx].Datum != parser.DBoolTrue {
+				// This row doesn't contribute to this aggregation.
+				continue
+			}
+		}
+		if filter := &ag.funcs[i].filter; filter.expr != nil {
+			passes, err := filter.evalFilter(row)
+			if err != nil {
+				return err
+			}
+			if !passes {
+				continue
+			}
+		}
+		var value parser.Datum
+		otherArgs := ag.otherArgs[:0]
+		hasNull := false
+		for j, c := range a.ColIdx {
+			if err := row[c].EnsureDecoded(&ag.datumAlloc); err != nil {
+				return err
+			}
+			if row[c].Datum == parser.DNull {
+				hasNull = true
+			}
+			if j == 0 {
 				value = row[c].Datum
+			} else {
+				otherArgs = append(otherArgs, row[c].Datum)
 			}
-			if err := ag.funcs[i].add(ctx, encoded, value); err != nil {
+		}
+		if hasNull && a.SkipNulls {
+			continue
+		}
+		for _, c := range a.Ordering.Columns {
+			if err := row[c.ColIdx].EnsureDecoded(&ag.datumAlloc); err != nil {
 				return err
 			}
+			otherArgs = append(otherArgs, row[c.ColIdx].Datum)
+		}
+		if err := ag.funcs[i].add(ctx, encoded, funcs[i], value, otherArgs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startSpilling is the aggregator's spill callback, invoked once a new group
+// doesn't fit in memory. From then on, the rows of the groups which are not in
+// memory are written to disk.
+func (ag *aggregator) startSpilling(ctx context.Context, err error) error {
+	if ag.spill == nil || len(ag.buckets) == 0 {
+		// Spilling can't help if not even a single group fits in memory.
+		return err
+	}
+	if ag.spill.partitions == nil {
+		if ag.spill.level > ag.maxSpillLevel() && !ag.groupColsSortable() {
+			// The groups can't be partitioned further, and sorting them requires
+			// key-encoding the group columns.
+			err = errors.Wrapf(err,
+				"unable to aggregate spilled groups after %d levels of partitioning, "+
+					"and groups of type ARRAY can't be sorted", ag.maxSpillLevel())
+			log.VEventf(ctx, 1, "%v", err)
+			return err
+		}
+		ag.spill.init(ctx, ag)
+	}
+	log.VEventf(ctx, 2, "spilling aggregation groups to disk (level %d)", ag.spill.level)
+	ag.spilling = true
+	return nil
+}
+
+// aggregateSpilledPartitions aggregates the rows that were spilled to disk.
+// Each partition contains all the rows of the groups it holds, so each
+// partition can be aggregated and emitted independently, after the state of
+// the previous groups has been released. Partitions whose groups still don't
+// fit in memory are in turn partitioned to disk, using a different hash
+// function. Once the rows have been partitioned maxAggregatorSpillLevel times,
+// the rows which still don't fit are sorted on disk instead, and aggregated
+// one group at a time.
+func (ag *aggregator) aggregateSpilledPartitions(
+	ctx context.Context, inputs ...RowSource,
+) (consumerDone bool, _ error) {
+	for ag.spill.partitions != nil {
+		spill := ag.spill
+		ag.spill = &aggregatorSpill{level: spill.level + 1}
+		if spill.sorted {
+			consumerDone, err := ag.aggregateSortedPartition(ctx, &spill.partitions[0], inputs...)
+			spill.close(ctx)
+			if err != nil || consumerDone {
+				return consumerDone, err
+			}
+			continue
+		}
+		for i := range spill.partitions {
+			ag.releaseBuckets(ctx)
+			if err := ag.accumulatePartition(ctx, &spill.partitions[i]); err != nil {
+				spill.close(ctx)
+				return false, err
+			}
+			if consumerDone, err := ag.renderBuckets(ctx, inputs...); err != nil || consumerDone {
+				spill.close(ctx)
+				return consumerDone, err
+			}
+		}
+		spill.close(ctx)
+		// If any of the partitions spilled, ag.spill.partitions now holds the rows
+		// that were spilled while aggregating them.
+	}
+	return false, nil
+}
+
+// accumulatePartition feeds all the rows of the given spill partition to the
+// aggregator.
+func (ag *aggregator) accumulatePartition(ctx context.Context, partition *diskRowContainer) error {
+	i := partition.NewIterator(ctx)
+	defer i.Close()
+	var scratch []byte
+	for i.Rewind(); ; i.Next() {
+		if ok, err := i.Valid(); err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+		row, err := i.Row()
+		if err != nil {
+			return err
+		}
+		if scratch, err = ag.accumulateRow(ctx, scratch, row); err != nil {
+			return err
+		}
+	}
+}
+
+// aggregateSortedPartition aggregates the rows of a spill partition sorted by
+// their group columns. The rows of each group are contiguous, so the groups
+// are accumulated and emitted one at a time, like for an input ordered on all
+// the group columns.
+func (ag *aggregator) aggregateSortedPartition(
+	ctx context.Context, partition *diskRowContainer, inputs ...RowSource,
+) (consumerDone bool, _ error) {
+	// Spilling is disabled while the groups are aggregated: a group which
+	// doesn't fit in memory on its own can't be helped by spilling.
+	spill := ag.spill
+	ag.spill = nil
+	defer func() {
+		ag.spill = spill
+		ag.spilling = false
+	}()
+
+	ag.releaseBuckets(ctx)
+	i := partition.NewIterator(ctx)
+	defer i.Close()
+	var scratch, sortKey, lastSortKey []byte
+	for i.Rewind(); ; i.Next() {
+		if ok, err := i.Valid(); err != nil {
+			return false, err
+		} else if !ok {
+			break
+		}
+		row, err := i.Row()
+		if err != nil {
+			return false, err
+		}
+		// Rows of the same group have the same key encoding. Note that the
+		// value encodings used as group keys may still differ for values which
+		// sort the same, e.g. 1.0 and 1.00, so several buckets can be
+		// accumulated at once.
+		sortKey, err = ag.encodeAs(
+			sortKey[:0], sqlbase.DatumEncoding_ASCENDING_KEY, ag.groupCols, row,
+		)
+		if err != nil {
+			return false, err
+		}
+		if lastSortKey != nil && !bytes.Equal(sortKey, lastSortKey) {
+			if consumerDone, err := ag.renderBuckets(ctx, inputs...); err != nil || consumerDone {
+				return consumerDone, err
+			}
+			ag.releaseBuckets(ctx)
+		}
+		lastSortKey, sortKey = sortKey, lastSortKey
+		if scratch, err = ag.accumulateRow(ctx, scratch, row); err != nil {
+			return false, err
+		}
+	}
+	if consumerDone, err := ag.renderBuckets(ctx, inputs...); err != nil || consumerDone {
+		return consumerDone, err
+	}
+	ag.releaseBuckets(ctx)
+	return false, nil
+}
+
+// groupColsSortable returns whether the group columns can be key-encoded, and
+// hence whether the rows can be sorted by group on disk.
+func (ag *aggregator) groupColsSortable() bool {
+	types := ag.input.Types()
+	for _, c := range ag.groupCols {
+		if types[c].SemanticType == sqlbase.ColumnType_ARRAY {
+			return false
+		}
+	}
+	return true
+}
+
+// numAggregatorSpillPartitions is the number of partitions among which groups
+// are distributed when they are spilled to disk.
+const numAggregatorSpillPartitions = 8
+
+// maxAggregatorSpillLevel is the maximum number of times groups can be
+// re-partitioned because a partition didn't fit in memory. The rows of the
+// groups which still don't fit are sorted on disk instead.
+const maxAggregatorSpillLevel = 4
+
+// maxSpillLevel returns maxAggregatorSpillLevel, unless overridden for
+// testing.
+func (ag *aggregator) maxSpillLevel() int {
+	if ag.testingKnobMaxSpillLevel > 0 {
+		return ag.testingKnobMaxSpillLevel
+	}
+	return maxAggregatorSpillLevel
+}
+
+// aggregatorSpill holds the rows of the groups that the aggregator could not
+// fit in memory. The rows are partitioned on disk according to a hash of their
+// group key, so that all the rows of a group end up in the same partition.
+// Past the maximum level of partitioning, a single partition holds the rows
+// sorted by their group columns instead.
+type aggregatorSpill struct {
+	// level is the number of times the rows in partitions have been
+	// partitioned. It seeds the hash function so that rows are distributed
+	// differently at each level.
+	level int
+	// partitions is nil until the first row is spilled.
+	partitions []diskRowContainer
+	// sorted is set if partitions holds a single partition, sorted by the
+	// group columns.
+	sorted bool
+}
+
+func (s *aggregatorSpill) init(ctx context.Context, ag *aggregator) {
+	types := ag.input.Types()
+	var ordering sqlbase.ColumnOrdering
+	numPartitions := numAggregatorSpillPartitions
+	if s.level > ag.maxSpillLevel() {
+		s.sorted = true
+		numPartitions = 1
+		ordering = make(sqlbase.ColumnOrdering, len(ag.groupCols))
+		for i, c := range ag.groupCols {
+			ordering[i] = sqlbase.ColumnOrderInfo{ColIdx: int(c), Direction: encoding.Ascending}
+		}
+	}
+	s.partitions = make([]diskRowContainer, numPartitions)
+	for i := range s.partitions {
+		s.partitions[i] = makeDiskRowContainer(
+			ctx, ag.spiller.diskMonitor(ctx), types, ordering, ag.tempStorage,
+			ag.flowCtx.tempStorageNamespace,
+		)
+	}
+}
+
+// addRow writes the given row, whose encoded group key is groupKey, to its
+// partition.
+func (s *aggregatorSpill) addRow(
+	ctx context.Context, groupKey []byte, row sqlbase.EncDatumRow,
+) error {
+	if len(s.partitions) == 1 {
+		return s.partitions[0].AddRow(ctx, row)
+	}
+	// FNV-1a hash of the level followed by the key.
+	h := uint32(fnv32Offset)
+	h ^= uint32(s.level)
+	h *= fnv32Prime
+	for _, c := range groupKey {
+		h ^= uint32(c)
+		h *= fnv32Prime
+	}
+	return s.partitions[h%uint32(len(s.partitions))].AddRow(ctx, row)
+}
+
+func (s *aggregatorSpill) close(ctx context.Context) {
+	for i := range s.partitions {
+		s.partitions[i].Close(ctx)
+	}
+	s.partitions = nil
+}
+
+// groupMemUsage is the memory used by a group, as recorded into the trace of
+// the aggregator.
+type groupMemUsage struct {
+	// key is the formatted group key.
+	key   string
+	bytes int64
+}
+
+// aggregatorTraceGroups is the number of groups using the most memory that a
+// traced aggregator records into its span.
+const aggregatorTraceGroups = 10
+
+// noteLargestGroups updates largestGroups with the groups currently held in
+// memory, either by ag or by its shards.
+func (ag *aggregator) noteLargestGroups() {
+	bucketMaps := []map[string]aggregateFuncs{ag.buckets}
+	if ag.shards != nil {
+		for _, shard := range ag.shards.shards {
+			bucketMaps = append(bucketMaps, shard.buckets)
+		}
+	}
+	for _, buckets := range bucketMaps {
+		for key, funcs := range buckets {
+			ag.noteGroup(key, funcs)
 		}
-		scratch = encoded[:0]
 	}
 }
 
+// noteGroup updates largestGroups with the given group.
+func (ag *aggregator) noteGroup(key string, funcs aggregateFuncs) {
+	bytes := bucketSize(len(key), funcs) + funcs.allocated()
+	n := len(ag.largestGroups)
+	if n == aggregatorTraceGroups && bytes <= ag.largestGroups[n-1].bytes {
+		return
+	}
+	i := sort.Search(n, func(i int) bool { return ag.largestGroups[i].bytes < bytes })
+	if n < aggregatorTraceGroups {
+		ag.largestGroups = append(ag.largestGroups, groupMemUsage{})
+	}
+	copy(ag.largestGroups[i+1:], ag.largestGroups[i:])
+	ag.largestGroups[i] = groupMemUsage{key: ag.formatGroupKey(key), bytes: bytes}
+}
+
+// formatGroupKey returns the values of the group columns encoded in the given
+// group key.
+func (ag *aggregator) formatGroupKey(key string) string {
+	enc := sqlbase.DatumEncoding_VALUE
+	if ag.sortOutput {
+		enc = sqlbase.DatumEncoding_ASCENDING_KEY
+	}
+	types := ag.input.Types()
+	row := make(sqlbase.EncDatumRow, len(ag.groupCols))
+	buf := []byte(key)
+	for i, c := range ag.groupCols {
+		var err error
+		if row[i], buf, err = sqlbase.EncDatumFromBuffer(types[c], enc, buf); err != nil {
+			return fmt.Sprintf("<error: %v>", err)
+		}
+	}
+	return row.String()
+}
+
+// traceLargestGroups records the groups using the most memory, including
+// those currently held in memory, into the span of the aggregator. It is a
+// no-op if the aggregator isn't traced.
+func (ag *aggregator) traceLargestGroups(ctx context.Context) {
+	if !ag.traceGroups {
+		return
+	}
+	ag.noteLargestGroups()
+	// The groups still held in memory must not be recorded again when they
+	// are released.
+	ag.traceGroups = false
+	for i, g := range ag.largestGroups {
+		log.VEventf(ctx, 2, "largest group #%d: %s using %s",
+			i+1, g.key, humanizeutil.IBytes(g.bytes))
+	}
+}
+
+// aggregatorProgressRows is the number of input rows the aggregator consumes
+// between two reports of its progress.
+const aggregatorProgressRows = 100000
+
+// aggregatorShardBatchSize is the number of rows handed to a shard at once.
+const aggregatorShardBatchSize = 128
+
+// The parameters of the 32-bit FNV-1a hash assigning groups to shards.
+const (
+	fnv32Offset = 2166136261
+	fnv32Prime  = 16777619
+)
+
+// aggregatorShards partitions the groups of an aggregator among several
+// shards according to a hash of their group key. Each shard is an aggregator
+// with its own buckets, distinct sets and memory account, which accumulates
+// the rows of its groups in its own goroutine. The groups of all the shards
+// are rendered by the parent aggregator once the input is exhausted.
+type aggregatorShards struct {
+	shards []*aggregator
+	// batches are the channels on which batches of rows are sent to the
+	// shards, and pending holds the batch being filled for each shard.
+	batches []chan aggregatorShardBatch
+	pending []aggregatorShardBatch
+	// errCh receives the error of each shard which fails. A failed shard keeps
+	// draining its channel without accumulating rows.
+	errCh    chan error
+	wg       sync.WaitGroup
+	rowAlloc sqlbase.EncDatumRowAlloc
+	started  bool
+}
+
+// aggregatorShardBatch is a batch of rows along with their group keys.
+type aggregatorShardBatch struct {
+	keys [][]byte
+	rows []sqlbase.EncDatumRow
+	// keyBuf holds the contents of keys.
+	keyBuf []byte
+}
+
+func newAggregatorShards(ag *aggregator, numShards int) (*aggregatorShards, error) {
+	s := &aggregatorShards{
+		shards:  make([]*aggregator, numShards),
+		batches: make([]chan aggregatorShardBatch, numShards),
+		pending: make([]aggregatorShardBatch, numShards),
+		errCh:   make(chan error, numShards),
+	}
+	for i := range s.shards {
+		// The aggregate functions of each shard get their own evaluation
+		// context, since it holds scratch space.
+		evalCtx := ag.flowCtx.EvalCtx
+		shard := &aggregator{
+			flowCtx:      ag.flowCtx,
+			evalCtx:      &evalCtx,
+			input:        ag.input,
+			groupCols:    ag.groupCols,
+			aggregations: ag.aggregations,
+			buckets:      make(map[string]aggregateFuncs),
+			funcs:        make([]*aggregateFuncHolder, len(ag.aggregations)),
+			outputTypes:  make([]sqlbase.ColumnType, len(ag.aggregations)),
+			bucketsAcc:   ag.flowCtx.EvalCtx.Mon.MakeBoundAccount(),
+		}
+		if err := shard.initFuncs(ag.input.Types()); err != nil {
+			return nil, err
+		}
+		s.shards[i] = shard
+	}
+	return s, nil
+}
+
+// start starts the goroutines of the shards.
+func (s *aggregatorShards) start(ctx context.Context) {
+	s.started = true
+	for i, shard := range s.shards {
+		s.batches[i] = make(chan aggregatorShardBatch, 2)
+		s.wg.Add(1)
+		go func(shard *aggregator, batches <-chan aggregatorShardBatch) {
+			defer s.wg.Done()
+			failed := false
+			for batch := range batches {
+				if failed {
+					continue
+				}
+				for j, row := range batch.rows {
+					if err := shard.accumulateGroupRow(ctx, batch.keys[j], row); err != nil {
+						s.errCh <- err
+						failed = true
+						break
+					}
+				}
+				atomic.StoreInt64(&shard.accumulatedBytes, shard.bucketsAcc.CurrentlyAllocated())
+			}
+		}(shard, s.batches[i])
+	}
+}
+
+// addRow hands the given row, whose group key is given, to the shard
+// accumulating its group. It returns the error of a failed shard, if any.
+func (s *aggregatorShards) addRow(
+	ctx context.Context, groupKey []byte, row sqlbase.EncDatumRow,
+) error {
+	// Compute the FNV-1a hash of the key inline; hash/fnv would allocate a
+	// hasher per row.
+	h := uint32(fnv32Offset)
+	for _, c := range groupKey {
+		h ^= uint32(c)
+		h *= fnv32Prime
+	}
+	i := h % uint32(len(s.shards))
+	b := &s.pending[i]
+	start := len(b.keyBuf)
+	b.keyBuf = append(b.keyBuf, groupKey...)
+	b.keys = append(b.keys, b.keyBuf[start:len(b.keyBuf):len(b.keyBuf)])
+	b.rows = append(b.rows, s.rowAlloc.CopyRow(row))
+	if len(b.rows) >= aggregatorShardBatchSize {
+		s.send(int(i))
+	}
+	select {
+	case err := <-s.errCh:
+		return err
+	default:
+		return nil
+	}
+}
+
+// send hands the pending batch of the given shard to it.
+func (s *aggregatorShards) send(i int) {
+	s.batches[i] <- s.pending[i]
+	s.pending[i] = aggregatorShardBatch{}
+}
+
+// wait hands the pending rows to the shards and waits for them to accumulate
+// all the rows. It returns the error of a failed shard, if any.
+func (s *aggregatorShards) wait() error {
+	if !s.started {
+		return nil
+	}
+	s.started = false
+	for i := range s.batches {
+		if len(s.pending[i].rows) > 0 {
+			s.send(i)
+		}
+		close(s.batches[i])
+	}
+	s.wg.Wait()
+	select {
+	case err := <-s.errCh:
+		return err
+	default:
+		return nil
+	}
+}
+
+// close releases the memory accounts of the shards. Their buckets must have
+// been released.
+func (s *aggregatorShards) close(ctx context.Context) {
+	for _, shard := range s.shards {
+		shard.bucketsAcc.Close(ctx)
+	}
+}
+
+// aggregateFuncs holds the aggregate functions of a group, one per
+// aggregation.
+type aggregateFuncs []parser.AggregateFunc
+
+// newAggregateFuncs creates the aggregate functions of a new group.
+func (ag *aggregator) newAggregateFuncs() aggregateFuncs {
+	funcs := make(aggregateFuncs, len(ag.funcs))
+	for i, f := range ag.funcs {
+		funcs[i] = f.create(ag.evalCtx)
+	}
+	return funcs
+}
+
+// bucketSize returns the memory accounted for a bucket whose key has the given
+// length: the key, the aggregate functions and the bucket's entry in the
+// buckets map.
+func bucketSize(keyLen int, funcs aggregateFuncs) int64 {
+	return int64(keyLen) + funcs.size() + sizeOfAggBucketsEntry
+}
+
+// size returns the memory used by the aggregate functions, including the
+// slice holding them.
+func (funcs aggregateFuncs) size() int64 {
+	size := int64(len(funcs)) * sizeOfAggregateFunc
+	for _, f := range funcs {
+		size += f.Size()
+	}
+	return size
+}
+
+// allocated returns the memory allocated by the aggregate functions during
+// aggregation.
+func (funcs aggregateFuncs) allocated() int64 {
+	var size int64
+	for _, f := range funcs {
+		size += parser.AggregateFuncAllocated(f)
+	}
+	return size
+}
+
+func (funcs aggregateFuncs) close(ctx context.Context) {
+	for _, f := range funcs {
+		f.Close(ctx)
+	}
+}
+
+// aggregateFuncHolder describes an aggregation. The aggregate functions of
+// each group are held in aggregator.buckets.
 type aggregateFuncHolder struct {
-	create        func(*parser.EvalContext) parser.AggregateFunc
-	group         *aggregator
-	buckets       map[string]parser.AggregateFunc
-	seen          map[string]struct{}
+	create func(*parser.EvalContext) parser.AggregateFunc
+	group  *aggregator
+	// seen is set for DISTINCT aggregations. It can be shared with other
+	// aggregations.
+	seen *distinctSet
+	// numOtherArgs is the number of arguments beyond the first. The values
+	// passed to add after them are those of the ordering columns, which are not
+	// part of the values made distinct.
+	numOtherArgs  int
 	bucketsMemAcc *mon.BoundAccount
+	// filter is the FILTER expression of the aggregation, if any.
+	filter exprHelper
+}
+
+// distinctSet holds the (group key, arguments) tuples already aggregated by
+// the DISTINCT aggregations on the same arguments. Sharing the set avoids
+// storing each tuple once per aggregation.
+type distinctSet struct {
+	// seen holds the encoded tuples, whose strings are allocated by keys.
+	seen map[string]struct{}
+	keys keyAlloc
+	// bytes is the memory of the tuples accounted for by isDuplicate.
+	bytes int64
+	// scratch is used to encode the tuple of each row.
+	scratch []byte
+	// rowIdx is the index of the last row checked against the set, and
+	// duplicate is whether its value had been seen before. The first
+	// aggregation to check a row adds its value to the set; the others reuse
+	// the result.
+	rowIdx    int64
+	duplicate bool
+}
+
+func newDistinctSet() *distinctSet {
+	return &distinctSet{seen: make(map[string]struct{})}
+}
+
+// reset empties the set, and releases the memory of its tuples from acc, the
+// account passed to isDuplicate.
+func (s *distinctSet) reset(ctx context.Context, acc *mon.BoundAccount) {
+	acc.Shrink(ctx, s.bytes)
+	s.bytes = 0
+	s.seen = make(map[string]struct{})
+	s.keys = keyAlloc{}
+}
+
+// isDuplicate returns whether the arguments of the row with the given index
+// had already been seen together in the given bucket, and adds them to the set
+// if not. The memory of the encoded tuple is accounted for by acc.
+func (s *distinctSet) isDuplicate(
+	ctx context.Context,
+	acc *mon.BoundAccount,
+	rowIdx int64,
+	bucket []byte,
+	d parser.Datum,
+	otherArgs ...parser.Datum,
+) (bool, error) {
+	if rowIdx == s.rowIdx {
+		return s.duplicate, nil
+	}
+	encoded, err := sqlbase.EncodeDatum(append(s.scratch[:0], bucket...), d)
+	if err != nil {
+		return false, err
+	}
+	for _, arg := range otherArgs {
+		if encoded, err = sqlbase.EncodeDatum(encoded, arg); err != nil {
+			return false, err
+		}
+	}
+	s.scratch = encoded
+	// Looking up a converted []byte doesn't allocate.
+	_, duplicate := s.seen[string(encoded)]
+	if !duplicate {
+		size := int64(len(encoded)) + sizeOfSeenEntry
+		if err := acc.Grow(ctx, size); err != nil {
+			return false, err
+		}
+		s.bytes += size
+		s.seen[s.keys.intern(encoded)] = struct{}{}
+	}
+	s.rowIdx, s.duplicate = rowIdx, duplicate
+	return duplicate, nil
+}
+
+// The chunks of memory holding the keys allocated by a keyAlloc start small,
+// so that aggregations with few groups don't waste memory, and double in size
+// up to keyAllocMaxChunkSize.
+const (
+	keyAllocMinChunkSize = 256
+	keyAllocMaxChunkSize = 16 << 10
+)
+
+// keyAlloc allocates the strings used as keys of the aggregator's maps. The
+// keys are copied into large chunks of memory rather than allocated one at a
+// time, which saves an allocation per group in high-cardinality aggregations.
+type keyAlloc struct {
+	chunk []byte
+}
+
+// intern returns a string holding a copy of b. The memory of the string is
+// never modified; it is released once all the strings sharing its chunk are
+// unreachable.
+func (a *keyAlloc) intern(b []byte) string {
+	if len(b) > keyAllocMaxChunkSize/8 {
+		// Don't waste the rest of the chunk on a large key.
+		return string(b)
+	}
+	if len(b) > cap(a.chunk)-len(a.chunk) {
+		size := 2 * cap(a.chunk)
+		if size < keyAllocMinChunkSize {
+			size = keyAllocMinChunkSize
+		} else if size > keyAllocMaxChunkSize {
+			size = keyAllocMaxChunkSize
+		}
+		if size < len(b) {
+			size = len(b)
+		}
+		a.chunk = make([]byte, 0, size)
+	}
+	start := len(a.chunk)
+	a.chunk = append(a.chunk, b...)
+	key := a.chunk[start:len(a.chunk):len(a.chunk)]
+	return *(*string)(unsafe.Pointer(&key))
 }
 
 const sizeOfAggregateFunc = int64(unsafe.Sizeof(parser.AggregateFunc(nil)))
 
+var (
+	// sizeOfAggBucketsEntry is the memory used by an entry of the buckets map,
+	// besides its key and aggregate functions.
+	sizeOfAggBucketsEntry = mapEntryOverhead(sizeOfString, int64(unsafe.Sizeof(aggregateFuncs(nil))))
+	// sizeOfSeenEntry is the memory used by an entry of distinctSet.seen,
+	// besides its key.
+	sizeOfSeenEntry = mapEntryOverhead(sizeOfString, 0)
+)
+
 func (ag *aggregator) newAggregateFuncHolder(
 	create func(*parser.EvalContext) parser.AggregateFunc,
 ) *aggregateFuncHolder {
 	return &aggregateFuncHolder{
 		create:        create,
 		group:         ag,
-		buckets:       make(map[string]parser.AggregateFunc),
 		bucketsMemAcc: &ag.bucketsAcc,
 	}
 }
 
-func (a *aggregateFuncHolder) add(ctx context.Context, bucket []byte, d parser.Datum) error {
+// add accumulates a value into impl, the aggregate function of this
+// aggregation for the given bucket.
+func (a *aggregateFuncHolder) add(
+	ctx context.Context,
+	bucket []byte,
+	impl parser.AggregateFunc,
+	d parser.Datum,
+	otherArgs ...parser.Datum,
+) error {
 	if a.seen != nil {
-		encoded, err := sqlbase.EncodeDatum(bucket, d)
+		duplicate, err := a.seen.isDuplicate(
+			ctx, a.bucketsMemAcc, a.group.rowIdx, bucket, d, otherArgs[:a.numOtherArgs]...,
+		)
 		if err != nil {
 			return err
 		}
-		if _, ok := a.seen[string(encoded)]; ok {
+		if duplicate {
 			// skip
 			return nil
 		}
-		if err := a.bucketsMemAcc.Grow(ctx, int64(len(encoded))); err != nil {
-			return err
-		}
-		a.seen[string(encoded)] = struct{}{}
 	}
 
-	impl, ok := a.buckets[string(bucket)]
-	if !ok {
-		// TODO(radu): we should account for the size of impl (this needs to be done
-		// in each aggregate constructor).
-		impl = a.create(&a.group.flowCtx.EvalCtx)
-		usage := int64(len(bucket))
-		usage += sizeOfAggregateFunc
-		// TODO(radu): this model of each func having a map of buckets (one per
-		// group) for each func plus a global map is very wasteful. We should have a
-		// single map that stores all the AggregateFuncs.
-		if err := a.bucketsMemAcc.Grow(ctx, usage); err != nil {
-			return err
-		}
-		a.buckets[string(bucket)] = impl
-	}
-
-	return impl.Add(ctx, d)
+	return impl.Add(ctx, d, otherArgs...)
 }
 
-func (a *aggregateFuncHolder) get(bucket string) (parser.Datum, error) {
-	found, ok := a.buckets[bucket]
-	if !ok {
-		found = a.create(&a.group.flowCtx.EvalCtx)
+// encode returns the encoding for the given grouping columns. The encoding of
+// all the grouping columns is used as our group key to determine which bucket
+// to add to. If the output is sorted, the columns are key-encoded so that the
+// group keys sort like the group columns.
+func (ag *aggregator) encode(
+	appendTo []byte, cols columns, row sqlbase.EncDatumRow,
+) (encoding []byte, err error) {
+	enc := sqlbase.DatumEncoding_VALUE
+	if ag.sortOutput {
+		enc = sqlbase.DatumEncoding_ASCENDING_KEY
 	}
-
-	return found.Result()
+	return ag.encodeAs(appendTo, enc, cols, row)
 }
 
-// encode returns the encoding for the grouping columns, this is then used as
-// our group key to determine which bucket to add to.
-func (ag *aggregator) encode(
-	appendTo []byte, row sqlbase.EncDatumRow,
-) (encoding []byte, err error) {
-	for _, colIdx := range ag.groupCols {
-		appendTo, err = row[colIdx].Encode(&ag.datumAlloc, sqlbase.DatumEncoding_VALUE, appendTo)
+// encodeAs appends the encoding of the given columns of the row, using the
+// given encoding.
+func (ag *aggregator) encodeAs(
+	appendTo []byte, enc sqlbase.DatumEncoding, cols columns, row sqlbase.EncDatumRow,
+) ([]byte, error) {
+	for _, colIdx := range cols {
+		var err error
+		appendTo, err = row[colIdx].Encode(&ag.datumAlloc, enc, appendTo)
 		if err != nil {
 			return appendTo, err
 		}
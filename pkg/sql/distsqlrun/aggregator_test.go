@@ -15,16 +15,25 @@
 package distsqlrun
 
 import (
+	"fmt"
+	"math"
 	"sort"
 	"strings"
 	"testing"
 
 	"golang.org/x/net/context"
 
+	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 )
 
 // TODO(irfansharif): Add tests to verify the following aggregation functions:
@@ -49,6 +58,17 @@ func TestAggregator(t *testing.T) {
 	boolFalse := sqlbase.DatumToEncDatum(columnTypeBool, parser.DBoolFalse)
 	boolNULL := sqlbase.DatumToEncDatum(columnTypeBool, parser.DNull)
 
+	columnTypeFloat := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_FLOAT}
+	floatEncDatum := func(f float64) sqlbase.EncDatum {
+		return sqlbase.DatumToEncDatum(columnTypeFloat, parser.NewDFloat(parser.DFloat(f)))
+	}
+
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	strEncDatum := func(s string) sqlbase.EncDatum {
+		return sqlbase.DatumToEncDatum(columnTypeString, parser.NewDString(s))
+	}
+	strNULL := sqlbase.DatumToEncDatum(columnTypeString, parser.DNull)
+
 	colPtr := func(idx uint32) *uint32 { return &idx }
 
 	testCases := []struct {
@@ -124,6 +144,70 @@ func TestAggregator(t *testing.T) {
 				{v[2], v[3]},
 			},
 		},
+		{
+			// SELECT @2, COUNT(@1), GROUP BY @2, with the input ordered on @2.
+			spec: AggregatorSpec{
+				GroupCols:        []uint32{1},
+				OrderedGroupCols: []uint32{1},
+				Aggregations: []AggregatorSpec_Aggregation{
+					{
+						Func:   AggregatorSpec_IDENT,
+						ColIdx: []uint32{1},
+					},
+					{
+						Func:   AggregatorSpec_COUNT,
+						ColIdx: []uint32{0},
+					},
+				},
+			},
+			input: sqlbase.EncDatumRows{
+				{v[3], null},
+				{v[1], v[2]},
+				{v[6], v[2]},
+				{v[7], v[2]},
+				{v[8], v[4]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{null, v[1]},
+				{v[2], v[3]},
+				{v[4], v[1]},
+			},
+		},
+		{
+			// SELECT @1, @2, SUM(@3), GROUP BY @1, @2, with the input ordered on @1.
+			spec: AggregatorSpec{
+				GroupCols:        []uint32{0, 1},
+				OrderedGroupCols: []uint32{0},
+				Aggregations: []AggregatorSpec_Aggregation{
+					{
+						Func:   AggregatorSpec_IDENT,
+						ColIdx: []uint32{0},
+					},
+					{
+						Func:   AggregatorSpec_IDENT,
+						ColIdx: []uint32{1},
+					},
+					{
+						Func:   AggregatorSpec_SUM_INT,
+						ColIdx: []uint32{2},
+					},
+				},
+			},
+			input: sqlbase.EncDatumRows{
+				{v[1], v[2], v[1]},
+				{v[1], v[3], v[2]},
+				{v[1], v[2], v[3]},
+				{v[2], v[3], v[4]},
+				{v[2], v[3], v[5]},
+				{v[3], v[2], v[6]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[1], v[2], v[4]},
+				{v[1], v[3], v[2]},
+				{v[2], v[3], v[9]},
+				{v[3], v[2], v[6]},
+			},
+		},
 		{
 			// SELECT @2, COUNT(@1), GROUP BY @2.
 			spec: AggregatorSpec{
@@ -304,57 +388,1001 @@ func TestAggregator(t *testing.T) {
 			expected: sqlbase.EncDatumRows{
 				{v[2], v[3], v[3]},
 			},
+		}, {
+			// SELECT COUNT(DISTINCT @1), SUM(DISTINCT @1), COUNT(DISTINCT @1) FILTER @2
+			// The first two aggregations share their set of seen values, the third
+			// one doesn't as it sees different rows.
+			spec: AggregatorSpec{
+				Aggregations: []AggregatorSpec_Aggregation{
+					{
+						Func:     AggregatorSpec_COUNT,
+						Distinct: true,
+						ColIdx:   []uint32{0},
+					},
+					{
+						Func:     AggregatorSpec_SUM,
+						Distinct: true,
+						ColIdx:   []uint32{0},
+					},
+					{
+						Func:         AggregatorSpec_COUNT,
+						Distinct:     true,
+						ColIdx:       []uint32{0},
+						FilterColIdx: colPtr(1),
+					},
+				},
+			},
+			input: sqlbase.EncDatumRows{
+				{v[2], boolTrue},
+				{v[4], boolFalse},
+				{v[2], boolTrue},
+				{v[4], boolTrue},
+				{v[2], boolFalse},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[2], v[6], v[2]},
+			},
+		}, {
+			// SELECT COUNT(DISTINCT @1, @2), COUNT(DISTINCT @2, @1), COUNT(DISTINCT @1),
+			//   STRING_AGG(DISTINCT @3, @4)
+			spec: AggregatorSpec{
+				Aggregations: []AggregatorSpec_Aggregation{
+					{
+						Func:     AggregatorSpec_COUNT,
+						Distinct: true,
+						ColIdx:   []uint32{0, 1},
+					},
+					{
+						Func:     AggregatorSpec_COUNT,
+						Distinct: true,
+						ColIdx:   []uint32{1, 0},
+					},
+					{
+						Func:     AggregatorSpec_COUNT,
+						Distinct: true,
+						ColIdx:   []uint32{0},
+					},
+					{
+						Func:     AggregatorSpec_STRING_AGG,
+						Distinct: true,
+						ColIdx:   []uint32{2, 3},
+					},
+				},
+			},
+			input: sqlbase.EncDatumRows{
+				{v[1], v[2], strEncDatum("a"), strEncDatum(",")},
+				{v[1], v[3], strEncDatum("a"), strEncDatum(",")},
+				{v[1], v[2], strEncDatum("a"), strEncDatum("-")},
+				{v[2], null, strEncDatum("b"), strEncDatum(",")},
+				{v[2], v[1], strEncDatum("a"), strEncDatum(",")},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[3], v[3], v[2], strEncDatum("a-a,b")},
+			},
+		}, {
+			// SELECT SUM(@1) FILTER (WHERE @2 > 1), COUNT(DISTINCT @1) FILTER (WHERE @1 < 4),
+			// COUNT(@1) FILTER @3 FILTER (WHERE @2 > 1)
+			spec: AggregatorSpec{
+				Aggregations: []AggregatorSpec_Aggregation{
+					{
+						Func:   AggregatorSpec_SUM,
+						ColIdx: []uint32{0},
+						Filter: Expression{Expr: "@2 > 1"},
+					},
+					{
+						Func:     AggregatorSpec_COUNT,
+						Distinct: true,
+						ColIdx:   []uint32{0},
+						Filter:   Expression{Expr: "@1 < 4"},
+					},
+					{
+						Func:         AggregatorSpec_COUNT,
+						ColIdx:       []uint32{0},
+						FilterColIdx: colPtr(2),
+						Filter:       Expression{Expr: "@2 > 1"},
+					},
+				},
+			},
+			input: sqlbase.EncDatumRows{
+				{v[1], v[2], boolTrue},
+				{v[3], v[1], boolTrue},
+				{v[3], v[3], boolFalse},
+				{v[5], v[4], boolTrue},
+				{v[1], null, boolTrue},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[9], v[2], v[2]},
+			},
+		}, {
+			// SELECT STRING_AGG(@1, @2), STRING_AGG(@1, ',') GROUP BY []
+			spec: AggregatorSpec{
+				Aggregations: []AggregatorSpec_Aggregation{
+					{
+						Func:   AggregatorSpec_STRING_AGG,
+						ColIdx: []uint32{0, 1},
+					},
+					{
+						Func:   AggregatorSpec_STRING_AGG,
+						ColIdx: []uint32{0, 2},
+					},
+				},
+			},
+			input: sqlbase.EncDatumRows{
+				{strEncDatum("a"), strEncDatum("-"), strEncDatum(",")},
+				{strEncDatum("b"), strEncDatum("+"), strEncDatum(",")},
+				{strNULL, strEncDatum("*"), strEncDatum(",")},
+				{strEncDatum("c"), strEncDatum("/"), strEncDatum(",")},
+			},
+			expected: sqlbase.EncDatumRows{
+				{strEncDatum("a+b/c"), strEncDatum("a,b,c")},
+			},
+		}, {
+			// SELECT STRING_AGG(@1, @2), STRING_AGG(@1, @2) SKIP NULLS GROUP BY []
+			spec: AggregatorSpec{
+				Aggregations: []AggregatorSpec_Aggregation{
+					{
+						Func:   AggregatorSpec_STRING_AGG,
+						ColIdx: []uint32{0, 1},
+					},
+					{
+						Func:      AggregatorSpec_STRING_AGG,
+						ColIdx:    []uint32{0, 1},
+						SkipNulls: true,
+					},
+				},
+			},
+			input: sqlbase.EncDatumRows{
+				{strEncDatum("a"), strEncDatum("-")},
+				{strEncDatum("b"), strNULL},
+				{strNULL, strEncDatum("+")},
+				{strEncDatum("c"), strEncDatum("/")},
+			},
+			expected: sqlbase.EncDatumRows{
+				{strEncDatum("ab/c"), strEncDatum("a/c")},
+			},
+		}, {
+			// SELECT REGR_COUNT(@1, @2), REGR_SLOPE(@1, @2), REGR_INTERCEPT(@1, @2)
+			spec: AggregatorSpec{
+				Aggregations: []AggregatorSpec_Aggregation{
+					{
+						Func:   AggregatorSpec_REGR_COUNT,
+						ColIdx: []uint32{0, 1},
+					},
+					{
+						Func:   AggregatorSpec_REGR_SLOPE,
+						ColIdx: []uint32{0, 1},
+					},
+					{
+						Func:   AggregatorSpec_REGR_INTERCEPT,
+						ColIdx: []uint32{0, 1},
+					},
+				},
+			},
+			input: sqlbase.EncDatumRows{
+				{v[1], v[1]},
+				{v[3], v[2]},
+				{v[5], v[3]},
+				{null, v[4]},
+				{v[7], null},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[3], floatEncDatum(2), floatEncDatum(-1)},
+			},
+		}, {
+			// SELECT @1, FIRST_VALUE(@2 ORDER BY @3), LAST_VALUE(@2 ORDER BY @3),
+			//   FIRST_VALUE(@2 ORDER BY @3 DESC, @4), ANY_VALUE(@2) GROUP BY @1
+			spec: AggregatorSpec{
+				GroupCols: []uint32{0},
+				Aggregations: []AggregatorSpec_Aggregation{
+					{
+						Func:   AggregatorSpec_IDENT,
+						ColIdx: []uint32{0},
+					},
+					{
+						Func:   AggregatorSpec_FIRST_VALUE,
+						ColIdx: []uint32{1},
+						Ordering: Ordering{Columns: []Ordering_Column{
+							{ColIdx: 2, Direction: Ordering_Column_ASC},
+						}},
+					},
+					{
+						Func:   AggregatorSpec_LAST_VALUE,
+						ColIdx: []uint32{1},
+						Ordering: Ordering{Columns: []Ordering_Column{
+							{ColIdx: 2, Direction: Ordering_Column_ASC},
+						}},
+					},
+					{
+						Func:   AggregatorSpec_FIRST_VALUE,
+						ColIdx: []uint32{1},
+						Ordering: Ordering{Columns: []Ordering_Column{
+							{ColIdx: 2, Direction: Ordering_Column_DESC},
+							{ColIdx: 3, Direction: Ordering_Column_ASC},
+						}},
+					},
+					{
+						Func:   AggregatorSpec_ANY_VALUE,
+						ColIdx: []uint32{1},
+					},
+				},
+			},
+			input: sqlbase.EncDatumRows{
+				{v[1], v[5], v[2], v[1]},
+				{v[1], null, v[1], v[0]},
+				{v[1], v[6], v[3], v[2]},
+				{v[1], v[7], v[3], v[1]},
+				{v[2], v[8], null, v[0]},
+			},
+			expected: sqlbase.EncDatumRows{
+				{v[1], null, v[7], v[7], v[5]},
+				{v[2], v[8], v[8], v[8], v[8]},
+			},
+		},
+	}
+
+	// Run the test cases with a single aggregator, and with groups partitioned
+	// among several shards.
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("Workers=%d", workers), func(t *testing.T) {
+			for _, c := range testCases {
+				t.Run("", func(t *testing.T) {
+					ags := c.spec
+
+					var types []sqlbase.ColumnType
+					if len(c.input) == 0 {
+						types = []sqlbase.ColumnType{columnTypeInt}
+					}
+					in := NewRowBuffer(types, c.input, RowBufferArgs{})
+					out := &RowBuffer{}
+					evalCtx := parser.MakeTestingEvalContext()
+					defer evalCtx.Stop(context.Background())
+					flowCtx := FlowCtx{
+						Settings: cluster.MakeTestingClusterSettings(),
+						EvalCtx:  evalCtx,
+					}
+
+					ag, err := newAggregator(&flowCtx, &ags, in, &PostProcessSpec{}, out)
+					if err != nil {
+						t.Fatal(err)
+					}
+					ag.testingKnobWorkers = workers
+
+					ag.Run(context.Background(), nil)
+
+					var expected []string
+					for _, row := range c.expected {
+						expected = append(expected, row.String())
+					}
+					sort.Strings(expected)
+					expStr := strings.Join(expected, "")
+
+					var rets []string
+					for {
+						row, meta := out.Next()
+						if !meta.Empty() {
+							t.Fatalf("unexpected metadata: %v", meta)
+						}
+						if row == nil {
+							break
+						}
+						rets = append(rets, row.String())
+					}
+					sort.Strings(rets)
+					retStr := strings.Join(rets, "")
+
+					if expStr != retStr {
+						t.Errorf("invalid results; expected:\n   %s\ngot:\n   %s",
+							expStr, retStr)
+					}
+				})
+			}
+		})
+	}
+}
+
+// TestAggregatorSortOutput verifies that the aggregator emits the groups in
+// the order of the group columns when configured to.
+func TestAggregatorSortOutput(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const numRows = 200
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	intEncDatum := func(i int) sqlbase.EncDatum {
+		return sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i)))
+	}
+	null := sqlbase.EncDatum{Datum: parser.DNull}
+
+	// The groups are on (@1, @2), where @1 is NULL for some rows and @2 takes
+	// negative values; the rows of each group are scattered across the input.
+	rng, _ := randutil.NewPseudoRand()
+	input := make(sqlbase.EncDatumRows, numRows)
+	for i := range input {
+		a := null
+		if n := rng.Intn(6); n > 0 {
+			a = intEncDatum(n * 100)
+		}
+		input[i] = sqlbase.EncDatumRow{a, intEncDatum(rng.Intn(10) - 5)}
+	}
+
+	// SELECT @1, @2, COUNT(*) GROUP BY @1, @2.
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0, 1},
+		Aggregations: []AggregatorSpec_Aggregation{
+			{
+				Func:   AggregatorSpec_IDENT,
+				ColIdx: []uint32{0},
+			},
+			{
+				Func:   AggregatorSpec_IDENT,
+				ColIdx: []uint32{1},
+			},
+			{
+				Func: AggregatorSpec_COUNT_ROWS,
+			},
+		},
+		SortOutput: true,
+	}
+
+	ordering := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	}
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("Workers=%d", workers), func(t *testing.T) {
+			ctx := context.Background()
+			in := NewRowBuffer(types, input, RowBufferArgs{})
+			out := &RowBuffer{}
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{
+				Settings: cluster.MakeTestingClusterSettings(),
+				EvalCtx:  evalCtx,
+			}
+
+			ag, err := newAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ag.testingKnobWorkers = workers
+			ag.Run(ctx, nil)
+
+			var datumAlloc sqlbase.DatumAlloc
+			var prev sqlbase.EncDatumRow
+			count := 0
+			for {
+				row, meta := out.Next()
+				if !meta.Empty() {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if row == nil {
+					break
+				}
+				count += int(parser.MustBeDInt(row[2].Datum))
+				if prev != nil {
+					cmp, err := prev.Compare(&datumAlloc, ordering, &evalCtx, row)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if cmp >= 0 {
+						t.Errorf("group %s emitted after group %s", row[:2], prev[:2])
+					}
+				}
+				prev = row
+			}
+			if count != numRows {
+				t.Errorf("expected %d rows to be aggregated, got %d", numRows, count)
+			}
+		})
+	}
+}
+
+// TestAggregatorProgress verifies that the aggregator periodically reports
+// the number of rows it consumed.
+func TestAggregatorProgress(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const numRows = 100
+	const progressRows = 10
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt}
+	input := make(sqlbase.EncDatumRows, numRows)
+	for i := range input {
+		input[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i%7))),
+		}
+	}
+
+	// SELECT COUNT(*) GROUP BY @1.
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Aggregations: []AggregatorSpec_Aggregation{
+			{
+				Func: AggregatorSpec_COUNT_ROWS,
+			},
 		},
 	}
 
-	for _, c := range testCases {
-		t.Run("", func(t *testing.T) {
-			ags := c.spec
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("Workers=%d", workers), func(t *testing.T) {
+			ctx := context.Background()
+			in := NewRowBuffer(types, input, RowBufferArgs{})
+			out := &RowBuffer{}
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{
+				Settings: cluster.MakeTestingClusterSettings(),
+				EvalCtx:  evalCtx,
+			}
 
-			var types []sqlbase.ColumnType
-			if len(c.input) == 0 {
-				types = []sqlbase.ColumnType{columnTypeInt}
+			ag, err := newAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
 			}
-			in := NewRowBuffer(types, c.input, RowBufferArgs{})
+			ag.testingKnobWorkers = workers
+			ag.testingKnobProgressRows = progressRows
+			ag.Run(ctx, nil)
+
+			var reports []*ProcessorProgress
+			count := 0
+			for {
+				row, meta := out.Next()
+				if meta.Progress != nil {
+					if count > 0 {
+						t.Errorf("progress reported after the groups were emitted")
+					}
+					reports = append(reports, meta.Progress)
+					continue
+				}
+				if !meta.Empty() {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if row == nil {
+					break
+				}
+				count += int(parser.MustBeDInt(row[0].Datum))
+			}
+			if count != numRows {
+				t.Errorf("expected %d rows to be aggregated, got %d", numRows, count)
+			}
+			if len(reports) != numRows/progressRows {
+				t.Fatalf("expected %d progress reports, got %d", numRows/progressRows, len(reports))
+			}
+			for i, p := range reports {
+				if expected := int64((i + 1) * progressRows); p.RowsConsumed != expected {
+					t.Errorf("expected report %d to have %d rows consumed, got %d",
+						i, expected, p.RowsConsumed)
+				}
+				if p.Processor != "aggregator" {
+					t.Errorf("unexpected processor %q", p.Processor)
+				}
+			}
+			if workers == 1 {
+				if last := reports[len(reports)-1]; last.BytesAccumulated <= 0 {
+					t.Errorf("expected accumulated bytes to be reported, got %d", last.BytesAccumulated)
+				}
+			}
+		})
+	}
+}
+
+// TestAggregatorTraceLargestGroups verifies that a traced aggregator records
+// the groups using the most memory into its span.
+func TestAggregatorTraceLargestGroups(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const numGroups = 20
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	// Group 7 has many more rows than the other groups.
+	var input sqlbase.EncDatumRows
+	for i := 0; i < numGroups; i++ {
+		n := 1
+		if i == 7 {
+			n = 100
+		}
+		for j := 0; j < n; j++ {
+			input = append(input, sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i))),
+				sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(j))),
+			})
+		}
+	}
+
+	// SELECT ARRAY_AGG(@2) GROUP BY @1.
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Aggregations: []AggregatorSpec_Aggregation{
+			{
+				Func:   AggregatorSpec_ARRAY_AGG,
+				ColIdx: []uint32{1},
+			},
+		},
+	}
+
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("Workers=%d", workers), func(t *testing.T) {
+			ctx, sp, err := tracing.StartSnowballTrace(
+				context.Background(), tracing.NewTracer(), "test",
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sp.Finish()
+
+			in := NewRowBuffer(types, input, RowBufferArgs{})
 			out := &RowBuffer{}
 			evalCtx := parser.MakeTestingEvalContext()
-			defer evalCtx.Stop(context.Background())
+			defer evalCtx.Stop(ctx)
 			flowCtx := FlowCtx{
 				Settings: cluster.MakeTestingClusterSettings(),
 				EvalCtx:  evalCtx,
 			}
 
-			ag, err := newAggregator(&flowCtx, &ags, in, &PostProcessSpec{}, out)
+			ag, err := newAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
 			if err != nil {
 				t.Fatal(err)
 			}
+			ag.testingKnobWorkers = workers
+			ag.Run(ctx, nil)
 
-			ag.Run(context.Background(), nil)
+			var trace []tracing.RecordedSpan
+			numRows := 0
+			for {
+				row, meta := out.Next()
+				if meta.TraceData != nil {
+					trace = append(trace, meta.TraceData...)
+					continue
+				}
+				if !meta.Empty() {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if row == nil {
+					break
+				}
+				numRows++
+			}
+			if numRows != numGroups {
+				t.Errorf("expected %d groups, got %d", numGroups, numRows)
+			}
 
-			var expected []string
-			for _, row := range c.expected {
-				expected = append(expected, row.String())
+			var events []string
+			for _, rs := range trace {
+				if rs.Operation != "aggregator" {
+					continue
+				}
+				for _, l := range rs.Logs {
+					for _, f := range l.Fields {
+						if strings.Contains(f.Value, "largest group") {
+							events = append(events, f.Value)
+						}
+					}
+				}
+			}
+			if len(events) != aggregatorTraceGroups {
+				t.Fatalf("expected %d groups to be traced, got %d: %v",
+					aggregatorTraceGroups, len(events), events)
 			}
-			sort.Strings(expected)
-			expStr := strings.Join(expected, "")
+			if !strings.Contains(events[0], "largest group #1: [7] using") {
+				t.Errorf("expected group 7 to be traced first, got %q", events[0])
+			}
+		})
+	}
+}
+
+// TestAggregatorSpilling verifies that the aggregator produces the same results
+// when the groups don't fit within its memory limit and it falls back to
+// partitioning their rows on disk, and to sorting them once the maximum level
+// of partitioning is reached.
+func TestAggregatorSpilling(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const numRows = 200
+	const numGroups = 40
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	input := make(sqlbase.EncDatumRows, numRows)
+	for i := range input {
+		input[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i%numGroups))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i))),
+		}
+	}
+	var expected []string
+	for g := 0; g < numGroups; g++ {
+		var sum int
+		for i := g; i < numRows; i += numGroups {
+			sum += i
+		}
+		row := sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(g))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(sum))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(numRows/numGroups)),
+		}
+		expected = append(expected, row.String())
+	}
+	sort.Strings(expected)
+	expStr := strings.Join(expected, "")
+
+	// SELECT @1, SUM(@2), COUNT(DISTINCT @2) GROUP BY @1.
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Aggregations: []AggregatorSpec_Aggregation{
+			{
+				Func:   AggregatorSpec_IDENT,
+				ColIdx: []uint32{0},
+			},
+			{
+				Func:   AggregatorSpec_SUM_INT,
+				ColIdx: []uint32{1},
+			},
+			{
+				Func:     AggregatorSpec_COUNT,
+				Distinct: true,
+				ColIdx:   []uint32{1},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	diskMonitor := mon.MakeMonitor(
+		"test-disk",
+		mon.DiskResource,
+		nil, /* curCount */
+		nil, /* maxHist */
+		-1,  /* increment: use default block size */
+		math.MaxInt64,
+	)
+	diskMonitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer diskMonitor.Stop(ctx)
+	flowCtx := FlowCtx{
+		EvalCtx:     evalCtx,
+		Settings:    cluster.MakeTestingClusterSettings(),
+		tempStorage: tempEngine,
+		diskMonitor: &diskMonitor,
+	}
 
-			var rets []string
+	// Test with several memory limits:
+	// 0: Use the default limit; nothing is spilled.
+	// 1: Not even a single group fits in memory, which is an error.
+	// 512, 2048: The rows of some of the groups are partitioned on disk, and
+	//   the partitions are aggregated one at a time.
+	// 1 << 20: A memory limit that should not be hit.
+	// Each limit is tested with the default maximum level of partitioning, and
+	// with a single level, past which the rows of the groups that still don't
+	// fit are sorted on disk and aggregated one group at a time.
+	for _, memLimit := range []int64{0, 1, 512, 2048, 1 << 20} {
+		for _, maxSpillLevel := range []int{0, 1} {
+			name := fmt.Sprintf("MemLimit=%d/MaxSpillLevel=%d", memLimit, maxSpillLevel)
+			t.Run(name, func(t *testing.T) {
+				in := NewRowBuffer(types, input, RowBufferArgs{})
+				out := &RowBuffer{}
+
+				ag, err := newAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ag.testingKnobMemLimit = memLimit
+				ag.testingKnobMaxSpillLevel = maxSpillLevel
+				ag.Run(ctx, nil)
+				if !out.ProducerClosed {
+					t.Fatalf("output RowReceiver not closed")
+				}
+
+				var rets []string
+				for {
+					row, meta := out.Next()
+					if meta.Err != nil {
+						if memLimit == 1 && testutils.IsError(meta.Err, "memory budget exceeded") {
+							return
+						}
+						t.Fatalf("unexpected error: %v", meta.Err)
+					}
+					if !meta.Empty() {
+						t.Fatalf("unexpected metadata: %v", meta)
+					}
+					if row == nil {
+						break
+					}
+					rets = append(rets, row.String())
+				}
+				if memLimit == 1 {
+					t.Fatal("expected memory budget error")
+				}
+				sort.Strings(rets)
+				retStr := strings.Join(rets, "")
+
+				if expStr != retStr {
+					t.Errorf("invalid results; expected:\n   %s\ngot:\n   %s",
+						expStr, retStr)
+				}
+			})
+		}
+	}
+}
+
+// TestAggregatorSpillingArrayGroups verifies that groups of type ARRAY, which
+// can't be sorted, are spilled to disk as long as they can be partitioned, and
+// that running out of partitioning levels is reported as an error.
+func TestAggregatorSpillingArrayGroups(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const numRows = 100
+	intType := sqlbase.ColumnType_INT
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	columnTypeIntArray := sqlbase.ColumnType{
+		SemanticType:  sqlbase.ColumnType_ARRAY,
+		ArrayContents: &intType,
+	}
+	types := []sqlbase.ColumnType{columnTypeIntArray, columnTypeInt}
+	input := make(sqlbase.EncDatumRows, numRows)
+	for i := range input {
+		arr := parser.NewDArray(parser.TypeInt)
+		if err := arr.Append(parser.NewDInt(parser.DInt(i))); err != nil {
+			t.Fatal(err)
+		}
+		input[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeIntArray, arr),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i))),
+		}
+	}
+
+	// SELECT @1, SUM(@2) GROUP BY @1.
+	spec := AggregatorSpec{
+		GroupCols: []uint32{0},
+		Aggregations: []AggregatorSpec_Aggregation{
+			{
+				Func:   AggregatorSpec_IDENT,
+				ColIdx: []uint32{0},
+			},
+			{
+				Func:   AggregatorSpec_SUM_INT,
+				ColIdx: []uint32{1},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	diskMonitor := mon.MakeMonitor(
+		"test-disk",
+		mon.DiskResource,
+		nil, /* curCount */
+		nil, /* maxHist */
+		-1,  /* increment: use default block size */
+		math.MaxInt64,
+	)
+	diskMonitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer diskMonitor.Stop(ctx)
+	flowCtx := FlowCtx{
+		EvalCtx:     evalCtx,
+		Settings:    cluster.MakeTestingClusterSettings(),
+		tempStorage: tempEngine,
+		diskMonitor: &diskMonitor,
+	}
+
+	testCases := []struct {
+		maxSpillLevel int
+		expectedErr   string
+	}{
+		// The default maximum level of partitioning is enough to aggregate all
+		// the groups.
+		{maxSpillLevel: 0},
+		// With a single level, some of the partitions still don't fit in memory
+		// and would have to be sorted.
+		{maxSpillLevel: 1, expectedErr: "groups of type ARRAY can't be sorted"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("MaxSpillLevel=%d", tc.maxSpillLevel), func(t *testing.T) {
+			in := NewRowBuffer(types, input, RowBufferArgs{})
+			out := &RowBuffer{}
+
+			ag, err := newAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ag.testingKnobMemLimit = 512
+			ag.testingKnobMaxSpillLevel = tc.maxSpillLevel
+			ag.Run(ctx, nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			var numGroups int
 			for {
 				row, meta := out.Next()
+				if meta.Err != nil {
+					if tc.expectedErr != "" && testutils.IsError(meta.Err, tc.expectedErr) {
+						return
+					}
+					t.Fatalf("unexpected error: %v", meta.Err)
+				}
 				if !meta.Empty() {
 					t.Fatalf("unexpected metadata: %v", meta)
 				}
 				if row == nil {
 					break
 				}
-				rets = append(rets, row.String())
+				numGroups++
+			}
+			if tc.expectedErr != "" {
+				t.Fatalf("expected error %q", tc.expectedErr)
+			}
+			if numGroups != numRows {
+				t.Errorf("expected %d groups, got %d", numRows, numGroups)
+			}
+		})
+	}
+}
+
+// BenchmarkAggregation times how long it takes to aggregate a fixed size input
+// into a varying number of groups.
+func BenchmarkAggregation(b *testing.B) {
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	// Two column integer rows: the group and the value.
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	rng, _ := randutil.NewPseudoRand()
+
+	const inputSize = 1 << 16
+	for _, numGroups := range []int{1, 1 << 4, 1 << 10, 1 << 16} {
+		input := make(sqlbase.EncDatumRows, inputSize)
+		for i := range input {
+			group := parser.NewDInt(parser.DInt(rng.Intn(numGroups)))
+			value := parser.NewDInt(parser.DInt(rng.Intn(100)))
+			input[i] = sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(columnTypeInt, group),
+				sqlbase.DatumToEncDatum(columnTypeInt, value),
+			}
+		}
+		rowSource := NewRepeatableRowSource(types, input)
+
+		for _, distinct := range []bool{false, true} {
+			// SELECT COUNT(*), SUM([DISTINCT] @2) GROUP BY @1.
+			spec := AggregatorSpec{
+				GroupCols: []uint32{0},
+				Aggregations: []AggregatorSpec_Aggregation{
+					{
+						Func: AggregatorSpec_COUNT_ROWS,
+					},
+					{
+						Func:     AggregatorSpec_SUM,
+						Distinct: distinct,
+						ColIdx:   []uint32{1},
+					},
+				},
+			}
+			for _, vectorize := range []bool{false, true} {
+				if distinct && vectorize {
+					// DISTINCT aggregations aren't vectorized.
+					continue
+				}
+				name := fmt.Sprintf("Groups=%d/Distinct=%t/Vectorize=%t", numGroups, distinct, vectorize)
+				b.Run(name, func(b *testing.B) {
+					flowCtx.Settings.DistSQLVectorizeAggs.Override(vectorize)
+					b.ReportAllocs()
+					b.SetBytes(int64(inputSize * 16))
+					for i := 0; i < b.N; i++ {
+						ag, err := newAggregator(
+							&flowCtx, &spec, rowSource, &PostProcessSpec{}, &RowDisposer{},
+						)
+						if err != nil {
+							b.Fatal(err)
+						}
+						ag.testingKnobWorkers = 1
+						ag.Run(ctx, nil)
+						rowSource.Reset()
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestAggregatorReleasesGroups verifies that the memory accounted for the
+// groups and the DISTINCT sets is released as the groups are emitted.
+func TestAggregatorReleasesGroups(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	var input sqlbase.EncDatumRows
+	for i := 0; i < 100; i++ {
+		input = append(input, sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i%10))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i))),
+		})
+	}
+
+	for _, sortOutput := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SortOutput=%t", sortOutput), func(t *testing.T) {
+			// SELECT @1, COUNT(DISTINCT @2) GROUP BY @1.
+			spec := AggregatorSpec{
+				GroupCols: []uint32{0},
+				Aggregations: []AggregatorSpec_Aggregation{
+					{
+						Func:   AggregatorSpec_IDENT,
+						ColIdx: []uint32{0},
+					},
+					{
+						Func:     AggregatorSpec_COUNT,
+						Distinct: true,
+						ColIdx:   []uint32{1},
+					},
+				},
+				SortOutput: sortOutput,
+			}
+
+			ctx := context.Background()
+			out := &RowBuffer{}
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			flowCtx := FlowCtx{
+				Settings: cluster.MakeTestingClusterSettings(),
+				EvalCtx:  evalCtx,
+			}
+
+			ag, err := newAggregator(
+				&flowCtx, &spec, NewRowBuffer(types, nil, RowBufferArgs{}), &PostProcessSpec{}, out,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ag.bucketsAcc.Close(ctx)
+			var scratch []byte
+			for _, row := range input {
+				if scratch, err = ag.accumulateRow(ctx, scratch, row); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if ag.bucketsAcc.CurrentlyAllocated() == 0 {
+				t.Fatal("expected the groups to be accounted for")
 			}
-			sort.Strings(rets)
-			retStr := strings.Join(rets, "")
 
-			if expStr != retStr {
-				t.Errorf("invalid results; expected:\n   %s\ngot:\n   %s",
-					expStr, retStr)
+			if _, err := ag.renderBuckets(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(ag.buckets); n != 0 {
+				t.Errorf("expected the groups to be released, %d remain", n)
+			}
+			if allocated := ag.bucketsAcc.CurrentlyAllocated(); allocated != 0 {
+				t.Errorf("expected the memory to be released, %d bytes remain", allocated)
+			}
+			count := 0
+			for {
+				row, meta := out.Next()
+				if !meta.Empty() {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if row == nil {
+					break
+				}
+				count += int(parser.MustBeDInt(row[1].Datum))
+			}
+			if count != len(input) {
+				t.Errorf("expected %d distinct values, got %d", len(input), count)
 			}
 		})
 	}
@@ -30,6 +30,7 @@ import (
 type algebraicSetOp struct {
 	processorBase
 
+	flowCtx                 *FlowCtx
 	leftSource, rightSource RowSource
 	opType                  AlgebraicSetOpSpec_SetOpType
 	ordering                Ordering
@@ -46,6 +47,7 @@ func newAlgebraicSetOp(
 	output RowReceiver,
 ) (*algebraicSetOp, error) {
 	e := &algebraicSetOp{
+		flowCtx:     flowCtx,
 		leftSource:  leftSource,
 		rightSource: rightSource,
 		ordering:    spec.Ordering,
@@ -88,7 +90,7 @@ func (e *algebraicSetOp) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 
 	ctx = log.WithLogTag(ctx, "ExceptAll", nil)
-	ctx, span := processorSpan(ctx, "exceptAll")
+	ctx, span := processorSpan(ctx, e.flowCtx, "exceptAll")
 	defer tracing.FinishSpan(span)
 
 	log.VEventf(ctx, 2, "starting exceptAll set process")
@@ -22,6 +22,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/jobs"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
@@ -78,7 +79,7 @@ func (b *backfiller) Run(ctx context.Context, wg *sync.WaitGroup) {
 
 	opName := fmt.Sprintf("%sBackfiller", b.name)
 	ctx = log.WithLogTagInt(ctx, opName, int(b.spec.Table.ID))
-	ctx, span := processorSpan(ctx, opName)
+	ctx, span := processorSpan(ctx, b.flowCtx, opName)
 	defer tracing.FinishSpan(span)
 
 	log.VEventf(ctx, 1, "starting")
@@ -145,7 +146,7 @@ func (b *backfiller) mainLoop(ctx context.Context) error {
 	}
 	log.VEventf(ctx, 2, "processed %d rows in %d chunks", row, nChunks)
 	return WriteResumeSpan(ctx,
-		b.flowCtx.clientDB,
+		b.flowCtx.ClientDB,
 		b.spec.Table.ID,
 		work,
 		resume,
@@ -154,6 +155,25 @@ func (b *backfiller) mainLoop(ctx context.Context) error {
 	)
 }
 
+// waitForWriteQuota blocks until the rate limit on backfill writes allows the
+// given number of bytes to be written.
+func (b *backfiller) waitForWriteQuota(ctx context.Context, bytes int) error {
+	limiter := b.flowCtx.Settings.BackfillWriteLimiter
+	// WaitN fails for more bytes than the burst, so we wait in burst-sized
+	// pieces.
+	for bytes > 0 {
+		n := bytes
+		if n > cluster.BackfillWriteLimiterBurst {
+			n = cluster.BackfillWriteLimiterBurst
+		}
+		if err := limiter.WaitN(ctx, n); err != nil {
+			return err
+		}
+		bytes -= n
+	}
+	return nil
+}
+
 // GetResumeSpansFromJob returns a ResumeSpanList from a job given a job id and index.
 func GetResumeSpansFromJob(
 	ctx context.Context, jobsRegistry *jobs.Registry, txn *client.Txn, jobID int64, mutationIdx int,
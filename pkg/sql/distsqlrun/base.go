@@ -20,13 +20,17 @@ import (
 	"sync/atomic"
 
 	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 )
 
@@ -174,14 +178,33 @@ func DrainAndForwardMetadata(ctx context.Context, src RowSource, dst RowReceiver
 	}
 }
 
+// sendTraceData sends the recording of the span in ctx to dst, if it is
+// recording. If the span is a processor's span, the peak memory usage of the
+// processor is recorded in it first.
 func sendTraceData(ctx context.Context, dst RowReceiver) {
 	if sp := opentracing.SpanFromContext(ctx); sp != nil {
+		if procMon, ok := ctx.Value(processorMonitorKey{}).(*mon.BytesMonitor); ok {
+			sp.SetTag("max_memory", humanizeutil.IBytes(procMon.MaximumBytes()))
+		}
 		if rec := tracing.GetRecording(sp); rec != nil {
 			dst.Push(nil /* row */, ProducerMetadata{TraceData: rec})
 		}
 	}
 }
 
+// sendLeafTxnState sends the state of the flow's leaf txn to dst, so that the
+// gateway can update the root txn with the clock observations made by the
+// reads of the flow and with the spans they read. It should be called by the processors which read through
+// the txn, once they are done reading. Nothing is sent if the flow runs
+// directly in a root txn.
+func sendLeafTxnState(ctx context.Context, flowCtx *FlowCtx, dst RowReceiver) {
+	if flowCtx.txn == nil || !flowCtx.txn.IsLeaf() {
+		return
+	}
+	txn := flowCtx.txn.LeafState(ctx)
+	dst.Push(nil /* row */, ProducerMetadata{LeafTxn: &txn})
+}
+
 // DrainAndClose is a version of DrainAndForwardMetadata that drains multiple
 // sources. These sources are assumed to be the only producers left for dst, so
 // dst is closed once they're all exhausted (this is different from
@@ -261,6 +284,9 @@ type RowChannelMsg struct {
 	// Only one of these fields will be set.
 	Row  sqlbase.EncDatumRow
 	Meta ProducerMetadata
+
+	// rowSize is the memory accounted for Row by the RowChannel, if any.
+	rowSize int64
 }
 
 // ProducerMetadata represents a metadata record flowing through a DistSQL flow.
@@ -273,11 +299,23 @@ type ProducerMetadata struct {
 	Err error
 	// TraceData is sent if snowball tracing is enabled.
 	TraceData []tracing.RecordedSpan
+	// Progress is sent periodically by long-running processors.
+	Progress *ProcessorProgress
+	// Stats is sent by each processor when it is done, if the flow collects
+	// execution statistics.
+	Stats *ProcessorStats
+	// LeafTxn is sent by the processors which read through the flow's leaf txn
+	// when they are done; see sendLeafTxnState.
+	LeafTxn *roachpb.LeafTxnFinalState
+	// Checkpoint is sent by table readers when their flow is paused.
+	Checkpoint *ScanCheckpoint
 }
 
 // Empty returns true if none of the fields in metadata are populated.
 func (meta ProducerMetadata) Empty() bool {
-	return meta.Ranges == nil && meta.Err == nil && meta.TraceData == nil
+	return meta.Ranges == nil && meta.Err == nil && meta.TraceData == nil &&
+		meta.Progress == nil && meta.Stats == nil && meta.LeafTxn == nil &&
+		meta.Checkpoint == nil
 }
 
 // RowChannel is a thin layer over a RowChannelMsg channel, which can be used to
@@ -294,6 +332,22 @@ type RowChannel struct {
 	// consumerStatus is an atomic that signals whether the RowChannel is only
 	// accepting draining metadata or is no longer accepting any rows via Push.
 	consumerStatus ConsumerStatus
+
+	// metrics, if set, are used to record the time producers are blocked
+	// because the channel is full.
+	metrics *DistSQLMetrics
+
+	// memAcc, if set, accounts for the memory of the rows buffered in the
+	// channel. It is used by both the producers and the consumer, so it is
+	// protected by memMu. memCtx is the context of the flow which owns it.
+	memAcc *mon.BoundAccount
+	memCtx context.Context
+	memMu  struct {
+		syncutil.Mutex
+		// draining is set once a row couldn't be accounted for; further rows
+		// are dropped and the producers are asked to drain.
+		draining bool
+	}
 }
 
 var _ RowReceiver = &RowChannel{}
@@ -317,11 +371,21 @@ func (rc *RowChannel) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) Consu
 		atomic.LoadUint32((*uint32)(&rc.consumerStatus)))
 	switch consumerStatus {
 	case NeedMoreRows:
-		rc.dataChan <- RowChannelMsg{Row: row, Meta: meta}
+		var rowSize int64
+		if row != nil && rc.memAcc != nil {
+			var err error
+			if rowSize, err = rc.reserveRow(row); err != nil {
+				if err != errRowChannelDraining {
+					rc.send(RowChannelMsg{Meta: ProducerMetadata{Err: err}})
+				}
+				return DrainRequested
+			}
+		}
+		rc.send(RowChannelMsg{Row: row, Meta: meta, rowSize: rowSize})
 	case DrainRequested:
 		// If we're draining, only forward metadata.
 		if !meta.Empty() {
-			rc.dataChan <- RowChannelMsg{Meta: meta}
+			rc.send(RowChannelMsg{Meta: meta})
 		}
 	case ConsumerClosed:
 		// If the consumer is gone, swallow all the rows.
@@ -329,6 +393,56 @@ func (rc *RowChannel) Push(row sqlbase.EncDatumRow, meta ProducerMetadata) Consu
 	return consumerStatus
 }
 
+// errRowChannelDraining is returned by reserveRow once the memory of a row
+// couldn't be reserved.
+var errRowChannelDraining = errors.New("row channel draining")
+
+// reserveRow reserves the memory of a row about to be buffered in the channel
+// and returns its size. If the flow's budget is exhausted, the memory error is
+// returned; from then on, errRowChannelDraining is returned for all the rows,
+// so that the producers drain and the memory error is forwarded only once.
+func (rc *RowChannel) reserveRow(row sqlbase.EncDatumRow) (int64, error) {
+	size := int64(row.Size())
+	rc.memMu.Lock()
+	defer rc.memMu.Unlock()
+	if rc.memMu.draining {
+		return 0, errRowChannelDraining
+	}
+	if err := rc.memAcc.Grow(rc.memCtx, size); err != nil {
+		rc.memMu.draining = true
+		return 0, err
+	}
+	return size, nil
+}
+
+// releaseRow releases the memory of a row received from the channel.
+func (rc *RowChannel) releaseRow(msg RowChannelMsg) {
+	if msg.rowSize == 0 {
+		return
+	}
+	rc.memMu.Lock()
+	rc.memAcc.Shrink(rc.memCtx, msg.rowSize)
+	rc.memMu.Unlock()
+}
+
+// send sends a message on the channel. If the channel is full, the time spent
+// blocked is recorded in the metrics.
+func (rc *RowChannel) send(msg RowChannelMsg) {
+	if rc.metrics == nil {
+		rc.dataChan <- msg
+		return
+	}
+	select {
+	case rc.dataChan <- msg:
+		return
+	default:
+	}
+	start := timeutil.Now()
+	rc.dataChan <- msg
+	rc.metrics.RowChannelBlocked.Inc(1)
+	rc.metrics.RowChannelBlockedHist.RecordValue(timeutil.Since(start).Nanoseconds())
+}
+
 // ProducerDone is part of the RowReceiver interface.
 func (rc *RowChannel) ProducerDone() {
 	close(rc.dataChan)
@@ -346,6 +460,7 @@ func (rc *RowChannel) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
 		// No more rows.
 		return nil, ProducerMetadata{}
 	}
+	rc.releaseRow(d)
 	return d.Row, d.Meta
 }
 
@@ -370,7 +485,8 @@ func (rc *RowChannel) ConsumerClosed() {
 	// channel this will not block. The producer might be neither blocked nor
 	// closed, though; hence the default case.
 	select {
-	case <-rc.dataChan:
+	case d := <-rc.dataChan:
+		rc.releaseRow(d)
 	default:
 	}
 }
@@ -387,10 +503,18 @@ type MultiplexedRowChannel struct {
 var _ RowReceiver = &MultiplexedRowChannel{}
 var _ RowSource = &MultiplexedRowChannel{}
 
+// InitWithBufSize initializes the MultiplexedRowChannel with a given buffer
+// size.
+func (mrc *MultiplexedRowChannel) InitWithBufSize(
+	numSenders int, types []sqlbase.ColumnType, chanBufSize int,
+) {
+	mrc.rowChan.InitWithBufSize(types, chanBufSize)
+	atomic.StoreInt32(&mrc.numSenders, int32(numSenders))
+}
+
 // Init initializes the MultiplexedRowChannel with the default buffer size.
 func (mrc *MultiplexedRowChannel) Init(numSenders int, types []sqlbase.ColumnType) {
-	mrc.rowChan.Init(types)
-	atomic.StoreInt32(&mrc.numSenders, int32(numSenders))
+	mrc.InitWithBufSize(numSenders, types, rowChannelBufSize)
 }
 
 // Push is part of the RowReceiver interface.
@@ -443,9 +567,11 @@ func (mrc *MultiplexedRowChannel) ConsumerClosed() {
 	// Drain (at most) numSenders messages in case senders are blocked trying to
 	// emit a row.
 	for i := int32(0); i < numSenders; i++ {
-		if _, ok := <-mrc.rowChan.dataChan; !ok {
+		d, ok := <-mrc.rowChan.dataChan
+		if !ok {
 			break
 		}
+		mrc.rowChan.releaseRow(d)
 	}
 }
 
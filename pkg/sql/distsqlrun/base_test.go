@@ -0,0 +1,181 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestRowChannelBlockedMetrics verifies that the pushes which block on a full
+// RowChannel are recorded in the metrics.
+func TestRowChannelBlockedMetrics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	metrics := MakeDistSQLMetrics(time.Hour /* histogramWindow */)
+	intType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	rc := &RowChannel{}
+	rc.InitWithBufSize([]sqlbase.ColumnType{intType}, 2)
+	rc.metrics = &metrics
+
+	const numRows = 5
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < numRows; i++ {
+			row := sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(i))),
+			}
+			rc.Push(row, ProducerMetadata{})
+		}
+		rc.ProducerDone()
+		close(done)
+	}()
+
+	// Wait for the producer to fill the buffer before consuming the rows, so
+	// that it blocks on the next push.
+	for len(rc.C) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; ; i++ {
+		row, meta := rc.Next()
+		if !meta.Empty() {
+			t.Fatalf("unexpected metadata: %v", meta)
+		}
+		if row == nil {
+			if i != numRows {
+				t.Fatalf("expected %d rows, got %d", numRows, i)
+			}
+			break
+		}
+	}
+	<-done
+
+	if blocked := metrics.RowChannelBlocked.Count(); blocked == 0 {
+		t.Fatal("expected blocked pushes to be recorded")
+	}
+	if n := metrics.RowChannelBlockedHist.TotalCount(); n != metrics.RowChannelBlocked.Count() {
+		t.Fatalf("expected %d blocked durations, got %d", metrics.RowChannelBlocked.Count(), n)
+	}
+}
+
+// TestRowChannelMemoryAccounting verifies that the memory of the rows buffered
+// in a RowChannel is accounted for, and that the producers are asked to drain
+// once the budget is exhausted.
+func TestRowChannelMemoryAccounting(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	intType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	makeRow := func(i int) sqlbase.EncDatumRow {
+		return sqlbase.EncDatumRow{sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(i)))}
+	}
+	rowSize := int64(makeRow(0).Size())
+
+	// The budget fits three rows.
+	monitor := mon.MakeMonitor(
+		"test", mon.MemoryResource, nil /* curCount */, nil /* maxHist */, 1 /* increment */, math.MaxInt64,
+	)
+	monitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(3*rowSize))
+	defer monitor.Stop(ctx)
+	acc := monitor.MakeBoundAccount()
+	defer acc.Close(ctx)
+
+	rc := &RowChannel{}
+	rc.InitWithBufSize([]sqlbase.ColumnType{intType}, 10)
+	rc.memAcc = &acc
+	rc.memCtx = ctx
+
+	for i := 0; i < 3; i++ {
+		if status := rc.Push(makeRow(i), ProducerMetadata{}); status != NeedMoreRows {
+			t.Fatalf("%d: unexpected consumer status %d", i, status)
+		}
+	}
+	if allocated := acc.CurrentlyAllocated(); allocated != 3*rowSize {
+		t.Fatalf("expected %d bytes to be accounted for, got %d", 3*rowSize, allocated)
+	}
+	// The rows which don't fit are dropped, and the memory error is forwarded
+	// once.
+	for i := 3; i < 5; i++ {
+		if status := rc.Push(makeRow(i), ProducerMetadata{}); status != DrainRequested {
+			t.Fatalf("%d: unexpected consumer status %d", i, status)
+		}
+	}
+	rc.ProducerDone()
+
+	numRows, numErrs := 0, 0
+	for {
+		row, meta := rc.Next()
+		if row == nil && meta.Empty() {
+			break
+		}
+		if row != nil {
+			numRows++
+		} else if meta.Err != nil {
+			numErrs++
+		}
+	}
+	if numRows != 3 || numErrs != 1 {
+		t.Fatalf("expected 3 rows and 1 error, got %d rows and %d errors", numRows, numErrs)
+	}
+	if allocated := acc.CurrentlyAllocated(); allocated != 0 {
+		t.Fatalf("expected the memory of the rows to be released, %d bytes remain", allocated)
+	}
+}
+
+// TestMultiplexedRowChannelConsumerClosedReleasesRows verifies that the rows
+// discarded when the consumer of a MultiplexedRowChannel closes it have their
+// memory released.
+func TestMultiplexedRowChannelConsumerClosedReleasesRows(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	intType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	monitor := mon.MakeMonitor(
+		"test", mon.MemoryResource, nil /* curCount */, nil /* maxHist */, 1 /* increment */, math.MaxInt64,
+	)
+	monitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer monitor.Stop(ctx)
+	acc := monitor.MakeBoundAccount()
+	defer acc.Close(ctx)
+
+	const numSenders = 3
+	mrc := &MultiplexedRowChannel{}
+	mrc.InitWithBufSize(numSenders, []sqlbase.ColumnType{intType}, numSenders)
+	mrc.rowChan.memAcc = &acc
+	mrc.rowChan.memCtx = ctx
+
+	for i := 0; i < numSenders; i++ {
+		row := sqlbase.EncDatumRow{sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(i)))}
+		if status := mrc.Push(row, ProducerMetadata{}); status != NeedMoreRows {
+			t.Fatalf("%d: unexpected consumer status %d", i, status)
+		}
+	}
+	if acc.CurrentlyAllocated() == 0 {
+		t.Fatal("expected the buffered rows to be accounted for")
+	}
+	mrc.ConsumerClosed()
+	if allocated := acc.CurrentlyAllocated(); allocated != 0 {
+		t.Fatalf("expected the memory of the discarded rows to be released, %d bytes remain", allocated)
+	}
+}
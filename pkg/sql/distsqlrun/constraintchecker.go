@@ -0,0 +1,218 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// constraintChecker checks that the rows of a table satisfy its CHECK and NOT
+// NULL constraints. See ConstraintCheckerSpec.
+type constraintChecker struct {
+	processorBase
+
+	flowCtx *FlowCtx
+	desc    sqlbase.TableDescriptor
+	spans   roachpb.Spans
+
+	// checks are the validated CHECK constraints of the table, and checkExprs
+	// their expressions, in terms of the columns of the table.
+	checks     []*sqlbase.TableDescriptor_CheckConstraint
+	checkExprs []exprHelper
+
+	fetcher scrubFetcher
+}
+
+var _ Processor = &constraintChecker{}
+
+func newConstraintChecker(
+	flowCtx *FlowCtx, spec *ConstraintCheckerSpec, post *PostProcessSpec, output RowReceiver,
+) (*constraintChecker, error) {
+	cc := &constraintChecker{
+		flowCtx: flowCtx,
+		desc:    spec.Table,
+	}
+	cc.spans = make(roachpb.Spans, len(spec.Spans))
+	for i, s := range spec.Spans {
+		cc.spans[i] = s.Span
+	}
+
+	types := make([]sqlbase.ColumnType, len(cc.desc.Columns))
+	for i := range types {
+		types[i] = cc.desc.Columns[i].Type
+	}
+	for _, check := range cc.desc.Checks {
+		// Unvalidated constraints might legitimately be violated by existing
+		// rows.
+		if check.Validity != sqlbase.ConstraintValidity_Validated {
+			continue
+		}
+		expr, err := checkExprWithOrdinals(&cc.desc, check.Expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "CHECK constraint %q", check.Name)
+		}
+		cc.checks = append(cc.checks, check)
+		cc.checkExprs = append(cc.checkExprs, exprHelper{})
+		h := &cc.checkExprs[len(cc.checkExprs)-1]
+		if err := h.init(Expression{Expr: expr}, types, &flowCtx.EvalCtx); err != nil {
+			return nil, errors.Wrapf(err, "CHECK constraint %q", check.Name)
+		}
+	}
+
+	if err := cc.fetcher.init(&cc.desc, 0 /* indexIdx */); err != nil {
+		return nil, err
+	}
+	if err := cc.out.Init(post, ScrubColumnTypes, &flowCtx.EvalCtx, output); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// checkExprWithOrdinals returns the given CHECK expression with its column
+// names replaced by ordinal references (@1, @2, ...) to the columns of the
+// table.
+func checkExprWithOrdinals(desc *sqlbase.TableDescriptor, exprStr string) (string, error) {
+	expr, err := parser.ParseExpr(exprStr)
+	if err != nil {
+		return "", err
+	}
+	v := columnOrdinalReplacer{desc: desc}
+	expr, _ = parser.WalkExpr(&v, expr)
+	if v.err != nil {
+		return "", v.err
+	}
+	return expr.String(), nil
+}
+
+// columnOrdinalReplacer is a parser.Visitor which replaces the names of the
+// columns of a table with ordinal references.
+type columnOrdinalReplacer struct {
+	desc *sqlbase.TableDescriptor
+	err  error
+}
+
+func (v *columnOrdinalReplacer) VisitPre(expr parser.Expr) (recurse bool, newExpr parser.Expr) {
+	if v.err != nil {
+		return false, expr
+	}
+	if name, ok := expr.(parser.UnresolvedName); ok {
+		varName, err := name.NormalizeVarName()
+		if err != nil {
+			v.err = err
+			return false, expr
+		}
+		c, ok := varName.(*parser.ColumnItem)
+		if !ok {
+			v.err = errors.Errorf("unexpected reference %s", varName)
+			return false, expr
+		}
+		for i := range v.desc.Columns {
+			if v.desc.Columns[i].Name == string(c.ColumnName) {
+				return false, parser.NewOrdinalReference(i)
+			}
+		}
+		v.err = errors.Errorf("column %q does not exist", c.ColumnName)
+		return false, expr
+	}
+	return true, expr
+}
+
+func (*columnOrdinalReplacer) VisitPost(expr parser.Expr) parser.Expr { return expr }
+
+// Run is part of the processor interface.
+func (cc *constraintChecker) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTagInt(ctx, "ConstraintChecker", int(cc.desc.ID))
+	ctx, span := processorSpan(ctx, cc.flowCtx, "constraint checker")
+	defer tracing.FinishSpan(span)
+
+	txn := cc.flowCtx.txn
+	if txn == nil {
+		log.Fatalf(ctx, "constraintChecker outside of txn")
+	}
+
+	if err := cc.mainLoop(ctx, txn); err != nil {
+		cc.out.output.Push(nil /* row */, ProducerMetadata{Err: err})
+	}
+	sendLeafTxnState(ctx, cc.flowCtx, cc.out.output)
+	sendTraceData(ctx, cc.out.output)
+	cc.out.Close()
+}
+
+// mainLoop checks the rows in the spans, until all the rows are checked or the
+// consumer doesn't need more rows.
+func (cc *constraintChecker) mainLoop(ctx context.Context, txn *client.Txn) error {
+	if err := cc.fetcher.StartScan(
+		ctx, txn, cc.spans, true /* limitBatches */, 0, /* limitHint */
+	); err != nil {
+		return err
+	}
+	for {
+		row, err := cc.fetcher.NextRow(ctx, false /* traceKV */)
+		if err != nil || row == nil {
+			return err
+		}
+		datums, err := cc.fetcher.decode(row)
+		if err != nil {
+			return err
+		}
+
+		emit := func(errorType, details string) (bool, error) {
+			status, err := cc.out.EmitRow(
+				ctx, makeScrubRow(errorType, cc.fetcher.primaryKey(datums), details),
+			)
+			return err == nil && status == NeedMoreRows, err
+		}
+		for i := range cc.desc.Columns {
+			if col := &cc.desc.Columns[i]; !col.Nullable && datums[i] == parser.DNull {
+				if more, err := emit(
+					ScrubErrorNotNullViolation, fmt.Sprintf("column %q", col.Name),
+				); !more {
+					return err
+				}
+			}
+		}
+		for i := range cc.checkExprs {
+			d, err := cc.checkExprs[i].eval(row)
+			if err != nil {
+				return err
+			}
+			// As for INSERT and UPDATE, a NULL result satisfies the constraint.
+			if d != parser.DBoolFalse {
+				continue
+			}
+			if more, err := emit(
+				ScrubErrorCheckConstraintViolation,
+				fmt.Sprintf("CHECK constraint %q: %s", cc.checks[i].Name, cc.checks[i].Expr),
+			); !more {
+				return err
+			}
+		}
+	}
+}
@@ -67,14 +67,17 @@ var _ sortableRowContainer = &diskRowContainer{}
 // 	- types is the schema of rows that will be added to this container.
 // 	- ordering is the output ordering; the order in which rows should be sorted.
 // 	- e is the underlying store that rows are stored on.
+// 	- namespace, if set, is the part of e's keyspace in which the rows are
+// 	  stored.
 func makeDiskRowContainer(
 	ctx context.Context,
 	diskMonitor *mon.BytesMonitor,
 	types []sqlbase.ColumnType,
 	ordering sqlbase.ColumnOrdering,
 	e engine.Engine,
+	namespace *engine.TempStorageNamespace,
 ) diskRowContainer {
-	diskMap := engine.NewRocksDBMap(e)
+	diskMap := namespace.NewRocksDBMap(e)
 	d := diskRowContainer{
 		diskMap:       diskMap,
 		diskAcc:       diskMonitor.MakeBoundAccount(),
@@ -122,7 +122,7 @@ func TestDiskRowContainer(t *testing.T) {
 				}
 				row := sqlbase.RandEncDatumRowOfTypes(rng, types)
 				func() {
-					d := makeDiskRowContainer(ctx, &diskMonitor, types, ordering, tempEngine)
+					d := makeDiskRowContainer(ctx, &diskMonitor, types, ordering, tempEngine, nil /* namespace */)
 					defer d.Close(ctx)
 					if err := d.AddRow(ctx, row); err != nil {
 						t.Fatal(err)
@@ -175,7 +175,7 @@ func TestDiskRowContainer(t *testing.T) {
 				types[i] = rows[0][i].Type
 			}
 			func() {
-				d := makeDiskRowContainer(ctx, &diskMonitor, types, ordering, tempEngine)
+				d := makeDiskRowContainer(ctx, &diskMonitor, types, ordering, tempEngine, nil /* namespace */)
 				defer d.Close(ctx)
 				for i := 0; i < len(rows); i++ {
 					if err := d.AddRow(ctx, rows[i]); err != nil {
@@ -268,6 +268,7 @@ func TestDiskRowContainerDiskFull(t *testing.T) {
 		[]sqlbase.ColumnType{columnTypeInt},
 		sqlbase.ColumnOrdering{sqlbase.ColumnOrderInfo{ColIdx: 0, Direction: encoding.Ascending}},
 		tempEngine,
+		nil, /* namespace */
 	)
 	defer d.Close(ctx)
 
@@ -15,10 +15,12 @@
 package distsqlrun
 
 import (
+	"bytes"
 	"sync"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"golang.org/x/net/context"
@@ -35,6 +37,20 @@ type distinct struct {
 	distinctCols map[uint32]struct{}
 	memAcc       mon.BoundAccount
 	datumAlloc   sqlbase.DatumAlloc
+
+	// testingKnobMemLimit is used in testing to set a limit on the memory that
+	// should be used by the distinct before spilling rows to disk. Minimum
+	// value to enable is 1.
+	testingKnobMemLimit int64
+	// spiller decides whether rows are spilled to disk once the seen set
+	// doesn't fit in memory.
+	spiller spiller
+	// spill, if set, holds the rows of the current group which were not in the
+	// seen set once it stopped growing. They are sorted on disk by their
+	// distinct columns so that duplicates are contiguous, and are deduplicated
+	// and emitted at the end of the group, which preserves the ordering of the
+	// input on the ordered columns.
+	spill *diskRowContainer
 }
 
 var _ Processor = &distinct{}
@@ -68,10 +84,9 @@ func (d *distinct) Run(ctx context.Context, wg *sync.WaitGroup) {
 	if wg != nil {
 		defer wg.Done()
 	}
-	defer d.memAcc.Close(ctx)
 
 	ctx = log.WithLogTag(ctx, "Evaluator", nil)
-	ctx, span := processorSpan(ctx, "distinct")
+	ctx, span := processorSpan(ctx, d.flowCtx, "distinct")
 	defer tracing.FinishSpan(span)
 
 	if log.V(2) {
@@ -79,6 +94,32 @@ func (d *distinct) Run(ctx context.Context, wg *sync.WaitGroup) {
 		defer log.Infof(ctx, "exiting distinct")
 	}
 
+	// Enable fall back to disk if the cluster setting is set or a memory limit
+	// has been set through testing.
+	d.spiller = makeSpiller(
+		d.flowCtx, "distinct", d.flowCtx.Settings.DistSQLUseTempStorageDistinct,
+		d.testingKnobMemLimit > 0,
+	)
+	defer d.spiller.close(ctx)
+	if d.spiller.enabled() && d.distinctColsSortable() {
+		// Limit the memory use by creating a child monitor with a hard limit.
+		// The rows which are not in the seen set once this limit is reached
+		// are deduplicated on disk.
+		limit := d.testingKnobMemLimit
+		if limit <= 0 {
+			limit = d.flowCtx.workMemLimit()
+		}
+		limitedMon := mon.MakeMonitorInheritWithLimit(
+			"distinct-limited", limit, d.flowCtx.EvalCtx.Mon,
+		)
+		limitedMon.Start(ctx, d.flowCtx.EvalCtx.Mon, mon.BoundAccount{})
+		defer limitedMon.Stop(ctx)
+		d.memAcc = limitedMon.MakeBoundAccount()
+		d.spiller.onSpill = d.startSpilling
+	}
+	defer d.memAcc.Close(ctx)
+	defer d.closeSpill(ctx)
+
 	earlyExit, err := d.mainLoop(ctx)
 	if err != nil {
 		DrainAndClose(ctx, d.out.output, err, d.input)
@@ -104,6 +145,9 @@ func (d *distinct) mainLoop(ctx context.Context) (earlyExit bool, _ error) {
 			continue
 		}
 		if row == nil {
+			if d.spill != nil {
+				return d.emitSpilledRows(ctx)
+			}
 			return false, nil
 		}
 
@@ -125,16 +169,37 @@ func (d *distinct) mainLoop(ctx context.Context) (earlyExit bool, _ error) {
 		}
 
 		if !matched {
+			if d.spill != nil {
+				// All the rows of the previous group were read.
+				if earlyExit, err := d.emitSpilledRows(ctx); err != nil || earlyExit {
+					return earlyExit, err
+				}
+			}
 			d.lastGroupKey = row
 			d.seen = make(map[string]struct{})
 			d.memAcc.Clear(ctx)
 		}
 
 		if _, ok := d.seen[string(encoding)]; !ok {
+			if d.spill != nil {
+				// The row may be a duplicate of another row which isn't in the
+				// seen set either; it is deduplicated on disk.
+				if err := d.spill.AddRow(ctx, row); err != nil {
+					return false, err
+				}
+				continue
+			}
 			if len(encoding) > 0 {
-				if err := d.memAcc.Grow(ctx, int64(len(encoding))); err != nil {
+				spilled, err := d.spiller.grow(ctx, &d.memAcc, int64(len(encoding)))
+				if err != nil {
 					return false, err
 				}
+				if spilled {
+					if err := d.spill.AddRow(ctx, row); err != nil {
+						return false, err
+					}
+					continue
+				}
 				d.seen[string(encoding)] = struct{}{}
 			}
 			if !emitHelper(ctx, &d.out, row, ProducerMetadata{}, d.input) {
@@ -162,6 +227,14 @@ func (d *distinct) matchLastGroupKey(row sqlbase.EncDatumRow) (bool, error) {
 // encode appends the encoding of non-ordered columns, which we use as a key in
 // our 'seen' set.
 func (d *distinct) encode(appendTo []byte, row sqlbase.EncDatumRow) ([]byte, error) {
+	return d.encodeAs(appendTo, sqlbase.DatumEncoding_VALUE, row)
+}
+
+// encodeAs appends the encoding of the distinct columns using the given
+// encoding.
+func (d *distinct) encodeAs(
+	appendTo []byte, enc sqlbase.DatumEncoding, row sqlbase.EncDatumRow,
+) ([]byte, error) {
 	var err error
 	for i, datum := range row {
 		// Ignore columns that are not in the distinctCols, as if we are
@@ -178,10 +251,102 @@ func (d *distinct) encode(appendTo []byte, row sqlbase.EncDatumRow) ([]byte, err
 		// datums). We instead opt to always choose sqlbase.DatumEncoding_VALUE
 		// but we may want to check the first row for what encodings are already
 		// available.
-		appendTo, err = datum.Encode(&d.datumAlloc, sqlbase.DatumEncoding_VALUE, appendTo)
+		appendTo, err = datum.Encode(&d.datumAlloc, enc, appendTo)
 		if err != nil {
 			return nil, err
 		}
 	}
 	return appendTo, nil
 }
+
+// distinctColsSortable returns whether the distinct columns can be
+// key-encoded, and hence whether the rows can be deduplicated on disk.
+func (d *distinct) distinctColsSortable() bool {
+	types := d.input.Types()
+	if len(d.distinctCols) == 0 {
+		return false
+	}
+	for c := range d.distinctCols {
+		if int(c) >= len(types) || types[c].SemanticType == sqlbase.ColumnType_ARRAY {
+			return false
+		}
+	}
+	return true
+}
+
+// startSpilling is the distinct's spill callback, invoked once the seen set
+// doesn't fit in memory. From then on, the rows which are not in the seen set
+// are deduplicated on disk.
+func (d *distinct) startSpilling(ctx context.Context, _ error) error {
+	log.VEventf(ctx, 2, "spilling distinct rows to disk")
+	d.initSpill(ctx)
+	return nil
+}
+
+func (d *distinct) initSpill(ctx context.Context) {
+	ordering := make(sqlbase.ColumnOrdering, 0, len(d.distinctCols))
+	for i := range d.input.Types() {
+		if _, ok := d.distinctCols[uint32(i)]; ok {
+			ordering = append(ordering, sqlbase.ColumnOrderInfo{ColIdx: i, Direction: encoding.Ascending})
+		}
+	}
+	rows := makeDiskRowContainer(
+		ctx, d.spiller.diskMonitor(ctx), d.input.Types(), ordering, d.flowCtx.tempStorage,
+		d.flowCtx.tempStorageNamespace,
+	)
+	d.spill = &rows
+}
+
+func (d *distinct) closeSpill(ctx context.Context) {
+	if d.spill != nil {
+		d.spill.Close(ctx)
+		d.spill = nil
+	}
+}
+
+// emitSpilledRows emits the distinct rows among the ones which were spilled to
+// disk, and releases the spill. The rows are sorted by their distinct columns
+// so the duplicates are contiguous.
+func (d *distinct) emitSpilledRows(ctx context.Context) (earlyExit bool, _ error) {
+	defer d.closeSpill(ctx)
+
+	i := d.spill.NewIterator(ctx)
+	defer i.Close()
+	// Rows with the same key encoding may still have different value
+	// encodings, e.g. 1.0 and 1.00, which are distinct as far as the seen set
+	// is concerned. runSeen holds the value encodings emitted for the current
+	// key encoding.
+	runSeen := make(map[string]struct{})
+	var scratch, sortKey, lastSortKey []byte
+	for i.Rewind(); ; i.Next() {
+		if ok, err := i.Valid(); err != nil {
+			return false, err
+		} else if !ok {
+			return false, nil
+		}
+		row, err := i.Row()
+		if err != nil {
+			return false, err
+		}
+		sortKey, err = d.encodeAs(sortKey[:0], sqlbase.DatumEncoding_ASCENDING_KEY, row)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(sortKey, lastSortKey) {
+			runSeen = make(map[string]struct{})
+		}
+		lastSortKey, sortKey = sortKey, lastSortKey
+		scratch, err = d.encode(scratch[:0], row)
+		if err != nil {
+			return false, err
+		}
+		if _, ok := runSeen[string(scratch)]; ok {
+			continue
+		}
+		runSeen[string(scratch)] = struct{}{}
+		if !emitHelper(ctx, &d.out, row, ProducerMetadata{}, d.input) {
+			// No cleanup required; emitHelper() took care of it.
+			return true, nil
+		}
+	}
+}
@@ -15,11 +15,18 @@
 package distsqlrun
 
 import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 
 	"golang.org/x/net/context"
@@ -172,3 +179,109 @@ func TestDistinct(t *testing.T) {
 		})
 	}
 }
+
+func TestDistinctDiskSpill(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	diskMonitor := mon.MakeMonitor(
+		"test-disk",
+		mon.DiskResource,
+		nil, /* curCount */
+		nil, /* maxHist */
+		-1,  /* increment: use default block size */
+		math.MaxInt64,
+	)
+	diskMonitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer diskMonitor.Stop(ctx)
+	flowCtx := FlowCtx{
+		EvalCtx:     evalCtx,
+		Settings:    cluster.MakeTestingClusterSettings(),
+		tempStorage: tempEngine,
+		diskMonitor: &diskMonitor,
+	}
+
+	// The rows are (i/20, i%7), so that the input is ordered on the first
+	// column and each value of the first column has 7 distinct rows.
+	const numRows = 2000
+	intType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{intType, intType}
+	input := make(sqlbase.EncDatumRows, numRows)
+	for i := range input {
+		input[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(i/20))),
+			sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(i%7))),
+		}
+	}
+	var expected []string
+	for a := 0; a < numRows/20; a++ {
+		for b := 0; b < 7; b++ {
+			expected = append(expected, fmt.Sprintf("[%d %d]", a, b))
+		}
+	}
+	sort.Strings(expected)
+
+	specs := map[string]DistinctSpec{
+		"Unordered": {DistinctColumns: []uint32{0, 1}},
+		"Ordered":   {OrderedColumns: []uint32{0}, DistinctColumns: []uint32{0, 1}},
+	}
+	// Test with several memory limits:
+	// 0: Use the default limit; nothing is spilled.
+	// 1: All the rows are deduplicated on disk.
+	// 64: The rows which don't fit in the seen set are deduplicated on disk.
+	for name, spec := range specs {
+		for _, memLimit := range []int64{0, 1, 64} {
+			t.Run(fmt.Sprintf("%s/MemLimit=%d", name, memLimit), func(t *testing.T) {
+				in := NewRowBuffer(types, input, RowBufferArgs{})
+				out := &RowBuffer{}
+				d, err := newDistinct(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				d.testingKnobMemLimit = memLimit
+				d.Run(ctx, nil)
+				if !out.ProducerClosed {
+					t.Fatalf("output RowReceiver not closed")
+				}
+
+				var res []string
+				var a sqlbase.DatumAlloc
+				last := int64(-1)
+				for {
+					row, meta := out.Next()
+					if !meta.Empty() {
+						t.Fatalf("unexpected metadata: %v", meta)
+					}
+					if row == nil {
+						break
+					}
+					res = append(res, row.String())
+					if len(spec.OrderedColumns) == 0 {
+						continue
+					}
+					// The ordering on the first column is preserved.
+					if err := row[0].EnsureDecoded(&a); err != nil {
+						t.Fatal(err)
+					}
+					if v := int64(*row[0].Datum.(*parser.DInt)); v < last {
+						t.Fatalf("row %s out of order", row)
+					} else {
+						last = v
+					}
+				}
+				sort.Strings(res)
+				if result, exp := strings.Join(res, ""), strings.Join(expected, ""); result != exp {
+					t.Errorf("invalid results:\n%s\nexpected:\n%s", result, exp)
+				}
+			})
+		}
+	}
+}
@@ -15,7 +15,9 @@
 package distsqlrun
 
 import (
+	"fmt"
 	"sync"
+	"sync/atomic"
 
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
@@ -28,9 +30,12 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/jobs"
 	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 )
 
@@ -63,9 +68,9 @@ type FlowCtx struct {
 	// The transaction in which kv operations performed by processors in the flow
 	// must be performed. Processors in the Flow will use this txn concurrently.
 	txn *client.Txn
-	// clientDB is a handle to the cluster. Used for performing requests outside
+	// ClientDB is a handle to the cluster. Used for performing requests outside
 	// of the transaction in which the flow's query is running.
-	clientDB *client.DB
+	ClientDB *client.DB
 	// nodeID is the ID of the node on which the processors using this FlowCtx
 	// run.
 	nodeID       roachpb.NodeID
@@ -74,11 +79,90 @@ type FlowCtx struct {
 	// tempStorage is used by some DistSQL processors to store Rows when the
 	// working set is larger than can be stored in memory.
 	tempStorage engine.Engine
+	// tempStorageNamespace, if set, is the part of tempStorage's keyspace in
+	// which the processors store their rows; it is cleared when the flow is
+	// cleaned up.
+	tempStorageNamespace *engine.TempStorageNamespace
 	// diskMonitor is used to monitor temporary storage disk usage.
 	diskMonitor *mon.BytesMonitor
 
+	// metrics, if set, are used to record statistics about the flow's
+	// execution, e.g. the time processors are blocked on full row channels.
+	metrics *DistSQLMetrics
+
 	// JobRegistry is used during backfill to load jobs which keep state.
 	JobRegistry *jobs.Registry
+
+	// pauseGate is used by the table readers to wait while the flow is paused.
+	// It is nil if the flow can't be paused.
+	pauseGate *pauseGate
+
+	// runtimeFilters is used by the hash joiners to share the filters they
+	// build at run time with the table readers of the flow. It is nil outside
+	// of flows.
+	runtimeFilters *runtimeFilters
+
+	// processorIdx is the index of the processor in the flow; it is only set in
+	// the FlowCtx of each processor (see makeProcessor).
+	processorIdx int32
+
+	// workMem is the amount of memory each processor which can fall back to
+	// temporary storage uses before it does; see workMemLimit.
+	workMem int64
+}
+
+// workMemLimit returns the memory limit of the processors which fall back to
+// temporary storage once it is reached. It defaults to COCKROACH_WORK_MEM if
+// the flow doesn't specify it.
+func (flowCtx *FlowCtx) workMemLimit() int64 {
+	if flowCtx.workMem > 0 {
+		return flowCtx.workMem
+	}
+	return workMemBytes
+}
+
+// pauseGate lets the processors of a flow wait while the flow is paused. See
+// Flow.Pause.
+type pauseGate struct {
+	// paused is accessed atomically; it allows checking whether the flow is
+	// paused without locking.
+	paused int32
+
+	mu struct {
+		syncutil.Mutex
+		// resumeCh is closed when the flow is resumed.
+		resumeCh chan struct{}
+	}
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.mu.resumeCh == nil {
+		g.mu.resumeCh = make(chan struct{})
+		atomic.StoreInt32(&g.paused, 1)
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.mu.resumeCh != nil {
+		atomic.StoreInt32(&g.paused, 0)
+		close(g.mu.resumeCh)
+		g.mu.resumeCh = nil
+	}
+}
+
+// pausedCh returns a channel which is closed when the flow is resumed if the
+// flow is paused, and nil otherwise.
+func (g *pauseGate) pausedCh() <-chan struct{} {
+	if g == nil || atomic.LoadInt32(&g.paused) == 0 {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.mu.resumeCh
 }
 
 type flowStatus int
@@ -100,6 +184,28 @@ type Flow struct {
 
 	flowRegistry *flowRegistry
 	processors   []Processor
+	// fusedProcessors are the processors which are used as the input of their
+	// consumer instead of running in their own goroutine. See
+	// RowSourcedProcessor.
+	fusedProcessors []RowSourcedProcessor
+	// streamCompression is the compression used by the outboxes of the flow.
+	streamCompression StreamCompression
+	// collectStats is set if the processors of the flow send their execution
+	// statistics as metadata.
+	collectStats bool
+	// memPool is the monitor from which the flow's monitor (EvalCtx.Mon) draws
+	// its memory. The flow's monitor is started by reserveMemory, and
+	// memReserved is set then.
+	memPool     *mon.BytesMonitor
+	memReserved bool
+
+	// inputRowChannels are the RowChannels created for the inputs of the
+	// processors; the accounts of their buffered rows are closed on cleanup.
+	inputRowChannels []*RowChannel
+
+	// processorMonitors contains the memory monitor of each processor; they
+	// draw from the flow's monitor (EvalCtx.Mon).
+	processorMonitors []mon.BytesMonitor
 	// startables are entities that must be started when the flow starts;
 	// currently these are outboxes and routers.
 	startables []startable
@@ -122,6 +228,10 @@ type Flow struct {
 
 	doneFn func()
 
+	// ctxCancel cancels the context that the processors and outboxes of the
+	// flow run with; it is set when the flow is started. See Cancel.
+	ctxCancel context.CancelFunc
+
 	status flowStatus
 }
 
@@ -131,10 +241,37 @@ func newFlow(flowCtx FlowCtx, flowReg *flowRegistry, syncFlowConsumer RowReceive
 		flowRegistry:     flowReg,
 		syncFlowConsumer: syncFlowConsumer,
 	}
+	f.pauseGate = &pauseGate{}
+	f.runtimeFilters = &runtimeFilters{}
 	f.status = FlowNotStarted
 	return f
 }
 
+// reserveMemory starts the flow's memory monitor with a reservation of
+// sql.distsql.flow_memory_reservation from the node's pool, which the flow's
+// processors use before drawing more memory from the pool. An error is
+// returned if the pool can't provide the reservation.
+func (f *Flow) reserveMemory(ctx context.Context) error {
+	reserved := f.memPool.MakeBoundAccount()
+	if err := reserved.Grow(ctx, f.Settings.FlowMemoryReservation.Get()); err != nil {
+		return pgerror.AnnotateError("unable to reserve memory for distributed sql flow:", err)
+	}
+	f.EvalCtx.Mon.Start(ctx, f.memPool, reserved)
+	f.memReserved = true
+	return nil
+}
+
+// initInputRowChannel sets up a RowChannel created for the input of a
+// processor: the memory of the rows buffered in it counts against the flow's
+// budget.
+func (f *Flow) initInputRowChannel(ctx context.Context, rc *RowChannel) {
+	rc.metrics = f.metrics
+	acc := f.EvalCtx.Mon.MakeBoundAccount()
+	rc.memAcc = &acc
+	rc.memCtx = ctx
+	f.inputRowChannels = append(f.inputRowChannels, rc)
+}
+
 // setupInboundStream adds a stream to the stream map (inboundStreams or
 // localStreams).
 func (f *Flow) setupInboundStream(
@@ -187,6 +324,7 @@ func (f *Flow) setupOutboundStream(spec StreamEndpointSpec) (RowReceiver, error)
 
 	case StreamEndpointSpec_REMOTE:
 		outbox := newOutbox(&f.FlowCtx, spec.TargetAddr, f.id, sid)
+		outbox.encoder.setCompression(f.streamCompression)
 		f.startables = append(f.startables, outbox)
 		return outbox, nil
 
@@ -231,12 +369,20 @@ func checkNumInOut(inputs []RowSource, outputs []RowReceiver, numIn, numOut int)
 	return nil
 }
 
-func (f *Flow) makeProcessor(ps *ProcessorSpec, inputs []RowSource) (Processor, error) {
+// makeProcessor creates the processor with the given spec. If fused is set, the
+// processor is created without an output since it is used as the input of its
+// consumer.
+func (f *Flow) makeProcessor(
+	procIdx int, ps *ProcessorSpec, inputs []RowSource, procMon *mon.BytesMonitor, fused bool,
+) (Processor, error) {
 	if len(ps.Output) != 1 {
 		return nil, errors.Errorf("only single-output processors supported")
 	}
 	outputs := make([]RowReceiver, len(ps.Output))
 	for i := range ps.Output {
+		if fused {
+			break
+		}
 		spec := &ps.Output[i]
 		if spec.Type == OutputRouterSpec_PASS_THROUGH {
 			// There is no entity that corresponds to a pass-through router - we just
@@ -259,7 +405,16 @@ func (f *Flow) makeProcessor(ps *ProcessorSpec, inputs []RowSource) (Processor,
 		outputs[i] = r
 		f.startables = append(f.startables, r)
 	}
-	proc, err := newProcessor(&f.FlowCtx, &ps.Core, &ps.Post, inputs, outputs)
+	// The processor gets its own FlowCtx, whose EvalCtx uses the processor's
+	// monitor, so that its memory usage is accounted for separately.
+	procFlowCtx := f.FlowCtx
+	procFlowCtx.EvalCtx.Mon = procMon
+	procFlowCtx.processorIdx = int32(procIdx)
+	procInputs, procOutputs := inputs, outputs
+	if f.collectStats && !fused {
+		procInputs, procOutputs = f.wrapWithStatCollectors(procIdx, ps, inputs, outputs, procMon)
+	}
+	proc, err := newProcessor(&procFlowCtx, &ps.Core, &ps.Post, procInputs, procOutputs)
 	if err != nil {
 		return nil, err
 	}
@@ -273,27 +428,91 @@ func (f *Flow) makeProcessor(ps *ProcessorSpec, inputs []RowSource) (Processor,
 	return proc, nil
 }
 
+// findFusions returns the local streams which connect a processor that can be
+// fused with its consumer (see RowSourcedProcessor), mapped to the index of
+// that processor. A processor can be fused if its only output is a
+// pass-through to a local stream, which is the only stream of an unordered
+// input synchronizer of the consumer.
+//
+// No processors are fused when execution statistics are collected, since the
+// statistics are collected per processor.
+func findFusions(spec *FlowSpec) map[StreamID]int {
+	if spec.CollectStats {
+		return nil
+	}
+	producers := make(map[StreamID]int)
+	for pIdx := range spec.Processors {
+		ps := &spec.Processors[pIdx]
+		if !canFuse(&ps.Core) || len(ps.Output) != 1 {
+			continue
+		}
+		out := &ps.Output[0]
+		if out.Type != OutputRouterSpec_PASS_THROUGH || len(out.Streams) != 1 ||
+			out.Streams[0].Type != StreamEndpointSpec_LOCAL {
+			continue
+		}
+		producers[out.Streams[0].StreamID] = pIdx
+	}
+	var fusions map[StreamID]int
+	for _, ps := range spec.Processors {
+		for _, is := range ps.Input {
+			if is.Type != InputSyncSpec_UNORDERED || len(is.Streams) != 1 {
+				continue
+			}
+			s := is.Streams[0]
+			if pIdx, ok := producers[s.StreamID]; ok && s.Type == StreamEndpointSpec_LOCAL {
+				if fusions == nil {
+					fusions = make(map[StreamID]int)
+				}
+				fusions[s.StreamID] = pIdx
+			}
+		}
+	}
+	return fusions
+}
+
 func (f *Flow) setup(ctx context.Context, spec *FlowSpec) error {
-	// First step: setup the input synchronizers for all processors.
+	f.streamCompression = spec.StreamCompression
+	f.collectStats = spec.CollectStats
+	bufSize := int(spec.RowChannelBufSize)
+	if bufSize == 0 {
+		bufSize = rowChannelBufSize
+	}
+	// Linear chains of local processors are fused: a fused processor is the
+	// input of its consumer, instead of a RowChannel.
+	fusions := findFusions(spec)
+	fusedProcs := make(map[int]bool, len(fusions))
+	for _, pIdx := range fusions {
+		fusedProcs[pIdx] = true
+	}
+
+	// First step: setup the input synchronizers for all processors. The inputs
+	// coming from fused processors are filled in once these are created.
 	inputSyncs := make([][]RowSource, len(spec.Processors))
 	for pIdx, ps := range spec.Processors {
 		for _, is := range ps.Input {
 			if len(is.Streams) == 0 {
 				return errors.Errorf("input sync with no streams")
 			}
+			if _, ok := fusions[is.Streams[0].StreamID]; ok {
+				inputSyncs[pIdx] = append(inputSyncs[pIdx], nil)
+				continue
+			}
 			var sync RowSource
 			switch is.Type {
 			case InputSyncSpec_UNORDERED:
 				if len(is.Streams) == 1 {
 					rowChan := &RowChannel{}
-					rowChan.Init(is.ColumnTypes)
+					rowChan.InitWithBufSize(is.ColumnTypes, bufSize)
+					f.initInputRowChannel(ctx, rowChan)
 					if err := f.setupInboundStream(ctx, is.Streams[0], rowChan); err != nil {
 						return err
 					}
 					sync = rowChan
 				} else {
 					mrc := &MultiplexedRowChannel{}
-					mrc.Init(len(is.Streams), is.ColumnTypes)
+					mrc.InitWithBufSize(len(is.Streams), is.ColumnTypes, bufSize)
+					f.initInputRowChannel(ctx, &mrc.rowChan)
 					for _, s := range is.Streams {
 						if err := f.setupInboundStream(ctx, s, mrc); err != nil {
 							return err
@@ -306,7 +525,8 @@ func (f *Flow) setup(ctx context.Context, spec *FlowSpec) error {
 				streams := make([]RowSource, len(is.Streams))
 				for i, s := range is.Streams {
 					rowChan := &RowChannel{}
-					rowChan.Init(is.ColumnTypes)
+					rowChan.InitWithBufSize(is.ColumnTypes, bufSize)
+					f.initInputRowChannel(ctx, rowChan)
 					if err := f.setupInboundStream(ctx, s, rowChan); err != nil {
 						return err
 					}
@@ -325,14 +545,54 @@ func (f *Flow) setup(ctx context.Context, spec *FlowSpec) error {
 		}
 	}
 
-	f.processors = make([]Processor, len(spec.Processors))
+	procs := make([]Processor, len(spec.Processors))
+	f.processorMonitors = make([]mon.BytesMonitor, len(spec.Processors))
 
-	for i := range spec.Processors {
+	// makeProc creates the processor with the given index, after creating the
+	// fused processors it uses as inputs.
+	var makeProc func(i int) error
+	makeProc = func(i int) error {
+		if procs[i] != nil {
+			return nil
+		}
+		for j, is := range spec.Processors[i].Input {
+			pIdx, ok := fusions[is.Streams[0].StreamID]
+			if !ok || inputSyncs[i][j] != nil {
+				continue
+			}
+			if err := makeProc(pIdx); err != nil {
+				return err
+			}
+			inputSyncs[i][j] = procs[pIdx].(RowSourcedProcessor)
+		}
+		procMon := &f.processorMonitors[i]
+		*procMon = mon.MakeMonitorWithLimit(
+			fmt.Sprintf("flow-processor-%d", i),
+			mon.MemoryResource,
+			0,   /* limit: the flow's monitor enforces the budget */
+			nil, /* curCount: accounted for by the flow's monitor */
+			nil, /* maxHist */
+			-1,  /* increment: use default block size */
+			noteworthyMemoryUsageBytes,
+		)
+		procMon.Start(ctx, f.EvalCtx.Mon, mon.BoundAccount{})
 		var err error
-		f.processors[i], err = f.makeProcessor(&spec.Processors[i], inputSyncs[i])
-		if err != nil {
+		procs[i], err = f.makeProcessor(i, &spec.Processors[i], inputSyncs[i], procMon, fusedProcs[i])
+		return err
+	}
+
+	for i := range spec.Processors {
+		if err := makeProc(i); err != nil {
 			return err
 		}
+		if fusedProcs[i] {
+			f.fusedProcessors = append(f.fusedProcessors, procs[i].(RowSourcedProcessor))
+		} else {
+			f.processors = append(f.processors, procs[i])
+		}
+	}
+	if len(f.fusedProcessors) > 0 {
+		log.VEventf(ctx, 1, "fused %d processors with their consumers", len(f.fusedProcessors))
 	}
 	return nil
 }
@@ -344,6 +604,7 @@ func (f *Flow) Start(ctx context.Context, doneFn func()) {
 		ctx, 1, "starting (%d processors, %d startables)", len(f.processors), len(f.startables),
 	)
 	f.status = FlowRunning
+	ctx, f.ctxCancel = context.WithCancel(ctx)
 
 	// Once we call RegisterFlow, the inbound streams become accessible; we must
 	// set up the WaitGroup counter before.
@@ -356,11 +617,57 @@ func (f *Flow) Start(ctx context.Context, doneFn func()) {
 	for _, s := range f.startables {
 		s.start(ctx, &f.waitGroup)
 	}
+	for _, p := range f.fusedProcessors {
+		p.Start(ctx)
+	}
 	for _, p := range f.processors {
 		go p.Run(ctx, &f.waitGroup)
 	}
 }
 
+// failToStart reports the given error, which prevents the flow from running,
+// to the consumers of the flow instead of starting it: the error is sent on
+// each of the flow's outboxes and pushed to its sync flow consumer, if any. The
+// processors of the flow are not run. The flow must be cleaned up once Wait
+// returns.
+func (f *Flow) failToStart(ctx context.Context, err error) {
+	for _, s := range f.startables {
+		if outbox, ok := s.(*outbox); ok {
+			outbox.start(ctx, &f.waitGroup)
+			outbox.Push(nil /* row */, ProducerMetadata{Err: err})
+			outbox.ProducerDone()
+		}
+	}
+	if f.syncFlowConsumer != nil {
+		f.syncFlowConsumer.Push(nil /* row */, ProducerMetadata{Err: err})
+		f.syncFlowConsumer.ProducerDone()
+	}
+}
+
+// Cancel cancels a running flow: the KV requests of its processors are
+// canceled and its outboxes send an error to their consumers and stop sending
+// rows, which in turn causes the processors to stop. It is a no-op if the flow
+// hasn't been started.
+func (f *Flow) Cancel() {
+	if f.ctxCancel != nil {
+		f.ctxCancel()
+	}
+}
+
+// Pause pauses the flow: its table readers send a checkpoint of their progress
+// (see ScanCheckpoint) and stop reading until the flow is resumed; the rest of
+// the flow idles once it has processed the rows which were read. The flow can
+// either be resumed, or canceled and planned again later from the checkpoints.
+// A flow can be paused before it is started.
+func (f *Flow) Pause() {
+	f.pauseGate.pause()
+}
+
+// Resume resumes a paused flow.
+func (f *Flow) Resume() {
+	f.pauseGate.resume()
+}
+
 // Wait waits for all the goroutines for this flow to exit.
 func (f *Flow) Wait() {
 	f.waitGroup.Wait()
@@ -372,9 +679,27 @@ func (f *Flow) Cleanup(ctx context.Context) {
 	if f.status == FlowFinished {
 		panic("flow cleanup called twice")
 	}
+	for i := range f.processorMonitors {
+		procMon := &f.processorMonitors[i]
+		log.VEventf(ctx, 1, "processor %d: max memory usage %s",
+			i, humanizeutil.IBytes(procMon.MaximumBytes()))
+		procMon.Stop(ctx)
+	}
+	for _, rc := range f.inputRowChannels {
+		rc.memAcc.Close(ctx)
+	}
 	// This closes the account and monitor opened in ServerImpl.setupFlow.
 	f.EvalCtx.ActiveMemAcc.Close(ctx)
-	f.EvalCtx.Stop(ctx)
+	if f.memReserved {
+		f.EvalCtx.Stop(ctx)
+	}
+	if f.tempStorageNamespace != nil {
+		if err := f.tempStorageNamespace.Clear(f.tempStorage); err != nil {
+			log.Warningf(ctx, "unable to clear the temporary storage of the flow: %s", err)
+		}
+		// This stops the disk monitor opened in ServerImpl.setupFlow.
+		f.diskMonitor.Stop(ctx)
+	}
 	if log.V(1) {
 		log.Infof(ctx, "cleaning up")
 	}
@@ -382,15 +707,23 @@ func (f *Flow) Cleanup(ctx context.Context) {
 	sp.Finish()
 	if f.status != FlowNotStarted {
 		f.flowRegistry.UnregisterFlow(f.id)
+		// Release the resources of the flow's context.
+		f.ctxCancel()
 	}
 	f.status = FlowFinished
-	f.doneFn()
-	f.doneFn = nil
+	// doneFn is not set if the flow is cleaned up without having been started.
+	if f.doneFn != nil {
+		f.doneFn()
+		f.doneFn = nil
+	}
 }
 
 // RunSync runs the processors in the flow in order (serially), in the same
 // context (no goroutines are spawned).
 func (f *Flow) RunSync(ctx context.Context) {
+	for _, p := range f.fusedProcessors {
+		p.Start(ctx)
+	}
 	for _, p := range f.processors {
 		p.Run(ctx, nil)
 	}
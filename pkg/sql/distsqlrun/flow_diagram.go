@@ -96,9 +96,15 @@ func (a *AggregatorSpec) summary() (string, []string) {
 			fmt.Fprintf(&buf, "@%d", c+1)
 		}
 		buf.WriteByte(')')
+		if agg.SkipNulls {
+			buf.WriteString(" SKIP NULLS")
+		}
 		if agg.FilterColIdx != nil {
 			fmt.Fprintf(&buf, " FILTER @%d", *agg.FilterColIdx+1)
 		}
+		if agg.Filter.Expr != "" {
+			fmt.Fprintf(&buf, " FILTER %s", agg.Filter.Expr)
+		}
 
 		details = append(details, buf.String())
 	}
@@ -148,6 +154,130 @@ func (hj *HashJoinerSpec) summary() (string, []string) {
 	return "HashJoiner", details
 }
 
+func (irj *InterleavedReaderJoinerSpec) summary() (string, []string) {
+	details := make([]string, 0, len(irj.Tables)+1)
+	for _, t := range irj.Tables {
+		index := "primary"
+		if t.IndexIdx > 0 {
+			index = t.Desc.Indexes[t.IndexIdx-1].Name
+		}
+		details = append(details, fmt.Sprintf("%s@%s", index, t.Desc.Name))
+		details = append(details, t.Post.summary()...)
+	}
+	if irj.OnExpr.Expr != "" {
+		details = append(details, fmt.Sprintf("ON %s", irj.OnExpr.Expr))
+	}
+	return "InterleavedReaderJoiner", details
+}
+
+func (lj *LookupJoinerSpec) summary() (string, []string) {
+	index := "primary"
+	if lj.IndexIdx > 0 {
+		index = lj.Table.Indexes[lj.IndexIdx-1].Name
+	}
+	details := []string{
+		fmt.Sprintf("%s@%s", index, lj.Table.Name),
+		fmt.Sprintf("lookup(%s)", colListStr(lj.LookupColumns)),
+	}
+	if lj.OnExpr.Expr != "" {
+		details = append(details, fmt.Sprintf("ON %s", lj.OnExpr.Expr))
+	}
+	return "LookupJoiner", details
+}
+
+func (zj *ZigzagJoinerSpec) summary() (string, []string) {
+	details := make([]string, 0, len(zj.Sides)+2)
+	for _, side := range zj.Sides {
+		index := "primary"
+		if side.IndexIdx > 0 {
+			index = zj.Table.Indexes[side.IndexIdx-1].Name
+		}
+		fixed := make([]string, len(side.FixedValues))
+		for i, v := range side.FixedValues {
+			fixed[i] = v.Expr
+		}
+		details = append(details, fmt.Sprintf(
+			"%s@%s fixed(%s)", index, zj.Table.Name, strings.Join(fixed, ", "),
+		))
+	}
+	details = append(details, fmt.Sprintf("eq(%s)", colListStr(zj.EqColumns)))
+	if zj.OnExpr.Expr != "" {
+		details = append(details, fmt.Sprintf("ON %s", zj.OnExpr.Expr))
+	}
+	return "ZigzagJoiner", details
+}
+
+// sketchesSummary returns a description of each sketch.
+func sketchesSummary(sketches []SketchSpec) []string {
+	details := make([]string, len(sketches))
+	for i, sk := range sketches {
+		details[i] = fmt.Sprintf("sketch(%s)", colListStr(sk.Columns))
+		if sk.GenerateHistogram {
+			details[i] += fmt.Sprintf(" histogram(%d)", sk.HistogramMaxBuckets)
+		}
+	}
+	return details
+}
+
+func (s *SamplerSpec) summary() (string, []string) {
+	details := append(
+		[]string{fmt.Sprintf("SampleSize: %d", s.SampleSize)}, sketchesSummary(s.Sketches)...,
+	)
+	return "Sampler", details
+}
+
+func (s *SampleAggregatorSpec) summary() (string, []string) {
+	details := append(
+		[]string{fmt.Sprintf("SampleSize: %d", s.SampleSize)}, sketchesSummary(s.Sketches)...,
+	)
+	return "SampleAggregator", details
+}
+
+func (w *CSVWriterSpec) summary() (string, []string) {
+	details := []string{w.Destination + "/" + w.NamePattern}
+	if w.ChunkRows != 0 {
+		details = append(details, fmt.Sprintf("ChunkRows: %d", w.ChunkRows))
+	}
+	if w.ChunkSize != 0 {
+		details = append(details, fmt.Sprintf("ChunkSize: %d", w.ChunkSize))
+	}
+	return "CSVWriter", details
+}
+
+func (r *CSVReaderSpec) summary() (string, []string) {
+	return "CSVReader", r.Uris
+}
+
+func (c *CSVConverterSpec) summary() (string, []string) {
+	return "CSVConverter", []string{c.TableDesc.Name}
+}
+
+func (w *KVWriterSpec) summary() (string, []string) {
+	return "KVWriter", []string{fmt.Sprintf("BatchSize: %d", w.BatchSize)}
+}
+
+func (ic *IndexCheckerSpec) summary() (string, []string) {
+	index := "primary"
+	if ic.IndexIdx > 0 {
+		index = ic.Table.Indexes[ic.IndexIdx-1].Name
+	}
+	return "IndexChecker", []string{
+		fmt.Sprintf("%s@%s", index, ic.Table.Name), ic.Check.String(),
+	}
+}
+
+func (cc *ConstraintCheckerSpec) summary() (string, []string) {
+	return "ConstraintChecker", []string{cc.Table.Name}
+}
+
+func (ps *ProjectSetSpec) summary() (string, []string) {
+	details := make([]string, len(ps.Exprs))
+	for i, e := range ps.Exprs {
+		details[i] = e.Expr
+	}
+	return "ProjectSet", details
+}
+
 func (hj *MergeJoinerSpec) summary() (string, []string) {
 	details := make([]string, 1, 2)
 	details[0] = fmt.Sprintf(
@@ -203,6 +203,30 @@ func (fr *flowRegistry) UnregisterFlow(id FlowID) {
 	fr.Unlock()
 }
 
+// LookupFlow returns the registered flow with the given ID, or nil if no such
+// flow is registered.
+func (fr *flowRegistry) LookupFlow(id FlowID) *Flow {
+	fr.Lock()
+	defer fr.Unlock()
+	if entry, ok := fr.flows[id]; ok {
+		return entry.flow
+	}
+	return nil
+}
+
+// CancelFlow cancels the registered flow with the given ID (see Flow.Cancel).
+// It returns false if no such flow is registered.
+func (fr *flowRegistry) CancelFlow(id FlowID) bool {
+	fr.Lock()
+	defer fr.Unlock()
+	entry, ok := fr.flows[id]
+	if !ok || entry.flow == nil {
+		return false
+	}
+	entry.flow.Cancel()
+	return true
+}
+
 // waitForFlowLocked returns the flowEntry of a registered flow with the given
 // ID. If no such flow is registered, waits until it gets registered - up to the
 // given timeout. If the timeout elapses, returns nil. It should only be called
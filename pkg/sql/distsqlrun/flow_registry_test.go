@@ -177,6 +177,34 @@ func TestFlowRegistry(t *testing.T) {
 
 // Test that, if inbound streams are not connected within the timeout, errors
 // are propagated to their consumers and future attempts to connect them fail.
+// Test that CancelFlow cancels registered flows only.
+func TestFlowRegistryCancelFlow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	reg := makeFlowRegistry()
+
+	ctx := context.Background()
+	flowCtx, cancel := context.WithCancel(ctx)
+	id := FlowID{uuid.MakeV4()}
+	f := &Flow{ctxCancel: cancel}
+
+	if reg.CancelFlow(id) {
+		t.Fatal("canceled unregistered flow")
+	}
+	reg.RegisterFlow(ctx, id, f, nil /* inboundStreams */, flowStreamDefaultTimeout)
+	if !reg.CancelFlow(id) {
+		t.Fatal("couldn't cancel registered flow")
+	}
+	select {
+	case <-flowCtx.Done():
+	default:
+		t.Fatal("flow context not canceled")
+	}
+	reg.UnregisterFlow(id)
+	if reg.CancelFlow(id) {
+		t.Fatal("canceled unregistered flow")
+	}
+}
+
 func TestStreamConnectionTimeout(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	reg := makeFlowRegistry()
@@ -16,25 +16,44 @@ package distsqlrun
 
 import (
 	"container/list"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/admission"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 )
 
-const maxRunningFlows = 500
 const flowDoneChanSize = 8
 
 // flowScheduler manages running flows and decides when to queue and when to
 // start flows. The main interface it presents is ScheduleFlows, which passes a
 // flow to be run.
+//
+// The number of running flows is limited by sql.distsql.max_running_flows, and
+// each flow must reserve sql.distsql.flow_memory_reservation from the node's
+// sql memory pool before it runs; further flows are queued. The queue is
+// bounded by sql.distsql.max_queued_flows: flows are rejected when it is full.
+// Flows which wait longer than sql.distsql.flow_queue_timeout in the queue are
+// abandoned, as the flows consuming their streams have given up on them by
+// then; a timer enforces the timeout even if no flow completes meanwhile.
 type flowScheduler struct {
 	log.AmbientContext
+	settings   *cluster.Settings
 	stopper    *stop.Stopper
 	flowDoneCh chan *Flow
-	metrics    *DistSQLMetrics
+	// flowQueuedCh is signaled when a flow is queued, so that the main loop
+	// sets its timer for the flow to expire.
+	flowQueuedCh chan struct{}
+	metrics      *DistSQLMetrics
+	// admission, if set, is the process-wide admission controller. Each
+	// scheduled flow holds one of its tokens until the flow completes.
+	admission *admission.Controller
 
 	mu struct {
 		syncutil.Mutex
@@ -47,58 +66,247 @@ type flowScheduler struct {
 // TODO(asubiotto): Figure out if asynchronous flow execution can be rearranged
 // to avoid the need to store the context.
 type flowWithCtx struct {
-	ctx  context.Context
-	flow *Flow
+	ctx         context.Context
+	flow        *Flow
+	enqueueTime time.Time
 }
 
 func newFlowScheduler(
-	ambient log.AmbientContext, stopper *stop.Stopper, metrics *DistSQLMetrics,
+	ambient log.AmbientContext,
+	settings *cluster.Settings,
+	stopper *stop.Stopper,
+	metrics *DistSQLMetrics,
+	admissionController *admission.Controller,
 ) *flowScheduler {
 	fs := &flowScheduler{
 		AmbientContext: ambient,
+		settings:       settings,
 		stopper:        stopper,
 		flowDoneCh:     make(chan *Flow, flowDoneChanSize),
+		flowQueuedCh:   make(chan struct{}, 1),
 		metrics:        metrics,
+		admission:      admissionController,
 	}
 	fs.mu.queue = list.New()
 	return fs
 }
 
-func (fs *flowScheduler) canRunFlow(_ *Flow) bool {
-	// TODO(radu): we will have more complex resource accounting (like memory).
-	// For now we just limit the number of concurrent flows.
-	return fs.mu.numRunning < maxRunningFlows
+// canRunFlowLocked returns whether the given flow can run now, in which case
+// its memory has been reserved. If the flow can't reserve its memory while no
+// other flow is running, the error is returned: the flow can't count on
+// memory being released by running flows then.
+func (fs *flowScheduler) canRunFlowLocked(ctx context.Context, f *Flow) (bool, error) {
+	if fs.mu.numRunning >= int(fs.settings.MaxRunningFlows.Get()) {
+		return false, nil
+	}
+	if err := f.reserveMemory(ctx); err != nil {
+		if fs.mu.numRunning == 0 {
+			return false, err
+		}
+		log.VEventf(ctx, 1, "flow %s waiting for memory: %s", f.id.Short(), err)
+		return false, nil
+	}
+	return true, nil
 }
 
 // runFlowNow starts the given flow; does not wait for the flow to complete.
 func (fs *flowScheduler) runFlowNow(ctx context.Context, f *Flow) {
 	fs.mu.numRunning++
 	fs.metrics.FlowStart()
+	start := timeutil.Now()
 	f.Start(ctx, func() { fs.flowDoneCh <- f })
 	// TODO(radu): we could replace the WaitGroup with a structure that keeps a
 	// refcount and automatically runs Cleanup() when the count reaches 0.
 	go func() {
 		f.Wait()
+		fs.metrics.FlowLatency.RecordValue(timeutil.Since(start).Nanoseconds())
 		f.Cleanup(ctx)
+		if fs.admission != nil {
+			fs.admission.Release()
+		}
+	}()
+}
+
+// abandonFlowLocked fails a queued flow which has waited too long to run.
+func (fs *flowScheduler) abandonFlowLocked(n *flowWithCtx) {
+	err := pgerror.NewErrorf(pgerror.CodeInsufficientResourcesError,
+		"distributed sql flow abandoned after waiting %s in the queue",
+		timeutil.Since(n.enqueueTime))
+	log.Warningf(n.ctx, "flow %s: %s", n.flow.id.Short(), err)
+	fs.metrics.FlowsTimedOut.Inc(1)
+	fs.stopQueuedFlowLocked(n, err)
+}
+
+// failQueuedFlowLocked fails a queued flow which can't run because of the
+// given error.
+func (fs *flowScheduler) failQueuedFlowLocked(n *flowWithCtx, err error) {
+	log.Warningf(n.ctx, "flow %s failed to start: %s", n.flow.id.Short(), err)
+	fs.metrics.FlowsRejected.Inc(1)
+	fs.stopQueuedFlowLocked(n, err)
+}
+
+// stopQueuedFlowLocked reports the given error to the consumers of a flow
+// removed from the queue, and cleans the flow up once its outboxes are done;
+// the flow is not run.
+func (fs *flowScheduler) stopQueuedFlowLocked(n *flowWithCtx, err error) {
+	n.flow.failToStart(n.ctx, err)
+	go func() {
+		n.flow.Wait()
+		n.flow.Cleanup(n.ctx)
+		if fs.admission != nil {
+			fs.admission.Release()
+		}
 	}()
 }
 
+// LookupQueuedFlow returns the queued flow with the given ID, or nil if no such
+// flow is queued.
+func (fs *flowScheduler) LookupQueuedFlow(id FlowID) *Flow {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for e := fs.mu.queue.Front(); e != nil; e = e.Next() {
+		if f := e.Value.(*flowWithCtx).flow; f.id == id {
+			return f
+		}
+	}
+	return nil
+}
+
+// CancelQueuedFlow removes the flow with the given ID from the queue and cleans
+// it up without running it. It returns false if the flow is not queued, in
+// which case it might be running already.
+func (fs *flowScheduler) CancelQueuedFlow(id FlowID) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for e := fs.mu.queue.Front(); e != nil; e = e.Next() {
+		if e.Value.(*flowWithCtx).flow.id != id {
+			continue
+		}
+		n := fs.dequeueFlowLocked(e)
+		log.VEventf(n.ctx, 1, "flow %s canceled while queued", id.Short())
+		fs.stopQueuedFlowLocked(n, pgerror.NewErrorf(pgerror.CodeQueryCanceledError,
+			"distributed sql flow canceled while queued"))
+		return true
+	}
+	return false
+}
+
+// dequeueFlowLocked removes the given element from the queue of flows and
+// returns its flow.
+func (fs *flowScheduler) dequeueFlowLocked(e *list.Element) *flowWithCtx {
+	n := fs.mu.queue.Remove(e).(*flowWithCtx)
+	fs.metrics.FlowsQueued.Dec(1)
+	fs.metrics.QueueWaitHist.RecordValue(timeutil.Since(n.enqueueTime).Nanoseconds())
+	return n
+}
+
+// expireQueuedFlowsLocked abandons the queued flows which have waited longer
+// than the queue timeout.
+func (fs *flowScheduler) expireQueuedFlowsLocked() {
+	timeout := fs.settings.FlowQueueTimeout.Get()
+	if timeout == 0 {
+		return
+	}
+	for e := fs.mu.queue.Front(); e != nil; {
+		next := e.Next()
+		if timeutil.Since(e.Value.(*flowWithCtx).enqueueTime) >= timeout {
+			fs.abandonFlowLocked(fs.dequeueFlowLocked(e))
+		}
+		e = next
+	}
+}
+
+// nextExpirationLocked returns the time left until the queued flow which has
+// waited the longest expires. It returns false if no queued flow can expire.
+func (fs *flowScheduler) nextExpirationLocked() (time.Duration, bool) {
+	if fs.mu.queue.Len() == 0 {
+		return 0, false
+	}
+	timeout := fs.settings.FlowQueueTimeout.Get()
+	if timeout == 0 {
+		return 0, false
+	}
+	var oldest time.Time
+	for e := fs.mu.queue.Front(); e != nil; e = e.Next() {
+		if t := e.Value.(*flowWithCtx).enqueueTime; oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	return timeout - timeutil.Since(oldest), true
+}
+
+// enqueueFlowLocked adds the given flow to the queue of flows waiting to run.
+// The queue is ordered by context deadline: flows whose contexts have the
+// nearest deadline are run first, followed by flows without a deadline in the
+// order in which they were scheduled.
+func (fs *flowScheduler) enqueueFlowLocked(ctx context.Context, f *Flow) {
+	n := &flowWithCtx{
+		ctx:         ctx,
+		flow:        f,
+		enqueueTime: timeutil.Now(),
+	}
+	fs.metrics.FlowsQueued.Inc(1)
+	select {
+	case fs.flowQueuedCh <- struct{}{}:
+	default:
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		fs.mu.queue.PushBack(n)
+		return
+	}
+	for e := fs.mu.queue.Front(); e != nil; e = e.Next() {
+		other, hasDeadline := e.Value.(*flowWithCtx).ctx.Deadline()
+		if !hasDeadline || deadline.Before(other) {
+			fs.mu.queue.InsertBefore(n, e)
+			return
+		}
+	}
+	fs.mu.queue.PushBack(n)
+}
+
 // ScheduleFlow is the main interface of the flow scheduler: it runs or enqueues
-// the given flow.
+// the given flow. An error is returned if the queue of flows is full or, if
+// the scheduler has an admission controller, if the flow can't be admitted
+// right away, in which case the flow is not run. ScheduleFlow doesn't wait for
+// admission: the flows of a query are set up on several nodes, and flows
+// waiting for each other's admission tokens across nodes could deadlock.
 func (fs *flowScheduler) ScheduleFlow(ctx context.Context, f *Flow) error {
-	return fs.stopper.RunTask(ctx, "distsqlrun.flowScheduler: scheduling flow", func(ctx context.Context) {
+	if fs.admission != nil && !fs.admission.TryAdmit(admission.NormalPri) {
+		fs.metrics.FlowsRejected.Inc(1)
+		return pgerror.NewErrorf(pgerror.CodeInsufficientResourcesError,
+			"too many concurrent operations on node: distributed sql flow not admitted")
+	}
+	var queueErr error
+	err := fs.stopper.RunTask(ctx, "distsqlrun.flowScheduler: scheduling flow", func(ctx context.Context) {
 		fs.mu.Lock()
 		defer fs.mu.Unlock()
 
-		if fs.canRunFlow(f) {
+		if ok, err := fs.canRunFlowLocked(ctx, f); err != nil {
+			fs.metrics.FlowsRejected.Inc(1)
+			queueErr = err
+			return
+		} else if ok {
 			fs.runFlowNow(ctx, f)
-		} else {
-			fs.mu.queue.PushBack(&flowWithCtx{
-				ctx:  ctx,
-				flow: f,
-			})
+			return
+		}
+		fs.expireQueuedFlowsLocked()
+		if maxQueued := int(fs.settings.MaxQueuedFlows.Get()); fs.mu.queue.Len() >= maxQueued {
+			fs.metrics.FlowsRejected.Inc(1)
+			queueErr = pgerror.NewErrorf(pgerror.CodeInsufficientResourcesError,
+				"too many distributed sql flows on node: %d running, %d queued",
+				fs.mu.numRunning, fs.mu.queue.Len())
+			return
 		}
+		fs.enqueueFlowLocked(ctx, f)
 	})
+	if err == nil {
+		err = queueErr
+	}
+	if err != nil && fs.admission != nil {
+		fs.admission.Release()
+	}
+	return err
 }
 
 // Start launches the main loop of the scheduler.
@@ -106,6 +314,8 @@ func (fs *flowScheduler) Start() {
 	ctx := fs.AnnotateCtx(context.Background())
 	fs.stopper.RunWorker(ctx, func(context.Context) {
 		stopped := false
+		var timer timeutil.Timer
+		defer timer.Stop()
 		fs.mu.Lock()
 		defer fs.mu.Unlock()
 
@@ -114,16 +324,44 @@ func (fs *flowScheduler) Start() {
 				// TODO(radu): somehow error out the flows that are still in the queue.
 				return
 			}
+			// Wake up when the oldest queued flow expires.
+			var expiredCh <-chan time.Time
+			if d, ok := fs.nextExpirationLocked(); ok && !stopped {
+				timer.Reset(d)
+				expiredCh = timer.C
+			}
 			fs.mu.Unlock()
 			select {
+			case <-expiredCh:
+				timer.Read = true
+				fs.mu.Lock()
+				fs.expireQueuedFlowsLocked()
+
+			case <-fs.flowQueuedCh:
+				fs.mu.Lock()
+
 			case <-fs.flowDoneCh:
 				fs.mu.Lock()
 				fs.mu.numRunning--
 				fs.metrics.FlowStop()
 				if !stopped {
-					if frElem := fs.mu.queue.Front(); frElem != nil {
+					fs.expireQueuedFlowsLocked()
+					// A flow which can't reserve its memory stays at the front of
+					// the queue until another flow completes or it expires, unless
+					// no flow is running anymore: then it fails, and the next flow
+					// gets a chance to run.
+					for fs.mu.queue.Len() > 0 {
+						frElem := fs.mu.queue.Front()
 						n := frElem.Value.(*flowWithCtx)
-						fs.mu.queue.Remove(frElem)
+						ok, err := fs.canRunFlowLocked(n.ctx, n.flow)
+						if err != nil {
+							fs.failQueuedFlowLocked(fs.dequeueFlowLocked(frElem), err)
+							continue
+						}
+						if !ok {
+							break
+						}
+						fs.dequeueFlowLocked(frElem)
 						// Note: we use the flow's context instead of the worker
 						// context, to ensure that logging etc is relative to the
 						// specific flow.
@@ -0,0 +1,319 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/admission"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+)
+
+// flowSchedulerTest holds the state shared by the flow scheduler tests.
+type flowSchedulerTest struct {
+	ctx      context.Context
+	stopper  *stop.Stopper
+	tracer   *tracing.Tracer
+	settings *cluster.Settings
+	metrics  DistSQLMetrics
+	reg      *flowRegistry
+	fs       *flowScheduler
+	// pool is a memory pool from which flows can reserve their memory, and
+	// emptyPool one from which they can't.
+	pool, emptyPool *mon.BytesMonitor
+}
+
+// makeFlowSchedulerTest starts a flow scheduler which runs a single flow at a
+// time, with the given admission controller (which can be nil). The returned
+// cleanup function must be called at the end of the test.
+func makeFlowSchedulerTest(ac *admission.Controller) (*flowSchedulerTest, func()) {
+	ctx := context.Background()
+	fst := &flowSchedulerTest{
+		ctx:      ctx,
+		stopper:  stop.NewStopper(),
+		tracer:   tracing.NewTracer(),
+		settings: cluster.MakeTestingClusterSettings(),
+		metrics:  MakeDistSQLMetrics(time.Hour),
+		reg:      makeFlowRegistry(),
+	}
+	fst.settings.MaxRunningFlows.Override(1)
+	fst.fs = newFlowScheduler(
+		log.AmbientContext{Tracer: fst.tracer}, fst.settings, fst.stopper, &fst.metrics, ac,
+	)
+	fst.fs.Start()
+
+	makePool := func(budget int64) *mon.BytesMonitor {
+		pool := mon.MakeMonitor(
+			"test-pool",
+			mon.MemoryResource,
+			nil, /* curCount */
+			nil, /* maxHist */
+			-1,  /* increment: use default block size */
+			math.MaxInt64,
+		)
+		pool.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(budget))
+		return &pool
+	}
+	fst.pool = makePool(math.MaxInt64)
+	fst.emptyPool = makePool(0)
+	return fst, func() {
+		fst.stopper.Stop(ctx)
+		fst.pool.Stop(ctx)
+		fst.emptyPool.Stop(ctx)
+	}
+}
+
+// makeFlow returns a flow without processors, which reserves its memory from
+// the given pool and reports errors to the given consumer (which can be nil),
+// along with the context to run it with.
+func (fst *flowSchedulerTest) makeFlow(
+	pool *mon.BytesMonitor, consumer RowReceiver,
+) (context.Context, *Flow) {
+	monitor := mon.MakeMonitor(
+		"flow",
+		mon.MemoryResource,
+		nil, /* curCount */
+		nil, /* maxHist */
+		-1,  /* increment: use default block size */
+		math.MaxInt64,
+	)
+	acc := monitor.MakeBoundAccount()
+	flowCtx := FlowCtx{
+		Settings: fst.settings,
+		id:       FlowID{UUID: uuid.MakeV4()},
+		EvalCtx: parser.EvalContext{
+			Mon:          &monitor,
+			ActiveMemAcc: &acc,
+		},
+	}
+	f := newFlow(flowCtx, fst.reg, consumer)
+	f.memPool = pool
+	return opentracing.ContextWithSpan(fst.ctx, fst.tracer.StartSpan("flow")), f
+}
+
+// occupySlot pretends that a flow is running, until releaseSlot is called.
+func (fst *flowSchedulerTest) occupySlot() {
+	fst.fs.mu.Lock()
+	defer fst.fs.mu.Unlock()
+	fst.fs.mu.numRunning++
+	fst.fs.metrics.FlowStart()
+}
+
+// releaseSlot completes the flow pretended to run by occupySlot.
+func (fst *flowSchedulerTest) releaseSlot() {
+	fst.fs.flowDoneCh <- nil
+}
+
+// waitIdle waits until no flow is running or queued.
+func (fst *flowSchedulerTest) waitIdle(t *testing.T) {
+	testutils.SucceedsSoon(t, func() error {
+		fst.fs.mu.Lock()
+		defer fst.fs.mu.Unlock()
+		if n := fst.fs.mu.queue.Len(); n != 0 {
+			return errors.Errorf("%d flows still queued", n)
+		}
+		if n := fst.fs.mu.numRunning; n != 0 {
+			return errors.Errorf("%d flows still running", n)
+		}
+		return nil
+	})
+}
+
+// expectConsumerError verifies that the consumer received the given error,
+// and was closed.
+func expectConsumerError(t *testing.T, consumer *RowChannel, expected string) {
+	if _, meta := consumer.Next(); !testutils.IsError(meta.Err, expected) {
+		t.Fatalf("expected error %q, got %v", expected, meta.Err)
+	}
+	if row, meta := consumer.Next(); row != nil || !meta.Empty() {
+		t.Fatalf("expected consumer to be closed, got %v %v", row, meta)
+	}
+}
+
+// TestFlowSchedulerFailsQueuedFlow verifies that a queued flow which can't
+// reserve its memory once no other flow is running is removed from the queue
+// and cleaned up, that its error is reported to its consumer, and that the
+// flows queued behind it still run.
+func TestFlowSchedulerFailsQueuedFlow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ac := admission.NewController(2)
+	fst, cleanup := makeFlowSchedulerTest(ac)
+	defer cleanup()
+
+	var consumer RowChannel
+	consumer.Init(nil /* types */)
+	failingCtx, failingFlow := fst.makeFlow(fst.emptyPool, &consumer)
+	okCtx, okFlow := fst.makeFlow(fst.pool, nil /* consumer */)
+
+	// Queue both flows behind a running flow, which then completes.
+	for i := 0; i < 2; i++ {
+		if !ac.TryAdmit(admission.NormalPri) {
+			t.Fatal("expected flow to be admitted")
+		}
+	}
+	fst.occupySlot()
+	fst.fs.mu.Lock()
+	fst.fs.enqueueFlowLocked(failingCtx, failingFlow)
+	fst.fs.enqueueFlowLocked(okCtx, okFlow)
+	fst.fs.mu.Unlock()
+	fst.releaseSlot()
+
+	// The error of the failing flow is reported to its consumer.
+	expectConsumerError(t, &consumer, "unable to reserve memory")
+
+	// The flow queued behind it runs and completes, and both flows release
+	// their admission tokens.
+	fst.waitIdle(t)
+	testutils.SucceedsSoon(t, func() error {
+		if n := ac.Available(); n != 2 {
+			return errors.Errorf("expected 2 admission tokens available, got %d", n)
+		}
+		return nil
+	})
+	if n := fst.metrics.FlowsRejected.Count(); n != 1 {
+		t.Errorf("expected 1 rejected flow, got %d", n)
+	}
+}
+
+// TestFlowSchedulerRejectsUnadmittedFlow verifies that a flow which can't be
+// admitted right away is rejected instead of waiting for admission.
+func TestFlowSchedulerRejectsUnadmittedFlow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ac := admission.NewController(1)
+	fst, cleanup := makeFlowSchedulerTest(ac)
+	defer cleanup()
+
+	if !ac.TryAdmit(admission.NormalPri) {
+		t.Fatal("expected to be admitted")
+	}
+	ctx, f := fst.makeFlow(fst.pool, nil /* consumer */)
+	if err := fst.fs.ScheduleFlow(ctx, f); !testutils.IsError(err, "not admitted") {
+		t.Fatalf("expected admission error, got %v", err)
+	}
+	f.Cleanup(ctx)
+	if n := ac.Available(); n != 0 {
+		t.Errorf("expected no admission token to be released, got %d available", n)
+	}
+	if n := fst.metrics.FlowsRejected.Count(); n != 1 {
+		t.Errorf("expected 1 rejected flow, got %d", n)
+	}
+
+	// Once a token is available, the flow is admitted and runs.
+	ac.Release()
+	ctx, f = fst.makeFlow(fst.pool, nil /* consumer */)
+	if err := fst.fs.ScheduleFlow(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	fst.waitIdle(t)
+	testutils.SucceedsSoon(t, func() error {
+		if n := ac.Available(); n != 1 {
+			return errors.Errorf("expected 1 admission token available, got %d", n)
+		}
+		return nil
+	})
+}
+
+// TestFlowSchedulerQueueLimit verifies that flows are rejected once the queue
+// is full, and that the consumers of a queued flow which gets canceled are
+// notified.
+func TestFlowSchedulerQueueLimit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fst, cleanup := makeFlowSchedulerTest(nil /* admission */)
+	defer cleanup()
+	fst.settings.MaxQueuedFlows.Override(1)
+
+	fst.occupySlot()
+	var consumer RowChannel
+	consumer.Init(nil /* types */)
+	queuedCtx, queuedFlow := fst.makeFlow(fst.pool, &consumer)
+	if err := fst.fs.ScheduleFlow(queuedCtx, queuedFlow); err != nil {
+		t.Fatal(err)
+	}
+	ctx, f := fst.makeFlow(fst.pool, nil /* consumer */)
+	if err := fst.fs.ScheduleFlow(ctx, f); !testutils.IsError(err, "too many distributed sql flows") {
+		t.Fatalf("expected queue limit error, got %v", err)
+	}
+	f.Cleanup(ctx)
+	if n := fst.metrics.FlowsRejected.Count(); n != 1 {
+		t.Errorf("expected 1 rejected flow, got %d", n)
+	}
+
+	if !fst.fs.CancelQueuedFlow(queuedFlow.id) {
+		t.Fatal("expected queued flow to be canceled")
+	}
+	expectConsumerError(t, &consumer, "canceled while queued")
+	fst.releaseSlot()
+	fst.waitIdle(t)
+}
+
+// TestFlowSchedulerQueueTimeout verifies that a flow which waits in the queue
+// longer than the queue timeout is abandoned, and its consumers notified, even
+// if no other flow completes meanwhile.
+func TestFlowSchedulerQueueTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fst, cleanup := makeFlowSchedulerTest(nil /* admission */)
+	defer cleanup()
+	fst.fs.mu.Lock()
+	fst.settings.FlowQueueTimeout = settings.TestingDuration(10 * time.Millisecond)
+	fst.fs.mu.Unlock()
+
+	fst.occupySlot()
+	var consumer RowChannel
+	consumer.Init(nil /* types */)
+	ctx, f := fst.makeFlow(fst.pool, &consumer)
+	if err := fst.fs.ScheduleFlow(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	expectConsumerError(t, &consumer, "abandoned after waiting")
+	if n := fst.metrics.FlowsTimedOut.Count(); n != 1 {
+		t.Errorf("expected 1 timed out flow, got %d", n)
+	}
+	fst.releaseSlot()
+	fst.waitIdle(t)
+}
+
+// TestFlowSchedulerRejectsFlowWithoutMemory verifies that a flow which can't
+// reserve its memory while no other flow is running is rejected rather than
+// queued.
+func TestFlowSchedulerRejectsFlowWithoutMemory(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fst, cleanup := makeFlowSchedulerTest(nil /* admission */)
+	defer cleanup()
+
+	ctx, f := fst.makeFlow(fst.emptyPool, nil /* consumer */)
+	if err := fst.fs.ScheduleFlow(ctx, f); !testutils.IsError(err, "unable to reserve memory") {
+		t.Fatalf("expected memory reservation error, got %v", err)
+	}
+	f.Cleanup(ctx)
+	if n := fst.metrics.FlowsRejected.Count(); n != 1 {
+		t.Errorf("expected 1 rejected flow, got %d", n)
+	}
+	fst.waitIdle(t)
+}
@@ -112,6 +112,23 @@ const sizeOfBucket = int64(unsafe.Sizeof([]int{}))
 const sizeOfRowIdx = int64(unsafe.Sizeof(int(0)))
 const sizeOfBoolSlice = int64(unsafe.Sizeof([]bool{}))
 const sizeOfBool = int64(unsafe.Sizeof(false))
+const sizeOfString = int64(unsafe.Sizeof(""))
+
+// mapEntryOverhead returns the estimated memory used by an entry of a Go map
+// whose keys and values have the given sizes, besides the memory that the key
+// and value point to. The entries are stored in buckets of slots holding the
+// key, the value and a byte of their hash. The buckets are between 40% and 80%
+// full, and the old buckets are kept while the map grows, so an entry uses
+// about twice the size of its slot. This is only a rough estimate: the actual
+// overhead depends on how full the buckets happen to be, and thus varies with
+// the number of entries.
+func mapEntryOverhead(keySize, valueSize int64) int64 {
+	return 2 * (keySize + valueSize + 1)
+}
+
+// sizeOfBucketsEntry is the memory used by an entry of
+// hashMemRowContainer.buckets, besides its key and its row indices.
+var sizeOfBucketsEntry = mapEntryOverhead(sizeOfString, sizeOfBucket)
 
 // hashMemRowContainer is an in-memory implementation of a hashRowContainer.
 // The rows are stored in an underlying memRowContainer and an accompanying
@@ -208,7 +225,7 @@ func (h *hashMemRowContainer) addRowToBucket(
 	usage := sizeOfRowIdx
 	if !ok {
 		usage += int64(len(encoded))
-		usage += sizeOfBucket
+		usage += sizeOfBucketsEntry
 	}
 
 	if err := h.bucketsAcc.Grow(ctx, usage); err != nil {
@@ -336,6 +353,7 @@ type hashDiskRowContainer struct {
 	// mark).
 	shouldMark    bool
 	engine        engine.Engine
+	namespace     *engine.TempStorageNamespace
 	scratchEncRow sqlbase.EncDatumRow
 }
 
@@ -347,10 +365,13 @@ var (
 )
 
 // makeHashDiskRowContainer creates a hashDiskRowContainer with the given engine
-// as the underlying store that rows are stored on. shouldMark specifies whether
-// the hashDiskRowContainer should set itself up to mark rows.
-func makeHashDiskRowContainer(diskMonitor *mon.BytesMonitor, e engine.Engine) hashDiskRowContainer {
-	return hashDiskRowContainer{diskMonitor: diskMonitor, engine: e}
+// as the underlying store that rows are stored on, in the given namespace if
+// set. shouldMark specifies whether the hashDiskRowContainer should set itself
+// up to mark rows.
+func makeHashDiskRowContainer(
+	diskMonitor *mon.BytesMonitor, e engine.Engine, namespace *engine.TempStorageNamespace,
+) hashDiskRowContainer {
+	return hashDiskRowContainer{diskMonitor: diskMonitor, engine: e, namespace: namespace}
 }
 
 // Init implements the hashRowContainer interface.
@@ -386,7 +407,9 @@ func (h *hashDiskRowContainer) Init(
 		)
 	}
 
-	h.diskRowContainer = makeDiskRowContainer(ctx, h.diskMonitor, storedTypes, ordering, h.engine)
+	h.diskRowContainer = makeDiskRowContainer(
+		ctx, h.diskMonitor, storedTypes, ordering, h.engine, h.namespace,
+	)
 	return nil
 }
 
@@ -16,14 +16,17 @@ package distsqlrun
 
 import (
 	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"sync"
 
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/bloom"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/pkg/errors"
@@ -33,6 +36,17 @@ import (
 // (see hashJoiner). This only applies when falling back to disk is disabled.
 const hashJoinerInitialBufferSize = 4 * 1024 * 1024
 
+// hashJoinerPartitionBits is the number of bits of the hash of the equality
+// columns used to pick a partition when the hashJoiner falls back to disk;
+// each partition is split into 1<<hashJoinerPartitionBits partitions.
+const hashJoinerPartitionBits = 3
+
+// hashJoinerMaxPartitionDepth is the number of times the partitions are split
+// when the stored side of a partition does not fit in memory. Past this depth
+// (e.g. if too many rows have the same equality columns), the partition is
+// joined using an on-disk hash table.
+const hashJoinerMaxPartitionDepth = 4
+
 // hashJoinPhases are used to describe phases of work in the hashJoiner. Used
 // in tests to specify a phase in which the hashJoiner should error out.
 type hashJoinPhase int
@@ -74,6 +88,14 @@ func (p hashJoinPhase) String() string {
 //  3. Probe phase: in this phase we process all the rows from the other stream
 //     and look for matching rows from the stored stream using the map.
 //
+// If the stored stream does not fit in memory during the first two phases and
+// falling back to disk is enabled, the rows of both streams are instead
+// partitioned on disk by the hash of their equality columns. The partitions
+// are then joined one at a time: the rows of one side of the partition are
+// loaded in memory and the rows of the other side probe them. A partition whose
+// rows do not fit in memory is itself split into smaller partitions, using
+// further bits of the hash.
+//
 // There is no guarantee on the output ordering.
 type hashJoiner struct {
 	joinerBase
@@ -91,9 +113,33 @@ type hashJoiner struct {
 	rows [2]memRowContainer
 
 	// storedSide is set by the initial buffering phase and indicates which
-	// stream we store fully and build the hashRowContainer from.
+	// stream we store fully and build the hashRowContainer from. When joining
+	// partitions, it is set for each partition.
 	storedSide joinSide
 
+	// evalCtx is the context the in-memory row containers are accounted
+	// against; its monitor is limited if falling back to disk is enabled.
+	evalCtx parser.EvalContext
+	// spiller decides whether the hashJoiner falls back to disk once the rows
+	// don't fit in memory.
+	spiller spiller
+
+	// partitions holds the partitions of the rows of both streams which are
+	// yet to be joined, once the hashJoiner has fallen back to disk.
+	partitions []*hashJoinPartition
+	// scratch and datumAlloc are used to encode the equality columns when
+	// partitioning rows.
+	scratch    []byte
+	datumAlloc sqlbase.DatumAlloc
+
+	// runtimeFilterID is the ID of the run-time filter the hashJoiner builds
+	// from the rows of runtimeFilterSide, if it's non-zero (see
+	// HashJoinerSpec).
+	runtimeFilterID   uint32
+	runtimeFilterSide joinSide
+	// runtimeFilterAcc accounts for the memory used by the run-time filter.
+	runtimeFilterAcc mon.BoundAccount
+
 	// testingKnobMemFailPoint specifies a phase in which the hashJoiner will
 	// fail at a random point during this phase.
 	testingKnobMemFailPoint hashJoinPhase
@@ -137,6 +183,18 @@ func newHashJoiner(
 	); err != nil {
 		return nil, err
 	}
+
+	if spec.RuntimeFilterID != 0 {
+		h.runtimeFilterID = spec.RuntimeFilterID
+		h.runtimeFilterSide = rightSide
+		if spec.RuntimeFilterLeft {
+			h.runtimeFilterSide = leftSide
+		}
+		// Filtering the other side would drop its unmatched rows.
+		if shouldEmitUnmatchedRow(otherSide(h.runtimeFilterSide), h.joinType) {
+			return nil, errors.Errorf("invalid run-time filter for %s join", spec.Type)
+		}
+	}
 	return h, nil
 }
 
@@ -147,7 +205,7 @@ func (h *hashJoiner) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 
 	ctx = log.WithLogTag(ctx, "HashJoiner", nil)
-	ctx, span := processorSpan(ctx, "hash joiner")
+	ctx, span := processorSpan(ctx, h.flowCtx, "hash joiner")
 	defer tracing.FinishSpan(span)
 
 	if log.V(2) {
@@ -155,17 +213,19 @@ func (h *hashJoiner) Run(ctx context.Context, wg *sync.WaitGroup) {
 		defer log.Infof(ctx, "exiting hash joiner run")
 	}
 
-	useTempStorage := (h.flowCtx.Settings.DistSQLUseTempStorage.Get() &&
-		h.flowCtx.Settings.DistSQLUseTempStorageJoins.Get()) ||
-		h.flowCtx.testingKnobs.MemoryLimitBytes > 0 ||
-		h.testingKnobMemFailPoint != unset
-	evalCtx := h.flowCtx.EvalCtx
-	if useTempStorage {
+	h.spiller = makeSpiller(
+		h.flowCtx, "hashjoiner", h.flowCtx.Settings.DistSQLUseTempStorageJoins,
+		h.flowCtx.testingKnobs.MemoryLimitBytes > 0 || h.testingKnobMemFailPoint != unset,
+	)
+	defer h.spiller.close(ctx)
+	h.evalCtx = h.flowCtx.EvalCtx
+	evalCtx := &h.evalCtx
+	if h.spiller.useTempStorage {
 		// Limit the memory use by creating a child monitor with a hard limit.
 		// The hashJoiner will overflow to disk if this limit is not enough.
 		limit := h.flowCtx.testingKnobs.MemoryLimitBytes
 		if limit <= 0 {
-			limit = workMemBytes
+			limit = h.flowCtx.workMemLimit()
 		}
 		limitedMon := mon.MakeMonitorInheritWithLimit("hashjoiner-limited", limit, evalCtx.Mon)
 		limitedMon.Start(ctx, evalCtx.Mon, mon.BoundAccount{})
@@ -178,26 +238,27 @@ func (h *hashJoiner) Run(ctx context.Context, wg *sync.WaitGroup) {
 		// to construct a hash map from these rows. We do not expect the hash
 		// map structure to consume more than the memory used to store the rows
 		// themselves.
-		// This assumption allows us to only worry about falling back to disk in
-		// the buffer phase.
+		// If it does, the rows are partitioned on disk in the build phase.
 		h.initialBufferSize = limit / 3
 
 		evalCtx.Mon = &limitedMon
 	}
 
-	h.rows[leftSide].init(nil /* ordering */, h.leftSource.Types(), &evalCtx)
-	h.rows[rightSide].init(nil /* ordering */, h.rightSource.Types(), &evalCtx)
+	h.runtimeFilterAcc = evalCtx.Mon.MakeBoundAccount()
+	defer h.runtimeFilterAcc.Close(ctx)
+
+	h.rows[leftSide].init(nil /* ordering */, h.leftSource.Types(), evalCtx)
+	h.rows[rightSide].init(nil /* ordering */, h.rightSource.Types(), evalCtx)
 	defer h.rows[leftSide].Close(ctx)
 	defer h.rows[rightSide].Close(ctx)
-
-	var storedRows hashRowContainer
 	defer func() {
-		if storedRows != nil {
-			storedRows.Close(ctx)
+		for _, p := range h.partitions {
+			p.close(ctx)
 		}
 	}()
 
-	if earlyExit, err := h.bufferPhase(ctx, useTempStorage, &storedRows); earlyExit || err != nil {
+	spilled, earlyExit, err := h.bufferPhase(ctx)
+	if earlyExit || err != nil {
 		if err != nil {
 			// We got an error. We still want to drain. Any error encountered while
 			// draining will be swallowed, and the original error will be forwarded to
@@ -214,31 +275,68 @@ func (h *hashJoiner) Run(ctx context.Context, wg *sync.WaitGroup) {
 		srcToClose = h.rightSource
 	}
 
-	// If storedRows is not nil, there was a memory limit reached in the buffer
-	// phase so we have already fallen back to a disk-based hashRowContainer.
-	// Otherwise, we have to build an in-memory hashRowContainer from
-	// h.rows[h.storedSide].
-	if storedRows == nil {
-		storedMemRows := makeHashMemRowContainer(&h.rows[h.storedSide])
-		if err := storedMemRows.Init(
-			ctx,
-			shouldEmitUnmatchedRow(h.storedSide, h.joinType),
-			h.rows[h.storedSide].types,
-			h.eqCols[h.storedSide],
-		); err != nil {
-			// We got an error. We still want to drain. Any error encountered
-			// while draining will be swallowed, and the original error will be
-			// forwarded to the consumer.
-			err = errors.Wrap(err, "error creating hash row container")
-			log.Info(ctx, err)
+	// If the buffer phase spilled, the rows of both streams have been
+	// partitioned on disk. Otherwise, we have to build an in-memory
+	// hashRowContainer from h.rows[h.storedSide], and partition the rows if
+	// it does not fit.
+	var storedRows hashRowContainer
+	if !spilled {
+		if err := h.maybePublishRuntimeFilter(ctx); err != nil {
+			log.Infof(ctx, "run-time filter error %s", err)
 			DrainAndClose(ctx, h.out.output, err /* cause */, h.leftSource, h.rightSource)
 			return
 		}
-		storedRows = &storedMemRows
+		storedMemRows := makeHashMemRowContainer(&h.rows[h.storedSide])
+		err := h.testingKnobMaybeFail(build)
+		if err == nil {
+			err = storedMemRows.Init(
+				ctx,
+				shouldEmitUnmatchedRow(h.storedSide, h.joinType),
+				h.rows[h.storedSide].types,
+				h.eqCols[h.storedSide],
+			)
+		}
+		if err == nil {
+			storedRows = &storedMemRows
+			defer storedRows.Close(ctx)
+		} else {
+			storedMemRows.Close(ctx)
+			if err = h.spiller.canSpill(err); err != nil {
+				err = errors.Wrap(err, "error creating hash row container")
+			} else {
+				log.VEventf(ctx, 2, "build phase falling back to disk")
+				spilled = true
+				earlyExit, err = h.partitionInputs(ctx, nil /* row */, true /* storedSideDone */)
+			}
+			if earlyExit || err != nil {
+				// We got an error. We still want to drain. Any error encountered
+				// while draining will be swallowed, and the original error will
+				// be forwarded to the consumer.
+				if err != nil {
+					log.Info(ctx, err)
+				}
+				DrainAndClose(ctx, h.out.output, err /* cause */, h.leftSource, h.rightSource)
+				return
+			}
+		}
 	}
 
 	log.VEventf(ctx, 1, "build phase complete")
 
+	if spilled {
+		// Both streams have been fully consumed into the partitions.
+		if earlyExit, err := h.joinPartitions(ctx); earlyExit || err != nil {
+			if err != nil {
+				log.Infof(ctx, "probe phase error %s", err)
+			}
+			DrainAndClose(ctx, h.out.output, err /* cause */)
+			return
+		}
+		sendTraceData(ctx, h.out.output)
+		h.out.Close()
+		return
+	}
+
 	if earlyExit, err := h.probePhase(ctx, storedRows); earlyExit || err != nil {
 		if err != nil {
 			// We got an error. We still want to drain. Any error encountered while
@@ -251,6 +349,48 @@ func (h *hashJoiner) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 }
 
+// maybePublishRuntimeFilter builds the run-time filter of the hashJoiner, if
+// it has one and its rows are the stored rows, and publishes it to the table
+// readers of the flow. No filter is built if the stored rows are too numerous
+// or the filter doesn't fit in memory; the table readers then read all their
+// rows.
+func (h *hashJoiner) maybePublishRuntimeFilter(ctx context.Context) error {
+	if h.runtimeFilterID == 0 || h.storedSide != h.runtimeFilterSide ||
+		h.flowCtx.runtimeFilters == nil {
+		return nil
+	}
+	rows := &h.rows[h.storedSide]
+	numRows := rows.Len()
+	if numRows > runtimeFilterMaxRows {
+		log.VEventf(ctx, 1, "not building a run-time filter from %d rows", numRows)
+		return nil
+	}
+	if err := h.runtimeFilterAcc.Grow(
+		ctx, bloom.Size(numRows, runtimeFilterBitsPerRow),
+	); err != nil {
+		log.VEventf(ctx, 1, "not building a run-time filter: %s", err)
+		return nil
+	}
+
+	filter := bloom.New(numRows, runtimeFilterBitsPerRow)
+	eqCols := h.eqCols[h.storedSide]
+	for i := 0; i < numRows; i++ {
+		// The rows with NULLs on equality columns were not stored (see
+		// receiveRow).
+		encoded, _, err := encodeColumnsOfRow(
+			&h.datumAlloc, h.scratch[:0], rows.EncRow(i), eqCols, false, /* encodeNull */
+		)
+		if err != nil {
+			return err
+		}
+		h.scratch = encoded
+		filter.Insert(encoded)
+	}
+	h.flowCtx.runtimeFilters.get(h.runtimeFilterID).publish(filter)
+	log.VEventf(ctx, 1, "published run-time filter %d built from %d rows", h.runtimeFilterID, numRows)
+	return nil
+}
+
 // receiveRow receives a row from either the left or right stream.
 // It takes care of forwarding any metadata, and processes any rows that have
 // NULL on an equality column - these rows will not match anything, they are
@@ -298,80 +438,36 @@ func (h *hashJoiner) receiveRow(
 // bufferPhase attempts to read a portion of both streams into memory (up to
 // h.initialBufferSize) in the hope that one of them is small and should be used
 // as h.storedSide. The phase attempts to consume all the rows from the chosen
-// side and falls back to disk if useTempStorage is true and the rows do not
-// fit in memory. In this case, an on-disk hash table is constructed from the
-// rows and storedRows is set to this hashRowContainer.
+// side and falls back to disk if h.spiller allows it and the rows do not fit
+// in memory. In this case, the rows of both streams are partitioned on
+// disk and spilled is set.
 // A successful initial buffering phase sets h.storedSide.
-func (h *hashJoiner) bufferPhase(
-	ctx context.Context, useTempStorage bool, storedRows *hashRowContainer,
-) (earlyExit bool, _ error) {
+func (h *hashJoiner) bufferPhase(ctx context.Context) (spilled bool, earlyExit bool, _ error) {
 	row, earlyExit, err := h.bufferPhaseImpl(ctx)
-	if pgErr, ok := err.(*pgerror.Error); earlyExit || !(ok && pgErr.Code == pgerror.CodeOutOfMemoryError) {
-		return earlyExit, err
-	}
-	if !useTempStorage {
-		return false, errors.Wrap(err, "external storage for large queries disabled")
+	if earlyExit || !isMemoryError(err) {
+		return false, earlyExit, err
 	}
-	if h.flowCtx.tempStorage == nil {
-		return false, errors.Wrap(err, "external storage not provided on this cockroach node")
+	if err := h.spiller.canSpill(err); err != nil {
+		return false, false, err
 	}
 
 	log.VEventf(ctx, 2, "buffer phase falling back to disk")
 
-	storedDiskRows := makeHashDiskRowContainer(h.flowCtx.diskMonitor, h.flowCtx.tempStorage)
-	if err := storedDiskRows.Init(
-		ctx,
-		shouldEmitUnmatchedRow(h.storedSide, h.joinType),
-		h.rows[h.storedSide].types,
-		h.eqCols[h.storedSide],
-	); err != nil {
-		return false, err
-	}
-
-	// Add the row that caused the memory error.
-	if row != nil {
-		if err := storedDiskRows.AddRow(ctx, row); err != nil {
-			return false, err
-		}
-	}
-
-	// Transfer rows from memory.
-	i := h.rows[h.storedSide].NewIterator(ctx)
-	defer i.Close()
-	for i.Rewind(); ; i.Next() {
-		if ok, err := i.Valid(); err != nil {
-			return false, err
-		} else if !ok {
-			break
-		}
-		memRow, err := i.Row()
-		if err != nil {
-			return false, err
-		}
-		if err := storedDiskRows.AddRow(ctx, memRow); err != nil {
-			return false, err
-		}
-	}
-
-	*storedRows = &storedDiskRows
+	earlyExit, err = h.partitionInputs(ctx, row, false /* storedSideDone */)
+	return true, earlyExit, err
+}
 
-	// Finish consuming the chosen source.
-	source := h.rightSource
-	if h.storedSide == leftSide {
-		source = h.leftSource
-	}
-	for {
-		row, earlyExit, err := h.receiveRow(ctx, source, h.storedSide)
-		if row == nil {
-			if err != nil {
-				return false, err
-			}
-			return earlyExit, nil
-		}
-		if err := storedDiskRows.AddRow(ctx, row); err != nil {
-			return false, err
-		}
+// testingKnobMaybeFail returns a memory error with probability
+// h.testingKnobFailProbability if h.testingKnobMemFailPoint is the given phase.
+func (h *hashJoiner) testingKnobMaybeFail(phase hashJoinPhase) error {
+	if h.testingKnobMemFailPoint == phase && rand.Float64() < h.testingKnobFailProbability {
+		return pgerror.NewErrorf(
+			pgerror.CodeOutOfMemoryError,
+			"%s test induced error",
+			h.testingKnobMemFailPoint,
+		)
 	}
+	return nil
 }
 
 // bufferPhaseImpl is an initial phase where we read a portion of both streams,
@@ -417,26 +513,18 @@ func (h *hashJoiner) bufferPhaseImpl(
 			h.storedSide = side
 			return nil, false, nil
 		}
-		if h.testingKnobMemFailPoint == buffer && rand.Float64() < h.testingKnobFailProbability {
+		if err := h.testingKnobMaybeFail(buffer); err != nil {
 			h.storedSide = side
-			return row, false, pgerror.NewErrorf(
-				pgerror.CodeOutOfMemoryError,
-				"%s test induced error",
-				h.testingKnobMemFailPoint,
-			)
+			return row, false, err
 		}
 		// Add the row to the correct container.
 		if err := h.rows[side].AddRow(ctx, row); err != nil {
 			h.storedSide = side
 			return row, false, err
 		}
-		if h.testingKnobMemFailPoint == buffer && rand.Float64() < h.testingKnobFailProbability {
+		if err := h.testingKnobMaybeFail(buffer); err != nil {
 			h.storedSide = side
-			return nil, false, pgerror.NewErrorf(
-				pgerror.CodeOutOfMemoryError,
-				"%s test induced error",
-				h.testingKnobMemFailPoint,
-			)
+			return nil, false, err
 		}
 	}
 
@@ -534,20 +622,8 @@ func (h *hashJoiner) probePhase(
 	// First process the rows that were already buffered.
 	probeIterator := h.rows[side].NewIterator(ctx)
 	defer probeIterator.Close()
-	for probeIterator.Rewind(); ; probeIterator.Next() {
-		if ok, err := probeIterator.Valid(); err != nil {
-			return false, err
-		} else if !ok {
-			break
-		}
-		row, err := probeIterator.Row()
-		if err != nil {
-			return false, err
-		}
-		earlyExit, err := h.probeRow(ctx, row, storedRows)
-		if earlyExit || err != nil {
-			return earlyExit, err
-		}
+	if earlyExit, err := h.probeRows(ctx, probeIterator, storedRows); earlyExit || err != nil {
+		return earlyExit, err
 	}
 
 	for {
@@ -563,32 +639,344 @@ func (h *hashJoiner) probePhase(
 		}
 	}
 
-	if shouldEmitUnmatchedRow(h.storedSide, h.joinType) {
-		// Produce results for unmatched rows, for FULL OUTER AND LEFT/RIGHT OUTER
-		// (depending on which stream we use).
-		i := storedRows.NewUnmarkedIterator(ctx)
-		defer i.Close()
+	if earlyExit, err := h.emitUnmatchedStoredRows(ctx, storedRows); earlyExit || err != nil {
+		return earlyExit, err
+	}
+
+	sendTraceData(ctx, h.out.output)
+	h.out.Close()
+	return false, nil
+}
+
+// probeRows probes storedRows with each row of the given iterator.
+func (h *hashJoiner) probeRows(
+	ctx context.Context, i rowIterator, storedRows hashRowContainer,
+) (earlyExit bool, _ error) {
+	for i.Rewind(); ; i.Next() {
+		if ok, err := i.Valid(); err != nil {
+			return false, err
+		} else if !ok {
+			return false, nil
+		}
+		row, err := i.Row()
+		if err != nil {
+			return false, err
+		}
+		if earlyExit, err := h.probeRow(ctx, row, storedRows); earlyExit || err != nil {
+			return earlyExit, err
+		}
+	}
+}
+
+// emitUnmatchedStoredRows produces results for the rows of storedRows which did
+// not match, for FULL OUTER AND LEFT/RIGHT OUTER (depending on which stream we
+// store).
+func (h *hashJoiner) emitUnmatchedStoredRows(
+	ctx context.Context, storedRows hashRowContainer,
+) (earlyExit bool, _ error) {
+	if !shouldEmitUnmatchedRow(h.storedSide, h.joinType) {
+		return false, nil
+	}
+	i := storedRows.NewUnmarkedIterator(ctx)
+	defer i.Close()
+	for i.Rewind(); ; i.Next() {
+		if ok, err := i.Valid(); err != nil {
+			return false, err
+		} else if !ok {
+			return false, nil
+		}
+		row, err := i.Row()
+		if err != nil {
+			return false, err
+		}
+		if !h.maybeEmitUnmatchedRow(ctx, row, h.storedSide) {
+			return true, nil
+		}
+	}
+}
+
+// hashJoinPartition holds the rows of both streams whose equality columns
+// hash to the same partition, once the hashJoiner has fallen back to disk.
+type hashJoinPartition struct {
+	rows    [2]diskRowContainer
+	numRows [2]int
+	// depth is the number of times the rows have been split into partitions;
+	// the partition of a row is determined by the depth-th group of
+	// hashJoinerPartitionBits bits of the hash of its equality columns.
+	depth int
+}
+
+func (p *hashJoinPartition) close(ctx context.Context) {
+	p.rows[leftSide].Close(ctx)
+	p.rows[rightSide].Close(ctx)
+}
+
+// newPartitions adds the partitions of the given depth to h.partitions and
+// returns them.
+func (h *hashJoiner) newPartitions(ctx context.Context, depth int) []*hashJoinPartition {
+	partitions := make([]*hashJoinPartition, 1<<hashJoinerPartitionBits)
+	for i := range partitions {
+		p := &hashJoinPartition{depth: depth}
+		for _, side := range []joinSide{leftSide, rightSide} {
+			p.rows[side] = makeDiskRowContainer(
+				ctx, h.spiller.diskMonitor(ctx), h.rows[side].types, nil /* ordering */, h.flowCtx.tempStorage,
+				h.flowCtx.tempStorageNamespace,
+			)
+		}
+		partitions[i] = p
+		// Keep track of the partitions as they are created so that they are
+		// closed even if we get an error.
+		h.partitions = append(h.partitions, p)
+	}
+	return partitions
+}
+
+// addToPartition adds a row of the given side to the partition it hashes to.
+func (h *hashJoiner) addToPartition(
+	ctx context.Context, partitions []*hashJoinPartition, row sqlbase.EncDatumRow, side joinSide,
+) error {
+	encoded, _, err := encodeColumnsOfRow(
+		&h.datumAlloc, h.scratch[:0], row, h.eqCols[side], false, /* encodeNull */
+	)
+	if err != nil {
+		return err
+	}
+	h.scratch = encoded
+	hash := fnv.New64a()
+	_, _ = hash.Write(encoded)
+	// Use the most significant bits first: they are the best mixed, and the
+	// rows of a partition only differ in the bits after the ones that were
+	// used to get to it.
+	shift := uint(64 - (partitions[0].depth+1)*hashJoinerPartitionBits)
+	p := partitions[(hash.Sum64()>>shift)&(1<<hashJoinerPartitionBits-1)]
+	p.numRows[side]++
+	return p.rows[side].AddRow(ctx, row)
+}
+
+// partitionInputs partitions the rows of both streams on disk: first the rows
+// buffered in memory (and the given row, which did not fit, if any) and then
+// the remaining rows of the streams. The source of h.storedSide has already
+// been consumed if storedSideDone is set.
+func (h *hashJoiner) partitionInputs(
+	ctx context.Context, row sqlbase.EncDatumRow, storedSideDone bool,
+) (earlyExit bool, _ error) {
+	partitions := h.newPartitions(ctx, 0 /* depth */)
+
+	// Add the row that caused the memory error.
+	if row != nil {
+		if err := h.addToPartition(ctx, partitions, row, h.storedSide); err != nil {
+			return false, err
+		}
+	}
+
+	// Transfer rows from memory.
+	for _, side := range []joinSide{leftSide, rightSide} {
+		i := h.rows[side].NewIterator(ctx)
 		for i.Rewind(); ; i.Next() {
 			if ok, err := i.Valid(); err != nil {
+				i.Close()
 				return false, err
 			} else if !ok {
 				break
 			}
-			row, err := i.Row()
+			memRow, err := i.Row()
 			if err != nil {
+				i.Close()
 				return false, err
 			}
-			if !h.maybeEmitUnmatchedRow(ctx, row, h.storedSide) {
-				return true, nil
+			if err := h.addToPartition(ctx, partitions, memRow, side); err != nil {
+				i.Close()
+				return false, err
 			}
 		}
+		i.Close()
+		h.rows[side].Clear(ctx)
 	}
 
-	sendTraceData(ctx, h.out.output)
-	h.out.Close()
+	// Finish consuming the sources.
+	srcs := [2]RowSource{h.leftSource, h.rightSource}
+	for _, side := range []joinSide{leftSide, rightSide} {
+		if side == h.storedSide && storedSideDone {
+			continue
+		}
+		for {
+			row, earlyExit, err := h.receiveRow(ctx, srcs[side], side)
+			if row == nil {
+				if earlyExit || err != nil {
+					return earlyExit, err
+				}
+				break
+			}
+			if err := h.addToPartition(ctx, partitions, row, side); err != nil {
+				return false, err
+			}
+		}
+	}
 	return false, nil
 }
 
+// joinPartitions joins the rows of each partition in h.partitions. The
+// partitions are removed as they are joined.
+func (h *hashJoiner) joinPartitions(ctx context.Context) (earlyExit bool, _ error) {
+	for len(h.partitions) > 0 {
+		p := h.partitions[len(h.partitions)-1]
+		h.partitions = h.partitions[:len(h.partitions)-1]
+		earlyExit, err := h.joinPartition(ctx, p)
+		p.close(ctx)
+		if earlyExit || err != nil {
+			return earlyExit, err
+		}
+	}
+	return false, nil
+}
+
+// joinPartition joins the rows of a partition. The rows of the side with fewer
+// rows are stored in memory; if they do not fit, the partition is split into
+// new partitions which are added to h.partitions, unless the partition has
+// already been split hashJoinerMaxPartitionDepth times, in which case the rows
+// are stored on disk.
+func (h *hashJoiner) joinPartition(
+	ctx context.Context, p *hashJoinPartition,
+) (earlyExit bool, _ error) {
+	if p.numRows[leftSide] == 0 && p.numRows[rightSide] == 0 {
+		return false, nil
+	}
+	h.storedSide = leftSide
+	if p.numRows[rightSide] < p.numRows[leftSide] {
+		h.storedSide = rightSide
+	}
+
+	storedRows, err := h.loadPartition(ctx, p)
+	if err != nil {
+		if pgErr, ok := err.(*pgerror.Error); !ok || pgErr.Code != pgerror.CodeOutOfMemoryError {
+			return false, err
+		}
+		if p.depth+1 < hashJoinerMaxPartitionDepth {
+			log.VEventf(ctx, 2, "splitting partition of depth %d", p.depth)
+			return false, h.splitPartition(ctx, p)
+		}
+		log.VEventf(ctx, 2, "joining partition of depth %d on disk", p.depth)
+		storedRows, err = h.loadPartitionOnDisk(ctx, p)
+		if err != nil {
+			return false, err
+		}
+	}
+	defer storedRows.Close(ctx)
+
+	i := p.rows[otherSide(h.storedSide)].NewIterator(ctx)
+	defer i.Close()
+	if earlyExit, err := h.probeRows(ctx, i, storedRows); earlyExit || err != nil {
+		return earlyExit, err
+	}
+	return h.emitUnmatchedStoredRows(ctx, storedRows)
+}
+
+// partitionedHashMemRowContainer is a hashMemRowContainer which owns its
+// memRowContainer.
+type partitionedHashMemRowContainer struct {
+	hashMemRowContainer
+	rows memRowContainer
+}
+
+// Close implements the hashRowContainer interface.
+func (c *partitionedHashMemRowContainer) Close(ctx context.Context) {
+	c.hashMemRowContainer.Close(ctx)
+	c.rows.Close(ctx)
+}
+
+// loadPartition stores the rows of h.storedSide of the partition in an
+// in-memory hashRowContainer.
+func (h *hashJoiner) loadPartition(
+	ctx context.Context, p *hashJoinPartition,
+) (hashRowContainer, error) {
+	if err := h.testingKnobMaybeFail(build); err != nil {
+		return nil, err
+	}
+	c := &partitionedHashMemRowContainer{}
+	c.rows.init(nil /* ordering */, h.rows[h.storedSide].types, &h.evalCtx)
+	c.hashMemRowContainer = makeHashMemRowContainer(&c.rows)
+	if err := h.copyPartition(ctx, c, p); err != nil {
+		c.Close(ctx)
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadPartitionOnDisk stores the rows of h.storedSide of the partition in an
+// on-disk hashRowContainer.
+func (h *hashJoiner) loadPartitionOnDisk(
+	ctx context.Context, p *hashJoinPartition,
+) (hashRowContainer, error) {
+	c := makeHashDiskRowContainer(
+		h.spiller.diskMonitor(ctx), h.flowCtx.tempStorage, h.flowCtx.tempStorageNamespace,
+	)
+	if err := h.copyPartition(ctx, &c, p); err != nil {
+		c.Close(ctx)
+		return nil, err
+	}
+	return &c, nil
+}
+
+// copyPartition initializes the given hashRowContainer and adds the rows of
+// h.storedSide of the partition to it.
+func (h *hashJoiner) copyPartition(
+	ctx context.Context, c hashRowContainer, p *hashJoinPartition,
+) error {
+	if err := c.Init(
+		ctx,
+		shouldEmitUnmatchedRow(h.storedSide, h.joinType),
+		h.rows[h.storedSide].types,
+		h.eqCols[h.storedSide],
+	); err != nil {
+		return err
+	}
+	i := p.rows[h.storedSide].NewIterator(ctx)
+	defer i.Close()
+	for i.Rewind(); ; i.Next() {
+		if ok, err := i.Valid(); err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+		row, err := i.Row()
+		if err != nil {
+			return err
+		}
+		if err := c.AddRow(ctx, row); err != nil {
+			return err
+		}
+	}
+}
+
+// splitPartition moves the rows of the partition into new partitions, using the
+// next bits of the hash of their equality columns.
+func (h *hashJoiner) splitPartition(ctx context.Context, p *hashJoinPartition) error {
+	partitions := h.newPartitions(ctx, p.depth+1)
+	for _, side := range []joinSide{leftSide, rightSide} {
+		if err := func() error {
+			i := p.rows[side].NewIterator(ctx)
+			defer i.Close()
+			for i.Rewind(); ; i.Next() {
+				if ok, err := i.Valid(); err != nil {
+					return err
+				} else if !ok {
+					return nil
+				}
+				row, err := i.Row()
+				if err != nil {
+					return err
+				}
+				if err := h.addToPartition(ctx, partitions, row, side); err != nil {
+					return err
+				}
+			}
+		}(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // encodeColumnsOfRow returns the encoding for the grouping columns. This is
 // then used as our group key to determine which bucket to add to.
 // If the row contains any NULLs and encodeNull is false, hasNull is true and
@@ -569,16 +569,17 @@ func TestHashJoiner(t *testing.T) {
 		// Run tests with a probability of the run failing with a memory error.
 		// These verify that the hashJoiner falls back to disk correctly in all
 		// cases.
-		for i := 0; i < 5; i++ {
-			memFailPoint := buffer
-			t.Run(fmt.Sprintf("MemFailPoint=%s", memFailPoint), func(t *testing.T) {
-				if err := testFunc(t, func(h *hashJoiner) {
-					h.testingKnobMemFailPoint = memFailPoint
-					h.testingKnobFailProbability = 0.5
-				}); err != nil {
-					t.Fatal(err)
-				}
-			})
+		for _, memFailPoint := range []hashJoinPhase{buffer, build} {
+			for i := 0; i < 5; i++ {
+				t.Run(fmt.Sprintf("MemFailPoint=%s", memFailPoint), func(t *testing.T) {
+					if err := testFunc(t, func(h *hashJoiner) {
+						h.testingKnobMemFailPoint = memFailPoint
+						h.testingKnobFailProbability = 0.5
+					}); err != nil {
+						t.Fatal(err)
+					}
+				})
+			}
 		}
 
 		// Run test with a variety of memory limits.
@@ -885,3 +886,73 @@ func BenchmarkHashJoiner(b *testing.B) {
 		})
 	}
 }
+
+// Test that the hashJoiner publishes a run-time filter of the equality columns
+// of its stored side.
+func TestHashJoinerRuntimeFilter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	v := [10]sqlbase.EncDatum{}
+	for i := range v {
+		v[i] = sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i)))
+	}
+	null := sqlbase.EncDatum{Datum: parser.DNull}
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings:       cluster.MakeTestingClusterSettings(),
+		EvalCtx:        evalCtx,
+		runtimeFilters: &runtimeFilters{},
+	}
+
+	spec := HashJoinerSpec{
+		LeftEqColumns:   []uint32{0},
+		RightEqColumns:  []uint32{1},
+		Type:            JoinType_INNER,
+		RuntimeFilterID: 1,
+	}
+	leftInput := NewRowBuffer(nil /* types */, sqlbase.EncDatumRows{
+		{v[0], v[0]}, {v[1], v[1]}, {v[2], v[2]}, {v[3], v[3]},
+	}, RowBufferArgs{})
+	rightInput := NewRowBuffer(nil /* types */, sqlbase.EncDatumRows{
+		{v[0], v[1]}, {v[0], v[3]}, {v[0], null},
+	}, RowBufferArgs{})
+	out := &RowBuffer{}
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0}}
+	h, err := newHashJoiner(&flowCtx, &spec, leftInput, rightInput, &post, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Disable initial buffering. We always store the right stream in this case.
+	h.initialBufferSize = 0
+	h.Run(context.Background(), nil)
+
+	if err := checkExpectedRows(sqlbase.EncDatumRows{{v[1]}, {v[3]}}, out); err != nil {
+		t.Fatal(err)
+	}
+	filter := flowCtx.runtimeFilters.get(1).load()
+	if filter == nil {
+		t.Fatal("run-time filter not published")
+	}
+	var da sqlbase.DatumAlloc
+	for _, i := range []int{1, 3} {
+		encoded, _, err := encodeColumnsOfRow(
+			&da, nil, sqlbase.EncDatumRow{v[i]}, columns{0}, false, /* encodeNull */
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !filter.MayContain(encoded) {
+			t.Errorf("expected the run-time filter to contain %d", i)
+		}
+	}
+
+	// The rows of the left side of a LEFT OUTER join can't be filtered.
+	spec.Type = JoinType_LEFT_OUTER
+	if _, err := newHashJoiner(
+		&flowCtx, &spec, leftInput, rightInput, &post, out,
+	); !testutils.IsError(err, "invalid run-time filter for LEFT_OUTER join") {
+		t.Errorf("expected an invalid run-time filter error, got %v", err)
+	}
+}
@@ -27,6 +27,9 @@ import (
 // them to a RowReceiver. Optionally processes an initial StreamMessage that was
 // already received (because the first message contains the flow and stream IDs,
 // it needs to be received before we can get here).
+//
+// If the span in ctx is recording, its recording is sent to dst once the stream
+// is done.
 func ProcessInboundStream(
 	ctx context.Context, stream DistSQL_FlowStreamServer, firstMsg *ProducerMessage, dst RowReceiver,
 ) error {
@@ -38,10 +41,12 @@ func ProcessInboundStream(
 	if err != nil {
 		log.VEventf(ctx, 1, "inbound stream error: %s", err)
 		dst.Push(nil, ProducerMetadata{Err: err})
+		sendTraceData(ctx, dst)
 		dst.ProducerDone()
 		return err
 	}
 	log.VEventf(ctx, 1, "inbound stream done")
+	sendTraceData(ctx, dst)
 	dst.ProducerDone()
 	// The consumer is now done. The producer, if it's still around, will
 	// receive an EOF error over its side of the stream.
@@ -175,7 +175,10 @@ func (ib *indexBackfiller) runChunk(
 	}
 
 	transactionalChunk := func(ctx context.Context) error {
-		return ib.flowCtx.clientDB.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+		return ib.flowCtx.ClientDB.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+			if err := txn.SetQoSClass(roachpb.QOS_BACKGROUND); err != nil {
+				return err
+			}
 			entries, err := buildIndexEntries(ctx, txn)
 			if err != nil {
 				return err
@@ -205,7 +208,10 @@ func (ib *indexBackfiller) runChunk(
 	*/
 
 	var entries []sqlbase.IndexEntry
-	if err := ib.flowCtx.clientDB.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+	if err := ib.flowCtx.ClientDB.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+		if err := txn.SetQoSClass(roachpb.QOS_BACKGROUND); err != nil {
+			return err
+		}
 		txn.SetFixedTimestamp(readAsOf)
 
 		var err error
@@ -217,7 +223,10 @@ func (ib *indexBackfiller) runChunk(
 
 	retried := false
 	// Write the new index values.
-	if err := ib.flowCtx.clientDB.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+	if err := ib.flowCtx.ClientDB.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+		if err := txn.SetQoSClass(roachpb.QOS_BACKGROUND); err != nil {
+			return err
+		}
 		batch := txn.NewBatch()
 
 		for _, entry := range entries {
@@ -261,5 +270,15 @@ func (ib *indexBackfiller) runChunk(
 		}
 	}
 
+	// Throttle the backfill according to the size of the written entries, so
+	// that it doesn't starve the foreground traffic.
+	bytes := 0
+	for _, entry := range entries {
+		bytes += len(entry.Key) + len(entry.Value.RawBytes)
+	}
+	if err := ib.waitForWriteQuota(ctx, bytes); err != nil {
+		return nil, err
+	}
+
 	return ib.fetcher.Key(), nil
 }
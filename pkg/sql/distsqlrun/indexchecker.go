@@ -0,0 +1,293 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// indexCheckerBatchSize is the number of rows (or index entries) whose
+// counterparts are looked up together.
+const indexCheckerBatchSize = 100
+
+// indexChecker checks the entries of a secondary index against the rows of the
+// primary index. See IndexCheckerSpec.
+type indexChecker struct {
+	processorBase
+
+	flowCtx *FlowCtx
+	desc    sqlbase.TableDescriptor
+	index   *sqlbase.IndexDescriptor
+	check   IndexCheckerSpec_Check
+	spans   roachpb.Spans
+
+	// fetcher reads the rows in the spans: the rows of the primary index for
+	// MISSING_ENTRIES, and the entries of the secondary index for
+	// DANGLING_ENTRIES.
+	fetcher scrubFetcher
+	// pkFetcher looks up the rows of the primary index referenced by the
+	// entries of the secondary index, for DANGLING_ENTRIES.
+	pkFetcher scrubFetcher
+}
+
+var _ Processor = &indexChecker{}
+
+func newIndexChecker(
+	flowCtx *FlowCtx, spec *IndexCheckerSpec, post *PostProcessSpec, output RowReceiver,
+) (*indexChecker, error) {
+	if spec.IndexIdx == 0 || int(spec.IndexIdx) > len(spec.Table.Indexes) {
+		return nil, errors.Errorf("invalid secondary index %d", spec.IndexIdx)
+	}
+	ic := &indexChecker{
+		flowCtx: flowCtx,
+		desc:    spec.Table,
+		check:   spec.Check,
+	}
+	ic.index = &ic.desc.Indexes[spec.IndexIdx-1]
+	ic.spans = make(roachpb.Spans, len(spec.Spans))
+	for i, s := range spec.Spans {
+		ic.spans[i] = s.Span
+	}
+
+	switch spec.Check {
+	case IndexCheckerSpec_MISSING_ENTRIES:
+		if err := ic.fetcher.init(&ic.desc, 0 /* indexIdx */); err != nil {
+			return nil, err
+		}
+	case IndexCheckerSpec_DANGLING_ENTRIES:
+		if err := ic.fetcher.init(&ic.desc, int(spec.IndexIdx)); err != nil {
+			return nil, err
+		}
+		if err := ic.pkFetcher.init(&ic.desc, 0 /* indexIdx */); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Errorf("unknown index check %s", spec.Check)
+	}
+
+	if err := ic.out.Init(post, ScrubColumnTypes, &flowCtx.EvalCtx, output); err != nil {
+		return nil, err
+	}
+	return ic, nil
+}
+
+// Run is part of the processor interface.
+func (ic *indexChecker) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTagInt(ctx, "IndexChecker", int(ic.desc.ID))
+	ctx, span := processorSpan(ctx, ic.flowCtx, "index checker")
+	defer tracing.FinishSpan(span)
+
+	txn := ic.flowCtx.txn
+	if txn == nil {
+		log.Fatalf(ctx, "indexChecker outside of txn")
+	}
+
+	if err := ic.mainLoop(ctx, txn); err != nil {
+		ic.out.output.Push(nil /* row */, ProducerMetadata{Err: err})
+	}
+	sendLeafTxnState(ctx, ic.flowCtx, ic.out.output)
+	sendTraceData(ctx, ic.out.output)
+	ic.out.Close()
+}
+
+// mainLoop reads the rows in the spans and checks them in batches, until all
+// the rows are checked or the consumer doesn't need more rows.
+func (ic *indexChecker) mainLoop(ctx context.Context, txn *client.Txn) error {
+	if err := ic.fetcher.StartScan(
+		ctx, txn, ic.spans, true /* limitBatches */, 0, /* limitHint */
+	); err != nil {
+		return err
+	}
+	var batch []parser.Datums
+	for {
+		row, err := ic.fetcher.NextRow(ctx, false /* traceKV */)
+		if err != nil {
+			return err
+		}
+		if row != nil {
+			datums, err := ic.fetcher.decode(row)
+			if err != nil {
+				return err
+			}
+			batch = append(batch, append(parser.Datums(nil), datums...))
+			if len(batch) < indexCheckerBatchSize {
+				continue
+			}
+		}
+		if len(batch) > 0 {
+			var status ConsumerStatus
+			if ic.check == IndexCheckerSpec_MISSING_ENTRIES {
+				status, err = ic.checkMissingEntries(ctx, txn, batch)
+			} else {
+				status, err = ic.checkDanglingEntries(ctx, txn, batch)
+			}
+			if err != nil || status != NeedMoreRows {
+				return err
+			}
+			batch = batch[:0]
+		}
+		if row == nil {
+			return nil
+		}
+	}
+}
+
+// checkMissingEntries looks up the entries of the secondary index which
+// correspond to the given rows of the primary index, and emits a row for each
+// entry which is missing or has an unexpected value.
+func (ic *indexChecker) checkMissingEntries(
+	ctx context.Context, txn *client.Txn, rows []parser.Datums,
+) (ConsumerStatus, error) {
+	entries := make([]sqlbase.IndexEntry, len(rows))
+	b := txn.NewBatch()
+	for i, datums := range rows {
+		var err error
+		entries[i], err = sqlbase.EncodeSecondaryIndex(
+			&ic.desc, ic.index, ic.fetcher.colIdxMap, datums,
+		)
+		if err != nil {
+			return ConsumerClosed, err
+		}
+		b.Get(entries[i].Key)
+	}
+	if err := txn.Run(ctx, b); err != nil {
+		return ConsumerClosed, err
+	}
+
+	for i, res := range b.Results {
+		var errorType, details string
+		if len(res.Rows) == 0 || res.Rows[0].Value == nil {
+			errorType = ScrubErrorMissingIndexEntry
+			details = fmt.Sprintf("index %q: no entry %s", ic.index.Name, entries[i].Key)
+		} else {
+			expected, err := entries[i].Value.GetBytes()
+			if err != nil {
+				return ConsumerClosed, err
+			}
+			actual, err := res.Rows[0].Value.GetBytes()
+			if err != nil || !bytes.Equal(actual, expected) {
+				errorType = ScrubErrorIndexValueMismatch
+				details = fmt.Sprintf("index %q: unexpected value for entry %s",
+					ic.index.Name, entries[i].Key)
+			}
+		}
+		if errorType == "" {
+			continue
+		}
+		row := makeScrubRow(errorType, ic.fetcher.primaryKey(rows[i]), details)
+		if status, err := ic.out.EmitRow(ctx, row); err != nil || status != NeedMoreRows {
+			return status, err
+		}
+	}
+	return NeedMoreRows, nil
+}
+
+// checkDanglingEntries looks up the rows of the primary index referenced by the
+// given entries of the secondary index, and emits a row for each entry which
+// doesn't match the entry of its row, or whose row doesn't exist.
+func (ic *indexChecker) checkDanglingEntries(
+	ctx context.Context, txn *client.Txn, entries []parser.Datums,
+) (ConsumerStatus, error) {
+	pkPrefix := sqlbase.MakeIndexKeyPrefix(&ic.desc, ic.desc.PrimaryIndex.ID)
+	encodePK := func(datums parser.Datums) (roachpb.Key, error) {
+		key, _, err := sqlbase.EncodeIndexKey(
+			&ic.desc, &ic.desc.PrimaryIndex, ic.fetcher.colIdxMap, datums, pkPrefix,
+		)
+		return key, err
+	}
+
+	spans := make(roachpb.Spans, len(entries))
+	for i, datums := range entries {
+		key, err := encodePK(datums)
+		if err != nil {
+			return ConsumerClosed, err
+		}
+		spans[i] = roachpb.Span{Key: key, EndKey: key.PrefixEnd()}
+	}
+
+	// Compute the expected index entry of each referenced row, by primary key.
+	expectedKeys := make(map[string]roachpb.Key, len(entries))
+	if err := ic.pkFetcher.StartScan(
+		ctx, txn, spans, true /* limitBatches */, 0, /* limitHint */
+	); err != nil {
+		return ConsumerClosed, err
+	}
+	for {
+		row, err := ic.pkFetcher.NextRow(ctx, false /* traceKV */)
+		if err != nil {
+			return ConsumerClosed, err
+		}
+		if row == nil {
+			break
+		}
+		datums, err := ic.pkFetcher.decode(row)
+		if err != nil {
+			return ConsumerClosed, err
+		}
+		pk, err := encodePK(datums)
+		if err != nil {
+			return ConsumerClosed, err
+		}
+		entry, err := sqlbase.EncodeSecondaryIndex(
+			&ic.desc, ic.index, ic.pkFetcher.colIdxMap, datums,
+		)
+		if err != nil {
+			return ConsumerClosed, err
+		}
+		expectedKeys[string(pk)] = entry.Key
+	}
+
+	for i, datums := range entries {
+		entry, err := sqlbase.EncodeSecondaryIndex(
+			&ic.desc, ic.index, ic.fetcher.colIdxMap, datums,
+		)
+		if err != nil {
+			return ConsumerClosed, err
+		}
+		var details string
+		if expected, ok := expectedKeys[string(spans[i].Key)]; !ok {
+			details = fmt.Sprintf("index %q: entry %s references a missing row",
+				ic.index.Name, entry.Key)
+		} else if !expected.Equal(entry.Key) {
+			details = fmt.Sprintf("index %q: entry %s doesn't match the row, expected %s",
+				ic.index.Name, entry.Key, expected)
+		} else {
+			continue
+		}
+		row := makeScrubRow(
+			ScrubErrorDanglingIndexReference, ic.fetcher.primaryKey(datums), details,
+		)
+		if status, err := ic.out.EmitRow(ctx, row); err != nil || status != NeedMoreRows {
+			return status, err
+		}
+	}
+	return NeedMoreRows, nil
+}
@@ -18,20 +18,25 @@
 package distsqlrun
 
 import (
-	"container/heap"
-
-	"golang.org/x/net/context"
-
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
-	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/pkg/errors"
 )
 
+// orderedSyncBatchSize is the maximum number of rows the orderedSynchronizer
+// reads ahead from each of its sources.
+const orderedSyncBatchSize = 16
+
 type srcInfo struct {
 	src RowSource
-	// row is the last row received from src.
-	row sqlbase.EncDatumRow
+	// rows holds the rows read from src which were not produced yet; rows[0]
+	// is the current row of the source. It is empty once src is exhausted.
+	rows []sqlbase.EncDatumRow
+	// buf backs rows.
+	buf [orderedSyncBatchSize]sqlbase.EncDatumRow
+	// exhausted is set once src returned its last row.
+	exhausted bool
 }
 
 // srcIdx refers to the index of a source inside a []srcInfo array.
@@ -40,8 +45,8 @@ type srcIdx int
 type orderedSynchronizerState int
 
 const (
-	// notInitialized means that the heap has not yet been constructed. A row
-	// needs to be read from each source to build the heap.
+	// notInitialized means that the heap has not yet been constructed. A batch
+	// of rows needs to be read from each source to build the heap.
 	notInitialized orderedSynchronizerState = iota
 	// returningRows is the regular operation mode of the orderedSynchronizer.
 	// Rows and metadata records are returning to the consumer.
@@ -61,6 +66,16 @@ const (
 // stream of rows, ordered according to a set of columns. The rows in each input
 // stream are assumed to be ordered according to the same set of columns
 // (intra-stream ordering).
+//
+// The rows are merged with a heap of the sources, ordered by their current
+// row. Rows are read from the sources in batches, and the ordering columns are
+// decoded as the rows are read so that comparisons are made on datums. As long
+// as the source at the root of the heap produces rows which don't exceed the
+// current row of the runner-up source, the heap doesn't need to be fixed up.
+//
+// The rows of a batch must remain valid after the following calls to Next() on
+// their source, which is the case for rows received from RowChannels and
+// inbound streams.
 type orderedSynchronizer struct {
 	ordering sqlbase.ColumnOrdering
 	evalCtx  *parser.EvalContext
@@ -73,6 +88,9 @@ type orderedSynchronizer struct {
 	// heap of source indexes, ordered by the current row. Sources with no more
 	// rows are not in the heap.
 	heap []srcIdx
+	// runnerUp is the position in the heap of the child of the root with the
+	// smallest current row, or -1 if it needs to be recomputed.
+	runnerUp int
 	// needsAdvance is set when the row at the root of the heap has already been
 	// consumed and thus producing a new row requires the root to be advanced.
 	// This is usually set after a row is produced, but is not set when a metadata
@@ -80,9 +98,6 @@ type orderedSynchronizer struct {
 	// serve the next row without advancing anything.
 	needsAdvance bool
 
-	// err can be set by the Less function (used by the heap implementation)
-	err error
-
 	alloc sqlbase.DatumAlloc
 
 	// metadata is accumulated from all the sources and is passed on as soon as
@@ -97,107 +112,120 @@ func (s *orderedSynchronizer) Types() []sqlbase.ColumnType {
 	return s.sources[0].src.Types()
 }
 
-// Len is part of heap.Interface and is only meant to be used internally.
-func (s *orderedSynchronizer) Len() int {
-	return len(s.heap)
-}
-
-// Less is part of heap.Interface and is only meant to be used internally.
-func (s *orderedSynchronizer) Less(i, j int) bool {
-	si := &s.sources[s.heap[i]]
-	sj := &s.sources[s.heap[j]]
-	cmp, err := si.row.Compare(&s.alloc, s.ordering, s.evalCtx, sj.row)
-	if err != nil {
-		s.err = err
-		return false
+// compareRows compares two rows according to the ordering. The ordering
+// columns of both rows must have been decoded.
+func (s *orderedSynchronizer) compareRows(a, b sqlbase.EncDatumRow) int {
+	for _, c := range s.ordering {
+		cmp := a[c.ColIdx].Datum.Compare(s.evalCtx, b[c.ColIdx].Datum)
+		if cmp != 0 {
+			if c.Direction == encoding.Descending {
+				cmp = -cmp
+			}
+			return cmp
+		}
 	}
-	return cmp < 0
+	return 0
 }
 
-// Swap is part of heap.Interface and is only meant to be used internally.
-func (s *orderedSynchronizer) Swap(i, j int) {
-	s.heap[i], s.heap[j] = s.heap[j], s.heap[i]
+// less returns whether the current row of the source at position i in the heap
+// is smaller than the current row of the source at position j.
+func (s *orderedSynchronizer) less(i, j int) bool {
+	return s.compareRows(s.sources[s.heap[i]].rows[0], s.sources[s.heap[j]].rows[0]) < 0
 }
 
-// Push is part of heap.Interface; it's not used as we never insert elements to
-// the heap (we initialize it with all sources, see initHeap).
-func (s *orderedSynchronizer) Push(x interface{}) { panic("unimplemented") }
-
-// Pop is part of heap.Interface and is only meant to be used internally.
-func (s *orderedSynchronizer) Pop() interface{} {
-	s.heap = s.heap[:len(s.heap)-1]
-	return nil
+// siftDown moves the source at position i in the heap down until it is
+// smaller than its children.
+func (s *orderedSynchronizer) siftDown(i int) {
+	n := len(s.heap)
+	for {
+		smallest := i
+		if l := 2*i + 1; l < n && s.less(l, smallest) {
+			smallest = l
+		}
+		if r := 2*i + 2; r < n && s.less(r, smallest) {
+			smallest = r
+		}
+		if smallest == i {
+			return
+		}
+		s.heap[i], s.heap[smallest] = s.heap[smallest], s.heap[i]
+		i = smallest
+	}
 }
 
-// initHeap grabs a row from each source and initializes the heap.
+// initHeap reads a batch of rows from each source and initializes the heap.
 func (s *orderedSynchronizer) initHeap() error {
 	for i := range s.sources {
 		src := &s.sources[i]
-		if err := s.consumeMetadata(src, stopOnRowOrError); err != nil {
+		if err := s.readBatch(src); err != nil {
 			return err
 		}
-		if src.row != nil {
-			// Add to the heap array (it won't be a heap until we call heap.Init).
+		if len(src.rows) > 0 {
+			// Add to the heap array (it won't be a heap until it's sifted).
 			s.heap = append(s.heap, srcIdx(i))
 		}
 	}
-	heap.Init(s)
-	// heap operations might set s.err (see Less)
-	return s.err
+	for i := len(s.heap)/2 - 1; i >= 0; i-- {
+		s.siftDown(i)
+	}
+	s.runnerUp = -1
+	return nil
 }
 
-type consumeMetadataOption int
-
-const (
-	// stopOnRowOrError means that consumeMetadata() will stop consuming as soon
-	// as a row or metadata record with an error is received. The idea is to allow
-	// this row to be placed in the heap, or for the error to be passed to the
-	// consumer as soon as possible.
-	stopOnRowOrError consumeMetadataOption = iota
-	// drain means that we're going to fully consume the source, accumulating all
-	// metadata records and ignoring all rows.
-	drain
-)
-
-// consumeMetadata accumulates metadata from a source. Depending on mode, it
-// will stop on the first row or error, or it will completely consume the
-// source.
+// readBatch reads up to orderedSyncBatchSize rows from a source, and decodes
+// their ordering columns. It stops early if the source is exhausted.
 //
-// In the stopOnRowOrError mode, src.row will be updated to the first row
-// received (or to nil if src has been exhausted).
-//
-// Metadata records are accumulated in s.metadata. With the stopOnRowOrError
-// mode, if a metadata record with an error is encountered, further metadata is
-// not consumed and the error is returned. With the drain mode, metadata records
-// with error are accumulated like all the others and this method doesn't return
-// any errors.
-func (s *orderedSynchronizer) consumeMetadata(src *srcInfo, mode consumeMetadataOption) error {
-	for {
+// Metadata records are accumulated in s.metadata. If a metadata record with an
+// error is encountered, further metadata is not consumed and the error is
+// returned, so that it can be passed to the consumer as soon as possible.
+func (s *orderedSynchronizer) readBatch(src *srcInfo) error {
+	src.rows = src.buf[:0]
+	for !src.exhausted && len(src.rows) < len(src.buf) {
 		row, meta := src.src.Next()
-		if meta.Err != nil && mode == stopOnRowOrError {
+		if meta.Err != nil {
 			return meta.Err
 		}
 		if !meta.Empty() {
 			s.metadata = append(s.metadata, &meta)
 			continue
 		}
-		if mode == stopOnRowOrError {
-			src.row = row
-			return nil
+		if row == nil {
+			src.exhausted = true
+			break
+		}
+		for _, c := range s.ordering {
+			if err := row[c.ColIdx].EnsureDecoded(&s.alloc); err != nil {
+				return err
+			}
+		}
+		src.rows = append(src.rows, row)
+	}
+	return nil
+}
+
+// drainSource consumes all the rows from a source, accumulating its metadata
+// records in s.metadata and ignoring all rows. Metadata records with errors
+// are accumulated like all the others.
+func (s *orderedSynchronizer) drainSource(src *srcInfo) {
+	src.rows = nil
+	for !src.exhausted {
+		row, meta := src.src.Next()
+		if !meta.Empty() {
+			s.metadata = append(s.metadata, &meta)
+			continue
 		}
-		if row == nil && meta.Empty() {
-			return nil
+		if row == nil {
+			src.exhausted = true
 		}
 	}
 }
 
-// advanceRoot retrieves the next row for the source at the root of the heap and
-// updates the heap accordingly.
+// advanceRoot moves on to the next row of the source at the root of the heap
+// and updates the heap accordingly.
 //
 // Metadata records from the source currently at the root are accumulated.
 //
-// If an error is returned, then either the heap is in a bad state (s.err has
-// been set), or one of the sources is borked. In either case, advanceRoot()
+// If an error is returned, one of the sources is borked and advanceRoot()
 // should not be called again - the caller should update the
 // orderedSynchronizer.state accordingly.
 func (s *orderedSynchronizer) advanceRoot() error {
@@ -208,37 +236,48 @@ func (s *orderedSynchronizer) advanceRoot() error {
 		return nil
 	}
 	src := &s.sources[s.heap[0]]
-	if src.row == nil {
+	if len(src.rows) == 0 {
 		return errors.Errorf("trying to advance closed source")
 	}
 
-	oldRow := src.row
-	if err := s.consumeMetadata(src, stopOnRowOrError); err != nil {
-		return err
+	oldRow := src.rows[0]
+	src.rows = src.rows[1:]
+	if len(src.rows) == 0 {
+		if err := s.readBatch(src); err != nil {
+			return err
+		}
 	}
 
-	if src.row == nil {
-		heap.Remove(s, 0)
-	} else {
-		heap.Fix(s, 0)
-		// TODO(radu): this check may be costly, we could disable it in production
-		if cmp, err := oldRow.Compare(&s.alloc, s.ordering, s.evalCtx, src.row); err != nil {
-			return err
-		} else if cmp > 0 {
-			return errors.Errorf("incorrectly ordered stream %s after %s", src.row, oldRow)
+	if len(src.rows) == 0 {
+		last := len(s.heap) - 1
+		s.heap[0] = s.heap[last]
+		s.heap = s.heap[:last]
+		s.siftDown(0)
+		s.runnerUp = -1
+		return nil
+	}
+	// TODO(radu): this check may be costly, we could disable it in production
+	if s.compareRows(oldRow, src.rows[0]) > 0 {
+		return errors.Errorf("incorrectly ordered stream %s after %s", src.rows[0], oldRow)
+	}
+	if s.runnerUp < 0 {
+		s.runnerUp = 1
+		if len(s.heap) > 2 && s.less(2, 1) {
+			s.runnerUp = 2
 		}
 	}
-	// heap operations might set s.err (see Less)
-	return s.err
+	if s.runnerUp < len(s.heap) && s.less(s.runnerUp, 0) {
+		s.siftDown(0)
+		s.runnerUp = -1
+	}
+	return nil
 }
 
 // drainSources consumes all the rows from the sources. All the data is
 // discarded, except the metadata records which are accumulated in s.metadata.
 func (s *orderedSynchronizer) drainSources() {
 	for _, srcIdx := range s.heap {
-		if err := s.consumeMetadata(&s.sources[srcIdx], drain); err != nil {
-			log.Fatalf(context.TODO(), "unexpected draining error: %s", err)
-		}
+		s.drainSource(&s.sources[srcIdx])
 	}
 }
 
@@ -281,7 +320,7 @@ func (s *orderedSynchronizer) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
 	}
 
 	s.needsAdvance = true
-	return s.sources[s.heap[0]].row, ProducerMetadata{}
+	return s.sources[s.heap[0]].rows[0], ProducerMetadata{}
 }
 
 // ConsumerDone is part of the RowSource interface.
@@ -329,6 +368,7 @@ func makeOrderedSync(
 		state:    notInitialized,
 		sources:  make([]srcInfo, len(sources)),
 		heap:     make([]srcIdx, 0, len(sources)),
+		runnerUp: -1,
 		ordering: ordering,
 		evalCtx:  evalCtx,
 	}
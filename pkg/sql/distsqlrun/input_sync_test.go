@@ -16,6 +16,7 @@ package distsqlrun
 
 import (
 	"fmt"
+	"sort"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -24,6 +25,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 	"github.com/pkg/errors"
 )
 
@@ -139,6 +141,73 @@ func TestOrderedSync(t *testing.T) {
 	}
 }
 
+// TestOrderedSyncRandom merges many sources of random lengths, each longer or
+// shorter than a batch, and verifies that the rows come out in order.
+func TestOrderedSyncRandom(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewPseudoRand()
+	intType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	ordering := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Descending},
+		{ColIdx: 1, Direction: encoding.Ascending},
+	}
+
+	const numSources = 10
+	var sources []RowSource
+	var expected []sqlbase.EncDatumRow
+	for i := 0; i < numSources; i++ {
+		numRows := rng.Intn(3 * orderedSyncBatchSize)
+		rows := make(sqlbase.EncDatumRows, numRows)
+		for j := range rows {
+			rows[j] = sqlbase.EncDatumRow{
+				sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(rng.Intn(20)))),
+				sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(rng.Intn(20)))),
+			}
+		}
+		sort.Slice(rows, func(a, b int) bool {
+			a0, b0 := *rows[a][0].Datum.(*parser.DInt), *rows[b][0].Datum.(*parser.DInt)
+			if a0 != b0 {
+				return a0 > b0
+			}
+			return *rows[a][1].Datum.(*parser.DInt) < *rows[b][1].Datum.(*parser.DInt)
+		})
+		sources = append(sources, NewRowBuffer([]sqlbase.ColumnType{intType, intType}, rows, RowBufferArgs{}))
+		expected = append(expected, rows...)
+	}
+
+	evalCtx := parser.NewTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	src, err := makeOrderedSync(ordering, evalCtx, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a sqlbase.DatumAlloc
+	var prev sqlbase.EncDatumRow
+	numRows := 0
+	for {
+		row, meta := src.Next()
+		if !meta.Empty() {
+			t.Fatalf("unexpected metadata: %v", meta)
+		}
+		if row == nil {
+			break
+		}
+		if prev != nil {
+			if cmp, err := prev.Compare(&a, ordering, evalCtx, row); err != nil {
+				t.Fatal(err)
+			} else if cmp > 0 {
+				t.Fatalf("row %s after %s", row, prev)
+			}
+		}
+		prev = row
+		numRows++
+	}
+	if numRows != len(expected) {
+		t.Fatalf("expected %d rows, got %d", len(expected), numRows)
+	}
+}
+
 func TestUnorderedSync(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -234,3 +303,51 @@ func TestUnorderedSync(t *testing.T) {
 		t.Error("Did not receive expected error")
 	}
 }
+
+// BenchmarkOrderedSync times how long it takes to merge a fixed number of rows
+// spread over a varying number of sources.
+func BenchmarkOrderedSync(b *testing.B) {
+	const numRows = 1 << 14
+	intType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{intType, intType}
+	ordering := sqlbase.ColumnOrdering{{ColIdx: 0, Direction: encoding.Ascending}}
+	evalCtx := parser.NewTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+
+	for _, numSources := range []int{2, 8, 16, 64} {
+		b.Run(fmt.Sprintf("sources=%d", numSources), func(b *testing.B) {
+			// The rows are dealt to the sources in order, so that each source
+			// has every numSources-th row.
+			rows := make([]sqlbase.EncDatumRows, numSources)
+			for i := 0; i < numRows; i++ {
+				rows[i%numSources] = append(rows[i%numSources], sqlbase.EncDatumRow{
+					sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(i))),
+					sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(i))),
+				})
+			}
+			b.SetBytes(numRows * 16)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				sources := make([]RowSource, numSources)
+				for j := range sources {
+					sources[j] = NewRowBuffer(types, rows[j], RowBufferArgs{})
+				}
+				b.StartTimer()
+				src, err := makeOrderedSync(ordering, evalCtx, sources)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for {
+					row, meta := src.Next()
+					if !meta.Empty() {
+						b.Fatalf("unexpected metadata: %v", meta)
+					}
+					if row == nil {
+						break
+					}
+				}
+			}
+		})
+	}
+}
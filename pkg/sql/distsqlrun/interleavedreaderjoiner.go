@@ -0,0 +1,301 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// interleavedReaderJoiner reads the rows of a parent table and of a table
+// interleaved in it with a single scan, and joins them as they are read. The
+// rows of the child table directly follow the parent row they are interleaved
+// in, so only the current parent row needs to be kept around.
+// See InterleavedReaderJoinerSpec.
+type interleavedReaderJoiner struct {
+	joinerBase
+
+	flowCtx *FlowCtx
+
+	// tables holds the parent table followed by the child table.
+	tables [2]interleavedReaderJoinerTable
+	spans  roachpb.Spans
+
+	fetcher sqlbase.InterleavedRowFetcher
+	alloc   sqlbase.DatumAlloc
+
+	// parentPrefix holds the values of the primary key of the current parent
+	// row, and parentRow the row after post-processing; parentRow is nil if the
+	// row was filtered out, or if no parent row has been read yet.
+	parentPrefix sqlbase.EncDatumRow
+	parentRow    sqlbase.EncDatumRow
+	// parentMatched is set once the current parent row has been joined with a
+	// child row.
+	parentMatched bool
+}
+
+// interleavedReaderJoinerTable holds the state of one of the tables of an
+// interleavedReaderJoiner.
+type interleavedReaderJoinerTable struct {
+	fetcher sqlbase.RowFetcher
+	// post performs the filtering and projection of the rows of the table,
+	// before they are joined.
+	post ProcOutputHelper
+	// prefixCols are the indices of the columns of the table which hold the
+	// primary key of the parent table.
+	prefixCols []int
+}
+
+var _ Processor = &interleavedReaderJoiner{}
+
+func newInterleavedReaderJoiner(
+	flowCtx *FlowCtx, spec *InterleavedReaderJoinerSpec, post *PostProcessSpec, output RowReceiver,
+) (*interleavedReaderJoiner, error) {
+	if flowCtx.nodeID == 0 {
+		return nil, errors.Errorf("attempting to create an interleavedReaderJoiner with uninitialized NodeID")
+	}
+	if len(spec.Tables) != 2 {
+		return nil, errors.Errorf("interleavedReaderJoiner requires 2 tables, got %d", len(spec.Tables))
+	}
+	if spec.Type != JoinType_INNER && spec.Type != JoinType_LEFT_OUTER {
+		return nil, errors.Errorf("interleavedReaderJoiner does not support %s joins", spec.Type)
+	}
+	parent, child := &spec.Tables[0], &spec.Tables[1]
+	if parent.IndexIdx != 0 {
+		return nil, errors.Errorf("parent table %s must be read through its primary index", parent.Desc.Name)
+	}
+	if child.IndexIdx > uint32(len(child.Desc.Indexes)) {
+		return nil, errors.Errorf("invalid indexIdx %d", child.IndexIdx)
+	}
+	childIndex := &child.Desc.PrimaryIndex
+	if child.IndexIdx > 0 {
+		childIndex = &child.Desc.Indexes[child.IndexIdx-1]
+	}
+	parentIndex := &parent.Desc.PrimaryIndex
+	ancestors := childIndex.Interleave.Ancestors
+	prefixLen := 0
+	for _, a := range ancestors {
+		prefixLen += int(a.SharedPrefixLen)
+	}
+	if len(ancestors) == 0 ||
+		ancestors[len(ancestors)-1].TableID != parent.Desc.ID ||
+		ancestors[len(ancestors)-1].IndexID != parentIndex.ID ||
+		prefixLen != len(parentIndex.ColumnIDs) {
+		return nil, errors.Errorf(
+			"index %s@%s is not interleaved in the primary key of %s",
+			childIndex.Name, child.Desc.Name, parent.Desc.Name,
+		)
+	}
+
+	irj := &interleavedReaderJoiner{
+		flowCtx:      flowCtx,
+		parentPrefix: make(sqlbase.EncDatumRow, prefixLen),
+	}
+	prefixColumnIDs := [2][]sqlbase.ColumnID{
+		parentIndex.ColumnIDs, childIndex.ColumnIDs[:prefixLen],
+	}
+	var fetchers [2]*sqlbase.RowFetcher
+	var types [2][]sqlbase.ColumnType
+	for i := range spec.Tables {
+		t := &irj.tables[i]
+		desc := spec.Tables[i].Desc
+		tableTypes := make([]sqlbase.ColumnType, len(desc.Columns))
+		for j := range tableTypes {
+			tableTypes[j] = desc.Columns[j].Type
+		}
+		if err := t.post.Init(
+			&spec.Tables[i].Post, tableTypes, &flowCtx.EvalCtx, nil, /* output */
+		); err != nil {
+			return nil, err
+		}
+
+		// The prefix columns are needed to join the rows, even if they are not
+		// part of the output.
+		neededCols := t.post.neededColumns()
+		colIdxMap := make(map[sqlbase.ColumnID]int, len(desc.Columns))
+		for j, c := range desc.Columns {
+			colIdxMap[c.ID] = j
+		}
+		t.prefixCols = make([]int, prefixLen)
+		for j, id := range prefixColumnIDs[i] {
+			t.prefixCols[j] = colIdxMap[id]
+			neededCols[t.prefixCols[j]] = true
+		}
+		if _, _, err := initRowFetcher(
+			&t.fetcher, &desc, int(spec.Tables[i].IndexIdx), false /* reverse */, neededCols, &irj.alloc,
+		); err != nil {
+			return nil, err
+		}
+		fetchers[i] = &t.fetcher
+		types[i] = t.post.outputTypes
+	}
+	if err := irj.fetcher.Init(fetchers[:]); err != nil {
+		return nil, err
+	}
+
+	if err := irj.joinerBase.initWithTypes(
+		flowCtx,
+		types[leftSide],
+		types[rightSide],
+		spec.Type,
+		spec.OnExpr,
+		nil, /* leftEqColumns */
+		nil, /* rightEqColumns */
+		0,   /* numMergedColumns */
+		post,
+		output,
+	); err != nil {
+		return nil, err
+	}
+
+	irj.spans = make(roachpb.Spans, len(spec.Spans))
+	for i, s := range spec.Spans {
+		irj.spans[i] = s.Span
+	}
+	return irj, nil
+}
+
+// Run is part of the processor interface.
+func (irj *interleavedReaderJoiner) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "InterleavedReaderJoiner", nil)
+	ctx, span := processorSpan(ctx, irj.flowCtx, "interleaved reader joiner")
+	defer tracing.FinishSpan(span)
+
+	txn := irj.flowCtx.txn
+	if txn == nil {
+		log.Fatalf(ctx, "interleavedReaderJoiner outside of txn")
+	}
+
+	log.VEventf(ctx, 1, "starting")
+	if log.V(1) {
+		defer log.Infof(ctx, "exiting")
+	}
+
+	if err := irj.fetcher.StartScan(ctx, txn, irj.spans, true /* limitBatches */); err != nil {
+		log.Errorf(ctx, "scan error: %s", err)
+		irj.out.output.Push(nil /* row */, ProducerMetadata{Err: err})
+		irj.out.Close()
+		return
+	}
+
+	if err := irj.join(ctx); err != nil {
+		irj.out.output.Push(nil /* row */, ProducerMetadata{Err: err})
+	}
+	sendLeafTxnState(ctx, irj.flowCtx, irj.out.output)
+	sendTraceData(ctx, irj.out.output)
+	irj.out.Close()
+}
+
+// join reads the rows of both tables and emits the joined rows, until the
+// rows run out or the consumer doesn't need more rows.
+func (irj *interleavedReaderJoiner) join(ctx context.Context) error {
+	for {
+		// TODO(radu,andrei,knz): set the traceKV flag when requested by the session.
+		row, table, err := irj.fetcher.NextRow(ctx, false /* traceKV */)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			irj.maybeEmitUnmatchedParent(ctx)
+			return nil
+		}
+		var moreRowsOK bool
+		if table == 0 {
+			moreRowsOK, err = irj.addParentRow(ctx, row)
+		} else {
+			moreRowsOK, err = irj.addChildRow(ctx, row)
+		}
+		if err != nil || !moreRowsOK {
+			return err
+		}
+	}
+}
+
+// addParentRow makes the given row of the parent table the current parent
+// row, after emitting the previous parent row if it was not matched.
+func (irj *interleavedReaderJoiner) addParentRow(
+	ctx context.Context, row sqlbase.EncDatumRow,
+) (moreRowsOK bool, _ error) {
+	if !irj.maybeEmitUnmatchedParent(ctx) {
+		return false, nil
+	}
+	t := &irj.tables[leftSide]
+	for i, c := range t.prefixCols {
+		irj.parentPrefix[i] = row[c]
+	}
+	irj.parentMatched = false
+	var err error
+	irj.parentRow, moreRowsOK, err = t.post.ProcessRow(ctx, row)
+	return moreRowsOK, err
+}
+
+// addChildRow joins the given row of the child table with the current parent
+// row, if it is interleaved in it.
+func (irj *interleavedReaderJoiner) addChildRow(
+	ctx context.Context, row sqlbase.EncDatumRow,
+) (moreRowsOK bool, _ error) {
+	if irj.parentRow == nil {
+		return true, nil
+	}
+	t := &irj.tables[rightSide]
+	// Skip the rows which are not interleaved in the current parent row, i.e.
+	// which have no parent row.
+	for i, c := range t.prefixCols {
+		cmp, err := row[c].Compare(&irj.alloc, &irj.flowCtx.EvalCtx, &irj.parentPrefix[i])
+		if err != nil {
+			return false, err
+		}
+		if cmp != 0 {
+			return true, nil
+		}
+	}
+	childRow, moreRowsOK, err := t.post.ProcessRow(ctx, row)
+	if err != nil || childRow == nil {
+		return moreRowsOK, err
+	}
+	renderedRow, err := irj.render(irj.parentRow, childRow)
+	if err != nil {
+		return false, err
+	}
+	// If the ON condition failed, renderedRow is nil.
+	if renderedRow == nil {
+		return true, nil
+	}
+	irj.parentMatched = true
+	consumerStatus, err := irj.out.EmitRow(ctx, renderedRow)
+	return err == nil && consumerStatus == NeedMoreRows, err
+}
+
+// maybeEmitUnmatchedParent emits the current parent row if it has not been
+// matched and this is an outer join. It returns false if the consumer doesn't
+// need more rows.
+func (irj *interleavedReaderJoiner) maybeEmitUnmatchedParent(ctx context.Context) bool {
+	if irj.parentRow == nil || irj.parentMatched {
+		return true
+	}
+	irj.parentMatched = true
+	return irj.maybeEmitUnmatchedRow(ctx, irj.parentRow, leftSide)
+}
@@ -57,14 +57,32 @@ func (jb *joinerBase) init(
 ) error {
 	jb.leftSource = leftSource
 	jb.rightSource = rightSource
+	return jb.initWithTypes(
+		flowCtx, leftSource.Types(), rightSource.Types(), jType, onExpr,
+		leftEqColumns, rightEqColumns, numMergedColumns, post, output,
+	)
+}
+
+// initWithTypes is like init, for joiners which produce the rows of both sides
+// themselves instead of reading them from sources.
+func (jb *joinerBase) initWithTypes(
+	flowCtx *FlowCtx,
+	leftTypes []sqlbase.ColumnType,
+	rightTypes []sqlbase.ColumnType,
+	jType JoinType,
+	onExpr Expression,
+	leftEqColumns []uint32,
+	rightEqColumns []uint32,
+	numMergedColumns uint32,
+	post *PostProcessSpec,
+	output RowReceiver,
+) error {
 	jb.joinType = joinType(jType)
 
-	leftTypes := leftSource.Types()
 	jb.emptyLeft = make(sqlbase.EncDatumRow, len(leftTypes))
 	for i := range jb.emptyLeft {
 		jb.emptyLeft[i] = sqlbase.DatumToEncDatum(leftTypes[i], parser.DNull)
 	}
-	rightTypes := rightSource.Types()
 	jb.emptyRight = make(sqlbase.EncDatumRow, len(rightTypes))
 	for i := range jb.emptyRight {
 		jb.emptyRight[i] = sqlbase.DatumToEncDatum(rightTypes[i], parser.DNull)
@@ -140,6 +140,7 @@ func (jr *joinReader) mainLoop(ctx context.Context) error {
 				if len(spans) == 0 {
 					// No fetching needed since we have collected no spans and
 					// the input has signalled that no more records are coming.
+					jr.out.pushTrailingMeta(ctx)
 					jr.out.Close()
 					return nil
 				}
@@ -185,6 +186,7 @@ func (jr *joinReader) mainLoop(ctx context.Context) error {
 
 		if len(spans) != joinReaderBatchSize {
 			// This was the last batch.
+			jr.out.pushTrailingMeta(ctx)
 			sendTraceData(ctx, jr.out.output)
 			jr.out.Close()
 			return nil
@@ -199,11 +201,17 @@ func (jr *joinReader) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 
 	ctx = log.WithLogTagInt(ctx, "JoinReader", int(jr.desc.ID))
-	ctx, span := processorSpan(ctx, "join reader")
+	ctx, span := processorSpan(ctx, jr.flowCtx, "join reader")
 	defer tracing.FinishSpan(span)
 
+	// The reads of the flow's leaf txn must be reported however the join
+	// reader stops.
+	jr.out.trailingMeta = func(ctx context.Context) {
+		sendLeafTxnState(ctx, jr.flowCtx, jr.out.output)
+	}
 	err := jr.mainLoop(ctx)
 	if err != nil {
+		jr.out.pushTrailingMeta(ctx)
 		DrainAndClose(ctx, jr.out.output, err /* cause */, jr.input)
 	}
 }
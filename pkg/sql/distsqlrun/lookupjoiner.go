@@ -0,0 +1,344 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// lookupJoinerBatchSize is the number of input rows whose lookups are
+// performed together.
+const lookupJoinerBatchSize = 100
+
+// lookupJoiner joins its input with a table by looking up the rows of the
+// table matching each input row in an index of the table. See
+// LookupJoinerSpec.
+type lookupJoiner struct {
+	joinerBase
+
+	flowCtx *FlowCtx
+
+	desc  sqlbase.TableDescriptor
+	index *sqlbase.IndexDescriptor
+	// lookupCols are the input columns which are looked up in the index.
+	lookupCols columns
+	// indexCols are the indices of the table columns which make up the index
+	// columns.
+	indexCols columns
+
+	fetcher sqlbase.RowFetcher
+	alloc   sqlbase.DatumAlloc
+
+	input RowSource
+
+	// batch holds the input rows of the current batch, and matched whether each
+	// of them has been joined with a row of the table.
+	batch    []sqlbase.EncDatumRow
+	matched  []bool
+	rowAlloc sqlbase.EncDatumRowAlloc
+	// keyToRows maps the index key of each lookup of the current batch to the
+	// indices of the input rows which look it up.
+	keyToRows map[string][]int
+	keyPrefix []byte
+	keyVals   sqlbase.EncDatumRow
+}
+
+var _ Processor = &lookupJoiner{}
+
+func newLookupJoiner(
+	flowCtx *FlowCtx,
+	spec *LookupJoinerSpec,
+	input RowSource,
+	post *PostProcessSpec,
+	output RowReceiver,
+) (*lookupJoiner, error) {
+	if spec.Type != JoinType_INNER && spec.Type != JoinType_LEFT_OUTER {
+		return nil, errors.Errorf("lookupJoiner does not support %s joins", spec.Type)
+	}
+	if spec.IndexIdx > uint32(len(spec.Table.Indexes)) {
+		return nil, errors.Errorf("invalid indexIdx %d", spec.IndexIdx)
+	}
+
+	lj := &lookupJoiner{
+		flowCtx:    flowCtx,
+		desc:       spec.Table,
+		lookupCols: columns(spec.LookupColumns),
+		input:      input,
+		keyToRows:  make(map[string][]int),
+	}
+	index := &lj.desc.PrimaryIndex
+	if spec.IndexIdx > 0 {
+		index = &lj.desc.Indexes[spec.IndexIdx-1]
+	}
+	if len(lj.lookupCols) != len(index.ColumnIDs) {
+		return nil, errors.Errorf(
+			"lookupJoiner has %d lookup columns, index %s has %d columns",
+			len(lj.lookupCols), index.Name, len(index.ColumnIDs),
+		)
+	}
+
+	inputTypes := input.Types()
+	tableTypes := make([]sqlbase.ColumnType, len(lj.desc.Columns))
+	colIdxMap := make(map[sqlbase.ColumnID]int, len(lj.desc.Columns))
+	for i, c := range lj.desc.Columns {
+		tableTypes[i] = c.Type
+		colIdxMap[c.ID] = i
+	}
+	lj.indexCols = make(columns, len(index.ColumnIDs))
+	for i, id := range index.ColumnIDs {
+		lj.indexCols[i] = uint32(colIdxMap[id])
+		lookupCol := lj.lookupCols[i]
+		if int(lookupCol) >= len(inputTypes) {
+			return nil, errors.Errorf("invalid lookup column %d", lookupCol)
+		}
+		if inputTypes[lookupCol].SemanticType != tableTypes[lj.indexCols[i]].SemanticType {
+			return nil, errors.Errorf(
+				"lookup column %d has type %s, index column %s has type %s",
+				lookupCol, inputTypes[lookupCol].SemanticType,
+				lj.desc.Columns[lj.indexCols[i]].Name, tableTypes[lj.indexCols[i]].SemanticType,
+			)
+		}
+	}
+
+	lj.leftSource = input
+	if err := lj.joinerBase.initWithTypes(
+		flowCtx,
+		inputTypes,
+		tableTypes,
+		spec.Type,
+		spec.OnExpr,
+		nil, /* leftEqColumns */
+		nil, /* rightEqColumns */
+		0,   /* numMergedColumns */
+		post,
+		output,
+	); err != nil {
+		return nil, err
+	}
+
+	// The table columns which are needed are those used by the post-processing
+	// or the ON expression, and the index columns.
+	needed := lj.out.neededColumns()[len(inputTypes):]
+	for i := range needed {
+		if !needed[i] && lj.onCond.expr != nil {
+			needed[i] = lj.onCond.vars.IndexedVarUsed(len(inputTypes) + i)
+		}
+	}
+	for _, c := range lj.indexCols {
+		needed[c] = true
+	}
+	if spec.IndexIdx > 0 {
+		indexed := make(map[sqlbase.ColumnID]struct{})
+		for _, ids := range [][]sqlbase.ColumnID{
+			index.ColumnIDs, index.ExtraColumnIDs, index.StoreColumnIDs,
+		} {
+			for _, id := range ids {
+				indexed[id] = struct{}{}
+			}
+		}
+		for i, c := range lj.desc.Columns {
+			if _, ok := indexed[c.ID]; needed[i] && !ok {
+				return nil, errors.Errorf("column %s is not part of index %s", c.Name, index.Name)
+			}
+		}
+	}
+
+	var err error
+	lj.index, _, err = initRowFetcher(
+		&lj.fetcher, &lj.desc, int(spec.IndexIdx), false /* reverse */, needed, &lj.alloc,
+	)
+	if err != nil {
+		return nil, err
+	}
+	lj.keyPrefix = sqlbase.MakeIndexKeyPrefix(&lj.desc, lj.index.ID)
+	lj.keyVals = make(sqlbase.EncDatumRow, len(lj.indexCols))
+	return lj, nil
+}
+
+// Run is part of the processor interface.
+func (lj *lookupJoiner) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTagInt(ctx, "LookupJoiner", int(lj.desc.ID))
+	ctx, span := processorSpan(ctx, lj.flowCtx, "lookup joiner")
+	defer tracing.FinishSpan(span)
+
+	// The reads of the flow's leaf txn must be reported however the lookup
+	// joiner stops.
+	lj.out.trailingMeta = func(ctx context.Context) {
+		sendLeafTxnState(ctx, lj.flowCtx, lj.out.output)
+	}
+	if err := lj.mainLoop(ctx); err != nil {
+		lj.out.pushTrailingMeta(ctx)
+		DrainAndClose(ctx, lj.out.output, err /* cause */, lj.input)
+	}
+}
+
+// mainLoop runs the mainLoop and returns any error.
+//
+// If no error is returned, the input has been drained and the output has been
+// closed. If an error is returned, the input hasn't been drained; the caller
+// should drain and close the output. The caller should also pass the returned
+// error to the consumer.
+func (lj *lookupJoiner) mainLoop(ctx context.Context) error {
+	txn := lj.flowCtx.txn
+	if txn == nil {
+		log.Fatalf(ctx, "lookupJoiner outside of txn")
+	}
+
+	log.VEventf(ctx, 1, "starting")
+	if log.V(1) {
+		defer log.Infof(ctx, "exiting")
+	}
+
+	spans := make(roachpb.Spans, 0, lookupJoinerBatchSize)
+	for {
+		// Read a batch of input rows.
+		lj.batch, lj.matched = lj.batch[:0], lj.matched[:0]
+		for k := range lj.keyToRows {
+			delete(lj.keyToRows, k)
+		}
+		spans = spans[:0]
+		inputDone := false
+		for len(lj.batch) < lookupJoinerBatchSize {
+			row, meta := lj.input.Next()
+			if !meta.Empty() {
+				if meta.Err != nil {
+					return meta.Err
+				}
+				if !emitHelper(ctx, &lj.out, nil /* row */, meta, lj.input) {
+					return nil
+				}
+				continue
+			}
+			if row == nil {
+				inputDone = true
+				break
+			}
+			rowIdx := len(lj.batch)
+			lj.batch = append(lj.batch, lj.rowAlloc.CopyRow(row))
+			lj.matched = append(lj.matched, false)
+
+			key, ok, err := lj.lookupKey(row, lj.lookupCols)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				// Rows with NULL lookup values don't match any row.
+				continue
+			}
+			rows, ok := lj.keyToRows[string(key)]
+			if !ok {
+				spans = append(spans, roachpb.Span{Key: key, EndKey: key.PrefixEnd()})
+			}
+			lj.keyToRows[string(key)] = append(rows, rowIdx)
+		}
+
+		if len(spans) > 0 {
+			if moreRowsOK, err := lj.joinBatch(ctx, spans); err != nil || !moreRowsOK {
+				return err
+			}
+		}
+		// Emit the unmatched input rows of the batch.
+		if shouldEmitUnmatchedRow(leftSide, lj.joinType) {
+			for i, row := range lj.batch {
+				if lj.matched[i] {
+					continue
+				}
+				renderedRow := lj.renderUnmatchedRow(row, leftSide)
+				if !emitHelper(ctx, &lj.out, renderedRow, ProducerMetadata{}, lj.input) {
+					return nil
+				}
+			}
+		}
+		if inputDone {
+			lj.out.pushTrailingMeta(ctx)
+			sendTraceData(ctx, lj.out.output)
+			lj.out.Close()
+			return nil
+		}
+	}
+}
+
+// joinBatch looks up the given spans, and joins the rows of the table with the
+// input rows of the current batch which look them up. It returns false if the
+// consumer doesn't need more rows, in which case the input has been drained
+// and the output has been closed.
+func (lj *lookupJoiner) joinBatch(
+	ctx context.Context, spans roachpb.Spans,
+) (moreRowsOK bool, _ error) {
+	if err := lj.fetcher.StartScan(
+		ctx, lj.flowCtx.txn, spans, false /* no batch limits */, 0, /* limitHint */
+	); err != nil {
+		log.Errorf(ctx, "scan error: %s", err)
+		return false, err
+	}
+	for {
+		// TODO(radu,andrei,knz): set the traceKV flag when requested by the session.
+		tableRow, err := lj.fetcher.NextRow(ctx, false /* traceKV */)
+		if err != nil {
+			return false, err
+		}
+		if tableRow == nil {
+			return true, nil
+		}
+		key, ok, err := lj.lookupKey(tableRow, lj.indexCols)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			continue
+		}
+		for _, rowIdx := range lj.keyToRows[string(key)] {
+			renderedRow, err := lj.render(lj.batch[rowIdx], tableRow)
+			if err != nil {
+				return false, err
+			}
+			// If the ON condition failed, renderedRow is nil.
+			if renderedRow == nil {
+				continue
+			}
+			lj.matched[rowIdx] = true
+			if !emitHelper(ctx, &lj.out, renderedRow, ProducerMetadata{}, lj.input) {
+				return false, nil
+			}
+		}
+	}
+}
+
+// lookupKey returns the index key made up of the values of the given columns
+// of the row; ok is false if any of them is NULL.
+func (lj *lookupJoiner) lookupKey(
+	row sqlbase.EncDatumRow, cols columns,
+) (_ roachpb.Key, ok bool, _ error) {
+	for i, c := range cols {
+		if row[c].IsNull() {
+			return nil, false, nil
+		}
+		lj.keyVals[i] = row[c]
+	}
+	key, err := sqlbase.MakeKeyFromEncDatums(lj.keyVals, &lj.desc, lj.index, lj.keyPrefix, &lj.alloc)
+	return key, true, err
+}
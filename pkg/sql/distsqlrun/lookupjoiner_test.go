@@ -0,0 +1,313 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	gosql "database/sql"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestLookupJoiner(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	// Create a table where each row is:
+	//
+	//  |     a    |     b    |         sum         |         s           |
+	//  |-----------------------------------------------------------------|
+	//  | rowId/10 | rowId%10 | rowId/10 + rowId%10 | IntToEnglish(rowId) |
+
+	aFn := func(row int) parser.Datum {
+		return parser.NewDInt(parser.DInt(row / 10))
+	}
+	bFn := func(row int) parser.Datum {
+		return parser.NewDInt(parser.DInt(row % 10))
+	}
+	sumFn := func(row int) parser.Datum {
+		return parser.NewDInt(parser.DInt(row/10 + row%10))
+	}
+
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"a INT, b INT, sum INT, s STRING, PRIMARY KEY (a,b), INDEX bs (b,s)",
+		99,
+		sqlutils.ToRowFn(aFn, bFn, sumFn, sqlutils.RowEnglishFn))
+
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	intType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	strType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	dInt := func(v int) parser.Datum { return parser.NewDInt(parser.DInt(v)) }
+	null := parser.DNull
+
+	// Input rows for lookups in the primary index: (a, b, x).
+	pkInput := [][]parser.Datum{
+		{dInt(0), dInt(2), dInt(100)},
+		{dInt(1), dInt(5), dInt(101)},
+		{dInt(20), dInt(0), dInt(102)},
+		{null, dInt(1), dInt(103)},
+		{dInt(0), dInt(2), dInt(104)},
+	}
+
+	// The internal columns are the input columns followed by a, b, sum, s.
+	testCases := []struct {
+		name     string
+		spec     LookupJoinerSpec
+		post     PostProcessSpec
+		types    []sqlbase.ColumnType
+		input    [][]parser.Datum
+		expected string
+	}{
+		{
+			name: "Inner",
+			spec: LookupJoinerSpec{LookupColumns: []uint32{0, 1}, Type: JoinType_INNER},
+			post: PostProcessSpec{
+				Projection:    true,
+				OutputColumns: []uint32{2, 5}, // x, sum
+			},
+			types:    []sqlbase.ColumnType{intType, intType, intType},
+			input:    pkInput,
+			expected: "[[100 2] [104 2] [101 6]]",
+		},
+		{
+			name: "LeftOuter",
+			spec: LookupJoinerSpec{LookupColumns: []uint32{0, 1}, Type: JoinType_LEFT_OUTER},
+			post: PostProcessSpec{
+				Projection:    true,
+				OutputColumns: []uint32{2, 5}, // x, sum
+			},
+			types:    []sqlbase.ColumnType{intType, intType, intType},
+			input:    pkInput,
+			expected: "[[100 2] [104 2] [101 6] [102 NULL] [103 NULL]]",
+		},
+		{
+			name: "OnExpr",
+			spec: LookupJoinerSpec{
+				LookupColumns: []uint32{0, 1},
+				OnExpr:        Expression{Expr: "@6 > 5"}, // sum > 5
+				Type:          JoinType_LEFT_OUTER,
+			},
+			post: PostProcessSpec{
+				Projection:    true,
+				OutputColumns: []uint32{2, 5}, // x, sum
+			},
+			types:    []sqlbase.ColumnType{intType, intType, intType},
+			input:    pkInput,
+			expected: "[[101 6] [100 NULL] [102 NULL] [103 NULL] [104 NULL]]",
+		},
+		{
+			name: "SecondaryIndex",
+			spec: LookupJoinerSpec{IndexIdx: 1, LookupColumns: []uint32{1, 0}, Type: JoinType_INNER},
+			post: PostProcessSpec{
+				Projection:    true,
+				OutputColumns: []uint32{0, 2}, // s, a
+			},
+			types: []sqlbase.ColumnType{strType, intType},
+			input: [][]parser.Datum{
+				{parser.NewDString("one-five"), dInt(5)},
+				{parser.NewDString("three"), dInt(3)},
+				{parser.NewDString("three"), dInt(4)},
+			},
+			expected: "[['one-five' 1] ['three' 0]]",
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+				// Pass a DB without a TxnCoordSender.
+				txn: client.NewTxn(client.NewDB(s.DistSender(), s.Clock())),
+			}
+
+			var rows sqlbase.EncDatumRows
+			for _, row := range c.input {
+				encRow := make(sqlbase.EncDatumRow, len(row))
+				for i, d := range row {
+					encRow[i] = sqlbase.DatumToEncDatum(c.types[i], d)
+				}
+				rows = append(rows, encRow)
+			}
+			in := NewRowBuffer(c.types, rows, RowBufferArgs{})
+
+			out := &RowBuffer{}
+			spec := c.spec
+			spec.Table = *td
+			lj, err := newLookupJoiner(&flowCtx, &spec, in, &c.post, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lj.Run(context.Background(), nil)
+
+			if !in.Done {
+				t.Fatal("lookupJoiner didn't consume all the rows")
+			}
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			var res sqlbase.EncDatumRows
+			for {
+				row, meta := out.Next()
+				if !meta.Empty() {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if row == nil {
+					break
+				}
+				res = append(res, row)
+			}
+
+			if result := res.String(); result != c.expected {
+				t.Errorf("invalid results: %s, expected %s'", result, c.expected)
+			}
+		})
+	}
+}
+
+// TestLookupJoinerLimitLeafTxnState verifies that a lookup joiner which stops
+// early because of a limit still sends the state of its leaf txn, so that the
+// reads are refreshed if the root txn gets pushed.
+func TestLookupJoinerLimitLeafTxnState(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"a INT, b INT, c INT, PRIMARY KEY (a,b)",
+		99,
+		sqlutils.ToRowFn(
+			func(row int) parser.Datum { return parser.NewDInt(parser.DInt(row / 10)) },
+			func(row int) parser.Datum { return parser.NewDInt(parser.DInt(row % 10)) },
+			sqlutils.RowIdxFn,
+		))
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	intType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{intType, intType}
+	var rows sqlbase.EncDatumRows
+	for _, v := range [][2]int{{0, 2}, {1, 5}, {2, 0}} {
+		rows = append(rows, sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(v[0]))),
+			sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(v[1]))),
+		})
+	}
+
+	checkLimitedLeafReadsRefreshed(t, s, sqlDB, kvDB,
+		"UPDATE test.t SET c = 0 WHERE a = 1 AND b = 5",
+		func(flowCtx *FlowCtx, out *RowBuffer) {
+			spec := LookupJoinerSpec{LookupColumns: []uint32{0, 1}, Type: JoinType_INNER, Table: *td}
+			post := PostProcessSpec{Limit: 1}
+			lj, err := newLookupJoiner(flowCtx, &spec, NewRowBuffer(types, rows, RowBufferArgs{}), &post, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lj.Run(context.Background(), nil)
+		})
+}
+
+// checkLimitedLeafReadsRefreshed runs a processor in a leaf txn with the given
+// function; the processor is expected to emit a single row because of a limit.
+// It verifies that the state of the leaf txn is sent all the same, and that
+// once merged into the root txn, the reads of the leaf keep the root txn from
+// committing after the given statement wrote to a row they read and the root
+// txn was pushed.
+func checkLimitedLeafReadsRefreshed(
+	t *testing.T,
+	s serverutils.TestServerInterface,
+	sqlDB *gosql.DB,
+	kvDB *client.DB,
+	conflictingStmt string,
+	run func(*FlowCtx, *RowBuffer),
+) {
+	ctx := context.Background()
+	root := client.NewTxn(kvDB)
+	// The leaf txn bypasses the TxnCoordSender.
+	leaf := client.NewLeafTxn(client.NewDB(s.DistSender(), s.Clock()), *root.Proto())
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      leaf,
+		nodeID:   s.NodeID(),
+	}
+	out := &RowBuffer{}
+	run(&flowCtx, out)
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+
+	var leafState *roachpb.LeafTxnFinalState
+	numRows := 0
+	for {
+		row, meta := out.Next()
+		if meta.LeafTxn != nil {
+			leafState = meta.LeafTxn
+			continue
+		}
+		if !meta.Empty() {
+			t.Fatalf("unexpected metadata: %+v", meta)
+		}
+		if row == nil {
+			break
+		}
+		numRows++
+	}
+	if numRows != 1 {
+		t.Fatalf("expected 1 row, got %d", numRows)
+	}
+	if leafState == nil || len(leafState.RefreshSpans) == 0 {
+		t.Fatalf("expected the leaf txn state with the spans read, got %+v", leafState)
+	}
+	root.UpdateStateOnLeafTxn(ctx, leafState)
+
+	// Outside of the root txn, write to a row read by the leaf, and read the key
+	// the root txn writes next, so that its timestamp gets pushed.
+	if _, err := sqlDB.Exec(conflictingStmt); err != nil {
+		t.Fatal(err)
+	}
+	key := roachpb.Key("leaf-reads-pushed")
+	if _, err := kvDB.Get(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Put(ctx, key, "value"); err != nil {
+		t.Fatal(err)
+	}
+	// The reads of the leaf can't be refreshed, so the root txn must restart.
+	if err := root.CommitOrCleanup(ctx); err == nil {
+		t.Fatal("expected the root txn to fail to refresh the reads of the leaf")
+	} else if _, ok := err.(*roachpb.HandledRetryableTxnError); !ok {
+		t.Fatalf("expected a retryable error, got %v", err)
+	}
+}
@@ -31,6 +31,7 @@ import (
 type mergeJoiner struct {
 	joinerBase
 
+	flowCtx      *FlowCtx
 	streamMerger streamMerger
 }
 
@@ -50,7 +51,7 @@ func newMergeJoiner(
 		}
 	}
 
-	m := &mergeJoiner{}
+	m := &mergeJoiner{flowCtx: flowCtx}
 	// TODO: Adapt MergeJoiner to new joinerBase constructor.
 	err := m.joinerBase.init(flowCtx, leftSource, rightSource, spec.Type, spec.OnExpr, nil, nil, 0, post, output)
 	if err != nil {
@@ -78,7 +79,7 @@ func (m *mergeJoiner) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 
 	ctx = log.WithLogTag(ctx, "MergeJoiner", nil)
-	ctx, span := processorSpan(ctx, "merge joiner")
+	ctx, span := processorSpan(ctx, m.flowCtx, "merge joiner")
 	defer tracing.FinishSpan(span)
 	log.VEventf(ctx, 2, "starting merge joiner run")
 
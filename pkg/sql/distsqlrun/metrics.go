@@ -15,6 +15,7 @@
 package distsqlrun
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
@@ -27,8 +28,26 @@ type DistSQLMetrics struct {
 	QueriesTotal  *metric.Counter
 	FlowsActive   *metric.Gauge
 	FlowsTotal    *metric.Counter
+	FlowsQueued   *metric.Gauge
+	FlowsRejected *metric.Counter
+	FlowsTimedOut *metric.Counter
+	// FlowLatency is the duration of the flows which completed in the recent
+	// window.
+	FlowLatency   *metric.WindowedHistogram
+	QueueWaitHist *metric.Histogram
 	MaxBytesHist  *metric.Histogram
 	CurBytesCount *metric.Counter
+
+	MaxDiskBytesHist  *metric.Histogram
+	CurDiskBytesCount *metric.Counter
+
+	RowChannelBlocked     *metric.Counter
+	RowChannelBlockedHist *metric.Histogram
+
+	SorterMem     ProcessorMemMetrics
+	HashJoinerMem ProcessorMemMetrics
+	AggregatorMem ProcessorMemMetrics
+	DistinctMem   ProcessorMemMetrics
 }
 
 // MetricStruct implements the metrics.Struct interface.
@@ -36,6 +55,55 @@ func (DistSQLMetrics) MetricStruct() {}
 
 var _ metric.Struct = DistSQLMetrics{}
 
+// ProcessorMemMetrics contains the metrics about the memory budget errors and
+// the spills to temporary storage of one type of processor (see spiller).
+type ProcessorMemMetrics struct {
+	MemoryErrors *metric.Counter
+	Spills       *metric.Counter
+	SpilledBytes *metric.Counter
+}
+
+// MetricStruct implements the metrics.Struct interface.
+func (ProcessorMemMetrics) MetricStruct() {}
+
+var _ metric.Struct = ProcessorMemMetrics{}
+
+// makeProcessorMemMetrics creates the metrics of the given type of processor;
+// desc is the plural of the processor's name in the help of the metrics.
+func makeProcessorMemMetrics(processor, desc string) ProcessorMemMetrics {
+	return ProcessorMemMetrics{
+		MemoryErrors: metric.NewCounter(metric.Metadata{
+			Name: fmt.Sprintf("sql.distsql.%s.memory_budget_errors", processor),
+			Help: fmt.Sprintf("Number of distributed SQL %s which failed because they exceeded their memory budget", desc)}),
+		Spills: metric.NewCounter(metric.Metadata{
+			Name: fmt.Sprintf("sql.distsql.%s.spills", processor),
+			Help: fmt.Sprintf("Number of times distributed SQL %s fell back to temporary storage", desc)}),
+		SpilledBytes: metric.NewCounter(metric.Metadata{
+			Name: fmt.Sprintf("sql.distsql.%s.spilled_bytes", processor),
+			Help: fmt.Sprintf("Temporary storage used by distributed SQL %s which spilled to disk", desc)}),
+	}
+}
+
+// processorMemMetrics returns the metrics of the given type of processor. It
+// returns nil if m is nil.
+func (m *DistSQLMetrics) processorMemMetrics(processor string) *ProcessorMemMetrics {
+	if m == nil {
+		return nil
+	}
+	switch processor {
+	case "sorter":
+		return &m.SorterMem
+	case "hashjoiner":
+		return &m.HashJoinerMem
+	case "aggregator":
+		return &m.AggregatorMem
+	case "distinct":
+		return &m.DistinctMem
+	default:
+		panic(fmt.Sprintf("no memory metrics for processor %q", processor))
+	}
+}
+
 var (
 	metaQueriesActive = metric.Metadata{
 		Name: "sql.distsql.queries.active",
@@ -49,12 +117,39 @@ var (
 	metaFlowsTotal = metric.Metadata{
 		Name: "sql.distsql.flows.total",
 		Help: "Number of distributed SQL flows executed"}
+	metaFlowsQueued = metric.Metadata{
+		Name: "sql.distsql.flows.queued",
+		Help: "Number of distributed SQL flows currently queued"}
+	metaFlowsRejected = metric.Metadata{
+		Name: "sql.distsql.flows.rejected",
+		Help: "Number of distributed SQL flows rejected because the queue was full"}
+	metaFlowsTimedOut = metric.Metadata{
+		Name: "sql.distsql.flows.queue_timeouts",
+		Help: "Number of distributed SQL flows abandoned after waiting too long in the queue"}
+	metaFlowLatency = metric.Metadata{
+		Name: "sql.distsql.flows.latency",
+		Help: "Recent duration of distributed SQL flows, from their start to their completion"}
+	metaQueueWait = metric.Metadata{
+		Name: "sql.distsql.flows.queue_wait",
+		Help: "Duration of time flows spend waiting in the queue"}
+	metaRowChannelBlocked = metric.Metadata{
+		Name: "sql.distsql.rowchannel.blocked",
+		Help: "Number of rows pushed by distributed SQL processors which blocked on a full row channel"}
+	metaRowChannelBlockedTime = metric.Metadata{
+		Name: "sql.distsql.rowchannel.blocked_time",
+		Help: "Duration of time distributed SQL processors spend blocked on a full row channel"}
 	metaMemMaxBytes = metric.Metadata{
 		Name: "sql.mem.distsql.max",
 		Help: "Memory usage per sql statement for distsql"}
 	metaMemCurBytes = metric.Metadata{
 		Name: "sql.mem.distsql.current",
 		Help: "Current sql statement memory usage for distsql"}
+	metaDiskMaxBytes = metric.Metadata{
+		Name: "sql.distsql.temp_storage.max",
+		Help: "Temporary storage usage per distributed SQL flow"}
+	metaDiskCurBytes = metric.Metadata{
+		Name: "sql.distsql.temp_storage.current",
+		Help: "Current temporary storage usage of distributed SQL flows"}
 )
 
 // See pkg/sql/mem_metrics.go
@@ -68,8 +163,24 @@ func MakeDistSQLMetrics(histogramWindow time.Duration) DistSQLMetrics {
 		QueriesTotal:  metric.NewCounter(metaQueriesTotal),
 		FlowsActive:   metric.NewGauge(metaFlowsActive),
 		FlowsTotal:    metric.NewCounter(metaFlowsTotal),
+		FlowsQueued:   metric.NewGauge(metaFlowsQueued),
+		FlowsRejected: metric.NewCounter(metaFlowsRejected),
+		FlowsTimedOut: metric.NewCounter(metaFlowsTimedOut),
+		FlowLatency:   metric.NewWindowedLatency(metaFlowLatency, histogramWindow),
+		QueueWaitHist: metric.NewLatency(metaQueueWait, histogramWindow),
 		MaxBytesHist:  metric.NewHistogram(metaMemMaxBytes, histogramWindow, log10int64times1000, 3),
 		CurBytesCount: metric.NewCounter(metaMemCurBytes),
+
+		MaxDiskBytesHist:  metric.NewHistogram(metaDiskMaxBytes, histogramWindow, log10int64times1000, 3),
+		CurDiskBytesCount: metric.NewCounter(metaDiskCurBytes),
+
+		RowChannelBlocked:     metric.NewCounter(metaRowChannelBlocked),
+		RowChannelBlockedHist: metric.NewLatency(metaRowChannelBlockedTime, histogramWindow),
+
+		SorterMem:     makeProcessorMemMetrics("sorter", "sorts"),
+		HashJoinerMem: makeProcessorMemMetrics("hashjoiner", "hash joiners"),
+		AggregatorMem: makeProcessorMemMetrics("aggregator", "aggregators"),
+		DistinctMem:   makeProcessorMemMetrics("distinct", "distinct operations"),
 	}
 }
 
@@ -19,10 +19,12 @@ import (
 	"sync"
 	"time"
 
+	opentracing "github.com/opentracing/opentracing-go"
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 )
 
 const outboxBufRows = 16
@@ -89,6 +91,14 @@ func (m *outbox) addRow(ctx context.Context, row sqlbase.EncDatumRow, meta Produ
 	mustFlush := false
 	var encodingErr error
 	if !meta.Empty() {
+		if meta.Checkpoint != nil {
+			// The decoder returns the metadata of a message before its rows. Send
+			// the rows preceding the checkpoint first, so that the consumer doesn't
+			// see the checkpoint before them.
+			if err := m.flush(ctx); err != nil {
+				return err
+			}
+		}
 		m.encoder.AddMetadata(meta)
 		// If we hit an error, let's forward it ASAP. The consumer will probably
 		// close.
@@ -164,6 +174,14 @@ func (m *outbox) flush(ctx context.Context) error {
 // set to nil.
 func (m *outbox) mainLoop(ctx context.Context) error {
 	if m.syncFlowStream == nil {
+		// The context of the flow's span is sent in the stream's header, since
+		// the span in ctx isn't propagated by the streaming RPC itself.
+		traceCtx, err := tracing.InjectSpanContext(opentracing.SpanFromContext(ctx))
+		if err != nil {
+			log.Warningf(ctx, "error injecting span context: %s", err)
+		}
+		m.encoder.msgHdr.TraceContext = traceCtx
+
 		conn, err := m.flowCtx.rpcCtx.GRPCDial(m.addr)
 		if err != nil {
 			return err
@@ -229,6 +247,15 @@ func (m *outbox) mainLoop(ctx context.Context) error {
 			if err != nil {
 				return err
 			}
+		case <-ctx.Done():
+			// The flow was canceled. Forward the error so that the consumer doesn't
+			// take the end of the stream for the end of the data, and stop without
+			// waiting for the producer; it will find out that we're gone when it
+			// next pushes a row.
+			if err := m.addRow(ctx, nil /* row */, ProducerMetadata{Err: ctx.Err()}); err != nil {
+				return err
+			}
+			return ctx.Err()
 		case drainSignal := <-drainCh:
 			if drainSignal.err != nil {
 				// The consumer either doesn't care any more (it returned from the
@@ -242,6 +242,75 @@ func TestOutboxInitializesStreamBeforeRecevingAnyRows(t *testing.T) {
 	outboxWG.Wait()
 }
 
+// Test that the outbox forwards an error to the consumer and finishes when the
+// flow is canceled, without waiting for the producer.
+func TestOutboxFlowCancellation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	mockServer, addr, err := startMockDistSQLServer(stopper)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		stopper:  stopper,
+		EvalCtx:  evalCtx,
+		rpcCtx:   newInsecureRPCContext(stopper),
+	}
+	outbox := newOutbox(&flowCtx, addr.String(), FlowID{uuid.MakeV4()}, StreamID(42))
+
+	var outboxWG sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outbox.start(ctx, &outboxWG)
+
+	streamNotification := <-mockServer.inboundStreams
+	serverStream := streamNotification.stream
+	// Wait for the header message before canceling.
+	if _, err := serverStream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	var decoder StreamDecoder
+	var rows sqlbase.EncDatumRows
+	var metas []ProducerMetadata
+	for {
+		msg, err := serverStream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			t.Fatal(err)
+		}
+		if err := decoder.AddMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+		rows, metas = testGetDecodedRows(t, &decoder, rows, metas)
+	}
+	if len(rows) != 0 {
+		t.Fatalf("unexpected rows: %s", rows)
+	}
+	if len(metas) != 1 || !testutils.IsError(metas[0].Err, "context canceled") {
+		t.Fatalf("expected a context canceled error, got: %+v", metas)
+	}
+
+	streamNotification.donec <- nil
+	outboxWG.Wait()
+	if !testutils.IsError(outbox.err, "context canceled") {
+		t.Fatalf("expected context canceled error, got: %v", outbox.err)
+	}
+	// The producer finds out that the outbox is gone when it pushes.
+	if status := outbox.Push(nil /* row */, ProducerMetadata{}); status != ConsumerClosed {
+		t.Fatalf("expected status %d, got %d", ConsumerClosed, status)
+	}
+}
+
 // Test that the outbox responds to the consumer shutting down in an unexpected
 // way by closing.
 func TestOutboxClosesWhenConsumerCloses(t *testing.T) {
@@ -447,6 +516,27 @@ func (ds *MockDistSQLServer) SetupFlow(
 	return nil, nil
 }
 
+// CancelFlows is part of the DistSQLServer interface.
+func (ds *MockDistSQLServer) CancelFlows(
+	_ context.Context, req *CancelFlowsRequest,
+) (*SimpleResponse, error) {
+	return nil, nil
+}
+
+// PauseFlows is part of the DistSQLServer interface.
+func (ds *MockDistSQLServer) PauseFlows(
+	_ context.Context, req *PauseFlowsRequest,
+) (*SimpleResponse, error) {
+	return nil, nil
+}
+
+// ResumeFlows is part of the DistSQLServer interface.
+func (ds *MockDistSQLServer) ResumeFlows(
+	_ context.Context, req *ResumeFlowsRequest,
+) (*SimpleResponse, error) {
+	return nil, nil
+}
+
 // FlowStream is part of the DistSQLServer interface.
 func (ds *MockDistSQLServer) FlowStream(stream DistSQL_FlowStreamServer) error {
 	donec := make(chan error)
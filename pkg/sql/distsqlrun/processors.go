@@ -40,6 +40,29 @@ type Processor interface {
 	Run(ctx context.Context, wg *sync.WaitGroup)
 }
 
+// RowSourcedProcessor is a Processor which can also be used directly as the
+// input of its consumer: instead of running in its own goroutine and pushing
+// rows to a RowChannel, it produces its rows when the consumer calls Next. This
+// is used to fuse linear chains of local processors (see Flow.setup), saving a
+// goroutine and a channel hop per row.
+//
+// A fused processor is created with a nil output; Start is called instead of
+// Run. It doesn't have its own tracing span and doesn't send its own trace
+// data.
+type RowSourcedProcessor interface {
+	Processor
+	RowSource
+
+	// Start prepares the processor for Next to be called.
+	Start(ctx context.Context)
+}
+
+// canFuse returns whether processors with the given core implement
+// RowSourcedProcessor.
+func canFuse(core *ProcessorCoreUnion) bool {
+	return core.Noop != nil
+}
+
 // ProcOutputHelper is a helper type that performs filtering and projection on
 // the output of a processor.
 type ProcOutputHelper struct {
@@ -72,6 +95,12 @@ type ProcOutputHelper struct {
 	maxRowIdx uint64
 
 	rowIdx uint64
+
+	// trailingMeta, if set, pushes the metadata which the processor sends once
+	// it is done, such as the state of the flow's leaf txn. It is called by
+	// pushTrailingMeta, which emitHelper also calls when the processor stops
+	// early, so that the metadata is sent as long as the consumer accepts it.
+	trailingMeta func(context.Context)
 }
 
 // Init sets up a ProcOutputHelper. The types describe the internal schema of
@@ -211,6 +240,7 @@ func emitHelper(
 		consumerStatus, err = output.EmitRow(ctx, row)
 		if err != nil {
 			output.output.Push(nil /* row */, ProducerMetadata{Err: err})
+			output.pushTrailingMeta(ctx)
 			for _, input := range inputs {
 				input.ConsumerClosed()
 			}
@@ -223,6 +253,7 @@ func emitHelper(
 		return true
 	case DrainRequested:
 		log.VEventf(ctx, 1, "no more rows required. drain requested.")
+		output.pushTrailingMeta(ctx)
 		DrainAndClose(ctx, output.output, nil /* cause */, inputs...)
 		return false
 	case ConsumerClosed:
@@ -249,26 +280,60 @@ func emitHelper(
 func (h *ProcOutputHelper) EmitRow(
 	ctx context.Context, row sqlbase.EncDatumRow,
 ) (ConsumerStatus, error) {
-	if h.rowIdx >= h.maxRowIdx {
+	outRow, moreRowsOK, err := h.ProcessRow(ctx, row)
+	if err != nil {
+		return ConsumerClosed, err
+	}
+	if outRow == nil {
+		if moreRowsOK {
+			return NeedMoreRows, nil
+		}
+		return DrainRequested, nil
+	}
+	if log.V(3) {
+		log.InfofDepth(ctx, 1, "pushing row %s", outRow)
+	}
+	if r := h.output.Push(outRow, ProducerMetadata{}); r != NeedMoreRows {
+		log.VEventf(ctx, 1, "no more rows required. drain requested: %t",
+			r == DrainRequested)
+		return r, nil
+	}
+	if h.rowIdx == h.maxRowIdx {
+		log.VEventf(ctx, 1, "hit row limit; asking producer to drain")
 		return DrainRequested, nil
 	}
+	return NeedMoreRows, nil
+}
+
+// ProcessRow sends a row through the post-processing stage and returns the
+// resulting row, without pushing it to the output. The same row can be reused.
+//
+// A nil row is returned if the row is filtered out or suppressed by the
+// offset; moreRowsOK is false if no more rows can be returned because the limit
+// has been reached.
+func (h *ProcOutputHelper) ProcessRow(
+	ctx context.Context, row sqlbase.EncDatumRow,
+) (_ sqlbase.EncDatumRow, moreRowsOK bool, _ error) {
+	if h.rowIdx >= h.maxRowIdx {
+		return nil, false, nil
+	}
 	if h.filter != nil {
 		// Filtering.
 		passes, err := h.filter.evalFilter(row)
 		if err != nil {
-			return ConsumerClosed, err
+			return nil, false, err
 		}
 		if !passes {
 			if log.V(3) {
 				log.Infof(ctx, "filtered out row %s", row)
 			}
-			return NeedMoreRows, nil
+			return nil, true, nil
 		}
 	}
 	h.rowIdx++
 	if h.rowIdx <= h.offset {
 		// Suppress row.
-		return NeedMoreRows, nil
+		return nil, true, nil
 	}
 	var outRow sqlbase.EncDatumRow
 	if h.renderExprs != nil {
@@ -277,7 +342,7 @@ func (h *ProcOutputHelper) EmitRow(
 		for i := range h.renderExprs {
 			datum, err := h.renderExprs[i].eval(row)
 			if err != nil {
-				return ConsumerClosed, err
+				return nil, false, err
 			}
 			outRow[i] = sqlbase.DatumToEncDatum(h.outputTypes[i], datum)
 		}
@@ -292,19 +357,15 @@ func (h *ProcOutputHelper) EmitRow(
 		outRow = h.rowAlloc.AllocRow(len(row))
 		copy(outRow, row)
 	}
-	if log.V(3) {
-		log.InfofDepth(ctx, 1, "pushing row %s", outRow)
-	}
-	if r := h.output.Push(outRow, ProducerMetadata{}); r != NeedMoreRows {
-		log.VEventf(ctx, 1, "no more rows required. drain requested: %t",
-			r == DrainRequested)
-		return r, nil
-	}
-	if h.rowIdx == h.maxRowIdx {
-		log.VEventf(ctx, 1, "hit row limit; asking producer to drain")
-		return DrainRequested, nil
+	return outRow, true, nil
+}
+
+// pushTrailingMeta calls trailingMeta, if set, the first time it is called.
+func (h *ProcOutputHelper) pushTrailingMeta(ctx context.Context) {
+	if f := h.trailingMeta; f != nil {
+		h.trailingMeta = nil
+		f(ctx)
 	}
-	return NeedMoreRows, nil
 }
 
 // Close signals to the output that there will be no more rows.
@@ -330,9 +391,16 @@ type noopProcessor struct {
 
 	flowCtx *FlowCtx
 	input   RowSource
+
+	// The following fields are used when the processor is fused with its
+	// consumer (see RowSourcedProcessor).
+	ctx context.Context
+	// draining is set once no more rows are needed; the rows of the input are
+	// then discarded and only its metadata is returned.
+	draining bool
 }
 
-var _ Processor = &noopProcessor{}
+var _ RowSourcedProcessor = &noopProcessor{}
 
 func newNoopProcessor(
 	flowCtx *FlowCtx, input RowSource, post *PostProcessSpec, output RowReceiver,
@@ -344,15 +412,26 @@ func newNoopProcessor(
 	return n, nil
 }
 
+// processorMonitorKey is the context key of the memory monitor of the
+// processor whose span is in the context. The peak memory usage of the
+// processor is recorded in its span by sendTraceData.
+type processorMonitorKey struct{}
+
 // processorSpan creates a child span for a processor (if we are doing any
 // tracing). The returned span needs to be finished using tracing.FinishSpan.
-func processorSpan(ctx context.Context, name string) (context.Context, opentracing.Span) {
+func processorSpan(
+	ctx context.Context, flowCtx *FlowCtx, name string,
+) (context.Context, opentracing.Span) {
 	parentSp := opentracing.SpanFromContext(ctx)
 	if parentSp == nil || tracing.IsBlackHoleSpan(parentSp) {
 		return ctx, nil
 	}
 	newSpan := tracing.StartChildSpan(name, parentSp, true /* separateRecording */)
-	return opentracing.ContextWithSpan(ctx, newSpan), newSpan
+	ctx = opentracing.ContextWithSpan(ctx, newSpan)
+	if flowCtx.EvalCtx.Mon != nil {
+		ctx = context.WithValue(ctx, processorMonitorKey{}, flowCtx.EvalCtx.Mon)
+	}
+	return ctx, newSpan
 }
 
 // Run is part of the processor interface.
@@ -360,7 +439,7 @@ func (n *noopProcessor) Run(ctx context.Context, wg *sync.WaitGroup) {
 	if wg != nil {
 		defer wg.Done()
 	}
-	ctx, span := processorSpan(ctx, "noop")
+	ctx, span := processorSpan(ctx, n.flowCtx, "noop")
 	defer tracing.FinishSpan(span)
 
 	for {
@@ -376,6 +455,57 @@ func (n *noopProcessor) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 }
 
+// Start is part of the RowSourcedProcessor interface.
+func (n *noopProcessor) Start(ctx context.Context) {
+	n.ctx = ctx
+}
+
+// Types is part of the RowSource interface.
+func (n *noopProcessor) Types() []sqlbase.ColumnType {
+	return n.OutputTypes()
+}
+
+// Next is part of the RowSource interface.
+func (n *noopProcessor) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
+	for {
+		row, meta := n.input.Next()
+		if !meta.Empty() {
+			return nil, meta
+		}
+		if row == nil {
+			return nil, ProducerMetadata{}
+		}
+		if n.draining {
+			continue
+		}
+		outRow, moreRowsOK, err := n.out.ProcessRow(n.ctx, row)
+		if err != nil {
+			n.ConsumerDone()
+			return nil, ProducerMetadata{Err: err}
+		}
+		if outRow != nil {
+			return outRow, ProducerMetadata{}
+		}
+		if !moreRowsOK {
+			log.VEventf(n.ctx, 1, "hit row limit; asking producer to drain")
+			n.ConsumerDone()
+		}
+	}
+}
+
+// ConsumerDone is part of the RowSource interface.
+func (n *noopProcessor) ConsumerDone() {
+	if !n.draining {
+		n.draining = true
+		n.input.ConsumerDone()
+	}
+}
+
+// ConsumerClosed is part of the RowSource interface.
+func (n *noopProcessor) ConsumerClosed() {
+	n.input.ConsumerClosed()
+}
+
 func newProcessor(
 	flowCtx *FlowCtx,
 	core *ProcessorCoreUnion,
@@ -439,6 +569,54 @@ func newProcessor(
 		}
 		return newHashJoiner(flowCtx, core.HashJoiner, inputs[0], inputs[1], post, outputs[0])
 	}
+	if core.InterleavedReaderJoiner != nil {
+		if err := checkNumInOut(inputs, outputs, 0, 1); err != nil {
+			return nil, err
+		}
+		return newInterleavedReaderJoiner(flowCtx, core.InterleavedReaderJoiner, post, outputs[0])
+	}
+	if core.LookupJoiner != nil {
+		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
+			return nil, err
+		}
+		return newLookupJoiner(flowCtx, core.LookupJoiner, inputs[0], post, outputs[0])
+	}
+	if core.ZigzagJoiner != nil {
+		if err := checkNumInOut(inputs, outputs, 0, 1); err != nil {
+			return nil, err
+		}
+		return newZigzagJoiner(flowCtx, core.ZigzagJoiner, post, outputs[0])
+	}
+	if core.Sampler != nil {
+		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
+			return nil, err
+		}
+		return newSampler(flowCtx, core.Sampler, inputs[0], post, outputs[0])
+	}
+	if core.SampleAggregator != nil {
+		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
+			return nil, err
+		}
+		return newSampleAggregator(flowCtx, core.SampleAggregator, inputs[0], post, outputs[0])
+	}
+	if core.IndexChecker != nil {
+		if err := checkNumInOut(inputs, outputs, 0, 1); err != nil {
+			return nil, err
+		}
+		return newIndexChecker(flowCtx, core.IndexChecker, post, outputs[0])
+	}
+	if core.ConstraintChecker != nil {
+		if err := checkNumInOut(inputs, outputs, 0, 1); err != nil {
+			return nil, err
+		}
+		return newConstraintChecker(flowCtx, core.ConstraintChecker, post, outputs[0])
+	}
+	if core.ProjectSet != nil {
+		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
+			return nil, err
+		}
+		return newProjectSetProcessor(flowCtx, core.ProjectSet, inputs[0], post, outputs[0])
+	}
 	if core.Backfiller != nil {
 		if err := checkNumInOut(inputs, outputs, 0, 1); err != nil {
 			return nil, err
@@ -465,16 +643,72 @@ func newProcessor(
 		}
 		return NewReadCSVProcessor(flowCtx, *core.ReadCSV, outputs[0])
 	}
+	if core.CSVWriter != nil {
+		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
+			return nil, err
+		}
+		if NewCSVWriterProcessor == nil {
+			return nil, errors.New("CSVWriter processor unimplemented")
+		}
+		return NewCSVWriterProcessor(flowCtx, *core.CSVWriter, inputs[0], post, outputs[0])
+	}
+	if core.CSVReader != nil {
+		if err := checkNumInOut(inputs, outputs, 0, 1); err != nil {
+			return nil, err
+		}
+		if NewCSVReaderProcessor == nil {
+			return nil, errors.New("CSVReader processor unimplemented")
+		}
+		return NewCSVReaderProcessor(flowCtx, *core.CSVReader, post, outputs[0])
+	}
+	if core.CSVConverter != nil {
+		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
+			return nil, err
+		}
+		if NewCSVConverterProcessor == nil {
+			return nil, errors.New("CSVConverter processor unimplemented")
+		}
+		return NewCSVConverterProcessor(flowCtx, *core.CSVConverter, inputs[0], post, outputs[0])
+	}
+	if core.KVWriter != nil {
+		if err := checkNumInOut(inputs, outputs, 1, 1); err != nil {
+			return nil, err
+		}
+		if NewKVWriterProcessor == nil {
+			return nil, errors.New("KVWriter processor unimplemented")
+		}
+		return NewKVWriterProcessor(flowCtx, *core.KVWriter, inputs[0], post, outputs[0])
+	}
 	return nil, errors.Errorf("unsupported processor core %s", core)
 }
 
 // NewReadCSVProcessor is externally implemented.
 var NewReadCSVProcessor func(*FlowCtx, ReadCSVSpec, RowReceiver) (Processor, error)
 
+// NewCSVWriterProcessor is externally implemented.
+var NewCSVWriterProcessor func(
+	*FlowCtx, CSVWriterSpec, RowSource, *PostProcessSpec, RowReceiver,
+) (Processor, error)
+
+// NewCSVReaderProcessor is externally implemented.
+var NewCSVReaderProcessor func(
+	*FlowCtx, CSVReaderSpec, *PostProcessSpec, RowReceiver,
+) (Processor, error)
+
+// NewCSVConverterProcessor is externally implemented.
+var NewCSVConverterProcessor func(
+	*FlowCtx, CSVConverterSpec, RowSource, *PostProcessSpec, RowReceiver,
+) (Processor, error)
+
+// NewKVWriterProcessor is externally implemented.
+var NewKVWriterProcessor func(
+	*FlowCtx, KVWriterSpec, RowSource, *PostProcessSpec, RowReceiver,
+) (Processor, error)
+
 // Equals returns true if two aggregation specifiers are identical (and thus
 // will always yield the same result).
 func (a AggregatorSpec_Aggregation) Equals(b AggregatorSpec_Aggregation) bool {
-	if a.Func != b.Func || a.Distinct != b.Distinct {
+	if a.Func != b.Func || a.Distinct != b.Distinct || a.SkipNulls != b.SkipNulls {
 		return false
 	}
 	if a.FilterColIdx == nil {
@@ -482,10 +716,13 @@ func (a AggregatorSpec_Aggregation) Equals(b AggregatorSpec_Aggregation) bool {
 			return false
 		}
 	} else {
-		if a.FilterColIdx == nil || *a.FilterColIdx != *b.FilterColIdx {
+		if b.FilterColIdx == nil || *a.FilterColIdx != *b.FilterColIdx {
 			return false
 		}
 	}
+	if a.Filter.Expr != b.Filter.Expr {
+		return false
+	}
 	if len(a.ColIdx) != len(b.ColIdx) {
 		return false
 	}
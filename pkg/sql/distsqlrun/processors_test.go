@@ -19,6 +19,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
@@ -284,3 +285,85 @@ func TestPostProcess(t *testing.T) {
 		})
 	}
 }
+
+// TestFusedNoopProcessor verifies the rows produced by a noop processor which
+// is used directly as the input of its consumer.
+func TestFusedNoopProcessor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	v := [5]sqlbase.EncDatum{}
+	for i := range v {
+		v[i] = sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(i)))
+	}
+	input := sqlbase.EncDatumRows{{v[0], v[1]}, {v[1], v[2]}, {v[2], v[3]}, {v[3], v[4]}}
+
+	testCases := []struct {
+		post     PostProcessSpec
+		expected string
+		// expDrain is set if the noop processor is expected to ask its input to
+		// drain.
+		expDrain bool
+	}{
+		{
+			post:     PostProcessSpec{},
+			expected: "[[0 1] [1 2] [2 3] [3 4]]",
+		},
+		{
+			post: PostProcessSpec{
+				Filter:        Expression{Expr: "@1 % 2 = 1"},
+				Projection:    true,
+				OutputColumns: []uint32{1},
+			},
+			expected: "[[2] [4]]",
+		},
+		{
+			post:     PostProcessSpec{Offset: 1, Limit: 2},
+			expected: "[[1 2] [2 3]]",
+			expDrain: true,
+		},
+	}
+
+	for tcIdx, tc := range testCases {
+		t.Run(strconv.Itoa(tcIdx), func(t *testing.T) {
+			inBuf := NewRowBuffer(
+				[]sqlbase.ColumnType{columnTypeInt, columnTypeInt}, input, RowBufferArgs{},
+			)
+			// A metadata record which must be passed through.
+			inBuf.Push(nil /* row */, ProducerMetadata{Err: errors.New("test")})
+
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{EvalCtx: evalCtx}
+
+			n, err := newNoopProcessor(&flowCtx, inBuf, &tc.post, nil /* output */)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.Start(context.Background())
+
+			var res sqlbase.EncDatumRows
+			var metas []ProducerMetadata
+			for {
+				row, meta := n.Next()
+				if !meta.Empty() {
+					metas = append(metas, meta)
+					continue
+				}
+				if row == nil {
+					break
+				}
+				res = append(res, row)
+			}
+			if str := res.String(); str != tc.expected {
+				t.Errorf("expected output:\n    %s\ngot:\n    %s\n", tc.expected, str)
+			}
+			if len(metas) != 1 || metas[0].Err == nil {
+				t.Errorf("expected the input's metadata to be passed through, got %v", metas)
+			}
+			if draining := inBuf.ConsumerStatus == DrainRequested; draining != tc.expDrain {
+				t.Errorf("expected the input to be asked to drain: %t, got %t", tc.expDrain, draining)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// projectSetProcessor evaluates set-returning functions and other expressions
+// for each of its input rows. See ProjectSetSpec.
+type projectSetProcessor struct {
+	processorBase
+
+	flowCtx *FlowCtx
+	input   RowSource
+	spec    *ProjectSetSpec
+
+	// exprHelpers are the expressions of the spec.
+	exprHelpers []exprHelper
+	// isGenerator is set for the expressions which are set-returning functions.
+	isGenerator []bool
+
+	// The state of the expressions for the current input row:
+	//  - gens holds the value generators of the set-returning functions; it is
+	//    nil for the other expressions.
+	//  - exprValues holds the values of the other expressions.
+	//  - done is set for the set-returning functions which are exhausted, and
+	//    for the other expressions once their value was produced.
+	gens       []parser.ValueGenerator
+	exprValues parser.Datums
+	done       []bool
+
+	// outTypes are the types of the internal columns.
+	outTypes []sqlbase.ColumnType
+	// rowBuffer holds the row being produced.
+	rowBuffer sqlbase.EncDatumRow
+}
+
+var _ Processor = &projectSetProcessor{}
+
+func newProjectSetProcessor(
+	flowCtx *FlowCtx,
+	spec *ProjectSetSpec,
+	input RowSource,
+	post *PostProcessSpec,
+	output RowReceiver,
+) (*projectSetProcessor, error) {
+	if len(spec.NumColsPerGen) != len(spec.Exprs) {
+		return nil, errors.Errorf("%d expressions but %d column counts",
+			len(spec.Exprs), len(spec.NumColsPerGen))
+	}
+	numGenCols := 0
+	for _, n := range spec.NumColsPerGen {
+		numGenCols += int(n)
+	}
+	if numGenCols != len(spec.GeneratedColumns) {
+		return nil, errors.Errorf("%d generated columns but %d column types",
+			numGenCols, len(spec.GeneratedColumns))
+	}
+
+	ps := &projectSetProcessor{
+		flowCtx:     flowCtx,
+		input:       input,
+		spec:        spec,
+		exprHelpers: make([]exprHelper, len(spec.Exprs)),
+		isGenerator: make([]bool, len(spec.Exprs)),
+		gens:        make([]parser.ValueGenerator, len(spec.Exprs)),
+		exprValues:  make(parser.Datums, len(spec.Exprs)),
+		done:        make([]bool, len(spec.Exprs)),
+	}
+	ps.outTypes = append(append([]sqlbase.ColumnType(nil), input.Types()...), spec.GeneratedColumns...)
+	ps.rowBuffer = make(sqlbase.EncDatumRow, len(ps.outTypes))
+
+	for i, expr := range spec.Exprs {
+		h := &ps.exprHelpers[i]
+		if err := h.init(expr, input.Types(), &flowCtx.EvalCtx); err != nil {
+			return nil, err
+		}
+		if h.expr == nil {
+			return nil, errors.Errorf("empty expression %d", i)
+		}
+		numCols := int(spec.NumColsPerGen[i])
+		if t, ok := h.expr.ResolvedType().(parser.TTable); ok {
+			if len(t.Cols) != numCols {
+				return nil, errors.Errorf("expression '%s' generates %d columns, expected %d",
+					h.expr, len(t.Cols), numCols)
+			}
+			ps.isGenerator[i] = true
+		} else if numCols != 1 {
+			return nil, errors.Errorf("expression '%s' generates 1 column, expected %d",
+				h.expr, numCols)
+		}
+	}
+
+	if err := ps.out.Init(post, ps.outTypes, &flowCtx.EvalCtx, output); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Run is part of the processor interface.
+func (ps *projectSetProcessor) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "ProjectSet", nil)
+	ctx, span := processorSpan(ctx, ps.flowCtx, "project set")
+	defer tracing.FinishSpan(span)
+
+	earlyExit, err := ps.mainLoop(ctx)
+	if err != nil {
+		DrainAndClose(ctx, ps.out.output, err, ps.input)
+	} else if !earlyExit {
+		sendTraceData(ctx, ps.out.output)
+		ps.input.ConsumerClosed()
+		ps.out.Close()
+	}
+}
+
+func (ps *projectSetProcessor) mainLoop(ctx context.Context) (earlyExit bool, _ error) {
+	for {
+		row, meta := ps.input.Next()
+		if !meta.Empty() {
+			if meta.Err != nil {
+				return false, meta.Err
+			}
+			if !emitHelper(ctx, &ps.out, nil /* row */, meta, ps.input) {
+				// No cleanup required; emitHelper() took care of it.
+				return true, nil
+			}
+			continue
+		}
+		if row == nil {
+			return false, nil
+		}
+		if earlyExit, err := ps.processRow(ctx, row); err != nil || earlyExit {
+			return earlyExit, err
+		}
+	}
+}
+
+// processRow evaluates the expressions for the given input row and emits the
+// rows they produce.
+func (ps *projectSetProcessor) processRow(
+	ctx context.Context, row sqlbase.EncDatumRow,
+) (earlyExit bool, _ error) {
+	defer ps.closeGenerators()
+	for i := range ps.exprHelpers {
+		ps.done[i] = false
+		datum, err := ps.exprHelpers[i].eval(row)
+		if err != nil {
+			return false, err
+		}
+		if !ps.isGenerator[i] {
+			ps.exprValues[i] = datum
+			continue
+		}
+		t, ok := datum.(*parser.DTable)
+		if !ok {
+			return false, errors.Errorf("expression '%s' returned %T, expected a table",
+				ps.exprHelpers[i].expr, datum)
+		}
+		if err := t.Start(); err != nil {
+			return false, err
+		}
+		ps.gens[i] = t.ValueGenerator
+	}
+
+	copy(ps.rowBuffer, row)
+	for {
+		ok, err := ps.nextGeneratedValues()
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+		if !emitHelper(ctx, &ps.out, ps.rowBuffer, ProducerMetadata{}, ps.input) {
+			return true, nil
+		}
+	}
+}
+
+// nextGeneratedValues fills in the generated columns of rowBuffer with the
+// next values of the expressions. It returns false once all of them are done.
+func (ps *projectSetProcessor) nextGeneratedValues() (bool, error) {
+	colIdx := len(ps.outTypes) - len(ps.spec.GeneratedColumns)
+	newValues := false
+	for i := range ps.exprHelpers {
+		numCols := int(ps.spec.NumColsPerGen[i])
+		if !ps.done[i] {
+			if !ps.isGenerator[i] {
+				ps.rowBuffer[colIdx] = sqlbase.DatumToEncDatum(ps.outTypes[colIdx], ps.exprValues[i])
+				colIdx++
+				ps.done[i] = true
+				newValues = true
+				continue
+			}
+			ok, err := ps.gens[i].Next()
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				for _, value := range ps.gens[i].Values() {
+					ps.rowBuffer[colIdx] = sqlbase.DatumToEncDatum(ps.outTypes[colIdx], value)
+					colIdx++
+				}
+				newValues = true
+				continue
+			}
+			ps.done[i] = true
+		}
+		for j := 0; j < numCols; j++ {
+			ps.rowBuffer[colIdx] = sqlbase.DatumToEncDatum(ps.outTypes[colIdx], parser.DNull)
+			colIdx++
+		}
+	}
+	return newValues, nil
+}
+
+func (ps *projectSetProcessor) closeGenerators() {
+	for i, gen := range ps.gens {
+		if gen != nil {
+			gen.Close()
+			ps.gens[i] = nil
+		}
+	}
+}
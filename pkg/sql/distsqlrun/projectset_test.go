@@ -0,0 +1,124 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestProjectSet(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	intType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	v := [11]sqlbase.EncDatum{}
+	for i := range v {
+		v[i] = sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(i)))
+	}
+
+	testCases := []struct {
+		description string
+		spec        ProjectSetSpec
+		input       sqlbase.EncDatumRows
+		expected    string
+	}{
+		{
+			description: "scalar function",
+			spec: ProjectSetSpec{
+				Exprs:            []Expression{{Expr: "@1 + 1"}},
+				GeneratedColumns: []sqlbase.ColumnType{intType},
+				NumColsPerGen:    []uint32{1},
+			},
+			input:    sqlbase.EncDatumRows{{v[2], v[3]}},
+			expected: "[[2 3 3]]",
+		},
+		{
+			description: "set-returning function with a scalar function",
+			spec: ProjectSetSpec{
+				Exprs:            []Expression{{Expr: "generate_series(1, @1)"}, {Expr: "@2 + 1"}},
+				GeneratedColumns: []sqlbase.ColumnType{intType, intType},
+				NumColsPerGen:    []uint32{1, 1},
+			},
+			input:    sqlbase.EncDatumRows{{v[2], v[10]}, {v[0], v[5]}},
+			expected: "[[2 10 1 11] [2 10 2 NULL] [0 5 NULL 6]]",
+		},
+		{
+			description: "set-returning functions of different lengths",
+			spec: ProjectSetSpec{
+				Exprs: []Expression{
+					{Expr: "unnest(ARRAY[@1, @2])"}, {Expr: "generate_series(@1, @1 + 2)"},
+				},
+				GeneratedColumns: []sqlbase.ColumnType{intType, intType},
+				NumColsPerGen:    []uint32{1, 1},
+			},
+			input:    sqlbase.EncDatumRows{{v[1], v[5]}},
+			expected: "[[1 5 1 1] [1 5 5 2] [1 5 NULL 3]]",
+		},
+		{
+			description: "empty set-returning function",
+			spec: ProjectSetSpec{
+				Exprs:            []Expression{{Expr: "generate_series(@2, @1)"}},
+				GeneratedColumns: []sqlbase.ColumnType{intType},
+				NumColsPerGen:    []uint32{1},
+			},
+			input:    sqlbase.EncDatumRows{{v[1], v[5]}, {v[6], v[5]}},
+			expected: "[[6 5 5] [6 5 6]]",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.description, func(t *testing.T) {
+			in := NewRowBuffer([]sqlbase.ColumnType{intType, intType}, c.input, RowBufferArgs{})
+			out := &RowBuffer{}
+
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				Settings: cluster.MakeTestingClusterSettings(),
+				EvalCtx:  evalCtx,
+			}
+
+			ps, err := newProjectSetProcessor(&flowCtx, &c.spec, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ps.Run(context.Background(), nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			var res sqlbase.EncDatumRows
+			for {
+				row, meta := out.Next()
+				if !meta.Empty() {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if row == nil {
+					break
+				}
+				res = append(res, row)
+			}
+			if result := res.String(); result != c.expected {
+				t.Errorf("invalid results: %s, expected %s", result, c.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"sync/atomic"
+
+	"github.com/cockroachdb/cockroach/pkg/util/bloom"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// runtimeFilterBitsPerRow is the number of bits per row of the run-time
+// filters built by hash joiners, for a false positive rate of about 1%.
+const runtimeFilterBitsPerRow = 10
+
+// runtimeFilterMaxRows is the maximum number of stored rows from which a hash
+// joiner builds a run-time filter. Past this, the filter would be large and
+// the join is unlikely to be selective.
+const runtimeFilterMaxRows = 1 << 20
+
+// runtimeFilters is the side-channel through which a hash joiner shares the
+// run-time filter it builds with the table readers of its flow (see
+// RuntimeFilterSpec). The hash joiner and the table readers look up the same
+// runtimeFilter by ID, in any order.
+type runtimeFilters struct {
+	mu struct {
+		syncutil.Mutex
+		filters map[uint32]*runtimeFilter
+	}
+}
+
+// get returns the runtimeFilter with the given ID, creating it if needed.
+func (r *runtimeFilters) get(id uint32) *runtimeFilter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.mu.filters[id]
+	if !ok {
+		if r.mu.filters == nil {
+			r.mu.filters = make(map[uint32]*runtimeFilter)
+		}
+		f = &runtimeFilter{}
+		r.mu.filters[id] = f
+	}
+	return f
+}
+
+// runtimeFilter holds a run-time filter once it is published.
+type runtimeFilter struct {
+	// filter is accessed atomically; it allows checking for the filter for
+	// each row without locking.
+	filter atomic.Value
+}
+
+// publish makes the given filter available. It must be called at most once,
+// and the filter must not be modified afterwards.
+func (f *runtimeFilter) publish(filter *bloom.Filter) {
+	f.filter.Store(filter)
+}
+
+// load returns the filter if it was published, and nil otherwise.
+func (f *runtimeFilter) load() *bloom.Filter {
+	filter, _ := f.filter.Load().(*bloom.Filter)
+	return filter
+}
@@ -0,0 +1,288 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// sampleAggregatorOutputTypes are the types of the rows produced by the sample
+// aggregator (see SampleAggregatorSpec).
+var sampleAggregatorOutputTypes = []sqlbase.ColumnType{
+	{SemanticType: sqlbase.ColumnType_INT},   // sketch_idx
+	{SemanticType: sqlbase.ColumnType_INT},   // row_count
+	{SemanticType: sqlbase.ColumnType_INT},   // distinct_count
+	{SemanticType: sqlbase.ColumnType_INT},   // null_count
+	{SemanticType: sqlbase.ColumnType_BYTES}, // histogram
+}
+
+// sampleAggregator combines the samples and sketches of multiple samplers and
+// computes the statistics of each sketch. See SampleAggregatorSpec.
+type sampleAggregator struct {
+	processorBase
+
+	flowCtx  *FlowCtx
+	input    RowSource
+	inTypes  []sqlbase.ColumnType
+	sr       sampleReservoir
+	sketches []sketchInfo
+
+	// The indices of the columns added by the samplers.
+	rankCol, sketchIdxCol, numRowsCol, numNullsCol, sketchCol int
+
+	datumAlloc sqlbase.DatumAlloc
+}
+
+var _ Processor = &sampleAggregator{}
+
+func newSampleAggregator(
+	flowCtx *FlowCtx,
+	spec *SampleAggregatorSpec,
+	input RowSource,
+	post *PostProcessSpec,
+	output RowReceiver,
+) (*sampleAggregator, error) {
+	inTypes := input.Types()
+	numSampledCols := len(inTypes) - len(samplerOutputTypes)
+	if numSampledCols < 0 {
+		return nil, errors.Errorf("sampleAggregator input has too few columns")
+	}
+	for i, t := range samplerOutputTypes {
+		if inTypes[numSampledCols+i].SemanticType != t.SemanticType {
+			return nil, errors.Errorf(
+				"sampleAggregator input column %d has type %s, expected %s",
+				numSampledCols+i, inTypes[numSampledCols+i].SemanticType, t.SemanticType,
+			)
+		}
+	}
+	for _, sketchSpec := range spec.Sketches {
+		if len(sketchSpec.Columns) == 0 {
+			return nil, errors.Errorf("sketch with no columns")
+		}
+		for _, c := range sketchSpec.Columns {
+			if int(c) >= numSampledCols {
+				return nil, errors.Errorf("invalid sketch column %d", c)
+			}
+		}
+		if sketchSpec.GenerateHistogram && sketchSpec.HistogramMaxBuckets == 0 {
+			return nil, errors.Errorf("histogram with no buckets")
+		}
+	}
+
+	s := &sampleAggregator{
+		flowCtx:      flowCtx,
+		input:        input,
+		inTypes:      inTypes,
+		sketches:     make([]sketchInfo, len(spec.Sketches)),
+		rankCol:      numSampledCols,
+		sketchIdxCol: numSampledCols + 1,
+		numRowsCol:   numSampledCols + 2,
+		numNullsCol:  numSampledCols + 3,
+		sketchCol:    numSampledCols + 4,
+	}
+	s.sr.init(int(spec.SampleSize))
+	for i := range spec.Sketches {
+		s.sketches[i].spec = spec.Sketches[i]
+	}
+
+	if err := s.out.Init(post, sampleAggregatorOutputTypes, &flowCtx.EvalCtx, output); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run is part of the processor interface.
+func (s *sampleAggregator) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "SampleAggregator", nil)
+	ctx, span := processorSpan(ctx, s.flowCtx, "sample aggregator")
+	defer tracing.FinishSpan(span)
+
+	earlyExit, err := s.mainLoop(ctx)
+	if err != nil {
+		DrainAndClose(ctx, s.out.output, err, s.input)
+	} else if !earlyExit {
+		sendTraceData(ctx, s.out.output)
+		s.input.ConsumerClosed()
+		s.out.Close()
+	}
+}
+
+func (s *sampleAggregator) mainLoop(ctx context.Context) (earlyExit bool, _ error) {
+	for {
+		row, meta := s.input.Next()
+		if !meta.Empty() {
+			if meta.Err != nil {
+				return false, meta.Err
+			}
+			if !emitHelper(ctx, &s.out, nil /* row */, meta, s.input) {
+				// No cleanup required; emitHelper() took care of it.
+				return true, nil
+			}
+			continue
+		}
+		if row == nil {
+			break
+		}
+
+		if err := row[s.rankCol].EnsureDecoded(&s.datumAlloc); err != nil {
+			return false, err
+		}
+		if rank := row[s.rankCol].Datum; rank != parser.DNull {
+			// This is a sampled row.
+			s.sr.sampleRow(row[:s.rankCol], int64(*rank.(*parser.DInt)))
+			continue
+		}
+		// This is a sketch row.
+		if err := s.mergeSketch(row); err != nil {
+			return false, err
+		}
+	}
+
+	outRow := make(sqlbase.EncDatumRow, len(sampleAggregatorOutputTypes))
+	for i := range s.sketches {
+		si := &s.sketches[i]
+		distinctCount := int64(si.sketch.Estimate())
+		if si.numNulls > 0 {
+			// NULL counts as a distinct value.
+			distinctCount++
+		}
+		if distinctCount > si.numRows {
+			distinctCount = si.numRows
+		}
+		histogram := parser.DNull
+		if si.spec.GenerateHistogram {
+			h, err := s.generateHistogram(si)
+			if err != nil {
+				return false, err
+			}
+			encoded, err := protoutil.Marshal(&h)
+			if err != nil {
+				return false, err
+			}
+			histogram = parser.NewDBytes(parser.DBytes(encoded))
+		}
+
+		for j, d := range []parser.Datum{
+			parser.NewDInt(parser.DInt(i)),
+			parser.NewDInt(parser.DInt(si.numRows)),
+			parser.NewDInt(parser.DInt(distinctCount)),
+			parser.NewDInt(parser.DInt(si.numNulls)),
+			histogram,
+		} {
+			outRow[j] = sqlbase.DatumToEncDatum(sampleAggregatorOutputTypes[j], d)
+		}
+		if !emitHelper(ctx, &s.out, outRow, ProducerMetadata{}, s.input) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mergeSketch merges the counts and the sketch of a sketch row produced by a
+// sampler into the corresponding sketch.
+func (s *sampleAggregator) mergeSketch(row sqlbase.EncDatumRow) error {
+	for _, c := range []int{s.sketchIdxCol, s.numRowsCol, s.numNullsCol, s.sketchCol} {
+		if err := row[c].EnsureDecoded(&s.datumAlloc); err != nil {
+			return err
+		}
+		if row[c].Datum == parser.DNull {
+			return errors.Errorf("NULL value in sketch row %s", row)
+		}
+	}
+	sketchIdx := int(*row[s.sketchIdxCol].Datum.(*parser.DInt))
+	if sketchIdx < 0 || sketchIdx >= len(s.sketches) {
+		return errors.Errorf("invalid sketch index %d", sketchIdx)
+	}
+	si := &s.sketches[sketchIdx]
+	si.numRows += int64(*row[s.numRowsCol].Datum.(*parser.DInt))
+	si.numNulls += int64(*row[s.numNullsCol].Datum.(*parser.DInt))
+	return si.sketch.Decode([]byte(*row[s.sketchCol].Datum.(*parser.DBytes)))
+}
+
+// generateHistogram builds an equi-depth histogram of the values of the first
+// column of the sketch from the sample. The number of rows in each bucket is
+// scaled from the sample to the number of rows seen.
+func (s *sampleAggregator) generateHistogram(si *sketchInfo) (HistogramData, error) {
+	var h HistogramData
+	if len(s.sr.samples) == 0 {
+		return h, nil
+	}
+	evalCtx := &s.flowCtx.EvalCtx
+	colIdx := si.spec.Columns[0]
+
+	values := make(parser.Datums, 0, len(s.sr.samples))
+	for _, sample := range s.sr.samples {
+		ed := &sample.row[colIdx]
+		if err := ed.EnsureDecoded(&s.datumAlloc); err != nil {
+			return h, err
+		}
+		if ed.Datum != parser.DNull {
+			values = append(values, ed.Datum)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Compare(evalCtx, values[j]) < 0
+	})
+
+	// Each sampled row stands for rowsPerSample rows.
+	rowsPerSample := float64(si.numRows) / float64(len(s.sr.samples))
+	numBuckets := int(si.spec.HistogramMaxBuckets)
+	if numBuckets > len(values) {
+		numBuckets = len(values)
+	}
+	for b, start := 0, 0; b < numBuckets && start < len(values); b++ {
+		end := (b+1)*len(values)/numBuckets - 1
+		if end < start {
+			end = start
+		}
+		upper := values[end]
+		// All the values equal to the upper bound belong to the bucket.
+		for end+1 < len(values) && values[end+1].Compare(evalCtx, upper) == 0 {
+			end++
+		}
+		numEq := 0
+		for i := end; i >= start && values[i].Compare(evalCtx, upper) == 0; i-- {
+			numEq++
+		}
+		numRange := end - start + 1 - numEq
+
+		encoded, err := sqlbase.EncodeTableKey(nil, upper, encoding.Ascending)
+		if err != nil {
+			return h, err
+		}
+		h.Buckets = append(h.Buckets, HistogramData_Bucket{
+			NumEq:      int64(float64(numEq)*rowsPerSample + 0.5),
+			NumRange:   int64(float64(numRange)*rowsPerSample + 0.5),
+			UpperBound: encoded,
+		})
+		start = end + 1
+	}
+	return h, nil
+}
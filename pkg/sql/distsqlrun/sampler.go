@@ -0,0 +1,284 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hyperloglog"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// sampledRow is a row of a sample, along with its rank.
+type sampledRow struct {
+	row  sqlbase.EncDatumRow
+	rank int64
+}
+
+// sampleReservoir holds the sampled rows with the smallest ranks seen. The rows
+// are kept in a max-heap ordered by rank, so the row with the largest rank can
+// be replaced when a row with a smaller rank is seen.
+type sampleReservoir struct {
+	samples  []sampledRow
+	size     int
+	rowAlloc sqlbase.EncDatumRowAlloc
+}
+
+var _ heap.Interface = &sampleReservoir{}
+
+func (sr *sampleReservoir) init(size int) {
+	sr.samples = make([]sampledRow, 0, size)
+	sr.size = size
+}
+
+// Len is part of heap.Interface and is only meant to be used internally.
+func (sr *sampleReservoir) Len() int {
+	return len(sr.samples)
+}
+
+// Less is part of heap.Interface and is only meant to be used internally.
+func (sr *sampleReservoir) Less(i, j int) bool {
+	// We want a max-heap.
+	return sr.samples[i].rank > sr.samples[j].rank
+}
+
+// Swap is part of heap.Interface and is only meant to be used internally.
+func (sr *sampleReservoir) Swap(i, j int) {
+	sr.samples[i], sr.samples[j] = sr.samples[j], sr.samples[i]
+}
+
+// Push is part of heap.Interface; it's not used as rows are added with
+// sampleRow.
+func (sr *sampleReservoir) Push(x interface{}) { panic("unimplemented") }
+
+// Pop is part of heap.Interface; it's not used as rows are never removed.
+func (sr *sampleReservoir) Pop() interface{} { panic("unimplemented") }
+
+// sampleRow adds the row to the sample if its rank is among the smallest ranks
+// seen. The row is copied.
+func (sr *sampleReservoir) sampleRow(row sqlbase.EncDatumRow, rank int64) {
+	if len(sr.samples) < sr.size {
+		sr.samples = append(sr.samples, sampledRow{row: sr.rowAlloc.CopyRow(row), rank: rank})
+		if len(sr.samples) == sr.size {
+			heap.Init(sr)
+		}
+		return
+	}
+	if sr.size > 0 && rank < sr.samples[0].rank {
+		copy(sr.samples[0].row, row)
+		sr.samples[0].rank = rank
+		heap.Fix(sr, 0)
+	}
+}
+
+// sketchInfo holds the state of a sketch of a sampler or a sample aggregator.
+type sketchInfo struct {
+	spec     SketchSpec
+	sketch   hyperloglog.Sketch
+	numRows  int64
+	numNulls int64
+}
+
+// samplerOutputTypes are the types of the columns which the sampler adds to
+// its input columns (see SamplerSpec).
+var samplerOutputTypes = []sqlbase.ColumnType{
+	{SemanticType: sqlbase.ColumnType_INT},   // rank
+	{SemanticType: sqlbase.ColumnType_INT},   // sketch_idx
+	{SemanticType: sqlbase.ColumnType_INT},   // num_rows
+	{SemanticType: sqlbase.ColumnType_INT},   // null_vals
+	{SemanticType: sqlbase.ColumnType_BYTES}, // sketch
+}
+
+// sampler collects a random sample of its input rows and builds sketches of
+// the distinct values of sets of columns. See SamplerSpec.
+type sampler struct {
+	processorBase
+
+	flowCtx  *FlowCtx
+	input    RowSource
+	sr       sampleReservoir
+	sketches []sketchInfo
+	rng      *rand.Rand
+
+	// outTypes are the types of the rows produced by the sampler.
+	outTypes []sqlbase.ColumnType
+	// The indices of the columns added by the sampler.
+	rankCol, sketchIdxCol, numRowsCol, numNullsCol, sketchCol int
+
+	datumAlloc sqlbase.DatumAlloc
+}
+
+var _ Processor = &sampler{}
+
+func newSampler(
+	flowCtx *FlowCtx, spec *SamplerSpec, input RowSource, post *PostProcessSpec, output RowReceiver,
+) (*sampler, error) {
+	inTypes := input.Types()
+	for _, sketchSpec := range spec.Sketches {
+		if len(sketchSpec.Columns) == 0 {
+			return nil, errors.Errorf("sketch with no columns")
+		}
+		for _, c := range sketchSpec.Columns {
+			if int(c) >= len(inTypes) {
+				return nil, errors.Errorf("invalid sketch column %d", c)
+			}
+		}
+	}
+
+	s := &sampler{
+		flowCtx:  flowCtx,
+		input:    input,
+		sketches: make([]sketchInfo, len(spec.Sketches)),
+		rng:      rand.New(rand.NewSource(rand.Int63())),
+	}
+	s.sr.init(int(spec.SampleSize))
+	for i := range spec.Sketches {
+		s.sketches[i].spec = spec.Sketches[i]
+	}
+
+	s.outTypes = append(append([]sqlbase.ColumnType(nil), inTypes...), samplerOutputTypes...)
+	s.rankCol = len(inTypes)
+	s.sketchIdxCol = len(inTypes) + 1
+	s.numRowsCol = len(inTypes) + 2
+	s.numNullsCol = len(inTypes) + 3
+	s.sketchCol = len(inTypes) + 4
+
+	if err := s.out.Init(post, s.outTypes, &flowCtx.EvalCtx, output); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run is part of the processor interface.
+func (s *sampler) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTag(ctx, "Sampler", nil)
+	ctx, span := processorSpan(ctx, s.flowCtx, "sampler")
+	defer tracing.FinishSpan(span)
+
+	earlyExit, err := s.mainLoop(ctx)
+	if err != nil {
+		DrainAndClose(ctx, s.out.output, err, s.input)
+	} else if !earlyExit {
+		sendTraceData(ctx, s.out.output)
+		s.input.ConsumerClosed()
+		s.out.Close()
+	}
+}
+
+func (s *sampler) mainLoop(ctx context.Context) (earlyExit bool, _ error) {
+	var buf []byte
+	for {
+		row, meta := s.input.Next()
+		if !meta.Empty() {
+			if meta.Err != nil {
+				return false, meta.Err
+			}
+			if !emitHelper(ctx, &s.out, nil /* row */, meta, s.input) {
+				// No cleanup required; emitHelper() took care of it.
+				return true, nil
+			}
+			continue
+		}
+		if row == nil {
+			break
+		}
+
+		for i := range s.sketches {
+			var err error
+			buf, err = s.addToSketch(&s.sketches[i], row, buf[:0])
+			if err != nil {
+				return false, err
+			}
+		}
+		s.sr.sampleRow(row, s.rng.Int63())
+	}
+
+	outRow := make(sqlbase.EncDatumRow, len(s.outTypes))
+	for i := range outRow {
+		outRow[i] = sqlbase.DatumToEncDatum(s.outTypes[i], parser.DNull)
+	}
+	// Emit the sampled rows.
+	for _, sample := range s.sr.samples {
+		copy(outRow, sample.row)
+		outRow[s.rankCol] = sqlbase.DatumToEncDatum(
+			s.outTypes[s.rankCol], parser.NewDInt(parser.DInt(sample.rank)),
+		)
+		if !emitHelper(ctx, &s.out, outRow, ProducerMetadata{}, s.input) {
+			return true, nil
+		}
+	}
+
+	// Emit the sketch rows.
+	for i := range outRow {
+		outRow[i] = sqlbase.DatumToEncDatum(s.outTypes[i], parser.DNull)
+	}
+	for i := range s.sketches {
+		si := &s.sketches[i]
+		outRow[s.sketchIdxCol] = sqlbase.DatumToEncDatum(
+			s.outTypes[s.sketchIdxCol], parser.NewDInt(parser.DInt(i)),
+		)
+		outRow[s.numRowsCol] = sqlbase.DatumToEncDatum(
+			s.outTypes[s.numRowsCol], parser.NewDInt(parser.DInt(si.numRows)),
+		)
+		outRow[s.numNullsCol] = sqlbase.DatumToEncDatum(
+			s.outTypes[s.numNullsCol], parser.NewDInt(parser.DInt(si.numNulls)),
+		)
+		outRow[s.sketchCol] = sqlbase.DatumToEncDatum(
+			s.outTypes[s.sketchCol], parser.NewDBytes(parser.DBytes(si.sketch.Encode(nil))),
+		)
+		if !emitHelper(ctx, &s.out, outRow, ProducerMetadata{}, s.input) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// addToSketch adds the values of the columns of the sketch in the row to the
+// sketch. Rows with a NULL value in any of the columns are counted but not
+// inserted. buf is used as scratch space and returned for reuse.
+func (s *sampler) addToSketch(
+	si *sketchInfo, row sqlbase.EncDatumRow, buf []byte,
+) ([]byte, error) {
+	si.numRows++
+	for _, c := range si.spec.Columns {
+		if row[c].IsNull() {
+			si.numNulls++
+			return buf, nil
+		}
+	}
+	for _, c := range si.spec.Columns {
+		// We use the key encoding, which is the same for values which are
+		// equal.
+		var err error
+		buf, err = row[c].Encode(&s.datumAlloc, sqlbase.DatumEncoding_ASCENDING_KEY, buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	si.sketch.Insert(buf)
+	return buf, nil
+}
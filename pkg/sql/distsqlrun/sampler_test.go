@@ -0,0 +1,192 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// runSampler runs a sampler over the given rows and returns its output rows.
+func runSampler(
+	t *testing.T,
+	flowCtx *FlowCtx,
+	spec *SamplerSpec,
+	types []sqlbase.ColumnType,
+	rows sqlbase.EncDatumRows,
+) sqlbase.EncDatumRows {
+	in := NewRowBuffer(types, rows, RowBufferArgs{})
+	out := &RowBuffer{}
+	s, err := newSampler(flowCtx, spec, in, &PostProcessSpec{}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Run(context.Background(), nil)
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	var res sqlbase.EncDatumRows
+	for {
+		row, meta := out.Next()
+		if !meta.Empty() {
+			t.Fatalf("unexpected metadata: %v", meta)
+		}
+		if row == nil {
+			return res
+		}
+		res = append(res, row)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+	}
+
+	// The rows are (i % 100, i % 7), where the second column is NULL when i is
+	// a multiple of 10.
+	const numRows = 1000
+	intType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{intType, intType}
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		var w parser.Datum = parser.NewDInt(parser.DInt(i % 7))
+		if i%10 == 0 {
+			w = parser.DNull
+		}
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(i%100))),
+			sqlbase.DatumToEncDatum(intType, w),
+		}
+	}
+	sketches := []SketchSpec{
+		{Columns: []uint32{0}, GenerateHistogram: true, HistogramMaxBuckets: 4},
+		{Columns: []uint32{1}},
+		{Columns: []uint32{0, 1}},
+	}
+
+	for _, sampleSize := range []int{10, numRows} {
+		t.Run(fmt.Sprintf("SampleSize=%d", sampleSize), func(t *testing.T) {
+			// Run two samplers over the two halves of the rows.
+			spec := SamplerSpec{Sketches: sketches, SampleSize: uint32(sampleSize)}
+			var samplerOut sqlbase.EncDatumRows
+			for _, half := range []sqlbase.EncDatumRows{rows[:numRows/2], rows[numRows/2:]} {
+				res := runSampler(t, &flowCtx, &spec, types, half)
+				numSamples := sampleSize
+				if numSamples > len(half) {
+					numSamples = len(half)
+				}
+				if len(res) != numSamples+len(sketches) {
+					t.Fatalf("expected %d samples and %d sketches, got %d rows",
+						numSamples, len(sketches), len(res))
+				}
+				samplerOut = append(samplerOut, res...)
+			}
+
+			aggTypes := append(append([]sqlbase.ColumnType(nil), types...), samplerOutputTypes...)
+			in := NewRowBuffer(aggTypes, samplerOut, RowBufferArgs{})
+			out := &RowBuffer{}
+			aggSpec := SampleAggregatorSpec{Sketches: sketches, SampleSize: uint32(sampleSize)}
+			agg, err := newSampleAggregator(&flowCtx, &aggSpec, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			agg.Run(context.Background(), nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+			if n := len(agg.sr.samples); n != sampleSize {
+				t.Fatalf("expected %d sampled rows, got %d", sampleSize, n)
+			}
+
+			// The expected sketch_idx, row_count, distinct_count and null_count
+			// of each sketch. The distinct counts are estimates, which are
+			// allowed to be off by a few percent.
+			expected := [][4]int64{
+				{0, numRows, 100, 0},
+				{1, numRows, 8, 100},
+				{2, numRows, 631, 100},
+			}
+			var a sqlbase.DatumAlloc
+			for i := range expected {
+				row, meta := out.Next()
+				if !meta.Empty() {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if row == nil {
+					t.Fatalf("expected %d rows, got %d", len(expected), i)
+				}
+				for j, exp := range expected[i] {
+					if err := row[j].EnsureDecoded(&a); err != nil {
+						t.Fatal(err)
+					}
+					v := int64(*row[j].Datum.(*parser.DInt))
+					tolerance := int64(0)
+					if j == 2 {
+						tolerance = exp/20 + 1
+					}
+					if v < exp-tolerance || v > exp+tolerance {
+						t.Errorf("sketch %d: expected column %d to be %d, got %d", i, j, exp, v)
+					}
+				}
+
+				if err := row[4].EnsureDecoded(&a); err != nil {
+					t.Fatal(err)
+				}
+				if !sketches[i].GenerateHistogram {
+					if row[4].Datum != parser.DNull {
+						t.Errorf("sketch %d: unexpected histogram", i)
+					}
+					continue
+				}
+				var h HistogramData
+				if err := h.Unmarshal([]byte(*row[4].Datum.(*parser.DBytes))); err != nil {
+					t.Fatal(err)
+				}
+				if len(h.Buckets) == 0 || len(h.Buckets) > int(sketches[i].HistogramMaxBuckets) {
+					t.Fatalf("invalid number of buckets: %d", len(h.Buckets))
+				}
+				// With a sample of all the rows, the histogram is exact.
+				if sampleSize == numRows {
+					total := int64(0)
+					for _, b := range h.Buckets {
+						if b.NumEq != numRows/100 {
+							t.Errorf("expected %d rows equal to the upper bound, got %d", numRows/100, b.NumEq)
+						}
+						total += b.NumEq + b.NumRange
+					}
+					if total != numRows {
+						t.Errorf("expected %d rows in the histogram, got %d", numRows, total)
+					}
+				}
+			}
+			if row, _ := out.Next(); row != nil {
+				t.Fatalf("unexpected row %s", row)
+			}
+		})
+	}
+}
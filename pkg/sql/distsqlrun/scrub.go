@@ -0,0 +1,133 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+)
+
+// ScrubColumnTypes are the types of the rows produced by the processors which
+// check the consistency of a table (IndexChecker and ConstraintChecker). Each
+// row describes a discrepancy, with:
+//  - the type of the error, one of the ScrubError* constants;
+//  - the primary key of the row concerned, formatted as a tuple;
+//  - details about the error.
+var ScrubColumnTypes = []sqlbase.ColumnType{
+	{SemanticType: sqlbase.ColumnType_STRING},
+	{SemanticType: sqlbase.ColumnType_STRING},
+	{SemanticType: sqlbase.ColumnType_STRING},
+}
+
+// The types of errors found by the consistency checks.
+const (
+	// ScrubErrorMissingIndexEntry is used for a row of the primary index without
+	// an entry in a secondary index.
+	ScrubErrorMissingIndexEntry = "missing_index_entry"
+	// ScrubErrorIndexValueMismatch is used for an entry of a secondary index
+	// whose value doesn't match the row of the primary index.
+	ScrubErrorIndexValueMismatch = "index_value_mismatch"
+	// ScrubErrorDanglingIndexReference is used for an entry of a secondary
+	// index which doesn't correspond to a row of the primary index.
+	ScrubErrorDanglingIndexReference = "dangling_index_reference"
+	// ScrubErrorCheckConstraintViolation is used for a row which doesn't satisfy
+	// a CHECK constraint.
+	ScrubErrorCheckConstraintViolation = "check_constraint_violation"
+	// ScrubErrorNotNullViolation is used for a row with a NULL value in a NOT
+	// NULL column.
+	ScrubErrorNotNullViolation = "not_null_violation"
+)
+
+// scrubFetcher reads all the columns of a table which are available in one of
+// its indexes. Unlike the RowFetchers of the other processors, it returns NULL
+// for a missing value of a NOT NULL column instead of panicking, since the
+// data being checked might be inconsistent.
+type scrubFetcher struct {
+	sqlbase.RowFetcher
+
+	desc *sqlbase.TableDescriptor
+	// colIdxMap maps the ColumnIDs of the table to indexes in the rows.
+	colIdxMap map[sqlbase.ColumnID]int
+	// valNeededForCol is set for the columns available in the index; the other
+	// columns are NULL.
+	valNeededForCol []bool
+
+	alloc  sqlbase.DatumAlloc
+	datums parser.Datums
+}
+
+// init sets up the fetcher for the given index: 0 for the primary index, or 1
+// to <num-indexes> for a secondary index.
+func (f *scrubFetcher) init(desc *sqlbase.TableDescriptor, indexIdx int) error {
+	if indexIdx < 0 || indexIdx > len(desc.Indexes) {
+		return errors.Errorf("invalid indexIdx %d", indexIdx)
+	}
+	index := &desc.PrimaryIndex
+	if indexIdx > 0 {
+		index = &desc.Indexes[indexIdx-1]
+	}
+
+	f.desc = desc
+	cols := make([]sqlbase.ColumnDescriptor, len(desc.Columns))
+	f.colIdxMap = make(map[sqlbase.ColumnID]int, len(desc.Columns))
+	f.valNeededForCol = make([]bool, len(desc.Columns))
+	for i := range desc.Columns {
+		cols[i] = desc.Columns[i]
+		cols[i].Nullable = true
+		f.colIdxMap[cols[i].ID] = i
+		f.valNeededForCol[i] = indexIdx == 0 || index.ContainsColumnID(cols[i].ID)
+	}
+	f.datums = make(parser.Datums, len(cols))
+	return f.RowFetcher.Init(
+		desc, f.colIdxMap, index, false /* reverse */, indexIdx > 0, /* isSecondaryIndex */
+		cols, f.valNeededForCol, false /* returnRangeInfo */, &f.alloc,
+	)
+}
+
+// decode decodes a row returned by the fetcher. The returned datums are only
+// valid until the next call.
+func (f *scrubFetcher) decode(row sqlbase.EncDatumRow) (parser.Datums, error) {
+	for i := range row {
+		if !f.valNeededForCol[i] {
+			f.datums[i] = parser.DNull
+			continue
+		}
+		if err := row[i].EnsureDecoded(&f.alloc); err != nil {
+			return nil, err
+		}
+		f.datums[i] = row[i].Datum
+	}
+	return f.datums, nil
+}
+
+// primaryKey formats the primary key of the given row as a tuple.
+func (f *scrubFetcher) primaryKey(datums parser.Datums) string {
+	pk := &parser.DTuple{D: make(parser.Datums, len(f.desc.PrimaryIndex.ColumnIDs))}
+	for i, id := range f.desc.PrimaryIndex.ColumnIDs {
+		pk.D[i] = datums[f.colIdxMap[id]]
+	}
+	return pk.String()
+}
+
+// makeScrubRow returns a row describing a discrepancy (see ScrubColumnTypes).
+func makeScrubRow(errorType string, primaryKey string, details string) sqlbase.EncDatumRow {
+	return sqlbase.EncDatumRow{
+		sqlbase.DatumToEncDatum(ScrubColumnTypes[0], parser.NewDString(errorType)),
+		sqlbase.DatumToEncDatum(ScrubColumnTypes[1], parser.NewDString(primaryKey)),
+		sqlbase.DatumToEncDatum(ScrubColumnTypes[2], parser.NewDString(details)),
+	}
+}
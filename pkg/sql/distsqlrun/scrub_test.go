@@ -0,0 +1,170 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestScrubProcessors(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	// Rows (k, k, k) for k in 1..10, except that w is NULL when k is a multiple
+	// of 5.
+	wFn := func(row int) parser.Datum {
+		if row%5 == 0 {
+			return parser.DNull
+		}
+		return parser.NewDInt(parser.DInt(row))
+	}
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"k INT PRIMARY KEY, v INT, w INT, INDEX vi (v)",
+		10,
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, sqlutils.RowIdxFn, wFn))
+
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+	ctx := context.Background()
+
+	// Corrupt the table: remove the index entry of row 3, and row 7 itself.
+	colIdxMap := map[sqlbase.ColumnID]int{
+		td.Columns[0].ID: 0, td.Columns[1].ID: 1, td.Columns[2].ID: 2,
+	}
+	entry, err := sqlbase.EncodeSecondaryIndex(
+		td, &td.Indexes[0], colIdxMap, parser.Datums{
+			parser.NewDInt(3), parser.NewDInt(3), parser.NewDInt(3),
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kvDB.Del(ctx, entry.Key); err != nil {
+		t.Fatal(err)
+	}
+	pkPrefix := sqlbase.MakeIndexKeyPrefix(td, td.PrimaryIndex.ID)
+	pk, _, err := sqlbase.EncodeIndexKey(
+		td, &td.PrimaryIndex, colIdxMap, parser.Datums{parser.NewDInt(7)}, pkPrefix,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kvDB.DelRange(ctx, pk, roachpb.Key(pk).PrefixEnd()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the constraints against a descriptor with a stricter schema.
+	strict := *td
+	strict.Columns = append([]sqlbase.ColumnDescriptor(nil), td.Columns...)
+	strict.Columns[2].Nullable = false
+	strict.Checks = []*sqlbase.TableDescriptor_CheckConstraint{
+		{Name: "v_small", Expr: "v < 9", Validity: sqlbase.ConstraintValidity_Validated},
+		{Name: "v_unvalidated", Expr: "v < 2", Validity: sqlbase.ConstraintValidity_Unvalidated},
+	}
+
+	testCases := []struct {
+		name     string
+		core     ProcessorCoreUnion
+		expected string
+	}{
+		{
+			name: "missing entries",
+			core: ProcessorCoreUnion{IndexChecker: &IndexCheckerSpec{
+				Table:    *td,
+				IndexIdx: 1,
+				Check:    IndexCheckerSpec_MISSING_ENTRIES,
+				Spans:    []TableReaderSpan{{Span: td.PrimaryIndexSpan()}},
+			}},
+			expected: "[['missing_index_entry' '(3)']]",
+		},
+		{
+			name: "dangling entries",
+			core: ProcessorCoreUnion{IndexChecker: &IndexCheckerSpec{
+				Table:    *td,
+				IndexIdx: 1,
+				Check:    IndexCheckerSpec_DANGLING_ENTRIES,
+				Spans:    []TableReaderSpan{{Span: td.IndexSpan(td.Indexes[0].ID)}},
+			}},
+			expected: "[['dangling_index_reference' '(7)']]",
+		},
+		{
+			name: "constraints",
+			core: ProcessorCoreUnion{ConstraintChecker: &ConstraintCheckerSpec{
+				Table: strict,
+				Spans: []TableReaderSpan{{Span: td.PrimaryIndexSpan()}},
+			}},
+			expected: "[['not_null_violation' '(5)'] ['check_constraint_violation' '(9)'] " +
+				"['not_null_violation' '(10)'] ['check_constraint_violation' '(10)']]",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: s.ClusterSettings(),
+				// Pass a DB without a TxnCoordSender.
+				txn:    client.NewTxn(client.NewDB(s.DistSender(), s.Clock())),
+				nodeID: s.NodeID(),
+			}
+			// Only output the error types and primary keys.
+			post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0, 1}}
+
+			out := &RowBuffer{}
+			var proc Processor
+			if c.core.IndexChecker != nil {
+				proc, err = newIndexChecker(&flowCtx, c.core.IndexChecker, &post, out)
+			} else {
+				proc, err = newConstraintChecker(&flowCtx, c.core.ConstraintChecker, &post, out)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			proc.Run(context.Background(), nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			var res sqlbase.EncDatumRows
+			for {
+				row, meta := out.Next()
+				if !meta.Empty() {
+					t.Fatalf("unexpected metadata: %+v", meta)
+				}
+				if row == nil {
+					break
+				}
+				res = append(res, row)
+			}
+			if result := res.String(); result != c.expected {
+				t.Errorf("invalid results: %s, expected %s", result, c.expected)
+			}
+		})
+	}
+}
@@ -16,6 +16,8 @@ package distsqlrun
 
 import (
 	"io"
+	"math"
+	"sync/atomic"
 	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
@@ -23,6 +25,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/gossip"
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/rpc"
@@ -30,8 +33,10 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/jobs"
 	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/admission"
 	"github.com/cockroachdb/cockroach/pkg/util/envutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
@@ -44,9 +49,11 @@ import (
 // This version is separate from the main CockroachDB version numbering; it is
 // only changed when the distsqlrun API changes.
 //
-// The planner populates the version in SetupFlowRequest.
-// A server only accepts requests with versions in the range MinAcceptedVersion
-// to Version.
+// The planner populates the version in SetupFlowRequest (and in the
+// ProcessorSpecs). A server only accepts requests with versions in the range
+// MinAcceptedVersion to Version; it gossips this range (see
+// DistSQLVersionGossipInfo) and the planners don't plan flows on nodes that
+// wouldn't accept them.
 //
 // Is is possible used to provide a "window" of compatibility when new features are
 // added. Example:
@@ -62,15 +69,27 @@ import (
 //  - at some later point, we can choose to deprecate version 1 and have
 //    servers only accept versions >= 2 (by setting
 //    MinAcceptedVersion to 2).
-const Version = 4
+//
+// Version 5 added the compression of the streams between nodes, which is only
+// used by the planner if enabled (sql.distsql.stream_compression.enabled).
+//
+// Version 6 added the spans read by the leaf txns to the leaf txn state sent
+// back to the gateway (see LeafTxnReadsVersion).
+const Version = 6
+
+// LeafTxnReadsVersion is the first version which sends the spans read by the
+// leaf txns back to the gateway. The gateway only refreshes the reads of a txn
+// which ran flows if all the nodes involved are at this version or above.
+const LeafTxnReadsVersion = 6
 
 // MinAcceptedVersion is the oldest version that the server is
 // compatible with; see above.
 const MinAcceptedVersion = 4
 
 // workMemBytes specifies the maximum amount of memory in bytes a processor can
-// use. This limit is only observed if the use of temporary storage is enabled
-// (see sql.defaults.distsql.tempstorage).
+// use, for flows which don't specify it (see sql.defaults.distsql.workmem).
+// This limit is only observed if the use of temporary storage is enabled (see
+// sql.defaults.distsql.tempstorage).
 var workMemBytes = envutil.EnvOrDefaultInt64("COCKROACH_WORK_MEM", 64*1024*1024 /* 64MB */)
 
 var noteworthyMemoryUsageBytes = envutil.EnvOrDefaultInt64("COCKROACH_NOTEWORTHY_DISTSQL_MEMORY_USAGE", 10*1024)
@@ -96,6 +115,9 @@ type ServerConfig struct {
 	RPCContext   *rpc.Context
 	Stopper      *stop.Stopper
 	TestingKnobs TestingKnobs
+	// Gossip is used to advertise the versions accepted by the server (see
+	// DistSQLVersionGossipInfo).
+	Gossip *gossip.Gossip
 
 	ParentMemoryMonitor *mon.BytesMonitor
 
@@ -112,6 +134,10 @@ type ServerConfig struct {
 
 	// JobRegistry manages jobs being used by this Server.
 	JobRegistry *jobs.Registry
+
+	// AdmissionController, if set, is the process-wide admission controller
+	// from which flows draw a token for the duration of their execution.
+	AdmissionController *admission.Controller
 }
 
 // ServerImpl implements the server for the distributed SQL APIs.
@@ -129,6 +155,9 @@ type ServerImpl struct {
 	// space used will be a small multiple (~1.1) of this because of RocksDB
 	// space amplification.
 	diskMonitor mon.BytesMonitor
+	// draining is an atomic which is set when the node is draining; remote
+	// flows are not accepted while it is set.
+	draining int32
 }
 
 var _ DistSQLServer = &ServerImpl{}
@@ -136,10 +165,12 @@ var _ DistSQLServer = &ServerImpl{}
 // NewServer instantiates a DistSQLServer.
 func NewServer(ctx context.Context, cfg ServerConfig) *ServerImpl {
 	ds := &ServerImpl{
-		ServerConfig:  cfg,
-		regexpCache:   parser.NewRegexpCache(512),
-		flowRegistry:  makeFlowRegistry(),
-		flowScheduler: newFlowScheduler(cfg.AmbientContext, cfg.Stopper, cfg.Metrics),
+		ServerConfig: cfg,
+		regexpCache:  parser.NewRegexpCache(512),
+		flowRegistry: makeFlowRegistry(),
+		flowScheduler: newFlowScheduler(
+			cfg.AmbientContext, cfg.Settings, cfg.Stopper, cfg.Metrics, cfg.AdmissionController,
+		),
 		memMonitor: mon.MakeMonitor(
 			"distsql",
 			mon.MemoryResource,
@@ -166,7 +197,7 @@ func NewServer(ctx context.Context, cfg ServerConfig) *ServerImpl {
 	ds.diskMonitor = mon.MakeMonitor(
 		"distsql-tempstorage",
 		mon.DiskResource,
-		nil,                 /* curCount */
+		cfg.Metrics.CurDiskBytesCount,
 		nil,                 /* maxHist */
 		workMemBytes,        /* increment: same size as processor's memory budget */
 		diskMonitorBudget/2, /* noteworthy */
@@ -175,11 +206,50 @@ func NewServer(ctx context.Context, cfg ServerConfig) *ServerImpl {
 	return ds
 }
 
-// Start launches workers for the server.
+// Start launches workers for the server and advertises the versions it
+// accepts. It must be called after the NodeID is resolved.
 func (ds *ServerImpl) Start() {
+	if ds.Gossip != nil {
+		if err := ds.Gossip.AddInfoProto(
+			gossip.MakeDistSQLNodeVersionKey(ds.NodeID.Get()),
+			&DistSQLVersionGossipInfo{
+				Version:            Version,
+				MinAcceptedVersion: MinAcceptedVersion,
+			},
+			0, // ttl - no expiration
+		); err != nil {
+			// Gateways don't plan flows on nodes whose versions they don't know,
+			// so this is not fatal.
+			log.Warningf(ds.AnnotateCtx(context.Background()), "failed to gossip DistSQL version: %s", err)
+		}
+	}
 	ds.flowScheduler.Start()
 }
 
+// SetDraining sets the draining state of the server. While draining, the
+// server rejects the flows set up by other nodes (see IsDrainingError), so that
+// they can be planned elsewhere; flows which are already running are not
+// affected.
+func (ds *ServerImpl) SetDraining(drain bool) {
+	var v int32
+	if drain {
+		v = 1
+	}
+	atomic.StoreInt32(&ds.draining, v)
+}
+
+// IsDraining returns true if the server is draining.
+func (ds *ServerImpl) IsDraining() bool {
+	return atomic.LoadInt32(&ds.draining) != 0
+}
+
+// IsDrainingError returns true if the error was returned by SetupFlow because
+// the node is draining.
+func IsDrainingError(err error) bool {
+	pgErr, ok := pgerror.GetPGCause(err)
+	return ok && pgErr.Code == pgerror.CodeCannotConnectNowError
+}
+
 // Note: unless an error is returned, the returned context contains a span that
 // must be finished through Flow.Cleanup.
 func (ds *ServerImpl) setupFlow(
@@ -197,14 +267,33 @@ func (ds *ServerImpl) setupFlow(
 		log.Warning(ctx, err)
 		return ctx, nil, err
 	}
+	for i := range req.Flow.Processors {
+		if v := req.Flow.Processors[i].Version; v != 0 && (v < MinAcceptedVersion || v > Version) {
+			err := errors.Errorf(
+				"version mismatch in processor spec: %d; this node accepts %d through %d",
+				v, MinAcceptedVersion, Version,
+			)
+			log.Warning(ctx, err)
+			return ctx, nil, err
+		}
+	}
 	nodeID := ds.ServerConfig.NodeID.Get()
 	if nodeID == 0 {
 		return nil, nil, errors.Errorf("setupFlow called before the NodeID was resolved")
 	}
 
 	const opName = "flow"
+	// Remote flows carry the span context of the gateway's span, which is used
+	// in favor of the span of the SetupFlow RPC so that the flow's span (and
+	// thus those of its processors) is a child of the query's span.
+	gatewayCtx, err := tracing.ExtractSpanContext(ds.Tracer, req.TraceContext)
+	if err != nil {
+		log.Warningf(ctx, "error extracting the gateway's span context: %s", err)
+	}
 	var sp opentracing.Span
-	if parentSpan == nil {
+	if gatewayCtx != nil {
+		sp = ds.Tracer.StartSpan(opName, opentracing.FollowsFrom(gatewayCtx))
+	} else if parentSpan == nil {
 		sp = ds.Tracer.StartSpan(opName)
 	} else {
 		// We use FollowsFrom because the flow's span outlives the SetupFlow request.
@@ -212,23 +301,32 @@ func (ds *ServerImpl) setupFlow(
 	}
 	ctx = opentracing.ContextWithSpan(ctx, sp)
 
-	// The monitor and account opened here are closed in Flow.Cleanup().
-	monitor := mon.MakeMonitor(
+	// The monitor and account opened here are closed in Flow.Cleanup(). The
+	// monitor is only started once the flow reserves its memory from the
+	// node's pool, before it runs (see Flow.reserveMemory). The monitor
+	// enforces the memory budget of the flow; each processor of the flow draws
+	// from it through its own monitor (see Flow.makeProcessor). The
+	// budget is further restricted by the flow's share of the query's budget,
+	// if any, so that the query's flows as a whole stay within its budget.
+	limit := ds.Settings.FlowMemoryLimit.Get()
+	if budget := req.Flow.MemoryBudget; budget > 0 && (limit == 0 || budget < limit) {
+		limit = budget
+	}
+	monitor := mon.MakeMonitorWithLimit(
 		"flow",
 		mon.MemoryResource,
+		limit,
 		ds.Metrics.CurBytesCount,
 		ds.Metrics.MaxBytesHist,
 		-1, /* use default block size */
 		noteworthyMemoryUsageBytes,
 	)
-	monitor.Start(ctx, &ds.memMonitor, mon.BoundAccount{})
 	acc := monitor.MakeBoundAccount()
 
-	// The flow will run in a Txn that bypasses the local TxnCoordSender.
-	txn := client.NewTxnWithProto(ds.FlowDB, req.Txn)
-	// DistSQL transactions get retryable errors that would otherwise be handled
-	// by the TxnCoordSender.
-	txn.AcceptUnhandledRetryableErrors()
+	// The flow will run in a leaf Txn that bypasses the local TxnCoordSender.
+	// The processors send the state of the leaf back to the gateway when they
+	// are done (see sendLeafTxnState).
+	txn := client.NewLeafTxn(ds.FlowDB, req.Txn)
 
 	location, err := sqlbase.TimeZoneStringToLocation(req.EvalContext.Location)
 	if err != nil {
@@ -265,17 +363,40 @@ func (ds *ServerImpl) setupFlow(
 		EvalCtx:        evalCtx,
 		rpcCtx:         ds.RPCContext,
 		txn:            txn,
-		clientDB:       ds.DB,
+		ClientDB:       ds.DB,
 		testingKnobs:   ds.TestingKnobs,
 		nodeID:         nodeID,
 		tempStorage:    ds.tempStorage,
 		diskMonitor:    &ds.diskMonitor,
+		metrics:        ds.Metrics,
 		JobRegistry:    ds.ServerConfig.JobRegistry,
+		workMem:        req.Flow.WorkMem,
+	}
+
+	if ds.tempStorage != nil {
+		// The monitor opened here is stopped in Flow.Cleanup(), which also
+		// clears the namespace, including the rows of the processors which
+		// couldn't close their containers. The rows of flows that didn't get
+		// cleaned up because the node crashed are removed when the temp engine
+		// is recreated.
+		flowCtx.tempStorageNamespace = engine.NewTempStorageNamespace()
+		diskMonitor := mon.MakeMonitorWithLimit(
+			"flow-tempstorage",
+			mon.DiskResource,
+			ds.Settings.FlowTempStorageLimit.Get(),
+			nil, /* curCount: accounted for by the node's monitor */
+			ds.Metrics.MaxDiskBytesHist,
+			workMemBytes,  /* increment */
+			math.MaxInt64, /* noteworthy */
+		)
+		diskMonitor.Start(ctx, &ds.diskMonitor, mon.BoundAccount{})
+		flowCtx.diskMonitor = &diskMonitor
 	}
 
 	ctx = flowCtx.AnnotateCtx(ctx)
 
 	f := newFlow(flowCtx, ds.flowRegistry, syncFlowConsumer)
+	f.memPool = &ds.memMonitor
 	flowCtx.AddLogTagStr("f", f.id.Short())
 	if err := f.setup(ctx, &req.Flow); err != nil {
 		log.Errorf(ctx, "error setting up flow: %s", err)
@@ -294,7 +415,17 @@ func (ds *ServerImpl) setupFlow(
 func (ds *ServerImpl) SetupSyncFlow(
 	ctx context.Context, req *SetupFlowRequest, output RowReceiver,
 ) (context.Context, *Flow, error) {
-	return ds.setupFlow(ds.AnnotateCtx(ctx), opentracing.SpanFromContext(ctx), req, output)
+	ctx, f, err := ds.setupFlow(ds.AnnotateCtx(ctx), opentracing.SpanFromContext(ctx), req, output)
+	if err != nil {
+		return ctx, nil, err
+	}
+	// Synchronous flows are not scheduled, so they can't wait for memory to
+	// be released by other flows.
+	if err := f.reserveMemory(ctx); err != nil {
+		f.Cleanup(ctx)
+		return ctx, nil, err
+	}
+	return ctx, f, nil
 }
 
 // RunSyncFlow is part of the DistSQLServer interface.
@@ -331,6 +462,11 @@ func (ds *ServerImpl) RunSyncFlow(stream DistSQL_RunSyncFlowServer) error {
 func (ds *ServerImpl) SetupFlow(
 	ctx context.Context, req *SetupFlowRequest,
 ) (*SimpleResponse, error) {
+	if ds.IsDraining() {
+		return &SimpleResponse{Error: NewError(pgerror.NewErrorf(
+			pgerror.CodeCannotConnectNowError, "node %d is draining", ds.NodeID.Get(),
+		))}, nil
+	}
 	parentSpan := opentracing.SpanFromContext(ctx)
 
 	// Note: the passed context will be canceled when this RPC completes, so we
@@ -338,7 +474,9 @@ func (ds *ServerImpl) SetupFlow(
 	ctx = ds.AnnotateCtx(context.Background())
 	ctx, f, err := ds.setupFlow(ctx, parentSpan, req, nil)
 	if err == nil {
-		err = ds.flowScheduler.ScheduleFlow(ctx, f)
+		if err = ds.flowScheduler.ScheduleFlow(ctx, f); err != nil {
+			f.Cleanup(ctx)
+		}
 	}
 	if err != nil {
 		// We return flow deployment errors in the response so that they are
@@ -349,6 +487,57 @@ func (ds *ServerImpl) SetupFlow(
 	return &SimpleResponse{}, nil
 }
 
+// CancelFlows is part of the DistSQLServer interface.
+func (ds *ServerImpl) CancelFlows(
+	ctx context.Context, req *CancelFlowsRequest,
+) (*SimpleResponse, error) {
+	for _, id := range req.FlowIDs {
+		// Flows are registered when they start running, under the lock of the
+		// scheduler. A flow that is not queued any more is thus either registered
+		// or finished.
+		if !ds.flowScheduler.CancelQueuedFlow(id) {
+			ds.flowRegistry.CancelFlow(id)
+		}
+	}
+	return &SimpleResponse{}, nil
+}
+
+// lookupFlow returns the queued or running flow with the given ID, or nil if
+// there is no such flow.
+func (ds *ServerImpl) lookupFlow(id FlowID) *Flow {
+	// Flows are registered when they start running, under the lock of the
+	// scheduler. A flow that is not queued any more is thus either registered
+	// or finished.
+	if f := ds.flowScheduler.LookupQueuedFlow(id); f != nil {
+		return f
+	}
+	return ds.flowRegistry.LookupFlow(id)
+}
+
+// PauseFlows is part of the DistSQLServer interface.
+func (ds *ServerImpl) PauseFlows(
+	ctx context.Context, req *PauseFlowsRequest,
+) (*SimpleResponse, error) {
+	for _, id := range req.FlowIDs {
+		if f := ds.lookupFlow(id); f != nil {
+			f.Pause()
+		}
+	}
+	return &SimpleResponse{}, nil
+}
+
+// ResumeFlows is part of the DistSQLServer interface.
+func (ds *ServerImpl) ResumeFlows(
+	ctx context.Context, req *ResumeFlowsRequest,
+) (*SimpleResponse, error) {
+	for _, id := range req.FlowIDs {
+		if f := ds.lookupFlow(id); f != nil {
+			f.Resume()
+		}
+	}
+	return &SimpleResponse{}, nil
+}
+
 func (ds *ServerImpl) flowStreamInt(ctx context.Context, stream DistSQL_FlowStreamServer) error {
 	// Receive the first message.
 	msg, err := stream.Recv()
@@ -372,6 +561,19 @@ func (ds *ServerImpl) flowStreamInt(ctx context.Context, stream DistSQL_FlowStre
 		return err
 	}
 	defer cleanup()
+	// The stream is processed in a span which follows from the producer's
+	// flow span, so that it is part of the query's trace. If the query is
+	// being recorded, so is the span, and its recording is sent to the
+	// consumer along with the stream's rows.
+	producerCtx, err := tracing.ExtractSpanContext(ds.Tracer, msg.Header.TraceContext)
+	if err != nil {
+		log.Warningf(ctx, "error extracting the producer's span context: %s", err)
+	}
+	if producerCtx != nil {
+		sp := ds.Tracer.StartSpan("inbound stream", opentracing.FollowsFrom(producerCtx))
+		defer sp.Finish()
+		ctx = opentracing.ContextWithSpan(ctx, sp)
+	}
 	log.VEventf(ctx, 1, "connected inbound stream %s/%d", flowID.Short(), streamID)
 	return ProcessInboundStream(f.AnnotateCtx(ctx), stream, msg, receiver)
 }
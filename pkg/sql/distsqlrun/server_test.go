@@ -120,7 +120,7 @@ func TestServer(t *testing.T) {
 				expectedErr: "version mismatch",
 			},
 			{
-				version:     Version - 1,
+				version:     MinAcceptedVersion - 1,
 				expectedErr: "version mismatch",
 			},
 			{
@@ -146,4 +146,19 @@ func TestServer(t *testing.T) {
 			})
 		}
 	})
+	// Verify that a draining server rejects the flows of other nodes.
+	t.Run("draining", func(t *testing.T) {
+		ds := s.DistSQLServer().(*ServerImpl)
+		ds.SetDraining(true)
+		defer ds.SetDraining(false)
+
+		req.Version = Version
+		resp, err := NewDistSQLClient(conn).SetupFlow(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := resp.Error.ErrorDetail(); !IsDrainingError(err) {
+			t.Fatalf("expected draining error, got %v", err)
+		}
+	})
 }
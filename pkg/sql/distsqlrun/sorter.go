@@ -50,6 +50,9 @@ type sorter struct {
 	// tempStorage is used to store rows when the working set is larger than can
 	// be stored in memory.
 	tempStorage engine.Engine
+	// spiller decides whether the sortAllStrategy falls back to disk once the
+	// rows don't fit in memory.
+	spiller spiller
 }
 
 var _ Processor = &sorter{}
@@ -85,7 +88,7 @@ func (s *sorter) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 
 	ctx = log.WithLogTag(ctx, "Sorter", nil)
-	ctx, span := processorSpan(ctx, "sorter")
+	ctx, span := processorSpan(ctx, s.flowCtx, "sorter")
 	defer tracing.FinishSpan(span)
 
 	if log.V(2) {
@@ -96,17 +99,18 @@ func (s *sorter) Run(ctx context.Context, wg *sync.WaitGroup) {
 	var sv memRowContainer
 	// Enable fall back to disk if the cluster setting is set or a memory limit
 	// has been set through testing.
-	useTempStorage := (s.flowCtx.Settings.DistSQLUseTempStorage.Get() &&
-		s.flowCtx.Settings.DistSQLUseTempStorageSorts.Get()) ||
-		s.testingKnobMemLimit > 0
-	if s.matchLen == 0 && s.count == 0 && useTempStorage {
+	s.spiller = makeSpiller(
+		s.flowCtx, "sorter", s.flowCtx.Settings.DistSQLUseTempStorageSorts, s.testingKnobMemLimit > 0,
+	)
+	defer s.spiller.close(ctx)
+	if s.matchLen == 0 && s.count == 0 && s.spiller.useTempStorage {
 		// We will use the sortAllStrategy in this case and potentially fall
 		// back to disk.
 		// Limit the memory use by creating a child monitor with a hard limit.
 		// The strategy will overflow to disk if this limit is not enough.
 		limit := s.testingKnobMemLimit
 		if limit <= 0 {
-			limit = workMemBytes
+			limit = s.flowCtx.workMemLimit()
 		}
 		limitedMon := mon.MakeMonitorInheritWithLimit(
 			"sortall-limited", limit, s.flowCtx.EvalCtx.Mon,
@@ -128,7 +132,7 @@ func (s *sorter) Run(ctx context.Context, wg *sync.WaitGroup) {
 			// optimizations are possible so we simply load all rows into memory and
 			// sort all values in-place. It has a worst-case time complexity of
 			// O(n*log(n)) and a worst-case space complexity of O(n).
-			ss = newSortAllStrategy(&sv, useTempStorage)
+			ss = newSortAllStrategy(&sv, &s.spiller)
 		} else {
 			// No specified ordering match length but specified limit; we can optimize
 			// our sort procedure by maintaining a max-heap populated with only the
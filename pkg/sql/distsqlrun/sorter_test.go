@@ -259,6 +259,98 @@ func TestSorter(t *testing.T) {
 	}
 }
 
+// TestSorterExternal sorts inputs which don't fit in memory with memory limits
+// small enough to result in many sorted runs, which then need to be merged
+// before the final merge.
+func TestSorterExternal(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	diskMonitor := mon.MakeMonitor(
+		"test-disk",
+		mon.DiskResource,
+		nil, /* curCount */
+		nil, /* maxHist */
+		-1,  /* increment: use default block size */
+		math.MaxInt64,
+	)
+	diskMonitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer diskMonitor.Stop(ctx)
+	flowCtx := FlowCtx{
+		EvalCtx:     evalCtx,
+		Settings:    cluster.MakeTestingClusterSettings(),
+		tempStorage: tempEngine,
+		diskMonitor: &diskMonitor,
+	}
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	types := []sqlbase.ColumnType{columnTypeInt, columnTypeInt}
+	ordering := sqlbase.ColumnOrdering{
+		{ColIdx: 0, Direction: encoding.Ascending},
+		{ColIdx: 1, Direction: encoding.Descending},
+	}
+	spec := SorterSpec{OutputOrdering: convertToSpecOrdering(ordering)}
+
+	rng := rand.New(rand.NewSource(int64(timeutil.Now().UnixNano())))
+	const numRows = 2000
+	input := make(sqlbase.EncDatumRows, numRows)
+	for i := range input {
+		input[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Intn(100)))),
+			sqlbase.DatumToEncDatum(columnTypeInt, parser.NewDInt(parser.DInt(rng.Intn(100)))),
+		}
+	}
+
+	for _, memLimit := range []int64{1, 1150, 4096, 16384} {
+		t.Run(fmt.Sprintf("MemLimit=%d", memLimit), func(t *testing.T) {
+			in := NewRowBuffer(types, input, RowBufferArgs{})
+			out := &RowBuffer{}
+			s, err := newSorter(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.testingKnobMemLimit = memLimit
+			s.Run(ctx, nil)
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			var alloc sqlbase.DatumAlloc
+			var prev sqlbase.EncDatumRow
+			numRet := 0
+			for {
+				row, meta := out.Next()
+				if !meta.Empty() {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if row == nil {
+					break
+				}
+				if prev != nil {
+					if cmp, err := prev.Compare(&alloc, ordering, &evalCtx, row); err != nil {
+						t.Fatal(err)
+					} else if cmp > 0 {
+						t.Fatalf("incorrectly ordered row %s after %s", row, prev)
+					}
+				}
+				prev = row
+				numRet++
+			}
+			if numRet != numRows {
+				t.Fatalf("expected %d rows, got %d", numRows, numRet)
+			}
+		})
+	}
+}
+
 // BenchmarkSortAll times how long it takes to sort an input of varying length.
 func BenchmarkSortAll(b *testing.B) {
 	ctx := context.Background()
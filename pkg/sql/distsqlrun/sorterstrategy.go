@@ -15,9 +15,11 @@
 package distsqlrun
 
 import (
+	"container/heap"
+
 	"golang.org/x/net/context"
 
-	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/pkg/errors"
@@ -42,21 +44,27 @@ type sorterStrategy interface {
 //
 // The strategy is intended to be used when all values need to be sorted.
 type sortAllStrategy struct {
-	rows           *memRowContainer
-	useTempStorage bool
+	rows    *memRowContainer
+	spiller *spiller
 }
 
 var _ sorterStrategy = &sortAllStrategy{}
 
-func newSortAllStrategy(rows *memRowContainer, useTempStorage bool) sorterStrategy {
+func newSortAllStrategy(rows *memRowContainer, spiller *spiller) sorterStrategy {
 	return &sortAllStrategy{
-		rows:           rows,
-		useTempStorage: useTempStorage,
+		rows:    rows,
+		spiller: spiller,
 	}
 }
 
+// sortAllMaxRuns is the maximum number of sorted runs that the external sort
+// keeps on disk at once. Once it is reached, the runs are merged into a single
+// one before a new run is started, which bounds the fan-in of the final merge.
+const sortAllMaxRuns = 16
+
 // Execute runs an in memory implementation of a sort. If this run fails with a
-// memory error, the strategy will fall back to use disk.
+// memory error, the strategy will fall back to an external sort which uses
+// disk.
 func (ss *sortAllStrategy) Execute(ctx context.Context, s *sorter) error {
 	defer ss.rows.Close(ctx)
 	row, err := ss.executeImpl(ctx, s, ss.rows)
@@ -64,55 +72,280 @@ func (ss *sortAllStrategy) Execute(ctx context.Context, s *sorter) error {
 	// than the COCKROACH_WORK_MEM was reached. We should distinguish between
 	// these cases and log the event to facilitate debugging of queries that
 	// may be slow for this reason.
-	if pgErr, ok := err.(*pgerror.Error); !(ok && pgErr.Code == pgerror.CodeOutOfMemoryError) {
+	if !isMemoryError(err) {
 		return err
 	}
-	if !ss.useTempStorage {
-		return errors.Wrap(err, "external storage for large queries disabled")
-	}
-	if s.tempStorage == nil {
-		return errors.Wrap(err, "external storage not provided on this cockroach node")
+	if err := ss.spiller.canSpill(err); err != nil {
+		return err
 	}
 	log.VEventf(ctx, 2, "falling back to disk")
-	diskContainer := makeDiskRowContainer(
-		ctx, s.flowCtx.diskMonitor, ss.rows.types, ss.rows.ordering, s.tempStorage,
+	return ss.executeExternal(ctx, s, row)
+}
+
+// executeExternal sorts the input using sorted runs stored on disk:
+//  - rows are accumulated in memory until the memory budget is exhausted, at
+//    which point they are sorted and written out to a new run on disk. Once
+//    sortAllMaxRuns runs have been written, they are merged into a single run.
+//  - once the input is exhausted, the remaining rows in memory are sorted and
+//    merged with the runs on disk, and the result is sent to the output stream.
+//
+// overflowRow is the row which didn't fit in memory when the in-memory sort
+// failed; the rows read before it are in ss.rows.
+func (ss *sortAllStrategy) executeExternal(
+	ctx context.Context, s *sorter, overflowRow sqlbase.EncDatumRow,
+) error {
+	var runs []*diskRowContainer
+	defer func() {
+		for _, r := range runs {
+			r.Close(ctx)
+		}
+	}()
+
+	// spill writes the rows held in memory, followed by the given row which
+	// didn't fit in memory, to a new run.
+	spill := func(row sqlbase.EncDatumRow) error {
+		if ss.rows.Len() == 0 && len(runs) > 0 {
+			// There is nothing to spill; the rows of a diskRowContainer are kept
+			// in sorted order so the row can be added to the last run.
+			return runs[len(runs)-1].AddRow(ctx, row)
+		}
+		if len(runs) == sortAllMaxRuns {
+			merged, err := ss.mergeRuns(ctx, s, runs)
+			if err != nil {
+				return err
+			}
+			for _, r := range runs {
+				r.Close(ctx)
+			}
+			runs = append(runs[:0], merged)
+		}
+		run := ss.newRun(ctx, s)
+		runs = append(runs, run)
+		log.VEventf(ctx, 2, "writing run %d of %d rows to disk", len(runs), ss.rows.Len()+1)
+
+		// Sorting the rows beforehand results in the run being written out in
+		// key order. Note that the iterator frees up the memory taken up by
+		// ss.rows.
+		ss.rows.Sort()
+		i := ss.rows.NewIterator(ctx)
+		defer i.Close()
+		if err := copyRows(ctx, i, run); err != nil {
+			return err
+		}
+		ss.rows.Clear(ctx)
+		return run.AddRow(ctx, row)
+	}
+
+	if err := spill(overflowRow); err != nil {
+		return err
+	}
+	for {
+		row, err := s.input.NextRow()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			break
+		}
+		if err := ss.rows.AddRow(ctx, row); err != nil {
+			if !isMemoryError(err) {
+				return err
+			}
+			if err := spill(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Merge the runs with the rows left in memory.
+	ss.rows.Sort()
+	iters := make([]rowIterator, 0, len(runs)+1)
+	defer func() {
+		for _, i := range iters {
+			i.Close()
+		}
+	}()
+	for _, r := range runs {
+		iters = append(iters, r.NewIterator(ctx))
+	}
+	iters = append(iters, ss.rows.NewIterator(ctx))
+	m := makeRowIteratorMerger(iters, ss.rows.ordering, ss.rows.evalCtx)
+	return m.merge(func(row sqlbase.EncDatumRow) (bool, error) {
+		consumerStatus, err := s.out.EmitRow(ctx, row)
+		return err == nil && consumerStatus == NeedMoreRows, err
+	})
+}
+
+// newRun creates a diskRowContainer in which a sorted run is stored.
+func (ss *sortAllStrategy) newRun(ctx context.Context, s *sorter) *diskRowContainer {
+	run := makeDiskRowContainer(
+		ctx, ss.spiller.diskMonitor(ctx), ss.rows.types, ss.rows.ordering, s.tempStorage,
+		s.flowCtx.tempStorageNamespace,
 	)
-	defer diskContainer.Close(ctx)
+	return &run
+}
 
-	// Transfer the rows from memory to disk. Note that this frees up the
-	// memory taken up by ss.rows.
-	i := ss.rows.NewIterator(ctx)
-	defer i.Close()
+// mergeRuns merges the given runs into a new run. The given runs are left
+// untouched and need to be closed by the caller.
+func (ss *sortAllStrategy) mergeRuns(
+	ctx context.Context, s *sorter, runs []*diskRowContainer,
+) (*diskRowContainer, error) {
+	log.VEventf(ctx, 2, "merging %d runs", len(runs))
+	merged := ss.newRun(ctx, s)
+	iters := make([]rowIterator, len(runs))
+	for i, r := range runs {
+		iters[i] = r.NewIterator(ctx)
+	}
+	m := makeRowIteratorMerger(iters, ss.rows.ordering, ss.rows.evalCtx)
+	err := m.merge(func(row sqlbase.EncDatumRow) (bool, error) {
+		return true, merged.AddRow(ctx, row)
+	})
+	for _, i := range iters {
+		i.Close()
+	}
+	if err != nil {
+		merged.Close(ctx)
+		return nil, err
+	}
+	return merged, nil
+}
+
+// copyRows adds the rows of the given iterator to the given container.
+func copyRows(ctx context.Context, i rowIterator, c sortableRowContainer) error {
 	for i.Rewind(); ; i.Next() {
 		if ok, err := i.Valid(); err != nil {
 			return err
 		} else if !ok {
-			break
+			return nil
 		}
-		memRow, err := i.Row()
+		row, err := i.Row()
 		if err != nil {
 			return err
 		}
-		if err := diskContainer.AddRow(ctx, memRow); err != nil {
+		if err := c.AddRow(ctx, row); err != nil {
 			return err
 		}
 	}
+}
 
-	// Add the row that caused the memory container to run out of memory.
-	if err := diskContainer.AddRow(ctx, row); err != nil {
-		return err
+// rowIteratorMerger merges rowIterators which iterate over rows sorted
+// according to the same ordering into a single sorted stream of rows.
+type rowIteratorMerger struct {
+	ordering sqlbase.ColumnOrdering
+	evalCtx  *parser.EvalContext
+
+	iters []rowIterator
+	// rows holds the current row of each iterator.
+	rows []sqlbase.EncDatumRow
+
+	// heap of iterator indexes, ordered by the current row. Iterators with no
+	// more rows are not in the heap.
+	heap []int
+
+	// err can be set by the Less function (used by the heap implementation).
+	err error
+
+	alloc sqlbase.DatumAlloc
+}
+
+var _ heap.Interface = &rowIteratorMerger{}
+
+func makeRowIteratorMerger(
+	iters []rowIterator, ordering sqlbase.ColumnOrdering, evalCtx *parser.EvalContext,
+) rowIteratorMerger {
+	return rowIteratorMerger{
+		ordering: ordering,
+		evalCtx:  evalCtx,
+		iters:    iters,
+		rows:     make([]sqlbase.EncDatumRow, len(iters)),
+		heap:     make([]int, 0, len(iters)),
 	}
-	if _, err := ss.executeImpl(ctx, s, &diskContainer); err != nil {
-		return err
+}
+
+// Len is part of heap.Interface and is only meant to be used internally.
+func (m *rowIteratorMerger) Len() int {
+	return len(m.heap)
+}
+
+// Less is part of heap.Interface and is only meant to be used internally.
+func (m *rowIteratorMerger) Less(i, j int) bool {
+	cmp, err := m.rows[m.heap[i]].Compare(&m.alloc, m.ordering, m.evalCtx, m.rows[m.heap[j]])
+	if err != nil {
+		m.err = err
+		return false
+	}
+	return cmp < 0
+}
+
+// Swap is part of heap.Interface and is only meant to be used internally.
+func (m *rowIteratorMerger) Swap(i, j int) {
+	m.heap[i], m.heap[j] = m.heap[j], m.heap[i]
+}
+
+// Push is part of heap.Interface; it's not used as we never insert elements to
+// the heap (we initialize it with all iterators, see merge).
+func (m *rowIteratorMerger) Push(x interface{}) { panic("unimplemented") }
+
+// Pop is part of heap.Interface and is only meant to be used internally.
+func (m *rowIteratorMerger) Pop() interface{} {
+	m.heap = m.heap[:len(m.heap)-1]
+	return nil
+}
+
+// advance reads the current row of the idx-th iterator into m.rows. It returns
+// false if the iterator has no more rows.
+func (m *rowIteratorMerger) advance(idx int) (bool, error) {
+	if ok, err := m.iters[idx].Valid(); err != nil || !ok {
+		return false, err
+	}
+	row, err := m.iters[idx].Row()
+	if err != nil {
+		return false, err
+	}
+	m.rows[idx] = row
+	return true, nil
+}
+
+// merge passes the rows of all the iterators to fn in sorted order, until fn
+// returns false or an error.
+func (m *rowIteratorMerger) merge(fn func(sqlbase.EncDatumRow) (bool, error)) error {
+	for idx, i := range m.iters {
+		i.Rewind()
+		if ok, err := m.advance(idx); err != nil {
+			return err
+		} else if ok {
+			m.heap = append(m.heap, idx)
+		}
+	}
+	heap.Init(m)
+	if m.err != nil {
+		return m.err
+	}
+
+	for len(m.heap) > 0 {
+		idx := m.heap[0]
+		if more, err := fn(m.rows[idx]); err != nil || !more {
+			return err
+		}
+		m.iters[idx].Next()
+		if ok, err := m.advance(idx); err != nil {
+			return err
+		} else if ok {
+			heap.Fix(m, 0)
+		} else {
+			heap.Remove(m, 0)
+		}
+		// heap operations might set m.err (see Less).
+		if m.err != nil {
+			return m.err
+		}
 	}
 	return nil
 }
 
 // The execution loop for the SortAll strategy:
-//  - loads all rows into memory. If the memory budget is not high enough, all
-//    rows are stored on disk.
-//  - runs sort.Sort to sort rows in place. In the disk-backed case, the rows
-//    are already kept in sorted order.
+//  - loads all rows into memory.
+//  - runs sort.Sort to sort rows in place.
 //  - sends each row out to the output stream.
 //
 // If an error occurs while adding a row to the given container, the row is
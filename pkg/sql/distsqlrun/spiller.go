@@ -0,0 +1,180 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"math"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// spiller makes the decision of whether a processor which exceeded its memory
+// budget falls back to temporary storage, for all the processors which can do
+// so. A memory budget error either triggers the spill callback registered by
+// the processor, or is returned annotated with the reason why the processor
+// can't spill. The spills and memory budget errors are recorded in the metrics
+// of the processor's type.
+type spiller struct {
+	flowCtx *FlowCtx
+	// name is the type of the processor, e.g. "sorter".
+	name string
+	// useTempStorage is set if the processor is allowed to use temporary
+	// storage, through the cluster settings or a testing knob.
+	useTempStorage bool
+	// onSpill is invoked instead of returning a memory budget error if the
+	// processor can spill. It moves (some of) the processor's state to disk, or
+	// returns the error if the state can't be spilled after all. It is nil if
+	// the processor doesn't support spilling in its current configuration.
+	onSpill func(ctx context.Context, err error) error
+
+	// metrics are the metrics of the processor's type; they are nil if the
+	// flow doesn't record metrics.
+	metrics *ProcessorMemMetrics
+	// diskMon accounts for the temporary storage used by the processor once it
+	// spilled, so that the amount of data spilled can be recorded. It is
+	// started by diskMonitor and stopped by close.
+	diskMon *mon.BytesMonitor
+}
+
+// makeSpiller returns a spiller for a processor of the given type whose use of
+// temporary storage is enabled by the given cluster setting, on top of the
+// general sql.defaults.distsql.tempstorage setting, or through a testing knob.
+func makeSpiller(
+	flowCtx *FlowCtx, name string, setting *settings.BoolSetting, testingKnob bool,
+) spiller {
+	return spiller{
+		flowCtx: flowCtx,
+		name:    name,
+		useTempStorage: (flowCtx.Settings.DistSQLUseTempStorage.Get() && setting.Get()) ||
+			testingKnob,
+		metrics: flowCtx.metrics.processorMemMetrics(name),
+	}
+}
+
+// enabled returns whether the processor is allowed to spill to temporary
+// storage, which must be provided on this node.
+func (s *spiller) enabled() bool {
+	return s.useTempStorage && s.flowCtx.tempStorage != nil
+}
+
+// canSpill returns nil if the processor can fall back to disk after
+// encountering the given error, and otherwise the error to return. The
+// processor is expected to spill if nil is returned.
+func (s *spiller) canSpill(err error) error {
+	if err := s.spillError(err); err != nil {
+		s.noteError(err)
+		return err
+	}
+	s.noteSpill()
+	return nil
+}
+
+// spillError is like canSpill, without recording the outcome.
+func (s *spiller) spillError(err error) error {
+	if !isMemoryError(err) {
+		return err
+	}
+	if !s.useTempStorage {
+		return errors.Wrap(err, "external storage for large queries disabled")
+	}
+	if s.flowCtx.tempStorage == nil {
+		return errors.Wrap(err, "external storage not provided on this cockroach node")
+	}
+	return nil
+}
+
+// grow grows acc by the given number of bytes. If the memory budget is
+// exceeded and the processor can spill, the registered spill callback is
+// invoked instead of returning the error; spilled is then set, and the caller
+// must not hold on to the memory it tried to account for.
+func (s *spiller) grow(
+	ctx context.Context, acc *mon.BoundAccount, bytes int64,
+) (spilled bool, _ error) {
+	err := acc.Grow(ctx, bytes)
+	if err == nil {
+		return false, nil
+	}
+	if s.onSpill == nil {
+		s.noteError(err)
+		return false, err
+	}
+	if err := s.spillError(err); err != nil {
+		s.noteError(err)
+		return false, err
+	}
+	if err := s.onSpill(ctx, err); err != nil {
+		s.noteError(err)
+		return false, err
+	}
+	s.noteSpill()
+	return true, nil
+}
+
+// diskMonitor returns the monitor which the disk row containers of the
+// processor use once it spilled.
+func (s *spiller) diskMonitor(ctx context.Context) *mon.BytesMonitor {
+	if s.diskMon == nil {
+		diskMon := mon.MakeMonitor(
+			s.name+"-tempstorage",
+			mon.DiskResource,
+			nil,           /* curCount: accounted for by the flow's monitor */
+			nil,           /* maxHist */
+			-1,            /* increment: use default block size */
+			math.MaxInt64, /* noteworthy */
+		)
+		diskMon.Start(ctx, s.flowCtx.diskMonitor, mon.BoundAccount{})
+		s.diskMon = &diskMon
+	}
+	return s.diskMon
+}
+
+// close records the amount of data spilled by the processor, if any. It must
+// be called once the processor closed its disk row containers.
+func (s *spiller) close(ctx context.Context) {
+	if s.diskMon == nil {
+		return
+	}
+	if s.metrics != nil {
+		s.metrics.SpilledBytes.Inc(s.diskMon.MaximumBytes())
+	}
+	s.diskMon.Stop(ctx)
+	s.diskMon = nil
+}
+
+// noteSpill records that the processor spilled to disk.
+func (s *spiller) noteSpill() {
+	if s.metrics != nil {
+		s.metrics.Spills.Inc(1)
+	}
+}
+
+// noteError records that the processor failed with err, if it is a memory
+// budget error.
+func (s *spiller) noteError(err error) {
+	if s.metrics != nil && isMemoryError(errors.Cause(err)) {
+		s.metrics.MemoryErrors.Inc(1)
+	}
+}
+
+// isMemoryError returns whether err is the error returned when a memory
+// budget is exceeded.
+func isMemoryError(err error) bool {
+	pgErr, ok := err.(*pgerror.Error)
+	return ok && pgErr.Code == pgerror.CodeOutOfMemoryError
+}
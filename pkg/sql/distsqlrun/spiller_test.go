@@ -0,0 +1,114 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestSpillerGrow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tempEngine, err := engine.NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	const limit = 100
+	testCases := []struct {
+		name           string
+		useTempStorage bool
+		tempStorage    engine.Engine
+		register       bool
+		expectedErr    string
+	}{
+		{name: "Spill", useTempStorage: true, tempStorage: tempEngine, register: true},
+		{name: "NoCallback", useTempStorage: true, tempStorage: tempEngine,
+			expectedErr: "^memory budget exceeded"},
+		{name: "Disabled", tempStorage: tempEngine, register: true,
+			expectedErr: "^external storage for large queries disabled"},
+		{name: "NoTempStorage", useTempStorage: true, register: true,
+			expectedErr: "^external storage not provided"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			monitor := mon.MakeMonitor(
+				"test", mon.MemoryResource, nil /* curCount */, nil /* maxHist */, 1, /* increment */
+				limit, /* noteworthy */
+			)
+			monitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(limit))
+			defer monitor.Stop(ctx)
+			acc := monitor.MakeBoundAccount()
+			defer acc.Close(ctx)
+
+			metrics := makeProcessorMemMetrics("test", "tests")
+			s := spiller{
+				flowCtx: &FlowCtx{
+					Settings:    cluster.MakeTestingClusterSettings(),
+					tempStorage: tc.tempStorage,
+				},
+				useTempStorage: tc.useTempStorage,
+				metrics:        &metrics,
+			}
+			var spills int
+			if tc.register {
+				s.onSpill = func(context.Context, error) error {
+					spills++
+					return nil
+				}
+			}
+
+			// Growing within the budget doesn't spill.
+			if spilled, err := s.grow(ctx, &acc, limit/2); err != nil || spilled {
+				t.Fatalf("unexpected spill: spilled=%t, err=%v", spilled, err)
+			}
+
+			spilled, err := s.grow(ctx, &acc, limit)
+			if !testutils.IsError(err, tc.expectedErr) {
+				t.Fatalf("expected error %q, got %v", tc.expectedErr, err)
+			}
+			if tc.expectedErr != "" {
+				if spilled || spills != 0 {
+					t.Fatalf("unexpected spill: spilled=%t, spills=%d", spilled, spills)
+				}
+				if c := metrics.MemoryErrors.Count(); c != 1 {
+					t.Fatalf("expected 1 memory budget error to be recorded, got %d", c)
+				}
+				return
+			}
+			if !spilled || spills != 1 {
+				t.Fatalf("expected a single spill: spilled=%t, spills=%d", spilled, spills)
+			}
+			if c := metrics.Spills.Count(); c != 1 {
+				t.Fatalf("expected 1 spill to be recorded, got %d", c)
+			}
+			// The memory which triggered the spill isn't accounted for.
+			if used := monitor.GetCurrentAllocationForTesting(); used != limit/2 {
+				t.Fatalf("expected %d bytes to be used, got %d", limit/2, used)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// inputStatCollector wraps an input of a processor and counts the rows read
+// from it and the time spent waiting for them.
+type inputStatCollector struct {
+	RowSource
+
+	rows      int64
+	stallTime time.Duration
+}
+
+var _ RowSource = &inputStatCollector{}
+
+// Next is part of the RowSource interface.
+func (isc *inputStatCollector) Next() (sqlbase.EncDatumRow, ProducerMetadata) {
+	start := timeutil.Now()
+	row, meta := isc.RowSource.Next()
+	isc.stallTime += timeutil.Since(start)
+	if row != nil {
+		isc.rows++
+	}
+	return row, meta
+}
+
+// outputStatCollector wraps the output of a processor; it counts the rows
+// pushed by the processor and the time spent pushing them. When the processor
+// is done, the statistics of the processor (including those collected by the
+// inputStatCollectors of its inputs) are sent as metadata.
+//
+// Push can be called concurrently when the processor drains multiple inputs
+// (see DrainAndClose), so the counters are updated atomically.
+type outputStatCollector struct {
+	RowReceiver
+
+	// stats has the fields identifying the processor already set.
+	stats  ProcessorStats
+	inputs []*inputStatCollector
+	mon    *mon.BytesMonitor
+
+	rows      int64
+	bytes     int64
+	stallTime int64 // nanoseconds
+}
+
+var _ RowReceiver = &outputStatCollector{}
+
+// Push is part of the RowReceiver interface.
+func (osc *outputStatCollector) Push(
+	row sqlbase.EncDatumRow, meta ProducerMetadata,
+) ConsumerStatus {
+	start := timeutil.Now()
+	status := osc.RowReceiver.Push(row, meta)
+	atomic.AddInt64(&osc.stallTime, int64(timeutil.Since(start)))
+	if row != nil {
+		atomic.AddInt64(&osc.rows, 1)
+		atomic.AddInt64(&osc.bytes, int64(row.Size()))
+	}
+	return status
+}
+
+// ProducerDone is part of the RowReceiver interface.
+func (osc *outputStatCollector) ProducerDone() {
+	stats := osc.stats
+	for _, in := range osc.inputs {
+		stats.InputRows += in.rows
+		stats.InputStallTime += in.stallTime
+	}
+	stats.OutputRows = atomic.LoadInt64(&osc.rows)
+	stats.OutputBytes = atomic.LoadInt64(&osc.bytes)
+	stats.OutputStallTime = time.Duration(atomic.LoadInt64(&osc.stallTime))
+	stats.MaxMemory = osc.mon.MaximumBytes()
+	osc.RowReceiver.Push(nil /* row */, ProducerMetadata{Stats: &stats})
+	osc.RowReceiver.ProducerDone()
+}
+
+// wrapWithStatCollectors wraps the inputs and outputs of a processor with
+// collectors of execution statistics.
+func (f *Flow) wrapWithStatCollectors(
+	procIdx int,
+	ps *ProcessorSpec,
+	inputs []RowSource,
+	outputs []RowReceiver,
+	procMon *mon.BytesMonitor,
+) ([]RowSource, []RowReceiver) {
+	inputCollectors := make([]*inputStatCollector, len(inputs))
+	wrappedInputs := make([]RowSource, len(inputs))
+	for i := range inputs {
+		inputCollectors[i] = &inputStatCollector{RowSource: inputs[i]}
+		wrappedInputs[i] = inputCollectors[i]
+	}
+	var name string
+	if v, ok := ps.Core.GetValue().(diagramCellType); ok {
+		name, _ = v.summary()
+	}
+	wrappedOutputs := make([]RowReceiver, len(outputs))
+	for i := range outputs {
+		wrappedOutputs[i] = &outputStatCollector{
+			RowReceiver: outputs[i],
+			stats: ProcessorStats{
+				NodeID:       f.nodeID,
+				ProcessorIdx: int32(procIdx),
+				StageID:      ps.StageID,
+				Processor:    name,
+			},
+			inputs: inputCollectors,
+			mon:    procMon,
+		}
+	}
+	return wrappedInputs, wrappedOutputs
+}
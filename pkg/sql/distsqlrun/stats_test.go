@@ -0,0 +1,147 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"math"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// TestProcessorStats verifies that a processor wrapped with stat collectors
+// sends its execution statistics when it is done.
+func TestProcessorStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	f := &Flow{FlowCtx: FlowCtx{
+		Settings: cluster.MakeTestingClusterSettings(),
+		EvalCtx:  evalCtx,
+		nodeID:   3,
+	}}
+	procMon := mon.MakeUnlimitedMonitor(ctx, "test", mon.MemoryResource, nil, nil, math.MaxInt64)
+	defer procMon.Stop(ctx)
+
+	const numRows = 10
+	intType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	rows := make(sqlbase.EncDatumRows, numRows)
+	for i := range rows {
+		rows[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(intType, parser.NewDInt(parser.DInt(i))),
+		}
+	}
+	in := NewRowBuffer([]sqlbase.ColumnType{intType}, rows, RowBufferArgs{})
+	out := &RowBuffer{}
+	ps := &ProcessorSpec{Core: ProcessorCoreUnion{Noop: &NoopCoreSpec{}}, StageID: 2}
+	inputs, outputs := f.wrapWithStatCollectors(
+		1 /* procIdx */, ps, []RowSource{in}, []RowReceiver{out}, &procMon,
+	)
+	p, err := newNoopProcessor(&f.FlowCtx, inputs[0], &PostProcessSpec{}, outputs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Run(ctx, nil)
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+
+	var stats *ProcessorStats
+	outRows := 0
+	for {
+		row, meta := out.Next()
+		if row == nil && meta.Empty() {
+			break
+		}
+		if row != nil {
+			outRows++
+			continue
+		}
+		if meta.Stats == nil {
+			t.Fatalf("unexpected metadata: %v", meta)
+		}
+		if stats != nil {
+			t.Fatalf("stats sent multiple times")
+		}
+		stats = meta.Stats
+	}
+	if outRows != numRows {
+		t.Fatalf("expected %d rows, got %d", numRows, outRows)
+	}
+	if stats == nil {
+		t.Fatal("no stats sent")
+	}
+	if stats.NodeID != 3 || stats.ProcessorIdx != 1 || stats.StageID != 2 || stats.Processor != "No-op" {
+		t.Errorf("invalid processor identification in stats: %+v", stats)
+	}
+	if stats.InputRows != numRows || stats.OutputRows != numRows {
+		t.Errorf("expected %d rows in and out, got %d in and %d out",
+			numRows, stats.InputRows, stats.OutputRows)
+	}
+	if expected := int64(rows[0].Size()) * numRows; stats.OutputBytes < expected {
+		t.Errorf("expected at least %d bytes out, got %d", expected, stats.OutputBytes)
+	}
+}
+
+// TestProcessorSpanMaxMemory verifies that the peak memory usage of a
+// processor is recorded in its span when its trace is sent.
+func TestProcessorSpanMaxMemory(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx, sp, err := tracing.StartSnowballTrace(context.Background(), tracing.NewTracer(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Finish()
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	procMon := mon.MakeUnlimitedMonitor(ctx, "test", mon.MemoryResource, nil, nil, math.MaxInt64)
+	defer procMon.Stop(ctx)
+	flowCtx := &FlowCtx{Settings: cluster.MakeTestingClusterSettings(), EvalCtx: evalCtx}
+	flowCtx.EvalCtx.Mon = &procMon
+
+	// The memory is released before the trace is sent; the peak usage is
+	// recorded nonetheless.
+	acc := procMon.MakeBoundAccount()
+	if err := acc.Grow(ctx, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	acc.Close(ctx)
+
+	procCtx, procSp := processorSpan(ctx, flowCtx, "test processor")
+	out := &RowBuffer{}
+	sendTraceData(procCtx, out)
+	tracing.FinishSpan(procSp)
+
+	_, meta := out.Next()
+	if len(meta.TraceData) == 0 {
+		t.Fatalf("expected trace data, got %+v", meta)
+	}
+	expected := humanizeutil.IBytes(procMon.MaximumBytes())
+	if tag := meta.TraceData[0].Tags["max_memory"]; tag != expected {
+		t.Fatalf("expected max_memory tag %q, got %q", expected, tag)
+	}
+}
@@ -17,10 +17,12 @@ package distsqlrun
 import (
 	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
 
 	"golang.org/x/net/context"
 
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/randutil"
@@ -48,9 +50,12 @@ func testGetDecodedRows(
 	return decodedRows, metas
 }
 
-func testRowStream(t *testing.T, rng *rand.Rand, records []rowOrMeta) {
+func testRowStream(
+	t *testing.T, rng *rand.Rand, records []rowOrMeta, compression StreamCompression,
+) {
 	var se StreamEncoder
 	var sd StreamDecoder
+	se.setCompression(compression)
 
 	var decodedRows sqlbase.EncDatumRows
 	var metas []ProducerMetadata
@@ -116,11 +121,60 @@ func TestStreamEncodeDecode(t *testing.T) {
 					rows[i].row[j] = sqlbase.DatumToEncDatum(info[j].Type,
 						sqlbase.RandDatum(rng, info[j].Type, true))
 				}
-			} else {
+			} else if rng.Intn(2) == 0 {
 				rows[i].meta.Err = fmt.Errorf("test error %d", i)
+			} else {
+				rows[i].meta.Progress = &ProcessorProgress{
+					Processor:    "test",
+					RowsConsumed: int64(i),
+				}
 			}
 		}
-		testRowStream(t, rng, rows)
+		testRowStream(t, rng, rows, StreamCompression_UNCOMPRESSED)
+		testRowStream(t, rng, rows, StreamCompression_SNAPPY)
+	}
+}
+
+// TestStreamCompression verifies that compressible rows are sent compressed
+// and decoded correctly.
+func TestStreamCompression(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	strType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	row := sqlbase.EncDatumRow{
+		sqlbase.DatumToEncDatum(strType, parser.NewDString(strings.Repeat("a", 1000))),
+	}
+	const numRows = 10
+
+	var se StreamEncoder
+	var sd StreamDecoder
+	se.setCompression(StreamCompression_SNAPPY)
+	for i := 0; i < numRows; i++ {
+		if err := se.AddRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg := se.FormMessage(context.TODO())
+	if msg.Data.Compression != StreamCompression_SNAPPY {
+		t.Fatalf("expected compressed rows, got %s", msg.Data.Compression)
+	}
+	if n := len(msg.Data.RawBytes); n >= numRows*1000 {
+		t.Fatalf("expected compressed rows to be smaller than %d bytes, got %d", numRows*1000, n)
+	}
+	if err := sd.AddMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	rows, metas := testGetDecodedRows(t, &sd, nil /* decodedRows */, nil /* metas */)
+	if len(metas) != 0 {
+		t.Fatalf("unexpected metadata: %v", metas)
+	}
+	if len(rows) != numRows {
+		t.Fatalf("expected %d rows, got %d", numRows, len(rows))
+	}
+	for _, r := range rows {
+		if s := r.String(); s != row.String() {
+			t.Fatalf("expected %s, got %s", row.String(), s)
+		}
 	}
 }
 
@@ -15,6 +15,9 @@
 package distsqlrun
 
 import (
+	"github.com/golang/snappy"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/pkg/errors"
 )
@@ -79,17 +82,29 @@ func (sd *StreamDecoder) AddMessage(msg *ProducerMessage) error {
 			return errors.Errorf("received data before header and/or typing info")
 		}
 
+		rawBytes := msg.Data.RawBytes
+		switch msg.Data.Compression {
+		case StreamCompression_UNCOMPRESSED:
+		case StreamCompression_SNAPPY:
+			var err error
+			if rawBytes, err = snappy.Decode(nil /* dst */, rawBytes); err != nil {
+				return errors.Wrap(err, "decompressing rows")
+			}
+		default:
+			return errors.Errorf("unsupported stream compression %s", msg.Data.Compression)
+		}
+
 		if len(sd.data) == 0 {
 			// We limit the capacity of the slice (using "three-index slices") out of
 			// paranoia: if the slice is going to need to grow later, we don't want to
 			// clobber any memory outside what the protobuf allocated for us
 			// initially (in case this memory might be coming from some buffer).
-			sd.data = msg.Data.RawBytes[:len(msg.Data.RawBytes):len(msg.Data.RawBytes)]
+			sd.data = rawBytes[:len(rawBytes):len(rawBytes)]
 		} else {
 			// This can only happen if we don't retrieve all the rows before
 			// adding another message, which shouldn't be the normal case.
 			// TODO(radu): maybe don't support this case at all?
-			sd.data = append(sd.data, msg.Data.RawBytes...)
+			sd.data = append(sd.data, rawBytes...)
 		}
 	}
 	if msg.Data.NumEmptyRows > 0 {
@@ -108,6 +123,26 @@ func (sd *StreamDecoder) AddMessage(msg *ProducerMessage) error {
 			case *RemoteProducerMetadata_TraceData_:
 				meta.TraceData = v.TraceData.CollectedSpans
 
+			case *RemoteProducerMetadata_Progress:
+				meta.Progress = v.Progress
+
+			case *RemoteProducerMetadata_Stats:
+				meta.Stats = v.Stats
+
+			case *RemoteProducerMetadata_LeafTxnFinalState:
+				meta.LeafTxn = v.LeafTxnFinalState
+
+			case *RemoteProducerMetadata_LeafTxn:
+				// Older nodes only send the leaf's Transaction proto. The reads of
+				// their leaf txns can't be refreshed.
+				meta.LeafTxn = &roachpb.LeafTxnFinalState{
+					Txn:            *v.LeafTxn,
+					RefreshInvalid: true,
+				}
+
+			case *RemoteProducerMetadata_Checkpoint:
+				meta.Checkpoint = v.Checkpoint
+
 			case *RemoteProducerMetadata_Error:
 				meta.Err = v.Error.ErrorDetail()
 
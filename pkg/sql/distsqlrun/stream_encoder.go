@@ -15,6 +15,7 @@
 package distsqlrun
 
 import (
+	"github.com/golang/snappy"
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
@@ -54,6 +55,11 @@ type StreamEncoder struct {
 	typingSent bool
 	alloc      sqlbase.DatumAlloc
 
+	// compression is the compression used for the encoded rows; compressedBuf
+	// holds the compressed rows of the last message.
+	compression   StreamCompression
+	compressedBuf []byte
+
 	// Preallocated structures to avoid allocations.
 	msg    ProducerMessage
 	msgHdr ProducerHeader
@@ -64,6 +70,12 @@ func (se *StreamEncoder) setHeaderFields(flowID FlowID, streamID StreamID) {
 	se.msgHdr.StreamID = streamID
 }
 
+// setCompression sets the compression used for the encoded rows of the
+// messages.
+func (se *StreamEncoder) setCompression(compression StreamCompression) {
+	se.compression = compression
+}
+
 // AddMetadata encodes a metadata message. Unlike AddRow(), it cannot fail. This
 // is important for the caller because a failure to encode a piece of metadata
 // (particularly one that contains an error) would not be recoverable.
@@ -86,6 +98,22 @@ func (se *StreamEncoder) AddMetadata(meta ProducerMetadata) {
 				CollectedSpans: meta.TraceData,
 			},
 		}
+	} else if meta.Progress != nil {
+		enc.Value = &RemoteProducerMetadata_Progress{
+			Progress: meta.Progress,
+		}
+	} else if meta.Stats != nil {
+		enc.Value = &RemoteProducerMetadata_Stats{
+			Stats: meta.Stats,
+		}
+	} else if meta.LeafTxn != nil {
+		enc.Value = &RemoteProducerMetadata_LeafTxnFinalState{
+			LeafTxnFinalState: meta.LeafTxn,
+		}
+	} else if meta.Checkpoint != nil {
+		enc.Value = &RemoteProducerMetadata_Checkpoint{
+			Checkpoint: meta.Checkpoint,
+		}
 	} else {
 		enc.Value = &RemoteProducerMetadata_Error{
 			Error: NewError(meta.Err),
@@ -135,6 +163,16 @@ func (se *StreamEncoder) FormMessage(ctx context.Context) *ProducerMessage {
 	msg := &se.msg
 	msg.Header = nil
 	msg.Data.RawBytes = se.rowBuf
+	msg.Data.Compression = StreamCompression_UNCOMPRESSED
+	if se.compression == StreamCompression_SNAPPY && len(se.rowBuf) > 0 {
+		se.compressedBuf = snappy.Encode(se.compressedBuf[:cap(se.compressedBuf)], se.rowBuf)
+		// The rows are sent uncompressed if compression doesn't make them
+		// smaller.
+		if len(se.compressedBuf) < len(se.rowBuf) {
+			msg.Data.RawBytes = se.compressedBuf
+			msg.Data.Compression = StreamCompression_SNAPPY
+		}
+	}
 	msg.Data.NumEmptyRows = int32(se.numEmptyRows)
 	msg.Data.Metadata = make([]RemoteProducerMetadata, len(se.metadata))
 	copy(msg.Data.Metadata, se.metadata)
@@ -15,18 +15,35 @@
 package distsqlrun
 
 import (
+	"encoding/binary"
 	"fmt"
 	"sync"
 
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 )
 
+const (
+	// tableReaderMinParallelSpans is the number of spans from which a
+	// tableReader without a limit scans groups of spans concurrently.
+	tableReaderMinParallelSpans = 4
+	// tableReaderMaxParallelScans is the maximum number of concurrent scans of
+	// a tableReader.
+	tableReaderMaxParallelScans = 4
+	// tableReaderParallelBufSize is the number of rows each concurrent scan can
+	// retrieve ahead of the rows being emitted.
+	tableReaderParallelBufSize = 256
+	// tableReaderProgressRows is the number of rows a tableReader reads between
+	// progress reports.
+	tableReaderProgressRows = 10000
+)
+
 // tableReader is the start of a computation flow; it performs KV operations to
 // retrieve rows for a table, runs a filter expression, and passes rows with the
 // desired column values to an output RowReceiver.
@@ -37,11 +54,32 @@ type tableReader struct {
 	flowCtx *FlowCtx
 
 	tableID   sqlbase.ID
+	desc      sqlbase.TableDescriptor
+	indexIdx  int
+	reverse   bool
 	spans     roachpb.Spans
 	limitHint int64
 
 	fetcher sqlbase.RowFetcher
 	alloc   sqlbase.DatumAlloc
+	// neededColumns are the columns decoded by the fetchers.
+	neededColumns []bool
+
+	// runtimeFilter, if set, receives the run-time filter built by a hash
+	// joiner of the flow (see RuntimeFilterSpec). Once it's published, the rows
+	// whose runtimeFilterCols aren't in the filter are skipped.
+	runtimeFilter     *runtimeFilter
+	runtimeFilterCols columns
+	// rowsSkipped counts the rows skipped because of the run-time filter.
+	rowsSkipped   int64
+	filterScratch []byte
+
+	// rowsRead counts the rows read so far. Progress metadata is emitted every
+	// tableReaderProgressRows of them.
+	rowsRead int64
+	// testingKnobProgressRows is used in testing to override the number of
+	// rows between progress reports.
+	testingKnobProgressRows int64
 }
 
 var _ Processor = &tableReader{}
@@ -54,8 +92,11 @@ func newTableReader(
 		return nil, errors.Errorf("attempting to create a tableReader with uninitialized NodeID")
 	}
 	tr := &tableReader{
-		flowCtx: flowCtx,
-		tableID: spec.Table.ID,
+		flowCtx:  flowCtx,
+		tableID:  spec.Table.ID,
+		desc:     spec.Table,
+		indexIdx: int(spec.IndexIdx),
+		reverse:  spec.Reverse,
 	}
 
 	// We ignore any limits that are higher than this value to avoid any
@@ -99,9 +140,20 @@ func newTableReader(
 		return nil, err
 	}
 
-	desc := spec.Table
+	tr.neededColumns = tr.out.neededColumns()
+	if spec.RuntimeFilter != nil && flowCtx.runtimeFilters != nil {
+		for _, c := range spec.RuntimeFilter.Columns {
+			if int(c) >= len(types) {
+				return nil, errors.Errorf("invalid run-time filter column %d", c)
+			}
+			tr.neededColumns[c] = true
+		}
+		tr.runtimeFilter = flowCtx.runtimeFilters.get(spec.RuntimeFilter.ID)
+		tr.runtimeFilterCols = spec.RuntimeFilter.Columns
+	}
+
 	if _, _, err := initRowFetcher(
-		&tr.fetcher, &desc, int(spec.IndexIdx), spec.Reverse, tr.out.neededColumns(), &tr.alloc,
+		&tr.fetcher, &tr.desc, tr.indexIdx, tr.reverse, tr.neededColumns, &tr.alloc,
 	); err != nil {
 		return nil, err
 	}
@@ -149,10 +201,11 @@ func initRowFetcher(
 }
 
 // sendMisplannedRangesMetadata sends information about the non-local ranges
-// that were read by this tableReader. This should be called after the fetcher
-// was used to read everything this tableReader was supposed to read.
-func (tr *tableReader) sendMisplannedRangesMetadata(ctx context.Context) {
-	rangeInfos := tr.fetcher.GetRangeInfo()
+// that were read by this tableReader. This should be called after the fetchers
+// were used to read everything this tableReader was supposed to read.
+func (tr *tableReader) sendMisplannedRangesMetadata(
+	ctx context.Context, rangeInfos []roachpb.RangeInfo,
+) {
 	var misplannedRanges []roachpb.RangeInfo
 	for _, ri := range rangeInfos {
 		if ri.Lease.Replica.NodeID != tr.flowCtx.nodeID {
@@ -179,7 +232,7 @@ func (tr *tableReader) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 
 	ctx = log.WithLogTagInt(ctx, "TableReader", int(tr.tableID))
-	ctx, span := processorSpan(ctx, "table reader")
+	ctx, span := processorSpan(ctx, tr.flowCtx, "table reader")
 	defer tracing.FinishSpan(span)
 
 	txn := tr.flowCtx.txn
@@ -192,9 +245,17 @@ func (tr *tableReader) Run(ctx context.Context, wg *sync.WaitGroup) {
 		defer log.Infof(ctx, "exiting")
 	}
 
-	if err := tr.fetcher.StartScan(
-		ctx, txn, tr.spans, true /* limit batches */, tr.limitHint,
-	); err != nil {
+	// Without a limit, all the rows are needed and many spans (e.g. from an IN
+	// list) can be scanned concurrently.
+	if tr.limitHint == 0 && len(tr.spans) >= tableReaderMinParallelSpans {
+		tr.runParallel(ctx, txn)
+		return
+	}
+
+	// The batches start small and grow as rows are consumed, which avoids
+	// reading too much when only a few rows are needed while keeping the number
+	// of round trips low for large scans.
+	if err := tr.fetcher.StartAdaptiveScan(ctx, txn, tr.spans, tr.limitHint); err != nil {
 		log.Errorf(ctx, "scan error: %s", err)
 		tr.out.output.Push(nil /* row */, ProducerMetadata{Err: err})
 		tr.out.Close()
@@ -202,6 +263,13 @@ func (tr *tableReader) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 
 	for {
+		if pausedCh := tr.flowCtx.pauseGate.pausedCh(); pausedCh != nil {
+			completed := completedSpans(tr.spans, tr.reverse, tr.fetcher.Key())
+			if err := tr.waitWhilePaused(ctx, pausedCh, completed); err != nil {
+				tr.out.output.Push(nil /* row */, ProducerMetadata{Err: err})
+				break
+			}
+		}
 		// TODO(radu,andrei,knz): set the traceKV flag when requested by the session.
 		fetcherRow, err := tr.fetcher.NextRow(ctx, false /* traceKV */)
 		if err != nil || fetcherRow == nil {
@@ -210,6 +278,13 @@ func (tr *tableReader) Run(ctx context.Context, wg *sync.WaitGroup) {
 			}
 			break
 		}
+		tr.rowRead(func() float64 { return scannedFraction(tr.spans, tr.reverse, tr.fetcher.Key()) })
+		if skip, err := tr.skipRow(fetcherRow); err != nil {
+			tr.out.output.Push(nil /* row */, ProducerMetadata{Err: err})
+			break
+		} else if skip {
+			continue
+		}
 		// Emit the row; stop if no more rows are needed.
 		consumerStatus, err := tr.out.EmitRow(ctx, fetcherRow)
 		if err != nil || consumerStatus != NeedMoreRows {
@@ -219,7 +294,346 @@ func (tr *tableReader) Run(ctx context.Context, wg *sync.WaitGroup) {
 			break
 		}
 	}
-	tr.sendMisplannedRangesMetadata(ctx)
+	tr.logRowsSkipped(ctx)
+	tr.sendMisplannedRangesMetadata(ctx, tr.fetcher.GetRangeInfo())
+	sendLeafTxnState(ctx, tr.flowCtx, tr.out.output)
 	sendTraceData(ctx, tr.out.output)
 	tr.out.Close()
 }
+
+// runParallel splits the spans into groups which are scanned concurrently, and
+// emits the rows of one group after the other so that they are ordered as with
+// a single scan.
+func (tr *tableReader) runParallel(ctx context.Context, txn *client.Txn) {
+	groupSize := (len(tr.spans) + tableReaderMaxParallelScans - 1) / tableReaderMaxParallelScans
+	var scans []*spanScan
+	for i := 0; i < len(tr.spans); i += groupSize {
+		end := i + groupSize
+		if end > len(tr.spans) {
+			end = len(tr.spans)
+		}
+		s := &spanScan{
+			spans: tr.spans[i:end],
+			rows:  make(chan sqlbase.EncDatumRow, tableReaderParallelBufSize),
+		}
+		if _, _, err := initRowFetcher(
+			&s.fetcher, &tr.desc, tr.indexIdx, tr.reverse, tr.neededColumns, &s.alloc,
+		); err != nil {
+			tr.out.output.Push(nil /* row */, ProducerMetadata{Err: err})
+			tr.out.Close()
+			return
+		}
+		scans = append(scans, s)
+	}
+	if tr.reverse {
+		// A reverse scan returns the rows of the last spans first.
+		for i, j := 0, len(scans)-1; i < j; i, j = i+1, j-1 {
+			scans[i], scans[j] = scans[j], scans[i]
+		}
+	}
+	log.VEventf(ctx, 1, "scanning %d spans with %d concurrent scans", len(tr.spans), len(scans))
+
+	scanCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(len(scans))
+	for _, s := range scans {
+		go func(s *spanScan) {
+			defer wg.Done()
+			s.run(scanCtx, txn)
+		}(s)
+	}
+	err := tr.emitScans(ctx, scans)
+	// Stop the scans that are still running if we're done early.
+	cancel()
+	wg.Wait()
+	if err != nil {
+		tr.out.output.Push(nil /* row */, ProducerMetadata{Err: err})
+	}
+
+	var rangeInfos []roachpb.RangeInfo
+	for _, s := range scans {
+		for _, ri := range s.fetcher.GetRangeInfo() {
+			rangeInfos = roachpb.InsertRangeInfo(rangeInfos, ri)
+		}
+	}
+	tr.logRowsSkipped(ctx)
+	tr.sendMisplannedRangesMetadata(ctx, rangeInfos)
+	sendLeafTxnState(ctx, tr.flowCtx, tr.out.output)
+	sendTraceData(ctx, tr.out.output)
+	tr.out.Close()
+}
+
+// emitScans emits the rows of the given scans in order, until they are all
+// done or no more rows are needed.
+func (tr *tableReader) emitScans(ctx context.Context, scans []*spanScan) error {
+	// completed are the spans of the scans whose rows were all emitted. The
+	// progress within a scan is not tracked since the rows are read ahead.
+	var completed roachpb.Spans
+	for _, s := range scans {
+		for row := range s.rows {
+			if pausedCh := tr.flowCtx.pauseGate.pausedCh(); pausedCh != nil {
+				if err := tr.waitWhilePaused(ctx, pausedCh, completed); err != nil {
+					return err
+				}
+			}
+			tr.rowRead(func() float64 { return float64(len(completed)) / float64(len(tr.spans)) })
+			if skip, err := tr.skipRow(row); err != nil {
+				return err
+			} else if skip {
+				continue
+			}
+			consumerStatus, err := tr.out.EmitRow(ctx, row)
+			if err != nil {
+				return err
+			}
+			if consumerStatus != NeedMoreRows {
+				return nil
+			}
+		}
+		if s.err != nil {
+			return s.err
+		}
+		completed = append(completed, s.spans...)
+	}
+	return nil
+}
+
+// rowRead counts a row read from KV, and periodically sends progress metadata
+// with an estimate of the total number of rows to read; scannedFraction
+// estimates the fraction of the spans which was scanned.
+func (tr *tableReader) rowRead(scannedFraction func() float64) {
+	tr.rowsRead++
+	progressRows := tr.testingKnobProgressRows
+	if progressRows <= 0 {
+		progressRows = tableReaderProgressRows
+	}
+	if tr.rowsRead%progressRows != 0 {
+		return
+	}
+	var estimatedRows int64
+	if f := scannedFraction(); f > 0 {
+		estimatedRows = int64(float64(tr.rowsRead) / f)
+		if estimatedRows < tr.rowsRead {
+			estimatedRows = tr.rowsRead
+		}
+	}
+	tr.out.output.Push(nil /* row */, ProducerMetadata{Progress: &ProcessorProgress{
+		NodeID:        tr.flowCtx.nodeID,
+		ProcessorIdx:  tr.flowCtx.processorIdx,
+		Processor:     "table reader",
+		RowsRead:      tr.rowsRead,
+		EstimatedRows: estimatedRows,
+	}})
+}
+
+// skipRow returns whether the given row can be skipped because it doesn't
+// pass the run-time filter, once the filter is published.
+func (tr *tableReader) skipRow(row sqlbase.EncDatumRow) (bool, error) {
+	if tr.runtimeFilter == nil {
+		return false, nil
+	}
+	filter := tr.runtimeFilter.load()
+	if filter == nil {
+		return false, nil
+	}
+	encoded, hasNull, err := encodeColumnsOfRow(
+		&tr.alloc, tr.filterScratch[:0], row, tr.runtimeFilterCols, false, /* encodeNull */
+	)
+	if err != nil {
+		return false, err
+	}
+	tr.filterScratch = encoded
+	// NULLs never satisfy the equality of the join.
+	if hasNull || !filter.MayContain(encoded) {
+		tr.rowsSkipped++
+		return true, nil
+	}
+	return false, nil
+}
+
+func (tr *tableReader) logRowsSkipped(ctx context.Context) {
+	if tr.runtimeFilter != nil {
+		log.VEventf(ctx, 1, "skipped %d rows with the run-time filter", tr.rowsSkipped)
+	}
+}
+
+// waitWhilePaused sends a checkpoint with the given completed spans and waits
+// until the flow is resumed, i.e. until pausedCh is closed. It returns an error
+// if the context is canceled in the meantime.
+func (tr *tableReader) waitWhilePaused(
+	ctx context.Context, pausedCh <-chan struct{}, completed roachpb.Spans,
+) error {
+	log.VEventf(ctx, 1, "paused with %d completed spans", len(completed))
+	tr.out.output.Push(nil /* row */, ProducerMetadata{
+		Checkpoint: &ScanCheckpoint{CompletedSpans: completed},
+	})
+	select {
+	case <-pausedCh:
+		log.VEventf(ctx, 1, "resumed")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// completedSpans returns the parts of the given (ordered) spans which were
+// scanned by a RowFetcher whose next key is key; a nil key means that the scan
+// is done.
+func completedSpans(spans roachpb.Spans, reverse bool, key roachpb.Key) roachpb.Spans {
+	if key == nil {
+		return append(roachpb.Spans(nil), spans...)
+	}
+	var completed roachpb.Spans
+	if !reverse {
+		// The keys before key were scanned.
+		for _, s := range spans {
+			if key.Compare(s.EndKey) >= 0 {
+				completed = append(completed, s)
+				continue
+			}
+			if key.Compare(s.Key) > 0 {
+				completed = append(completed, roachpb.Span{Key: s.Key, EndKey: key})
+			}
+			break
+		}
+		return completed
+	}
+	// The keys after key were scanned.
+	for i := len(spans) - 1; i >= 0; i-- {
+		s := spans[i]
+		if key.Compare(s.Key) < 0 {
+			completed = append(completed, s)
+			continue
+		}
+		if start := key.Next(); start.Compare(s.EndKey) < 0 {
+			completed = append(completed, roachpb.Span{Key: start, EndKey: s.EndKey})
+		}
+		break
+	}
+	// Return the spans in order.
+	for i, j := 0, len(completed)-1; i < j; i, j = i+1, j-1 {
+		completed[i], completed[j] = completed[j], completed[i]
+	}
+	return completed
+}
+
+// scannedFraction estimates the fraction of the given (ordered) spans which was
+// scanned by a RowFetcher whose next key is key; a nil key means that the scan
+// is done. Each span counts equally, and the fraction of a partially scanned
+// span is interpolated from the keys (see keyFraction).
+func scannedFraction(spans roachpb.Spans, reverse bool, key roachpb.Key) float64 {
+	if key == nil {
+		return 1
+	}
+	var scanned float64
+	for _, s := range spans {
+		var f float64
+		switch {
+		case key.Compare(s.Key) < 0:
+			if reverse {
+				f = 1
+			}
+		case key.Compare(s.EndKey) >= 0:
+			if !reverse {
+				f = 1
+			}
+		default:
+			f = keyFraction(s.Key, s.EndKey, key)
+			if reverse {
+				f = 1 - f
+			}
+		}
+		scanned += f
+	}
+	return scanned / float64(len(spans))
+}
+
+// keyFraction estimates the position of key within [start, end) as a
+// fraction between 0 and 1, by interpreting the 8 bytes which follow the
+// common prefix of start and end as integers.
+func keyFraction(start, end, key roachpb.Key) float64 {
+	prefix := 0
+	for prefix < len(start) && prefix < len(end) && start[prefix] == end[prefix] {
+		prefix++
+	}
+	toUint := func(k roachpb.Key) uint64 {
+		var buf [8]byte
+		if len(k) > prefix {
+			copy(buf[:], k[prefix:])
+		}
+		return binary.BigEndian.Uint64(buf[:])
+	}
+	s, e, k := toUint(start), toUint(end), toUint(key)
+	if k <= s || e <= s {
+		return 0
+	}
+	if k >= e {
+		return 1
+	}
+	return float64(k-s) / float64(e-s)
+}
+
+// RemainingSpans returns the parts of the given spans which are not covered by
+// the completed spans of a ScanCheckpoint. The spans must have an EndKey. It
+// is used to plan the scan of a table reader again after its flow was paused
+// and canceled.
+func RemainingSpans(spans, completed roachpb.Spans) roachpb.Spans {
+	var remaining roachpb.Spans
+	for _, s := range spans {
+		pending := roachpb.Spans{s}
+		for _, c := range completed {
+			var next roachpb.Spans
+			for _, p := range pending {
+				if c.EndKey.Compare(p.Key) <= 0 || c.Key.Compare(p.EndKey) >= 0 {
+					next = append(next, p)
+					continue
+				}
+				if p.Key.Compare(c.Key) < 0 {
+					next = append(next, roachpb.Span{Key: p.Key, EndKey: c.Key})
+				}
+				if c.EndKey.Compare(p.EndKey) < 0 {
+					next = append(next, roachpb.Span{Key: c.EndKey, EndKey: p.EndKey})
+				}
+			}
+			pending = next
+		}
+		remaining = append(remaining, pending...)
+	}
+	return remaining
+}
+
+// spanScan is one of the concurrent scans of a tableReader. See
+// tableReader.runParallel.
+type spanScan struct {
+	spans    roachpb.Spans
+	fetcher  sqlbase.RowFetcher
+	alloc    sqlbase.DatumAlloc
+	rowAlloc sqlbase.EncDatumRowAlloc
+
+	// rows receives the rows of the scan, and is closed when the scan is done.
+	rows chan sqlbase.EncDatumRow
+	// err is set before rows is closed if the scan failed.
+	err error
+}
+
+// run scans the spans, sending copies of the rows on s.rows, until it's done
+// or the context is canceled.
+func (s *spanScan) run(ctx context.Context, txn *client.Txn) {
+	defer close(s.rows)
+	if err := s.fetcher.StartAdaptiveScan(ctx, txn, s.spans, 0 /* limitHint */); err != nil {
+		s.err = err
+		return
+	}
+	for {
+		row, err := s.fetcher.NextRow(ctx, false /* traceKV */)
+		if err != nil || row == nil {
+			s.err = err
+			return
+		}
+		select {
+		case s.rows <- s.rowAlloc.CopyRow(row):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
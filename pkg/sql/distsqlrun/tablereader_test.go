@@ -15,6 +15,7 @@
 package distsqlrun
 
 import (
+	"reflect"
 	"sort"
 	"testing"
 
@@ -27,6 +28,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/bloom"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 )
@@ -111,6 +113,38 @@ func TestTableReader(t *testing.T) {
 			},
 			expected: "[[2 5] [1 5] [0 5] [2 4] [1 4] [0 4]]",
 		},
+		// Many spans are scanned concurrently; the rows are still ordered.
+		{
+			spec: TableReaderSpec{
+				IndexIdx: 1,
+				Spans: []TableReaderSpan{
+					makeIndexSpan(0, 1), makeIndexSpan(2, 3), makeIndexSpan(4, 5),
+					makeIndexSpan(6, 7), makeIndexSpan(8, 9),
+				},
+			},
+			post: PostProcessSpec{
+				Filter:        Expression{Expr: "@1 < 2"}, // a < 2
+				Projection:    true,
+				OutputColumns: []uint32{0, 1},
+			},
+			expected: "[[1 0] [1 2] [0 2] [0 4] [1 4] [1 6] [0 6] [0 8] [1 8]]",
+		},
+		{
+			spec: TableReaderSpec{
+				IndexIdx: 1,
+				Reverse:  true,
+				Spans: []TableReaderSpan{
+					makeIndexSpan(0, 1), makeIndexSpan(2, 3), makeIndexSpan(4, 5),
+					makeIndexSpan(6, 7), makeIndexSpan(8, 9),
+				},
+			},
+			post: PostProcessSpec{
+				Filter:        Expression{Expr: "@1 < 2"}, // a < 2
+				Projection:    true,
+				OutputColumns: []uint32{0, 1},
+			},
+			expected: "[[1 8] [0 8] [0 6] [1 6] [1 4] [0 4] [0 2] [1 2] [1 0]]",
+		},
 	}
 
 	for _, c := range testCases {
@@ -246,3 +280,298 @@ ALTER TABLE t TESTING_RELOCATE VALUES (ARRAY[2], 1), (ARRAY[1], 2), (ARRAY[3], 3
 		t.Fatalf("expected misplanned ranges from nodes 2 and 3, got: %+v", metas[0])
 	}
 }
+
+// Test that a TableReader running in a leaf txn sends the state of the leaf,
+// and that the root txn absorbs the clock observations made by the reads.
+func TestTableReaderLeafTxnState(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"num INT PRIMARY KEY",
+		3, /* numRows */
+		sqlutils.ToRowFn(sqlutils.RowIdxFn))
+
+	// Pass a DB without a TxnCoordSender.
+	db := client.NewDB(s.DistSender(), s.Clock())
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+	root := client.NewTxn(db)
+	leaf := client.NewLeafTxn(db, *root.Proto())
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		txn:      leaf,
+		nodeID:   s.NodeID(),
+	}
+	spec := TableReaderSpec{
+		Spans: []TableReaderSpan{{Span: td.PrimaryIndexSpan()}},
+		Table: *td,
+	}
+
+	out := &RowBuffer{}
+	tr, err := newTableReader(&flowCtx, &spec, &PostProcessSpec{}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Run(context.Background(), nil)
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+	var leafState *roachpb.LeafTxnFinalState
+	for {
+		row, meta := out.Next()
+		if meta.LeafTxn != nil {
+			leafState = meta.LeafTxn
+			continue
+		}
+		if !meta.Empty() {
+			t.Fatalf("unexpected metadata: %+v", meta)
+		}
+		if row == nil {
+			break
+		}
+	}
+	if leafState == nil {
+		t.Fatal("expected metadata with the leaf txn state")
+	}
+	if len(leafState.RefreshSpans) == 0 {
+		t.Fatal("expected the leaf txn state to contain the spans read")
+	}
+
+	nodeID := s.NodeID()
+	if _, ok := root.Proto().GetObservedTimestamp(nodeID); ok {
+		t.Fatalf("unexpected observed timestamp in root txn: %s", root.Proto())
+	}
+	root.UpdateStateOnLeafTxn(context.Background(), leafState)
+	if _, ok := root.Proto().GetObservedTimestamp(nodeID); !ok {
+		t.Fatalf("expected observed timestamp for node %d in root txn: %s", nodeID, root.Proto())
+	}
+}
+
+func TestTableReaderCheckpointSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	sp := func(start, end string) roachpb.Span {
+		return roachpb.Span{Key: roachpb.Key(start), EndKey: roachpb.Key(end)}
+	}
+	spans := roachpb.Spans{sp("b", "d"), sp("f", "h")}
+
+	testCases := []struct {
+		reverse   bool
+		key       roachpb.Key
+		completed roachpb.Spans
+		remaining roachpb.Spans
+	}{
+		{false, roachpb.Key("b"), nil, spans},
+		{false, roachpb.Key("c"), roachpb.Spans{sp("b", "c")}, roachpb.Spans{sp("c", "d"), sp("f", "h")}},
+		{false, roachpb.Key("f"), roachpb.Spans{sp("b", "d")}, roachpb.Spans{sp("f", "h")}},
+		{false, roachpb.Key("g"), roachpb.Spans{sp("b", "d"), sp("f", "g")}, roachpb.Spans{sp("g", "h")}},
+		{false, nil, spans, nil},
+		{true, roachpb.Key("g"), roachpb.Spans{sp("g\x00", "h")}, roachpb.Spans{sp("b", "d"), sp("f", "g\x00")}},
+		{true, roachpb.Key("c"), roachpb.Spans{sp("c\x00", "d"), sp("f", "h")}, roachpb.Spans{sp("b", "c\x00")}},
+		{true, nil, spans, nil},
+	}
+	for _, tc := range testCases {
+		completed := completedSpans(spans, tc.reverse, tc.key)
+		if !reflect.DeepEqual(completed, tc.completed) {
+			t.Errorf("reverse=%t key=%s: expected completed spans %v, got %v",
+				tc.reverse, tc.key, tc.completed, completed)
+		}
+		if remaining := RemainingSpans(spans, completed); !reflect.DeepEqual(remaining, tc.remaining) {
+			t.Errorf("reverse=%t key=%s: expected remaining spans %v, got %v",
+				tc.reverse, tc.key, tc.remaining, remaining)
+		}
+	}
+}
+
+func TestTableReaderScannedFraction(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	sp := func(start, end string) roachpb.Span {
+		return roachpb.Span{Key: roachpb.Key(start), EndKey: roachpb.Key(end)}
+	}
+	spans := roachpb.Spans{sp("b", "d"), sp("f", "h")}
+
+	testCases := []struct {
+		reverse  bool
+		key      roachpb.Key
+		expected float64
+	}{
+		{false, roachpb.Key("b"), 0},
+		{false, roachpb.Key("c"), 0.25},
+		{false, roachpb.Key("f"), 0.5},
+		{false, roachpb.Key("g"), 0.75},
+		{false, nil, 1},
+		{true, roachpb.Key("g"), 0.25},
+		{true, roachpb.Key("c"), 0.75},
+		{true, nil, 1},
+	}
+	for _, tc := range testCases {
+		if f := scannedFraction(spans, tc.reverse, tc.key); f != tc.expected {
+			t.Errorf("reverse=%t key=%s: expected %f, got %f", tc.reverse, tc.key, tc.expected, f)
+		}
+	}
+
+	// The keys are compared after their common prefix.
+	if f := keyFraction(
+		roachpb.Key("/t/1/a"), roachpb.Key("/t/1/c"), roachpb.Key("/t/1/b"),
+	); f != 0.5 {
+		t.Errorf("expected 0.5, got %f", f)
+	}
+}
+
+// Test that a tableReader periodically reports its progress, with an estimate
+// of the number of rows to read.
+func TestTableReaderProgress(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	const numRows = 100
+	const progressRows = 10
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"num INT PRIMARY KEY",
+		numRows,
+		sqlutils.ToRowFn(sqlutils.RowIdxFn))
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		// Pass a DB without a TxnCoordSender.
+		txn:    client.NewTxn(client.NewDB(s.DistSender(), s.Clock())),
+		nodeID: s.NodeID(),
+	}
+	spec := TableReaderSpec{
+		Table: *td,
+		Spans: []TableReaderSpan{{Span: td.PrimaryIndexSpan()}},
+	}
+	out := &RowBuffer{}
+	tr, err := newTableReader(&flowCtx, &spec, &PostProcessSpec{}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.testingKnobProgressRows = progressRows
+	tr.Run(context.Background(), nil)
+
+	var reports []*ProcessorProgress
+	for {
+		row, meta := out.Next()
+		if meta.Progress != nil {
+			reports = append(reports, meta.Progress)
+			continue
+		}
+		if !meta.Empty() {
+			t.Fatalf("unexpected metadata: %+v", meta)
+		}
+		if row == nil {
+			break
+		}
+	}
+	if len(reports) != numRows/progressRows {
+		t.Fatalf("expected %d progress reports, got %d", numRows/progressRows, len(reports))
+	}
+	for i, p := range reports {
+		if expected := int64((i + 1) * progressRows); p.RowsRead != expected {
+			t.Errorf("expected report %d to have %d rows read, got %d", i, expected, p.RowsRead)
+		}
+		if p.EstimatedRows < p.RowsRead {
+			t.Errorf("expected report %d to estimate at least %d rows, got %d",
+				i, p.RowsRead, p.EstimatedRows)
+		}
+		if p.Processor != "table reader" || p.NodeID != s.NodeID() {
+			t.Errorf("unexpected processor %q on node %d", p.Processor, p.NodeID)
+		}
+	}
+}
+
+// Test that a tableReader skips the rows which don't pass a published run-time
+// filter.
+func TestTableReaderRuntimeFilter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"a INT PRIMARY KEY, b INT",
+		100,
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, sqlutils.RowModuloFn(10)))
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	// The filter contains the values 3 and 7.
+	filter := bloom.New(100, runtimeFilterBitsPerRow)
+	var da sqlbase.DatumAlloc
+	colType := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	for _, b := range []int{3, 7} {
+		row := sqlbase.EncDatumRow{sqlbase.DatumToEncDatum(colType, parser.NewDInt(parser.DInt(b)))}
+		encoded, _, err := encodeColumnsOfRow(&da, nil, row, columns{0}, false /* encodeNull */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filter.Insert(encoded)
+	}
+
+	evalCtx := parser.MakeTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	flowCtx := FlowCtx{
+		EvalCtx:  evalCtx,
+		Settings: s.ClusterSettings(),
+		// Pass a DB without a TxnCoordSender.
+		txn:            client.NewTxn(client.NewDB(s.DistSender(), s.Clock())),
+		nodeID:         s.NodeID(),
+		runtimeFilters: &runtimeFilters{},
+	}
+	flowCtx.runtimeFilters.get(1).publish(filter)
+
+	spec := TableReaderSpec{
+		Table:         *td,
+		Spans:         []TableReaderSpan{{Span: td.PrimaryIndexSpan()}},
+		RuntimeFilter: &RuntimeFilterSpec{ID: 1, Columns: []uint32{1}},
+	}
+	// Only output column a, so that the filter column isn't otherwise needed.
+	post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0}}
+	out := &RowBuffer{}
+	tr, err := newTableReader(&flowCtx, &spec, &post, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Run(context.Background(), nil)
+	if !out.ProducerClosed {
+		t.Fatalf("output RowReceiver not closed")
+	}
+
+	var res sqlbase.EncDatumRows
+	for {
+		row, meta := out.Next()
+		if !meta.Empty() {
+			t.Fatalf("unexpected metadata: %+v", meta)
+		}
+		if row == nil {
+			break
+		}
+		res = append(res, row)
+	}
+	if len(res) != 20 {
+		t.Fatalf("expected 20 rows, got %d: %s", len(res), res)
+	}
+	for _, row := range res {
+		if err := row[0].EnsureDecoded(&da); err != nil {
+			t.Fatal(err)
+		}
+		if a := int(*row[0].Datum.(*parser.DInt)); a%10 != 3 && a%10 != 7 {
+			t.Errorf("unexpected row %s", row)
+		}
+	}
+	if tr.rowsSkipped != 80 {
+		t.Errorf("expected 80 rows to be skipped, got %d", tr.rowsSkipped)
+	}
+}
@@ -59,7 +59,7 @@ func (v *valuesProcessor) Run(ctx context.Context, wg *sync.WaitGroup) {
 		defer wg.Done()
 	}
 
-	ctx, span := processorSpan(ctx, "values")
+	ctx, span := processorSpan(ctx, v.flowCtx, "values")
 	defer tracing.FinishSpan(span)
 
 	// We reuse the code in StreamDecoder for decoding the raw data. We just need
@@ -0,0 +1,615 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"math"
+	"unsafe"
+
+	"github.com/cockroachdb/apd"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+)
+
+// vecBatchSize is the number of input rows accumulated at once by a
+// vectorized aggregation.
+const vecBatchSize = 1024
+
+// vecAggregation accumulates the groups of an aggregator whose aggregations
+// all have a vectorized implementation. Instead of feeding each input row to
+// one aggregate function per group, it decodes the input rows into columnar
+// batches and runs each aggregation over a whole batch at a time, keeping the
+// state of all the groups in typed slices indexed by group.
+type vecAggregation struct {
+	ag   *aggregator
+	aggs []vecAggregate
+	// groups maps the key of each group to its index. The keys are allocated
+	// by ag.keys.
+	groups    map[string]int
+	numGroups int
+	// groupSize is the memory used by the state of each group, not counting
+	// its key.
+	groupSize int64
+	batch     vecBatch
+}
+
+// vecBatch holds a batch of input rows in columnar form.
+type vecBatch struct {
+	// n is the number of rows in the batch.
+	n int
+	// groups holds the index of the group of each row.
+	groups []int
+	// cols holds the input columns, of which only those used by the
+	// aggregations are filled.
+	cols []vecColumn
+	// usedCols lists the indices of the input columns used by the
+	// aggregations.
+	usedCols []int
+}
+
+// vecColumn holds the values of an input column for a batch of rows. The
+// values are decoded into the representations needed by the aggregations
+// using the column.
+type vecColumn struct {
+	// used is set if the column is used by some aggregations, which need
+	// its values in the representations for which needInts, needFloats and
+	// needDatums are set.
+	used                             bool
+	needInts, needFloats, needDatums bool
+
+	ints   []int64
+	floats []float64
+	datums parser.Datums
+	// nonNull is the selection vector of the rows of the batch for which the
+	// column is not NULL.
+	nonNull []int
+}
+
+// vecAggregate computes an aggregation for all the groups, a batch of rows
+// at a time.
+type vecAggregate interface {
+	// addGroup adds the state of a new group.
+	addGroup()
+	// addBatch accumulates the rows of the batch into the states of their
+	// groups.
+	addBatch(ctx context.Context, b *vecBatch) error
+	// result returns the result of the given group.
+	result(group int) parser.Datum
+	// groupSize returns the memory used by the state of each group.
+	groupSize() int64
+	// reset releases the states of all the groups.
+	reset()
+}
+
+// newVecAggregation returns a vecAggregation for the aggregator, or nil if
+// some of its aggregations don't have a vectorized implementation, in which
+// case the aggregator accumulates its groups a row at a time.
+func newVecAggregation(ag *aggregator) *vecAggregation {
+	inputTypes := ag.input.Types()
+	v := &vecAggregation{
+		ag:     ag,
+		groups: make(map[string]int),
+		batch: vecBatch{
+			groups: make([]int, vecBatchSize),
+			cols:   make([]vecColumn, len(inputTypes)),
+		},
+	}
+	for _, a := range ag.aggregations {
+		if a.Distinct || a.FilterColIdx != nil || a.Filter.Expr != "" || a.SkipNulls ||
+			len(a.Ordering.Columns) > 0 || a.ErrorOnOverflow {
+			return nil
+		}
+		var semType sqlbase.ColumnType_SemanticType
+		var col *vecColumn
+		if len(a.ColIdx) == 1 {
+			semType = inputTypes[a.ColIdx[0]].SemanticType
+			col = &v.batch.cols[a.ColIdx[0]]
+		} else if a.Func != AggregatorSpec_COUNT_ROWS {
+			return nil
+		}
+		colIdx := -1
+		if col != nil {
+			col.used = true
+			colIdx = int(a.ColIdx[0])
+		}
+
+		var agg vecAggregate
+		switch a.Func {
+		case AggregatorSpec_COUNT_ROWS:
+			agg = &vecCountRows{}
+		case AggregatorSpec_COUNT:
+			agg = &vecCount{col: colIdx}
+		case AggregatorSpec_IDENT:
+			col.needDatums = true
+			agg = &vecIdent{col: colIdx}
+		case AggregatorSpec_SUM, AggregatorSpec_SUM_INT, AggregatorSpec_MIN, AggregatorSpec_MAX:
+			switch semType {
+			case sqlbase.ColumnType_INT:
+				col.needInts = true
+				switch a.Func {
+				case AggregatorSpec_SUM:
+					agg = &vecIntSum{col: colIdx, acc: &ag.bucketsAcc}
+				case AggregatorSpec_SUM_INT:
+					agg = &vecSmallIntSum{col: colIdx}
+				default:
+					agg = &vecIntMinMax{col: colIdx, max: a.Func == AggregatorSpec_MAX}
+				}
+			case sqlbase.ColumnType_FLOAT:
+				col.needFloats = true
+				switch a.Func {
+				case AggregatorSpec_SUM:
+					agg = &vecFloatSum{col: colIdx}
+				case AggregatorSpec_SUM_INT:
+					return nil
+				default:
+					agg = &vecFloatMinMax{col: colIdx, max: a.Func == AggregatorSpec_MAX}
+				}
+			default:
+				return nil
+			}
+		default:
+			return nil
+		}
+		v.aggs = append(v.aggs, agg)
+		v.groupSize += agg.groupSize()
+	}
+
+	for i := range v.batch.cols {
+		c := &v.batch.cols[i]
+		if c.needInts {
+			c.ints = make([]int64, vecBatchSize)
+		}
+		if c.needFloats {
+			c.floats = make([]float64, vecBatchSize)
+		}
+		if c.needDatums {
+			c.datums = make(parser.Datums, vecBatchSize)
+		}
+		if c.used {
+			c.nonNull = make([]int, 0, vecBatchSize)
+			v.batch.usedCols = append(v.batch.usedCols, i)
+		}
+	}
+	return v
+}
+
+// addRow adds a row, whose group has the given key, to the current batch. The
+// batch is accumulated once it is full.
+func (v *vecAggregation) addRow(
+	ctx context.Context, encoded []byte, row sqlbase.EncDatumRow,
+) error {
+	group, ok := v.groups[string(encoded)]
+	if !ok {
+		size := int64(len(encoded)) + v.groupSize + sizeOfVecGroupsEntry
+		if err := v.ag.bucketsAcc.Grow(ctx, size); err != nil {
+			return err
+		}
+		group = v.addGroup()
+		v.groups[v.ag.keys.intern(encoded)] = group
+	}
+
+	b := &v.batch
+	for _, i := range b.usedCols {
+		if err := row[i].EnsureDecoded(&v.ag.datumAlloc); err != nil {
+			return err
+		}
+		c := &b.cols[i]
+		d := row[i].Datum
+		if c.needDatums {
+			c.datums[b.n] = d
+		}
+		if d == parser.DNull {
+			continue
+		}
+		c.nonNull = append(c.nonNull, b.n)
+		if c.needInts {
+			c.ints[b.n] = int64(parser.MustBeDInt(d))
+		}
+		if c.needFloats {
+			c.floats[b.n] = float64(*d.(*parser.DFloat))
+		}
+	}
+	b.groups[b.n] = group
+	b.n++
+	if b.n == vecBatchSize {
+		return v.flushBatch(ctx)
+	}
+	return nil
+}
+
+// addGroup adds a new group and returns its index.
+func (v *vecAggregation) addGroup() int {
+	for _, agg := range v.aggs {
+		agg.addGroup()
+	}
+	v.numGroups++
+	return v.numGroups - 1
+}
+
+// flushBatch accumulates the rows of the current batch into their groups and
+// empties the batch.
+func (v *vecAggregation) flushBatch(ctx context.Context) error {
+	b := &v.batch
+	if b.n == 0 {
+		return nil
+	}
+	for _, agg := range v.aggs {
+		if err := agg.addBatch(ctx, b); err != nil {
+			return err
+		}
+	}
+	for _, i := range b.usedCols {
+		c := &b.cols[i]
+		c.nonNull = c.nonNull[:0]
+		if c.needDatums {
+			// Don't hold on to the datums of the batch.
+			for j := 0; j < b.n; j++ {
+				c.datums[j] = nil
+			}
+		}
+	}
+	b.n = 0
+	return nil
+}
+
+// render emits the result rows of all the groups. It returns true if the
+// consumer doesn't need any more rows, in which case the inputs and the
+// output have already been closed.
+func (v *vecAggregation) render(ctx context.Context, inputs ...RowSource) (bool, error) {
+	if v.numGroups == 0 && len(v.ag.groupCols) == 0 {
+		// Queries like `SELECT MAX(n) FROM t` expect a row of NULLs if nothing
+		// was aggregated.
+		v.addGroup()
+	}
+	row := make(sqlbase.EncDatumRow, len(v.aggs))
+	for g := 0; g < v.numGroups; g++ {
+		for i, agg := range v.aggs {
+			result := agg.result(g)
+			if result == nil {
+				// Special case useful when this is a local stage of a distributed
+				// aggregation.
+				result = parser.DNull
+			}
+			row[i] = sqlbase.DatumToEncDatum(v.ag.outputTypes[i], result)
+		}
+		if !emitHelper(ctx, &v.ag.out, row, ProducerMetadata{}, inputs...) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// reset releases the state of all the groups. Their memory is released along
+// with the aggregator's buckets.
+func (v *vecAggregation) reset() {
+	for _, agg := range v.aggs {
+		agg.reset()
+	}
+	v.groups = make(map[string]int)
+	v.numGroups = 0
+}
+
+const (
+	sizeOfInt64   = int64(unsafe.Sizeof(int64(0)))
+	sizeOfFloat64 = int64(unsafe.Sizeof(float64(0)))
+	sizeOfDatum   = int64(unsafe.Sizeof(parser.Datum(nil)))
+	sizeOfDecimal = int64(unsafe.Sizeof(apd.Decimal{}))
+)
+
+// sizeOfVecGroupsEntry is the memory used by an entry of vecAggregation.groups,
+// besides its key.
+var sizeOfVecGroupsEntry = mapEntryOverhead(sizeOfString, int64(unsafe.Sizeof(int(0))))
+
+// vecCountRows counts the rows of each group.
+type vecCountRows struct {
+	counts []int64
+}
+
+func (a *vecCountRows) addGroup() { a.counts = append(a.counts, 0) }
+
+func (a *vecCountRows) addBatch(_ context.Context, b *vecBatch) error {
+	for _, g := range b.groups[:b.n] {
+		a.counts[g]++
+	}
+	return nil
+}
+
+func (a *vecCountRows) result(g int) parser.Datum {
+	return parser.NewDInt(parser.DInt(a.counts[g]))
+}
+
+func (a *vecCountRows) groupSize() int64 { return sizeOfInt64 }
+func (a *vecCountRows) reset()           { a.counts = nil }
+
+// vecCount counts the non-NULL values of a column in each group.
+type vecCount struct {
+	col    int
+	counts []int64
+}
+
+func (a *vecCount) addGroup() { a.counts = append(a.counts, 0) }
+
+func (a *vecCount) addBatch(_ context.Context, b *vecBatch) error {
+	for _, i := range b.cols[a.col].nonNull {
+		a.counts[b.groups[i]]++
+	}
+	return nil
+}
+
+func (a *vecCount) result(g int) parser.Datum {
+	return parser.NewDInt(parser.DInt(a.counts[g]))
+}
+
+func (a *vecCount) groupSize() int64 { return sizeOfInt64 }
+func (a *vecCount) reset()           { a.counts = nil }
+
+// vecIdent is the vectorized version of parser.NewIdentAggregate.
+type vecIdent struct {
+	col  int
+	vals parser.Datums
+}
+
+func (a *vecIdent) addGroup() { a.vals = append(a.vals, nil) }
+
+func (a *vecIdent) addBatch(_ context.Context, b *vecBatch) error {
+	datums := b.cols[a.col].datums
+	for i, g := range b.groups[:b.n] {
+		// If we see at least one non-NULL value, ignore any NULLs.
+		if a.vals[g] == nil || datums[i] != parser.DNull {
+			a.vals[g] = datums[i]
+		}
+	}
+	return nil
+}
+
+func (a *vecIdent) result(g int) parser.Datum { return a.vals[g] }
+func (a *vecIdent) groupSize() int64          { return sizeOfDatum }
+func (a *vecIdent) reset()                    { a.vals = nil }
+
+// vecIntSum sums the values of an integer column, which may overflow into a
+// decimal.
+type vecIntSum struct {
+	col  int
+	sums []int64
+	seen []bool
+	// large holds the sums of the groups which overflowed int64.
+	large map[int]*apd.Decimal
+	tmp   apd.Decimal
+	acc   *mon.BoundAccount
+}
+
+func (a *vecIntSum) addGroup() {
+	a.sums = append(a.sums, 0)
+	a.seen = append(a.seen, false)
+}
+
+func (a *vecIntSum) addBatch(ctx context.Context, b *vecBatch) error {
+	c := &b.cols[a.col]
+	for _, i := range c.nonNull {
+		g, x := b.groups[i], c.ints[i]
+		a.seen[g] = true
+		if d, ok := a.large[g]; ok {
+			a.tmp.SetCoefficient(x)
+			if _, err := parser.ExactCtx.Add(d, d, &a.tmp); err != nil {
+				return err
+			}
+			continue
+		}
+		sum := a.sums[g] + x
+		if (sum^a.sums[g])&(sum^x) < 0 {
+			// The addition overflowed; go to large integers, but keep the sum
+			// computed so far. The size of the coefficient of the decimal grows
+			// slowly enough that only its initial size is accounted for.
+			if err := a.acc.Grow(ctx, sizeOfDecimal); err != nil {
+				return err
+			}
+			if a.large == nil {
+				a.large = make(map[int]*apd.Decimal)
+			}
+			d := new(apd.Decimal).SetCoefficient(a.sums[g])
+			a.tmp.SetCoefficient(x)
+			if _, err := parser.ExactCtx.Add(d, d, &a.tmp); err != nil {
+				return err
+			}
+			a.large[g] = d
+			continue
+		}
+		a.sums[g] = sum
+	}
+	return nil
+}
+
+func (a *vecIntSum) result(g int) parser.Datum {
+	if !a.seen[g] {
+		return parser.DNull
+	}
+	dd := &parser.DDecimal{}
+	if d, ok := a.large[g]; ok {
+		dd.Set(d)
+	} else {
+		dd.SetCoefficient(a.sums[g])
+	}
+	return dd
+}
+
+func (a *vecIntSum) groupSize() int64 { return sizeOfInt64 + sizeOfBool }
+
+func (a *vecIntSum) reset() {
+	a.sums, a.seen, a.large = nil, nil, nil
+}
+
+// vecSmallIntSum sums the values of an integer column into an integer.
+type vecSmallIntSum struct {
+	col  int
+	sums []int64
+	seen []bool
+}
+
+func (a *vecSmallIntSum) addGroup() {
+	a.sums = append(a.sums, 0)
+	a.seen = append(a.seen, false)
+}
+
+func (a *vecSmallIntSum) addBatch(_ context.Context, b *vecBatch) error {
+	c := &b.cols[a.col]
+	for _, i := range c.nonNull {
+		g := b.groups[i]
+		a.sums[g] += c.ints[i]
+		a.seen[g] = true
+	}
+	return nil
+}
+
+func (a *vecSmallIntSum) result(g int) parser.Datum {
+	if !a.seen[g] {
+		return parser.DNull
+	}
+	return parser.NewDInt(parser.DInt(a.sums[g]))
+}
+
+func (a *vecSmallIntSum) groupSize() int64 { return sizeOfInt64 + sizeOfBool }
+func (a *vecSmallIntSum) reset()           { a.sums, a.seen = nil, nil }
+
+// vecFloatSum sums the values of a float column.
+type vecFloatSum struct {
+	col  int
+	sums []float64
+	seen []bool
+}
+
+func (a *vecFloatSum) addGroup() {
+	a.sums = append(a.sums, 0)
+	a.seen = append(a.seen, false)
+}
+
+func (a *vecFloatSum) addBatch(_ context.Context, b *vecBatch) error {
+	c := &b.cols[a.col]
+	for _, i := range c.nonNull {
+		g := b.groups[i]
+		a.sums[g] += c.floats[i]
+		a.seen[g] = true
+	}
+	return nil
+}
+
+func (a *vecFloatSum) result(g int) parser.Datum {
+	if !a.seen[g] {
+		return parser.DNull
+	}
+	return parser.NewDFloat(parser.DFloat(a.sums[g]))
+}
+
+func (a *vecFloatSum) groupSize() int64 { return sizeOfFloat64 + sizeOfBool }
+func (a *vecFloatSum) reset()           { a.sums, a.seen = nil, nil }
+
+// vecIntMinMax computes the minimum or the maximum of an integer column.
+type vecIntMinMax struct {
+	col  int
+	max  bool
+	vals []int64
+	seen []bool
+}
+
+func (a *vecIntMinMax) addGroup() {
+	a.vals = append(a.vals, 0)
+	a.seen = append(a.seen, false)
+}
+
+func (a *vecIntMinMax) addBatch(_ context.Context, b *vecBatch) error {
+	c := &b.cols[a.col]
+	// The loops are split to keep the direction out of the inner loop.
+	if a.max {
+		for _, i := range c.nonNull {
+			g, x := b.groups[i], c.ints[i]
+			if !a.seen[g] || x > a.vals[g] {
+				a.vals[g], a.seen[g] = x, true
+			}
+		}
+	} else {
+		for _, i := range c.nonNull {
+			g, x := b.groups[i], c.ints[i]
+			if !a.seen[g] || x < a.vals[g] {
+				a.vals[g], a.seen[g] = x, true
+			}
+		}
+	}
+	return nil
+}
+
+func (a *vecIntMinMax) result(g int) parser.Datum {
+	if !a.seen[g] {
+		return parser.DNull
+	}
+	return parser.NewDInt(parser.DInt(a.vals[g]))
+}
+
+func (a *vecIntMinMax) groupSize() int64 { return sizeOfInt64 + sizeOfBool }
+func (a *vecIntMinMax) reset()           { a.vals, a.seen = nil, nil }
+
+// vecFloatMinMax computes the minimum or the maximum of a float column. NaN
+// sorts before any other value, as in (*parser.DFloat).Compare.
+type vecFloatMinMax struct {
+	col  int
+	max  bool
+	vals []float64
+	seen []bool
+}
+
+func (a *vecFloatMinMax) addGroup() {
+	a.vals = append(a.vals, 0)
+	a.seen = append(a.seen, false)
+}
+
+func (a *vecFloatMinMax) addBatch(_ context.Context, b *vecBatch) error {
+	c := &b.cols[a.col]
+	if a.max {
+		for _, i := range c.nonNull {
+			g, x := b.groups[i], c.floats[i]
+			if !a.seen[g] || x > a.vals[g] || (math.IsNaN(a.vals[g]) && !math.IsNaN(x)) {
+				a.vals[g], a.seen[g] = x, true
+			}
+		}
+	} else {
+		for _, i := range c.nonNull {
+			g, x := b.groups[i], c.floats[i]
+			if !a.seen[g] || x < a.vals[g] || (math.IsNaN(x) && !math.IsNaN(a.vals[g])) {
+				a.vals[g], a.seen[g] = x, true
+			}
+		}
+	}
+	return nil
+}
+
+func (a *vecFloatMinMax) result(g int) parser.Datum {
+	if !a.seen[g] {
+		return parser.DNull
+	}
+	return parser.NewDFloat(parser.DFloat(a.vals[g]))
+}
+
+func (a *vecFloatMinMax) groupSize() int64 { return sizeOfFloat64 + sizeOfBool }
+func (a *vecFloatMinMax) reset()           { a.vals, a.seen = nil, nil }
+
+var _ vecAggregate = &vecCountRows{}
+var _ vecAggregate = &vecCount{}
+var _ vecAggregate = &vecIdent{}
+var _ vecAggregate = &vecIntSum{}
+var _ vecAggregate = &vecSmallIntSum{}
+var _ vecAggregate = &vecFloatSum{}
+var _ vecAggregate = &vecIntMinMax{}
+var _ vecAggregate = &vecFloatMinMax{}
@@ -0,0 +1,162 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+// TestVecAggregation verifies that aggregating the groups in columnar batches
+// produces the same results as aggregating them a row at a time.
+func TestVecAggregation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	columnTypeInt := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}
+	columnTypeFloat := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_FLOAT}
+	columnTypeString := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}
+	types := []sqlbase.ColumnType{columnTypeString, columnTypeInt, columnTypeFloat}
+	rng, _ := randutil.NewPseudoRand()
+
+	// The input spans several batches. Some values are NULL, some floats are
+	// NaN, and some ints are large enough for their sums to overflow.
+	const numRows = 3*vecBatchSize + 17
+	input := make(sqlbase.EncDatumRows, numRows)
+	for i := range input {
+		var group, intVal, floatVal parser.Datum = parser.DNull, parser.DNull, parser.DNull
+		if rng.Intn(20) != 0 {
+			group = parser.NewDString(fmt.Sprintf("g%d", rng.Intn(50)))
+		}
+		switch rng.Intn(10) {
+		case 0:
+		case 1:
+			intVal = parser.NewDInt(parser.DInt(math.MaxInt64 - rng.Int63n(10)))
+		default:
+			intVal = parser.NewDInt(parser.DInt(rng.Int63n(2000) - 1000))
+		}
+		switch rng.Intn(10) {
+		case 0:
+		case 1:
+			floatVal = parser.NewDFloat(parser.DFloat(math.NaN()))
+		default:
+			floatVal = parser.NewDFloat(parser.DFloat(rng.NormFloat64()))
+		}
+		input[i] = sqlbase.EncDatumRow{
+			sqlbase.DatumToEncDatum(columnTypeString, group),
+			sqlbase.DatumToEncDatum(columnTypeInt, intVal),
+			sqlbase.DatumToEncDatum(columnTypeFloat, floatVal),
+		}
+	}
+
+	aggregations := []AggregatorSpec_Aggregation{
+		{Func: AggregatorSpec_IDENT, ColIdx: []uint32{0}},
+		{Func: AggregatorSpec_COUNT_ROWS},
+		{Func: AggregatorSpec_COUNT, ColIdx: []uint32{1}},
+		{Func: AggregatorSpec_COUNT, ColIdx: []uint32{2}},
+		{Func: AggregatorSpec_SUM, ColIdx: []uint32{1}},
+		{Func: AggregatorSpec_SUM_INT, ColIdx: []uint32{1}},
+		{Func: AggregatorSpec_SUM, ColIdx: []uint32{2}},
+		{Func: AggregatorSpec_MIN, ColIdx: []uint32{1}},
+		{Func: AggregatorSpec_MAX, ColIdx: []uint32{1}},
+		{Func: AggregatorSpec_MIN, ColIdx: []uint32{2}},
+		{Func: AggregatorSpec_MAX, ColIdx: []uint32{2}},
+	}
+
+	for _, groupCols := range [][]uint32{nil, {0}} {
+		for _, inputRows := range []sqlbase.EncDatumRows{nil, input} {
+			spec := AggregatorSpec{GroupCols: groupCols, Aggregations: aggregations}
+			name := fmt.Sprintf("GroupCols=%v/Rows=%d", groupCols, len(inputRows))
+			t.Run(name, func(t *testing.T) {
+				var results [2][]string
+				for i, vectorize := range []bool{false, true} {
+					ctx := context.Background()
+					in := NewRowBuffer(types, inputRows, RowBufferArgs{})
+					out := &RowBuffer{}
+					evalCtx := parser.MakeTestingEvalContext()
+					defer evalCtx.Stop(ctx)
+					flowCtx := FlowCtx{
+						Settings: cluster.MakeTestingClusterSettings(),
+						EvalCtx:  evalCtx,
+					}
+					flowCtx.Settings.DistSQLVectorizeAggs.Override(vectorize)
+
+					ag, err := newAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, out)
+					if err != nil {
+						t.Fatal(err)
+					}
+					ag.Run(ctx, nil)
+					if vectorized := ag.vec != nil; vectorized != vectorize {
+						t.Fatalf("expected vectorized=%t, got %t", vectorize, vectorized)
+					}
+
+					for {
+						row, meta := out.Next()
+						if !meta.Empty() {
+							t.Fatalf("unexpected metadata: %v", meta)
+						}
+						if row == nil {
+							break
+						}
+						results[i] = append(results[i], row.String())
+					}
+					sort.Strings(results[i])
+				}
+				if len(results[0]) != len(results[1]) {
+					t.Fatalf("expected %d groups, got %d", len(results[0]), len(results[1]))
+				}
+				for i := range results[0] {
+					if results[0][i] != results[1][i] {
+						t.Errorf("expected %s, got %s", results[0][i], results[1][i])
+					}
+				}
+			})
+		}
+	}
+
+	// Aggregations without a vectorized implementation use the buckets.
+	for _, agg := range []AggregatorSpec_Aggregation{
+		{Func: AggregatorSpec_SUM, Distinct: true, ColIdx: []uint32{1}},
+		{Func: AggregatorSpec_AVG, ColIdx: []uint32{1}},
+		{Func: AggregatorSpec_MAX, ColIdx: []uint32{0}},
+		{Func: AggregatorSpec_ARRAY_AGG, ColIdx: []uint32{1}},
+		{Func: AggregatorSpec_SUM, ColIdx: []uint32{1}, ErrorOnOverflow: true},
+	} {
+		spec := AggregatorSpec{Aggregations: []AggregatorSpec_Aggregation{agg}}
+		evalCtx := parser.MakeTestingEvalContext()
+		flowCtx := FlowCtx{
+			Settings: cluster.MakeTestingClusterSettings(),
+			EvalCtx:  evalCtx,
+		}
+		in := NewRowBuffer(types, nil /* rows */, RowBufferArgs{})
+		ag, err := newAggregator(&flowCtx, &spec, in, &PostProcessSpec{}, &RowBuffer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if newVecAggregation(ag) != nil {
+			t.Errorf("expected %v not to be vectorized", agg)
+		}
+		evalCtx.Stop(context.Background())
+	}
+}
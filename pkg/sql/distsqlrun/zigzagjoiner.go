@@ -0,0 +1,463 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// zigzagJoinerSide holds the state of the scan of one of the indexes of a
+// zigzagJoiner.
+type zigzagJoinerSide struct {
+	index   *sqlbase.IndexDescriptor
+	fetcher sqlbase.RowFetcher
+	alloc   sqlbase.DatumAlloc
+	// prefix is the key prefix of the index entries with the fixed values.
+	prefix roachpb.Key
+	// eqEncodings are the key encodings of the equality columns in the index.
+	eqEncodings []sqlbase.DatumEncoding
+
+	// group holds the rows of the last group of rows read which share the same
+	// equality values.
+	group    sqlbase.EncDatumRows
+	rowAlloc sqlbase.EncDatumRowAlloc
+	// next is the row following the last group, or nil if the scan has no
+	// more rows.
+	next sqlbase.EncDatumRow
+}
+
+// zigzagJoiner joins the rows of two indexes of a table by alternating between
+// the scans of the two indexes. See ZigzagJoinerSpec.
+type zigzagJoiner struct {
+	joinerBase
+
+	flowCtx *FlowCtx
+
+	desc  sqlbase.TableDescriptor
+	sides [2]zigzagJoinerSide
+	// eqCols are the indices of the table columns on which the rows are
+	// joined.
+	eqCols columns
+	// eqOrdering is the ordering of the equality values of the rows, as they
+	// are stored in the indexes.
+	eqOrdering sqlbase.ColumnOrdering
+
+	alloc sqlbase.DatumAlloc
+}
+
+var _ Processor = &zigzagJoiner{}
+
+func newZigzagJoiner(
+	flowCtx *FlowCtx, spec *ZigzagJoinerSpec, post *PostProcessSpec, output RowReceiver,
+) (*zigzagJoiner, error) {
+	if len(spec.Sides) != 2 {
+		return nil, errors.Errorf("zigzagJoiner requires 2 sides, got %d", len(spec.Sides))
+	}
+	if len(spec.EqColumns) == 0 {
+		return nil, errors.Errorf("zigzagJoiner requires equality columns")
+	}
+
+	z := &zigzagJoiner{
+		flowCtx: flowCtx,
+		desc:    spec.Table,
+		eqCols:  columns(spec.EqColumns),
+	}
+	tableTypes := make([]sqlbase.ColumnType, len(z.desc.Columns))
+	for i, c := range z.desc.Columns {
+		tableTypes[i] = c.Type
+	}
+	for _, c := range z.eqCols {
+		if int(c) >= len(tableTypes) {
+			return nil, errors.Errorf("invalid equality column %d", c)
+		}
+	}
+
+	if err := z.joinerBase.initWithTypes(
+		flowCtx,
+		tableTypes,
+		tableTypes,
+		JoinType_INNER,
+		spec.OnExpr,
+		nil, /* leftEqColumns */
+		nil, /* rightEqColumns */
+		0,   /* numMergedColumns */
+		post,
+		output,
+	); err != nil {
+		return nil, err
+	}
+
+	neededColumns := z.out.neededColumns()
+	for i := range z.sides {
+		// The table columns which are needed on this side are those used by
+		// the post-processing or the ON expression, and the equality columns.
+		offset := i * len(tableTypes)
+		needed := neededColumns[offset : offset+len(tableTypes)]
+		for j := range needed {
+			if !needed[j] && z.onCond.expr != nil {
+				needed[j] = z.onCond.vars.IndexedVarUsed(offset + j)
+			}
+		}
+		for _, c := range z.eqCols {
+			needed[c] = true
+		}
+		if err := z.initSide(i, &spec.Sides[i], needed); err != nil {
+			return nil, err
+		}
+	}
+
+	// Both indexes must store the equality columns in the same order.
+	for i := range z.eqOrdering {
+		if z.sides[0].eqEncodings[i] != z.sides[1].eqEncodings[i] {
+			return nil, errors.Errorf(
+				"column %s has different directions in indexes %s and %s",
+				z.desc.Columns[z.eqCols[i]].Name, z.sides[0].index.Name, z.sides[1].index.Name,
+			)
+		}
+	}
+	return z, nil
+}
+
+// indexKeyColumns returns the IDs and the directions of the columns which are
+// encoded in the keys of the given index, in order.
+func indexKeyColumns(
+	index *sqlbase.IndexDescriptor, isSecondaryIndex bool,
+) ([]sqlbase.ColumnID, []encoding.Direction, error) {
+	ids := append([]sqlbase.ColumnID(nil), index.ColumnIDs...)
+	dirs := make([]encoding.Direction, len(index.ColumnDirections))
+	for i, d := range index.ColumnDirections {
+		var err error
+		if dirs[i], err = d.ToEncodingDirection(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if isSecondaryIndex && !index.Unique {
+		// The extra columns of non-unique secondary indexes are encoded in the
+		// key, in ascending order.
+		for _, id := range index.ExtraColumnIDs {
+			ids = append(ids, id)
+			dirs = append(dirs, encoding.Ascending)
+		}
+	}
+	return ids, dirs, nil
+}
+
+// initSide initializes the scan of the idx-th side of the join.
+func (z *zigzagJoiner) initSide(idx int, spec *ZigzagJoinerSpec_Side, needed []bool) error {
+	side := &z.sides[idx]
+	index, isSecondaryIndex, err := initRowFetcher(
+		&side.fetcher, &z.desc, int(spec.IndexIdx), false /* reverse */, needed, &side.alloc,
+	)
+	if err != nil {
+		return err
+	}
+	side.index = index
+	if len(index.Interleave.Ancestors) > 0 {
+		return errors.Errorf("zigzagJoiner does not support interleaved index %s", index.Name)
+	}
+
+	colIdxMap := make(map[sqlbase.ColumnID]int, len(z.desc.Columns))
+	for i, c := range z.desc.Columns {
+		colIdxMap[c.ID] = i
+	}
+	if isSecondaryIndex {
+		indexed := make(map[sqlbase.ColumnID]struct{})
+		for _, ids := range [][]sqlbase.ColumnID{
+			index.ColumnIDs, index.ExtraColumnIDs, index.StoreColumnIDs,
+		} {
+			for _, id := range ids {
+				indexed[id] = struct{}{}
+			}
+		}
+		for i, c := range z.desc.Columns {
+			if _, ok := indexed[c.ID]; needed[i] && !ok {
+				return errors.Errorf("column %s is not part of index %s", c.Name, index.Name)
+			}
+		}
+	}
+
+	keyCols, keyDirs, err := indexKeyColumns(index, isSecondaryIndex)
+	if err != nil {
+		return err
+	}
+	numFixed := len(spec.FixedValues)
+	if numFixed+len(z.eqCols) > len(keyCols) {
+		return errors.Errorf(
+			"index %s has %d key columns, %d fixed and %d equality columns requested",
+			index.Name, len(keyCols), numFixed, len(z.eqCols),
+		)
+	}
+
+	// Encode the fixed values into the key prefix of the scan.
+	side.prefix = sqlbase.MakeIndexKeyPrefix(&z.desc, index.ID)
+	for i, expr := range spec.FixedValues {
+		col := &z.desc.Columns[colIdxMap[keyCols[i]]]
+		if expr.Expr == "" {
+			return errors.Errorf("no fixed value for column %s", col.Name)
+		}
+		var eh exprHelper
+		if err := eh.init(expr, nil /* types */, &z.flowCtx.EvalCtx); err != nil {
+			return err
+		}
+		d, err := eh.eval(nil /* row */)
+		if err != nil {
+			return err
+		}
+		if d == parser.DNull {
+			return errors.Errorf("fixed value for column %s is NULL", col.Name)
+		}
+		if !d.ResolvedType().Equivalent(col.Type.ToDatumType()) {
+			return errors.Errorf(
+				"fixed value %s has type %s, column %s has type %s",
+				d, d.ResolvedType(), col.Name, col.Type.SemanticType,
+			)
+		}
+		encDatum := sqlbase.DatumToEncDatum(col.Type, d)
+		side.prefix, err = encDatum.Encode(
+			&side.alloc, sqlbase.EncodingDirToDatumEncoding(keyDirs[i]), side.prefix,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The equality columns must directly follow the fixed columns.
+	side.eqEncodings = make([]sqlbase.DatumEncoding, len(z.eqCols))
+	if idx == 0 {
+		z.eqOrdering = make(sqlbase.ColumnOrdering, len(z.eqCols))
+	}
+	for i, c := range z.eqCols {
+		if keyCols[numFixed+i] != z.desc.Columns[c].ID {
+			return errors.Errorf(
+				"equality column %s is not key column %d of index %s",
+				z.desc.Columns[c].Name, numFixed+i, index.Name,
+			)
+		}
+		dir := keyDirs[numFixed+i]
+		side.eqEncodings[i] = sqlbase.EncodingDirToDatumEncoding(dir)
+		if idx == 0 {
+			z.eqOrdering[i] = sqlbase.ColumnOrderInfo{ColIdx: i, Direction: dir}
+		}
+	}
+	return nil
+}
+
+// Run is part of the processor interface.
+func (z *zigzagJoiner) Run(ctx context.Context, wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+
+	ctx = log.WithLogTagInt(ctx, "ZigzagJoiner", int(z.desc.ID))
+	ctx, span := processorSpan(ctx, z.flowCtx, "zigzag joiner")
+	defer tracing.FinishSpan(span)
+
+	// The reads of the flow's leaf txn must be reported however the zigzag
+	// joiner stops.
+	z.out.trailingMeta = func(ctx context.Context) {
+		sendLeafTxnState(ctx, z.flowCtx, z.out.output)
+	}
+	if err := z.mainLoop(ctx); err != nil {
+		z.out.pushTrailingMeta(ctx)
+		DrainAndClose(ctx, z.out.output, err /* cause */)
+	}
+}
+
+// mainLoop runs the mainLoop and returns any error.
+//
+// If no error is returned, the output has been closed. If an error is
+// returned, the caller should close the output and pass the error to the
+// consumer.
+func (z *zigzagJoiner) mainLoop(ctx context.Context) error {
+	if z.flowCtx.txn == nil {
+		log.Fatalf(ctx, "zigzagJoiner outside of txn")
+	}
+
+	log.VEventf(ctx, 1, "starting")
+	if log.V(1) {
+		defer log.Infof(ctx, "exiting")
+	}
+
+	// Start with the first row of the first side. Each iteration seeks the
+	// current side to the equality values of the last row read from the other
+	// side; target holds these values.
+	if err := z.seek(ctx, 0 /* side */, nil /* target */); err != nil {
+		return err
+	}
+	target, ok := z.eqValues(0)
+	cur := 1
+	for ok {
+		if err := z.seek(ctx, cur, target); err != nil {
+			return err
+		}
+		vals, found := z.eqValues(cur)
+		if !found {
+			break
+		}
+		cmp, err := vals.Compare(&z.alloc, z.eqOrdering, &z.flowCtx.EvalCtx, target)
+		if err != nil {
+			return err
+		}
+		if cmp == 0 {
+			// Both sides have rows with these equality values: join them. The
+			// group of the other side has to be read again as the last seek
+			// on the other side may have read a different group.
+			other := 1 - cur
+			if err := z.seek(ctx, other, target); err != nil {
+				return err
+			}
+			if moreRowsOK, err := z.emitGroups(ctx); err != nil || !moreRowsOK {
+				return err
+			}
+			// Continue after the group of the current side.
+			if z.sides[cur].next == nil {
+				break
+			}
+			vals, err = z.rowEqValues(z.sides[cur].next)
+			if err != nil {
+				return err
+			}
+		}
+		target = vals
+		cur = 1 - cur
+	}
+
+	z.out.pushTrailingMeta(ctx)
+	sendTraceData(ctx, z.out.output)
+	z.out.Close()
+	return nil
+}
+
+// seek reads the first group of rows of the given side whose equality values
+// are not NULL and are greater than or equal to target (in the order of the
+// index); if target is nil the scan starts at the beginning of the rows with
+// the fixed values.
+func (z *zigzagJoiner) seek(ctx context.Context, idx int, target sqlbase.EncDatumRow) error {
+	side := &z.sides[idx]
+	side.group = side.group[:0]
+	side.next = nil
+
+	startKey := append(roachpb.Key(nil), side.prefix...)
+	for i := range target {
+		var err error
+		startKey, err = target[i].Encode(&side.alloc, side.eqEncodings[i], startKey)
+		if err != nil {
+			return err
+		}
+	}
+	spans := roachpb.Spans{{Key: startKey, EndKey: side.prefix.PrefixEnd()}}
+	if err := side.fetcher.StartScan(
+		ctx, z.flowCtx.txn, spans, true /* limit batches */, 0, /* limitHint */
+	); err != nil {
+		log.Errorf(ctx, "scan error: %s", err)
+		return err
+	}
+
+	var groupVals sqlbase.EncDatumRow
+	for {
+		// TODO(radu,andrei,knz): set the traceKV flag when requested by the session.
+		row, err := side.fetcher.NextRow(ctx, false /* traceKV */)
+		if err != nil || row == nil {
+			return err
+		}
+		vals, err := z.rowEqValues(row)
+		if err != nil {
+			return err
+		}
+		if vals == nil {
+			// Rows with NULL equality values don't match any row.
+			continue
+		}
+		if groupVals != nil {
+			cmp, err := vals.Compare(&z.alloc, z.eqOrdering, &z.flowCtx.EvalCtx, groupVals)
+			if err != nil {
+				return err
+			}
+			if cmp != 0 {
+				side.next = side.rowAlloc.CopyRow(row)
+				return nil
+			}
+		}
+		row = side.rowAlloc.CopyRow(row)
+		side.group = append(side.group, row)
+		if groupVals == nil {
+			groupVals = z.eqValuesOf(row)
+		}
+	}
+}
+
+// eqValues returns the equality values of the group of rows of the given side;
+// ok is false if the side has no group of rows.
+func (z *zigzagJoiner) eqValues(idx int) (_ sqlbase.EncDatumRow, ok bool) {
+	if len(z.sides[idx].group) == 0 {
+		return nil, false
+	}
+	return z.eqValuesOf(z.sides[idx].group[0]), true
+}
+
+// rowEqValues returns the equality values of the given row, or nil if any of
+// them is NULL.
+func (z *zigzagJoiner) rowEqValues(row sqlbase.EncDatumRow) (sqlbase.EncDatumRow, error) {
+	for _, c := range z.eqCols {
+		if err := row[c].EnsureDecoded(&z.alloc); err != nil {
+			return nil, err
+		}
+		if row[c].IsNull() {
+			return nil, nil
+		}
+	}
+	return z.eqValuesOf(row), nil
+}
+
+// eqValuesOf returns a new row holding the equality values of the given row.
+func (z *zigzagJoiner) eqValuesOf(row sqlbase.EncDatumRow) sqlbase.EncDatumRow {
+	vals := make(sqlbase.EncDatumRow, len(z.eqCols))
+	for i, c := range z.eqCols {
+		vals[i] = row[c]
+	}
+	return vals
+}
+
+// emitGroups emits the joined rows of the groups of rows of the two sides. It
+// returns false if the consumer doesn't need more rows, in which case the
+// output has been closed.
+func (z *zigzagJoiner) emitGroups(ctx context.Context) (moreRowsOK bool, _ error) {
+	for _, lrow := range z.sides[0].group {
+		for _, rrow := range z.sides[1].group {
+			renderedRow, err := z.render(lrow, rrow)
+			if err != nil {
+				return false, err
+			}
+			// If the ON condition failed, renderedRow is nil.
+			if renderedRow == nil {
+				continue
+			}
+			if !emitHelper(ctx, &z.out, renderedRow, ProducerMetadata{}) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestZigzagJoiner(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	// Create a table where each row is:
+	//
+	//  |  id   |    a    |    b    |  c  |
+	//  |----------------------------------|
+	//  | rowId | rowId%5 | rowId%7 | -id |
+
+	aFn := func(row int) parser.Datum {
+		return parser.NewDInt(parser.DInt(row % 5))
+	}
+	bFn := func(row int) parser.Datum {
+		return parser.NewDInt(parser.DInt(row % 7))
+	}
+	cFn := func(row int) parser.Datum {
+		return parser.NewDInt(parser.DInt(-row))
+	}
+
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"id INT PRIMARY KEY, a INT, b INT, c INT, INDEX a (a), INDEX b (b) STORING (c)",
+		99,
+		sqlutils.ToRowFn(sqlutils.RowIdxFn, aFn, bFn, cFn))
+
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	// The internal columns are id, a, b, c read from the first index followed
+	// by id, a, b, c read from the second index.
+	testCases := []struct {
+		name     string
+		spec     ZigzagJoinerSpec
+		post     PostProcessSpec
+		expected string
+		err      string
+	}{
+		{
+			// Rows with a = 1 AND b = 2.
+			name: "Intersection",
+			spec: ZigzagJoinerSpec{
+				Sides: []ZigzagJoinerSpec_Side{
+					{IndexIdx: 1, FixedValues: []Expression{{Expr: "1"}}},
+					{IndexIdx: 2, FixedValues: []Expression{{Expr: "2"}}},
+				},
+				EqColumns: []uint32{0},
+			},
+			post: PostProcessSpec{
+				Projection:    true,
+				OutputColumns: []uint32{0, 7}, // id, c
+			},
+			expected: "[[16 -16] [51 -51] [86 -86]]",
+		},
+		{
+			name: "OnExpr",
+			spec: ZigzagJoinerSpec{
+				Sides: []ZigzagJoinerSpec_Side{
+					{IndexIdx: 1, FixedValues: []Expression{{Expr: "1"}}},
+					{IndexIdx: 2, FixedValues: []Expression{{Expr: "2"}}},
+				},
+				EqColumns: []uint32{0},
+				OnExpr:    Expression{Expr: "@8 < -20"}, // c < -20
+			},
+			post: PostProcessSpec{
+				Projection:    true,
+				OutputColumns: []uint32{0, 7}, // id, c
+			},
+			expected: "[[51 -51] [86 -86]]",
+		},
+		{
+			name: "PrimaryIndex",
+			spec: ZigzagJoinerSpec{
+				Sides: []ZigzagJoinerSpec_Side{
+					{IndexIdx: 2, FixedValues: []Expression{{Expr: "6"}}},
+					{IndexIdx: 0},
+				},
+				EqColumns: []uint32{0},
+			},
+			post: PostProcessSpec{
+				Filter:        Expression{Expr: "@6 = 4"}, // a = 4
+				Projection:    true,
+				OutputColumns: []uint32{4, 6}, // id, b
+			},
+			expected: "[[34 6] [69 6]]",
+		},
+		{
+			name: "NoMatches",
+			spec: ZigzagJoinerSpec{
+				Sides: []ZigzagJoinerSpec_Side{
+					{IndexIdx: 1, FixedValues: []Expression{{Expr: "1"}}},
+					{IndexIdx: 2, FixedValues: []Expression{{Expr: "7"}}},
+				},
+				EqColumns: []uint32{0},
+			},
+			post: PostProcessSpec{
+				Projection:    true,
+				OutputColumns: []uint32{0},
+			},
+			expected: "[]",
+		},
+		{
+			name: "NotCovered",
+			spec: ZigzagJoinerSpec{
+				Sides: []ZigzagJoinerSpec_Side{
+					{IndexIdx: 1, FixedValues: []Expression{{Expr: "1"}}},
+					{IndexIdx: 2, FixedValues: []Expression{{Expr: "2"}}},
+				},
+				EqColumns: []uint32{0},
+			},
+			post: PostProcessSpec{
+				Projection:    true,
+				OutputColumns: []uint32{3}, // c, which is not stored in index a
+			},
+			err: "column c is not part of index a",
+		},
+		{
+			name: "EqColumnNotInKey",
+			spec: ZigzagJoinerSpec{
+				Sides: []ZigzagJoinerSpec_Side{
+					{IndexIdx: 1},
+					{IndexIdx: 2, FixedValues: []Expression{{Expr: "2"}}},
+				},
+				EqColumns: []uint32{0},
+			},
+			post: PostProcessSpec{
+				Projection:    true,
+				OutputColumns: []uint32{0},
+			},
+			err: "equality column id is not key column 0 of index a",
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			evalCtx := parser.MakeTestingEvalContext()
+			defer evalCtx.Stop(context.Background())
+			flowCtx := FlowCtx{
+				EvalCtx:  evalCtx,
+				Settings: cluster.MakeTestingClusterSettings(),
+				// Pass a DB without a TxnCoordSender.
+				txn: client.NewTxn(client.NewDB(s.DistSender(), s.Clock())),
+			}
+
+			out := &RowBuffer{}
+			spec := c.spec
+			spec.Table = *td
+			z, err := newZigzagJoiner(&flowCtx, &spec, &c.post, out)
+			if c.err != "" {
+				if !testutils.IsError(err, c.err) {
+					t.Fatalf("expected error %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			z.Run(context.Background(), nil)
+
+			if !out.ProducerClosed {
+				t.Fatalf("output RowReceiver not closed")
+			}
+
+			var res sqlbase.EncDatumRows
+			for {
+				row, meta := out.Next()
+				if !meta.Empty() {
+					t.Fatalf("unexpected metadata: %v", meta)
+				}
+				if row == nil {
+					break
+				}
+				res = append(res, row)
+			}
+
+			if result := res.String(); result != c.expected {
+				t.Errorf("invalid results: %s, expected %s'", result, c.expected)
+			}
+		})
+	}
+}
+
+// TestZigzagJoinerLimitLeafTxnState verifies that a zigzag joiner which stops
+// early because of a limit still sends the state of its leaf txn, so that the
+// reads are refreshed if the root txn gets pushed.
+func TestZigzagJoinerLimitLeafTxnState(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	sqlutils.CreateTable(t, sqlDB, "t",
+		"id INT PRIMARY KEY, a INT, b INT, INDEX a (a), INDEX b (b)",
+		99,
+		sqlutils.ToRowFn(
+			sqlutils.RowIdxFn,
+			func(row int) parser.Datum { return parser.NewDInt(parser.DInt(row % 5)) },
+			func(row int) parser.Datum { return parser.NewDInt(parser.DInt(row % 7)) },
+		))
+	td := sqlbase.GetTableDescriptor(kvDB, "test", "t")
+
+	// The rows with a = 1 AND b = 2 are 16, 51 and 86; the joiner stops after
+	// the first one, whose index entries it read.
+	checkLimitedLeafReadsRefreshed(t, s, sqlDB, kvDB,
+		"UPDATE test.t SET b = 3 WHERE id = 16",
+		func(flowCtx *FlowCtx, out *RowBuffer) {
+			spec := ZigzagJoinerSpec{
+				Sides: []ZigzagJoinerSpec_Side{
+					{IndexIdx: 1, FixedValues: []Expression{{Expr: "1"}}},
+					{IndexIdx: 2, FixedValues: []Expression{{Expr: "2"}}},
+				},
+				EqColumns: []uint32{0},
+				Table:     *td,
+			}
+			post := PostProcessSpec{Projection: true, OutputColumns: []uint32{0}, Limit: 1}
+			z, err := newZigzagJoiner(flowCtx, &spec, &post, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			z.Run(context.Background(), nil)
+		})
+}
@@ -228,6 +228,9 @@ type Executor struct {
 	// Application-level SQL statistics
 	sqlStats sqlStats
 
+	// The statements written to the slow query log.
+	slowQueries slowQueryLog
+
 	// Attempts to use unimplemented features.
 	unimplementedErrors struct {
 		syncutil.Mutex
@@ -1671,9 +1674,10 @@ func commitSQLTransaction(
 }
 
 // exectDistSQL converts a classic plan to a distributed SQL physical plan and
-// runs it.
+// runs it. The progress of the flows is recorded in the active query with the
+// given ID.
 func (e *Executor) execDistSQL(
-	planner *planner, tree planNode, rowResultWriter StatementResultWriter,
+	planner *planner, tree planNode, rowResultWriter StatementResultWriter, queryID uint128.Uint128,
 ) error {
 	ctx := planner.session.Ctx()
 	recv, err := makeDistSQLReceiver(
@@ -1687,6 +1691,10 @@ func (e *Executor) execDistSQL(
 	if err != nil {
 		return err
 	}
+	recv.onProgress = func(rowsRead, estimatedRows int64) {
+		planner.session.setQueryProgress(queryID, rowsRead, estimatedRows)
+	}
+	recv.workMem = planner.session.DistSQLWorkMem
 	err = e.distSQLPlanner.PlanAndRun(ctx, planner.txn, tree, &recv, planner.evalCtx)
 	if err != nil {
 		return err
@@ -1830,6 +1838,7 @@ func (e *Executor) execStmt(
 	statementResultWriter StatementResultWriter,
 ) error {
 	session := planner.session
+	defer session.TxnState.traceStmt(session, stmt)()
 	ctx := session.Ctx()
 
 	planner.phaseTimes[plannerStartLogicalPlan] = timeutil.Now()
@@ -1858,7 +1867,7 @@ func (e *Executor) execStmt(
 	planner.phaseTimes[plannerStartExecStmt] = timeutil.Now()
 	session.setQueryExecutionMode(stmt.queryID, useDistSQL)
 	if useDistSQL {
-		err = e.execDistSQL(planner, plan, statementResultWriter)
+		err = e.execDistSQL(planner, plan, statementResultWriter, stmt.queryID)
 	} else {
 		err = e.execClassic(planner, plan, statementResultWriter)
 	}
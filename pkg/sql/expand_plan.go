@@ -151,11 +151,21 @@ func doExpandPlan(
 		n.plan, err = doExpandPlan(ctx, p, params, n.plan)
 
 	case *groupNode:
+		limited := params.numRowsHint != math.MaxInt64
 		params.desiredOrdering = n.desiredOrdering
 		// Under a group node, there may be arbitrarily more rows
 		// than those required by the context.
 		params.numRowsHint = math.MaxInt64
 		n.plan, err = doExpandPlan(ctx, p, params, n.plan)
+		if err != nil {
+			return plan, err
+		}
+
+		if limited {
+			// If the input is ordered on some of the group columns, the group
+			// node can stop consuming it once enough groups are complete.
+			n.orderedGroupCols = n.computeOrderedGroupCols(planOrdering(n.plan))
+		}
 
 		if len(n.desiredOrdering) > 0 {
 			match := planOrdering(n.plan).computeMatch(n.desiredOrdering)
@@ -474,8 +484,15 @@ func simplifyOrderings(plan planNode, usefulOrdering sqlbase.ColumnOrdering) pla
 	case *groupNode:
 		if n.needOnlyOneRow {
 			n.plan = simplifyOrderings(n.plan, n.desiredOrdering)
+		} else if n.isOrderSensitive() {
+			// The results of some of the aggregations depend on the order in which
+			// they receive their input; preserve the ordering of the input.
+			ordering := planOrdering(n.plan)
+			n.plan = simplifyOrderings(n.plan, ordering.getColumnOrdering())
 		} else {
-			n.plan = simplifyOrderings(n.plan, nil)
+			// The ordering on the group columns, if any, tells the group node
+			// when groups are complete.
+			n.plan = simplifyOrderings(n.plan, n.orderedGroupCols)
 		}
 
 	case *windowNode:
@@ -15,6 +15,7 @@
 package sql
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
 
@@ -296,6 +297,20 @@ type groupNode struct {
 	desiredOrdering sqlbase.ColumnOrdering
 	needOnlyOneRow  bool
 	gotOneRow       bool
+
+	// orderedGroupCols is the ordering of the input on some of the group
+	// columns. The rows of the groups having the same values on these columns
+	// are contiguous in the input. It is only set if a limit may apply to the
+	// number of groups.
+	orderedGroupCols sqlbase.ColumnOrdering
+	// groupLimit is the hard limit on the number of groups set by applyLimit,
+	// or 0 if there is none. Once this many groups are complete, the rest of
+	// the input is not consumed.
+	groupLimit int64
+
+	// rowIdx is incremented for each input row. It allows the aggregations
+	// sharing a distinctSet to only check each row once.
+	rowIdx int64
 }
 
 func (n *groupNode) Values() parser.Datums {
@@ -303,11 +318,43 @@ func (n *groupNode) Values() parser.Datums {
 }
 
 func (n *groupNode) Start(params runParams) error {
+	n.shareDistinctSets()
 	return n.plan.Start(params)
 }
 
+// shareDistinctSets makes the DISTINCT aggregations which have the same
+// arguments and the same filter share their set of seen values, as they see
+// the same values.
+func (n *groupNode) shareDistinctSets() {
+	type distinctKey struct {
+		// args holds the render indices of the arguments.
+		args            string
+		hasFilter       bool
+		filterRenderIdx int
+	}
+	sets := make(map[distinctKey]*distinctSet)
+	for _, f := range n.funcs {
+		if f.seen == nil {
+			continue
+		}
+		key := distinctKey{
+			args:      fmt.Sprint(f.argRenderIdx, f.otherArgRenderIdxs),
+			hasFilter: f.hasFilter,
+		}
+		if f.hasFilter {
+			key.filterRenderIdx = f.filterRenderIdx
+		}
+		if set, ok := sets[key]; ok {
+			f.seen = set
+		} else {
+			sets[key] = f.seen
+		}
+	}
+}
+
 func (n *groupNode) Next(params runParams) (bool, error) {
-	var scratch []byte
+	var scratch, orderedScratch, lastOrdered []byte
+	stopAtLimit := n.groupLimit > 0 && len(n.orderedGroupCols) > 0
 	// We're going to consume n.plan until it's exhausted (feeding all the rows to
 	// n.funcs), and then call n.setupOutput.
 	// Subsequent calls to next will skip the first part and just return a result.
@@ -333,6 +380,26 @@ func (n *groupNode) Next(params runParams) (bool, error) {
 
 		values := n.plan.Values()
 
+		if stopAtLimit {
+			orderedScratch = orderedScratch[:0]
+			for _, c := range n.orderedGroupCols {
+				var err error
+				orderedScratch, err = sqlbase.EncodeDatum(orderedScratch, values[c.ColIdx])
+				if err != nil {
+					return false, err
+				}
+			}
+			if lastOrdered != nil && !bytes.Equal(orderedScratch, lastOrdered) &&
+				int64(len(n.buckets)) >= n.groupLimit {
+				// All the groups seen so far are complete, and there are enough of
+				// them; the rest of the input is not needed.
+				n.populated = true
+				n.setupOutput()
+				break
+			}
+			lastOrdered, orderedScratch = orderedScratch, lastOrdered
+		}
+
 		// TODO(dt): optimization: skip buckets when underlying plan is ordered by grouped values.
 
 		bucket := scratch
@@ -345,6 +412,7 @@ func (n *groupNode) Next(params runParams) (bool, error) {
 		}
 
 		n.buckets[string(bucket)] = struct{}{}
+		n.rowIdx++
 
 		// Feed the aggregateFuncHolders for this bucket the non-grouped values.
 		for _, f := range n.funcs {
@@ -356,8 +424,14 @@ func (n *groupNode) Next(params runParams) (bool, error) {
 			if f.argRenderIdx != noRenderIdx {
 				value = values[f.argRenderIdx]
 			}
+			for i, idx := range f.otherArgRenderIdxs {
+				f.otherArgs[i] = values[idx]
+			}
+			for i, idx := range f.orderRenderIdxs {
+				f.otherArgs[len(f.otherArgRenderIdxs)+i] = values[idx]
+			}
 
-			if err := f.add(params.ctx, n.planner.session, bucket, value); err != nil {
+			if err := f.add(params.ctx, n.planner.session, bucket, value, f.otherArgs...); err != nil {
 				return false, err
 			}
 		}
@@ -438,6 +512,59 @@ func (n *groupNode) addIsNotNullFilter(where *filterNode, render *renderNode) {
 	}
 }
 
+// isOrderSensitive returns whether the result of any of the aggregations
+// depends on the order in which the input rows are fed to it.
+func (n *groupNode) isOrderSensitive() bool {
+	for _, f := range n.funcs {
+		fn, ok := f.expr.(*parser.FuncExpr)
+		if !ok || f.identAggregate {
+			continue
+		}
+		switch strings.ToLower(fn.Func.FunctionReference.String()) {
+		case "array_agg", "concat_agg", "string_agg":
+			return true
+		case "first_value", "last_value":
+			if len(fn.OrderBy) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// aggregateOrdering returns whether the result of the given aggregation
+// depends on the ORDER BY given in its call, and if so whether it is the value
+// of the row which sorts last rather than first. The other aggregations ignore
+// their ORDER BY.
+func aggregateOrdering(fn *parser.FuncExpr) (ordered bool, last bool) {
+	if len(fn.OrderBy) == 0 {
+		return false, false
+	}
+	switch strings.ToLower(fn.Func.FunctionReference.String()) {
+	case "first_value":
+		return true, false
+	case "last_value":
+		return true, true
+	}
+	return false, false
+}
+
+// computeOrderedGroupCols returns the longest prefix of the given ordering of
+// the input which only involves group columns.
+func (n *groupNode) computeOrderedGroupCols(ord orderingInfo) sqlbase.ColumnOrdering {
+	var res sqlbase.ColumnOrdering
+	for _, g := range ord.ordering {
+		col, ok := g.cols.Next(0)
+		if !ok || int(col) >= n.numGroupCols {
+			// The columns of a group are equivalent; the group columns come
+			// first in the input, so the smallest one is a group column if any is.
+			break
+		}
+		res = append(res, sqlbase.ColumnOrderInfo{ColIdx: int(col), Direction: g.dir})
+	}
+	return res
+}
+
 // desiredAggregateOrdering computes the desired output ordering from the
 // scan.
 //
@@ -548,32 +675,64 @@ func (v *extractAggregatesVisitor) VisitPre(expr parser.Expr) (recurse bool, new
 				// COUNT_ROWS has no arguments.
 				f = v.groupNode.newAggregateFuncHolder(t, noRenderIdx, false /* not ident */, agg)
 
-			case 1:
-				argExpr := t.Exprs[0].(parser.TypedExpr)
-
-				if err := v.planner.parser.AssertNoAggregationOrWindowing(
-					argExpr,
-					fmt.Sprintf("the argument of %s()", t.Func),
-					v.planner.session.SearchPath,
-				); err != nil {
-					v.err = err
-					return false, expr
-				}
-
-				// Add a render for the argument.
-				col := sqlbase.ResultColumn{
-					Name: argExpr.String(),
-					Typ:  argExpr.ResolvedType(),
+			default:
+				argRenderIdxs := make([]int, len(t.Exprs))
+				for i, e := range t.Exprs {
+					argExpr := e.(parser.TypedExpr)
+
+					if err := v.planner.parser.AssertNoAggregationOrWindowing(
+						argExpr,
+						fmt.Sprintf("the argument of %s()", t.Func),
+						v.planner.session.SearchPath,
+					); err != nil {
+						v.err = err
+						return false, expr
+					}
+
+					// Add a render for the argument.
+					col := sqlbase.ResultColumn{
+						Name: argExpr.String(),
+						Typ:  argExpr.ResolvedType(),
+					}
+
+					argRenderIdxs[i] = v.preRender.addOrReuseRender(col, argExpr, true /* reuse */)
 				}
 
-				argRenderIdx := v.preRender.addOrReuseRender(col, argExpr, true /* reuse */)
-
-				f = v.groupNode.newAggregateFuncHolder(t, argRenderIdx, false /* not ident */, agg)
+				f = v.groupNode.newAggregateFuncHolder(t, argRenderIdxs[0], false /* not ident */, agg)
+				f.setOtherArgs(argRenderIdxs[1:])
+			}
 
-			default:
-				// TODO: #10495
-				v.err = pgerror.UnimplementedWithIssueErrorf(10495, "aggregate functions with multiple arguments are not supported yet")
-				return false, expr
+			if ordered, last := aggregateOrdering(t); ordered {
+				orderRenderIdxs := make([]int, len(t.OrderBy))
+				directions := make([]parser.Direction, len(t.OrderBy))
+				for i, o := range t.OrderBy {
+					orderExpr := o.Expr.(parser.TypedExpr)
+
+					if err := v.planner.parser.AssertNoAggregationOrWindowing(
+						orderExpr,
+						fmt.Sprintf("the ORDER BY of %s()", t.Func),
+						v.planner.session.SearchPath,
+					); err != nil {
+						v.err = err
+						return false, expr
+					}
+
+					col := sqlbase.ResultColumn{
+						Name: orderExpr.String(),
+						Typ:  orderExpr.ResolvedType(),
+					}
+					orderRenderIdxs[i] = v.preRender.addOrReuseRender(col, orderExpr, true /* reuse */)
+					directions[i] = o.Direction
+
+					if t.Type == parser.DistinctFuncType && orderRenderIdxs[i] != f.argRenderIdx {
+						// Same error message as Postgres. Otherwise the rows left out as
+						// duplicates could sort before the ones which are kept.
+						v.err = pgerror.NewErrorf(pgerror.CodeInvalidColumnReferenceError,
+							"in an aggregate with DISTINCT, ORDER BY expressions must appear in argument list")
+						return false, expr
+					}
+				}
+				f.setOrdering(orderRenderIdxs, directions, last)
 			}
 
 			if t.Type == parser.DistinctFuncType {
@@ -638,7 +797,16 @@ type aggregateFuncHolder struct {
 	// The argument of the function is a single value produced by the renderNode
 	// underneath.
 	argRenderIdx int
-	hasFilter    bool
+	// For functions with more than one argument, the arguments beyond the first
+	// are also produced by the renderNode underneath. otherArgs is used to pass
+	// their values to the function.
+	otherArgRenderIdxs []int
+	// For aggregations with an ordering, the values of the ordering
+	// expressions are also produced by the renderNode underneath. They are
+	// passed to the function after the other arguments.
+	orderRenderIdxs []int
+	otherArgs       parser.Datums
+	hasFilter       bool
 	// If there is a filter, the result is a single value produced by the
 	// renderNode underneath.
 	filterRenderIdx int
@@ -649,7 +817,22 @@ type aggregateFuncHolder struct {
 	group         *groupNode
 	buckets       map[string]parser.AggregateFunc
 	bucketsMemAcc WrappableMemoryAccount
-	seen          map[string]struct{}
+	// seen is set for DISTINCT aggregations. It can be shared with other
+	// aggregations (see shareDistinctSets).
+	seen *distinctSet
+}
+
+// distinctSet holds the (bucket, arguments) tuples already aggregated by the
+// DISTINCT aggregations on the same arguments. Sharing the set avoids storing
+// each tuple once per aggregation.
+type distinctSet struct {
+	seen map[string]struct{}
+	// rowIdx is the index of the last row checked against the set, and
+	// duplicate is whether its value had been seen before. The first
+	// aggregation to check a row adds its value to the set; the others reuse
+	// the result.
+	rowIdx    int64
+	duplicate bool
 }
 
 const noRenderIdx = -1
@@ -672,6 +855,24 @@ func (n *groupNode) newAggregateFuncHolder(
 	return res
 }
 
+func (a *aggregateFuncHolder) setOtherArgs(otherArgRenderIdxs []int) {
+	a.otherArgRenderIdxs = otherArgRenderIdxs
+	a.otherArgs = make(parser.Datums, len(otherArgRenderIdxs))
+}
+
+// setOrdering causes a to only aggregate the arguments of the row which sorts
+// first (or last) in each bucket according to the given ordering.
+func (a *aggregateFuncHolder) setOrdering(
+	orderRenderIdxs []int, directions []parser.Direction, last bool,
+) {
+	a.orderRenderIdxs = orderRenderIdxs
+	a.otherArgs = make(parser.Datums, len(a.otherArgRenderIdxs)+len(orderRenderIdxs))
+	create := a.create
+	a.create = func(evalCtx *parser.EvalContext) parser.AggregateFunc {
+		return parser.NewOrderedAggregate(create, evalCtx, directions, last)
+	}
+}
+
 func (a *aggregateFuncHolder) setFilter(filterRenderIdx int) {
 	a.hasFilter = true
 	a.filterRenderIdx = filterRenderIdx
@@ -679,7 +880,7 @@ func (a *aggregateFuncHolder) setFilter(filterRenderIdx int) {
 
 // setDistinct causes a to ignore duplicate values of the argument.
 func (a *aggregateFuncHolder) setDistinct() {
-	a.seen = make(map[string]struct{})
+	a.seen = &distinctSet{seen: make(map[string]struct{})}
 }
 
 func (a *aggregateFuncHolder) close(ctx context.Context, s *Session) {
@@ -695,33 +896,51 @@ func (a *aggregateFuncHolder) close(ctx context.Context, s *Session) {
 }
 
 // add accumulates one more value for a particular bucket into an aggregation
-// function.
+// function. otherArgs holds the values of the arguments beyond the first, if
+// any.
 func (a *aggregateFuncHolder) add(
-	ctx context.Context, s *Session, bucket []byte, d parser.Datum,
+	ctx context.Context, s *Session, bucket []byte, d parser.Datum, otherArgs ...parser.Datum,
 ) error {
 	// NB: the compiler *should* optimize `myMap[string(myBytes)]`. See:
 	// https://github.com/golang/go/commit/f5f5a8b6209f84961687d993b93ea0d397f5d5bf
 
-	if a.seen != nil {
+	if a.seen != nil && a.seen.rowIdx != a.group.rowIdx {
 		encoded, err := sqlbase.EncodeDatum(bucket, d)
 		if err != nil {
 			return err
 		}
-		if _, ok := a.seen[string(encoded)]; ok {
-			// skip
-			return nil
+		// The values of the ordering expressions, which follow the arguments,
+		// are not part of the tuple made distinct.
+		for _, arg := range otherArgs[:len(a.otherArgRenderIdxs)] {
+			if encoded, err = sqlbase.EncodeDatum(encoded, arg); err != nil {
+				return err
+			}
 		}
-		if err := a.bucketsMemAcc.Wtxn(s).Grow(ctx, int64(len(encoded))); err != nil {
-			return err
+		_, a.seen.duplicate = a.seen.seen[string(encoded)]
+		if !a.seen.duplicate {
+			if err := a.bucketsMemAcc.Wtxn(s).Grow(ctx, int64(len(encoded))); err != nil {
+				return err
+			}
+			a.seen.seen[string(encoded)] = struct{}{}
 		}
-		a.seen[string(encoded)] = struct{}{}
+		a.seen.rowIdx = a.group.rowIdx
+	}
+	if a.seen != nil && a.seen.duplicate {
+		// skip
+		return nil
 	}
 
 	impl, ok := a.buckets[string(bucket)]
 	if !ok {
 		impl = a.create(&a.group.planner.evalCtx)
+		// Account for the bucket key and the aggregate function. Memory the
+		// function allocates while aggregating is accounted for by the function.
+		if err := a.bucketsMemAcc.Wtxn(s).Grow(ctx, int64(len(bucket))+impl.Size()); err != nil {
+			impl.Close(ctx)
+			return err
+		}
 		a.buckets[string(bucket)] = impl
 	}
 
-	return impl.Add(ctx, d)
+	return impl.Add(ctx, d, otherArgs...)
 }
@@ -28,6 +28,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlutil"
 	"github.com/cockroachdb/cockroach/pkg/storage"
+	"github.com/cockroachdb/cockroach/pkg/util/admission"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
@@ -50,6 +51,9 @@ type Registry struct {
 	clock     *hlc.Clock
 	nodeID    *base.NodeIDContainer
 	clusterID func() uuid.UUID
+	// admission, if set, is the process-wide admission controller. Resumed
+	// jobs hold one of its tokens while they run.
+	admission *admission.Controller
 
 	mu struct {
 		syncutil.Mutex
@@ -66,8 +70,17 @@ func MakeRegistry(
 	gossip *gossip.Gossip,
 	nodeID *base.NodeIDContainer,
 	clusterID func() uuid.UUID,
+	admissionController *admission.Controller,
 ) *Registry {
-	r := &Registry{clock: clock, db: db, ex: ex, gossip: gossip, nodeID: nodeID, clusterID: clusterID}
+	r := &Registry{
+		clock:     clock,
+		db:        db,
+		ex:        ex,
+		gossip:    gossip,
+		nodeID:    nodeID,
+		clusterID: clusterID,
+		admission: admissionController,
+	}
 	r.mu.epoch = 1
 	r.mu.jobs = make(map[int64]*Job)
 	return r
@@ -290,6 +303,13 @@ func (r *Registry) maybeAdoptJob(ctx context.Context, nl nodeLiveness) error {
 		}
 
 		go func() {
+			if r.admission != nil {
+				if err := r.admission.Admit(ctx, admission.LowPri); err != nil {
+					log.Warningf(ctx, "job %d: not resuming: %s", *id, err)
+					return
+				}
+				defer r.admission.Release()
+			}
 			log.Infof(ctx, "job %d: resuming", *id)
 			err := resumeFn(ctx, &job)
 			if _, isDuplicate := errors.Cause(err).(*duplicateRegistrationError); isDuplicate {
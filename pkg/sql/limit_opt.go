@@ -98,6 +98,13 @@ func applyLimit(plan planNode, numRows int64, soft bool) {
 		} else {
 			setUnlimited(n.plan)
 		}
+		// A hard limit on the number of groups lets the group node stop
+		// consuming its input once enough groups are complete, if the input is
+		// ordered on the group columns.
+		n.groupLimit = 0
+		if !soft && numRows != math.MaxInt64 {
+			n.groupLimit = numRows
+		}
 
 	case *indexJoinNode:
 		// If we have a limit in the table node (i.e. post-index-join), the
@@ -419,6 +419,14 @@ type BytesAccount struct {
 	curAllocated int64
 }
 
+// MaximumBytes returns the maximum number of bytes that were allocated by this
+// monitor at one time since it was started.
+func (mm *BytesMonitor) MaximumBytes() int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.mu.maxAllocated
+}
+
 // CurrentlyAllocated returns the number of bytes currently allocated through
 // this account.
 func (acc BytesAccount) CurrentlyAllocated() int64 {
@@ -291,6 +291,9 @@ func TestBytesMonitor(t *testing.T) {
 	if m.mu.maxAllocated != 100 {
 		t.Fatalf("incorrect max allocation: got %d, expected %d", m.mu.maxAllocated, 100)
 	}
+	if max := m.MaximumBytes(); max != 100 {
+		t.Fatalf("incorrect maximum bytes: got %d, expected %d", max, 100)
+	}
 
 	m.releaseBytes(ctx, 10) // Should succeed without panic.
 	if m.mu.curAllocated != 0 {
@@ -16,15 +16,23 @@ package parser
 
 import (
 	"bytes"
+	"container/heap"
+	"encoding/binary"
 	"fmt"
 	"math"
+	"math/big"
+	"sort"
+	"unsafe"
 
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/apd"
 	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/countminsketch"
 	"github.com/cockroachdb/cockroach/pkg/util/duration"
+	"github.com/cockroachdb/cockroach/pkg/util/hyperloglog"
+	"github.com/cockroachdb/cockroach/pkg/util/tdigest"
 	"github.com/pkg/errors"
 )
 
@@ -62,8 +70,10 @@ func initAggregateBuiltins() {
 
 // AggregateFunc accumulates the result of a function of a Datum.
 type AggregateFunc interface {
-	// Add accumulates the passed datum into the AggregateFunc.
-	Add(context.Context, Datum) error
+	// Add accumulates the passed datum into the AggregateFunc. Aggregates taking
+	// more than one argument receive the values of the arguments beyond the
+	// first in otherArgs.
+	Add(_ context.Context, firstArg Datum, otherArgs ...Datum) error
 
 	// Result returns the current value of the accumulation. This value
 	// will be a deep copy of any AggregateFunc internal state, so that
@@ -74,6 +84,105 @@ type AggregateFunc interface {
 	// requested during aggregation, and must be called upon completion of the
 	// aggregation.
 	Close(context.Context)
+
+	// Size returns the size of the AggregateFunc implementation in bytes. It
+	// does not include memory allocated during aggregation, which the
+	// implementation accounts for itself.
+	Size() int64
+}
+
+// AllocatingAggregateFunc is implemented by the AggregateFuncs which account
+// for memory allocated during aggregation.
+type AllocatingAggregateFunc interface {
+	AggregateFunc
+
+	// Allocated returns the memory currently accounted for by the
+	// AggregateFunc, on top of its Size.
+	Allocated() int64
+}
+
+// AggregateFuncAllocated returns the memory accounted for by fn during
+// aggregation, if any.
+func AggregateFuncAllocated(fn AggregateFunc) int64 {
+	if a, ok := fn.(AllocatingAggregateFunc); ok {
+		return a.Allocated()
+	}
+	return 0
+}
+
+const (
+	sizeOfIdentAggregate               = int64(unsafe.Sizeof(identAggregate{}))
+	sizeOfApproxCountDistinctAggregate = int64(unsafe.Sizeof(approxCountDistinctAggregate{}))
+	sizeOfCountMinSketchAggregate      = int64(unsafe.Sizeof(countMinSketchAggregate{}))
+	sizeOfEquiDepthHistogramAggregate  = int64(unsafe.Sizeof(equiDepthHistogramAggregate{}))
+	sizeOfArrayAggregate               = int64(unsafe.Sizeof(arrayAggregate{}))
+	sizeOfAvgAggregate                 = int64(unsafe.Sizeof(avgAggregate{}))
+	sizeOfConcatAggregate              = int64(unsafe.Sizeof(concatAggregate{}))
+	sizeOfBoolAndAggregate             = int64(unsafe.Sizeof(boolAndAggregate{}))
+	sizeOfBoolOrAggregate              = int64(unsafe.Sizeof(boolOrAggregate{}))
+	sizeOfCountAggregate               = int64(unsafe.Sizeof(countAggregate{}))
+	sizeOfCountRowsAggregate           = int64(unsafe.Sizeof(countRowsAggregate{}))
+	sizeOfValueAggregate               = int64(unsafe.Sizeof(valueAggregate{}))
+	sizeOfOrderedAggregate             = int64(unsafe.Sizeof(orderedAggregate{}))
+	sizeOfMaxAggregate                 = int64(unsafe.Sizeof(MaxAggregate{}))
+	sizeOfMinAggregate                 = int64(unsafe.Sizeof(MinAggregate{}))
+	sizeOfSmallIntSumAggregate         = int64(unsafe.Sizeof(smallIntSumAggregate{}))
+	sizeOfIntSumAggregate              = int64(unsafe.Sizeof(intSumAggregate{}))
+	sizeOfDecimalSumAggregate          = int64(unsafe.Sizeof(decimalSumAggregate{}))
+	sizeOfFloatSumAggregate            = int64(unsafe.Sizeof(floatSumAggregate{}))
+	sizeOfIntervalSumAggregate         = int64(unsafe.Sizeof(intervalSumAggregate{}))
+	sizeOfIntVarianceAggregate         = int64(unsafe.Sizeof(intVarianceAggregate{}))
+	sizeOfFloatVarianceAggregate       = int64(unsafe.Sizeof(floatVarianceAggregate{}))
+	sizeOfDecimalVarianceAggregate     = int64(unsafe.Sizeof(decimalVarianceAggregate{}))
+	sizeOfStdDevAggregate              = int64(unsafe.Sizeof(stdDevAggregate{}))
+	sizeOfAvgStateAggregate            = int64(unsafe.Sizeof(avgStateAggregate{}))
+	sizeOfAvgMergeAggregate            = int64(unsafe.Sizeof(avgMergeAggregate{}))
+	sizeOfVarianceStateAggregate       = int64(unsafe.Sizeof(varianceStateAggregate{}))
+	sizeOfVarianceMergeAggregate       = int64(unsafe.Sizeof(varianceMergeAggregate{}))
+	sizeOfPercentileAggregate          = int64(unsafe.Sizeof(percentileAggregate{}))
+	sizeOfRegressionAggregate          = int64(unsafe.Sizeof(regressionAggregate{}))
+	sizeOfBytesXorAggregate            = int64(unsafe.Sizeof(bytesXorAggregate{}))
+	sizeOfIntXorAggregate              = int64(unsafe.Sizeof(intXorAggregate{}))
+	sizeOfTopKAggregate                = int64(unsafe.Sizeof(topKAggregate{}))
+	sizeOfTopKMergeAggregate           = int64(unsafe.Sizeof(topKMergeAggregate{}))
+)
+
+// sizeOfBigWord is the size of a word of the coefficient of a decimal.
+const sizeOfBigWord = int64(unsafe.Sizeof(big.Word(0)))
+
+// sizeOfDatum is the size of a Datum interface value, excluding the value it
+// points to.
+const sizeOfDatum = int64(unsafe.Sizeof(Datum(nil)))
+
+// resizableItem accounts for a single piece of the state of an aggregate
+// whose size changes during aggregation.
+type resizableItem struct {
+	acc  mon.BoundAccount
+	size int64
+}
+
+func makeResizableItem(evalCtx *EvalContext) resizableItem {
+	return resizableItem{acc: evalCtx.Mon.MakeBoundAccount()}
+}
+
+// resize updates the accounted size of the item. The previous size remains
+// accounted for if the new size is refused.
+func (r *resizableItem) resize(ctx context.Context, size int64) error {
+	if err := r.acc.ResizeItem(ctx, r.size, size); err != nil {
+		return err
+	}
+	r.size = size
+	return nil
+}
+
+func (r *resizableItem) close(ctx context.Context) {
+	r.acc.Close(ctx)
+}
+
+// decimalCoeffSize returns the size in bytes of the coefficient of d, which is
+// allocated separately from d and grows with its number of digits.
+func decimalCoeffSize(d *apd.Decimal) int64 {
+	return int64(cap(d.Coeff.Bits())) * sizeOfBigWord
 }
 
 // Aggregates are a special class of builtin functions that are wrapped
@@ -88,6 +197,32 @@ type AggregateFunc interface {
 // execution.
 // Exported for use in documentation.
 var Aggregates = map[string][]Builtin{
+	"any_value": collectBuiltins(func(t Type) Builtin {
+		return makeAggBuiltin(t, t, newAnyValueAggregate,
+			"Returns an arbitrary non-NULL selected value.")
+	}, TypesAnyNonArray...),
+
+	"approx_count_distinct": {
+		makeAggBuiltin(TypeAny, TypeInt, newApproxCountDistinctAggregate,
+			"Estimates the number of distinct non-NULL selected values."),
+	},
+
+	// approx_count_distinct_sketch and approx_count_distinct_merge are the local
+	// and final stages of a distributed approx_count_distinct: the former
+	// encodes a HyperLogLog sketch of its input values, and the latter merges
+	// such sketches and estimates the distinct count of their union.
+	"approx_count_distinct_sketch": {
+		makeAggBuiltin(TypeAny, TypeBytes, newApproxCountDistinctSketchAggregate,
+			"Builds a HyperLogLog sketch of the distinct non-NULL selected values, "+
+				"for use with approx_count_distinct_merge."),
+	},
+
+	"approx_count_distinct_merge": {
+		makeAggBuiltin(TypeBytes, TypeInt, newApproxCountDistinctMergeAggregate,
+			"Estimates the number of distinct values in the union of the selected "+
+				"sketches built by approx_count_distinct_sketch."),
+	},
+
 	"array_agg": {
 		makeAggBuiltinWithReturnType(
 			TypeAny,
@@ -111,6 +246,22 @@ var Aggregates = map[string][]Builtin{
 			"Calculates the average of the selected values."),
 	},
 
+	"avg_state": {
+		makeAggBuiltin(TypeInt, TArray{Typ: TypeDecimal}, newIntAvgStateAggregate,
+			"Encodes the count and the sum of the selected values, for use with avg_merge."),
+		makeAggBuiltin(TypeFloat, TArray{Typ: TypeFloat}, newFloatAvgStateAggregate,
+			"Encodes the count and the sum of the selected values, for use with avg_merge."),
+		makeAggBuiltin(TypeDecimal, TArray{Typ: TypeDecimal}, newDecimalAvgStateAggregate,
+			"Encodes the count and the sum of the selected values, for use with avg_merge."),
+	},
+
+	"avg_merge": {
+		makeAggBuiltin(TArray{Typ: TypeFloat}, TypeFloat, newFloatAvgMergeAggregate,
+			"Calculates the average of the values whose states were encoded by avg_state."),
+		makeAggBuiltin(TArray{Typ: TypeDecimal}, TypeDecimal, newDecimalAvgMergeAggregate,
+			"Calculates the average of the values whose states were encoded by avg_state."),
+	},
+
 	"bool_and": {
 		makeAggBuiltin(TypeBool, TypeBool, newBoolAndAggregate,
 			"Calculates the boolean value of `AND`ing all selected values."),
@@ -122,9 +273,6 @@ var Aggregates = map[string][]Builtin{
 	},
 
 	"concat_agg": {
-		// TODO(knz): When CockroachDB supports STRING_AGG, CONCAT_AGG(X)
-		// should be substituted to STRING_AGG(X, '') and executed as
-		// such (no need for a separate implementation).
 		makeAggBuiltin(TypeString, TypeString, newStringConcatAggregate,
 			"Concatenates all selected values."),
 		makeAggBuiltin(TypeBytes, TypeBytes, newBytesConcatAggregate,
@@ -133,9 +281,45 @@ var Aggregates = map[string][]Builtin{
 		// supports parametric types.
 	},
 
+	"string_agg": {
+		makeAggBuiltinWithArgTypes(
+			ArgTypes{{"arg", TypeString}, {"delimiter", TypeString}},
+			fixedReturnType(TypeString),
+			newStringConcatAggregate,
+			"Concatenates all selected values, separated by the delimiter.",
+		),
+		makeAggBuiltinWithArgTypes(
+			ArgTypes{{"arg", TypeBytes}, {"delimiter", TypeBytes}},
+			fixedReturnType(TypeBytes),
+			newBytesConcatAggregate,
+			"Concatenates all selected values, separated by the delimiter.",
+		),
+	},
+
+	"corr": makeRegressionBuiltins(TypeFloat, regrCorr,
+		"Calculates the correlation coefficient of the selected values."),
+	"covar_pop": makeRegressionBuiltins(TypeFloat, regrCovarPop,
+		"Calculates the population covariance of the selected values."),
+	"covar_samp": makeRegressionBuiltins(TypeFloat, regrCovarSamp,
+		"Calculates the sample covariance of the selected values."),
+
 	"count": {
-		makeAggBuiltin(TypeAny, TypeInt, newCountAggregate,
-			"Calculates the number of selected elements."),
+		makeCountBuiltin(),
+	},
+
+	// count_min_sketch builds a count-min sketch of its input values, from
+	// which the number of occurrences of each value can be estimated, and
+	// count_min_sketch_merge merges such sketches. They are the local and final
+	// stages of a distributed count_min_sketch.
+	"count_min_sketch": {
+		makeAggBuiltin(TypeAny, TypeBytes, newCountMinSketchAggregate,
+			"Builds a count-min sketch of the number of occurrences of the non-NULL "+
+				"selected values, for use with count_min_sketch_estimate."),
+	},
+
+	"count_min_sketch_merge": {
+		makeAggBuiltin(TypeBytes, TypeBytes, newCountMinSketchMergeAggregate,
+			"Merges the selected count-min sketches built by count_min_sketch."),
 	},
 
 	"count_rows": {
@@ -152,6 +336,55 @@ var Aggregates = map[string][]Builtin{
 		},
 	},
 
+	// equidepth_histogram_sketch and equidepth_histogram_merge are the local
+	// and final stages of a distributed equidepth_histogram: the former
+	// encodes the number of buckets and a t-digest of its input values, and the
+	// latter merges such digests and estimates the histogram of their union.
+	"equidepth_histogram": collectBuiltins(func(t Type) Builtin {
+		return makeAggBuiltinWithArgTypes(
+			ArgTypes{{"arg", t}, {"buckets", TypeInt}},
+			fixedReturnType(TArray{TypeFloat}),
+			newEquiDepthHistogramAggregate,
+			"Estimates the boundaries of an equi-depth histogram of the selected values, "+
+				"whose buckets each hold about the same number of values. The first "+
+				"boundary is the minimum and the last one is the maximum.",
+		)
+	}, TypeInt, TypeFloat, TypeDecimal),
+
+	"equidepth_histogram_sketch": collectBuiltins(func(t Type) Builtin {
+		return makeAggBuiltinWithArgTypes(
+			ArgTypes{{"arg", t}, {"buckets", TypeInt}},
+			fixedReturnType(TypeBytes),
+			newEquiDepthHistogramSketchAggregate,
+			"Builds a t-digest of the selected values, for use with "+
+				"equidepth_histogram_merge.",
+		)
+	}, TypeInt, TypeFloat, TypeDecimal),
+
+	"equidepth_histogram_merge": {
+		makeAggBuiltin(TypeBytes, TArray{TypeFloat}, newEquiDepthHistogramMergeAggregate,
+			"Estimates the boundaries of an equi-depth histogram of the union of the "+
+				"selected t-digests built by equidepth_histogram_sketch."),
+	},
+
+	// first_value and last_value return the value of the first or last row of
+	// the group according to the ORDER BY given in their call, or to the order
+	// of their input if there is none. Applied as window functions, they
+	// return the value of the first or last row of the window frame instead.
+	"first_value": collectBuiltins(func(t Type) Builtin {
+		b := makeAggBuiltin(t, t, newFirstValueAggregate,
+			"Returns the selected value of the first row of the group.")
+		b.WindowFunc = newFirstValueWindow
+		return b
+	}, TypesAnyNonArray...),
+
+	"last_value": collectBuiltins(func(t Type) Builtin {
+		b := makeAggBuiltin(t, t, newLastValueAggregate,
+			"Returns the selected value of the last row of the group.")
+		b.WindowFunc = newLastValueWindow
+		return b
+	}, TypesAnyNonArray...),
+
 	"max": collectBuiltins(func(t Type) Builtin {
 		return makeAggBuiltin(t, t, newMaxAggregate,
 			"Identifies the maximum selected value.")
@@ -161,6 +394,96 @@ var Aggregates = map[string][]Builtin{
 			"Identifies the minimum selected value.")
 	}, TypesAnyNonArray...),
 
+	"median": collectBuiltins(func(t Type) Builtin {
+		return makeAggBuiltin(t, TypeFloat, newMedianAggregate,
+			"Estimates the median of the selected values.")
+	}, TypeInt, TypeFloat, TypeDecimal),
+
+	"percentile_cont": collectBuiltins(func(t Type) Builtin {
+		return makeAggBuiltinWithArgTypes(
+			ArgTypes{{"arg", t}, {"fraction", TypeFloat}},
+			fixedReturnType(TypeFloat),
+			newPercentileContAggregate,
+			"Estimates the value at the given fraction of the selected values, "+
+				"interpolating between adjacent values if needed.",
+		)
+	}, TypeInt, TypeFloat, TypeDecimal),
+
+	"percentile_disc": collectBuiltins(func(t Type) Builtin {
+		return makeAggBuiltinWithArgTypes(
+			ArgTypes{{"arg", t}, {"fraction", TypeFloat}},
+			fixedReturnType(TypeFloat),
+			newPercentileDiscAggregate,
+			"Estimates the first selected value whose position in the ordering of "+
+				"the selected values equals or exceeds the given fraction.",
+		)
+	}, TypeInt, TypeFloat, TypeDecimal),
+
+	// percentile_sketch and median_merge are the local and final stages of a
+	// distributed median: the former encodes a t-digest of its input values,
+	// and the latter merges such digests and estimates the median of their
+	// union.
+	"percentile_sketch": collectBuiltins(func(t Type) Builtin {
+		return makeAggBuiltin(t, TypeBytes, newPercentileSketchAggregate,
+			"Builds a t-digest of the selected values, for use with median_merge.")
+	}, TypeInt, TypeFloat, TypeDecimal),
+
+	"median_merge": {
+		makeAggBuiltin(TypeBytes, TypeFloat, newMedianMergeAggregate,
+			"Estimates the median of the union of the selected t-digests built by "+
+				"percentile_sketch."),
+	},
+
+	"regr_avgx": makeRegressionBuiltins(TypeFloat, regrAvgX,
+		"Calculates the average of the independent variable (sum(X)/N)."),
+	"regr_avgy": makeRegressionBuiltins(TypeFloat, regrAvgY,
+		"Calculates the average of the dependent variable (sum(Y)/N)."),
+	"regr_count": makeRegressionBuiltins(TypeInt, regrCount,
+		"Calculates the number of input rows in which both expressions are non-null."),
+	"regr_intercept": makeRegressionBuiltins(TypeFloat, regrIntercept,
+		"Calculates the y-intercept of the least-squares-fit linear equation "+
+			"determined by the (X, Y) pairs."),
+	"regr_r2": makeRegressionBuiltins(TypeFloat, regrR2,
+		"Calculates the square of the correlation coefficient."),
+	"regr_slope": makeRegressionBuiltins(TypeFloat, regrSlope,
+		"Calculates the slope of the least-squares-fit linear equation determined "+
+			"by the (X, Y) pairs."),
+	"regr_sxx": makeRegressionBuiltins(TypeFloat, regrSXX,
+		"Calculates sum(X^2) - sum(X)^2/N (\"sum of squares\" of the independent "+
+			"variable)."),
+	"regr_sxy": makeRegressionBuiltins(TypeFloat, regrSXY,
+		"Calculates sum(X*Y) - sum(X) * sum(Y)/N (\"sum of products\" of "+
+			"independent times dependent variable)."),
+	"regr_syy": makeRegressionBuiltins(TypeFloat, regrSYY,
+		"Calculates sum(Y^2) - sum(Y)^2/N (\"sum of squares\" of the dependent "+
+			"variable)."),
+
+	// regr_state is the local stage of the distributed two-argument statistical
+	// aggregates: it encodes their common transition state. The final stage of
+	// each aggregate merges these states and computes its result.
+	"regr_state": collectBuiltins(func(t Type) Builtin {
+		return makeAggBuiltinWithArgTypes(
+			ArgTypes{{"y", t}, {"x", t}},
+			fixedReturnType(TypeBytes),
+			newRegressionStateAggregate,
+			"Encodes the transition state of the two-argument statistical aggregates, "+
+				"for use with their _merge variants.",
+		)
+	}, TypeInt, TypeFloat, TypeDecimal),
+
+	"corr_merge":           makeRegressionMergeBuiltins(TypeFloat, regrCorr),
+	"covar_pop_merge":      makeRegressionMergeBuiltins(TypeFloat, regrCovarPop),
+	"covar_samp_merge":     makeRegressionMergeBuiltins(TypeFloat, regrCovarSamp),
+	"regr_avgx_merge":      makeRegressionMergeBuiltins(TypeFloat, regrAvgX),
+	"regr_avgy_merge":      makeRegressionMergeBuiltins(TypeFloat, regrAvgY),
+	"regr_count_merge":     makeRegressionMergeBuiltins(TypeInt, regrCount),
+	"regr_intercept_merge": makeRegressionMergeBuiltins(TypeFloat, regrIntercept),
+	"regr_r2_merge":        makeRegressionMergeBuiltins(TypeFloat, regrR2),
+	"regr_slope_merge":     makeRegressionMergeBuiltins(TypeFloat, regrSlope),
+	"regr_sxx_merge":       makeRegressionMergeBuiltins(TypeFloat, regrSXX),
+	"regr_sxy_merge":       makeRegressionMergeBuiltins(TypeFloat, regrSXY),
+	"regr_syy_merge":       makeRegressionMergeBuiltins(TypeFloat, regrSYY),
+
 	"sum_int": {
 		makeAggBuiltin(TypeInt, TypeInt, newSmallIntSumAggregate,
 			"Calculates the sum of the selected values."),
@@ -177,6 +500,40 @@ var Aggregates = map[string][]Builtin{
 			"Calculates the sum of the selected values."),
 	},
 
+	"top_k": {
+		makeAggBuiltinWithArgTypes(
+			ArgTypes{{"value", TypeAny}, {"k", TypeInt}},
+			topKReturnType,
+			newTopKAggregate,
+			"Aggregates the k greatest selected values into an array, in descending order. "+
+				"k is taken from the first row.",
+		),
+	},
+
+	"top_k_state": {
+		makeAggBuiltinWithArgTypes(
+			ArgTypes{{"value", TypeAny}, {"k", TypeInt}},
+			topKReturnType,
+			newTopKStateAggregate,
+			"Encodes the k greatest selected values, for use with top_k_merge.",
+		),
+	},
+
+	"top_k_merge": {
+		makeAggBuiltinWithReturnType(
+			TypeAnyArray,
+			func(args []TypedExpr) Type {
+				if len(args) == 0 {
+					return unknownReturnType
+				}
+				return args[0].ResolvedType()
+			},
+			newTopKMergeAggregate,
+			"Aggregates the k greatest values whose states were encoded by top_k_state into "+
+				"an array, in descending order.",
+		),
+	},
+
 	"variance": {
 		makeAggBuiltin(TypeInt, TypeDecimal, newIntVarianceAggregate,
 			"Calculates the variance of the selected values."),
@@ -186,6 +543,25 @@ var Aggregates = map[string][]Builtin{
 			"Calculates the variance of the selected values."),
 	},
 
+	"variance_state": {
+		makeAggBuiltin(TypeInt, TArray{Typ: TypeDecimal}, newIntVarianceStateAggregate,
+			"Encodes the count, the mean and the sum of squared differences from the mean "+
+				"of the selected values, for use with variance_merge and stddev_merge."),
+		makeAggBuiltin(TypeDecimal, TArray{Typ: TypeDecimal}, newDecimalVarianceStateAggregate,
+			"Encodes the count, the mean and the sum of squared differences from the mean "+
+				"of the selected values, for use with variance_merge and stddev_merge."),
+		makeAggBuiltin(TypeFloat, TArray{Typ: TypeFloat}, newFloatVarianceStateAggregate,
+			"Encodes the count, the mean and the sum of squared differences from the mean "+
+				"of the selected values, for use with variance_merge and stddev_merge."),
+	},
+
+	"variance_merge": {
+		makeAggBuiltin(TArray{Typ: TypeDecimal}, TypeDecimal, newDecimalVarianceMergeAggregate,
+			"Calculates the variance of the values whose states were encoded by variance_state."),
+		makeAggBuiltin(TArray{Typ: TypeFloat}, TypeFloat, newFloatVarianceMergeAggregate,
+			"Calculates the variance of the values whose states were encoded by variance_state."),
+	},
+
 	"stddev": {
 		makeAggBuiltin(TypeInt, TypeDecimal, newIntStdDevAggregate,
 			"Calculates the standard deviation of the selected values."),
@@ -195,6 +571,15 @@ var Aggregates = map[string][]Builtin{
 			"Calculates the standard deviation of the selected values."),
 	},
 
+	"stddev_merge": {
+		makeAggBuiltin(TArray{Typ: TypeDecimal}, TypeDecimal, newDecimalStdDevMergeAggregate,
+			"Calculates the standard deviation of the values whose states were encoded by "+
+				"variance_state."),
+		makeAggBuiltin(TArray{Typ: TypeFloat}, TypeFloat, newFloatStdDevMergeAggregate,
+			"Calculates the standard deviation of the values whose states were encoded by "+
+				"variance_state."),
+	},
+
 	"xor_agg": {
 		makeAggBuiltin(TypeBytes, TypeBytes, newBytesXorAggregate,
 			"Calculates the bitwise XOR of the selected values."),
@@ -203,19 +588,57 @@ var Aggregates = map[string][]Builtin{
 	},
 }
 
+// makeRegressionBuiltins returns the overloads of a two-argument statistical
+// aggregate, which takes a dependent value Y and an independent value X.
+func makeRegressionBuiltins(ret Type, final regressionFinal, info string) []Builtin {
+	f := func(_ []Type, _ *EvalContext) AggregateFunc {
+		return &regressionAggregate{final: final}
+	}
+	return collectBuiltins(func(t Type) Builtin {
+		return makeAggBuiltinWithArgTypes(ArgTypes{{"y", t}, {"x", t}}, fixedReturnType(ret), f, info)
+	}, TypeInt, TypeFloat, TypeDecimal)
+}
+
+// makeRegressionMergeBuiltins returns the final stage of a distributed
+// two-argument statistical aggregate, which merges the states encoded by
+// regr_state.
+func makeRegressionMergeBuiltins(ret Type, final regressionFinal) []Builtin {
+	f := func(_ []Type, _ *EvalContext) AggregateFunc {
+		return &regressionAggregate{mergeInput: true, final: final}
+	}
+	return []Builtin{makeAggBuiltin(TypeBytes, ret, f,
+		"Merges the selected states built by regr_state and computes the result.")}
+}
+
+// makeCountBuiltin returns the count builtin, which takes any number of
+// arguments so that COUNT(DISTINCT a, b) counts the distinct pairs.
+func makeCountBuiltin() Builtin {
+	b := makeAggBuiltin(TypeAny, TypeInt, newCountAggregate,
+		"Calculates the number of selected elements. Given several arguments, "+
+			"counts the selected rows where none of them is NULL.")
+	b.Types = VariadicType{TypeAny}
+	return b
+}
+
 func makeAggBuiltin(in, ret Type, f func([]Type, *EvalContext) AggregateFunc, info string) Builtin {
 	return makeAggBuiltinWithReturnType(in, fixedReturnType(ret), f, info)
 }
 
 func makeAggBuiltinWithReturnType(
 	in Type, retType returnTyper, f func([]Type, *EvalContext) AggregateFunc, info string,
+) Builtin {
+	return makeAggBuiltinWithArgTypes(ArgTypes{{"arg", in}}, retType, f, info)
+}
+
+func makeAggBuiltinWithArgTypes(
+	in ArgTypes, retType returnTyper, f func([]Type, *EvalContext) AggregateFunc, info string,
 ) Builtin {
 	return Builtin{
 		// See the comment about aggregate functions in the definitions
 		// of the Builtins array above.
 		impure:        true,
 		class:         AggregateClass,
-		Types:         ArgTypes{{"arg", in}},
+		Types:         in,
 		ReturnType:    retType,
 		AggregateFunc: f,
 		WindowFunc: func(params []Type, evalCtx *EvalContext) WindowFunc {
@@ -225,8 +648,15 @@ func makeAggBuiltinWithReturnType(
 	}
 }
 
+var _ AggregateFunc = &approxCountDistinctAggregate{}
 var _ AggregateFunc = &arrayAggregate{}
 var _ AggregateFunc = &avgAggregate{}
+var _ AggregateFunc = &topKAggregate{}
+var _ AggregateFunc = &countMinSketchAggregate{}
+var _ AggregateFunc = &equiDepthHistogramAggregate{}
+var _ AggregateFunc = &topKMergeAggregate{}
+var _ AggregateFunc = &valueAggregate{}
+var _ AggregateFunc = &orderedAggregate{}
 var _ AggregateFunc = &countAggregate{}
 var _ AggregateFunc = &MaxAggregate{}
 var _ AggregateFunc = &MinAggregate{}
@@ -238,10 +668,26 @@ var _ AggregateFunc = &intVarianceAggregate{}
 var _ AggregateFunc = &floatVarianceAggregate{}
 var _ AggregateFunc = &decimalVarianceAggregate{}
 var _ AggregateFunc = &identAggregate{}
+var _ AggregateFunc = &percentileAggregate{}
 var _ AggregateFunc = &concatAggregate{}
+var _ AggregateFunc = &regressionAggregate{}
 var _ AggregateFunc = &bytesXorAggregate{}
 var _ AggregateFunc = &intXorAggregate{}
 
+var _ AllocatingAggregateFunc = &approxCountDistinctAggregate{}
+var _ AllocatingAggregateFunc = &arrayAggregate{}
+var _ AllocatingAggregateFunc = &topKAggregate{}
+var _ AllocatingAggregateFunc = &countMinSketchAggregate{}
+var _ AllocatingAggregateFunc = &equiDepthHistogramAggregate{}
+var _ AllocatingAggregateFunc = &valueAggregate{}
+var _ AllocatingAggregateFunc = &orderedAggregate{}
+var _ AllocatingAggregateFunc = &MaxAggregate{}
+var _ AllocatingAggregateFunc = &MinAggregate{}
+var _ AllocatingAggregateFunc = &intSumAggregate{}
+var _ AllocatingAggregateFunc = &decimalSumAggregate{}
+var _ AllocatingAggregateFunc = &percentileAggregate{}
+var _ AllocatingAggregateFunc = &concatAggregate{}
+
 // In order to render the unaggregated (i.e. grouped) fields, during aggregation,
 // the values for those fields have to be stored for each bucket.
 // The `identAggregate` provides an "aggregate" function that actually
@@ -258,7 +704,7 @@ func NewIdentAggregate(*EvalContext) AggregateFunc {
 }
 
 // Add sets the value to the passed datum.
-func (a *identAggregate) Add(_ context.Context, datum Datum) error {
+func (a *identAggregate) Add(_ context.Context, datum Datum, _ ...Datum) error {
 	// If we see at least one non-NULL value, ignore any NULLs.
 	// This is used in distributed multi-stage aggregations, where a local stage
 	// with multiple (parallel) instances feeds into a final stage. If some of the
@@ -286,6 +732,187 @@ func (a *identAggregate) Result() (Datum, error) {
 // Close is no-op in aggregates using constant space.
 func (a *identAggregate) Close(context.Context) {}
 
+// Size is part of the AggregateFunc interface.
+func (a *identAggregate) Size() int64 {
+	return sizeOfIdentAggregate
+}
+
+// approxCountDistinctAggregate estimates the number of distinct values using
+// a HyperLogLog sketch. Depending on the builtin, it either inserts values or
+// merges encoded sketches, and either returns the estimate or the encoding of
+// the sketch.
+type approxCountDistinctAggregate struct {
+	sketch       hyperloglog.Sketch
+	mergeInput   bool
+	sketchResult bool
+	sawNonNull   bool
+	scratch      []byte
+	acc          mon.BoundAccount
+}
+
+func newApproxCountDistinctAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &approxCountDistinctAggregate{acc: evalCtx.Mon.MakeBoundAccount()}
+}
+
+func newApproxCountDistinctSketchAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &approxCountDistinctAggregate{
+		sketchResult: true,
+		acc:          evalCtx.Mon.MakeBoundAccount(),
+	}
+}
+
+func newApproxCountDistinctMergeAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &approxCountDistinctAggregate{
+		mergeInput: true,
+		acc:        evalCtx.Mon.MakeBoundAccount(),
+	}
+}
+
+// Add inserts the passed datum into the sketch, or merges the sketch it
+// encodes.
+func (a *approxCountDistinctAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
+	if datum == DNull {
+		return nil
+	}
+	if !a.sawNonNull {
+		// The sketch allocates its registers when it sees its first value.
+		if err := a.acc.Grow(ctx, hyperloglog.EncodedSize); err != nil {
+			return err
+		}
+		a.sawNonNull = true
+	}
+	if a.mergeInput {
+		return a.sketch.Decode([]byte(*datum.(*DBytes)))
+	}
+	a.scratch = appendApproxDistinctKey(a.scratch[:0], datum)
+	a.sketch.Insert(a.scratch)
+	return nil
+}
+
+// appendApproxDistinctKey appends a representation of the datum to appendTo
+// such that datums of the same type are equal if and only if their
+// representations are equal.
+func appendApproxDistinctKey(appendTo []byte, datum Datum) []byte {
+	switch t := datum.(type) {
+	case *DDecimal:
+		// Decimals which only differ in their number of trailing zeros are equal.
+		var d apd.Decimal
+		d.Reduce(&t.Decimal)
+		return append(appendTo, d.String()...)
+	case *DFloat:
+		if *t == 0 {
+			// Positive and negative zero are equal.
+			return append(appendTo, '0')
+		}
+	}
+	return append(appendTo, AsStringWithFlags(datum, FmtBareStrings)...)
+}
+
+// Result returns the estimated number of distinct values, or the encoded
+// sketch.
+func (a *approxCountDistinctAggregate) Result() (Datum, error) {
+	if a.sketchResult {
+		if !a.sawNonNull {
+			return DNull, nil
+		}
+		return NewDBytes(DBytes(a.sketch.Encode(nil))), nil
+	}
+	return NewDInt(DInt(a.sketch.Estimate())), nil
+}
+
+// Close allows the aggregate to release the memory it requested during
+// operation.
+func (a *approxCountDistinctAggregate) Close(ctx context.Context) {
+	a.acc.Close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *approxCountDistinctAggregate) Size() int64 {
+	return sizeOfApproxCountDistinctAggregate
+}
+
+// Allocated is part of the AllocatingAggregateFunc interface.
+func (a *approxCountDistinctAggregate) Allocated() int64 {
+	return a.acc.CurrentlyAllocated()
+}
+
+// countMinSketchAggregate builds a count-min sketch of the number of
+// occurrences of each value. Depending on the builtin, it either inserts
+// values or merges encoded sketches; it returns the encoding of the sketch.
+type countMinSketchAggregate struct {
+	sketch     countminsketch.Sketch
+	mergeInput bool
+	sawNonNull bool
+	scratch    []byte
+	acc        mon.BoundAccount
+}
+
+func newCountMinSketchAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &countMinSketchAggregate{acc: evalCtx.Mon.MakeBoundAccount()}
+}
+
+func newCountMinSketchMergeAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &countMinSketchAggregate{
+		mergeInput: true,
+		acc:        evalCtx.Mon.MakeBoundAccount(),
+	}
+}
+
+// Add inserts the passed datum into the sketch, or merges the sketch it
+// encodes.
+func (a *countMinSketchAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
+	if datum == DNull {
+		return nil
+	}
+	if !a.sawNonNull {
+		// The sketch allocates its counters when it sees its first value.
+		if err := a.acc.Grow(ctx, countminsketch.Size); err != nil {
+			return err
+		}
+		a.sawNonNull = true
+	}
+	if a.mergeInput {
+		return a.sketch.Decode([]byte(*datum.(*DBytes)))
+	}
+	a.scratch = appendApproxDistinctKey(a.scratch[:0], datum)
+	a.sketch.Insert(a.scratch)
+	return nil
+}
+
+// Result returns the encoded sketch.
+func (a *countMinSketchAggregate) Result() (Datum, error) {
+	if !a.sawNonNull {
+		return DNull, nil
+	}
+	return NewDBytes(DBytes(a.sketch.Encode(nil))), nil
+}
+
+// Close allows the aggregate to release the memory it requested during
+// operation.
+func (a *countMinSketchAggregate) Close(ctx context.Context) {
+	a.acc.Close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *countMinSketchAggregate) Size() int64 {
+	return sizeOfCountMinSketchAggregate
+}
+
+// Allocated is part of the AllocatingAggregateFunc interface.
+func (a *countMinSketchAggregate) Allocated() int64 {
+	return a.acc.CurrentlyAllocated()
+}
+
+// countMinSketchEstimate returns the estimated number of occurrences of the
+// datum in the values whose count-min sketch is encoded by sketch.
+func countMinSketchEstimate(sketch *DBytes, datum Datum) (Datum, error) {
+	var s countminsketch.Sketch
+	if err := s.Decode([]byte(*sketch)); err != nil {
+		return nil, err
+	}
+	return NewDInt(DInt(s.Estimate(appendApproxDistinctKey(nil, datum)))), nil
+}
+
 type arrayAggregate struct {
 	arr *DArray
 	acc mon.BoundAccount
@@ -299,7 +926,7 @@ func newArrayAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
 }
 
 // Add accumulates the passed datum into the array.
-func (a *arrayAggregate) Add(ctx context.Context, datum Datum) error {
+func (a *arrayAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
 	if err := a.acc.Grow(ctx, int64(datum.Size())); err != nil {
 		return err
 	}
@@ -323,6 +950,16 @@ func (a *arrayAggregate) Close(ctx context.Context) {
 	a.acc.Close(ctx)
 }
 
+// Size is part of the AggregateFunc interface.
+func (a *arrayAggregate) Size() int64 {
+	return sizeOfArrayAggregate
+}
+
+// Allocated is part of the AllocatingAggregateFunc interface.
+func (a *arrayAggregate) Allocated() int64 {
+	return a.acc.CurrentlyAllocated()
+}
+
 type avgAggregate struct {
 	agg   AggregateFunc
 	count int
@@ -339,7 +976,7 @@ func newDecimalAvgAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
 }
 
 // Add accumulates the passed datum into the average.
-func (a *avgAggregate) Add(ctx context.Context, datum Datum) error {
+func (a *avgAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
@@ -372,8 +1009,17 @@ func (a *avgAggregate) Result() (Datum, error) {
 }
 
 // Close is part of the AggregateFunc interface.
-func (a *avgAggregate) Close(context.Context) {}
+func (a *avgAggregate) Close(ctx context.Context) {
+	a.agg.Close(ctx)
+}
 
+// Size is part of the AggregateFunc interface.
+func (a *avgAggregate) Size() int64 {
+	return sizeOfAvgAggregate + a.agg.Size()
+}
+
+// concatAggregate implements both CONCAT_AGG and STRING_AGG. The latter
+// passes a delimiter which is written between the concatenated values.
 type concatAggregate struct {
 	forBytes   bool
 	sawNonNull bool
@@ -391,20 +1037,32 @@ func newStringConcatAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
 	return &concatAggregate{acc: evalCtx.Mon.MakeBoundAccount()}
 }
 
-func (a *concatAggregate) Add(ctx context.Context, datum Datum) error {
+func (a *concatAggregate) Add(ctx context.Context, datum Datum, others ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
+	var delimiter Datum = DNull
+	if len(others) > 0 && a.sawNonNull {
+		// The delimiter only goes between values.
+		delimiter = others[0]
+	}
 	a.sawNonNull = true
-	var arg string
+	var arg, delimiterArg string
 	if a.forBytes {
 		arg = string(*datum.(*DBytes))
+		if delimiter != DNull {
+			delimiterArg = string(*delimiter.(*DBytes))
+		}
 	} else {
 		arg = string(MustBeDString(datum))
+		if delimiter != DNull {
+			delimiterArg = string(MustBeDString(delimiter))
+		}
 	}
-	if err := a.acc.Grow(ctx, int64(datum.Size())); err != nil {
+	if err := a.acc.Grow(ctx, int64(datum.Size())+int64(len(delimiterArg))); err != nil {
 		return err
 	}
+	a.result.WriteString(delimiterArg)
 	a.result.WriteString(arg)
 	return nil
 }
@@ -427,6 +1085,16 @@ func (a *concatAggregate) Close(ctx context.Context) {
 	a.acc.Close(ctx)
 }
 
+// Size is part of the AggregateFunc interface.
+func (a *concatAggregate) Size() int64 {
+	return sizeOfConcatAggregate
+}
+
+// Allocated is part of the AllocatingAggregateFunc interface.
+func (a *concatAggregate) Allocated() int64 {
+	return a.acc.CurrentlyAllocated()
+}
+
 type boolAndAggregate struct {
 	sawNonNull bool
 	result     bool
@@ -436,7 +1104,7 @@ func newBoolAndAggregate(_ []Type, _ *EvalContext) AggregateFunc {
 	return &boolAndAggregate{}
 }
 
-func (a *boolAndAggregate) Add(_ context.Context, datum Datum) error {
+func (a *boolAndAggregate) Add(_ context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
@@ -458,6 +1126,11 @@ func (a *boolAndAggregate) Result() (Datum, error) {
 // Close is part of the AggregateFunc interface.
 func (a *boolAndAggregate) Close(context.Context) {}
 
+// Size is part of the AggregateFunc interface.
+func (a *boolAndAggregate) Size() int64 {
+	return sizeOfBoolAndAggregate
+}
+
 type boolOrAggregate struct {
 	sawNonNull bool
 	result     bool
@@ -467,7 +1140,7 @@ func newBoolOrAggregate(_ []Type, _ *EvalContext) AggregateFunc {
 	return &boolOrAggregate{}
 }
 
-func (a *boolOrAggregate) Add(_ context.Context, datum Datum) error {
+func (a *boolOrAggregate) Add(_ context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
@@ -486,6 +1159,11 @@ func (a *boolOrAggregate) Result() (Datum, error) {
 // Close is part of the AggregateFunc interface.
 func (a *boolOrAggregate) Close(context.Context) {}
 
+// Size is part of the AggregateFunc interface.
+func (a *boolOrAggregate) Size() int64 {
+	return sizeOfBoolOrAggregate
+}
+
 type countAggregate struct {
 	count int
 }
@@ -494,10 +1172,15 @@ func newCountAggregate(_ []Type, _ *EvalContext) AggregateFunc {
 	return &countAggregate{}
 }
 
-func (a *countAggregate) Add(_ context.Context, datum Datum) error {
+func (a *countAggregate) Add(_ context.Context, datum Datum, otherArgs ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
+	for _, d := range otherArgs {
+		if d == DNull {
+			return nil
+		}
+	}
 	a.count++
 	return nil
 }
@@ -509,6 +1192,11 @@ func (a *countAggregate) Result() (Datum, error) {
 // Close is part of the AggregateFunc interface.
 func (a *countAggregate) Close(context.Context) {}
 
+// Size is part of the AggregateFunc interface.
+func (a *countAggregate) Size() int64 {
+	return sizeOfCountAggregate
+}
+
 type countRowsAggregate struct {
 	count int
 }
@@ -517,7 +1205,7 @@ func newCountRowsAggregate(_ []Type, _ *EvalContext) AggregateFunc {
 	return &countRowsAggregate{}
 }
 
-func (a *countRowsAggregate) Add(_ context.Context, _ Datum) error {
+func (a *countRowsAggregate) Add(_ context.Context, _ Datum, _ ...Datum) error {
 	a.count++
 	return nil
 }
@@ -529,29 +1217,194 @@ func (a *countRowsAggregate) Result() (Datum, error) {
 // Close is part of the AggregateFunc interface.
 func (a *countRowsAggregate) Close(context.Context) {}
 
+// Size is part of the AggregateFunc interface.
+func (a *countRowsAggregate) Size() int64 {
+	return sizeOfCountRowsAggregate
+}
+
+// valueAggregate keeps track of a single value passed to Add: the first one,
+// the last one, or the first non-NULL one. When the aggregation has an
+// ordering, the executor only feeds it the value of the row that sorts first
+// (or last), so that it doesn't depend on the order of its input.
+type valueAggregate struct {
+	val Datum
+	// last is set if each value passed to Add replaces the previous one.
+	last bool
+	// skipNulls is set if NULL values are ignored.
+	skipNulls bool
+	// valSize accounts for the size of val, which changes along with it.
+	valSize resizableItem
+}
+
+func newFirstValueAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &valueAggregate{valSize: makeResizableItem(evalCtx)}
+}
+
+func newLastValueAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &valueAggregate{last: true, valSize: makeResizableItem(evalCtx)}
+}
+
+func newAnyValueAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &valueAggregate{skipNulls: true, valSize: makeResizableItem(evalCtx)}
+}
+
+// Add keeps the passed datum if it is the value the aggregation picks so far.
+func (a *valueAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
+	if a.skipNulls && datum == DNull {
+		return nil
+	}
+	if a.val != nil && !a.last {
+		return nil
+	}
+	if err := a.valSize.resize(ctx, int64(datum.Size())); err != nil {
+		return err
+	}
+	a.val = datum
+	return nil
+}
+
+// Result returns the value picked by the aggregation.
+func (a *valueAggregate) Result() (Datum, error) {
+	if a.val == nil {
+		return DNull, nil
+	}
+	return a.val, nil
+}
+
+// Close is part of the AggregateFunc interface.
+func (a *valueAggregate) Close(ctx context.Context) {
+	a.valSize.close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *valueAggregate) Size() int64 {
+	return sizeOfValueAggregate
+}
+
+// Allocated is part of the AllocatingAggregateFunc interface.
+func (a *valueAggregate) Allocated() int64 {
+	return a.valSize.size
+}
+
+// orderedAggregate wraps the aggregate function of an aggregation with an
+// ordering (e.g. first_value(x ORDER BY y)) for a single group. It keeps track
+// of the values of the ordering expressions of the best row so far, and only
+// feeds the wrapped function the arguments of that row: each better row
+// replaces the function with a new one.
+type orderedAggregate struct {
+	create  func(*EvalContext) AggregateFunc
+	evalCtx *EvalContext
+	impl    AggregateFunc
+	// directions holds the direction of each ordering expression.
+	directions []Direction
+	// last is set if the row which sorts last is the best one, and ties are
+	// broken in favor of the last row added. Otherwise the row which sorts
+	// first is, and ties are broken in favor of the first row added.
+	last bool
+	// best holds the values of the ordering expressions of the best row so
+	// far. It is nil until a row is added.
+	best     Datums
+	bestSize resizableItem
+}
+
+// NewOrderedAggregate returns an aggregate function which feeds the function
+// returned by create the arguments of the best row according to the given
+// ordering directions. The values of the ordering expressions are passed to
+// Add after the arguments of the function.
+func NewOrderedAggregate(
+	create func(*EvalContext) AggregateFunc, evalCtx *EvalContext, directions []Direction, last bool,
+) AggregateFunc {
+	return &orderedAggregate{
+		create:     create,
+		evalCtx:    evalCtx,
+		impl:       create(evalCtx),
+		directions: directions,
+		last:       last,
+		bestSize:   makeResizableItem(evalCtx),
+	}
+}
+
+// Add feeds the arguments of the row to the wrapped function if the row is
+// better than all the rows added before it.
+func (a *orderedAggregate) Add(ctx context.Context, datum Datum, otherArgs ...Datum) error {
+	n := len(otherArgs) - len(a.directions)
+	otherArgs, keys := otherArgs[:n], otherArgs[n:]
+	if a.best != nil {
+		cmp := 0
+		for i, dir := range a.directions {
+			if cmp = keys[i].Compare(a.evalCtx, a.best[i]); cmp != 0 {
+				if dir == Descending {
+					cmp = -cmp
+				}
+				break
+			}
+		}
+		if (!a.last && cmp >= 0) || (a.last && cmp < 0) {
+			return nil
+		}
+	}
+	var size int64
+	for _, d := range keys {
+		size += int64(d.Size())
+	}
+	if err := a.bestSize.resize(ctx, size); err != nil {
+		return err
+	}
+	if a.best == nil {
+		a.best = make(Datums, len(keys))
+	} else {
+		a.impl.Close(ctx)
+		a.impl = a.create(a.evalCtx)
+	}
+	copy(a.best, keys)
+	return a.impl.Add(ctx, datum, otherArgs...)
+}
+
+// Result returns the result of the wrapped function.
+func (a *orderedAggregate) Result() (Datum, error) {
+	return a.impl.Result()
+}
+
+// Close is part of the AggregateFunc interface.
+func (a *orderedAggregate) Close(ctx context.Context) {
+	a.impl.Close(ctx)
+	a.bestSize.close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *orderedAggregate) Size() int64 {
+	return sizeOfOrderedAggregate + a.impl.Size() + int64(len(a.directions))*sizeOfDatum
+}
+
+// Allocated is part of the AllocatingAggregateFunc interface.
+func (a *orderedAggregate) Allocated() int64 {
+	return a.bestSize.size + AggregateFuncAllocated(a.impl)
+}
+
 // MaxAggregate keeps track of the largest value passed to Add.
 type MaxAggregate struct {
 	max     Datum
 	evalCtx *EvalContext
+	// maxSize accounts for the size of max, which changes along with it.
+	maxSize resizableItem
 }
 
 func newMaxAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
-	return &MaxAggregate{evalCtx: evalCtx}
+	return &MaxAggregate{evalCtx: evalCtx, maxSize: makeResizableItem(evalCtx)}
 }
 
 // Add sets the max to the larger of the current max or the passed datum.
-func (a *MaxAggregate) Add(_ context.Context, datum Datum) error {
+func (a *MaxAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
-	if a.max == nil {
-		a.max = datum
+	if a.max != nil && a.max.Compare(a.evalCtx, datum) >= 0 {
 		return nil
 	}
-	c := a.max.Compare(a.evalCtx, datum)
-	if c < 0 {
-		a.max = datum
+	if err := a.maxSize.resize(ctx, int64(datum.Size())); err != nil {
+		return err
 	}
+	a.max = datum
 	return nil
 }
 
@@ -564,31 +1417,44 @@ func (a *MaxAggregate) Result() (Datum, error) {
 }
 
 // Close is part of the AggregateFunc interface.
-func (a *MaxAggregate) Close(context.Context) {}
+func (a *MaxAggregate) Close(ctx context.Context) {
+	a.maxSize.close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *MaxAggregate) Size() int64 {
+	return sizeOfMaxAggregate
+}
+
+// Allocated is part of the AllocatingAggregateFunc interface.
+func (a *MaxAggregate) Allocated() int64 {
+	return a.maxSize.size
+}
 
 // MinAggregate keeps track of the smallest value passed to Add.
 type MinAggregate struct {
 	min     Datum
 	evalCtx *EvalContext
+	// minSize accounts for the size of min, which changes along with it.
+	minSize resizableItem
 }
 
 func newMinAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
-	return &MinAggregate{evalCtx: evalCtx}
+	return &MinAggregate{evalCtx: evalCtx, minSize: makeResizableItem(evalCtx)}
 }
 
 // Add sets the min to the smaller of the current min or the passed datum.
-func (a *MinAggregate) Add(_ context.Context, datum Datum) error {
+func (a *MinAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
-	if a.min == nil {
-		a.min = datum
+	if a.min != nil && a.min.Compare(a.evalCtx, datum) <= 0 {
 		return nil
 	}
-	c := a.min.Compare(a.evalCtx, datum)
-	if c > 0 {
-		a.min = datum
+	if err := a.minSize.resize(ctx, int64(datum.Size())); err != nil {
+		return err
 	}
+	a.min = datum
 	return nil
 }
 
@@ -601,7 +1467,19 @@ func (a *MinAggregate) Result() (Datum, error) {
 }
 
 // Close is part of the AggregateFunc interface.
-func (a *MinAggregate) Close(context.Context) {}
+func (a *MinAggregate) Close(ctx context.Context) {
+	a.minSize.close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *MinAggregate) Size() int64 {
+	return sizeOfMinAggregate
+}
+
+// Allocated is part of the AllocatingAggregateFunc interface.
+func (a *MinAggregate) Allocated() int64 {
+	return a.minSize.size
+}
 
 type smallIntSumAggregate struct {
 	sum         int64
@@ -613,7 +1491,7 @@ func newSmallIntSumAggregate(_ []Type, _ *EvalContext) AggregateFunc {
 }
 
 // Add adds the value of the passed datum to the sum.
-func (a *smallIntSumAggregate) Add(_ context.Context, datum Datum) error {
+func (a *smallIntSumAggregate) Add(_ context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
@@ -634,6 +1512,11 @@ func (a *smallIntSumAggregate) Result() (Datum, error) {
 // Close is part of the AggregateFunc interface.
 func (a *smallIntSumAggregate) Close(context.Context) {}
 
+// Size is part of the AggregateFunc interface.
+func (a *smallIntSumAggregate) Size() int64 {
+	return sizeOfSmallIntSumAggregate
+}
+
 type intSumAggregate struct {
 	// Either the `intSum` and `decSum` fields contains the
 	// result. Which one is used is determined by the `large` field
@@ -643,14 +1526,32 @@ type intSumAggregate struct {
 	tmpDec      apd.Decimal
 	large       bool
 	seenNonNull bool
+	// decSumSize accounts for the coefficient of decSum, which grows with
+	// the number of its digits.
+	decSumSize resizableItem
+	// errorOnOverflow causes Result to return an error when the sum does not
+	// fit in an integer, instead of returning it as a larger decimal.
+	errorOnOverflow bool
 }
 
-func newIntSumAggregate(_ []Type, _ *EvalContext) AggregateFunc {
-	return &intSumAggregate{}
+func newIntSumAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return NewIntSumAggregate(evalCtx, false /* errorOnOverflow */)
+}
+
+// NewIntSumAggregate returns the SUM aggregate over integers. If
+// errorOnOverflow is set, the aggregate errors out when the sum does not fit in
+// an integer rather than promoting it to a decimal. Only the final sum is
+// checked, so the result does not depend on the order in which the values are
+// added.
+func NewIntSumAggregate(evalCtx *EvalContext, errorOnOverflow bool) AggregateFunc {
+	return &intSumAggregate{
+		decSumSize:      makeResizableItem(evalCtx),
+		errorOnOverflow: errorOnOverflow,
+	}
 }
 
 // Add adds the value of the passed datum to the sum.
-func (a *intSumAggregate) Add(_ context.Context, datum Datum) error {
+func (a *intSumAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
@@ -676,7 +1577,10 @@ func (a *intSumAggregate) Add(_ context.Context, datum Datum) error {
 			if err != nil {
 				return err
 			}
-		} else {
+			if err := a.decSumSize.resize(ctx, decimalCoeffSize(&a.decSum.Decimal)); err != nil {
+				return err
+			}
+		} else {
 			a.intSum += t
 		}
 	}
@@ -691,6 +1595,11 @@ func (a *intSumAggregate) Result() (Datum, error) {
 	}
 	dd := &DDecimal{}
 	if a.large {
+		if a.errorOnOverflow {
+			if _, err := a.decSum.Int64(); err != nil {
+				return nil, errIntOutOfRange
+			}
+		}
 		dd.Set(&a.decSum.Decimal)
 	} else {
 		dd.SetCoefficient(a.intSum)
@@ -699,19 +1608,48 @@ func (a *intSumAggregate) Result() (Datum, error) {
 }
 
 // Close is part of the AggregateFunc interface.
-func (a *intSumAggregate) Close(context.Context) {}
+func (a *intSumAggregate) Close(ctx context.Context) {
+	a.decSumSize.close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *intSumAggregate) Size() int64 {
+	return sizeOfIntSumAggregate
+}
+
+// Allocated is part of the AllocatingAggregateFunc interface.
+func (a *intSumAggregate) Allocated() int64 {
+	return a.decSumSize.size
+}
 
 type decimalSumAggregate struct {
 	sum        apd.Decimal
 	sawNonNull bool
+	// sumSize accounts for the coefficient of sum, which grows with the
+	// number of its digits.
+	sumSize resizableItem
+	// errorOnOverflow causes Result to return an error when the sum is not an
+	// integer that fits in an int64.
+	errorOnOverflow bool
 }
 
-func newDecimalSumAggregate(_ []Type, _ *EvalContext) AggregateFunc {
-	return &decimalSumAggregate{}
+func newDecimalSumAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return NewDecimalSumAggregate(evalCtx, false /* errorOnOverflow */)
+}
+
+// NewDecimalSumAggregate returns the SUM aggregate over decimals. If
+// errorOnOverflow is set, the aggregate errors out when the sum is not an
+// integer that fits in an int64; this is used to combine the partial sums of a
+// distributed integer SUM which must not overflow.
+func NewDecimalSumAggregate(evalCtx *EvalContext, errorOnOverflow bool) AggregateFunc {
+	return &decimalSumAggregate{
+		sumSize:         makeResizableItem(evalCtx),
+		errorOnOverflow: errorOnOverflow,
+	}
 }
 
 // Add adds the value of the passed datum to the sum.
-func (a *decimalSumAggregate) Add(_ context.Context, datum Datum) error {
+func (a *decimalSumAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
@@ -721,7 +1659,7 @@ func (a *decimalSumAggregate) Add(_ context.Context, datum Datum) error {
 		return err
 	}
 	a.sawNonNull = true
-	return nil
+	return a.sumSize.resize(ctx, decimalCoeffSize(&a.sum))
 }
 
 // Result returns the sum.
@@ -729,13 +1667,30 @@ func (a *decimalSumAggregate) Result() (Datum, error) {
 	if !a.sawNonNull {
 		return DNull, nil
 	}
+	if a.errorOnOverflow {
+		if _, err := a.sum.Int64(); err != nil {
+			return nil, errIntOutOfRange
+		}
+	}
 	dd := &DDecimal{}
 	dd.Set(&a.sum)
 	return dd, nil
 }
 
 // Close is part of the AggregateFunc interface.
-func (a *decimalSumAggregate) Close(context.Context) {}
+func (a *decimalSumAggregate) Close(ctx context.Context) {
+	a.sumSize.close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *decimalSumAggregate) Size() int64 {
+	return sizeOfDecimalSumAggregate
+}
+
+// Allocated is part of the AllocatingAggregateFunc interface.
+func (a *decimalSumAggregate) Allocated() int64 {
+	return a.sumSize.size
+}
 
 type floatSumAggregate struct {
 	sum        float64
@@ -747,7 +1702,7 @@ func newFloatSumAggregate(_ []Type, _ *EvalContext) AggregateFunc {
 }
 
 // Add adds the value of the passed datum to the sum.
-func (a *floatSumAggregate) Add(_ context.Context, datum Datum) error {
+func (a *floatSumAggregate) Add(_ context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
@@ -768,6 +1723,11 @@ func (a *floatSumAggregate) Result() (Datum, error) {
 // Close is part of the AggregateFunc interface.
 func (a *floatSumAggregate) Close(context.Context) {}
 
+// Size is part of the AggregateFunc interface.
+func (a *floatSumAggregate) Size() int64 {
+	return sizeOfFloatSumAggregate
+}
+
 type intervalSumAggregate struct {
 	sum        duration.Duration
 	sawNonNull bool
@@ -778,7 +1738,7 @@ func newIntervalSumAggregate(_ []Type, _ *EvalContext) AggregateFunc {
 }
 
 // Add adds the value of the passed datum to the sum.
-func (a *intervalSumAggregate) Add(_ context.Context, datum Datum) error {
+func (a *intervalSumAggregate) Add(_ context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
@@ -799,6 +1759,207 @@ func (a *intervalSumAggregate) Result() (Datum, error) {
 // Close is part of the AggregateFunc interface.
 func (a *intervalSumAggregate) Close(context.Context) {}
 
+// Size is part of the AggregateFunc interface.
+func (a *intervalSumAggregate) Size() int64 {
+	return sizeOfIntervalSumAggregate
+}
+
+func topKReturnType(args []TypedExpr) Type {
+	if len(args) == 0 {
+		return unknownReturnType
+	}
+	return TArray{args[0].ResolvedType()}
+}
+
+// topKHeap is a min-heap of the values kept by a topKAggregate: its root is
+// the smallest of them.
+type topKHeap struct {
+	values  []Datum
+	evalCtx *EvalContext
+}
+
+var _ heap.Interface = &topKHeap{}
+
+func (h *topKHeap) Len() int { return len(h.values) }
+
+func (h *topKHeap) Less(i, j int) bool {
+	return h.values[i].Compare(h.evalCtx, h.values[j]) < 0
+}
+
+func (h *topKHeap) Swap(i, j int) { h.values[i], h.values[j] = h.values[j], h.values[i] }
+
+func (h *topKHeap) Push(x interface{}) { h.values = append(h.values, x.(Datum)) }
+
+func (h *topKHeap) Pop() interface{} {
+	n := len(h.values)
+	x := h.values[n-1]
+	h.values = h.values[:n-1]
+	return x
+}
+
+// topKAggregate implements TOP_K, which aggregates the k greatest values into
+// an array in descending order. The values are kept in a heap bounded to k
+// elements, so that its memory use doesn't depend on the number of values.
+// k is the second argument of the first row; NULL values are ignored.
+//
+// It also implements TOP_K_STATE, the local stage of a distributed TOP_K,
+// whose result is padded with NULLs to k elements so that the final stage
+// knows k.
+type topKAggregate struct {
+	typ Type
+	// k is -1 until the first row is added.
+	k      int
+	heap   topKHeap
+	acc    mon.BoundAccount
+	padded bool
+}
+
+func newTopKAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	return &topKAggregate{
+		typ:  params[0],
+		k:    -1,
+		heap: topKHeap{evalCtx: evalCtx},
+		acc:  evalCtx.Mon.MakeBoundAccount(),
+	}
+}
+
+func newTopKStateAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	a := newTopKAggregate(params, evalCtx).(*topKAggregate)
+	a.padded = true
+	return a
+}
+
+// Add accumulates the passed datum into the heap.
+func (a *topKAggregate) Add(ctx context.Context, datum Datum, otherArgs ...Datum) error {
+	if a.k < 0 {
+		if otherArgs[0] == DNull {
+			return errors.New("top_k: k must not be NULL")
+		}
+		k := int(MustBeDInt(otherArgs[0]))
+		if k < 0 {
+			return errors.Errorf("top_k: k must not be negative: %d", k)
+		}
+		a.k = k
+	}
+	if datum == DNull {
+		return nil
+	}
+	return a.add(ctx, datum)
+}
+
+// add keeps the given non-NULL value if it is among the k greatest values
+// seen so far.
+func (a *topKAggregate) add(ctx context.Context, datum Datum) error {
+	if len(a.heap.values) < a.k {
+		if err := a.acc.Grow(ctx, int64(datum.Size())); err != nil {
+			return err
+		}
+		heap.Push(&a.heap, datum)
+		return nil
+	}
+	if a.k == 0 || datum.Compare(a.heap.evalCtx, a.heap.values[0]) <= 0 {
+		return nil
+	}
+	// Replace the smallest value.
+	if err := a.acc.Grow(ctx, int64(datum.Size())); err != nil {
+		return err
+	}
+	a.acc.Shrink(ctx, int64(a.heap.values[0].Size()))
+	a.heap.values[0] = datum
+	heap.Fix(&a.heap, 0)
+	return nil
+}
+
+// Result returns an array of the k greatest values in descending order.
+func (a *topKAggregate) Result() (Datum, error) {
+	if a.k < 0 || (len(a.heap.values) == 0 && !a.padded) {
+		return DNull, nil
+	}
+	values := append([]Datum(nil), a.heap.values...)
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Compare(a.heap.evalCtx, values[j]) > 0
+	})
+	arr := NewDArray(a.typ)
+	for _, v := range values {
+		if err := arr.Append(v); err != nil {
+			return nil, err
+		}
+	}
+	if a.padded {
+		for arr.Len() < a.k {
+			if err := arr.Append(DNull); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return arr, nil
+}
+
+// Close is part of the AggregateFunc interface.
+func (a *topKAggregate) Close(ctx context.Context) {
+	a.acc.Close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *topKAggregate) Size() int64 {
+	return sizeOfTopKAggregate
+}
+
+// Allocated is part of the AllocatingAggregateFunc interface.
+func (a *topKAggregate) Allocated() int64 {
+	return a.acc.CurrentlyAllocated()
+}
+
+// topKMergeAggregate implements TOP_K_MERGE, the final stage of a distributed
+// TOP_K, which combines the transition states produced by TOP_K_STATE.
+type topKMergeAggregate struct {
+	topK *topKAggregate
+}
+
+func newTopKMergeAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	typ := UnwrapType(params[0]).(TArray).Typ
+	return &topKMergeAggregate{
+		topK: newTopKAggregate([]Type{typ}, evalCtx).(*topKAggregate),
+	}
+}
+
+// Add combines the passed transition state into the heap.
+func (a *topKMergeAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
+	if datum == DNull {
+		return nil
+	}
+	arr, ok := AsDArray(datum)
+	if !ok || (a.topK.k >= 0 && arr.Len() != a.topK.k) {
+		return errors.Errorf("invalid aggregate transition state: %s", datum)
+	}
+	a.topK.k = arr.Len()
+	for _, v := range arr.Array {
+		if v == DNull {
+			// The rest of the state is padding.
+			break
+		}
+		if err := a.topK.add(ctx, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Result returns an array of the k greatest values in descending order.
+func (a *topKMergeAggregate) Result() (Datum, error) {
+	return a.topK.Result()
+}
+
+// Close is part of the AggregateFunc interface.
+func (a *topKMergeAggregate) Close(ctx context.Context) {
+	a.topK.Close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *topKMergeAggregate) Size() int64 {
+	return sizeOfTopKMergeAggregate + a.topK.Size()
+}
+
 type intVarianceAggregate struct {
 	agg *decimalVarianceAggregate
 	// Used for passing int64s as *apd.Decimal values.
@@ -811,7 +1972,7 @@ func newIntVarianceAggregate(_ []Type, _ *EvalContext) AggregateFunc {
 	}
 }
 
-func (a *intVarianceAggregate) Add(ctx context.Context, datum Datum) error {
+func (a *intVarianceAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
@@ -827,6 +1988,11 @@ func (a *intVarianceAggregate) Result() (Datum, error) {
 // Close is part of the AggregateFunc interface.
 func (a *intVarianceAggregate) Close(context.Context) {}
 
+// Size is part of the AggregateFunc interface.
+func (a *intVarianceAggregate) Size() int64 {
+	return sizeOfIntVarianceAggregate + a.agg.Size()
+}
+
 type floatVarianceAggregate struct {
 	count   int
 	mean    float64
@@ -837,7 +2003,7 @@ func newFloatVarianceAggregate(_ []Type, _ *EvalContext) AggregateFunc {
 	return &floatVarianceAggregate{}
 }
 
-func (a *floatVarianceAggregate) Add(_ context.Context, datum Datum) error {
+func (a *floatVarianceAggregate) Add(_ context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
@@ -860,9 +2026,43 @@ func (a *floatVarianceAggregate) Result() (Datum, error) {
 	return NewDFloat(DFloat(a.sqrDiff / (float64(a.count) - 1))), nil
 }
 
+// state returns the transition state of the aggregate, as encoded by
+// variance_state.
+func (a *floatVarianceAggregate) state() (Datum, error) {
+	if a.count == 0 {
+		return DNull, nil
+	}
+	arr := NewDArray(TypeFloat)
+	for _, f := range []float64{float64(a.count), a.mean, a.sqrDiff} {
+		if err := arr.Append(NewDFloat(DFloat(f))); err != nil {
+			return nil, err
+		}
+	}
+	return arr, nil
+}
+
+// merge combines the transition state of other values into the aggregate.
+func (a *floatVarianceAggregate) merge(count int, mean, sqrDiff float64) {
+	if count == 0 {
+		return
+	}
+	// Uses the parallel algorithm of Chan et al. See
+	// https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Parallel_algorithm.
+	total := a.count + count
+	delta := mean - a.mean
+	a.sqrDiff += sqrDiff + delta*delta*float64(a.count)*float64(count)/float64(total)
+	a.mean += delta * float64(count) / float64(total)
+	a.count = total
+}
+
 // Close is part of the AggregateFunc interface.
 func (a *floatVarianceAggregate) Close(context.Context) {}
 
+// Size is part of the AggregateFunc interface.
+func (a *floatVarianceAggregate) Size() int64 {
+	return sizeOfFloatVarianceAggregate
+}
+
 type decimalVarianceAggregate struct {
 	// Variables used across iterations.
 	ed      *apd.ErrDecimal
@@ -897,7 +2097,7 @@ var (
 	decimalTwo = apd.New(2, 0)
 )
 
-func (a *decimalVarianceAggregate) Add(_ context.Context, datum Datum) error {
+func (a *decimalVarianceAggregate) Add(_ context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
@@ -934,9 +2134,52 @@ func (a *decimalVarianceAggregate) Result() (Datum, error) {
 	return dd, nil
 }
 
+// state returns the transition state of the aggregate, as encoded by
+// variance_state.
+func (a *decimalVarianceAggregate) state() (Datum, error) {
+	if a.count.Sign() == 0 {
+		return DNull, nil
+	}
+	arr := NewDArray(TypeDecimal)
+	for _, d := range []*apd.Decimal{&a.count, &a.mean, &a.sqrDiff} {
+		dd := &DDecimal{}
+		dd.Set(d)
+		if err := arr.Append(dd); err != nil {
+			return nil, err
+		}
+	}
+	return arr, nil
+}
+
+// merge combines the transition state of other values into the aggregate.
+func (a *decimalVarianceAggregate) merge(count, mean, sqrDiff *apd.Decimal) error {
+	if count.Sign() == 0 {
+		return nil
+	}
+	// Uses the parallel algorithm of Chan et al. See
+	// https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Parallel_algorithm.
+	a.ed.Sub(&a.delta, mean, &a.mean)
+	a.ed.Mul(&a.tmp, &a.count, count)
+	a.ed.Add(&a.count, &a.count, count)
+	a.ed.Mul(&a.tmp, &a.tmp, &a.delta)
+	a.ed.Mul(&a.tmp, &a.tmp, &a.delta)
+	a.ed.Quo(&a.tmp, &a.tmp, &a.count)
+	a.ed.Add(&a.sqrDiff, &a.sqrDiff, sqrDiff)
+	a.ed.Add(&a.sqrDiff, &a.sqrDiff, &a.tmp)
+	a.ed.Mul(&a.tmp, &a.delta, count)
+	a.ed.Quo(&a.tmp, &a.tmp, &a.count)
+	a.ed.Add(&a.mean, &a.mean, &a.tmp)
+	return a.ed.Err()
+}
+
 // Close is part of the AggregateFunc interface.
 func (a *decimalVarianceAggregate) Close(context.Context) {}
 
+// Size is part of the AggregateFunc interface.
+func (a *decimalVarianceAggregate) Size() int64 {
+	return sizeOfDecimalVarianceAggregate
+}
+
 type stdDevAggregate struct {
 	agg AggregateFunc
 }
@@ -952,7 +2195,7 @@ func newDecimalStdDevAggregate(params []Type, evalCtx *EvalContext) AggregateFun
 }
 
 // Add implements the AggregateFunc interface.
-func (a *stdDevAggregate) Add(ctx context.Context, datum Datum) error {
+func (a *stdDevAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
 	return a.agg.Add(ctx, datum)
 }
 
@@ -976,10 +2219,759 @@ func (a *stdDevAggregate) Result() (Datum, error) {
 }
 
 // Close is part of the AggregateFunc interface.
-func (a *stdDevAggregate) Close(context.Context) {}
+func (a *stdDevAggregate) Close(ctx context.Context) {
+	a.agg.Close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *stdDevAggregate) Size() int64 {
+	return sizeOfStdDevAggregate + a.agg.Size()
+}
+
+// transitionState returns the elements of the given transition state of a
+// distributed aggregate, which must be an array of n non-NULL values.
+func transitionState(datum Datum, n int) (Datums, error) {
+	arr, ok := AsDArray(datum)
+	if !ok || arr.Len() != n || arr.HasNulls {
+		return nil, errors.Errorf("invalid aggregate transition state: %s", datum)
+	}
+	return arr.Array, nil
+}
+
+// avgStateAggregate implements avg_state, the local stage of a distributed
+// AVG. Its transition state is an array holding the count and the sum of the
+// values: FLOAT[] for FLOAT values, and DECIMAL[] otherwise.
+type avgStateAggregate struct {
+	sum   AggregateFunc
+	count int
+}
+
+func newIntAvgStateAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	return &avgStateAggregate{sum: newIntSumAggregate(params, evalCtx)}
+}
+func newFloatAvgStateAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	return &avgStateAggregate{sum: newFloatSumAggregate(params, evalCtx)}
+}
+func newDecimalAvgStateAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	return &avgStateAggregate{sum: newDecimalSumAggregate(params, evalCtx)}
+}
+
+// Add accumulates the passed datum into the count and the sum.
+func (a *avgStateAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
+	if datum == DNull {
+		return nil
+	}
+	if err := a.sum.Add(ctx, datum); err != nil {
+		return err
+	}
+	a.count++
+	return nil
+}
+
+// Result returns the transition state.
+func (a *avgStateAggregate) Result() (Datum, error) {
+	sum, err := a.sum.Result()
+	if err != nil || sum == DNull {
+		return sum, err
+	}
+	var arr *DArray
+	var count Datum
+	switch t := sum.(type) {
+	case *DFloat:
+		arr = NewDArray(TypeFloat)
+		count = NewDFloat(DFloat(a.count))
+	case *DDecimal:
+		arr = NewDArray(TypeDecimal)
+		dd := &DDecimal{}
+		dd.SetCoefficient(int64(a.count))
+		count = dd
+	default:
+		return nil, errors.Errorf("unexpected SUM result type: %s", t)
+	}
+	if err := arr.Append(count); err != nil {
+		return nil, err
+	}
+	if err := arr.Append(sum); err != nil {
+		return nil, err
+	}
+	return arr, nil
+}
+
+// Close is part of the AggregateFunc interface.
+func (a *avgStateAggregate) Close(ctx context.Context) {
+	a.sum.Close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *avgStateAggregate) Size() int64 {
+	return sizeOfAvgStateAggregate + a.sum.Size()
+}
+
+// avgMergeAggregate implements avg_merge, the final stage of a distributed
+// AVG, which combines the transition states produced by avg_state.
+type avgMergeAggregate struct {
+	count AggregateFunc
+	sum   AggregateFunc
+}
+
+func newFloatAvgMergeAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	return &avgMergeAggregate{
+		count: newFloatSumAggregate(params, evalCtx),
+		sum:   newFloatSumAggregate(params, evalCtx),
+	}
+}
+func newDecimalAvgMergeAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	return &avgMergeAggregate{
+		count: newDecimalSumAggregate(params, evalCtx),
+		sum:   newDecimalSumAggregate(params, evalCtx),
+	}
+}
+
+// Add combines the passed transition state into the count and the sum.
+func (a *avgMergeAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
+	if datum == DNull {
+		return nil
+	}
+	state, err := transitionState(datum, 2)
+	if err != nil {
+		return err
+	}
+	if err := a.count.Add(ctx, state[0]); err != nil {
+		return err
+	}
+	return a.sum.Add(ctx, state[1])
+}
+
+// Result returns the average of all the values whose states were passed to
+// Add.
+func (a *avgMergeAggregate) Result() (Datum, error) {
+	count, err := a.count.Result()
+	if err != nil || count == DNull {
+		return count, err
+	}
+	sum, err := a.sum.Result()
+	if err != nil {
+		return nil, err
+	}
+	switch t := sum.(type) {
+	case *DFloat:
+		return NewDFloat(*t / *count.(*DFloat)), nil
+	case *DDecimal:
+		_, err := DecimalCtx.Quo(&t.Decimal, &t.Decimal, &count.(*DDecimal).Decimal)
+		return t, err
+	default:
+		return nil, errors.Errorf("unexpected SUM result type: %s", t)
+	}
+}
+
+// Close is part of the AggregateFunc interface.
+func (a *avgMergeAggregate) Close(ctx context.Context) {
+	a.count.Close(ctx)
+	a.sum.Close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *avgMergeAggregate) Size() int64 {
+	return sizeOfAvgMergeAggregate + a.count.Size() + a.sum.Size()
+}
+
+// varianceStateAggregate implements variance_state, the local stage of a
+// distributed VARIANCE or STDDEV. Its transition state is an array holding the
+// count, the mean and the sum of squared differences from the mean of the
+// values: FLOAT[] for FLOAT values, and DECIMAL[] otherwise.
+type varianceStateAggregate struct {
+	// Exactly one of float and decimal is set.
+	float   *floatVarianceAggregate
+	decimal *decimalVarianceAggregate
+	// agg is the aggregate accumulating the values.
+	agg AggregateFunc
+}
+
+func newIntVarianceStateAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	agg := newIntVarianceAggregate(params, evalCtx).(*intVarianceAggregate)
+	return &varianceStateAggregate{decimal: agg.agg, agg: agg}
+}
+func newFloatVarianceStateAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	agg := newFloatVarianceAggregate(params, evalCtx).(*floatVarianceAggregate)
+	return &varianceStateAggregate{float: agg, agg: agg}
+}
+func newDecimalVarianceStateAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	agg := newDecimalVariance()
+	return &varianceStateAggregate{decimal: agg, agg: agg}
+}
+
+// Add accumulates the passed datum into the transition state.
+func (a *varianceStateAggregate) Add(ctx context.Context, datum Datum, _ ...Datum) error {
+	return a.agg.Add(ctx, datum)
+}
+
+// Result returns the transition state.
+func (a *varianceStateAggregate) Result() (Datum, error) {
+	if a.float != nil {
+		return a.float.state()
+	}
+	return a.decimal.state()
+}
+
+// Close is part of the AggregateFunc interface.
+func (a *varianceStateAggregate) Close(ctx context.Context) {
+	a.agg.Close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *varianceStateAggregate) Size() int64 {
+	return sizeOfVarianceStateAggregate + a.agg.Size()
+}
+
+// varianceMergeAggregate implements variance_merge, the final stage of a
+// distributed VARIANCE, which combines the transition states produced by
+// variance_state. The final stage of STDDEV wraps it in a stdDevAggregate.
+type varianceMergeAggregate struct {
+	// Exactly one of float and decimal is set.
+	float   *floatVarianceAggregate
+	decimal *decimalVarianceAggregate
+}
+
+func newFloatVarianceMergeAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	return &varianceMergeAggregate{float: &floatVarianceAggregate{}}
+}
+func newDecimalVarianceMergeAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	return &varianceMergeAggregate{decimal: newDecimalVariance()}
+}
+func newFloatStdDevMergeAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	return &stdDevAggregate{agg: newFloatVarianceMergeAggregate(params, evalCtx)}
+}
+func newDecimalStdDevMergeAggregate(params []Type, evalCtx *EvalContext) AggregateFunc {
+	return &stdDevAggregate{agg: newDecimalVarianceMergeAggregate(params, evalCtx)}
+}
+
+// Add combines the passed transition state into the aggregate.
+func (a *varianceMergeAggregate) Add(_ context.Context, datum Datum, _ ...Datum) error {
+	if datum == DNull {
+		return nil
+	}
+	state, err := transitionState(datum, 3)
+	if err != nil {
+		return err
+	}
+	if a.float != nil {
+		count, mean, sqrDiff := state[0].(*DFloat), state[1].(*DFloat), state[2].(*DFloat)
+		a.float.merge(int(*count), float64(*mean), float64(*sqrDiff))
+		return nil
+	}
+	count, mean, sqrDiff := state[0].(*DDecimal), state[1].(*DDecimal), state[2].(*DDecimal)
+	return a.decimal.merge(&count.Decimal, &mean.Decimal, &sqrDiff.Decimal)
+}
+
+// Result returns the variance of all the values whose states were passed to
+// Add.
+func (a *varianceMergeAggregate) Result() (Datum, error) {
+	if a.float != nil {
+		return a.float.Result()
+	}
+	return a.decimal.Result()
+}
+
+// Close is part of the AggregateFunc interface.
+func (a *varianceMergeAggregate) Close(context.Context) {}
+
+// Size is part of the AggregateFunc interface.
+func (a *varianceMergeAggregate) Size() int64 {
+	if a.float != nil {
+		return sizeOfVarianceMergeAggregate + a.float.Size()
+	}
+	return sizeOfVarianceMergeAggregate + a.decimal.Size()
+}
 
 var _ Visitor = &IsAggregateVisitor{}
 
+// percentileAggregate estimates percentiles using a t-digest. Depending on
+// the builtin, it either adds values or merges encoded digests, and either
+// returns the estimated percentile or the encoding of the digest.
+type percentileAggregate struct {
+	digest   tdigest.Digest
+	discrete bool
+	// fraction is the percentile to estimate. If fractionArg is set, it is
+	// passed as the second argument.
+	fraction     float64
+	fractionArg  bool
+	sawFraction  bool
+	mergeInput   bool
+	sketchResult bool
+	// numAccounted is the number of centroids accounted for in acc.
+	numAccounted int
+	acc          mon.BoundAccount
+}
+
+func newMedianAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &percentileAggregate{fraction: 0.5, acc: evalCtx.Mon.MakeBoundAccount()}
+}
+
+func newPercentileContAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &percentileAggregate{fractionArg: true, acc: evalCtx.Mon.MakeBoundAccount()}
+}
+
+func newPercentileDiscAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &percentileAggregate{
+		discrete:    true,
+		fractionArg: true,
+		acc:         evalCtx.Mon.MakeBoundAccount(),
+	}
+}
+
+func newPercentileSketchAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &percentileAggregate{sketchResult: true, acc: evalCtx.Mon.MakeBoundAccount()}
+}
+
+func newMedianMergeAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &percentileAggregate{
+		fraction:   0.5,
+		mergeInput: true,
+		acc:        evalCtx.Mon.MakeBoundAccount(),
+	}
+}
+
+// Add adds the passed datum to the digest, or merges the digest it encodes.
+func (a *percentileAggregate) Add(ctx context.Context, datum Datum, others ...Datum) error {
+	if a.fractionArg && !a.sawFraction && others[0] != DNull {
+		// Like the direct arguments of ordered-set aggregates in PostgreSQL, the
+		// fraction is expected to be the same for all rows.
+		a.fraction = float64(*others[0].(*DFloat))
+		if a.fraction < 0 || a.fraction > 1 || math.IsNaN(a.fraction) {
+			return pgerror.NewErrorf(pgerror.CodeNumericValueOutOfRangeError,
+				"percentile value %g is not between 0 and 1", a.fraction)
+		}
+		a.sawFraction = true
+	}
+	if datum == DNull {
+		return nil
+	}
+	if t, ok := datum.(*DBytes); ok {
+		if err := a.digest.Decode([]byte(*t)); err != nil {
+			return err
+		}
+	} else if err := addToDigest(&a.digest, datum); err != nil {
+		return err
+	}
+	if n := a.digest.NumCentroids(); n > a.numAccounted {
+		if err := a.acc.Grow(ctx, int64(n-a.numAccounted)*tdigest.CentroidSize); err != nil {
+			return err
+		}
+		a.numAccounted = n
+	}
+	return nil
+}
+
+// addToDigest adds the passed numeric datum to the digest.
+func addToDigest(d *tdigest.Digest, datum Datum) error {
+	switch t := datum.(type) {
+	case *DInt:
+		d.Add(float64(*t))
+	case *DFloat:
+		d.Add(float64(*t))
+	case *DDecimal:
+		f, err := t.Float64()
+		if err != nil {
+			return err
+		}
+		d.Add(f)
+	default:
+		return errors.Errorf("unexpected t-digest argument type: %s", datum.ResolvedType())
+	}
+	return nil
+}
+
+// Result returns the estimated percentile, or the encoded digest.
+func (a *percentileAggregate) Result() (Datum, error) {
+	if a.digest.Count() == 0 || (a.fractionArg && !a.sawFraction) {
+		return DNull, nil
+	}
+	if a.sketchResult {
+		return NewDBytes(DBytes(a.digest.Encode(nil))), nil
+	}
+	if a.discrete {
+		return NewDFloat(DFloat(a.digest.DiscreteQuantile(a.fraction))), nil
+	}
+	return NewDFloat(DFloat(a.digest.Quantile(a.fraction))), nil
+}
+
+// Close allows the aggregate to release the memory it requested during
+// operation.
+func (a *percentileAggregate) Close(ctx context.Context) {
+	a.acc.Close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *percentileAggregate) Size() int64 {
+	return sizeOfPercentileAggregate
+}
+
+// Allocated is part of the AllocatingAggregateFunc interface.
+func (a *percentileAggregate) Allocated() int64 {
+	return a.acc.CurrentlyAllocated()
+}
+
+// maxHistogramBuckets is the maximum number of buckets of the histograms built
+// by equidepth_histogram.
+const maxHistogramBuckets = 10000
+
+// equiDepthHistogramAggregate estimates the boundaries of an equi-depth
+// histogram using a t-digest. Depending on the builtin, it either adds values
+// or merges encoded sketches, and either returns the boundaries or the
+// encoding of the sketch. A sketch starts with the number of buckets, which
+// is only passed to the local stage of a distributed histogram.
+type equiDepthHistogramAggregate struct {
+	digest tdigest.Digest
+	// numBuckets is 0 until the number of buckets is known.
+	numBuckets   int
+	mergeInput   bool
+	sketchResult bool
+	// numAccounted is the number of centroids accounted for in acc.
+	numAccounted int
+	acc          mon.BoundAccount
+}
+
+func newEquiDepthHistogramAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &equiDepthHistogramAggregate{acc: evalCtx.Mon.MakeBoundAccount()}
+}
+
+func newEquiDepthHistogramSketchAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &equiDepthHistogramAggregate{
+		sketchResult: true,
+		acc:          evalCtx.Mon.MakeBoundAccount(),
+	}
+}
+
+func newEquiDepthHistogramMergeAggregate(_ []Type, evalCtx *EvalContext) AggregateFunc {
+	return &equiDepthHistogramAggregate{
+		mergeInput: true,
+		acc:        evalCtx.Mon.MakeBoundAccount(),
+	}
+}
+
+// Add adds the passed datum to the digest, or merges the sketch it encodes.
+func (a *equiDepthHistogramAggregate) Add(ctx context.Context, datum Datum, others ...Datum) error {
+	if !a.mergeInput && a.numBuckets == 0 {
+		// Like the fraction of percentile_cont, the number of buckets is
+		// expected to be the same for all rows.
+		if others[0] == DNull {
+			return errors.New("the number of histogram buckets must not be NULL")
+		}
+		if err := a.setNumBuckets(int64(MustBeDInt(others[0]))); err != nil {
+			return err
+		}
+	}
+	if datum == DNull {
+		return nil
+	}
+	if a.mergeInput {
+		data := []byte(*datum.(*DBytes))
+		numBuckets, n := binary.Uvarint(data)
+		if n <= 0 || (a.numBuckets != 0 && numBuckets != uint64(a.numBuckets)) {
+			return errors.New("invalid histogram sketch")
+		}
+		if a.numBuckets == 0 {
+			if err := a.setNumBuckets(int64(numBuckets)); err != nil {
+				return err
+			}
+		}
+		if err := a.digest.Decode(data[n:]); err != nil {
+			return err
+		}
+	} else if err := addToDigest(&a.digest, datum); err != nil {
+		return err
+	}
+	if n := a.digest.NumCentroids(); n > a.numAccounted {
+		if err := a.acc.Grow(ctx, int64(n-a.numAccounted)*tdigest.CentroidSize); err != nil {
+			return err
+		}
+		a.numAccounted = n
+	}
+	return nil
+}
+
+func (a *equiDepthHistogramAggregate) setNumBuckets(n int64) error {
+	if n < 1 || n > maxHistogramBuckets {
+		return pgerror.NewErrorf(pgerror.CodeNumericValueOutOfRangeError,
+			"number of histogram buckets %d is not between 1 and %d", n, maxHistogramBuckets)
+	}
+	a.numBuckets = int(n)
+	return nil
+}
+
+// Result returns the estimated boundaries of the buckets, or the encoded
+// sketch.
+func (a *equiDepthHistogramAggregate) Result() (Datum, error) {
+	if a.digest.Count() == 0 {
+		return DNull, nil
+	}
+	if a.sketchResult {
+		var buf [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(buf[:], uint64(a.numBuckets))
+		return NewDBytes(DBytes(a.digest.Encode(append([]byte(nil), buf[:n]...)))), nil
+	}
+	arr := NewDArray(TypeFloat)
+	for i := 0; i <= a.numBuckets; i++ {
+		q := float64(i) / float64(a.numBuckets)
+		if err := arr.Append(NewDFloat(DFloat(a.digest.Quantile(q)))); err != nil {
+			return nil, err
+		}
+	}
+	return arr, nil
+}
+
+// Close allows the aggregate to release the memory it requested during
+// operation.
+func (a *equiDepthHistogramAggregate) Close(ctx context.Context) {
+	a.acc.Close(ctx)
+}
+
+// Size is part of the AggregateFunc interface.
+func (a *equiDepthHistogramAggregate) Size() int64 {
+	return sizeOfEquiDepthHistogramAggregate
+}
+
+// Allocated is part of the AllocatingAggregateFunc interface.
+func (a *equiDepthHistogramAggregate) Allocated() int64 {
+	return a.acc.CurrentlyAllocated()
+}
+
+// regressionState is the transition state of the two-argument statistical
+// aggregates. Like PostgreSQL, it accumulates the sums of squares and
+// products of the deviations from the mean using the Youngs-Cramer
+// algorithm, which is more accurate than accumulating the sums of squares
+// and products of the values.
+type regressionState struct {
+	n   float64
+	sx  float64
+	sy  float64
+	sxx float64
+	syy float64
+	sxy float64
+}
+
+// regressionStateEncodedSize is the size of an encoded regressionState.
+const regressionStateEncodedSize = 6 * 8
+
+func (s *regressionState) add(y, x float64) {
+	s.n++
+	s.sx += x
+	s.sy += y
+	if s.n > 1 {
+		dx := x*s.n - s.sx
+		dy := y*s.n - s.sy
+		scale := 1 / (s.n * (s.n - 1))
+		s.sxx += dx * dx * scale
+		s.syy += dy * dy * scale
+		s.sxy += dx * dy * scale
+	}
+}
+
+// merge folds the state of a disjoint set of values into s.
+func (s *regressionState) merge(o regressionState) {
+	if o.n == 0 {
+		return
+	}
+	if s.n == 0 {
+		*s = o
+		return
+	}
+	n := s.n + o.n
+	dx := s.sx/s.n - o.sx/o.n
+	dy := s.sy/s.n - o.sy/o.n
+	scale := s.n * o.n / n
+	s.sxx += o.sxx + dx*dx*scale
+	s.syy += o.syy + dy*dy*scale
+	s.sxy += o.sxy + dx*dy*scale
+	s.n = n
+	s.sx += o.sx
+	s.sy += o.sy
+}
+
+func (s *regressionState) encode() []byte {
+	b := make([]byte, regressionStateEncodedSize)
+	for i, f := range [...]float64{s.n, s.sx, s.sy, s.sxx, s.syy, s.sxy} {
+		binary.LittleEndian.PutUint64(b[i*8:], math.Float64bits(f))
+	}
+	return b
+}
+
+func decodeRegressionState(b []byte) (regressionState, error) {
+	if len(b) != regressionStateEncodedSize {
+		return regressionState{}, errors.Errorf("invalid regression state length %d", len(b))
+	}
+	var f [6]float64
+	for i := range f {
+		f[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[i*8:]))
+	}
+	return regressionState{n: f[0], sx: f[1], sy: f[2], sxx: f[3], syy: f[4], sxy: f[5]}, nil
+}
+
+// regressionFinal computes the result of a two-argument statistical
+// aggregate from its transition state.
+type regressionFinal func(s *regressionState) Datum
+
+func regrCount(s *regressionState) Datum {
+	return NewDInt(DInt(s.n))
+}
+
+func regrAvgX(s *regressionState) Datum {
+	if s.n < 1 {
+		return DNull
+	}
+	return NewDFloat(DFloat(s.sx / s.n))
+}
+
+func regrAvgY(s *regressionState) Datum {
+	if s.n < 1 {
+		return DNull
+	}
+	return NewDFloat(DFloat(s.sy / s.n))
+}
+
+func regrSXX(s *regressionState) Datum {
+	if s.n < 1 {
+		return DNull
+	}
+	return NewDFloat(DFloat(s.sxx))
+}
+
+func regrSYY(s *regressionState) Datum {
+	if s.n < 1 {
+		return DNull
+	}
+	return NewDFloat(DFloat(s.syy))
+}
+
+func regrSXY(s *regressionState) Datum {
+	if s.n < 1 {
+		return DNull
+	}
+	return NewDFloat(DFloat(s.sxy))
+}
+
+func regrCovarPop(s *regressionState) Datum {
+	if s.n < 1 {
+		return DNull
+	}
+	return NewDFloat(DFloat(s.sxy / s.n))
+}
+
+func regrCovarSamp(s *regressionState) Datum {
+	if s.n < 2 {
+		return DNull
+	}
+	return NewDFloat(DFloat(s.sxy / (s.n - 1)))
+}
+
+func regrCorr(s *regressionState) Datum {
+	if s.n < 1 || s.sxx == 0 || s.syy == 0 {
+		return DNull
+	}
+	return NewDFloat(DFloat(s.sxy / math.Sqrt(s.sxx*s.syy)))
+}
+
+func regrR2(s *regressionState) Datum {
+	if s.n < 1 || s.sxx == 0 {
+		return DNull
+	}
+	if s.syy == 0 {
+		// All the Y values are equal, which the horizontal fit line matches
+		// perfectly.
+		return NewDFloat(1)
+	}
+	return NewDFloat(DFloat(s.sxy * s.sxy / (s.sxx * s.syy)))
+}
+
+func regrSlope(s *regressionState) Datum {
+	if s.n < 1 || s.sxx == 0 {
+		return DNull
+	}
+	return NewDFloat(DFloat(s.sxy / s.sxx))
+}
+
+func regrIntercept(s *regressionState) Datum {
+	if s.n < 1 || s.sxx == 0 {
+		return DNull
+	}
+	return NewDFloat(DFloat((s.sy - s.sx*s.sxy/s.sxx) / s.n))
+}
+
+// regressionAggregate implements the two-argument statistical aggregates.
+// Depending on the builtin, it either accumulates (Y, X) pairs or merges
+// encoded states, and either returns the encoded state or computes its result
+// with final.
+type regressionAggregate struct {
+	state      regressionState
+	mergeInput bool
+	final      regressionFinal
+}
+
+func newRegressionStateAggregate(_ []Type, _ *EvalContext) AggregateFunc {
+	return &regressionAggregate{}
+}
+
+// Add accumulates the passed (Y, X) pair, or merges the passed encoded state.
+// Pairs in which either value is NULL are ignored.
+func (a *regressionAggregate) Add(_ context.Context, datum Datum, others ...Datum) error {
+	if datum == DNull {
+		return nil
+	}
+	if a.mergeInput {
+		s, err := decodeRegressionState([]byte(*datum.(*DBytes)))
+		if err != nil {
+			return err
+		}
+		a.state.merge(s)
+		return nil
+	}
+	if others[0] == DNull {
+		return nil
+	}
+	y, err := regressionArg(datum)
+	if err != nil {
+		return err
+	}
+	x, err := regressionArg(others[0])
+	if err != nil {
+		return err
+	}
+	a.state.add(y, x)
+	return nil
+}
+
+func regressionArg(d Datum) (float64, error) {
+	switch t := d.(type) {
+	case *DInt:
+		return float64(*t), nil
+	case *DFloat:
+		return float64(*t), nil
+	case *DDecimal:
+		return t.Float64()
+	default:
+		return 0, errors.Errorf("unexpected regression argument type: %s", d.ResolvedType())
+	}
+}
+
+// Result returns the result of the aggregate, or the encoded state.
+func (a *regressionAggregate) Result() (Datum, error) {
+	if a.final == nil {
+		if a.state.n == 0 {
+			return DNull, nil
+		}
+		return NewDBytes(DBytes(a.state.encode())), nil
+	}
+	return a.final(&a.state), nil
+}
+
+// Close is no-op in aggregates using constant space.
+func (a *regressionAggregate) Close(context.Context) {}
+
+// Size is part of the AggregateFunc interface.
+func (a *regressionAggregate) Size() int64 {
+	return sizeOfRegressionAggregate
+}
+
 type bytesXorAggregate struct {
 	sum        []byte
 	sawNonNull bool
@@ -990,7 +2982,7 @@ func newBytesXorAggregate(_ []Type, _ *EvalContext) AggregateFunc {
 }
 
 // Add inserts one value into the running xor.
-func (a *bytesXorAggregate) Add(_ context.Context, datum Datum) error {
+func (a *bytesXorAggregate) Add(_ context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
@@ -1019,6 +3011,11 @@ func (a *bytesXorAggregate) Result() (Datum, error) {
 // Close is part of the AggregateFunc interface.
 func (a *bytesXorAggregate) Close(context.Context) {}
 
+// Size is part of the AggregateFunc interface.
+func (a *bytesXorAggregate) Size() int64 {
+	return sizeOfBytesXorAggregate
+}
+
 type intXorAggregate struct {
 	sum        int64
 	sawNonNull bool
@@ -1029,7 +3026,7 @@ func newIntXorAggregate(_ []Type, _ *EvalContext) AggregateFunc {
 }
 
 // Add inserts one value into the running xor.
-func (a *intXorAggregate) Add(_ context.Context, datum Datum) error {
+func (a *intXorAggregate) Add(_ context.Context, datum Datum, _ ...Datum) error {
 	if datum == DNull {
 		return nil
 	}
@@ -1050,6 +3047,11 @@ func (a *intXorAggregate) Result() (Datum, error) {
 // Close is part of the AggregateFunc interface.
 func (a *intXorAggregate) Close(context.Context) {}
 
+// Size is part of the AggregateFunc interface.
+func (a *intXorAggregate) Size() int64 {
+	return sizeOfIntXorAggregate
+}
+
 // IsAggregateVisitor checks if walked expressions contain aggregate functions.
 type IsAggregateVisitor struct {
 	Aggregated bool
@@ -16,11 +16,16 @@ package parser
 
 import (
 	"fmt"
+	"math"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 
 	"golang.org/x/net/context"
 
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util/duration"
 	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 )
@@ -37,6 +42,7 @@ func testAggregateResultDeepCopy(
 	evalCtx := NewTestingEvalContext()
 	defer evalCtx.Stop(context.Background())
 	aggImpl := aggFunc([]Type{vals[0].ResolvedType()}, evalCtx)
+	defer aggImpl.Close(context.Background())
 	runningDatums := make([]Datum, len(vals))
 	runningStrings := make([]string, len(vals))
 	for i := range vals {
@@ -60,6 +66,130 @@ func testAggregateResultDeepCopy(
 	}
 }
 
+// TestAggregateMemoryAccounting verifies that aggregates account for the
+// memory their state grows to, and release it when closed.
+func TestAggregateMemoryAccounting(t *testing.T) {
+	one, err := ParseDDecimal("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := ParseDDecimal("1e-1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name     string
+		aggFunc  func([]Type, *EvalContext) AggregateFunc
+		vals     []Datum
+		minUsage int64
+	}{
+		{
+			name:     "sum",
+			aggFunc:  newDecimalSumAggregate,
+			vals:     []Datum{one, small},
+			minUsage: 400,
+		},
+		{
+			name:     "max",
+			aggFunc:  newMaxAggregate,
+			vals:     []Datum{NewDString("a"), NewDString(strings.Repeat("b", 1000))},
+			minUsage: 1000,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			evalCtx := NewTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			aggImpl := tc.aggFunc([]Type{tc.vals[0].ResolvedType()}, evalCtx)
+			for _, v := range tc.vals {
+				if err := aggImpl.Add(ctx, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if usage := evalCtx.Mon.GetCurrentAllocationForTesting(); usage < tc.minUsage {
+				t.Errorf("expected at least %d bytes to be accounted for, got %d", tc.minUsage, usage)
+			}
+			aggImpl.Close(ctx)
+			if usage := evalCtx.Mon.GetCurrentAllocationForTesting(); usage != 0 {
+				t.Errorf("expected no bytes to be accounted for after closing, got %d", usage)
+			}
+		})
+	}
+}
+
+// TestSumErrorOnOverflow verifies that integer sums which are set to error out
+// on overflow only do so when the final sum doesn't fit in an integer.
+func TestSumErrorOnOverflow(t *testing.T) {
+	ctx := context.Background()
+	evalCtx := NewTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+
+	decimal := func(s string) Datum {
+		d, err := ParseDDecimal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	testCases := []struct {
+		name     string
+		agg      AggregateFunc
+		vals     []Datum
+		expected string
+	}{
+		{
+			name:     "int",
+			agg:      NewIntSumAggregate(evalCtx, true /* errorOnOverflow */),
+			vals:     []Datum{NewDInt(math.MaxInt64), NewDInt(1), NewDInt(-2)},
+			expected: "9223372036854775806",
+		},
+		{
+			name:     "int-overflow",
+			agg:      NewIntSumAggregate(evalCtx, true /* errorOnOverflow */),
+			vals:     []Datum{NewDInt(math.MinInt64), NewDInt(-1)},
+			expected: errIntOutOfRange.Error(),
+		},
+		{
+			name:     "int-promote",
+			agg:      NewIntSumAggregate(evalCtx, false /* errorOnOverflow */),
+			vals:     []Datum{NewDInt(math.MaxInt64), NewDInt(1)},
+			expected: "9223372036854775808",
+		},
+		{
+			name:     "decimal",
+			agg:      NewDecimalSumAggregate(evalCtx, true /* errorOnOverflow */),
+			vals:     []Datum{decimal("9223372036854775808"), decimal("-1")},
+			expected: "9223372036854775807",
+		},
+		{
+			name:     "decimal-overflow",
+			agg:      NewDecimalSumAggregate(evalCtx, true /* errorOnOverflow */),
+			vals:     []Datum{decimal("9223372036854775807"), decimal("1")},
+			expected: errIntOutOfRange.Error(),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer tc.agg.Close(ctx)
+			for _, v := range tc.vals {
+				if err := tc.agg.Add(ctx, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var res string
+			if d, err := tc.agg.Result(); err != nil {
+				res = err.Error()
+			} else {
+				res = d.String()
+			}
+			if res != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, res)
+			}
+		})
+	}
+}
+
 func TestAvgIntResultDeepCopy(t *testing.T) {
 	testAggregateResultDeepCopy(t, newIntAvgAggregate, makeIntTestDatum(10))
 }
@@ -160,6 +290,328 @@ func TestStdDevDecimalResultDeepCopy(t *testing.T) {
 	testAggregateResultDeepCopy(t, newDecimalStdDevAggregate, makeDecimalTestDatum(10))
 }
 
+func TestMedianIntResultDeepCopy(t *testing.T) {
+	testAggregateResultDeepCopy(t, newMedianAggregate, makeIntTestDatum(10))
+}
+
+func TestMedianFloatResultDeepCopy(t *testing.T) {
+	testAggregateResultDeepCopy(t, newMedianAggregate, makeFloatTestDatum(10))
+}
+
+func TestMedianDecimalResultDeepCopy(t *testing.T) {
+	testAggregateResultDeepCopy(t, newMedianAggregate, makeDecimalTestDatum(10))
+}
+
+func TestPercentileSketchResultDeepCopy(t *testing.T) {
+	testAggregateResultDeepCopy(t, newPercentileSketchAggregate, makeIntTestDatum(10))
+}
+
+func TestStringAggDelimiter(t *testing.T) {
+	evalCtx := NewTestingEvalContext()
+	defer evalCtx.Stop(context.Background())
+	testCases := []struct {
+		vals       []Datum
+		delimiters []Datum
+		expected   string
+	}{
+		{
+			vals:       []Datum{NewDString("a"), NewDString("b")},
+			delimiters: []Datum{NewDString(","), NewDString(",")},
+			expected:   "'a,b'",
+		},
+		{
+			// NULL values are skipped, along with their delimiter.
+			vals:       []Datum{NewDString("a"), DNull, NewDString("b")},
+			delimiters: []Datum{NewDString("x"), NewDString("y"), NewDString("z")},
+			expected:   "'azb'",
+		},
+		{
+			vals:       []Datum{NewDString("a"), NewDString("b")},
+			delimiters: []Datum{NewDString(","), DNull},
+			expected:   "'ab'",
+		},
+		{
+			vals:       []Datum{DNull},
+			delimiters: []Datum{NewDString(",")},
+			expected:   "NULL",
+		},
+	}
+	for _, tc := range testCases {
+		aggImpl := newStringConcatAggregate([]Type{TypeString, TypeString}, evalCtx)
+		for i := range tc.vals {
+			if err := aggImpl.Add(context.Background(), tc.vals[i], tc.delimiters[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		res, err := aggImpl.Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.String() != tc.expected {
+			t.Errorf("expected %s, got %s", tc.expected, res)
+		}
+		aggImpl.Close(context.Background())
+	}
+}
+
+// TestRegressionStateMerge verifies that merging the regression states of
+// disjoint sets of values is equivalent to accumulating all the values in a
+// single state.
+func TestRegressionStateMerge(t *testing.T) {
+	rng, _ := randutil.NewPseudoRand()
+	var all regressionState
+	parts := make([]regressionState, 5)
+	for i := 0; i < 1000; i++ {
+		y, x := rng.NormFloat64()*10+3, rng.Float64()*100
+		all.add(y, x)
+		parts[rng.Intn(len(parts))].add(y, x)
+	}
+	var merged regressionState
+	for _, p := range parts {
+		decoded, err := decodeRegressionState(p.encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		merged.merge(decoded)
+	}
+	expected := []float64{all.n, all.sx, all.sy, all.sxx, all.syy, all.sxy}
+	actual := []float64{merged.n, merged.sx, merged.sy, merged.sxx, merged.syy, merged.sxy}
+	for i := range expected {
+		if math.Abs(expected[i]-actual[i]) > 1e-9*math.Abs(expected[i]) {
+			t.Errorf("%d: expected %f, got %f", i, expected[i], actual[i])
+		}
+	}
+}
+
+// TestTransitionStateMerge verifies that merging the transition states of
+// disjoint sets of values yields the same result as aggregating all the values
+// in a single stage.
+func TestTransitionStateMerge(t *testing.T) {
+	testCases := []struct {
+		name         string
+		aggFunc      func([]Type, *EvalContext) AggregateFunc
+		stateAggFunc func([]Type, *EvalContext) AggregateFunc
+		mergeAggFunc func([]Type, *EvalContext) AggregateFunc
+		vals         []Datum
+	}{
+		{"avg/int", newIntAvgAggregate, newIntAvgStateAggregate,
+			newDecimalAvgMergeAggregate, makeIntTestDatum(100)},
+		{"avg/float", newFloatAvgAggregate, newFloatAvgStateAggregate,
+			newFloatAvgMergeAggregate, makeFloatTestDatum(100)},
+		{"avg/decimal", newDecimalAvgAggregate, newDecimalAvgStateAggregate,
+			newDecimalAvgMergeAggregate, makeDecimalTestDatum(100)},
+		{"variance/int", newIntVarianceAggregate, newIntVarianceStateAggregate,
+			newDecimalVarianceMergeAggregate, makeSmallIntTestDatum(100)},
+		{"variance/float", newFloatVarianceAggregate, newFloatVarianceStateAggregate,
+			newFloatVarianceMergeAggregate, makeFloatTestDatum(100)},
+		{"variance/decimal", newDecimalVarianceAggregate, newDecimalVarianceStateAggregate,
+			newDecimalVarianceMergeAggregate, makeDecimalTestDatum(100)},
+		{"stddev/float", newFloatStdDevAggregate, newFloatVarianceStateAggregate,
+			newFloatStdDevMergeAggregate, makeFloatTestDatum(100)},
+		{"stddev/decimal", newDecimalStdDevAggregate, newDecimalVarianceStateAggregate,
+			newDecimalStdDevMergeAggregate, makeDecimalTestDatum(100)},
+	}
+	rng, _ := randutil.NewPseudoRand()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			evalCtx := NewTestingEvalContext()
+			defer evalCtx.Stop(ctx)
+			params := []Type{tc.vals[0].ResolvedType()}
+
+			all := tc.aggFunc(params, evalCtx)
+			defer all.Close(ctx)
+			parts := make([]AggregateFunc, 5)
+			for i := range parts {
+				parts[i] = tc.stateAggFunc(params, evalCtx)
+				defer parts[i].Close(ctx)
+			}
+			for _, v := range tc.vals {
+				if err := all.Add(ctx, v); err != nil {
+					t.Fatal(err)
+				}
+				if err := parts[rng.Intn(len(parts))].Add(ctx, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var merge AggregateFunc
+			for _, p := range parts {
+				state, err := p.Result()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if merge == nil {
+					merge = tc.mergeAggFunc([]Type{state.ResolvedType()}, evalCtx)
+					defer merge.Close(ctx)
+				}
+				if err := merge.Add(ctx, state); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := all.Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := merge.Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected.ResolvedType() != actual.ResolvedType() {
+				t.Fatalf("expected %s, got %s", expected.ResolvedType(), actual.ResolvedType())
+			}
+			e, err := strconv.ParseFloat(expected.String(), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, err := strconv.ParseFloat(actual.String(), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(e-a) > 1e-9*math.Abs(e) {
+				t.Errorf("expected %s, got %s", expected, actual)
+			}
+		})
+	}
+}
+
+func TestTopKAggregate(t *testing.T) {
+	ctx := context.Background()
+	evalCtx := NewTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	rng, _ := randutil.NewPseudoRand()
+
+	vals := makeIntTestDatum(100)
+	for i := 0; i < 10; i++ {
+		vals = append(vals, DNull)
+	}
+	sorted := make([]Datum, 0, len(vals))
+	for _, v := range vals {
+		if v != DNull {
+			sorted = append(sorted, v)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Compare(evalCtx, sorted[j]) > 0
+	})
+	params := []Type{TypeInt}
+
+	for _, k := range []int{0, 1, 5, 100, 200} {
+		t.Run(fmt.Sprintf("k=%d", k), func(t *testing.T) {
+			expected := DNull
+			if k > 0 {
+				n := k
+				if n > len(sorted) {
+					n = len(sorted)
+				}
+				arr := NewDArray(TypeInt)
+				for _, v := range sorted[:n] {
+					if err := arr.Append(v); err != nil {
+						t.Fatal(err)
+					}
+				}
+				expected = arr
+			}
+
+			all := newTopKAggregate(params, evalCtx)
+			defer all.Close(ctx)
+			parts := make([]AggregateFunc, 5)
+			for i := range parts {
+				parts[i] = newTopKStateAggregate(params, evalCtx)
+				defer parts[i].Close(ctx)
+			}
+			dk := NewDInt(DInt(k))
+			for _, v := range vals {
+				if err := all.Add(ctx, v, dk); err != nil {
+					t.Fatal(err)
+				}
+				if err := parts[rng.Intn(len(parts))].Add(ctx, v, dk); err != nil {
+					t.Fatal(err)
+				}
+			}
+			merge := newTopKMergeAggregate([]Type{TArray{TypeInt}}, evalCtx)
+			defer merge.Close(ctx)
+			for _, p := range parts {
+				state, err := p.Result()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := merge.Add(ctx, state); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, agg := range []AggregateFunc{all, merge} {
+				actual, err := agg.Result()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if actual.Compare(evalCtx, expected) != 0 {
+					t.Errorf("expected %s, got %s", expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestEquiDepthHistogramAggregate(t *testing.T) {
+	ctx := context.Background()
+	evalCtx := NewTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+	rng, _ := randutil.NewPseudoRand()
+
+	// The digests of few values are exact, so the boundaries of the buckets of
+	// 1..201 are exact as well.
+	const numVals = 201
+	numBuckets := NewDInt(4)
+	expected := "ARRAY[1.0,51.0,101.0,151.0,201.0]"
+	params := []Type{TypeInt}
+
+	all := newEquiDepthHistogramAggregate(params, evalCtx)
+	defer all.Close(ctx)
+	parts := make([]AggregateFunc, 3)
+	for i := range parts {
+		parts[i] = newEquiDepthHistogramSketchAggregate(params, evalCtx)
+		defer parts[i].Close(ctx)
+	}
+	for _, i := range rng.Perm(numVals) {
+		v := NewDInt(DInt(i + 1))
+		if err := all.Add(ctx, v, numBuckets); err != nil {
+			t.Fatal(err)
+		}
+		if err := parts[rng.Intn(len(parts))].Add(ctx, v, numBuckets); err != nil {
+			t.Fatal(err)
+		}
+	}
+	merge := newEquiDepthHistogramMergeAggregate([]Type{TypeBytes}, evalCtx)
+	defer merge.Close(ctx)
+	for _, p := range parts {
+		sketch, err := p.Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := merge.Add(ctx, sketch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, agg := range []AggregateFunc{all, merge} {
+		actual, err := agg.Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual.String() != expected {
+			t.Errorf("expected %s, got %s", expected, actual)
+		}
+	}
+
+	invalid := newEquiDepthHistogramAggregate(params, evalCtx)
+	defer invalid.Close(ctx)
+	if err := invalid.Add(ctx, NewDInt(1), NewDInt(0)); !testutils.IsError(err, "not between") {
+		t.Errorf("expected error for 0 buckets, got %v", err)
+	}
+}
+
 func makeIntTestDatum(count int) []Datum {
 	rng, _ := randutil.NewPseudoRand()
 
@@ -254,6 +706,7 @@ func runBenchmarkAggregate(
 		if err != nil || res == nil {
 			b.Errorf("taking result of aggregate implementation %T failed", aggImpl)
 		}
+		aggImpl.Close(context.Background())
 	}
 }
 
@@ -432,3 +885,57 @@ func BenchmarkStdDevAggregateDecimal(b *testing.B) {
 		})
 	}
 }
+
+func TestOrderedAggregate(t *testing.T) {
+	ctx := context.Background()
+	evalCtx := NewTestingEvalContext()
+	defer evalCtx.Stop(ctx)
+
+	// Rows of (value, ordering key 1, ordering key 2).
+	rows := []Datums{
+		{NewDString("a"), NewDInt(2), NewDInt(1)},
+		{NewDString("b"), NewDInt(1), NewDInt(1)},
+		{DNull, NewDInt(1), NewDInt(2)},
+		{NewDString("c"), NewDInt(3), NewDInt(0)},
+		{NewDString("d"), NewDInt(1), NewDInt(1)},
+		{NewDString("e"), NewDInt(1), DNull},
+	}
+
+	// Ties are broken in favor of the first row for first_value, and of the
+	// last row for last_value. NULLs sort first.
+	testCases := []struct {
+		create     func([]Type, *EvalContext) AggregateFunc
+		directions []Direction
+		last       bool
+		expected   Datum
+	}{
+		{newFirstValueAggregate, []Direction{Ascending}, false, NewDString("b")},
+		{newFirstValueAggregate, []Direction{Descending}, false, NewDString("c")},
+		{newFirstValueAggregate, []Direction{DefaultDirection, Descending}, false, DNull},
+		{newFirstValueAggregate, []Direction{Ascending, Ascending}, false, NewDString("e")},
+		{newLastValueAggregate, []Direction{Ascending}, true, NewDString("c")},
+		{newLastValueAggregate, []Direction{Descending}, true, NewDString("e")},
+		{newLastValueAggregate, []Direction{Descending, Ascending}, true, DNull},
+	}
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			create := func(evalCtx *EvalContext) AggregateFunc {
+				return tc.create([]Type{TypeString}, evalCtx)
+			}
+			agg := NewOrderedAggregate(create, evalCtx, tc.directions, tc.last)
+			defer agg.Close(ctx)
+			for _, row := range rows {
+				if err := agg.Add(ctx, row[0], row[1:1+len(tc.directions)]...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			res, err := agg.Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Compare(evalCtx, tc.expected) != 0 {
+				t.Errorf("expected %s, got %s", tc.expected, res)
+			}
+		})
+	}
+}
@@ -224,6 +224,52 @@ func (b Builtin) FixedReturnType() Type {
 	return returnTypeToFixedType(b.ReturnType)
 }
 
+// InferReturnTypeFromInputArgTypes returns the type that the function returns
+// when given arguments of the specified types. Unlike FixedReturnType, it is
+// able to resolve return types which depend on the function's arguments.
+func (b Builtin) InferReturnTypeFromInputArgTypes(argTypes []Type) Type {
+	retType := b.FixedReturnType()
+	if retType != TypeAny {
+		return retType
+	}
+	args := make([]TypedExpr, len(argTypes))
+	for i, t := range argTypes {
+		args[i] = &typedDummy{typ: t}
+	}
+	return b.ReturnType(args)
+}
+
+// typedDummy is a TypedExpr which only carries a type. It is used to resolve
+// return types without having actual arguments.
+type typedDummy struct {
+	typ Type
+}
+
+var _ TypedExpr = &typedDummy{}
+
+// String implements the fmt.Stringer interface.
+func (d *typedDummy) String() string { return AsString(d) }
+
+// Format implements the NodeFormatter interface.
+func (d *typedDummy) Format(buf *bytes.Buffer, f FmtFlags) {
+	buf.WriteString("dummy::")
+	buf.WriteString(d.typ.String())
+}
+
+// Walk implements the Expr interface.
+func (d *typedDummy) Walk(_ Visitor) Expr { return d }
+
+// TypeCheck implements the Expr interface.
+func (d *typedDummy) TypeCheck(_ *SemaContext, _ Type) (TypedExpr, error) { return d, nil }
+
+// ResolvedType implements the TypedExpr interface.
+func (d *typedDummy) ResolvedType() Type { return d.typ }
+
+// Eval implements the TypedExpr interface.
+func (d *typedDummy) Eval(_ *EvalContext) (Datum, error) {
+	return nil, errors.Errorf("dummy expression of type %s cannot be evaluated", d.typ)
+}
+
 // Signature returns a human-readable signature.
 func (b Builtin) Signature() string {
 	return fmt.Sprintf("(%s) -> %s", b.Types.String(), b.FixedReturnType())
@@ -1525,6 +1571,19 @@ var Builtins = map[string][]Builtin{
 		},
 	},
 
+	"count_min_sketch_estimate": {
+		Builtin{
+			Types:      ArgTypes{{"sketch", TypeBytes}, {"val", TypeAny}},
+			ReturnType: fixedReturnType(TypeInt),
+			fn: func(_ *EvalContext, args Datums) (Datum, error) {
+				return countMinSketchEstimate(args[0].(*DBytes), args[1])
+			},
+			Info: "Estimates the number of occurrences of `val` among the values whose count-min " +
+				"sketch is `sketch`, as built by count_min_sketch. The estimate may exceed, but is " +
+				"never below, the actual number.",
+		},
+	},
+
 	// Array functions.
 
 	"array_length": {
@@ -880,6 +880,10 @@ type FuncExpr struct {
 	Func  ResolvableFunctionReference
 	Type  funcType
 	Exprs Exprs
+	// OrderBy is used for orderings within aggregates:
+	// FIRST_VALUE(k ORDER BY v). It is only honored by the aggregates
+	// whose result depends on the order of their input.
+	OrderBy OrderBy
 	// Filter is used for filters on aggregates: SUM(k) FILTER (WHERE k > 0)
 	Filter    Expr
 	WindowDef *WindowDef
@@ -963,6 +967,7 @@ func (node *FuncExpr) Format(buf *bytes.Buffer, f FmtFlags) {
 	buf.WriteByte('(')
 	buf.WriteString(typ)
 	FormatNode(buf, f, node.Exprs)
+	FormatNode(buf, f, node.OrderBy)
 	buf.WriteByte(')')
 	if window := node.WindowDef; window != nil {
 		buf.WriteString(" OVER ")
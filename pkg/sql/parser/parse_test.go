@@ -541,6 +541,10 @@ func TestParse(t *testing.T) {
 		{`SELECT avg(1) OVER (PARTITION BY b ORDER BY c) FROM t`},
 		{`SELECT avg(1) OVER (w PARTITION BY b ORDER BY c) FROM t`},
 
+		{`SELECT first_value(a ORDER BY b) FROM t`},
+		{`SELECT last_value(a ORDER BY b DESC, c) FROM t GROUP BY d`},
+		{`SELECT first_value(DISTINCT a ORDER BY b) FROM t`},
+
 		{`SELECT a FROM t UNION SELECT 1 FROM t`},
 		{`SELECT a FROM t UNION SELECT 1 FROM t UNION SELECT 1 FROM t`},
 		{`SELECT a FROM t UNION ALL SELECT 1 FROM t`},
@@ -473,6 +473,17 @@ func (expr *FuncExpr) TypeCheck(ctx *SemaContext, desired Type) (TypedExpr, erro
 		}
 	}
 
+	for i, orderBy := range expr.OrderBy {
+		if orderBy.OrderType != OrderByColumn {
+			return nil, errors.New("ORDER BY INDEX in aggregate function call is not supported")
+		}
+		typedOrderBy, err := orderBy.Expr.TypeCheck(ctx, TypeAny)
+		if err != nil {
+			return nil, err
+		}
+		expr.OrderBy[i].Expr = typedOrderBy
+	}
+
 	if expr.Filter != nil {
 		typedFilter, err := typeCheckAndRequireBoolean(ctx, expr.Filter, "FILTER expression")
 		if err != nil {
@@ -496,6 +507,9 @@ func (expr *FuncExpr) TypeCheck(ctx *SemaContext, desired Type) (TypedExpr, erro
 		if expr.Filter != nil {
 			return nil, fmt.Errorf("FILTER within a window function call is not yet supported")
 		}
+		if len(expr.OrderBy) > 0 {
+			return nil, fmt.Errorf("ORDER BY within a window function call is not supported")
+		}
 	} else {
 		// Make sure the window function builtins are used as window function applications.
 		switch builtin.class {
@@ -512,6 +526,18 @@ func (expr *FuncExpr) TypeCheck(ctx *SemaContext, desired Type) (TypedExpr, erro
 
 	}
 
+	if builtin.class == AggregateClass && len(expr.Exprs) == 0 && builtin.Types.Length() > 0 {
+		// Same error message as Postgres. Variadic aggregates like count() would
+		// otherwise accept being called without arguments.
+		return nil, pgerror.NewErrorf(pgerror.CodeWrongObjectTypeError,
+			"%s(*) must be used to call a parameterless aggregate function", expr.Func)
+	}
+
+	if len(expr.OrderBy) > 0 && builtin.class != AggregateClass {
+		// Same error message as Postgres.
+		return nil, fmt.Errorf("ORDER BY specified, but %s is not an aggregate function", expr.Func)
+	}
+
 	// Check that the built-in is allowed for the current user.
 	// TODO(knz): this check can be moved to evaluation time pending #15363.
 	if builtin.privileged && !ctx.privileged {
@@ -202,6 +202,13 @@ func (expr *FuncExpr) CopyNode() *FuncExpr {
 		exprCopy.WindowDef = &windowDefCopy
 	}
 	exprCopy.Exprs = append(Exprs(nil), exprCopy.Exprs...)
+	if len(expr.OrderBy) > 0 {
+		newOrderBy := make(OrderBy, len(expr.OrderBy))
+		for i, o := range expr.OrderBy {
+			newOrderBy[i] = &Order{OrderType: o.OrderType, Expr: o.Expr, Direction: o.Direction}
+		}
+		exprCopy.OrderBy = newOrderBy
+	}
 	if windowDef := exprCopy.WindowDef; windowDef != nil {
 		windowDef.Partitions = append(Exprs(nil), windowDef.Partitions...)
 		if len(windowDef.OrderBy) > 0 {
@@ -227,6 +234,18 @@ func (expr *FuncExpr) Walk(v Visitor) Expr {
 			ret.Exprs[i] = e
 		}
 	}
+	for i := range expr.OrderBy {
+		if expr.OrderBy[i].OrderType != OrderByColumn {
+			continue
+		}
+		e, changed := WalkExpr(v, expr.OrderBy[i].Expr)
+		if changed {
+			if ret == expr {
+				ret = expr.CopyNode()
+			}
+			ret.OrderBy[i].Expr = e
+		}
+	}
 	if expr.WindowDef != nil {
 		for i := range expr.WindowDef.Partitions {
 			e, changed := WalkExpr(v, expr.WindowDef.Partitions[i])
@@ -152,12 +152,8 @@ var windows = map[string][]Builtin{
 				t, makeLeadLagWindowConstructor(true, true, true))
 		}, TypesAnyNonArray...),
 	),
-	"first_value": collectBuiltins(func(t Type) Builtin {
-		return makeWindowBuiltin(ArgTypes{{"val", t}}, t, newFirstValueWindow)
-	}, TypesAnyNonArray...),
-	"last_value": collectBuiltins(func(t Type) Builtin {
-		return makeWindowBuiltin(ArgTypes{{"val", t}}, t, newLastValueWindow)
-	}, TypesAnyNonArray...),
+	// first_value and last_value are defined with the aggregates, as they can
+	// also be applied as aggregate functions.
 	"nth_value": collectBuiltins(func(t Type) Builtin {
 		return makeWindowBuiltin(ArgTypes{{"val", t}, {"n", TypeInt}}, t, newNthValueWindow)
 	}, TypesAnyNonArray...),
@@ -224,11 +220,13 @@ func (w *aggregateWindowFunc) Compute(
 	for i := 0; i < wf.PeerRowCount; i++ {
 		args := wf.argsWithRowOffset(i)
 		var value Datum
+		var others Datums
 		// COUNT_ROWS takes no arguments.
 		if len(args) > 0 {
 			value = args[0]
+			others = args[1:]
 		}
-		if err := w.agg.Add(ctx, value); err != nil {
+		if err := w.agg.Add(ctx, value, others...); err != nil {
 			return nil, err
 		}
 	}
@@ -86,6 +86,13 @@ type queryMeta struct {
 	// Current phase of execution of query.
 	phase queryPhase
 
+	// The progress of a distributed query: the number of rows read from KV so
+	// far by its processors, and an estimate of the total (see
+	// distSQLReceiver.updateProgress). Both are 0 until the processors report
+	// their progress.
+	rowsRead      int64
+	estimatedRows int64
+
 	// Context associated with this query's transaction.
 	ctx context.Context
 
@@ -149,6 +156,9 @@ type Session struct {
 	// DistSQLMode indicates whether to run queries using the distributed
 	// execution engine.
 	DistSQLMode cluster.DistSQLExecMode
+	// DistSQLWorkMem is the amount of memory each DistSQL processor can use
+	// before falling back to temporary storage.
+	DistSQLWorkMem int64
 	// Location indicates the current time zone.
 	Location *time.Location
 	// SearchPath is a list of databases that will be searched for a table name
@@ -292,6 +302,8 @@ type Session struct {
 	// sqlStats tracks per-application statistics for all
 	// applications on each node.
 	sqlStats *sqlStats
+	// slowQueries is the node's slow query log.
+	slowQueries *slowQueryLog
 	// appStats track per-application SQL usage statistics.
 	appStats *appStats
 	// phaseTimes tracks session-level phase times. It is copied-by-value
@@ -367,6 +379,7 @@ func NewSession(
 	s := &Session{
 		Database:         args.Database,
 		DistSQLMode:      distSQLMode,
+		DistSQLWorkMem:   e.cfg.Settings.DistSQLWorkMem.Get(),
 		SearchPath:       sqlbase.DefaultSearchPath,
 		Location:         time.UTC,
 		User:             args.User,
@@ -376,6 +389,7 @@ func NewSession(
 		parallelizeQueue: MakeParallelizeQueue(NewSpanBasedDependencyAnalyzer()),
 		memMetrics:       memMetrics,
 		sqlStats:         &e.sqlStats,
+		slowQueries:      &e.slowQueries,
 		defaults: sessionDefaults{
 			applicationName: args.ApplicationName,
 			database:        args.Database,
@@ -623,6 +637,16 @@ func (s *Session) setQueryExecutionMode(queryID uint128.Uint128, isDistributed b
 	s.mu.Unlock()
 }
 
+// setQueryProgress records the progress of a distributed query.
+func (s *Session) setQueryProgress(queryID uint128.Uint128, rowsRead, estimatedRows int64) {
+	s.mu.Lock()
+	if queryMeta, ok := s.mu.ActiveQueries[queryID]; ok {
+		queryMeta.rowsRead = rowsRead
+		queryMeta.estimatedRows = estimatedRows
+	}
+	s.mu.Unlock()
+}
+
 // MaxSQLBytes is the maximum length in bytes of SQL statements serialized
 // into a serverpb.Session. Exported for testing.
 const MaxSQLBytes = 1000
@@ -663,6 +687,8 @@ func (s *Session) serialize() serverpb.Session {
 			Sql:           sql,
 			IsDistributed: query.isDistributed,
 			Phase:         (serverpb.ActiveQuery_Phase)(query.phase),
+			RowsRead:      query.rowsRead,
+			EstimatedRows: query.estimatedRows,
 		})
 	}
 
@@ -978,6 +1004,59 @@ func (ts *txnState) finishSQLTxn(s *Session) {
 	ts.sp = nil
 }
 
+// traceStmt records the execution of a statement if
+// sql.trace.stmt.enable_threshold or sql.trace.slow_query_log.threshold is
+// set, by swapping the txn's context for one with a snowball recording span
+// for the duration of the statement. The recording thus includes the spans
+// of all the nodes the statement runs on, which are returned to the gateway
+// with the KV responses and DistSQL metadata. The returned function must be
+// called once the statement has executed; it logs the trace if the statement
+// took longer than the first threshold, and writes the statement to the slow
+// query log if it took longer than the second one.
+//
+// Statements aren't recorded separately when session tracing is enabled or
+// when their txn is already recorded (e.g. for
+// sql.trace.txn.enable_threshold). Neither are the statements which can
+// start session tracing, which records the txn's span.
+func (ts *txnState) traceStmt(s *Session, stmt Statement) func() {
+	traceThreshold := s.execCfg.Settings.TraceStmtThreshold.Get()
+	slowThreshold := s.execCfg.Settings.SlowQueryLogThreshold.Get()
+	if (traceThreshold <= 0 && slowThreshold <= 0) ||
+		s.Tracing.Enabled() || ts.sp == nil || tracing.IsRecording(ts.sp) {
+		return func() {}
+	}
+	switch stmt.AST.(type) {
+	case *parser.Set, *parser.ShowTrace:
+		return func() {}
+	}
+	txnCtx := ts.Ctx
+	sp := ts.sp.Tracer().StartSpan(
+		"sql stmt", opentracing.ChildOf(ts.sp.Context()), tracing.Recordable)
+	tracing.StartRecording(sp, tracing.SnowballRecording)
+	stmtCtx := opentracing.ContextWithSpan(txnCtx, sp)
+	ts.Ctx = stmtCtx
+	start := timeutil.Now()
+
+	return func() {
+		// The statement might have finished the txn, in which case its context
+		// doesn't need to be restored.
+		if ts.Ctx == stmtCtx {
+			ts.Ctx = txnCtx
+		}
+		sp.Finish()
+		elapsed := timeutil.Since(start)
+		if traceThreshold > 0 && elapsed >= traceThreshold {
+			dump := tracing.FormatRecordedSpans(tracing.GetRecording(sp))
+			if len(dump) > 0 {
+				log.Infof(s.context, "SQL statement trace for %s:\n%s", stmt, dump)
+			}
+		}
+		if slowThreshold > 0 && elapsed >= slowThreshold && s.slowQueries != nil {
+			s.slowQueries.add(makeSlowQuery(s, stmt, start, elapsed, tracing.GetRecording(sp)))
+		}
+	}
+}
+
 // updateStateAndCleanupOnErr updates txnState based on the type of error that we
 // received. If it's a retriable error and we're going to retry the txn,
 // then the state moves to RestartWait. Otherwise, the state moves to Aborted
@@ -0,0 +1,133 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sql
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// slowQueryLogSize is the number of statements kept by a slowQueryLog.
+const slowQueryLogSize = 100
+
+// slowQuery is a statement written to the slow query log.
+type slowQuery struct {
+	start    time.Time
+	duration time.Duration
+	user     string
+	appName  string
+	stmt     string
+	// batches summarizes the KV batches evaluated for the statement, as
+	// received by the ranges which evaluated them.
+	batches []string
+	// retries describes the automatic retries of the statement's txn.
+	retries []string
+	// trace is the condensed trace of the statement: the operation and
+	// duration of each of its spans.
+	trace string
+}
+
+// slowQueryLog keeps the most recent statements which took longer than
+// sql.trace.slow_query_log.threshold on the node, for after-the-fact
+// analysis (see crdb_internal.node_slow_queries).
+type slowQueryLog struct {
+	syncutil.Mutex
+	queries []slowQuery
+	next    int
+}
+
+func (l *slowQueryLog) add(q slowQuery) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.queries) < slowQueryLogSize {
+		l.queries = append(l.queries, q)
+		return
+	}
+	l.queries[l.next] = q
+	l.next = (l.next + 1) % slowQueryLogSize
+}
+
+// get returns the statements in the log, oldest first.
+func (l *slowQueryLog) get() []slowQuery {
+	l.Lock()
+	defer l.Unlock()
+	queries := make([]slowQuery, 0, len(l.queries))
+	queries = append(queries, l.queries[l.next:]...)
+	return append(queries, l.queries[:l.next]...)
+}
+
+// makeSlowQuery describes a slow statement using its recording.
+func makeSlowQuery(
+	s *Session, stmt Statement, start time.Time, duration time.Duration, spans []tracing.RecordedSpan,
+) slowQuery {
+	s.mu.RLock()
+	appName := s.mu.ApplicationName
+	s.mu.RUnlock()
+	q := slowQuery{
+		start:    start,
+		duration: duration,
+		user:     s.User,
+		appName:  appName,
+		stmt:     stmt.String(),
+		trace:    condenseRecording(spans),
+	}
+	for _, sp := range spans {
+		for i := range sp.Logs {
+			payload, err := sp.Logs[i].StructuredPayload()
+			if err != nil {
+				continue
+			}
+			switch ev := payload.(type) {
+			case *roachpb.BatchSummaryEvent:
+				q.batches = append(q.batches, fmt.Sprintf("r%d: %s", ev.RangeID, ev))
+			case *roachpb.TxnRetryEvent:
+				q.retries = append(q.retries, ev.String())
+			}
+		}
+	}
+	return q
+}
+
+// condenseRecording renders the tree of the recorded spans with one line per
+// span, holding its operation and duration but none of its events.
+func condenseRecording(spans []tracing.RecordedSpan) string {
+	ids := make(map[uint64]struct{}, len(spans))
+	children := make(map[uint64][]int)
+	for i := range spans {
+		ids[spans[i].SpanID] = struct{}{}
+		children[spans[i].ParentSpanID] = append(children[spans[i].ParentSpanID], i)
+	}
+	var buf bytes.Buffer
+	var render func(i, depth int)
+	render = func(i, depth int) {
+		fmt.Fprintf(&buf, "%s%s: %s\n",
+			strings.Repeat("  ", depth), spans[i].Operation, spans[i].Duration)
+		for _, c := range children[spans[i].SpanID] {
+			render(c, depth+1)
+		}
+	}
+	for i := range spans {
+		if _, ok := ids[spans[i].ParentSpanID]; !ok {
+			render(i, 0)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sql
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+func TestSlowQueryLogBounded(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var l slowQueryLog
+	const n = 2*slowQueryLogSize + 3
+	for i := 0; i < n; i++ {
+		l.add(slowQuery{stmt: fmt.Sprint(i)})
+	}
+	queries := l.get()
+	if len(queries) != slowQueryLogSize {
+		t.Fatalf("expected %d queries, got %d", slowQueryLogSize, len(queries))
+	}
+	for i, q := range queries {
+		if exp := fmt.Sprint(n - slowQueryLogSize + i); q.stmt != exp {
+			t.Fatalf("%d: expected statement %s, got %s", i, exp, q.stmt)
+		}
+	}
+}
+
+func TestCondenseRecording(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	spans := []tracing.RecordedSpan{
+		{SpanID: 2, ParentSpanID: 1, Operation: "sql stmt", Duration: 3 * time.Millisecond},
+		{SpanID: 3, ParentSpanID: 2, Operation: "dist sender", Duration: 2 * time.Millisecond},
+		{SpanID: 4, ParentSpanID: 3, Operation: "node", Duration: time.Millisecond},
+		{SpanID: 5, ParentSpanID: 2, Operation: "consuming rows", Duration: 500 * time.Microsecond},
+	}
+	exp := `sql stmt: 3ms
+  dist sender: 2ms
+    node: 1ms
+  consuming rows: 500µs
+`
+	if trace := condenseRecording(spans); trace != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, trace)
+	}
+}
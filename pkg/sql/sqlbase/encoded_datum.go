@@ -17,6 +17,7 @@ package sqlbase
 import (
 	"bytes"
 	"fmt"
+	"unsafe"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
@@ -52,6 +53,18 @@ type EncDatum struct {
 	Datum parser.Datum
 }
 
+const sizeOfEncDatum = unsafe.Sizeof(EncDatum{})
+
+// Size returns a lower bound on the total size of the receiver in bytes,
+// including memory referenced by the receiver.
+func (ed *EncDatum) Size() uintptr {
+	size := sizeOfEncDatum + uintptr(len(ed.encoded))
+	if ed.Datum != nil {
+		size += ed.Datum.Size()
+	}
+	return size
+}
+
 func (ed *EncDatum) stringWithAlloc(a *DatumAlloc) string {
 	if ed.Datum == nil {
 		if ed.encoded == nil {
@@ -276,6 +289,16 @@ func (r EncDatumRow) String() string {
 	return b.String()
 }
 
+// Size returns a lower bound on the total size of the receiver in bytes,
+// including memory referenced by the receiver.
+func (r EncDatumRow) Size() uintptr {
+	var size uintptr
+	for i := range r {
+		size += r[i].Size()
+	}
+	return size
+}
+
 // EncDatumRowToDatums converts a given EncDatumRow to a Datums.
 func EncDatumRowToDatums(datums parser.Datums, row EncDatumRow, da *DatumAlloc) error {
 	if len(row) != len(datums) {
@@ -0,0 +1,193 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sqlbase
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+)
+
+// InterleavedRowFetcher fetches the rows of several tables whose indexes are
+// interleaved with a single scan. Each table is read by a RowFetcher which is
+// initialized as usual; the key/values of the scan are handed to the fetcher
+// of the table they belong to, and those which belong to none of the tables
+// (e.g. the rows of other interleaved tables) are skipped. The rows are
+// returned in the order of the scan, so the rows of a table interleaved in
+// another follow the row of the other table they are interleaved in.
+// Usage:
+//   var f InterleavedRowFetcher
+//   err := f.Init([]*RowFetcher{&parentFetcher, &childFetcher})
+//   // Handle err
+//   err := f.StartScan(..)
+//   // Handle err
+//   for {
+//      row, table, err := f.NextRow(ctx, traceKV)
+//      // Handle err
+//      if row == nil {
+//         // Done
+//         break
+//      }
+//      // Process the row of fetchers[table]
+//   }
+type InterleavedRowFetcher struct {
+	fetchers []*RowFetcher
+	// views are the kvFetchers of each of the fetchers.
+	views []interleavedKVFetcher
+	// keyVals are used to decode the index keys of each table to find out
+	// which table a key belongs to, without affecting the fetchers.
+	keyVals [][]EncDatum
+	alloc   DatumAlloc
+
+	kvFetcher kvFetcher
+	// kv is the next key/value of the scan if peeked is set; kvTable is the
+	// table it belongs to, and kvEnd is set if the scan is over.
+	kv      client.KeyValue
+	kvTable int
+	kvEnd   bool
+	peeked  bool
+
+	// cur is the index of the fetcher whose row is being fetched, or -1.
+	cur int
+}
+
+// Init sets up an InterleavedRowFetcher for the given fetchers, which must have
+// been initialized and must scan in the same direction.
+func (f *InterleavedRowFetcher) Init(fetchers []*RowFetcher) error {
+	if len(fetchers) == 0 {
+		return errors.New("no fetchers")
+	}
+	f.fetchers = fetchers
+	f.views = make([]interleavedKVFetcher, len(fetchers))
+	f.keyVals = make([][]EncDatum, len(fetchers))
+	for i, rf := range fetchers {
+		if rf.reverse != fetchers[0].reverse {
+			return errors.New("interleaved fetchers must scan in the same direction")
+		}
+		f.views[i] = interleavedKVFetcher{f: f, table: i}
+		indexColumnIDs, _ := rf.index.FullColumnIDs()
+		var err error
+		if f.keyVals[i], err = MakeEncodedKeyVals(rf.desc, indexColumnIDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartScan initializes and starts the key-value scan. Can be used multiple
+// times.
+func (f *InterleavedRowFetcher) StartScan(
+	ctx context.Context, txn *client.Txn, spans roachpb.Spans, limitBatches bool,
+) error {
+	if len(spans) == 0 {
+		panic("no spans")
+	}
+	kvf, err := makeKVFetcher(
+		txn, spans, f.fetchers[0].reverse, limitBatches, false, /* adaptiveBatches */
+		0 /* firstBatchLimit */, false, /* returnRangeInfo */
+	)
+	if err != nil {
+		return err
+	}
+	f.kvFetcher = &kvf
+	f.peeked = false
+	f.cur = -1
+	return nil
+}
+
+// NextRow returns the next row of any of the tables, along with the index of
+// the fetcher of its table. The EncDatumRow should not be modified and is only
+// valid until the next call. When there are no more rows, the EncDatumRow is
+// nil.
+func (f *InterleavedRowFetcher) NextRow(
+	ctx context.Context, traceKV bool,
+) (_ EncDatumRow, table int, _ error) {
+	for {
+		if f.cur >= 0 {
+			row, err := f.fetchers[f.cur].NextRow(ctx, traceKV)
+			if err != nil || row != nil {
+				return row, f.cur, err
+			}
+			// The fetcher reached a key of another table, or the end of the
+			// scan.
+			f.cur = -1
+		}
+		if err := f.peek(ctx); err != nil {
+			return nil, 0, err
+		}
+		if f.kvEnd {
+			return nil, 0, nil
+		}
+		f.cur = f.kvTable
+		if err := f.fetchers[f.cur].StartScanFrom(ctx, &f.views[f.cur]); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// peek retrieves the next key/value of the scan which belongs to one of the
+// tables, if it hasn't been retrieved already.
+func (f *InterleavedRowFetcher) peek(ctx context.Context) error {
+	for !f.peeked {
+		ok, kv, err := f.kvFetcher.nextKV(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			f.kvEnd, f.peeked = true, true
+			return nil
+		}
+		for i, rf := range f.fetchers {
+			_, ok, err := DecodeIndexKey(
+				&f.alloc, rf.desc, rf.index.ID, f.keyVals[i], rf.indexColumnDirs, kv.Key,
+			)
+			if err != nil {
+				return err
+			}
+			if ok {
+				f.kv, f.kvTable, f.kvEnd, f.peeked = kv, i, false, true
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// interleavedKVFetcher is the kvFetcher of one of the fetchers of an
+// InterleavedRowFetcher. It returns the key/values of the scan as long as they
+// belong to its table.
+type interleavedKVFetcher struct {
+	f     *InterleavedRowFetcher
+	table int
+}
+
+var _ kvFetcher = &interleavedKVFetcher{}
+
+func (v *interleavedKVFetcher) nextKV(ctx context.Context) (bool, client.KeyValue, error) {
+	if err := v.f.peek(ctx); err != nil {
+		return false, client.KeyValue{}, err
+	}
+	if v.f.kvEnd || v.f.kvTable != v.table {
+		return false, client.KeyValue{}, nil
+	}
+	v.f.peeked = false
+	return true, v.f.kv, nil
+}
+
+func (v *interleavedKVFetcher) getRangesInfo() []roachpb.RangeInfo {
+	return nil
+}
@@ -79,6 +79,25 @@ func SetKVBatchSize(val int64) func() {
 	return func() { kvBatchSize = oldVal }
 }
 
+// kvAdaptiveFirstBatchSize is the number of keys requested by the first batch
+// of an adaptive scan without a limit hint. It is also the smallest size of
+// the following batches, unless the rows are too wide for it.
+var kvAdaptiveFirstBatchSize int64 = 100
+
+// kvAdaptiveMaxBatchSize is the largest number of keys requested by a batch of
+// an adaptive scan.
+var kvAdaptiveMaxBatchSize int64 = 100000
+
+// kvAdaptiveBatchBytes is the approximate number of bytes an adaptive scan
+// aims to retrieve per batch. The KV layer can only limit batches by number of
+// keys, so the number of keys is derived from the average size of the
+// key/values fetched so far.
+var kvAdaptiveBatchBytes int64 = 4 << 20
+
+// kvAdaptiveGrowthFactor is how much larger each batch of an adaptive scan is
+// than the previous one.
+const kvAdaptiveGrowthFactor = 4
+
 // txnKVFetcher handles retrieval of key/values.
 type txnKVFetcher struct {
 	// "Constant" fields, provided by the caller.
@@ -90,11 +109,20 @@ type txnKVFetcher struct {
 	// returnRangeInfo, if set, causes the kvFetcher to populate rangeInfos.
 	// See also rowFetcher.returnRangeInfo.
 	returnRangeInfo bool
-
-	fetchEnd  bool
-	batchIdx  int
-	responses []roachpb.ResponseUnion
-	kvs       []roachpb.KeyValue
+	// adaptiveBatches, if set, causes the batch sizes to be determined by
+	// getAdaptiveBatchSize.
+	adaptiveBatches bool
+
+	fetchEnd bool
+	batchIdx int
+	// lastBatchSize is the key limit of the last batch sent.
+	lastBatchSize int64
+	// fetchedKeys and fetchedBytes are the number of key/values retrieved so
+	// far and their total size.
+	fetchedKeys  int64
+	fetchedBytes int64
+	responses    []roachpb.ResponseUnion
+	kvs          []roachpb.KeyValue
 
 	// As the kvFetcher fetches batches of kvs, it accumulates information on the
 	// replicas where the batches came from. This info can be retrieved through
@@ -116,6 +144,9 @@ func (f *txnKVFetcher) getBatchSize() int64 {
 	if !f.useBatchLimit {
 		return 0
 	}
+	if f.adaptiveBatches {
+		return f.getAdaptiveBatchSize()
+	}
 	if f.firstBatchLimit == 0 || f.firstBatchLimit >= kvBatchSize {
 		return kvBatchSize
 	}
@@ -153,11 +184,57 @@ func (f *txnKVFetcher) getBatchSize() int64 {
 	}
 }
 
+// getAdaptiveBatchSize returns the max size of the next batch of an adaptive
+// scan. The first batch is small (or limited by the limit hint); every batch
+// after that means the consumer needed more rows than we retrieved so far, so
+// each is kvAdaptiveGrowthFactor times larger than the previous one, up to
+// kvAdaptiveMaxBatchSize keys or about kvAdaptiveBatchBytes bytes, whichever
+// is less. Sample progressions of batch sizes for small key/values:
+//
+//  First batch limit | Batches
+//  ----------------------------------------------------------------
+//              none  | 100, 400, 1,600, 6,400, 25,600, 100,000
+//                 2  | 2, 100, 400, 1,600, 6,400, 25,600, 100,000
+//             1,000  | 1,000, 4,000, 16,000, 64,000, 100,000
+func (f *txnKVFetcher) getAdaptiveBatchSize() int64 {
+	if f.batchIdx == 0 {
+		if f.firstBatchLimit != 0 && f.firstBatchLimit < kvAdaptiveMaxBatchSize {
+			return f.firstBatchLimit
+		}
+		if f.firstBatchLimit == 0 && kvAdaptiveFirstBatchSize < kvAdaptiveMaxBatchSize {
+			return kvAdaptiveFirstBatchSize
+		}
+		return kvAdaptiveMaxBatchSize
+	}
+
+	size := f.lastBatchSize * kvAdaptiveGrowthFactor
+	if size < kvAdaptiveFirstBatchSize {
+		size = kvAdaptiveFirstBatchSize
+	}
+	if size > kvAdaptiveMaxBatchSize {
+		size = kvAdaptiveMaxBatchSize
+	}
+	if f.fetchedKeys > 0 {
+		kvSize := f.fetchedBytes / f.fetchedKeys
+		if kvSize == 0 {
+			kvSize = 1
+		}
+		if maxKeys := kvAdaptiveBatchBytes / kvSize; size > maxKeys {
+			size = maxKeys
+		}
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
 // makeKVFetcher initializes a kvFetcher for the given spans.
 //
 // If useBatchLimit is true, batches are limited to kvBatchSize. If
 // firstBatchLimit is also set, the first batch is limited to that value.
-// Subsequent batches are larger, up to kvBatchSize.
+// Subsequent batches are larger, up to kvBatchSize. If adaptiveBatches is also
+// set, the batch sizes are instead determined by getAdaptiveBatchSize.
 //
 // Batch limits can only be used if the spans are ordered.
 func makeKVFetcher(
@@ -165,6 +242,7 @@ func makeKVFetcher(
 	spans roachpb.Spans,
 	reverse bool,
 	useBatchLimit bool,
+	adaptiveBatches bool,
 	firstBatchLimit int64,
 	returnRangeInfo bool,
 ) (txnKVFetcher, error) {
@@ -172,6 +250,9 @@ func makeKVFetcher(
 		return txnKVFetcher{}, errors.Errorf("invalid batch limit %d (useBatchLimit: %t)",
 			firstBatchLimit, useBatchLimit)
 	}
+	if adaptiveBatches && !useBatchLimit {
+		return txnKVFetcher{}, errors.Errorf("adaptive batches require a batch limit")
+	}
 
 	if useBatchLimit {
 		// Verify the spans are ordered if a batch limit is used.
@@ -198,6 +279,7 @@ func makeKVFetcher(
 		spans:           copySpans,
 		reverse:         reverse,
 		useBatchLimit:   useBatchLimit,
+		adaptiveBatches: adaptiveBatches,
 		firstBatchLimit: firstBatchLimit,
 		returnRangeInfo: returnRangeInfo,
 	}, nil
@@ -207,6 +289,7 @@ func makeKVFetcher(
 func (f *txnKVFetcher) fetch(ctx context.Context) error {
 	var ba roachpb.BatchRequest
 	ba.Header.MaxSpanRequestKeys = f.getBatchSize()
+	f.lastBatchSize = ba.Header.MaxSpanRequestKeys
 	ba.Header.ReturnRangeInfo = f.returnRangeInfo
 	ba.Requests = make([]roachpb.RequestUnion, len(f.spans))
 	if f.reverse {
@@ -238,12 +321,19 @@ func (f *txnKVFetcher) fetch(ctx context.Context) error {
 	for _, resp := range f.responses {
 		reply := resp.GetInner()
 
-		var numKVs int
+		var rows []roachpb.KeyValue
 		switch t := reply.(type) {
 		case *roachpb.ScanResponse:
-			numKVs = len(t.Rows)
+			rows = t.Rows
 		case *roachpb.ReverseScanResponse:
-			numKVs = len(t.Rows)
+			rows = t.Rows
+		}
+		numKVs := len(rows)
+		if f.adaptiveBatches {
+			f.fetchedKeys += int64(numKVs)
+			for i := range rows {
+				f.fetchedBytes += int64(len(rows[i].Key) + len(rows[i].Value.RawBytes))
+			}
 		}
 
 		if numKVs > 0 && sawResumeSpan {
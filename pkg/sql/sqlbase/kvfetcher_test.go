@@ -0,0 +1,68 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sqlbase
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestAdaptiveBatchSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testCases := []struct {
+		firstBatchLimit int64
+		// kvSize is the size of each key/value returned by the simulated
+		// batches.
+		kvSize   int64
+		expected []int64
+	}{
+		{0, 10, []int64{100, 400, 1600, 6400, 25600, 100000, 100000}},
+		{2, 10, []int64{2, 100, 400, 1600, 6400, 25600, 100000}},
+		{1000, 10, []int64{1000, 4000, 16000, 64000, 100000, 100000}},
+		{200000, 10, []int64{100000, 100000}},
+		// Wide rows limit the batches to about kvAdaptiveBatchBytes.
+		{0, 1000, []int64{100, 400, 1600, 4194, 4194}},
+		{0, 10 << 20, []int64{100, 1, 1}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%d/%d", tc.firstBatchLimit, tc.kvSize), func(t *testing.T) {
+			f, err := makeKVFetcher(
+				nil /* txn */, nil /* spans */, false, /* reverse */
+				true /* useBatchLimit */, true, /* adaptiveBatches */
+				tc.firstBatchLimit, false, /* returnRangeInfo */
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sizes []int64
+			for range tc.expected {
+				size := f.getBatchSize()
+				sizes = append(sizes, size)
+				// Simulate fetching a full batch.
+				f.lastBatchSize = size
+				f.fetchedKeys += size
+				f.fetchedBytes += size * tc.kvSize
+				f.batchIdx++
+			}
+			if !reflect.DeepEqual(sizes, tc.expected) {
+				t.Errorf("expected batch sizes %v, got %v", tc.expected, sizes)
+			}
+		})
+	}
+}
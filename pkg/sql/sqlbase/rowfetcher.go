@@ -183,6 +183,27 @@ func (rf *RowFetcher) Init(
 // times.
 func (rf *RowFetcher) StartScan(
 	ctx context.Context, txn *client.Txn, spans roachpb.Spans, limitBatches bool, limitHint int64,
+) error {
+	return rf.startScan(ctx, txn, spans, limitBatches, false /* adaptiveBatches */, limitHint)
+}
+
+// StartAdaptiveScan is like StartScan with limited batches, except that the
+// batches start small and grow as the consumer keeps asking for rows, up to a
+// size that depends on the width of the key/values retrieved so far. Can be
+// used multiple times.
+func (rf *RowFetcher) StartAdaptiveScan(
+	ctx context.Context, txn *client.Txn, spans roachpb.Spans, limitHint int64,
+) error {
+	return rf.startScan(ctx, txn, spans, true /* limitBatches */, true /* adaptiveBatches */, limitHint)
+}
+
+func (rf *RowFetcher) startScan(
+	ctx context.Context,
+	txn *client.Txn,
+	spans roachpb.Spans,
+	limitBatches bool,
+	adaptiveBatches bool,
+	limitHint int64,
 ) error {
 	if len(spans) == 0 {
 		panic("no spans")
@@ -200,7 +221,9 @@ func (rf *RowFetcher) StartScan(
 		firstBatchLimit++
 	}
 
-	f, err := makeKVFetcher(txn, spans, rf.reverse, limitBatches, firstBatchLimit, rf.returnRangeInfo)
+	f, err := makeKVFetcher(
+		txn, spans, rf.reverse, limitBatches, adaptiveBatches, firstBatchLimit, rf.returnRangeInfo,
+	)
 	if err != nil {
 		return err
 	}
@@ -26,6 +26,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/pkg/errors"
 )
@@ -216,6 +217,31 @@ var varGen = map[string]sessionVar{
 		},
 	},
 
+	`distsql_workmem`: {
+		Set: func(_ context.Context, session *Session, values []parser.TypedExpr) error {
+			s, err := getStringVal(session, `distsql_workmem`, values)
+			if err != nil {
+				return err
+			}
+			workMem, err := humanizeutil.ParseBytes(s)
+			if err != nil {
+				return fmt.Errorf("set distsql_workmem: %v", err)
+			}
+			if workMem < 1 {
+				return fmt.Errorf("set distsql_workmem: %q must be positive", s)
+			}
+			session.DistSQLWorkMem = workMem
+			return nil
+		},
+		Get: func(session *Session) string {
+			return humanizeutil.IBytes(session.DistSQLWorkMem)
+		},
+		Reset: func(session *Session) error {
+			session.DistSQLWorkMem = session.execCfg.Settings.DistSQLWorkMem.Get()
+			return nil
+		},
+	},
+
 	// Supported for PG compatibility only.
 	// See https://www.postgresql.org/docs/9.6/static/runtime-config-client.html
 	`extra_float_digits`: nopVar,
@@ -279,7 +279,7 @@ func runMVCCConditionalPut(emk engineMaker, valueSize int, createFirst bool, b *
 	for i := 0; i < b.N; i++ {
 		key := roachpb.Key(encoding.EncodeUvarintAscending(keyBuf[:4], uint64(i)))
 		ts := hlc.Timestamp{WallTime: timeutil.Now().UnixNano()}
-		if err := MVCCConditionalPut(context.Background(), eng, nil, key, ts, value, expected, nil); err != nil {
+		if err := MVCCConditionalPut(context.Background(), eng, nil, key, ts, value, expected, CPutFailIfMissing, nil); err != nil {
 			b.Fatalf("failed put: %s", err)
 		}
 	}
@@ -301,7 +301,7 @@ func runMVCCBlindConditionalPut(emk engineMaker, valueSize int, b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		key := roachpb.Key(encoding.EncodeUvarintAscending(keyBuf[:4], uint64(i)))
 		ts := hlc.Timestamp{WallTime: timeutil.Now().UnixNano()}
-		if err := MVCCBlindConditionalPut(context.Background(), eng, nil, key, ts, value, nil, nil); err != nil {
+		if err := MVCCBlindConditionalPut(context.Background(), eng, nil, key, ts, value, nil, CPutFailIfMissing, nil); err != nil {
 			b.Fatalf("failed put: %s", err)
 		}
 	}
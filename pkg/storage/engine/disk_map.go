@@ -155,6 +155,48 @@ func NewRocksDBMap(e Engine) *RocksDBMap {
 	return &RocksDBMap{prefix: encoding.EncodeUvarintAscending([]byte(nil), prefix), store: e}
 }
 
+// TempStorageNamespace is a part of the keyspace of a temporary storage engine
+// which holds a group of RocksDBMaps, e.g. those of a DistSQL flow, so that
+// their data can be cleared at once, including that of the maps that were not
+// closed.
+type TempStorageNamespace struct {
+	prefix []byte
+	// used is set atomically once a map is created in the namespace.
+	used int32
+}
+
+// NewTempStorageNamespace creates a TempStorageNamespace with a unique prefix.
+func NewTempStorageNamespace() *TempStorageNamespace {
+	return &TempStorageNamespace{
+		prefix: encoding.EncodeUvarintAscending([]byte(nil), generateTempStorageID()),
+	}
+}
+
+// NewRocksDBMap creates a new RocksDBMap with the passed in Engine as the
+// underlying store, whose keyspace is part of the namespace. If the namespace
+// is nil, the map is not part of any namespace (see NewRocksDBMap).
+func (n *TempStorageNamespace) NewRocksDBMap(e Engine) *RocksDBMap {
+	if n == nil {
+		return NewRocksDBMap(e)
+	}
+	atomic.StoreInt32(&n.used, 1)
+	prefix := append([]byte(nil), n.prefix...)
+	prefix = encoding.EncodeUvarintAscending(prefix, generateTempStorageID())
+	return &RocksDBMap{prefix: prefix, store: e}
+}
+
+// Clear removes the data of all the maps of the namespace from the passed in
+// Engine, which must be the store of the maps.
+func (n *TempStorageNamespace) Clear(e Engine) error {
+	if n == nil || atomic.LoadInt32(&n.used) == 0 {
+		return nil
+	}
+	return e.ClearRange(
+		MVCCKey{Key: n.prefix},
+		MVCCKey{Key: roachpb.Key(n.prefix).PrefixEnd()},
+	)
+}
+
 // makeKey appends k to the RocksDBMap's prefix to keep the key local to this
 // instance and creates an MVCCKey, which is what the underlying storage engine
 // expects. The returned key is only valid until the next call to makeKey().
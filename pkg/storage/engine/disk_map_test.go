@@ -220,6 +220,47 @@ func TestRocksDBMapSandbox(t *testing.T) {
 	})
 }
 
+func TestTempStorageNamespace(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	tempEngine, err := NewTempEngine(ctx, base.DefaultTestStoreSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tempEngine.Close()
+
+	// Clearing a namespace without maps is a no-op.
+	if err := NewTempStorageNamespace().Clear(tempEngine); err != nil {
+		t.Fatal(err)
+	}
+
+	namespace := NewTempStorageNamespace()
+	nsMaps := []*RocksDBMap{namespace.NewRocksDBMap(tempEngine), namespace.NewRocksDBMap(tempEngine)}
+	otherMap := NewRocksDBMap(tempEngine)
+	defer otherMap.Close(ctx)
+	for _, m := range append(nsMaps, otherMap) {
+		if err := m.Put([]byte("k"), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := namespace.Clear(tempEngine); err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range nsMaps {
+		if v, err := m.Get([]byte("k")); err != nil {
+			t.Fatal(err)
+		} else if v != nil {
+			t.Errorf("%d: expected the map to be cleared, found %q", i, v)
+		}
+	}
+	if v, err := otherMap.Get([]byte("k")); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(v, []byte("v")) {
+		t.Errorf("expected the map outside of the namespace to be untouched, found %q", v)
+	}
+}
+
 func BenchmarkRocksDBMapWrite(b *testing.B) {
 	dir, err := ioutil.TempDir("", "BenchmarkRocksDBMapWrite")
 	if err != nil {
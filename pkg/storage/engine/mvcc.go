@@ -1225,9 +1225,24 @@ func MVCCIncrement(
 	return int64Val, err
 }
 
+// CPutMissingBehavior describes the handling of a key which doesn't exist by
+// a conditional put which expects a value.
+type CPutMissingBehavior bool
+
+const (
+	// CPutAllowIfMissing is used to indicate a CPut can also succeed when the
+	// key doesn't exist, as well as when the existing value matches the
+	// expected value.
+	CPutAllowIfMissing CPutMissingBehavior = true
+	// CPutFailIfMissing is used to indicate the existing value must match the
+	// expected value exactly, i.e. if a value is expected, it must exist.
+	CPutFailIfMissing CPutMissingBehavior = false
+)
+
 // MVCCConditionalPut sets the value for a specified key only if the
 // expected value matches. If not, the return a ConditionFailedError
-// containing the actual value.
+// containing the actual value. If allowIfDoesNotExist is set, the value is
+// also set if the key doesn't exist.
 //
 // The condition check reads a value from the key using the same operational
 // timestamp as we use to write a value.
@@ -1239,19 +1254,22 @@ func MVCCConditionalPut(
 	timestamp hlc.Timestamp,
 	value roachpb.Value,
 	expVal *roachpb.Value,
+	allowIfDoesNotExist CPutMissingBehavior,
 	txn *roachpb.Transaction,
 ) error {
 	iter := engine.NewIterator(true)
 	defer iter.Close()
 
-	return mvccConditionalPutUsingIter(ctx, engine, iter, ms, key, timestamp, value, expVal, txn)
+	return mvccConditionalPutUsingIter(
+		ctx, engine, iter, ms, key, timestamp, value, expVal, allowIfDoesNotExist, txn)
 }
 
 // MVCCBlindConditionalPut is a fast-path of MVCCConditionalPut. See the
 // MVCCConditionalPut comments for details of the
 // semantics. MVCCBlindConditionalPut skips retrieving the existing metadata
 // for the key requiring the caller to guarantee no versions for the key
-// currently exist.
+// currently exist. A blind conditional put which allows the key not to exist
+// thus always succeeds.
 func MVCCBlindConditionalPut(
 	ctx context.Context,
 	engine Writer,
@@ -1260,9 +1278,11 @@ func MVCCBlindConditionalPut(
 	timestamp hlc.Timestamp,
 	value roachpb.Value,
 	expVal *roachpb.Value,
+	allowIfDoesNotExist CPutMissingBehavior,
 	txn *roachpb.Transaction,
 ) error {
-	return mvccConditionalPutUsingIter(ctx, engine, nil, ms, key, timestamp, value, expVal, txn)
+	return mvccConditionalPutUsingIter(
+		ctx, engine, nil, ms, key, timestamp, value, expVal, allowIfDoesNotExist, txn)
 }
 
 func mvccConditionalPutUsingIter(
@@ -1274,6 +1294,7 @@ func mvccConditionalPutUsingIter(
 	timestamp hlc.Timestamp,
 	value roachpb.Value,
 	expVal *roachpb.Value,
+	allowIfDoesNotExist CPutMissingBehavior,
 	txn *roachpb.Transaction,
 ) error {
 	return mvccPutUsingIter(
@@ -1286,7 +1307,7 @@ func mvccConditionalPutUsingIter(
 						ActualValue: existVal.ShallowClone(),
 					}
 				}
-			} else if expValPresent != existValPresent {
+			} else if expValPresent != existValPresent && (existValPresent || !bool(allowIfDoesNotExist)) {
 				return nil, &roachpb.ConditionFailedError{
 					ActualValue: existVal.ShallowClone(),
 				}
@@ -1425,6 +1446,24 @@ func MVCCDeleteRange(
 	timestamp hlc.Timestamp,
 	txn *roachpb.Transaction,
 	returnKeys bool,
+) ([]roachpb.Key, *roachpb.Span, int64, error) {
+	return MVCCDeleteRangeWhere(ctx, engine, ms, key, endKey, max, timestamp, txn, returnKeys, nil)
+}
+
+// MVCCDeleteRangeWhere is like MVCCDeleteRange, but only deletes the keys for
+// which pred, if set, returns true when passed their latest value. Only the
+// deleted keys count towards max.
+func MVCCDeleteRangeWhere(
+	ctx context.Context,
+	engine ReadWriter,
+	ms *enginepb.MVCCStats,
+	key,
+	endKey roachpb.Key,
+	max int64,
+	timestamp hlc.Timestamp,
+	txn *roachpb.Transaction,
+	returnKeys bool,
+	pred func(roachpb.KeyValue) bool,
 ) ([]roachpb.Key, *roachpb.Span, int64, error) {
 	if max == 0 {
 		return nil, &roachpb.Span{Key: key, EndKey: endKey}, 0, nil
@@ -1435,6 +1474,9 @@ func MVCCDeleteRange(
 	buf := newPutBuffer()
 	iter := engine.NewIterator(true)
 	f := func(kv roachpb.KeyValue) (bool, error) {
+		if pred != nil && !pred(kv) {
+			return false, nil
+		}
 		if num == max {
 			// Another key was found beyond the max limit.
 			resumeSpan = &roachpb.Span{Key: kv.Key, EndKey: endKey}
@@ -1780,6 +1822,119 @@ func MVCCIterate(
 	return intents, wiErr
 }
 
+// MVCCScanRevisions returns the revisions of the keys in [key,endKey) written
+// after startTime and at or before endTime, ordered by key and then by
+// ascending timestamp. Deletions are returned as values without bytes, and
+// inline values, which aren't versioned, are skipped. If revisions of more
+// than max keys are found, only those of the first max keys are returned,
+// along with a span to be used in the next call to this function. The
+// intents at or below endTime are returned in a WriteIntentError, as they
+// would be by a consistent scan at endTime, except for those of the given
+// transaction, if any.
+func MVCCScanRevisions(
+	ctx context.Context,
+	engine Reader,
+	key,
+	endKey roachpb.Key,
+	max int64,
+	startTime,
+	endTime hlc.Timestamp,
+	txn *roachpb.Transaction,
+) ([]roachpb.KeyValue, *roachpb.Span, error) {
+	if len(endKey) == 0 {
+		return nil, nil, emptyKeyError()
+	}
+	if max == 0 {
+		return nil, &roachpb.Span{Key: key, EndKey: endKey}, nil
+	}
+
+	iter := engine.NewIterator(false)
+	defer iter.Close()
+
+	var res []roachpb.KeyValue
+	var resumeSpan *roachpb.Span
+	var wiErr *roachpb.WriteIntentError
+	var alloc bufalloc.ByteAllocator
+	var meta enginepb.MVCCMetadata
+	// The versions of a key are iterated over in descending timestamp order;
+	// keyStart is the index in res of the first revision of the current key,
+	// which get reversed once all of them have been found.
+	var curKey roachpb.Key
+	var keyStart int
+	var keys int64
+	// The provisional value of an intent isn't a revision.
+	var intentKey roachpb.Key
+	var intentTS hlc.Timestamp
+	finishKey := func() {
+		for i, j := keyStart, len(res)-1; i < j; i, j = i+1, j-1 {
+			res[i], res[j] = res[j], res[i]
+		}
+		keyStart = len(res)
+	}
+
+	encEndKey := MakeMVCCMetadataKey(endKey)
+	for iter.Seek(MakeMVCCMetadataKey(key)); ; iter.Next() {
+		if ok, err := iter.Valid(); err != nil {
+			return nil, nil, err
+		} else if !ok {
+			break
+		}
+		unsafeKey := iter.UnsafeKey()
+		if !unsafeKey.Less(encEndKey) {
+			break
+		}
+		if !unsafeKey.IsValue() {
+			if err := iter.ValueProto(&meta); err != nil {
+				return nil, nil, err
+			}
+			intentKey = nil
+			if meta.Txn != nil {
+				alloc, intentKey = alloc.Copy(unsafeKey.Key, 0)
+				intentTS = meta.Timestamp
+				ownIntent := txn != nil && meta.Txn.ID == txn.ID
+				if !ownIntent && !endTime.Less(meta.Timestamp) {
+					if wiErr == nil {
+						wiErr = &roachpb.WriteIntentError{}
+					}
+					wiErr.Intents = append(wiErr.Intents, roachpb.Intent{
+						Span: roachpb.Span{Key: intentKey}, Status: roachpb.PENDING, Txn: *meta.Txn,
+					})
+				}
+			}
+			continue
+		}
+		if unsafeKey.Timestamp == intentTS && unsafeKey.Key.Equal(intentKey) {
+			continue
+		}
+		if endTime.Less(unsafeKey.Timestamp) || !startTime.Less(unsafeKey.Timestamp) {
+			continue
+		}
+		if !unsafeKey.Key.Equal(curKey) {
+			finishKey()
+			if keys == max {
+				// Another key was found beyond the max limit.
+				resumeSpan = &roachpb.Span{
+					Key: append(roachpb.Key(nil), unsafeKey.Key...), EndKey: endKey,
+				}
+				break
+			}
+			alloc, curKey = alloc.Copy(unsafeKey.Key, 0)
+			keys++
+		}
+		value := roachpb.Value{Timestamp: unsafeKey.Timestamp}
+		if v := iter.UnsafeValue(); len(v) > 0 {
+			alloc, value.RawBytes = alloc.Copy(v, 0)
+		}
+		res = append(res, roachpb.KeyValue{Key: curKey, Value: value})
+	}
+	finishKey()
+
+	if wiErr != nil {
+		return nil, nil, wiErr
+	}
+	return res, resumeSpan, nil
+}
+
 // MVCCResolveWriteIntent either commits or aborts (rolls back) an
 // extant write intent for a given txn according to commit parameter.
 // ResolveWriteIntent will skip write intents of other txns.
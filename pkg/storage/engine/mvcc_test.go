@@ -1700,6 +1700,76 @@ func TestMVCCDeleteRangeReturnKeys(t *testing.T) {
 	}
 }
 
+func TestMVCCDeleteRangeWhere(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	engine := createTestEngine()
+	defer engine.Close()
+
+	ctx := context.Background()
+	for _, kv := range []struct {
+		key   roachpb.Key
+		value roachpb.Value
+		ts    hlc.Timestamp
+	}{
+		{testKey1, value1, hlc.Timestamp{WallTime: 1}},
+		{testKey2, value2, hlc.Timestamp{WallTime: 3}},
+		{testKey3, value3, hlc.Timestamp{WallTime: 1}},
+		{testKey4, value4, hlc.Timestamp{WallTime: 1}},
+		{testKey5, value5, hlc.Timestamp{WallTime: 3}},
+	} {
+		if err := MVCCPut(ctx, engine, nil, kv.key, kv.ts, kv.value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	olderThan := func(kv roachpb.KeyValue) bool {
+		return kv.Value.Timestamp.Less(hlc.Timestamp{WallTime: 2})
+	}
+
+	// Only the matching keys count towards the limit.
+	deleted, resumeSpan, num, err := MVCCDeleteRangeWhere(
+		ctx, engine, nil, keyMin, keyMax, 2, hlc.Timestamp{WallTime: 4}, nil, true, olderThan,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 2 {
+		t.Fatalf("incorrect number of keys deleted: %d", num)
+	}
+	if expected := []roachpb.Key{testKey1, testKey3}; !reflect.DeepEqual(expected, deleted) {
+		t.Fatalf("expected %v to be deleted, found %v", expected, deleted)
+	}
+	if expected := (roachpb.Span{Key: testKey4, EndKey: keyMax}); !resumeSpan.EqualValue(expected) {
+		t.Fatalf("expected = %+v, resumeSpan = %+v", expected, resumeSpan)
+	}
+
+	deleted, resumeSpan, num, err = MVCCDeleteRangeWhere(
+		ctx, engine, nil, resumeSpan.Key, resumeSpan.EndKey, math.MaxInt64, hlc.Timestamp{WallTime: 4},
+		nil, true, olderThan,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 1 {
+		t.Fatalf("incorrect number of keys deleted: %d", num)
+	}
+	if expected := []roachpb.Key{testKey4}; !reflect.DeepEqual(expected, deleted) {
+		t.Fatalf("expected %v to be deleted, found %v", expected, deleted)
+	}
+	if resumeSpan != nil {
+		t.Fatalf("wrong resume key: expected nil, found %v", resumeSpan)
+	}
+
+	kvs, _, _, err := MVCCScan(ctx, engine, keyMin, keyMax, math.MaxInt64, hlc.Timestamp{WallTime: 4}, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 ||
+		!bytes.Equal(kvs[0].Key, testKey2) ||
+		!bytes.Equal(kvs[1].Key, testKey5) {
+		t.Fatalf("unexpected remaining keys: %v", kvs)
+	}
+}
+
 func TestMVCCDeleteRangeFailed(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	engine := createTestEngine()
@@ -1904,7 +1974,7 @@ func TestMVCCConditionalPut(t *testing.T) {
 
 	clock := hlc.NewClock(hlc.NewManualClock(123).UnixNano, time.Nanosecond)
 
-	err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value1, &value2, nil)
+	err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value1, &value2, CPutFailIfMissing, nil)
 	if err == nil {
 		t.Fatal("expected error on key not exists")
 	}
@@ -1918,7 +1988,7 @@ func TestMVCCConditionalPut(t *testing.T) {
 	}
 
 	// Verify the difference between missing value and empty value.
-	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value1, &valueEmpty, nil)
+	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value1, &valueEmpty, CPutFailIfMissing, nil)
 	if err == nil {
 		t.Fatal("expected error on key not exists")
 	}
@@ -1932,13 +2002,13 @@ func TestMVCCConditionalPut(t *testing.T) {
 	}
 
 	// Do a conditional put with expectation that the value is completely missing; will succeed.
-	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value1, nil, nil)
+	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value1, nil, CPutFailIfMissing, nil)
 	if err != nil {
 		t.Fatalf("expected success with condition that key doesn't yet exist: %v", err)
 	}
 
 	// Another conditional put expecting value missing will fail, now that value1 is written.
-	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value1, nil, nil)
+	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value1, nil, CPutFailIfMissing, nil)
 	if err == nil {
 		t.Fatal("expected error on key already exists")
 	}
@@ -1955,7 +2025,7 @@ func TestMVCCConditionalPut(t *testing.T) {
 	}
 
 	// Conditional put expecting wrong value2, will fail.
-	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value1, &value2, nil)
+	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value1, &value2, CPutFailIfMissing, nil)
 	if err == nil {
 		t.Fatal("expected error on key does not match")
 	}
@@ -1973,11 +2043,11 @@ func TestMVCCConditionalPut(t *testing.T) {
 	}
 
 	// Move to an empty value. Will succeed.
-	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), valueEmpty, &value1, nil); err != nil {
+	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), valueEmpty, &value1, CPutFailIfMissing, nil); err != nil {
 		t.Fatal(err)
 	}
 	// Now move to value2 from expected empty value.
-	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value2, &valueEmpty, nil); err != nil {
+	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value2, &valueEmpty, CPutFailIfMissing, nil); err != nil {
 		t.Fatal(err)
 	}
 	// Verify we get value2 as expected.
@@ -1991,6 +2061,56 @@ func TestMVCCConditionalPut(t *testing.T) {
 	}
 }
 
+// TestMVCCConditionalPutAllowIfMissing verifies that a conditional put which
+// allows the key not to exist succeeds if the key is missing or holds the
+// expected value, blindly or not, and fails otherwise.
+func TestMVCCConditionalPutAllowIfMissing(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	engine := createTestEngine()
+	defer engine.Close()
+
+	clock := hlc.NewClock(hlc.NewManualClock(123).UnixNano, time.Nanosecond)
+	ctx := context.Background()
+
+	// The key is missing, so the put succeeds despite expecting value2.
+	if err := MVCCConditionalPut(ctx, engine, nil, testKey1, clock.Now(), value1, &value2, CPutAllowIfMissing, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The key holds value1, so expecting value2 fails.
+	err := MVCCConditionalPut(ctx, engine, nil, testKey1, clock.Now(), value3, &value2, CPutAllowIfMissing, nil)
+	if e, ok := err.(*roachpb.ConditionFailedError); !ok {
+		t.Fatalf("expected a ConditionFailedError, got %v", err)
+	} else if !bytes.Equal(e.ActualValue.RawBytes, value1.RawBytes) {
+		t.Fatalf("expected actual value %s, got %s", value1.RawBytes, e.ActualValue.RawBytes)
+	}
+	// Expecting the key to be missing fails too, since it exists.
+	err = MVCCConditionalPut(ctx, engine, nil, testKey1, clock.Now(), value3, nil, CPutAllowIfMissing, nil)
+	if _, ok := err.(*roachpb.ConditionFailedError); !ok {
+		t.Fatalf("expected a ConditionFailedError, got %v", err)
+	}
+	// Expecting value1 succeeds.
+	if err := MVCCConditionalPut(ctx, engine, nil, testKey1, clock.Now(), value3, &value1, CPutAllowIfMissing, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A blind put to a missing key succeeds, just like a blind InitPut.
+	if err := MVCCBlindConditionalPut(ctx, engine, nil, testKey2, clock.Now(), value1, &value2, CPutAllowIfMissing, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range []struct {
+		key   roachpb.Key
+		value roachpb.Value
+	}{{testKey1, value3}, {testKey2, value1}} {
+		value, _, err := MVCCGet(ctx, engine, kv.key, clock.Now(), true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value.RawBytes, kv.value.RawBytes) {
+			t.Fatalf("%s: expected value %s, got %s", kv.key, kv.value.RawBytes, value.RawBytes)
+		}
+	}
+}
+
 func TestMVCCConditionalPutWithTxn(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	engine := createTestEngine()
@@ -2001,18 +2121,18 @@ func TestMVCCConditionalPutWithTxn(t *testing.T) {
 	// Write value1.
 	txn := *txn1
 	txn.Sequence++
-	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value1, nil, &txn); err != nil {
+	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value1, nil, CPutFailIfMissing, &txn); err != nil {
 		t.Fatal(err)
 	}
 	// Now, overwrite value1 with value2 from same txn; should see value1 as pre-existing value.
 	txn.Sequence++
-	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value2, &value1, &txn); err != nil {
+	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value2, &value1, CPutFailIfMissing, &txn); err != nil {
 		t.Fatal(err)
 	}
 	// Writing value3 from a new epoch should see nil again.
 	txn.Sequence++
 	txn.Epoch = 2
-	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value3, nil, &txn); err != nil {
+	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value3, nil, CPutFailIfMissing, &txn); err != nil {
 		t.Fatal(err)
 	}
 	// Commit value3.
@@ -2023,7 +2143,7 @@ func TestMVCCConditionalPutWithTxn(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Write value4 with an old timestamp without txn...should get a write too old error.
-	err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value4, &value3, nil)
+	err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, clock.Now(), value4, &value3, CPutFailIfMissing, nil)
 	if _, ok := err.(*roachpb.WriteTooOldError); !ok {
 		t.Fatalf("expected write too old error; got %s", err)
 	}
@@ -2192,21 +2312,21 @@ func TestMVCCConditionalPutWriteTooOld(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Try a non-transactional put @t=1ns with expectation of nil; should fail.
-	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, hlc.Timestamp{WallTime: 1}, value2, nil, nil); err == nil {
+	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, hlc.Timestamp{WallTime: 1}, value2, nil, CPutFailIfMissing, nil); err == nil {
 		t.Fatal("expected error on conditional put")
 	}
 	// Now do a non-transactional put @t=1ns with expectation of value1; will succeed @t=10,1.
-	err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, hlc.Timestamp{WallTime: 1}, value2, &value1, nil)
+	err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, hlc.Timestamp{WallTime: 1}, value2, &value1, CPutFailIfMissing, nil)
 	expTS := hlc.Timestamp{WallTime: 10, Logical: 1}
 	if wtoErr, ok := err.(*roachpb.WriteTooOldError); !ok || wtoErr.ActualTimestamp != expTS {
 		t.Fatalf("expected WriteTooOldError with actual time = %s; got %s", expTS, err)
 	}
 	// Try a transactional put @t=1ns with expectation of value2; should fail.
-	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, hlc.Timestamp{WallTime: 1}, value2, &value1, txn1); err == nil {
+	if err := MVCCConditionalPut(context.Background(), engine, nil, testKey1, hlc.Timestamp{WallTime: 1}, value2, &value1, CPutFailIfMissing, txn1); err == nil {
 		t.Fatal("expected error on conditional put")
 	}
 	// Now do a transactional put @t=1ns with expectation of nil; will succeed @t=10,2.
-	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, hlc.Timestamp{WallTime: 1}, value3, nil, txn1)
+	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, hlc.Timestamp{WallTime: 1}, value3, nil, CPutFailIfMissing, txn1)
 	expTS = hlc.Timestamp{WallTime: 10, Logical: 2}
 	if wtoErr, ok := err.(*roachpb.WriteTooOldError); !ok || wtoErr.ActualTimestamp != expTS {
 		t.Fatalf("expected WriteTooOldError with actual time = %s; got %s", expTS, err)
@@ -2247,6 +2367,110 @@ func TestMVCCIncrementWriteTooOld(t *testing.T) {
 
 // TestMVCCReverseScan verifies that MVCCReverseScan scans [start,
 // end) in descending order of keys.
+func TestMVCCScanRevisions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	engine := createTestEngine()
+	defer engine.Close()
+
+	ctx := context.Background()
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	for _, put := range []struct {
+		key   roachpb.Key
+		ts    hlc.Timestamp
+		value roachpb.Value
+		txn   *roachpb.Transaction
+	}{
+		{key: testKey1, ts: ts(1), value: value1},
+		{key: testKey1, ts: ts(2), value: value4},
+		{key: testKey2, ts: ts(1), value: value2},
+		{key: testKey2, ts: ts(3), value: value3},
+		{key: testKey3, ts: ts(5), value: value3},
+		{key: testKey4, ts: ts(3), value: value1, txn: makeTxn(*txn1, ts(3))},
+	} {
+		if err := MVCCPut(ctx, engine, nil, put.key, put.ts, put.value, put.txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := MVCCDelete(ctx, engine, nil, testKey1, ts(4), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A revision is represented by its key, timestamp and value, which is
+	// empty for deletions.
+	type revision struct {
+		key   roachpb.Key
+		ts    hlc.Timestamp
+		value roachpb.Value
+	}
+	testCases := []struct {
+		endKey      roachpb.Key
+		max         int64
+		start, end  hlc.Timestamp
+		expected    []revision
+		txn         *roachpb.Transaction
+		expResume   *roachpb.Span
+		expIntentOn roachpb.Key
+	}{
+		// The intent below the end timestamp is an error.
+		{endKey: testKey5, max: math.MaxInt64, start: ts(1), end: ts(4), expIntentOn: testKey4},
+		// Revisions at or before the start timestamp and after the end
+		// timestamp are omitted.
+		{endKey: testKey4, max: math.MaxInt64, start: ts(1), end: ts(4), expected: []revision{
+			{key: testKey1, ts: ts(2), value: value4},
+			{key: testKey1, ts: ts(4)},
+			{key: testKey2, ts: ts(3), value: value3},
+		}},
+		// The intent after the end timestamp is ignored.
+		{endKey: testKey5, max: math.MaxInt64, start: hlc.Timestamp{}, end: ts(2), expected: []revision{
+			{key: testKey1, ts: ts(1), value: value1},
+			{key: testKey1, ts: ts(2), value: value4},
+			{key: testKey2, ts: ts(1), value: value2},
+		}},
+		// All the revisions of a key are returned at once.
+		{endKey: testKey5, max: 1, start: ts(1), end: ts(5), expected: []revision{
+			{key: testKey1, ts: ts(2), value: value4},
+			{key: testKey1, ts: ts(4)},
+		}, expResume: &roachpb.Span{Key: testKey2, EndKey: testKey5}},
+		{endKey: testKey5, max: 0, start: ts(1), end: ts(5),
+			expResume: &roachpb.Span{Key: testKey1, EndKey: testKey5}},
+		// The intents of the given transaction are ignored, along with their
+		// provisional values.
+		{endKey: testKey5, max: math.MaxInt64, start: ts(3), end: ts(5), txn: txn1, expected: []revision{
+			{key: testKey1, ts: ts(4)},
+			{key: testKey3, ts: ts(5), value: value3},
+		}},
+	}
+	for i, c := range testCases {
+		kvs, resumeSpan, err := MVCCScanRevisions(
+			ctx, engine, testKey1, c.endKey, c.max, c.start, c.end, c.txn,
+		)
+		if c.expIntentOn != nil {
+			wiErr, ok := err.(*roachpb.WriteIntentError)
+			if !ok || len(wiErr.Intents) != 1 || !wiErr.Intents[0].Key.Equal(c.expIntentOn) {
+				t.Fatalf("%d: expected intent on %s, got %v", i, c.expIntentOn, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		var revisions []revision
+		for _, kv := range kvs {
+			r := revision{key: kv.Key, ts: kv.Value.Timestamp}
+			if kv.Value.IsPresent() {
+				r.value.RawBytes = kv.Value.RawBytes
+			}
+			revisions = append(revisions, r)
+		}
+		if !reflect.DeepEqual(revisions, c.expected) {
+			t.Errorf("%d: expected revisions %+v, got %+v", i, c.expected, revisions)
+		}
+		if !reflect.DeepEqual(resumeSpan, c.expResume) {
+			t.Errorf("%d: expected resume span %s, got %s", i, c.expResume, resumeSpan)
+		}
+	}
+}
+
 func TestMVCCReverseScan(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	engine := createTestEngine()
@@ -2452,7 +2676,7 @@ func TestMVCCConditionalPutOldTimestamp(t *testing.T) {
 	}
 
 	// Check nothing is written if the value doesn't match.
-	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, hlc.Timestamp{WallTime: 2}, value3, &value1, nil)
+	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, hlc.Timestamp{WallTime: 2}, value3, &value1, CPutFailIfMissing, nil)
 	if err == nil {
 		t.Errorf("unexpected success on conditional put")
 	}
@@ -2462,7 +2686,7 @@ func TestMVCCConditionalPutOldTimestamp(t *testing.T) {
 
 	// But if value does match the most recently written version, we'll get
 	// a write too old error but still write updated value.
-	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, hlc.Timestamp{WallTime: 2}, value3, &value2, nil)
+	err = MVCCConditionalPut(context.Background(), engine, nil, testKey1, hlc.Timestamp{WallTime: 2}, value3, &value2, CPutFailIfMissing, nil)
 	if err == nil {
 		t.Errorf("unexpected success on conditional put")
 	}
@@ -18,6 +18,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
@@ -149,8 +150,11 @@ func NewNodeLiveness(
 	nl.pauseHeartbeat.Store(false)
 	nl.mu.nodes = map[roachpb.NodeID]Liveness{}
 
-	livenessRegex := gossip.MakePrefixPattern(gossip.KeyNodeLivenessPrefix)
-	nl.gossip.RegisterCallback(livenessRegex, nl.livenessGossipUpdate)
+	nl.gossip.RegisterProtoCallback(gossip.ProtoSubscription{
+		Prefix:          gossip.MakeKeyPrefix(gossip.KeyNodeLivenessPrefix),
+		New:             func() proto.Message { return &Liveness{} },
+		DeliverExisting: true,
+	}, nl.livenessGossipUpdate)
 
 	return nl
 }
@@ -288,6 +292,18 @@ func (nl *NodeLiveness) IsLive(nodeID roachpb.NodeID) (bool, error) {
 	return liveness.IsLive(nl.clock.Now(), nl.clock.MaxOffset()), nil
 }
 
+// IsUnavailable returns whether the specified node is known to be
+// unable to serve requests, i.e. its last liveness update received via
+// gossip shows it draining or no longer live. Nodes for which no liveness
+// record is known aren't considered unavailable.
+func (nl *NodeLiveness) IsUnavailable(nodeID roachpb.NodeID) bool {
+	liveness, err := nl.GetLiveness(nodeID)
+	if err != nil {
+		return false
+	}
+	return liveness.Draining || !liveness.IsLive(nl.clock.Now(), nl.clock.MaxOffset())
+}
+
 // StartHeartbeat starts a periodic heartbeat to refresh this node's
 // last heartbeat in the node liveness table. The optionally provided
 // HeartbeatCallback will be invoked whenever this node updates its own liveness.
@@ -657,12 +673,8 @@ func (nl *NodeLiveness) updateLiveness(
 
 // livenessGossipUpdate is the gossip callback used to keep the
 // in-memory liveness info up to date.
-func (nl *NodeLiveness) livenessGossipUpdate(key string, content roachpb.Value) {
-	var liveness Liveness
-	if err := content.GetProto(&liveness); err != nil {
-		log.Error(context.TODO(), err)
-		return
-	}
+func (nl *NodeLiveness) livenessGossipUpdate(_ string, msg proto.Message) {
+	liveness := *msg.(*Liveness)
 
 	// If there's an existing liveness record, only update the received
 	// timestamp if this is our first receipt of this node's liveness, the
@@ -27,6 +27,7 @@ import (
 
 	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/gogo/protobuf/proto"
 	"github.com/google/btree"
 	"github.com/kr/pretty"
 	"github.com/opentracing/opentracing-go"
@@ -285,6 +286,15 @@ type Replica struct {
 		// the follower to estimate the number of Raft log entries it is
 		// behind. This field is only valid when the Replica is a follower.
 		estimatedCommitIndex uint64
+		// appliedAsOf is the time up to which the follower is known to have
+		// applied the writes committed by the leader. It is advanced to the
+		// time at which pendingCommit was received once its index has been
+		// applied. Used to serve INCONSISTENT reads with a bounded staleness.
+		appliedAsOf   hlc.Timestamp
+		pendingCommit struct {
+			index      uint64
+			receivedAt hlc.Timestamp
+		}
 		// The raft log index of a pending preemptive snapshot. Used to prohibit
 		// raft log truncation while a preemptive snapshot is in flight. A value of
 		// 0 indicates that there is no pending snapshot.
@@ -857,6 +867,52 @@ func (r *Replica) setEstimatedCommitIndexLocked(commit uint64) {
 	}
 }
 
+// recordLeaderCommitLocked records the commit index of a MsgApp from the
+// leader, received at the given time. Once applied, all of the entries the
+// leader had committed by then are known to be applied, which advances
+// appliedAsOf.
+func (r *Replica) recordLeaderCommitLocked(commit uint64, receivedAt hlc.Timestamp) {
+	r.mu.appliedAsOf = r.appliedAsOfRLocked()
+	if r.mu.pendingCommit.index > r.mu.state.RaftAppliedIndex {
+		// Keep waiting for the pending index to be applied, or appliedAsOf
+		// would never advance while writes keep coming in.
+		return
+	}
+	r.mu.pendingCommit.index = commit
+	r.mu.pendingCommit.receivedAt = receivedAt
+}
+
+// appliedAsOfRLocked returns the time up to which the replica is known to
+// have applied the writes committed by the leader.
+func (r *Replica) appliedAsOfRLocked() hlc.Timestamp {
+	appliedAsOf := r.mu.appliedAsOf
+	if pending := r.mu.pendingCommit; pending.index != 0 &&
+		pending.index <= r.mu.state.RaftAppliedIndex {
+		appliedAsOf.Forward(pending.receivedAt)
+	}
+	return appliedAsOf
+}
+
+// checkStalenessBound returns a NotLeaseHolderError redirecting an
+// INCONSISTENT read at the given timestamp to the lease holder if the
+// replica isn't known to have applied the writes of the range up to that
+// timestamp. The lease holder and quiescent replicas are up to date.
+//
+// Note that the bound is approximate: the writes which the leader committed
+// while the messages to this replica were in flight may be missing.
+func (r *Replica) checkStalenessBound(ts hlc.Timestamp) *roachpb.Error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.mu.quiescent || !r.appliedAsOfRLocked().Less(ts) {
+		return nil
+	}
+	lease := *r.mu.state.Lease
+	if lease.OwnedBy(r.store.StoreID()) && r.isLeaseValidRLocked(lease, r.store.Clock().Now()) {
+		return nil
+	}
+	return roachpb.NewError(newNotLeaseHolderError(&lease, r.store.StoreID(), r.mu.state.Desc))
+}
+
 func (r *Replica) maybeAcquireProposalQuota(ctx context.Context, quota int64) error {
 	r.mu.RLock()
 	quotaPool := r.mu.proposalQuota
@@ -1435,7 +1491,13 @@ func (r *Replica) setDesc(desc *roachpb.RangeDescriptor) error {
 		// r.rm is null in some tests.
 		return nil
 	}
-	return r.store.processRangeDescriptorUpdate(r.AnnotateCtx(context.TODO()), r)
+	ctx := r.AnnotateCtx(context.TODO())
+	// The gossiped descriptor of a system range must follow splits and
+	// replication changes.
+	if err := r.maybeGossipSystemRangeLeaseHolder(ctx); err != nil {
+		log.Error(ctx, err)
+	}
+	return r.store.processRangeDescriptorUpdate(ctx, r)
 }
 
 // setDescWithoutProcessUpdate updates the range descriptor without calling
@@ -1785,6 +1847,9 @@ func (r *Replica) checkBatchRequest(ba roachpb.BatchRequest) error {
 	} else if ba.ReadConsistency == roachpb.INCONSISTENT {
 		return errors.Errorf("inconsistent mode is only available to reads")
 	}
+	if ba.MaxStalenessNanos != 0 && ba.ReadConsistency != roachpb.INCONSISTENT {
+		return errors.Errorf("max staleness is only available to inconsistent reads")
+	}
 
 	return nil
 }
@@ -2361,6 +2426,10 @@ func (r *Replica) executeReadOnlyBatch(
 		if _, pErr = r.redirectOnOrAcquireLease(ctx); pErr != nil {
 			return nil, pErr
 		}
+	} else if ba.MaxStalenessNanos != 0 {
+		if pErr = r.checkStalenessBound(ba.Timestamp); pErr != nil {
+			return nil, pErr
+		}
 	}
 
 	spans, err := collectSpans(*r.Desc(), &ba)
@@ -2937,6 +3006,23 @@ func (r *Replica) propose(
 		delete(r.mu.proposals, proposal.idKey)
 		return nil, nil, undoQuotaAcquisition, roachpb.NewError(err)
 	}
+	if ba.AsyncConsensus && ba.Txn != nil && ba.IsAsyncConsensusCandidate() &&
+		proposal.Local.Err == nil && proposal.Local.Reply != nil {
+		// The writes are acknowledged without waiting for the command to be
+		// applied; the client will prove them before relying on them. The
+		// command stays in the command queue until it applies, so overlapping
+		// commands (including the proofs) wait for it. If it fails to apply
+		// (for instance because it would have had to be reevaluated), the
+		// proofs fail and the transaction restarts. The proposal must not
+		// hold on to the client's context, which may go away in the meantime.
+		proposal.ctx = r.AnnotateCtx(context.TODO())
+		ch := make(chan proposalResult, 1)
+		ch <- proposalResult{
+			Reply: protoutil.Clone(proposal.Local.Reply).(*roachpb.BatchResponse),
+		}
+		close(ch)
+		return ch, func() bool { return false }, undoQuotaAcquisition, nil
+	}
 	// Must not use `proposal` in the closure below as a proposal which is not
 	// present in r.mu.proposals is no longer protected by the mutex. Abandoning
 	// a command only abandons the associated context. As soon as we propose a
@@ -5153,6 +5239,37 @@ func (r *Replica) maybeGossipNodeLiveness(ctx context.Context, span roachpb.Span
 	return nil
 }
 
+// maybeGossipSystemRangeLeaseHolder gossips the descriptor of the range along
+// with its lease holder if the range contains system data (meta, node
+// liveness or system config keys) and this replica holds the lease, so that
+// nodes route requests for that data to the lease holder from the start.
+func (r *Replica) maybeGossipSystemRangeLeaseHolder(ctx context.Context) error {
+	if r.store.Gossip() == nil || !r.IsInitialized() {
+		return nil
+	}
+	desc := r.Desc()
+	if !desc.StartKey.Less(roachpb.RKey(keys.SystemConfigTableDataMax)) || !r.shouldGossip() {
+		return nil
+	}
+	repDesc, err := r.GetReplicaDescriptor()
+	if err != nil {
+		return err
+	}
+	leaseHolder := gossip.SystemRangeLeaseHolder{Desc: *desc, LeaseHolder: repDesc}
+	key := gossip.MakeSystemRangeLeaseHolderKey(desc.RangeID)
+	// Look up the lease holder from gossip; skip gossiping anew if unchanged.
+	var gossipLeaseHolder gossip.SystemRangeLeaseHolder
+	if err := r.store.Gossip().GetInfoProto(key, &gossipLeaseHolder); err == nil &&
+		proto.Equal(&gossipLeaseHolder, &leaseHolder) {
+		return nil
+	}
+	log.VEventf(ctx, 2, "gossiping lease holder of system range")
+	if err := r.store.Gossip().AddInfoProto(key, &leaseHolder, 0); err != nil {
+		return errors.Wrap(err, "failed to gossip system range lease holder")
+	}
+	return nil
+}
+
 // NewReplicaCorruptionError creates a new error indicating a corrupt replica,
 // with the supplied list of errors given as history.
 func NewReplicaCorruptionError(err error) *roachpb.ReplicaCorruptionError {
@@ -117,8 +117,13 @@ var commands = map[roachpb.Method]Command{
 	roachpb.Increment:          {DeclareKeys: DefaultDeclareKeys, Eval: evalIncrement},
 	roachpb.Delete:             {DeclareKeys: DefaultDeclareKeys, Eval: evalDelete},
 	roachpb.DeleteRange:        {DeclareKeys: DefaultDeclareKeys, Eval: evalDeleteRange},
+	roachpb.DeleteRangeWhere:   {DeclareKeys: DefaultDeclareKeys, Eval: evalDeleteRangeWhere},
 	roachpb.Scan:               {DeclareKeys: DefaultDeclareKeys, Eval: evalScan},
 	roachpb.ReverseScan:        {DeclareKeys: DefaultDeclareKeys, Eval: evalReverseScan},
+	roachpb.PollChanges:        {DeclareKeys: DefaultDeclareKeys, Eval: evalPollChanges},
+	roachpb.Refresh:            {DeclareKeys: DefaultDeclareKeys, Eval: evalRefresh},
+	roachpb.RefreshRange:       {DeclareKeys: DefaultDeclareKeys, Eval: evalRefreshRange},
+	roachpb.QueryIntent:        {DeclareKeys: DefaultDeclareKeys, Eval: evalQueryIntent},
 	roachpb.BeginTransaction:   {DeclareKeys: declareKeysBeginTransaction, Eval: evalBeginTransaction},
 	roachpb.EndTransaction:     {DeclareKeys: declareKeysEndTransaction, Eval: evalEndTransaction},
 	roachpb.RangeLookup:        {DeclareKeys: declareKeysRangeLookup, Eval: evalRangeLookup},
@@ -297,8 +302,8 @@ func evalPut(
 }
 
 // evalConditionalPut sets the value for a specified key only if
-// the expected value matches. If not, the return value contains
-// the actual value.
+// the expected value matches, or if the key doesn't exist and the request
+// allows it. If not, the return value contains the actual value.
 func evalConditionalPut(
 	ctx context.Context, batch engine.ReadWriter, cArgs CommandArgs, resp roachpb.Response,
 ) (EvalResult, error) {
@@ -314,10 +319,11 @@ func evalConditionalPut(
 			defer batch.Close()
 		}
 	}
+	allowIfDoesNotExist := engine.CPutMissingBehavior(args.AllowIfDoesNotExist)
 	if args.Blind {
-		return EvalResult{}, engine.MVCCBlindConditionalPut(ctx, batch, cArgs.Stats, args.Key, h.Timestamp, args.Value, args.ExpValue, h.Txn)
+		return EvalResult{}, engine.MVCCBlindConditionalPut(ctx, batch, cArgs.Stats, args.Key, h.Timestamp, args.Value, args.ExpValue, allowIfDoesNotExist, h.Txn)
 	}
-	return EvalResult{}, engine.MVCCConditionalPut(ctx, batch, cArgs.Stats, args.Key, h.Timestamp, args.Value, args.ExpValue, h.Txn)
+	return EvalResult{}, engine.MVCCConditionalPut(ctx, batch, cArgs.Stats, args.Key, h.Timestamp, args.Value, args.ExpValue, allowIfDoesNotExist, h.Txn)
 }
 
 // evalInitPut sets the value for a specified key only if it doesn't exist. It
@@ -400,6 +406,37 @@ func evalDeleteRange(
 	return EvalResult{}, err
 }
 
+// evalDeleteRangeWhere deletes the keys between the start and end keys whose
+// latest value satisfies the predicate of the request.
+func evalDeleteRangeWhere(
+	ctx context.Context, batch engine.ReadWriter, cArgs CommandArgs, resp roachpb.Response,
+) (EvalResult, error) {
+	args := cArgs.Args.(*roachpb.DeleteRangeWhereRequest)
+	h := cArgs.Header
+	reply := resp.(*roachpb.DeleteRangeWhereResponse)
+
+	if h.Txn != nil {
+		return EvalResult{}, errors.New("DeleteRangeWhere cannot be used in a transaction")
+	}
+	pred := func(kv roachpb.KeyValue) bool {
+		if olderThan := args.Predicate.OlderThan; olderThan != (hlc.Timestamp{}) &&
+			!kv.Value.Timestamp.Less(olderThan) {
+			return false
+		}
+		return true
+	}
+	deleted, resumeSpan, num, err := engine.MVCCDeleteRangeWhere(
+		ctx, batch, cArgs.Stats, args.Key, args.EndKey, cArgs.MaxKeys, h.Timestamp, nil, /* txn */
+		args.ReturnKeys, pred,
+	)
+	if err == nil {
+		reply.Keys = deleted
+	}
+	reply.NumKeys = num
+	reply.ResumeSpan = resumeSpan
+	return EvalResult{}, err
+}
+
 // evalScan scans the key range specified by start key through end key
 // in ascending order up to some maximum number of results. maxKeys
 // stores the number of scan results remaining for this batch
@@ -440,6 +477,108 @@ func evalReverseScan(
 	return intentsToEvalResult(intents, args, true /* alwaysReturn */), err
 }
 
+// evalPollChanges returns the revisions written to the keys in the span of
+// the request after its start time and at or before the timestamp of the
+// batch, for up to maxKeys keys (MaxInt64 for no limit).
+func evalPollChanges(
+	ctx context.Context, batch engine.ReadWriter, cArgs CommandArgs, resp roachpb.Response,
+) (EvalResult, error) {
+	args := cArgs.Args.(*roachpb.PollChangesRequest)
+	h := cArgs.Header
+	reply := resp.(*roachpb.PollChangesResponse)
+
+	if h.Txn != nil {
+		return EvalResult{}, errors.Errorf("%s cannot be used in a transaction", args.Method())
+	}
+	revisions, resumeSpan, err := engine.MVCCScanRevisions(ctx, batch, args.Key, args.EndKey,
+		cArgs.MaxKeys, args.StartTime, h.Timestamp, nil /* txn */)
+	if err != nil {
+		return EvalResult{}, err
+	}
+
+	for i := range revisions {
+		if i == 0 || !revisions[i].Key.Equal(revisions[i-1].Key) {
+			reply.NumKeys++
+		}
+	}
+	reply.ResumeSpan = resumeSpan
+	reply.Revisions = revisions
+	return EvalResult{}, nil
+}
+
+// evalRefresh checks that the key of the request hasn't been written to
+// since the original timestamp of the transaction, up to the timestamp of the
+// batch.
+func evalRefresh(
+	ctx context.Context, batch engine.ReadWriter, cArgs CommandArgs, resp roachpb.Response,
+) (EvalResult, error) {
+	args := cArgs.Args.(*roachpb.RefreshRequest)
+	return EvalResult{}, refreshSpan(ctx, batch, cArgs.Header, args, args.Key, args.Key.Next())
+}
+
+// evalRefreshRange checks that the keys in the span of the request haven't
+// been written to since the original timestamp of the transaction, up to the
+// timestamp of the batch.
+func evalRefreshRange(
+	ctx context.Context, batch engine.ReadWriter, cArgs CommandArgs, resp roachpb.Response,
+) (EvalResult, error) {
+	args := cArgs.Args.(*roachpb.RefreshRangeRequest)
+	return EvalResult{}, refreshSpan(ctx, batch, cArgs.Header, args, args.Key, args.EndKey)
+}
+
+// refreshSpan returns an error if a revision was written to the keys in
+// [key,endKey) after the original timestamp of the transaction and at or
+// before the timestamp of the batch, or if an intent of another transaction
+// is found at or below the timestamp of the batch.
+func refreshSpan(
+	ctx context.Context,
+	batch engine.Reader,
+	h roachpb.Header,
+	args roachpb.Request,
+	key, endKey roachpb.Key,
+) error {
+	if h.Txn == nil {
+		return errors.Errorf("no transaction specified to %s", args.Method())
+	}
+	revisions, _, err := engine.MVCCScanRevisions(
+		ctx, batch, key, endKey, 1 /* max */, h.Txn.OrigTimestamp, h.Timestamp, h.Txn,
+	)
+	if wiErr, ok := err.(*roachpb.WriteIntentError); ok {
+		intent := wiErr.Intents[0]
+		return errors.Errorf("encountered recently written intent %s @%s",
+			intent.Key, intent.Txn.Timestamp)
+	} else if err != nil {
+		return err
+	}
+	if len(revisions) > 0 {
+		return errors.Errorf("encountered recently written key %s @%s",
+			revisions[0].Key, revisions[0].Value.Timestamp)
+	}
+	return nil
+}
+
+// evalQueryIntent checks whether the intent at the key of the request was
+// written by the transaction of the request, in its epoch and with at least
+// its sequence number. Since the key is declared for reading, the request
+// waits for the commands writing the key to be applied.
+func evalQueryIntent(
+	ctx context.Context, batch engine.ReadWriter, cArgs CommandArgs, resp roachpb.Response,
+) (EvalResult, error) {
+	args := cArgs.Args.(*roachpb.QueryIntentRequest)
+	reply := resp.(*roachpb.QueryIntentResponse)
+
+	var meta enginepb.MVCCMetadata
+	ok, _, _, err := batch.GetProto(engine.MakeMVCCMetadataKey(args.Key), &meta)
+	if err != nil {
+		return EvalResult{}, err
+	}
+	reply.FoundIntent = ok && meta.Txn != nil &&
+		meta.Txn.ID == args.Txn.ID &&
+		meta.Txn.Epoch == args.Txn.Epoch &&
+		meta.Txn.Sequence >= args.Txn.Sequence
+	return EvalResult{}, nil
+}
+
 func verifyTransaction(h roachpb.Header, args roachpb.Request) error {
 	if h.Txn == nil {
 		return errors.Errorf("no transaction specified to %s", args.Method())
@@ -1387,6 +1526,11 @@ func declareKeysHeartbeatTransaction(
 			Key: keys.AbortCacheKey(header.RangeID, header.Txn.ID),
 		})
 	}
+	if hb := req.(*roachpb.HeartbeatTxnRequest); hb.Txn != nil {
+		spans.Add(SpanReadWrite, roachpb.Span{
+			Key: keys.TransactionKey(hb.Key, hb.Txn.ID),
+		})
+	}
 }
 
 // evalHeartbeatTxn updates the transaction status and heartbeat
@@ -1399,11 +1543,25 @@ func evalHeartbeatTxn(
 	h := cArgs.Header
 	reply := resp.(*roachpb.HeartbeatTxnResponse)
 
-	if err := verifyTransaction(h, args); err != nil {
-		return EvalResult{}, err
+	// A heartbeat is either sent as part of the transaction it heartbeats, or
+	// outside of a transaction along with the heartbeats of others.
+	var txnMeta *enginepb.TxnMeta
+	if args.Txn != nil {
+		if h.Txn != nil {
+			return EvalResult{}, errors.New("HeartbeatTxn specifying a transaction must not be sent in one")
+		}
+		if !args.Key.Equal(args.Txn.Key) {
+			return EvalResult{}, errors.Errorf("request key %s should match txn key %s", args.Key, args.Txn.Key)
+		}
+		txnMeta = args.Txn
+	} else {
+		if err := verifyTransaction(h, args); err != nil {
+			return EvalResult{}, err
+		}
+		txnMeta = &h.Txn.TxnMeta
 	}
 
-	key := keys.TransactionKey(h.Txn.Key, h.Txn.ID)
+	key := keys.TransactionKey(txnMeta.Key, txnMeta.ID)
 
 	var txn roachpb.Transaction
 	if ok, err := engine.MVCCGetProto(ctx, batch, key, hlc.Timestamp{}, true, nil, &txn); err != nil {
@@ -1413,6 +1571,11 @@ func evalHeartbeatTxn(
 		// This could mean the heartbeat is a delayed relic or it could
 		// mean that the BeginTransaction call was delayed. In either
 		// case, there's no reason to persist a new transaction record.
+		if args.Txn != nil {
+			// Don't fail the heartbeats of the other transactions in the
+			// batch; the coordinator notices the missing record instead.
+			return EvalResult{}, nil
+		}
 		return EvalResult{}, errors.Errorf("heartbeat for transaction %s failed; record not present", h.Txn)
 	}
 
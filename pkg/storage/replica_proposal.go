@@ -540,6 +540,9 @@ func (r *Replica) leasePostApply(ctx context.Context, newLease roachpb.Lease) {
 		if err := r.maybeGossipNodeLiveness(ctx, keys.NodeLivenessSpan); err != nil {
 			log.Error(ctx, err)
 		}
+		if err := r.maybeGossipSystemRangeLeaseHolder(ctx); err != nil {
+			log.Error(ctx, err)
+		}
 		// Make sure the push transaction queue is enabled.
 		r.pushTxnQueue.Enable()
 	}
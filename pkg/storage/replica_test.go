@@ -3469,6 +3469,106 @@ func TestEndTransactionAfterHeartbeat(t *testing.T) {
 	}
 }
 
+// TestReplicaCoalescedHeartbeats verifies that the heartbeats of several
+// transactions can be sent in a single non-transactional batch, and that a
+// missing transaction record doesn't fail the heartbeats of the others.
+func TestReplicaCoalescedHeartbeats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	var txns []*roachpb.Transaction
+	for _, key := range []roachpb.Key{roachpb.Key("a"), roachpb.Key("b")} {
+		txn := newTransaction("test", key, 1, enginepb.SERIALIZABLE, tc.Clock())
+		_, btH := beginTxnArgs(key, txn)
+		put := putArgs(key, key)
+		if _, pErr := maybeWrapWithBeginTransaction(context.Background(), tc.Sender(), btH, &put); pErr != nil {
+			t.Fatal(pErr)
+		}
+		txns = append(txns, txn)
+	}
+	// The record of this transaction was never written.
+	txns = append(txns, newTransaction("test", roachpb.Key("c"), 1, enginepb.SERIALIZABLE, tc.Clock()))
+
+	now := tc.Clock().Now()
+	ba := roachpb.BatchRequest{}
+	ba.Timestamp = now
+	for _, txn := range txns {
+		hb, _ := heartbeatArgs(txn, now)
+		hb.Txn = &txn.TxnMeta
+		ba.Add(&hb)
+	}
+	br, pErr := tc.Sender().Send(context.Background(), ba)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	for i, txn := range txns {
+		respTxn := br.Responses[i].GetInner().(*roachpb.HeartbeatTxnResponse).Txn
+		if i == len(txns)-1 {
+			if respTxn != nil {
+				t.Errorf("%d: expected no transaction, got %s", i, respTxn)
+			}
+			continue
+		}
+		if respTxn == nil || respTxn.ID != txn.ID {
+			t.Fatalf("%d: expected transaction %s, got %v", i, txn.ID, respTxn)
+		}
+		if respTxn.Status != roachpb.PENDING || respTxn.LastHeartbeat != now {
+			t.Errorf("%d: expected pending transaction heartbeated at %s, got %s", i, now, respTxn)
+		}
+	}
+
+	// The transaction can't be specified by both the batch and the request.
+	hb, h := heartbeatArgs(txns[0], now)
+	hb.Txn = &txns[0].TxnMeta
+	if _, pErr := tc.SendWrappedWith(h, &hb); !testutils.IsPError(pErr, "must not be sent in one") {
+		t.Fatalf("unexpected error: %v", pErr)
+	}
+}
+
+// TestReplicaAppliedAsOf verifies that the time up to which a follower has
+// applied the writes of the range advances as the commit indexes received
+// from the leader are applied, and that the lease holder serves reads with a
+// bounded staleness regardless.
+func TestReplicaAppliedAsOf(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var r Replica
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	for i, step := range []struct {
+		applied        uint64
+		commit         uint64
+		receivedAt     hlc.Timestamp
+		expAppliedAsOf hlc.Timestamp
+	}{
+		// The commit index hasn't been applied yet.
+		{applied: 5, commit: 10, receivedAt: ts(1), expAppliedAsOf: hlc.Timestamp{}},
+		// Newer commit indexes are ignored until the pending one is applied.
+		{applied: 8, commit: 12, receivedAt: ts(2), expAppliedAsOf: hlc.Timestamp{}},
+		{applied: 10, expAppliedAsOf: ts(1)},
+		{applied: 10, commit: 14, receivedAt: ts(3), expAppliedAsOf: ts(1)},
+		{applied: 14, expAppliedAsOf: ts(3)},
+	} {
+		r.mu.state.RaftAppliedIndex = step.applied
+		if step.commit != 0 {
+			r.recordLeaderCommitLocked(step.commit, step.receivedAt)
+		}
+		if appliedAsOf := r.appliedAsOfRLocked(); appliedAsOf != step.expAppliedAsOf {
+			t.Errorf("%d: expected applied as of %s, got %s", i, step.expAppliedAsOf, appliedAsOf)
+		}
+	}
+
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+	if pErr := tc.repl.checkStalenessBound(tc.Clock().Now()); pErr != nil {
+		t.Fatalf("expected the lease holder to serve the read, got %s", pErr)
+	}
+}
+
 // TestEndTransactionWithPushedTimestamp verifies that txn can be
 // ended (both commit or abort) correctly when the commit timestamp is
 // greater than the transaction timestamp, depending on the isolation
@@ -8148,3 +8248,121 @@ func TestErrorInRaftApplicationClearsIntents(t *testing.T) {
 		t.Fatal("expected intents to have been cleared")
 	}
 }
+
+// TestReplicaAsyncConsensus verifies that transactional writes sent with
+// AsyncConsensus are acknowledged before they are applied, and that
+// QueryIntent waits for them to be applied to find out whether they were
+// carried out.
+func TestReplicaAsyncConsensus(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	keyA, keyB := roachpb.Key("a"), roachpb.Key("b")
+
+	var asyncCmdID atomic.Value
+	applyBlocked := make(chan struct{}, 1)
+	unblockApply := make(chan struct{})
+	tc := testContext{}
+	tsc := TestStoreConfig(nil)
+	tsc.TestingKnobs.TestingEvalFilter =
+		func(filterArgs storagebase.FilterArgs) *roachpb.Error {
+			if filterArgs.Hdr.AsyncConsensus {
+				asyncCmdID.Store(filterArgs.CmdID)
+			}
+			return nil
+		}
+	// The write sent with AsyncConsensus fails to apply once unblocked.
+	tsc.TestingKnobs.TestingApplyFilter =
+		func(filterArgs storagebase.ApplyFilterArgs) *roachpb.Error {
+			if id, ok := asyncCmdID.Load().(storagebase.CmdIDKey); ok && id == filterArgs.CmdID {
+				select {
+				case applyBlocked <- struct{}{}:
+				default:
+				}
+				<-unblockApply
+				return roachpb.NewErrorf("boom")
+			}
+			return nil
+		}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.StartWithStoreConfig(t, stopper, tsc)
+
+	txn := newTransaction("test", keyA, 1, enginepb.SERIALIZABLE, tc.Clock())
+	txn.Sequence = 1
+	btArgs, h := beginTxnArgs(keyA, txn)
+	pArgs := putArgs(keyA, []byte("value"))
+	var ba roachpb.BatchRequest
+	ba.Header = h
+	ba.Add(&btArgs, &pArgs)
+	br, pErr := tc.Sender().Send(context.Background(), ba)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	txn.Update(br.Txn)
+
+	// The write of b is acknowledged while its application is blocked.
+	txn.Sequence++
+	putDone := make(chan *roachpb.Error, 1)
+	go func() {
+		pArgs := putArgs(keyB, []byte("value"))
+		_, pErr := tc.SendWrappedWith(roachpb.Header{Txn: txn, AsyncConsensus: true}, &pArgs)
+		putDone <- pErr
+	}()
+	<-applyBlocked
+	select {
+	case pErr := <-putDone:
+		if pErr != nil {
+			t.Fatal(pErr)
+		}
+	case <-time.After(testutils.DefaultSucceedsSoonDuration):
+		t.Fatal("write wasn't acknowledged before being applied")
+	}
+
+	queryIntent := func(key roachpb.Key, seq int32) (bool, *roachpb.Error) {
+		txnMeta := txn.TxnMeta
+		txnMeta.Sequence = seq
+		qiArgs := roachpb.QueryIntentRequest{Span: roachpb.Span{Key: key}, Txn: txnMeta}
+		reply, pErr := tc.SendWrappedWith(roachpb.Header{Txn: txn}, &qiArgs)
+		if pErr != nil {
+			return false, pErr
+		}
+		return reply.(*roachpb.QueryIntentResponse).FoundIntent, nil
+	}
+
+	// Proving the write of b waits for its application, which fails.
+	type queryResult struct {
+		found bool
+		pErr  *roachpb.Error
+	}
+	queryDone := make(chan queryResult, 1)
+	go func() {
+		found, pErr := queryIntent(keyB, txn.Sequence)
+		queryDone <- queryResult{found, pErr}
+	}()
+	select {
+	case <-queryDone:
+		t.Fatal("query didn't wait for the write to be applied")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(unblockApply)
+	if res := <-queryDone; res.pErr != nil {
+		t.Fatal(res.pErr)
+	} else if res.found {
+		t.Errorf("expected the intent at %s not to be found", keyB)
+	}
+
+	// The intent at a is found for the sequence number which wrote it, but not
+	// for later ones.
+	for _, c := range []struct {
+		seq   int32
+		found bool
+	}{
+		{1, true},
+		{2, false},
+	} {
+		if found, pErr := queryIntent(keyA, c.seq); pErr != nil {
+			t.Fatal(pErr)
+		} else if found != c.found {
+			t.Errorf("seq %d: expected found=%t, got %t", c.seq, c.found, found)
+		}
+	}
+}
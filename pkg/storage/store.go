@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -27,6 +28,7 @@ import (
 
 	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/elastic/gosigar"
 	"github.com/google/btree"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
@@ -363,6 +365,15 @@ type Store struct {
 	// the most recently gossiped value so that we can tell if a newly measured
 	// value differs by enough to justify re-gossiping the store.
 	gossipWritesPerSecondVal syncutil.AtomicFloat64
+	// cpuSample is the CPU time used by the process as of the previous
+	// computation of the store's capacity, from which the CPU usage gossiped
+	// along with the capacity is derived.
+	cpuSample struct {
+		syncutil.Mutex
+		at        time.Time
+		cpuTime   time.Duration
+		perSecond float64
+	}
 
 	coalescedMu struct {
 		syncutil.Mutex
@@ -2268,13 +2279,18 @@ func (s *Store) Capacity() (roachpb.StoreCapacity, error) {
 
 	now := s.cfg.Clock.Now()
 	var leaseCount int32
-	var totalWritesPerSecond float64
+	var totalWritesPerSecond, totalQueriesPerSecond float64
 	bytesPerReplica := make([]float64, 0, capacity.RangeCount)
 	writesPerReplica := make([]float64, 0, capacity.RangeCount)
 	newStoreReplicaVisitor(s).Visit(func(r *Replica) bool {
 		if r.ownsValidLease(now) {
 			leaseCount++
 		}
+		if r.leaseholderStats != nil {
+			if qps, dur := r.leaseholderStats.avgQPS(); dur >= MinStatsDuration {
+				totalQueriesPerSecond += qps
+			}
+		}
 		bytesPerReplica = append(bytesPerReplica, float64(r.GetMVCCStats().LiveBytes))
 		// TODO(a-robinson): How dangerous is it that this number will be incorrectly
 		// low the first time or two it gets gossiped when a store starts? We can't
@@ -2287,6 +2303,8 @@ func (s *Store) Capacity() (roachpb.StoreCapacity, error) {
 	})
 	capacity.LeaseCount = leaseCount
 	capacity.WritesPerSecond = totalWritesPerSecond
+	capacity.QueriesPerSecond = totalQueriesPerSecond
+	capacity.CpuPerSecond = s.cpuPerSecond()
 	capacity.BytesPerReplica = roachpb.PercentilesFromData(bytesPerReplica)
 	capacity.WritesPerReplica = roachpb.PercentilesFromData(writesPerReplica)
 	s.recordNewWritesPerSecond(totalWritesPerSecond)
@@ -2294,6 +2312,30 @@ func (s *Store) Capacity() (roachpb.StoreCapacity, error) {
 	return capacity, nil
 }
 
+// cpuPerSecond returns the number of CPU seconds used per second by the
+// process since the previous call. The previous value is returned if it was
+// computed too recently to be meaningful, and zero if the CPU time of the
+// process can't be retrieved on this platform.
+func (s *Store) cpuPerSecond() float64 {
+	cpu := gosigar.ProcTime{}
+	if err := cpu.Get(os.Getpid()); err != nil {
+		return 0
+	}
+	cpuTime := time.Duration(cpu.User+cpu.Sys) * time.Millisecond
+	now := timeutil.Now()
+
+	s.cpuSample.Lock()
+	defer s.cpuSample.Unlock()
+	if elapsed := now.Sub(s.cpuSample.at); elapsed >= time.Second {
+		if !s.cpuSample.at.IsZero() {
+			s.cpuSample.perSecond = (cpuTime - s.cpuSample.cpuTime).Seconds() / elapsed.Seconds()
+		}
+		s.cpuSample.at = now
+		s.cpuSample.cpuTime = cpuTime
+	}
+	return s.cpuSample.perSecond
+}
+
 // ReplicaCount returns the number of replicas contained by this store. This
 // method is O(n) in the number of replicas and should not be called from
 // performance critical code.
@@ -3142,6 +3184,7 @@ func (s *Store) processRaftRequest(
 		r.unquiesceLocked()
 		if req.Message.Type == raftpb.MsgApp {
 			r.setEstimatedCommitIndexLocked(req.Message.Commit)
+			r.recordLeaderCommitLocked(req.Message.Commit, s.Clock().Now())
 		}
 		return false, /* !unquiesceAndWakeLeader */
 			raftGroup.Step(req.Message)
@@ -20,6 +20,7 @@ import (
 	"sort"
 	"time"
 
+	"github.com/gogo/protobuf/proto"
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/config"
@@ -229,10 +230,16 @@ func NewStorePool(
 	sp.detailsMu.storeDetails = make(map[roachpb.StoreID]*storeDetail)
 	sp.localitiesMu.nodeLocalities = make(map[roachpb.NodeID]localityWithString)
 
-	storeRegex := gossip.MakePrefixPattern(gossip.KeyStorePrefix)
-	g.RegisterCallback(storeRegex, sp.storeGossipUpdate)
-	deadReplicasRegex := gossip.MakePrefixPattern(gossip.KeyDeadReplicasPrefix)
-	g.RegisterCallback(deadReplicasRegex, sp.deadReplicasGossipUpdate)
+	g.RegisterProtoCallback(gossip.ProtoSubscription{
+		Prefix:          gossip.MakeKeyPrefix(gossip.KeyStorePrefix),
+		New:             func() proto.Message { return &roachpb.StoreDescriptor{} },
+		DeliverExisting: true,
+	}, sp.storeGossipUpdate)
+	g.RegisterProtoCallback(gossip.ProtoSubscription{
+		Prefix:          gossip.MakeKeyPrefix(gossip.KeyDeadReplicasPrefix),
+		New:             func() proto.Message { return &roachpb.StoreDeadReplicas{} },
+		DeliverExisting: true,
+	}, sp.deadReplicasGossipUpdate)
 
 	return sp
 }
@@ -269,17 +276,12 @@ func (sp *StorePool) String() string {
 }
 
 // storeGossipUpdate is the gossip callback used to keep the StorePool up to date.
-func (sp *StorePool) storeGossipUpdate(_ string, content roachpb.Value) {
-	var storeDesc roachpb.StoreDescriptor
-	if err := content.GetProto(&storeDesc); err != nil {
-		ctx := sp.AnnotateCtx(context.TODO())
-		log.Error(ctx, err)
-		return
-	}
+func (sp *StorePool) storeGossipUpdate(_ string, msg proto.Message) {
+	storeDesc := msg.(*roachpb.StoreDescriptor)
 
 	sp.detailsMu.Lock()
 	detail := sp.getStoreDetailLocked(storeDesc.StoreID)
-	detail.desc = &storeDesc
+	detail.desc = storeDesc
 	detail.lastUpdatedTime = sp.clock.PhysicalTime()
 	sp.detailsMu.Unlock()
 
@@ -290,13 +292,8 @@ func (sp *StorePool) storeGossipUpdate(_ string, content roachpb.Value) {
 }
 
 // deadReplicasGossipUpdate is the gossip callback used to keep the StorePool up to date.
-func (sp *StorePool) deadReplicasGossipUpdate(_ string, content roachpb.Value) {
-	var replicas roachpb.StoreDeadReplicas
-	if err := content.GetProto(&replicas); err != nil {
-		ctx := sp.AnnotateCtx(context.TODO())
-		log.Error(ctx, err)
-		return
-	}
+func (sp *StorePool) deadReplicasGossipUpdate(_ string, msg proto.Message) {
+	replicas := msg.(*roachpb.StoreDeadReplicas)
 
 	sp.detailsMu.Lock()
 	defer sp.detailsMu.Unlock()
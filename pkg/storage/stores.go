@@ -300,7 +300,8 @@ func (ls *Stores) ReadBootstrapInfo(bi *gossip.BootstrapInfo) error {
 	if err != nil {
 		return err
 	}
-	log.Infof(ctx, "read %d node addresses from persistent storage", len(bi.Addresses))
+	log.Infof(ctx, "read %d node addresses and %d gossip infos from persistent storage",
+		len(bi.Addresses), len(bi.Infos))
 
 	ls.mu.Lock()
 	defer ls.mu.Unlock()
@@ -319,7 +320,8 @@ func (ls *Stores) WriteBootstrapInfo(bi *gossip.BootstrapInfo) error {
 		return err
 	}
 	ctx := ls.AnnotateCtx(context.TODO())
-	log.Infof(ctx, "wrote %d node addresses to persistent storage", len(bi.Addresses))
+	log.Infof(ctx, "wrote %d node addresses and %d gossip infos to persistent storage",
+		len(bi.Addresses), len(bi.Infos))
 	return nil
 }
 
@@ -111,6 +111,7 @@ export default function Debug() {
         </DebugTableRow>
         <DebugTableRow title="Stopper">
           <DebugTableLink name="Active Tasks" url="/debug/stopper" />
+          <DebugTableLink name="Limited Async Tasks" url="/debug/stopper/tasks" />
         </DebugTableRow>
         <DebugTableRow title="pprof">
           <DebugTableLink name="Heap" url="/debug/pprof/head?debug=1" />
@@ -0,0 +1,239 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package admission implements a process-wide admission controller which
+// hands out a bounded number of tokens to the subsystems that fan out work
+// asynchronously: KV batch fan-out in the DistSender, DistSQL flows and
+// background jobs. Drawing all of this work from a single pool lets the
+// process bound its total concurrency while still prioritizing
+// latency-sensitive work over background work.
+package admission
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// Priority is the priority with which a unit of work requests admission.
+// Waiters with a higher priority are always granted tokens before waiters
+// with a lower priority.
+type Priority int
+
+const (
+	// LowPri is used for background work, such as jobs.
+	LowPri Priority = iota
+	// NormalPri is used for DistSQL flows.
+	NormalPri
+	// HighPri is used for KV batch fan-out, which is on the critical path of
+	// every request which spans ranges.
+	HighPri
+
+	numPriorities = int(HighPri) + 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case LowPri:
+		return "low"
+	case NormalPri:
+		return "normal"
+	case HighPri:
+		return "high"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// waiter is a goroutine blocked in Admit. The token is handed over by
+// closing the granted channel.
+type waiter struct {
+	granted chan struct{}
+	// deadline is the deadline of the waiter's context, if any.
+	deadline time.Time
+	// seq is used to break ties between waiters with the same deadline (or
+	// without a deadline) in FIFO order.
+	seq uint64
+	// index is the waiter's position in its waitQueue.
+	index int
+}
+
+// waitQueue is a heap of waiters of the same priority. Waiters whose
+// contexts have the nearest deadline are at the front of the queue, followed
+// by waiters without a deadline in FIFO order. This ensures that work close to
+// timing out is not stuck behind work which can afford to wait.
+type waitQueue []*waiter
+
+var _ heap.Interface = &waitQueue{}
+
+func (q waitQueue) Len() int { return len(q) }
+
+func (q waitQueue) Less(i, j int) bool {
+	a, b := q[i], q[j]
+	if a.deadline.IsZero() != b.deadline.IsZero() {
+		return !a.deadline.IsZero()
+	}
+	if !a.deadline.Equal(b.deadline) {
+		return a.deadline.Before(b.deadline)
+	}
+	return a.seq < b.seq
+}
+
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	w.index = -1
+	return w
+}
+
+// Controller hands out admission tokens from a fixed-size pool. A token must
+// be returned with Release once the admitted work has completed.
+//
+// Controller is safe for concurrent use.
+type Controller struct {
+	capacity int64
+
+	mu struct {
+		syncutil.Mutex
+		// available is the number of tokens which are not currently held.
+		available int64
+		// waiters holds one queue of waiters per priority.
+		waiters [numPriorities]waitQueue
+		// seq is the sequence number assigned to the next waiter.
+		seq uint64
+	}
+}
+
+// NewController creates a Controller with the given number of tokens.
+func NewController(capacity int64) *Controller {
+	if capacity <= 0 {
+		panic(fmt.Sprintf("invalid admission capacity %d", capacity))
+	}
+	c := &Controller{capacity: capacity}
+	c.mu.available = capacity
+	return c
+}
+
+// Capacity returns the total number of tokens managed by the controller.
+func (c *Controller) Capacity() int64 {
+	return c.capacity
+}
+
+// Available returns the number of tokens which are not currently held.
+func (c *Controller) Available() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mu.available
+}
+
+// hasWaitersLocked returns whether there are queued waiters with a priority
+// of at least pri.
+func (c *Controller) hasWaitersLocked(pri Priority) bool {
+	for p := int(pri); p < numPriorities; p++ {
+		if len(c.mu.waiters[p]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// TryAdmit acquires a token without blocking. It returns false if no token
+// is available, or if waiters of the same or a higher priority are already
+// queued for one. On success, the caller must call Release.
+func (c *Controller) TryAdmit(pri Priority) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mu.available == 0 || c.hasWaitersLocked(pri) {
+		return false
+	}
+	c.mu.available--
+	return true
+}
+
+// Admit acquires a token, blocking until one is available or the context is
+// canceled. Among waiters of the same priority, those whose contexts have the
+// nearest deadline are admitted first. On success, the caller must call
+// Release.
+func (c *Controller) Admit(ctx context.Context, pri Priority) error {
+	c.mu.Lock()
+	if c.mu.available > 0 && !c.hasWaitersLocked(pri) {
+		c.mu.available--
+		c.mu.Unlock()
+		return nil
+	}
+	w := &waiter{granted: make(chan struct{}), seq: c.mu.seq}
+	c.mu.seq++
+	if deadline, ok := ctx.Deadline(); ok {
+		w.deadline = deadline
+	}
+	heap.Push(&c.mu.waiters[pri], w)
+	c.mu.Unlock()
+
+	select {
+	case <-w.granted:
+		return nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		select {
+		case <-w.granted:
+			// We were granted a token concurrently with the cancellation. Pass it
+			// on to the next waiter.
+			c.releaseLocked()
+		default:
+			heap.Remove(&c.mu.waiters[pri], w.index)
+		}
+		return ctx.Err()
+	}
+}
+
+// Release returns a token acquired through TryAdmit or Admit to the pool,
+// handing it to the highest priority waiter, if any.
+func (c *Controller) Release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.releaseLocked()
+}
+
+func (c *Controller) releaseLocked() {
+	for p := numPriorities - 1; p >= 0; p-- {
+		if len(c.mu.waiters[p]) > 0 {
+			w := heap.Pop(&c.mu.waiters[p]).(*waiter)
+			close(w.granted)
+			return
+		}
+	}
+	if c.mu.available == c.capacity {
+		panic("admission token released more times than acquired")
+	}
+	c.mu.available++
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package admission
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/pkg/errors"
+)
+
+func TestControllerTryAdmit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	c := NewController(2)
+	for i := 0; i < 2; i++ {
+		if !c.TryAdmit(HighPri) {
+			t.Fatalf("%d: expected admission", i)
+		}
+	}
+	if c.TryAdmit(HighPri) {
+		t.Fatal("expected admission to be denied")
+	}
+	c.Release()
+	if a := c.Available(); a != 1 {
+		t.Fatalf("expected 1 available token, got %d", a)
+	}
+	if !c.TryAdmit(LowPri) {
+		t.Fatal("expected admission")
+	}
+}
+
+func TestControllerPriorityOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	c := NewController(1)
+	if !c.TryAdmit(NormalPri) {
+		t.Fatal("expected admission")
+	}
+
+	order := make(chan Priority, 3)
+	for _, pri := range []Priority{LowPri, NormalPri, HighPri} {
+		pri := pri
+		go func() {
+			if err := c.Admit(context.Background(), pri); err != nil {
+				t.Error(err)
+			}
+			order <- pri
+		}()
+		// Wait for the waiter to be queued so the queue order is deterministic.
+		testutils.SucceedsSoon(t, func() error {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if len(c.mu.waiters[pri]) != 1 {
+				return errors.Errorf("%s waiter not yet queued", pri)
+			}
+			return nil
+		})
+	}
+
+	// Queued low priority work must not let new normal priority work jump
+	// ahead, but it is not allowed to block higher priority work either.
+	if c.TryAdmit(NormalPri) {
+		t.Fatal("expected admission to be denied while waiters are queued")
+	}
+
+	for _, expected := range []Priority{HighPri, NormalPri, LowPri} {
+		c.Release()
+		select {
+		case pri := <-order:
+			if pri != expected {
+				t.Fatalf("expected %s to be admitted, got %s", expected, pri)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s waiter was not admitted", expected)
+		}
+	}
+	c.Release()
+	if a := c.Available(); a != 1 {
+		t.Fatalf("expected 1 available token, got %d", a)
+	}
+}
+
+func TestControllerAdmitCanceled(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	c := NewController(1)
+	if !c.TryAdmit(HighPri) {
+		t.Fatal("expected admission")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- c.Admit(ctx, LowPri)
+	}()
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("expected context cancellation, got %v", err)
+	}
+	c.Release()
+	if a := c.Available(); a != 1 {
+		t.Fatalf("expected 1 available token, got %d", a)
+	}
+}
+
+func TestControllerDeadlineOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	c := NewController(1)
+	if !c.TryAdmit(HighPri) {
+		t.Fatal("expected admission")
+	}
+
+	// Queue a waiter without a deadline, followed by waiters with a far and
+	// a near deadline. The waiters must be admitted nearest deadline first.
+	now := time.Now()
+	deadlines := []time.Duration{0, time.Hour, time.Minute}
+	order := make(chan int, len(deadlines))
+	for i, d := range deadlines {
+		i, d := i, d
+		ctx := context.Background()
+		if d != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, now.Add(d))
+			defer cancel()
+		}
+		go func() {
+			if err := c.Admit(ctx, NormalPri); err != nil {
+				t.Error(err)
+			}
+			order <- i
+		}()
+		testutils.SucceedsSoon(t, func() error {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if len(c.mu.waiters[NormalPri]) != i+1 {
+				return errors.Errorf("waiter %d not yet queued", i)
+			}
+			return nil
+		})
+	}
+
+	for _, expected := range []int{2, 1, 0} {
+		c.Release()
+		select {
+		case i := <-order:
+			if i != expected {
+				t.Fatalf("expected waiter %d to be admitted, got %d", expected, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("waiter %d was not admitted", expected)
+		}
+	}
+	c.Release()
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package bloom implements Bloom filters, which test whether an element
+// belongs to a set using a small, fixed amount of memory. There are no false
+// negatives; with 10 bits per element, the probability of a false positive is
+// about 1%.
+//
+// See Bloom, "Space/time trade-offs in hash coding with allowable errors"
+// (1970).
+package bloom
+
+import (
+	"hash/fnv"
+	"math"
+
+	"github.com/cockroachdb/cockroach/pkg/util/hashutil"
+)
+
+// Filter is a Bloom filter. Filters are not safe for concurrent use, except
+// for concurrent calls to MayContain once all the elements are inserted.
+type Filter struct {
+	bits      []uint64
+	numBits   uint64
+	numHashes uint64
+}
+
+// New returns an empty filter sized for the given number of elements, with
+// the given number of bits per element.
+func New(numElements int, bitsPerElement int) *Filter {
+	numBits := numBitsFor(numElements, bitsPerElement)
+	// The optimal number of hashes is ln(2) times the number of bits per
+	// element.
+	numHashes := uint64(math.Ceil(math.Ln2 * float64(bitsPerElement)))
+	if numHashes < 1 {
+		numHashes = 1
+	}
+	return &Filter{
+		bits:      make([]uint64, numBits/64),
+		numBits:   numBits,
+		numHashes: numHashes,
+	}
+}
+
+// Size returns the size in bytes of a filter sized for the given number of
+// elements and bits per element (see New).
+func Size(numElements int, bitsPerElement int) int64 {
+	return int64(numBitsFor(numElements, bitsPerElement) / 8)
+}
+
+// numBitsFor returns the number of bits of a filter sized for the given number
+// of elements and bits per element, rounded up to a multiple of 64.
+func numBitsFor(numElements int, bitsPerElement int) uint64 {
+	numBits := uint64(numElements) * uint64(bitsPerElement)
+	if numBits < 64 {
+		numBits = 64
+	}
+	return (numBits + 63) / 64 * 64
+}
+
+// Insert adds the element with the given encoding to the filter. Elements are
+// considered equal if their encodings are equal.
+func (f *Filter) Insert(data []byte) {
+	h1, h2 := hashes(data)
+	for i := uint64(0); i < f.numHashes; i++ {
+		bit := (h1 + i*h2) % f.numBits
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// MayContain returns false if the element with the given encoding was not
+// inserted into the filter, and true if it probably was.
+func (f *Filter) MayContain(data []byte) bool {
+	h1, h2 := hashes(data)
+	for i := uint64(0); i < f.numHashes; i++ {
+		bit := (h1 + i*h2) % f.numBits
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hashes returns two hashes of data, from which the index of each bit is
+// derived as h1+i*h2. See Kirsch and Mitzenmacher, "Less hashing, same
+// performance: building a better Bloom filter" (2006).
+func hashes(data []byte) (h1, h2 uint64) {
+	h := fnv.New64a()
+	// Writes to a hash.Hash never fail.
+	_, _ = h.Write(data)
+	// FNV does not distribute its input well enough over the low bits, which
+	// select the bits of the filter.
+	x := hashutil.Mix64(h.Sum64())
+	return x, hashutil.Mix64(x) | 1
+}
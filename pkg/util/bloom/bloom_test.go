@@ -0,0 +1,69 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package bloom
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	const n = 10000
+	f := New(n, 10)
+	for i := 0; i < n; i++ {
+		f.Insert([]byte(strconv.Itoa(i)))
+	}
+
+	// There are no false negatives.
+	for i := 0; i < n; i++ {
+		if !f.MayContain([]byte(strconv.Itoa(i))) {
+			t.Fatalf("element %d not found", i)
+		}
+	}
+
+	// About 1% of the absent elements are false positives.
+	numFalsePositives := 0
+	for i := n; i < 2*n; i++ {
+		if f.MayContain([]byte(strconv.Itoa(i))) {
+			numFalsePositives++
+		}
+	}
+	if numFalsePositives > n/50 {
+		t.Errorf("%d false positives out of %d absent elements", numFalsePositives, n)
+	}
+}
+
+func TestFilterSize(t *testing.T) {
+	testCases := []struct {
+		numElements, bitsPerElement int
+		expected                    int64
+	}{
+		{0, 10, 8},
+		{1, 10, 8},
+		{7, 10, 16},
+		{1000, 10, 1256},
+	}
+	for _, c := range testCases {
+		if size := Size(c.numElements, c.bitsPerElement); size != c.expected {
+			t.Errorf("%d elements, %d bits each: expected size %d, got %d",
+				c.numElements, c.bitsPerElement, c.expected, size)
+		}
+		f := New(c.numElements, c.bitsPerElement)
+		if size := int64(len(f.bits) * 8); size != c.expected {
+			t.Errorf("%d elements, %d bits each: expected %d bytes of bits, got %d",
+				c.numElements, c.bitsPerElement, c.expected, size)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package countminsketch implements count-min sketches, which estimate the
+// number of occurrences of each element of a multiset using a small, fixed
+// amount of memory. Estimates never undercount; they overcount by at most
+// about e/width times the total number of elements, with a probability of
+// at least 1-exp(-depth). Sketches can be merged losslessly: the merge of the
+// sketches of two multisets is identical to the sketch of their union.
+//
+// See Cormode and Muthukrishnan, "An improved data stream summary: the
+// count-min sketch and its applications" (2005).
+package countminsketch
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/util/hashutil"
+)
+
+// depth is the number of rows of counters, each indexed by a different hash.
+const depth = 4
+
+// width is the number of counters in each row.
+const width = 1024
+
+// numCounters is the number of counters in a sketch.
+const numCounters = depth * width
+
+// encodingVersion is the first byte of an encoded sketch.
+const encodingVersion = 1
+
+// Size is the in-memory size in bytes of a non-empty sketch.
+const Size = 8 * numCounters
+
+// Sketch is a count-min sketch. The zero value is an empty sketch.
+type Sketch struct {
+	// counters holds the rows of counters one after the other. It is
+	// allocated lazily.
+	counters []uint64
+	// count is the number of elements inserted into the sketch.
+	count uint64
+}
+
+// Insert adds an occurrence of the element with the given encoding to the
+// sketch. Elements are considered equal if their encodings are equal.
+func (s *Sketch) Insert(data []byte) {
+	if s.counters == nil {
+		s.counters = make([]uint64, numCounters)
+	}
+	h1, h2 := hashes(data)
+	for i := uint64(0); i < depth; i++ {
+		s.counters[i*width+(h1+i*h2)%width]++
+	}
+	s.count++
+}
+
+// hashes returns two hashes of data, from which the index of the counter in
+// each row is derived as h1+i*h2. See Kirsch and Mitzenmacher, "Less hashing,
+// same performance: building a better Bloom filter" (2006).
+func hashes(data []byte) (h1, h2 uint64) {
+	h := fnv.New64a()
+	// Writes to a hash.Hash never fail.
+	_, _ = h.Write(data)
+	// FNV does not distribute its input well enough over the low bits, which
+	// select the counters.
+	x := hashutil.Mix64(h.Sum64())
+	// h2 is odd, so that it is coprime with the width.
+	return x, hashutil.Mix64(x) | 1
+}
+
+// Estimate returns the estimated number of occurrences of the element with
+// the given encoding.
+func (s *Sketch) Estimate(data []byte) uint64 {
+	if s.counters == nil {
+		return 0
+	}
+	h1, h2 := hashes(data)
+	est := s.count
+	for i := uint64(0); i < depth; i++ {
+		if c := s.counters[i*width+(h1+i*h2)%width]; c < est {
+			est = c
+		}
+	}
+	return est
+}
+
+// Count returns the number of elements inserted into the sketch.
+func (s *Sketch) Count() uint64 {
+	return s.count
+}
+
+// Merge folds other into s, so that s estimates the number of occurrences of
+// the elements inserted into either sketch.
+func (s *Sketch) Merge(other *Sketch) {
+	if other.counters == nil {
+		return
+	}
+	if s.counters == nil {
+		s.counters = make([]uint64, numCounters)
+	}
+	for i, c := range other.counters {
+		s.counters[i] += c
+	}
+	s.count += other.count
+}
+
+// Encode appends the encoding of the sketch to appendTo. Empty sketches have
+// an empty encoding. Counters are encoded as varints, which keeps the
+// encoding of sketches of few elements small.
+func (s *Sketch) Encode(appendTo []byte) []byte {
+	if s.counters == nil {
+		return appendTo
+	}
+	appendTo = append(appendTo, encodingVersion)
+	var buf [binary.MaxVarintLen64]byte
+	for _, x := range []uint64{depth, width, s.count} {
+		n := binary.PutUvarint(buf[:], x)
+		appendTo = append(appendTo, buf[:n]...)
+	}
+	for _, c := range s.counters {
+		n := binary.PutUvarint(buf[:], c)
+		appendTo = append(appendTo, buf[:n]...)
+	}
+	return appendTo
+}
+
+// Decode merges the sketch with the given encoding, as produced by Encode,
+// into s.
+func (s *Sketch) Decode(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if data[0] != encodingVersion {
+		return errors.Errorf("unknown sketch encoding version %d", data[0])
+	}
+	data = data[1:]
+	var header [3]uint64
+	for i := range header {
+		x, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid sketch encoding")
+		}
+		header[i] = x
+		data = data[n:]
+	}
+	if header[0] != depth || header[1] != width {
+		return errors.Errorf("unsupported sketch dimensions %dx%d", header[0], header[1])
+	}
+	other := Sketch{counters: make([]uint64, numCounters), count: header[2]}
+	for i := range other.counters {
+		c, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid sketch encoding")
+		}
+		other.counters[i] = c
+		data = data[n:]
+	}
+	if len(data) != 0 {
+		return errors.Errorf("invalid sketch encoding: %d trailing bytes", len(data))
+	}
+	s.Merge(&other)
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package countminsketch
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func TestSketchEstimate(t *testing.T) {
+	const n = 10000
+
+	// Element i occurs i%100+1 times.
+	var s Sketch
+	total := uint64(0)
+	for i := 0; i < n; i++ {
+		data := []byte(strconv.Itoa(i))
+		for j := 0; j <= i%100; j++ {
+			s.Insert(data)
+			total++
+		}
+	}
+	if s.Count() != total {
+		t.Fatalf("expected count %d, got %d", total, s.Count())
+	}
+
+	// Estimates never undercount, and rarely overcount by more than
+	// e/width of the total.
+	maxError := uint64(2.72 * float64(total) / width)
+	numOff := 0
+	for i := 0; i < n; i++ {
+		expected := uint64(i%100 + 1)
+		est := s.Estimate([]byte(strconv.Itoa(i)))
+		if est < expected {
+			t.Fatalf("element %d: estimated %d occurrences, expected at least %d", i, est, expected)
+		}
+		if est-expected > maxError {
+			numOff++
+		}
+	}
+	if numOff > n/20 {
+		t.Errorf("%d of %d estimates are off by more than %d", numOff, n, maxError)
+	}
+
+	if est := s.Estimate([]byte("absent")); est > maxError {
+		t.Errorf("estimated %d occurrences of an absent element", est)
+	}
+	var empty Sketch
+	if est := empty.Estimate([]byte("absent")); est != 0 {
+		t.Errorf("estimated %d occurrences in an empty sketch", est)
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	const n = 5000
+
+	// Build one sketch from all the elements, and two sketches from
+	// overlapping subsets of them.
+	var all, a, b Sketch
+	for i := 0; i < n; i++ {
+		data := []byte(strconv.Itoa(i % 1000))
+		all.Insert(data)
+		if i < 3*n/4 {
+			a.Insert(data)
+		} else {
+			b.Insert(data)
+		}
+	}
+
+	// Round-trip the sketches through their encodings before merging them.
+	var merged Sketch
+	for _, s := range []*Sketch{&a, &b} {
+		if err := merged.Decode(s.Encode(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(merged.Encode(nil), all.Encode(nil)) {
+		t.Fatal("merged sketch differs from the sketch of the union")
+	}
+
+	var empty Sketch
+	if enc := empty.Encode(nil); len(enc) != 0 {
+		t.Fatalf("expected empty encoding, got %d bytes", len(enc))
+	}
+	if err := merged.Decode(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := merged.Decode([]byte{1, 2, 3}); err == nil {
+		t.Fatal("expected error decoding invalid sketch")
+	}
+	if err := merged.Decode(append(all.Encode(nil), 0)); err == nil {
+		t.Fatal("expected error decoding sketch with trailing bytes")
+	}
+}
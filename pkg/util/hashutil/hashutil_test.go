@@ -0,0 +1,35 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package hashutil
+
+import "testing"
+
+func TestMix64Avalanche(t *testing.T) {
+	// Flipping a single bit of the input flips about half of the bits of the
+	// output, whichever the bit.
+	const n = 1000
+	for bit := uint(0); bit < 64; bit++ {
+		var flipped int
+		for i := uint64(0); i < n; i++ {
+			x := i * 0x9e3779b97f4a7c15
+			for d := Mix64(x) ^ Mix64(x^(1<<bit)); d != 0; d &= d - 1 {
+				flipped++
+			}
+		}
+		if avg := float64(flipped) / n; avg < 28 || avg > 36 {
+			t.Errorf("flipping bit %d flips %.1f output bits on average", bit, avg)
+		}
+	}
+}
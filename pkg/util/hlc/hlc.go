@@ -19,6 +19,7 @@
 package hlc
 
 import (
+	"fmt"
 	"sync/atomic"
 	"time"
 
@@ -181,18 +182,47 @@ func (c *Clock) PhysicalTime() time.Time {
 	return time.Unix(0, c.PhysicalNow()).UTC()
 }
 
+// UntrustworthyRemoteWallTimeError is returned by UpdateAndCheckMaxOffset
+// when a remote wall time is further ahead of the local physical clock than
+// the clock's maximum offset, which likely means that the remote node's clock
+// jumped.
+type UntrustworthyRemoteWallTimeError struct {
+	Offset    time.Duration
+	MaxOffset time.Duration
+}
+
+func (e *UntrustworthyRemoteWallTimeError) Error() string {
+	return fmt.Sprintf("remote wall time is too far ahead (%s) to be trustworthy (max offset %s)",
+		e.Offset, e.MaxOffset)
+}
+
 // Update takes a hybrid timestamp, usually originating from
 // an event received from another member of a distributed
 // system. The clock is updated and the hybrid timestamp
 // associated to the receipt of the event returned.
-// An error may only occur if offset checking is active and
-// the remote timestamp was rejected due to clock offset,
-// in which case the timestamp of the clock will not have been
-// altered.
+// A remote wall time which is too far ahead of the local physical
+// clock is logged, but the clock is updated anyway; see
+// UpdateAndCheckMaxOffset for a version which rejects it.
 // To timestamp events of local origin, use Now instead.
 func (c *Clock) Update(rt Timestamp) Timestamp {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	ts, _ := c.updateLocked(rt, false /* checkMaxOffset */)
+	return ts
+}
+
+// UpdateAndCheckMaxOffset is like Update, but if offset checking is active
+// and the remote wall time is further ahead of the local physical clock than
+// the maximum offset, the clock isn't updated and an
+// UntrustworthyRemoteWallTimeError is returned along with the clock's
+// current timestamp.
+func (c *Clock) UpdateAndCheckMaxOffset(rt Timestamp) (Timestamp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.updateLocked(rt, true /* checkMaxOffset */)
+}
+
+func (c *Clock) updateLocked(rt Timestamp, checkMaxOffset bool) (Timestamp, error) {
 	physicalClock := c.getPhysicalClockLocked()
 
 	if physicalClock > c.mu.timestamp.WallTime && physicalClock > rt.WallTime {
@@ -200,7 +230,7 @@ func (c *Clock) Update(rt Timestamp) Timestamp {
 		// as the new wall time and the logical clock is reset.
 		c.mu.timestamp.WallTime = physicalClock
 		c.mu.timestamp.Logical = 0
-		return c.mu.timestamp
+		return c.mu.timestamp, nil
 	}
 
 	// In the remaining cases, our physical clock plays no role
@@ -209,6 +239,12 @@ func (c *Clock) Update(rt Timestamp) Timestamp {
 	if rt.WallTime > c.mu.timestamp.WallTime {
 		offset := time.Duration(rt.WallTime-physicalClock) * time.Nanosecond
 		if c.maxOffset > 0 && offset > c.maxOffset {
+			if checkMaxOffset {
+				return c.mu.timestamp, &UntrustworthyRemoteWallTimeError{
+					Offset:    offset,
+					MaxOffset: c.maxOffset,
+				}
+			}
 			log.Warningf(context.TODO(), "remote wall time is too far ahead (%s) to be trustworthy - updating anyway", offset)
 		}
 		// The remote clock is ahead of ours, and we update
@@ -227,5 +263,5 @@ func (c *Clock) Update(rt Timestamp) Timestamp {
 		}
 		c.mu.timestamp.Logical++
 	}
-	return c.mu.timestamp
+	return c.mu.timestamp, nil
 }
@@ -149,6 +149,34 @@ func TestHLCClock(t *testing.T) {
 	}
 }
 
+// TestHLCUpdateAndCheckMaxOffset verifies that remote wall times which are
+// too far ahead of the physical clock are rejected.
+func TestHLCUpdateAndCheckMaxOffset(t *testing.T) {
+	m := NewManualClock(100)
+	c := NewClock(m.UnixNano, 10*time.Nanosecond)
+
+	ts, err := c.UpdateAndCheckMaxOffset(Timestamp{WallTime: 105})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Timestamp{WallTime: 105, Logical: 1}); ts != expected {
+		t.Fatalf("expected %s, got %s", expected, ts)
+	}
+
+	ts, err = c.UpdateAndCheckMaxOffset(Timestamp{WallTime: 120})
+	if _, ok := err.(*UntrustworthyRemoteWallTimeError); !ok {
+		t.Fatalf("expected an UntrustworthyRemoteWallTimeError, got %v", err)
+	}
+	if expected := (Timestamp{WallTime: 105, Logical: 1}); ts != expected || c.Now().WallTime != 105 {
+		t.Fatalf("expected the clock to remain at %s, got %s", expected, ts)
+	}
+
+	// Without offset checking, the clock is updated regardless.
+	if ts := c.Update(Timestamp{WallTime: 120}); ts.WallTime != 120 {
+		t.Fatalf("expected the clock to be updated, got %s", ts)
+	}
+}
+
 // TestExampleManualClock shows how a manual clock can be
 // used as a physical clock. This is useful for testing.
 func TestExampleManualClock(t *testing.T) {
@@ -0,0 +1,151 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package hyperloglog implements HyperLogLog sketches, which estimate the
+// number of distinct elements of a multiset using a small, fixed amount of
+// memory. Sketches can be merged losslessly: the merge of the sketches of two
+// multisets is identical to the sketch of their union. This allows distinct
+// counts to be computed in a distributed fashion.
+//
+// See Flajolet et al., "HyperLogLog: the analysis of a near-optimal
+// cardinality estimation algorithm" (2007).
+package hyperloglog
+
+import (
+	"hash/fnv"
+	"math"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/util/hashutil"
+)
+
+// precision is the number of hash bits used to select a register. The
+// standard error of the estimate is about 1.04/sqrt(2^precision), or 1.6%.
+const precision = 12
+
+// numRegisters is the number of registers in a sketch.
+const numRegisters = 1 << precision
+
+// encodingVersion is the first byte of an encoded sketch.
+const encodingVersion = 1
+
+// EncodedSize is the size in bytes of an encoded sketch.
+const EncodedSize = 2 + numRegisters
+
+// Sketch is a HyperLogLog sketch. The zero value is an empty sketch.
+type Sketch struct {
+	// registers holds, for each register, the maximum rank observed among the
+	// hashes which map to it. It is allocated lazily.
+	registers []uint8
+}
+
+// Insert adds the element with the given encoding to the sketch. Elements
+// are considered equal if their encodings are equal.
+func (s *Sketch) Insert(data []byte) {
+	h := fnv.New64a()
+	// Writes to a hash.Hash never fail.
+	_, _ = h.Write(data)
+	// FNV does not distribute its input well enough over the high bits, which
+	// HyperLogLog relies on.
+	s.insertHash(hashutil.Mix64(h.Sum64()))
+}
+
+func (s *Sketch) insertHash(x uint64) {
+	if s.registers == nil {
+		s.registers = make([]uint8, numRegisters)
+	}
+	idx := x >> (64 - precision)
+	// The rank is the position of the leftmost 1-bit among the remaining bits.
+	// A sentinel bit bounds it by 64-precision+1.
+	w := x<<precision | 1<<(precision-1)
+	rank := uint8(1)
+	for w&(1<<63) == 0 {
+		rank++
+		w <<= 1
+	}
+	if rank > s.registers[idx] {
+		s.registers[idx] = rank
+	}
+}
+
+// Merge folds other into s, so that s estimates the number of distinct
+// elements inserted into either sketch.
+func (s *Sketch) Merge(other *Sketch) {
+	if other.registers == nil {
+		return
+	}
+	if s.registers == nil {
+		s.registers = make([]uint8, numRegisters)
+	}
+	for i, r := range other.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+}
+
+// Estimate returns the estimated number of distinct elements inserted into
+// the sketch.
+func (s *Sketch) Estimate() uint64 {
+	if s.registers == nil {
+		return 0
+	}
+	const m = float64(numRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, r := range s.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	est := alpha * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// Use linear counting for small cardinalities, for which the raw
+		// estimate is heavily biased.
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+// Encode appends the encoding of the sketch to appendTo. Empty sketches have
+// an empty encoding.
+func (s *Sketch) Encode(appendTo []byte) []byte {
+	if s.registers == nil {
+		return appendTo
+	}
+	appendTo = append(appendTo, encodingVersion, precision)
+	return append(appendTo, s.registers...)
+}
+
+// Decode merges the sketch with the given encoding, as produced by Encode,
+// into s.
+func (s *Sketch) Decode(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if len(data) != EncodedSize {
+		return errors.Errorf("invalid sketch encoding length %d", len(data))
+	}
+	if data[0] != encodingVersion {
+		return errors.Errorf("unknown sketch encoding version %d", data[0])
+	}
+	if data[1] != precision {
+		return errors.Errorf("unsupported sketch precision %d", data[1])
+	}
+	s.Merge(&Sketch{registers: data[2:]})
+	return nil
+}
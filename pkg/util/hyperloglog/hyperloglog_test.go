@@ -0,0 +1,82 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package hyperloglog
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestSketchEstimate(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 100, 1000, 10000, 100000} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			var s Sketch
+			// Insert every element twice; duplicates must not be counted.
+			for rep := 0; rep < 2; rep++ {
+				for i := 0; i < n; i++ {
+					s.Insert([]byte(fmt.Sprintf("element-%d", i)))
+				}
+			}
+			est := s.Estimate()
+			// Allow for five times the standard error.
+			if diff := math.Abs(float64(est) - float64(n)); diff > 0.08*float64(n) {
+				t.Errorf("estimated %d distinct elements, expected %d", est, n)
+			}
+		})
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	const n = 5000
+
+	// Build one sketch from all the elements, and two sketches from
+	// overlapping subsets of them.
+	var all, a, b Sketch
+	for i := 0; i < n; i++ {
+		data := []byte(strconv.Itoa(i))
+		all.Insert(data)
+		if i < 3*n/4 {
+			a.Insert(data)
+		}
+		if i >= n/4 {
+			b.Insert(data)
+		}
+	}
+
+	// Round-trip the sketches through their encodings before merging them.
+	var merged Sketch
+	for _, s := range []*Sketch{&a, &b} {
+		if err := merged.Decode(s.Encode(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(merged.Encode(nil), all.Encode(nil)) {
+		t.Fatal("merged sketch differs from the sketch of the union")
+	}
+
+	var empty Sketch
+	if enc := empty.Encode(nil); len(enc) != 0 {
+		t.Fatalf("expected empty encoding, got %d bytes", len(enc))
+	}
+	if err := merged.Decode(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := merged.Decode([]byte{1, 2, 3}); err == nil {
+		t.Fatal("expected error decoding invalid sketch")
+	}
+}
@@ -19,6 +19,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/gogo/protobuf/proto"
 	opentracing "github.com/opentracing/opentracing-go"
 	otlog "github.com/opentracing/opentracing-go/log"
 	"golang.org/x/net/context"
@@ -179,6 +180,26 @@ func ErrEventf(ctx context.Context, format string, args ...interface{}) {
 	eventInternal(ctx, true /*isErr*/, true /*withTags*/, format, args...)
 }
 
+// StructuredEvent looks for an opentracing.Trace in the context and logs the
+// given payload to it (see tracing.LogStructured). If no Trace is found, it
+// looks for an EventLog in the context and logs the payload's text
+// representation to it. If neither is found, does nothing.
+func StructuredEvent(ctx context.Context, payload proto.Message) {
+	sp, el, ok := getSpanOrEventLog(ctx)
+	if !ok {
+		return
+	}
+	if sp != nil {
+		tracing.LogStructured(sp, payload)
+		return
+	}
+	el.Lock()
+	if el.eventLog != nil {
+		el.eventLog.Printf("%s", payload)
+	}
+	el.Unlock()
+}
+
 // VEvent either logs a message to the log files (which also outputs to the
 // active trace or event log) or to the trace/event log alone, depending on
 // whether the specified verbosity level is active.
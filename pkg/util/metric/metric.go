@@ -107,6 +107,7 @@ var _ Iterable = &Gauge{}
 var _ Iterable = &GaugeFloat64{}
 var _ Iterable = &Counter{}
 var _ Iterable = &Histogram{}
+var _ Iterable = &WindowedHistogram{}
 
 var _ json.Marshaler = &Gauge{}
 var _ json.Marshaler = &GaugeFloat64{}
@@ -117,6 +118,7 @@ var _ PrometheusExportable = &Gauge{}
 var _ PrometheusExportable = &GaugeFloat64{}
 var _ PrometheusExportable = &Counter{}
 var _ PrometheusExportable = &Histogram{}
+var _ PrometheusExportable = &WindowedHistogram{}
 
 type periodic interface {
 	nextTick() time.Time
@@ -286,6 +288,117 @@ func (h *Histogram) ToPrometheusMetric() *prometheusgo.Metric {
 	}
 }
 
+// windowedQuantiles are the quantiles of a WindowedHistogram exported to
+// prometheus.
+var windowedQuantiles = []float64{50, 75, 90, 99, 99.9, 99.99, 99.999, 100}
+
+// A WindowedHistogram collects observed values like a Histogram, but keeps
+// only the windowed set of buckets. All of its methods, including those
+// exporting it to prometheus, apply to recently collected samples, so that
+// the quantiles it reports reflect recent behavior instead of being
+// dominated by the lifetime of the process.
+type WindowedHistogram struct {
+	Metadata
+	maxVal int64
+	mu     struct {
+		syncutil.Mutex
+		sliding *slidingHistogram
+	}
+}
+
+// NewWindowedHistogram initializes a given WindowedHistogram. It rotates
+// every 'duration' and tracks nonnegative values up to 'maxVal' with
+// 'sigFigs' decimal points of precision.
+func NewWindowedHistogram(
+	metadata Metadata, duration time.Duration, maxVal int64, sigFigs int,
+) *WindowedHistogram {
+	h := &WindowedHistogram{
+		Metadata: metadata,
+		maxVal:   maxVal,
+	}
+	h.mu.sliding = newSlidingHistogram(duration, maxVal, sigFigs)
+	return h
+}
+
+// NewWindowedLatency is the WindowedHistogram counterpart of NewLatency.
+// It retains values for approximately histogramWindow.
+func NewWindowedLatency(metadata Metadata, histogramWindow time.Duration) *WindowedHistogram {
+	return NewWindowedHistogram(
+		metadata, histogramWindow, MaxLatency.Nanoseconds(), 1,
+	)
+}
+
+// Windowed returns a copy of the current histogram data and its rotation
+// interval.
+func (h *WindowedHistogram) Windowed() (*hdrhistogram.Histogram, time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return cloneHistogram(h.mu.sliding.Current()), h.mu.sliding.duration
+}
+
+// RecordValue adds the given value to the histogram. Recording a value in
+// excess of the configured maximum value for that histogram results in
+// recording the maximum value instead.
+func (h *WindowedHistogram) RecordValue(v int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.mu.sliding.RecordValue(v) != nil {
+		_ = h.mu.sliding.RecordValue(h.maxVal)
+	}
+}
+
+// TotalCount returns the number of samples in the current window.
+func (h *WindowedHistogram) TotalCount() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.mu.sliding.Current().TotalCount()
+}
+
+// Inspect calls the closure with the empty string and the receiver.
+func (h *WindowedHistogram) Inspect(f func(interface{})) {
+	h.mu.Lock()
+	maybeTick(h.mu.sliding)
+	h.mu.Unlock()
+	f(h)
+}
+
+// GetType returns the prometheus type enum for this metric.
+func (h *WindowedHistogram) GetType() *prometheusgo.MetricType {
+	return prometheusgo.MetricType_SUMMARY.Enum()
+}
+
+// ToPrometheusMetric returns a filled-in prometheus metric of the right type.
+// The histogram is exported as a summary of the quantiles of the current
+// window, since its buckets are not cumulative.
+func (h *WindowedHistogram) ToPrometheusMetric() *prometheusgo.Metric {
+	h.mu.Lock()
+	cur := h.mu.sliding.Current()
+	h.mu.Unlock()
+
+	summary := &prometheusgo.Summary{
+		Quantile: make([]*prometheusgo.Quantile, 0, len(windowedQuantiles)),
+	}
+	for _, q := range windowedQuantiles {
+		summary.Quantile = append(summary.Quantile, &prometheusgo.Quantile{
+			Quantile: proto.Float64(q / 100),
+			Value:    proto.Float64(float64(cur.ValueAtQuantile(q))),
+		})
+	}
+	var count uint64
+	var sum float64
+	for _, bar := range cur.Distribution() {
+		count += uint64(bar.Count)
+		sum += float64(bar.To) * float64(bar.Count) // approximated like Histogram
+	}
+	summary.SampleCount = &count
+	summary.SampleSum = &sum
+
+	return &prometheusgo.Metric{
+		Summary: summary,
+	}
+}
+
 // A Counter holds a single mutable atomic value.
 type Counter struct {
 	Metadata
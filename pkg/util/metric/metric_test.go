@@ -161,6 +161,64 @@ func TestHistogramRotate(t *testing.T) {
 	}
 }
 
+func TestWindowedHistogram(t *testing.T) {
+	defer TestingSetNow(nil)()
+	setNow(0)
+	duration := histWrapNum * time.Second
+	h := NewWindowedHistogram(emptyMetadata, duration, 10, 1)
+	h.RecordValue(1)
+	h.RecordValue(5)
+	h.RecordValue(5)
+	h.RecordValue(10)
+	h.RecordValue(15000) // counts as 10
+
+	f := func(v float64) *float64 { return &v }
+	u := func(v uint64) *uint64 { return &v }
+	quantiles := func(vals ...float64) []*prometheusgo.Quantile {
+		var qs []*prometheusgo.Quantile
+		for i, v := range vals {
+			qs = append(qs, &prometheusgo.Quantile{
+				Quantile: f(windowedQuantiles[i] / 100), Value: f(v),
+			})
+		}
+		return qs
+	}
+
+	if typ := h.GetType(); *typ != prometheusgo.MetricType_SUMMARY {
+		t.Fatalf("unexpected type %s", typ)
+	}
+	act := *h.ToPrometheusMetric().Summary
+	exp := prometheusgo.Summary{
+		SampleCount: u(5),
+		SampleSum:   f(1*1 + 2*5 + 2*10),
+		Quantile:    quantiles(5, 10, 10, 10, 10, 10, 10, 10),
+	}
+	if !reflect.DeepEqual(act, exp) {
+		t.Fatalf("expected differs from actual: %s", pretty.Diff(exp, act))
+	}
+
+	// Once the window has fully rotated, the samples are gone from the
+	// histogram and from its export.
+	setNow(duration)
+	if n := h.TotalCount(); n != 0 {
+		t.Fatalf("expected an empty window, got %d samples", n)
+	}
+	act = *h.ToPrometheusMetric().Summary
+	exp = prometheusgo.Summary{
+		SampleCount: u(0),
+		SampleSum:   f(0),
+		Quantile:    quantiles(0, 0, 0, 0, 0, 0, 0, 0),
+	}
+	if !reflect.DeepEqual(act, exp) {
+		t.Fatalf("expected differs from actual: %s", pretty.Diff(exp, act))
+	}
+
+	h.RecordValue(7)
+	if cur, _ := h.Windowed(); cur.TotalCount() != 1 || cur.Max() != 7 {
+		t.Fatalf("unexpected window: %d samples, max %d", cur.TotalCount(), cur.Max())
+	}
+}
+
 func TestRateRotate(t *testing.T) {
 	defer TestingSetNow(nil)()
 	setNow(0)
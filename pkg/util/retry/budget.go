@@ -0,0 +1,87 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package retry
+
+import (
+	"math"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// A Budget is a token bucket shared by retry loops (see Options.Budget).
+// Each retry takes a token, and the tokens are replenished at a fixed rate
+// up to a maximum. When many loops retry at once, e.g. during an outage of
+// the cluster, they run out of tokens and collectively back off to the rate
+// of the budget, instead of retrying in a synchronized storm.
+type Budget struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu struct {
+		syncutil.Mutex
+		// tokens is negative when retries are waiting for tokens. Each
+		// waiting retry has reserved the token it waits for.
+		tokens float64
+		last   time.Time
+	}
+}
+
+// NewBudget returns a Budget which replenishes rate tokens per second, up to
+// burst tokens. It starts full.
+func NewBudget(rate float64, burst int) *Budget {
+	b := &Budget{rate: rate, burst: float64(burst)}
+	b.mu.tokens = b.burst
+	b.mu.last = timeutil.Now()
+	return b
+}
+
+// refillLocked replenishes the tokens accumulated since the last call.
+func (b *Budget) refillLocked(now time.Time) {
+	if elapsed := now.Sub(b.mu.last); elapsed > 0 {
+		b.mu.tokens = math.Min(b.burst, b.mu.tokens+elapsed.Seconds()*b.rate)
+		b.mu.last = now
+	}
+}
+
+// reserve takes a token and returns how long to wait for it to be
+// replenished, which is zero if it was available.
+func (b *Budget) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(now)
+	b.mu.tokens--
+	if b.mu.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.mu.tokens * float64(time.Second) / b.rate)
+}
+
+// cancel returns a token reserved by a retry which stopped waiting for it.
+func (b *Budget) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mu.tokens = math.Min(b.burst, b.mu.tokens+1)
+}
+
+// Available returns the number of tokens available to retries. It is
+// negative when retries are waiting for tokens to be replenished.
+func (b *Budget) Available() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(timeutil.Now())
+	return int64(math.Floor(b.mu.tokens))
+}
@@ -20,6 +20,8 @@ import (
 	"time"
 
 	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 )
 
 // Options provides reusable configuration of Retry objects.
@@ -30,6 +32,9 @@ type Options struct {
 	MaxRetries          int             // Maximum number of attempts (0 for infinite)
 	RandomizationFactor float64         // Randomize the backoff interval by constant
 	Closer              <-chan struct{} // Optionally end retry loop channel close.
+	// Budget, if set, is shared with other retry loops, and each retry waits
+	// for a token of the budget in addition to its backoff.
+	Budget *Budget
 }
 
 // Retry implements the public methods necessary to control an exponential-
@@ -88,7 +93,28 @@ func (r *Retry) Reset() {
 	r.isReset = true
 }
 
+// retryIn returns how long to wait before the next retry. If the retry has a
+// budget, a token of the budget is reserved for the retry, and the retry
+// waits at least until the token is available.
 func (r Retry) retryIn() time.Duration {
+	backoff := r.backoff()
+	if r.opts.Budget != nil {
+		if wait := r.opts.Budget.reserve(timeutil.Now()); wait > backoff {
+			return wait
+		}
+	}
+	return backoff
+}
+
+// cancelBudget returns the token reserved by retryIn to the budget, if any,
+// when the retry loop ends before the retry.
+func (r Retry) cancelBudget() {
+	if r.opts.Budget != nil {
+		r.opts.Budget.cancel()
+	}
+}
+
+func (r Retry) backoff() time.Duration {
 	backoff := float64(r.opts.InitialBackoff) * math.Pow(r.opts.Multiplier, float64(r.currentAttempt))
 	if maxBackoff := float64(r.opts.MaxBackoff); backoff > maxBackoff {
 		backoff = maxBackoff
@@ -120,8 +146,10 @@ func (r *Retry) Next() bool {
 		r.currentAttempt++
 		return true
 	case <-r.opts.Closer:
+		r.cancelBudget()
 		return false
 	case <-r.ctxDoneChan:
+		r.cancelBudget()
 		return false
 	}
 }
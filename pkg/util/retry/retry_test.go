@@ -149,3 +149,61 @@ func TestRetryWithMaxAttempts(t *testing.T) {
 		t.Errorf("expected %d attempts, got %d attempts", maxAttempts, attempts)
 	}
 }
+
+func TestBudget(t *testing.T) {
+	b := NewBudget(10 /* rate */, 2 /* burst */)
+	now := b.mu.last
+	// Once the burst is used up, each retry waits for its own token.
+	for i, exp := range []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if wait := b.reserve(now); wait != exp {
+			t.Errorf("%d: expected to wait %s, got %s", i, exp, wait)
+		}
+	}
+	// The tokens are replenished up to the burst.
+	b.refillLocked(now.Add(time.Hour))
+	if tokens := b.mu.tokens; tokens != 2 {
+		t.Errorf("expected 2 tokens, got %f", tokens)
+	}
+	if wait := b.reserve(now.Add(time.Hour)); wait != 0 {
+		t.Errorf("expected not to wait, got %s", wait)
+	}
+}
+
+func TestRetryWithBudget(t *testing.T) {
+	closer := make(chan struct{})
+	opts := Options{
+		InitialBackoff: time.Microsecond,
+		MaxBackoff:     time.Microsecond,
+		Multiplier:     2,
+		Closer:         closer,
+		// The budget is replenished too slowly for the test to get a second
+		// token.
+		Budget: NewBudget(1e-3, 1),
+	}
+
+	r := Start(opts)
+	// The first attempt and the first retry, which uses up the budget, don't
+	// wait.
+	for i := 0; i < 2; i++ {
+		if !r.Next() {
+			t.Fatalf("%d: expected the retry loop to continue", i)
+		}
+	}
+	if available := opts.Budget.Available(); available != 0 {
+		t.Fatalf("expected no tokens to be available, got %d", available)
+	}
+
+	// The next retry waits for a token, until the loop is closed.
+	done := make(chan bool)
+	go func() {
+		done <- r.Next()
+	}()
+	close(closer)
+	if <-done {
+		t.Fatal("expected the retry loop to end")
+	}
+	// The token reserved by the retry was returned to the budget.
+	if available := opts.Budget.Available(); available != 0 {
+		t.Fatalf("expected no tokens to be available, got %d", available)
+	}
+}
@@ -29,8 +29,19 @@ type Interface interface {
 
 // Shuffle randomizes the order of the array.
 func Shuffle(data Interface) {
+	shuffle(data, rand.Intn)
+}
+
+// ShuffleWithRand randomizes the order of the array using the given source
+// of randomness, which makes the order reproducible from the seed of the
+// source.
+func ShuffleWithRand(rng *rand.Rand, data Interface) {
+	shuffle(data, rng.Intn)
+}
+
+func shuffle(data Interface, intn func(int) int) {
 	n := data.Len()
 	for i := 1; i < n; i++ {
-		data.Swap(i, rand.Intn(i+1))
+		data.Swap(i, intn(i+1))
 	}
 }
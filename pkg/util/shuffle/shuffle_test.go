@@ -78,3 +78,18 @@ func TestShuffle(t *testing.T) {
 
 	verify(ts, testSlice{1, 3, 4, 2, 5})
 }
+
+func TestShuffleWithRand(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// Shuffles with sources of the same seed produce the same orders.
+	rng1, rng2 := rand.New(rand.NewSource(42)), rand.New(rand.NewSource(42))
+	ts1, ts2 := testSlice{1, 2, 3, 4, 5}, testSlice{1, 2, 3, 4, 5}
+	for i := 0; i < 10; i++ {
+		ShuffleWithRand(rng1, ts1)
+		ShuffleWithRand(rng2, ts2)
+		if !reflect.DeepEqual(ts1, ts2) {
+			t.Fatalf("%d: expected %v, got %v", i, ts1, ts2)
+		}
+	}
+}
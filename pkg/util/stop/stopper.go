@@ -21,6 +21,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -28,6 +29,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/caller"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/opentracing/opentracing-go"
 )
@@ -75,8 +77,36 @@ func handleDebug(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleDebugTasks lists the limited async tasks running in each stopper,
+// oldest first. If the min_age parameter is given (e.g. "?min_age=1m"),
+// only the tasks which have been running for at least that long are listed.
+func handleDebugTasks(w http.ResponseWriter, r *http.Request) {
+	var minAge time.Duration
+	if v := r.URL.Query().Get("min_age"); v != "" {
+		var err error
+		if minAge, err = time.ParseDuration(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid min_age: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	now := timeutil.Now()
+	trackedStoppers.Lock()
+	defer trackedStoppers.Unlock()
+	for _, s := range trackedStoppers.stoppers {
+		tasks := s.AsyncTasks()
+		fmt.Fprintf(w, "%p: %d limited async tasks\n", s, len(tasks))
+		for _, task := range tasks {
+			if age := now.Sub(task.Start); age >= minAge {
+				fmt.Fprintf(w, "%-12s %s\n", age, task.Name)
+			}
+		}
+	}
+}
+
 func init() {
 	http.Handle("/debug/stopper", http.HandlerFunc(handleDebug))
+	http.Handle("/debug/stopper/tasks", http.HandlerFunc(handleDebugTasks))
 }
 
 // Closer is an interface for objects to attach to the stopper to
@@ -120,8 +150,12 @@ type Stopper struct {
 		quiescing bool       // true when Stop() has been called
 		numTasks  int        // number of outstanding tasks
 		tasks     TaskMap
-		closers   []Closer
-		cancels   []func()
+		// asyncTasks tracks the running tasks started by
+		// RunLimitedAsyncTask, keyed by an ID assigned from nextTaskID.
+		asyncTasks map[int64]AsyncTask
+		nextTaskID int64
+		closers    []Closer
+		cancels    []func()
 	}
 }
 
@@ -154,6 +188,7 @@ func NewStopper(options ...Option) *Stopper {
 	}
 
 	s.mu.tasks = TaskMap{}
+	s.mu.asyncTasks = map[int64]AsyncTask{}
 
 	for _, opt := range options {
 		opt.apply(s)
@@ -315,12 +350,14 @@ func (s *Stopper) RunLimitedAsyncTask(
 		<-sem
 		return errUnavailable
 	}
+	id := s.addAsyncTask(taskName)
 
 	ctx, span := tracing.ForkCtxSpan(ctx, taskName)
 
 	go func() {
 		defer s.Recover(ctx)
 		defer s.runPostlude(taskName)
+		defer s.removeAsyncTask(id)
 		defer func() { <-sem }()
 		defer tracing.FinishSpan(span)
 
@@ -348,6 +385,24 @@ func (s *Stopper) runPostlude(taskName string) {
 	s.mu.quiesce.Broadcast()
 }
 
+// addAsyncTask registers a task started by RunLimitedAsyncTask and returns
+// the ID with which to remove it once it completes.
+func (s *Stopper) addAsyncTask(taskName string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.nextTaskID++
+	s.mu.asyncTasks[s.mu.nextTaskID] = AsyncTask{
+		Name: taskName, Start: timeutil.Now(), id: s.mu.nextTaskID,
+	}
+	return s.mu.nextTaskID
+}
+
+func (s *Stopper) removeAsyncTask(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.mu.asyncTasks, id)
+}
+
 // NumTasks returns the number of active tasks.
 func (s *Stopper) NumTasks() int {
 	s.mu.Lock()
@@ -388,6 +443,34 @@ func (s *Stopper) runningTasksLocked() TaskMap {
 	return m
 }
 
+// An AsyncTask is a task started by RunLimitedAsyncTask which is still
+// running, as returned by AsyncTasks().
+type AsyncTask struct {
+	Name  string
+	Start time.Time
+
+	id int64 // orders the tasks with the same start time
+}
+
+// AsyncTasks returns the tasks started by RunLimitedAsyncTask which are
+// still running, sorted by start time (oldest first). When a node appears
+// wedged, the oldest tasks point at what it is stuck on.
+func (s *Stopper) AsyncTasks() []AsyncTask {
+	s.mu.Lock()
+	tasks := make([]AsyncTask, 0, len(s.mu.asyncTasks))
+	for _, task := range s.mu.asyncTasks {
+		tasks = append(tasks, task)
+	}
+	s.mu.Unlock()
+	sort.Slice(tasks, func(i, j int) bool {
+		if !tasks[i].Start.Equal(tasks[j].Start) {
+			return tasks[i].Start.Before(tasks[j].Start)
+		}
+		return tasks[i].id < tasks[j].id
+	})
+	return tasks
+}
+
 // Stop signals all live workers to stop and then waits for each to
 // confirm it has stopped.
 func (s *Stopper) Stop(ctx context.Context) {
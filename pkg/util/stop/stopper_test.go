@@ -16,6 +16,9 @@ package stop_test
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -490,6 +493,60 @@ func TestStopperRunLimitedAsyncTask(t *testing.T) {
 	}
 }
 
+func TestStopperAsyncTasks(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	s := stop.NewStopper()
+	defer s.Stop(context.Background())
+
+	sem := make(chan struct{}, 2)
+	release := make(chan struct{})
+	f := func(context.Context) { <-release }
+	for _, name := range []string{"test: first", "test: second"} {
+		if err := s.RunLimitedAsyncTask(
+			context.Background(), name, sem, true /* wait */, f,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tasks := s.AsyncTasks()
+	if len(tasks) != 2 || tasks[0].Name != "test: first" || tasks[1].Name != "test: second" {
+		t.Fatalf("unexpected tasks %+v", tasks)
+	}
+	if tasks[1].Start.Before(tasks[0].Start) {
+		t.Fatalf("tasks not sorted by start time: %+v", tasks)
+	}
+
+	for _, tc := range []struct {
+		url    string
+		listed bool
+	}{
+		{"/debug/stopper/tasks", true},
+		{"/debug/stopper/tasks?min_age=1h", false},
+	} {
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", tc.url, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d: %s", tc.url, w.Code, w.Body)
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, fmt.Sprintf("%p: 2 limited async tasks", s)) {
+			t.Fatalf("%s: stopper missing from listing:\n%s", tc.url, body)
+		}
+		if listed := strings.Contains(body, "test: first"); listed != tc.listed {
+			t.Fatalf("%s: expected task listed=%t:\n%s", tc.url, tc.listed, body)
+		}
+	}
+
+	close(release)
+	testutils.SucceedsSoon(t, func() error {
+		if tasks := s.AsyncTasks(); len(tasks) != 0 {
+			return errors.Errorf("tasks still running: %+v", tasks)
+		}
+		return nil
+	})
+}
+
 func TestStopperRunLimitedAsyncTaskCancelContext(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	s := stop.NewStopper()
@@ -0,0 +1,227 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package tdigest implements t-digests, which summarize a distribution of
+// values using a bounded amount of memory and can estimate its quantiles.
+// Values are grouped into weighted centroids; centroids near the tails of the
+// distribution are kept small, so extreme quantiles remain accurate. Digests
+// can be merged, which allows quantiles to be computed in a distributed
+// fashion.
+//
+// Small digests are exact: values are only grouped into centroids once their
+// number exceeds a limit, so quantiles of small distributions (and of the
+// merge of such distributions) are computed precisely.
+//
+// See Dunning and Ertl, "Computing extremely accurate quantiles using
+// t-digests" (2014).
+package tdigest
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// compression bounds the number of centroids after compressing a digest.
+// Larger values lead to more accurate estimates.
+const compression = 100
+
+// maxCentroids is the number of centroids above which a digest is
+// compressed.
+const maxCentroids = 5 * compression
+
+// CentroidSize is the in-memory size of a centroid, in bytes.
+const CentroidSize = 16
+
+// encodingVersion is the first byte of an encoded digest.
+const encodingVersion = 1
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// Digest is a t-digest. The zero value is an empty digest.
+type Digest struct {
+	centroids []centroid
+	// sorted is set if centroids are sorted by their mean.
+	sorted bool
+	count  float64
+}
+
+// Count returns the number of values added to the digest.
+func (d *Digest) Count() float64 {
+	return d.count
+}
+
+// NumCentroids returns the number of centroids the digest currently holds.
+func (d *Digest) NumCentroids() int {
+	return len(d.centroids)
+}
+
+// Add adds a value to the digest.
+func (d *Digest) Add(x float64) {
+	d.add(centroid{mean: x, weight: 1})
+}
+
+func (d *Digest) add(c centroid) {
+	d.centroids = append(d.centroids, c)
+	d.sorted = false
+	d.count += c.weight
+	if len(d.centroids) > maxCentroids {
+		d.compress()
+	}
+}
+
+// Merge adds all the values summarized by other to d.
+func (d *Digest) Merge(other *Digest) {
+	for _, c := range other.centroids {
+		d.add(c)
+	}
+}
+
+func (d *Digest) sort() {
+	if d.sorted {
+		return
+	}
+	sort.Slice(d.centroids, func(i, j int) bool {
+		return d.centroids[i].mean < d.centroids[j].mean
+	})
+	d.sorted = true
+}
+
+// scale maps a quantile to the scale k1 of the paper: merged centroids may
+// span at most one unit of it. Its slope grows near the tails, which keeps
+// the centroids there small.
+func scale(q float64) float64 {
+	return compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// compress merges adjacent centroids while respecting the size bound given by
+// scale.
+func (d *Digest) compress() {
+	d.sort()
+	merged := d.centroids[:1]
+	cur := &merged[0]
+	weightBefore := 0.0
+	kLow := scale(0)
+	for _, c := range d.centroids[1:] {
+		q := (weightBefore + cur.weight + c.weight) / d.count
+		if scale(q)-kLow <= 1 {
+			cur.weight += c.weight
+			cur.mean += (c.mean - cur.mean) * c.weight / cur.weight
+			continue
+		}
+		weightBefore += cur.weight
+		kLow = scale(weightBefore / d.count)
+		merged = append(merged, c)
+		cur = &merged[len(merged)-1]
+	}
+	d.centroids = merged
+}
+
+// Quantile returns an estimate of the q-th quantile of the added values,
+// interpolating between adjacent values. Like PostgreSQL's percentile_cont,
+// the 0th quantile is the minimum and the 1st quantile is the maximum. It
+// returns NaN if the digest is empty.
+func (d *Digest) Quantile(q float64) float64 {
+	if len(d.centroids) == 0 {
+		return math.NaN()
+	}
+	d.sort()
+	// Each centroid is centered on the middle of the range of positions its
+	// values occupy. With a centroid per value, value i (starting from 0) is
+	// centered on i+0.5.
+	target := q*(d.count-1) + 0.5
+	first := d.centroids[0]
+	if target <= first.weight/2 {
+		return first.mean
+	}
+	weightBefore := 0.0
+	for i := 0; i < len(d.centroids)-1; i++ {
+		a, b := d.centroids[i], d.centroids[i+1]
+		center := weightBefore + a.weight/2
+		next := weightBefore + a.weight + b.weight/2
+		if target <= next {
+			return a.mean + (b.mean-a.mean)*(target-center)/(next-center)
+		}
+		weightBefore += a.weight
+	}
+	return d.centroids[len(d.centroids)-1].mean
+}
+
+// DiscreteQuantile returns an estimate of the first value whose position
+// among the added values is at least the q-th fraction of their count, like
+// PostgreSQL's percentile_disc. It returns NaN if the digest is empty.
+func (d *Digest) DiscreteQuantile(q float64) float64 {
+	if len(d.centroids) == 0 {
+		return math.NaN()
+	}
+	d.sort()
+	target := q * d.count
+	weight := 0.0
+	for _, c := range d.centroids {
+		weight += c.weight
+		if weight >= target {
+			return c.mean
+		}
+	}
+	return d.centroids[len(d.centroids)-1].mean
+}
+
+// Encode appends the encoding of the digest to appendTo.
+func (d *Digest) Encode(appendTo []byte) []byte {
+	appendTo = append(appendTo, encodingVersion)
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(d.centroids)))
+	appendTo = append(appendTo, buf[:n]...)
+	for _, c := range d.centroids {
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(c.mean))
+		appendTo = append(appendTo, buf[:8]...)
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(c.weight))
+		appendTo = append(appendTo, buf[:8]...)
+	}
+	return appendTo
+}
+
+// Decode merges the digest with the given encoding, as produced by Encode,
+// into d.
+func (d *Digest) Decode(data []byte) error {
+	if len(data) == 0 || data[0] != encodingVersion {
+		return errors.New("invalid t-digest encoding")
+	}
+	data = data[1:]
+	num, n := binary.Uvarint(data)
+	if n <= 0 {
+		return errors.New("invalid t-digest encoding")
+	}
+	data = data[n:]
+	if uint64(len(data)) != num*CentroidSize {
+		return errors.Errorf("invalid t-digest encoding length for %d centroids", num)
+	}
+	for i := uint64(0); i < num; i++ {
+		c := centroid{
+			mean:   math.Float64frombits(binary.LittleEndian.Uint64(data)),
+			weight: math.Float64frombits(binary.LittleEndian.Uint64(data[8:])),
+		}
+		if !(c.weight > 0) {
+			return errors.Errorf("invalid t-digest centroid weight %f", c.weight)
+		}
+		d.add(c)
+		data = data[CentroidSize:]
+	}
+	return nil
+}
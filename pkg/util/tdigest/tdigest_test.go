@@ -0,0 +1,93 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package tdigest
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestDigestExact(t *testing.T) {
+	var d Digest
+	for _, x := range []float64{4, 1, 3, 2} {
+		d.Add(x)
+	}
+	testCases := []struct {
+		q          float64
+		cont, disc float64
+	}{
+		{0, 1, 1},
+		{0.25, 1.75, 1},
+		{0.5, 2.5, 2},
+		{0.6, 2.8, 3},
+		{1, 4, 4},
+	}
+	for _, tc := range testCases {
+		if r := d.Quantile(tc.q); r != tc.cont {
+			t.Errorf("%f: expected continuous quantile %f, got %f", tc.q, tc.cont, r)
+		}
+		if r := d.DiscreteQuantile(tc.q); r != tc.disc {
+			t.Errorf("%f: expected discrete quantile %f, got %f", tc.q, tc.disc, r)
+		}
+	}
+
+	var empty Digest
+	if r := empty.Quantile(0.5); !math.IsNaN(r) {
+		t.Errorf("expected NaN for empty digest, got %f", r)
+	}
+}
+
+func TestDigestAccuracy(t *testing.T) {
+	const n = 100000
+	rng := rand.New(rand.NewSource(0))
+
+	// Build the digest from several partial digests, round-tripped through
+	// their encodings.
+	var d Digest
+	parts := make([]Digest, 7)
+	for i := 0; i < n; i++ {
+		parts[rng.Intn(len(parts))].Add(float64(rng.Intn(n)))
+	}
+	for i := range parts {
+		if err := d.Decode(parts[i].Encode(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.Count() != n {
+		t.Fatalf("expected count %d, got %f", n, d.Count())
+	}
+	if c := d.NumCentroids(); c > maxCentroids {
+		t.Fatalf("expected at most %d centroids, got %d", maxCentroids, c)
+	}
+
+	for _, q := range []float64{0.001, 0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+		t.Run(fmt.Sprint(q), func(t *testing.T) {
+			// The values are uniformly distributed, so the q-th quantile is about
+			// q*n.
+			if r := d.Quantile(q); math.Abs(r-q*n) > 0.01*n {
+				t.Errorf("expected continuous quantile close to %f, got %f", q*n, r)
+			}
+			if r := d.DiscreteQuantile(q); math.Abs(r-q*n) > 0.01*n {
+				t.Errorf("expected discrete quantile close to %f, got %f", q*n, r)
+			}
+		})
+	}
+
+	if err := d.Decode([]byte{encodingVersion, 1, 0}); err == nil {
+		t.Fatal("expected error decoding invalid digest")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package tracing
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// activeSpans keeps track of the spans of a Tracer which haven't finished
+// yet. Noop spans aren't tracked.
+type activeSpans struct {
+	syncutil.Mutex
+	m map[*span]struct{}
+}
+
+func (as *activeSpans) add(s *span) {
+	as.Lock()
+	if as.m == nil {
+		as.m = make(map[*span]struct{})
+	}
+	as.m[s] = struct{}{}
+	as.Unlock()
+}
+
+func (as *activeSpans) remove(s *span) {
+	as.Lock()
+	delete(as.m, s)
+	as.Unlock()
+}
+
+// ActiveSpans returns the spans created by the tracer which haven't finished
+// yet, oldest first. Their durations are zero and they contain no logs.
+//
+// Only real spans are tracked: when tracing is disabled (see Reconfigure),
+// only the spans which are recorded or that were created with the Recordable
+// option are returned.
+func (t *Tracer) ActiveSpans() []RecordedSpan {
+	t.activeSpans.Lock()
+	spans := make([]*span, 0, len(t.activeSpans.m))
+	for s := range t.activeSpans.m {
+		spans = append(spans, s)
+	}
+	t.activeSpans.Unlock()
+
+	result := make([]RecordedSpan, len(spans))
+	for i, s := range spans {
+		rs := &result[i]
+		rs.TraceID = s.TraceID
+		rs.SpanID = s.SpanID
+		rs.ParentSpanID = s.parentSpanID
+		rs.Operation = s.operation
+		rs.StartTime = s.startTime
+		s.mu.Lock()
+		if len(s.mu.tags) > 0 {
+			rs.Tags = make(map[string]string, len(s.mu.tags))
+			for k, v := range s.mu.tags {
+				rs.Tags[k] = fmt.Sprint(v)
+			}
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartTime.Before(result[j].StartTime)
+	})
+	return result
+}
@@ -0,0 +1,168 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package tracing
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// traceRegistrySize is the number of sampled traces, and separately of slow
+// traces, kept by a TraceRegistry.
+const traceRegistrySize = 100
+
+// RegisteredTrace is an operation kept in a TraceRegistry.
+type RegisteredTrace struct {
+	Operation string
+	Start     time.Time
+	Duration  time.Duration
+	// Summary describes the operation, e.g. the requests of a batch.
+	Summary string
+	// Slow is set if the operation took longer than its slow threshold.
+	Slow bool
+	// Spans is the recording of the operation. It is only set if the
+	// operation was sampled; slow operations which weren't are registered
+	// without a recording.
+	Spans []RecordedSpan
+}
+
+// traceRing holds the most recent traces added to it.
+type traceRing struct {
+	traces []RegisteredTrace
+	next   int
+}
+
+func (r *traceRing) add(rt RegisteredTrace) {
+	if len(r.traces) < traceRegistrySize {
+		r.traces = append(r.traces, rt)
+		return
+	}
+	r.traces[r.next] = rt
+	r.next = (r.next + 1) % traceRegistrySize
+}
+
+// TraceRegistry keeps a bounded number of traces of recent operations in
+// memory: those which were sampled and, separately so that they aren't
+// evicted by sampled ones, those which were slow.
+type TraceRegistry struct {
+	mu struct {
+		syncutil.Mutex
+		sampled traceRing
+		slow    traceRing
+	}
+}
+
+func (r *TraceRegistry) add(rt RegisteredTrace) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rt.Slow {
+		r.mu.slow.add(rt)
+	} else {
+		r.mu.sampled.add(rt)
+	}
+}
+
+// Traces returns the traces in the registry, most recent first.
+func (r *TraceRegistry) Traces() []RegisteredTrace {
+	r.mu.Lock()
+	traces := make([]RegisteredTrace, 0, len(r.mu.sampled.traces)+len(r.mu.slow.traces))
+	traces = append(traces, r.mu.sampled.traces...)
+	traces = append(traces, r.mu.slow.traces...)
+	r.mu.Unlock()
+	sort.Slice(traces, func(i, j int) bool {
+		return traces[i].Start.After(traces[j].Start)
+	})
+	return traces
+}
+
+// Registry returns the registry into which the tracer keeps the traces of
+// the operations started with StartSampledSpan.
+func (t *Tracer) Registry() *TraceRegistry {
+	return &t.registry
+}
+
+// SetSampleRate sets the fraction of the operations started with
+// StartSampledSpan which are recorded.
+func (t *Tracer) SetSampleRate(rate float64) {
+	atomic.StoreUint64(&t._sampleRate, math.Float64bits(rate))
+}
+
+func (t *Tracer) shouldSample() bool {
+	rate := math.Float64frombits(atomic.LoadUint64(&t._sampleRate))
+	return rate > 0 && rand.Float64() < rate
+}
+
+// StartSampledSpan is used for operations which are traced into the tracer's
+// registry, so that their traces are available without having to reproduce
+// them with tracing enabled. The operation is recorded if it is sampled,
+// according to the tracer's sample rate, in which case the returned context
+// contains the recording span. The operation is registered if it was
+// sampled or if it took longer than slowThreshold.
+//
+// Operations which are already part of a recording are neither sampled nor
+// registered.
+//
+// The returned closure must be called once the operation has completed. Its
+// argument is only called if the operation is registered, to describe it.
+func (t *Tracer) StartSampledSpan(
+	ctx context.Context, opName string, slowThreshold time.Duration,
+) (context.Context, func(summarize func() string)) {
+	parent := opentracing.SpanFromContext(ctx)
+	if parent != nil && IsRecording(parent) {
+		return ctx, func(func() string) {}
+	}
+
+	start := time.Now()
+	var sp opentracing.Span
+	if t.shouldSample() {
+		if parent != nil && IsRecordable(parent) {
+			sp = t.StartSpan(opName, opentracing.ChildOf(parent.Context()), Recordable)
+		} else {
+			sp = t.StartSpan(opName, Recordable)
+		}
+		// Snowball recording collects the spans of the remote nodes too.
+		StartRecording(sp, SnowballRecording)
+		ctx = opentracing.ContextWithSpan(ctx, sp)
+	}
+
+	return ctx, func(summarize func() string) {
+		duration := time.Since(start)
+		slow := duration >= slowThreshold
+		if sp == nil && !slow {
+			return
+		}
+		rt := RegisteredTrace{
+			Operation: opName,
+			Start:     start,
+			Duration:  duration,
+			Summary:   summarize(),
+			Slow:      slow,
+		}
+		if sp != nil {
+			sp.Finish()
+			rt.Spans = GetRecording(sp)
+			StopRecording(sp)
+		}
+		t.registry.add(rt)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package tracing
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+func TestStartSampledSpan(t *testing.T) {
+	tr := NewTracer()
+	summary := func() string { return "summary" }
+
+	// Operations which are neither sampled nor slow aren't registered.
+	ctx, finish := tr.StartSampledSpan(context.Background(), "unsampled", time.Hour)
+	if sp := opentracing.SpanFromContext(ctx); sp != nil {
+		t.Fatalf("expected no span for an unsampled operation, got %v", sp)
+	}
+	finish(summary)
+	if traces := tr.Registry().Traces(); len(traces) != 0 {
+		t.Fatalf("expected no traces, got %+v", traces)
+	}
+
+	// Slow operations are registered, without a recording unless sampled.
+	_, finish = tr.StartSampledSpan(context.Background(), "slow", 0)
+	finish(summary)
+
+	tr.SetSampleRate(1)
+	ctx, finish = tr.StartSampledSpan(context.Background(), "sampled", time.Hour)
+	sp := opentracing.SpanFromContext(ctx)
+	if sp == nil || !IsRecording(sp) {
+		t.Fatal("expected a recording span for a sampled operation")
+	}
+	sp.LogKV("event", "hello")
+
+	// Operations which are part of a recording aren't registered on their own.
+	_, nestedFinish := tr.StartSampledSpan(ctx, "nested", 0)
+	nestedFinish(summary)
+	finish(summary)
+
+	traces := tr.Registry().Traces()
+	if len(traces) != 2 {
+		t.Fatalf("expected 2 traces, got %+v", traces)
+	}
+	if rt := traces[0]; rt.Operation != "sampled" || rt.Slow || rt.Summary != "summary" {
+		t.Errorf("unexpected sampled trace %+v", rt)
+	}
+	if err := TestingCheckRecordedSpans(traces[0].Spans, `
+		span sampled:
+			tags: sb=1
+			event: hello
+	`); err != nil {
+		t.Error(err)
+	}
+	if rt := traces[1]; rt.Operation != "slow" || !rt.Slow || rt.Spans != nil {
+		t.Errorf("unexpected slow trace %+v", rt)
+	}
+}
+
+func TestTraceRegistryBounded(t *testing.T) {
+	var r TraceRegistry
+	start := time.Unix(0, 0)
+	const n = 4 * traceRegistrySize
+	for i := 0; i < n; i++ {
+		r.add(RegisteredTrace{Start: start.Add(time.Duration(i)), Slow: i%2 == 0})
+	}
+	traces := r.Traces()
+	if len(traces) != 2*traceRegistrySize {
+		t.Fatalf("expected %d traces, got %d", 2*traceRegistrySize, len(traces))
+	}
+	if !traces[0].Start.Equal(start.Add(n - 1)) {
+		t.Fatalf("expected the most recent trace first, got %s", traces[0].Start)
+	}
+
+	// Sampled traces don't evict slow ones.
+	for i := 0; i < traceRegistrySize; i++ {
+		r.add(RegisteredTrace{Start: start.Add(time.Duration(n + i))})
+	}
+	var slow int
+	for _, rt := range r.Traces() {
+		if rt.Slow {
+			slow++
+		}
+	}
+	if slow != traceRegistrySize {
+		t.Fatalf("expected %d slow traces, got %d", traceRegistrySize, slow)
+	}
+}
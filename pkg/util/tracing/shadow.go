@@ -50,12 +50,15 @@ func (lightStepManager) Close(tr opentracing.Tracer) {
 	_ = lightstep.CloseTracer(tr)
 }
 
+// zipkinManager manages a tracer exporting to a Zipkin collector, or to a
+// Jaeger collector through its Zipkin-compatible endpoint.
 type zipkinManager struct {
+	name      string
 	collector zipkin.Collector
 }
 
-func (*zipkinManager) Name() string {
-	return "zipkin"
+func (m *zipkinManager) Name() string {
+	return m.name
 }
 
 func (m *zipkinManager) Close(tr opentracing.Tracer) {
@@ -115,14 +118,21 @@ func createLightStepTracer(token string) (shadowTracerManager, opentracing.Trace
 	})
 }
 
-func createZipkinTracer(collectorAddr string) (shadowTracerManager, opentracing.Tracer) {
+// createZipkinTracer creates a tracer exporting to the Zipkin-compatible
+// collector at the given address. The name distinguishes Zipkin from Jaeger
+// collectors. Only the given fraction of the traces is exported; the
+// decision is taken from the trace ID, so that all the nodes export the same
+// traces.
+func createZipkinTracer(
+	name string, collectorAddr string, sampleRate float64,
+) (shadowTracerManager, opentracing.Tracer) {
 	// Create our HTTP collector.
 	collector, err := zipkin.NewHTTPCollector(
 		fmt.Sprintf("http://%s/api/v1/spans", collectorAddr),
 		zipkin.HTTPLogger(zipkin.LoggerFunc(func(keyvals ...interface{}) error {
 			// These logs are from the collector (e.g. errors sending data, dropped
 			// traces). We can't use `log` from this package so print them to stderr.
-			toPrint := append([]interface{}{"Zipkin collector"}, keyvals...)
+			toPrint := append([]interface{}{name + " collector"}, keyvals...)
 			fmt.Fprintln(os.Stderr, toPrint)
 			return nil
 		})),
@@ -135,9 +145,11 @@ func createZipkinTracer(collectorAddr string) (shadowTracerManager, opentracing.
 	recorder := zipkin.NewRecorder(collector, false /* !debug */, "0.0.0.0:0", "cockroach")
 
 	// Create our tracer.
-	zipkinTr, err := zipkin.NewTracer(recorder)
+	zipkinTr, err := zipkin.NewTracer(
+		recorder, zipkin.WithSampler(zipkin.NewBoundarySampler(sampleRate, 0 /* salt */)),
+	)
 	if err != nil {
 		panic(err)
 	}
-	return &zipkinManager{collector: collector}, zipkinTr
+	return &zipkinManager{name: name, collector: collector}, zipkinTr
 }
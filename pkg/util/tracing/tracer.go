@@ -88,6 +88,15 @@ type Tracer struct {
 
 	// Pointer to shadowTracer, if using one.
 	shadowTracer unsafe.Pointer
+
+	// The fraction of the operations started with StartSampledSpan which are
+	// recorded, as float64 bits. Accessed via t.shouldSample().
+	_sampleRate uint64 // updated atomically
+
+	// registry keeps the traces of sampled and slow operations.
+	registry TraceRegistry
+
+	activeSpans activeSpans
 }
 
 var _ opentracing.Tracer = &Tracer{}
@@ -107,16 +116,20 @@ type ReconfigurationOptions interface {
 	EnableNetTrace() bool
 	LightstepToken() string
 	ZipkinAddr() string
+	JaegerAddr() string
+	ZipkinSampleRate() float64
 }
 
 // Reconfigure reconfigures the tracer with the given debug/requests switch,
-// lightstep token, and zipkin collector address. Empty values disable the
-// respective functionality.
+// lightstep token, and zipkin or jaeger collector address and sample rate.
+// Empty values disable the respective functionality.
 func (t *Tracer) Reconfigure(o ReconfigurationOptions) {
 	if lsToken := o.LightstepToken(); lsToken != "" {
 		t.setShadowTracer(createLightStepTracer(lsToken))
 	} else if zipkinAddr := o.ZipkinAddr(); zipkinAddr != "" {
-		t.setShadowTracer(createZipkinTracer(zipkinAddr))
+		t.setShadowTracer(createZipkinTracer("zipkin", zipkinAddr, o.ZipkinSampleRate()))
+	} else if jaegerAddr := o.JaegerAddr(); jaegerAddr != "" {
+		t.setShadowTracer(createZipkinTracer("jaeger", jaegerAddr, o.ZipkinSampleRate()))
 	} else {
 		t.setShadowTracer(nil, nil)
 	}
@@ -306,6 +319,7 @@ func (t *Tracer) StartSpan(
 		s.SetTag(k, v)
 	}
 
+	t.activeSpans.add(s)
 	return s
 }
 
@@ -377,6 +391,7 @@ func StartChildSpan(
 	}
 
 	pSpan.mu.Unlock()
+	tr.activeSpans.add(s)
 	return s
 }
 
@@ -517,6 +532,32 @@ func (t *Tracer) Extract(format interface{}, carrier interface{}) (opentracing.S
 	return &sc, nil
 }
 
+// InjectSpanContext returns the context of the given span injected in the
+// TextMap format, for requests which carry it to other nodes themselves
+// instead of relying on the gRPC interceptors (e.g. streaming RPCs). It
+// returns nil if the span is nil or a black hole span.
+func InjectSpanContext(sp opentracing.Span) (map[string]string, error) {
+	if sp == nil || IsBlackHoleSpan(sp) {
+		return nil, nil
+	}
+	carrier := make(opentracing.TextMapCarrier)
+	if err := sp.Tracer().Inject(sp.Context(), opentracing.TextMap, carrier); err != nil {
+		return nil, err
+	}
+	return carrier, nil
+}
+
+// ExtractSpanContext extracts a span context injected by InjectSpanContext.
+// It returns nil if the carrier is empty.
+func ExtractSpanContext(
+	tr opentracing.Tracer, carrier map[string]string,
+) (opentracing.SpanContext, error) {
+	if len(carrier) == 0 {
+		return nil, nil
+	}
+	return tr.Extract(opentracing.TextMap, opentracing.TextMapCarrier(carrier))
+}
+
 // FinishSpan closes the given span (if not nil). It is a convenience wrapper
 // for span.Finish() which tolerates nil spans.
 func FinishSpan(span opentracing.Span) {
@@ -20,6 +20,8 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
 	"golang.org/x/net/trace"
 
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
@@ -101,9 +103,9 @@ type span struct {
 		recordingGroup *spanGroup
 		recordingType  RecordingType
 		recordedLogs   []opentracing.LogRecord
-		// tags are only set when recording.
-		// TODO(radu): perhaps we want a recording to capture all the tags (even
-		// those that were set before recording started)?
+		// tags are kept even when not recording, so that the recording of a
+		// span captures the tags set before recording started, and so that
+		// they are part of the span's description in Tracer.ActiveSpans.
 		tags opentracing.Tags
 
 		// The span's associated baggage.
@@ -182,6 +184,41 @@ func IsRecordable(os opentracing.Span) bool {
 	return isCockroachSpan
 }
 
+// structuredPayload wraps the payload of a record logged with LogStructured.
+// It is formatted as the payload's text representation for the consumers of
+// the span's events which don't know about structured payloads.
+type structuredPayload struct {
+	proto.Message
+}
+
+// LogStructured logs the given payload to the span, as an event whose text
+// is the payload's text representation. The payload itself is part of the
+// recording of the span (see RecordedSpan_LogRecord.Structured), which lets
+// tools process recordings without parsing the text of their events.
+func LogStructured(os opentracing.Span, payload proto.Message) {
+	os.LogFields(otlog.Object("event", structuredPayload{payload}))
+}
+
+// StructuredPayload returns the payload of a record logged with
+// LogStructured, or nil if the record isn't structured. The type of the
+// payload must be linked into the binary.
+func (r *RecordedSpan_LogRecord) StructuredPayload() (proto.Message, error) {
+	if r.Structured == nil {
+		return nil, nil
+	}
+	var payload types.DynamicAny
+	if err := types.UnmarshalAny(r.Structured, &payload); err != nil {
+		return nil, err
+	}
+	return payload.Message, nil
+}
+
+// IsRecording returns true if the span is recording its events.
+func IsRecording(os opentracing.Span) bool {
+	s, ok := os.(*span)
+	return ok && s.isRecording()
+}
+
 // GetRecording retrieves the current recording, if the span has
 // recording enabled. This can be called while spans that are part of the
 // record are still open; it can run concurrently with operations on those
@@ -255,6 +292,7 @@ func (s *span) FinishWithOptions(opts opentracing.FinishOptions) {
 	s.mu.Lock()
 	s.mu.duration = finishTime.Sub(s.startTime)
 	s.mu.Unlock()
+	s.tracer.activeSpans.remove(s)
 	if s.shadowTr != nil {
 		s.shadowSpan.Finish()
 	}
@@ -312,17 +350,15 @@ func (s *span) setTagInner(key string, value interface{}, locked bool) opentraci
 	if s.netTr != nil {
 		s.netTr.LazyPrintf("%s:%v", key, value)
 	}
-	if s.isRecording() {
-		if !locked {
-			s.mu.Lock()
-		}
-		if s.mu.tags == nil {
-			s.mu.tags = make(opentracing.Tags)
-		}
-		s.mu.tags[key] = value
-		if !locked {
-			s.mu.Unlock()
-		}
+	if !locked {
+		s.mu.Lock()
+	}
+	if s.mu.tags == nil {
+		s.mu.tags = make(opentracing.Tags)
+	}
+	s.mu.tags[key] = value
+	if !locked {
+		s.mu.Unlock()
 	}
 	return s
 }
@@ -493,6 +529,14 @@ func (ss *spanGroup) getSpans() []RecordedSpan {
 					Key:   f.Key(),
 					Value: fmt.Sprint(f.Value()),
 				}
+				if p, ok := f.Value().(structuredPayload); ok {
+					any, err := types.MarshalAny(p.Message)
+					if err != nil {
+						rs.Logs[i].Fields[j].Value = fmt.Sprintf("error marshaling %T: %s", p.Message, err)
+						continue
+					}
+					rs.Logs[i].Structured = any
+				}
 			}
 		}
 		s.mu.Unlock()
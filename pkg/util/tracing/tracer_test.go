@@ -17,8 +17,10 @@ package tracing
 import (
 	"testing"
 
+	"github.com/gogo/protobuf/proto"
 	lightstep "github.com/lightstep/lightstep-tracer-go"
 	opentracing "github.com/opentracing/opentracing-go"
+	zipkin "github.com/openzipkin/zipkin-go-opentracing"
 )
 
 func TestTracerRecording(t *testing.T) {
@@ -162,6 +164,41 @@ func TestStartChildSpan(t *testing.T) {
 	}
 }
 
+func TestActiveSpans(t *testing.T) {
+	tr := NewTracer()
+	sp1 := tr.StartSpan("parent", Recordable, opentracing.Tag{Key: "node", Value: 1})
+	// Children of spans which aren't recording are noop spans when tracing is
+	// disabled, and aren't tracked.
+	if sp := StartChildSpan("noop", sp1, false /*!separateRecording*/); !IsBlackHoleSpan(sp) {
+		t.Fatalf("expected a black hole span, got %v", sp)
+	}
+	StartRecording(sp1, SingleNodeRecording)
+	sp2 := StartChildSpan("child", sp1, false /*!separateRecording*/)
+	sp2.SetTag("range", 2)
+
+	active := tr.ActiveSpans()
+	if len(active) != 2 {
+		t.Fatalf("expected 2 active spans, got %+v", active)
+	}
+	parent, child := active[0], active[1]
+	if parent.Operation != "parent" || parent.ParentSpanID != 0 || parent.Tags["node"] != "1" {
+		t.Errorf("unexpected parent span %+v", parent)
+	}
+	if child.Operation != "child" || child.ParentSpanID != parent.SpanID ||
+		child.TraceID != parent.TraceID || child.Tags["range"] != "2" {
+		t.Errorf("unexpected child span %+v", child)
+	}
+
+	sp2.Finish()
+	if active := tr.ActiveSpans(); len(active) != 1 || active[0].Operation != "parent" {
+		t.Fatalf("expected only the parent span to be active, got %+v", active)
+	}
+	sp1.Finish()
+	if active := tr.ActiveSpans(); len(active) != 0 {
+		t.Fatalf("expected no active spans, got %+v", active)
+	}
+}
+
 func TestTracerInjectExtract(t *testing.T) {
 	tr := NewTracer()
 	tr2 := NewTracer()
@@ -251,6 +288,46 @@ func TestTracerInjectExtract(t *testing.T) {
 	}
 }
 
+func TestInjectExtractSpanContext(t *testing.T) {
+	tr := NewTracer()
+	tr2 := NewTracer()
+
+	// Noop spans aren't propagated.
+	carrier, err := InjectSpanContext(tr.StartSpan("noop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if carrier != nil {
+		t.Fatalf("expected no carrier for a noop span, got %+v", carrier)
+	}
+	if sc, err := ExtractSpanContext(tr2, carrier); err != nil || sc != nil {
+		t.Fatalf("expected no span context, got %v (err: %v)", sc, err)
+	}
+
+	s1 := tr.StartSpan("a", Recordable)
+	StartRecording(s1, SnowballRecording)
+	carrier, err = InjectSpanContext(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ExtractSpanContext(tr2, carrier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := tr2.StartSpan("remote op", opentracing.FollowsFrom(sc))
+	s2.Finish()
+	rec := GetRecording(s2)
+	if len(rec) != 1 || rec[0].ParentSpanID != s1.Context().(*spanContext).SpanID {
+		t.Fatalf("expected a child of the injected span, got %+v", rec)
+	}
+	if err := TestingCheckRecordedSpans(rec, `
+		span remote op:
+			tags: sb=1
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestLightstepContext(t *testing.T) {
 	tr := NewTracer()
 	lsTr := lightstep.NewTracer(lightstep.Options{
@@ -297,3 +374,82 @@ func TestLightstepContext(t *testing.T) {
 		}
 	}
 }
+
+type testReconfigurationOptions struct {
+	zipkinAddr, jaegerAddr string
+	zipkinSampleRate       float64
+}
+
+func (testReconfigurationOptions) EnableNetTrace() bool        { return false }
+func (testReconfigurationOptions) LightstepToken() string      { return "" }
+func (o testReconfigurationOptions) ZipkinAddr() string        { return o.zipkinAddr }
+func (o testReconfigurationOptions) JaegerAddr() string        { return o.jaegerAddr }
+func (o testReconfigurationOptions) ZipkinSampleRate() float64 { return o.zipkinSampleRate }
+
+func TestReconfigureCollectors(t *testing.T) {
+	tr := NewTracer()
+	defer tr.Close()
+
+	testCases := []struct {
+		opts    testReconfigurationOptions
+		typ     string
+		sampled bool
+	}{
+		{testReconfigurationOptions{}, "", false},
+		{testReconfigurationOptions{zipkinAddr: "127.0.0.1:65535", zipkinSampleRate: 1}, "zipkin", true},
+		{testReconfigurationOptions{jaegerAddr: "127.0.0.1:65535", zipkinSampleRate: 1}, "jaeger", true},
+		{testReconfigurationOptions{
+			zipkinAddr: "127.0.0.1:65535", jaegerAddr: "127.0.0.1:65534", zipkinSampleRate: 1,
+		}, "zipkin", true},
+		{testReconfigurationOptions{jaegerAddr: "127.0.0.1:65535"}, "jaeger", false},
+	}
+	for i, tc := range testCases {
+		tr.Reconfigure(tc.opts)
+		shadowTr := tr.getShadowTracer()
+		if tc.typ == "" {
+			if shadowTr != nil {
+				t.Errorf("%d: expected no shadow tracer, got %s", i, shadowTr.Typ())
+			}
+			continue
+		}
+		if shadowTr == nil || shadowTr.Typ() != tc.typ {
+			t.Errorf("%d: expected a %s shadow tracer, got %v", i, tc.typ, shadowTr)
+			continue
+		}
+		sp := tr.StartSpan("test")
+		if sampled := sp.(*span).shadowSpan.Context().(zipkin.SpanContext).Sampled; sampled != tc.sampled {
+			t.Errorf("%d: expected sampled=%t, got %t", i, tc.sampled, sampled)
+		}
+		sp.Finish()
+	}
+}
+
+func TestLogStructured(t *testing.T) {
+	tr := NewTracer()
+	sp := tr.StartSpan("a", Recordable)
+	StartRecording(sp, SingleNodeRecording)
+	payload := &RecordedSpan{Operation: "payload"}
+	LogStructured(sp, payload)
+	sp.LogKV("event", "unstructured")
+	sp.Finish()
+
+	rec := GetRecording(sp)
+	if err := TestingCheckRecordedSpans(rec, `
+		span a:
+			event: `+payload.String()+`
+			event: unstructured
+	`); err != nil {
+		t.Fatal(err)
+	}
+	logs := rec[0].Logs
+	decoded, err := logs[0].StructuredPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(decoded, payload) {
+		t.Errorf("expected payload %s, got %s", payload, decoded)
+	}
+	if decoded, err := logs[1].StructuredPayload(); err != nil || decoded != nil {
+		t.Errorf("expected no payload for an unstructured record, got %v (%v)", decoded, err)
+	}
+}